@@ -0,0 +1,255 @@
+package main
+
+// accounting module provides compute accounting of clients
+//
+// Groups sharing the server can be charged (or shown back) for compute time
+// their requests consume. Go and TF library do not report CPU time of
+// individual requests, therefore the server samples CPU time of the process
+// (and GPU time when nvidia-smi is available) every "accountingInterval"
+// seconds (default 1) and apportions it among clients proportionally to
+// time their requests were in flight within the interval. Compute time of
+// intervals without requests, e.g. background jobs, is accounted to
+// "_server". Clients are identified by DN of client certificate (or user of
+// dashboard session), anonymous requests are accounted to "anonymous".
+// The report is provided by /admin/accounting endpoint and in Prometheus
+// format by /metrics, counters start with the server.
+
+import (
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// name of the client of compute time outside of requests
+const serverClient = "_server"
+
+// ClientAccount represents compute accounting of the client
+type ClientAccount struct {
+	Client      string  `json:"client"`               // client identity
+	Requests    int64   `json:"requests"`             // number of requests
+	WallSeconds float64 `json:"wallSeconds"`          // time requests were in flight
+	CPUSeconds  float64 `json:"cpuSeconds"`           // apportioned CPU time
+	GPUSeconds  float64 `json:"gpuSeconds,omitempty"` // apportioned GPU time
+}
+
+// AccountingReport represents compute accounting of all clients
+type AccountingReport struct {
+	Since      string          `json:"since"`      // start of accounting
+	CPUSeconds float64         `json:"cpuSeconds"` // total CPU time of the server
+	GPUSeconds float64         `json:"gpuSeconds"` // total GPU time of the server
+	GPU        bool            `json:"gpu"`        // GPU time is available
+	Clients    []ClientAccount `json:"clients"`    // accounts of clients
+}
+
+// Accounting keeps track of compute time of clients
+type Accounting struct {
+	Since    time.Time                 // start of accounting
+	Accounts map[string]*ClientAccount // accounts of clients
+	active   map[*accountedRequest]bool
+	busy     map[string]float64 // in flight time of clients in current interval
+	last     time.Time          // time of the last sample
+	cpu, gpu float64            // totals of the last sample
+	hasGPU   bool
+	mutex    sync.Mutex
+}
+
+// accountedRequest represents request in flight
+type accountedRequest struct {
+	client string
+	start  time.Time
+}
+
+// global accounting of compute time
+var _accounting = newAccounting(time.Now())
+
+// helper function to create new accounting
+func newAccounting(now time.Time) *Accounting {
+	return &Accounting{
+		Since:    now,
+		Accounts: make(map[string]*ClientAccount),
+		active:   make(map[*accountedRequest]bool),
+		busy:     make(map[string]float64),
+		last:     now,
+	}
+}
+
+// helper function to return account of the client, it should be called
+// with acquired lock
+func (a *Accounting) account(client string) *ClientAccount {
+	acc, ok := a.Accounts[client]
+	if !ok {
+		acc = &ClientAccount{Client: client}
+		a.Accounts[client] = acc
+	}
+	return acc
+}
+
+// begin registers request of the client
+func (a *Accounting) begin(client string, now time.Time) *accountedRequest {
+	req := &accountedRequest{client: client, start: now}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.active[req] = true
+	a.account(client).Requests++
+	return req
+}
+
+// end accounts in flight time of finished request
+func (a *Accounting) end(req *accountedRequest, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.active, req)
+	a.account(req.client).WallSeconds += now.Sub(req.start).Seconds()
+	start := req.start
+	if start.Before(a.last) {
+		start = a.last
+	}
+	if d := now.Sub(start).Seconds(); d > 0 {
+		a.busy[req.client] += d
+	}
+}
+
+// sample apportions compute time consumed since the last sample, cpu and
+// gpu are total compute times of the server
+func (a *Accounting) sample(now time.Time, cpu, gpu float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for req := range a.active {
+		start := req.start
+		if start.Before(a.last) {
+			start = a.last
+		}
+		if d := now.Sub(start).Seconds(); d > 0 {
+			a.busy[req.client] += d
+		}
+	}
+	dcpu, dgpu := cpu-a.cpu, gpu-a.gpu
+	if dcpu < 0 {
+		dcpu = 0
+	}
+	if dgpu < 0 {
+		dgpu = 0
+	}
+	var total float64
+	for _, d := range a.busy {
+		total += d
+	}
+	if total == 0 {
+		acc := a.account(serverClient)
+		acc.CPUSeconds += dcpu
+		acc.GPUSeconds += dgpu
+	}
+	for client, d := range a.busy {
+		acc := a.account(client)
+		acc.CPUSeconds += dcpu * d / total
+		acc.GPUSeconds += dgpu * d / total
+	}
+	a.busy = make(map[string]float64)
+	a.last, a.cpu, a.gpu = now, cpu, gpu
+}
+
+// report returns accounting report sorted by CPU time
+func (a *Accounting) report() AccountingReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	rep := AccountingReport{
+		Since:   a.Since.Format(time.RFC3339),
+		GPU:     a.hasGPU,
+		Clients: []ClientAccount{},
+	}
+	for _, acc := range a.Accounts {
+		rep.Clients = append(rep.Clients, *acc)
+		rep.CPUSeconds += acc.CPUSeconds
+		rep.GPUSeconds += acc.GPUSeconds
+	}
+	sort.Slice(rep.Clients, func(i, j int) bool {
+		if rep.Clients[i].CPUSeconds != rep.Clients[j].CPUSeconds {
+			return rep.Clients[i].CPUSeconds > rep.Clients[j].CPUSeconds
+		}
+		return rep.Clients[i].Client < rep.Clients[j].Client
+	})
+	return rep
+}
+
+// helper function to return CPU time of the process in seconds
+func processCPUSeconds() float64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	cpu := time.Duration(ru.Utime.Nano()) + time.Duration(ru.Stime.Nano())
+	return cpu.Seconds()
+}
+
+// helper function to return utilization of GPUs in percents (sum over all
+// devices), it returns false if GPU utilization is not available
+func gpuUtilization() (float64, bool) {
+	out, err := exec.Command("nvidia-smi", "--query-gpu=utilization.gpu", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return 0, false
+	}
+	var total float64
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+		if err != nil {
+			return 0, false
+		}
+		total += v
+	}
+	return total, true
+}
+
+// accountingSampler periodically apportions compute time among clients
+func accountingSampler(interval time.Duration) {
+	_, hasGPU := gpuUtilization()
+	_accounting.mutex.Lock()
+	_accounting.hasGPU = hasGPU
+	_accounting.cpu = processCPUSeconds()
+	_accounting.mutex.Unlock()
+	var gpu float64
+	last := time.Now()
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		if hasGPU {
+			// GPU time is integrated from utilization samples
+			if util, ok := gpuUtilization(); ok {
+				gpu += util / 100 * now.Sub(last).Seconds()
+			}
+		}
+		last = now
+		_accounting.sample(now, processCPUSeconds(), gpu)
+	}
+}
+
+// helper function to return accounting interval
+func accountingInterval() time.Duration {
+	if _config.AccountingInterval > 0 {
+		return time.Duration(_config.AccountingInterval) * time.Second
+	}
+	return time.Second
+}
+
+// helper function to identify client of the request for accounting
+func accountingClient(r *http.Request) string {
+	return requestIdentity(r).User
+}
+
+// accountingMiddleware accounts time requests are in flight to their clients
+func accountingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := _accounting.begin(accountingClient(r), time.Now())
+		defer func() { _accounting.end(req, time.Now()) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AccountingHandler provides compute accounting report of clients
+func AccountingHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, _accounting.report())
+}
@@ -0,0 +1,67 @@
+package main
+
+// tests of compute accounting, they do not require TF C library
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAccountingSample checks apportioning of compute time among clients
+func TestAccountingSample(t *testing.T) {
+	t0 := time.Now()
+	at := func(s float64) time.Time { return t0.Add(time.Duration(s * float64(time.Second))) }
+	a := newAccounting(t0)
+	ra := a.begin("A", t0)
+	rb := a.begin("B", t0)
+	a.end(ra, at(1))
+	a.sample(at(2), 3, 0)
+	// B is still in flight in the next interval
+	a.sample(at(3), 4, 0)
+	a.end(rb, at(3.5))
+	a.sample(at(4), 5, 0)
+	// interval without requests is accounted to the server
+	a.sample(at(5), 6, 0)
+
+	expect := map[string]float64{"A": 1, "B": 4, serverClient: 1}
+	rep := a.report()
+	if len(rep.Clients) != len(expect) || math.Abs(rep.CPUSeconds-6) > 1e-9 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	for _, acc := range rep.Clients {
+		if math.Abs(acc.CPUSeconds-expect[acc.Client]) > 1e-9 {
+			t.Errorf("client %s: CPU %v, expected %v", acc.Client, acc.CPUSeconds, expect[acc.Client])
+		}
+	}
+	if rep.Clients[0].Client != "B" || rep.Clients[0].Requests != 1 || rep.Clients[0].WallSeconds != 3.5 {
+		t.Errorf("unexpected account of B %+v", rep.Clients[0])
+	}
+}
+
+// TestAccountingHandler checks accounting of requests and accounting report
+func TestAccountingHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	orig := _accounting
+	_accounting = newAccounting(time.Now())
+	t.Cleanup(func() { _accounting = orig })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/models", nil))
+	_accounting.sample(time.Now(), 1, 0)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/accounting", nil))
+	var rep AccountingReport
+	json.Unmarshal(w.Body.Bytes(), &rep)
+	if w.Code != http.StatusOK || len(rep.Clients) == 0 || rep.Clients[0].Client != anonymousUser {
+		t.Fatalf("unexpected accounting report, status %d: %s", w.Code, w.Body.String())
+	}
+	if rep.Clients[0].Requests != 2 || rep.Clients[0].CPUSeconds != 1 {
+		t.Errorf("unexpected account %+v", rep.Clients[0])
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+// aliases module provides support of model aliases
+//
+// An alias, e.g. "dnn-prod", points to concrete model version, e.g. "dnn_v2",
+// such that clients may use alias name in their requests and administrators
+// may promote (or demote) model versions without changing clients' code.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alias represents model alias
+type Alias struct {
+	Name      string   `json:"name"`      // alias name
+	Model     string   `json:"model"`     // model name alias points to
+	History   []string `json:"history"`   // previous models alias pointed to
+	TimeStamp string   `json:"timestamp"` // time of last alias change
+}
+
+// Aliases holds all model aliases
+type Aliases struct {
+	Aliases map[string]Alias
+	mutex   sync.RWMutex
+}
+
+// global aliases
+var _aliases = Aliases{Aliases: make(map[string]Alias)}
+
+// helper function to return location of aliases file
+func aliasesFile() string {
+	if _config.AliasesFile != "" {
+		return _config.AliasesFile
+	}
+	return filepath.Join(_config.ModelDir, "aliases.json")
+}
+
+// load aliases from aliases file or state store
+func (a *Aliases) load() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _stateStore != nil {
+		return a.loadStore()
+	}
+	return a.loadFile()
+}
+
+// helper function to load aliases from aliases file
+func (a *Aliases) loadFile() error {
+	fname := aliasesFile()
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	aliases := make(map[string]Alias)
+	err = json.Unmarshal(data, &aliases)
+	if err != nil {
+		return err
+	}
+	a.Aliases = aliases
+	return nil
+}
+
+// helper function to load aliases from state store, aliases of existing
+// aliases file are imported into empty store
+func (a *Aliases) loadStore() error {
+	records, err := _stateStore.List(aliasesBucket)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		if err := a.loadFile(); err != nil {
+			return err
+		}
+		if len(a.Aliases) > 0 {
+			log.Printf("import %d aliases of %s into state store", len(a.Aliases), aliasesFile())
+		}
+		return a.write()
+	}
+	aliases := make(map[string]Alias)
+	for name, data := range records {
+		var alias Alias
+		if err := json.Unmarshal(data, &alias); err != nil {
+			return fmt.Errorf("unable to read alias %s: %v", name, err)
+		}
+		aliases[name] = alias
+	}
+	a.Aliases = aliases
+	return nil
+}
+
+// write aliases to aliases file (or state store), we write data to
+// temporary file first and rename it afterwards to have atomic update of
+// aliases file. State store is updated only for given aliases (all aliases
+// if none is given) to not overwrite changes of other replicas.
+func (a *Aliases) write(names ...string) error {
+	if _stateStore != nil {
+		return _stateStore.Update(func(tx StateTx) error {
+			for name, alias := range a.Aliases {
+				if len(names) > 0 && !InList(name, names) {
+					continue
+				}
+				data, err := json.Marshal(alias)
+				if err != nil {
+					return err
+				}
+				if err := tx.Put(aliasesBucket, name, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	fname := aliasesFile()
+	data, err := json.MarshalIndent(a.Aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp", fname)
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// resolve returns model name for given alias, if given name is not an alias
+// it is returned as is
+func (a *Aliases) resolve(name string) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if alias, ok := a.Aliases[name]; ok {
+		return alias.Model
+	}
+	return name
+}
+
+// list returns sorted list of aliases
+func (a *Aliases) list() []Alias {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	var out []Alias
+	for _, alias := range a.Aliases {
+		out = append(out, alias)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// promote points given alias to given model
+func (a *Aliases) promote(name, model string) (Alias, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	alias, ok := a.Aliases[name]
+	if !ok {
+		alias = Alias{Name: name}
+	}
+	if alias.Model == model {
+		return alias, nil
+	}
+	if alias.Model != "" {
+		alias.History = append(alias.History, alias.Model)
+	}
+	alias.Model = model
+	alias.TimeStamp = time.Now().String()
+	prev, exists := a.Aliases[name]
+	a.Aliases[name] = alias
+	if err := a.write(name); err != nil {
+		// restore previous state of alias
+		if exists {
+			a.Aliases[name] = prev
+		} else {
+			delete(a.Aliases, name)
+		}
+		return alias, err
+	}
+	return alias, nil
+}
+
+// demote points given alias back to its previous model
+func (a *Aliases) demote(name string) (Alias, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	prev, ok := a.Aliases[name]
+	if !ok {
+		return prev, fmt.Errorf("alias %s does not exist", name)
+	}
+	if len(prev.History) == 0 {
+		return prev, fmt.Errorf("alias %s does not have previous models", name)
+	}
+	alias := prev
+	alias.Model = prev.History[len(prev.History)-1]
+	alias.History = append([]string{}, prev.History[:len(prev.History)-1]...)
+	alias.TimeStamp = time.Now().String()
+	a.Aliases[name] = alias
+	if err := a.write(name); err != nil {
+		a.Aliases[name] = prev
+		return alias, err
+	}
+	return alias, nil
+}
+
+// helper function to resolve model name via known aliases
+func resolveModel(name string) string {
+	return _aliases.resolve(name)
+}
+
+// helper function to check if given model exists in model area
+func modelExists(model string) bool {
+	if model == "" {
+		return false
+	}
+	path := filepath.Join(_config.ModelDir, model)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return true
+	}
+	return false
+}
+
+// AliasRequest represents alias request
+type AliasRequest struct {
+	Alias string `json:"alias"` // alias name
+	Model string `json:"model"` // model name
+}
+
+// AliasesHandler returns list of known aliases
+func AliasesHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, _aliases.list())
+}
+
+// PromoteHandler points alias to given model
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req AliasRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		responseError(w, "unable to decode alias request", err, http.StatusBadRequest)
+		return
+	}
+	if req.Alias == "" {
+		responseError(w, "no alias name is provided", nil, http.StatusBadRequest)
+		return
+	}
+	if modelExists(req.Alias) {
+		msg := fmt.Sprintf("alias %s conflicts with existing model name", req.Alias)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	if !modelExists(req.Model) {
+		msg := fmt.Sprintf("model %s does not exist", req.Model)
+		responseError(w, msg, errors.New(msg), http.StatusBadRequest)
+		return
+	}
+	alias, err := _aliases.promote(req.Alias, req.Model)
+	if err != nil {
+		responseError(w, "unable to promote alias", err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("promote alias %s to model %s", alias.Name, alias.Model)
+	publish(EventPromotion, alias.Model, fmt.Sprintf("alias %s points to model %s", alias.Name, alias.Model))
+	responseJSON(w, alias)
+}
+
+// DemoteHandler points alias back to its previous model
+func DemoteHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req AliasRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		responseError(w, "unable to decode alias request", err, http.StatusBadRequest)
+		return
+	}
+	alias, err := _aliases.demote(req.Alias)
+	if err != nil {
+		responseError(w, "unable to demote alias", err, http.StatusBadRequest)
+		return
+	}
+	log.Printf("demote alias %s to model %s", alias.Name, alias.Model)
+	publish(EventDemotion, alias.Model, fmt.Sprintf("alias %s points to model %s", alias.Name, alias.Model))
+	responseJSON(w, alias)
+}
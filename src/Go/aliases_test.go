@@ -0,0 +1,77 @@
+package main
+
+// tests of model aliases, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// helper function to call alias handler with given request
+func aliasRequest(t *testing.T, handler http.HandlerFunc, alias, model string) (int, Alias) {
+	data, _ := json.Marshal(AliasRequest{Alias: alias, Model: model})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/alias", bytes.NewReader(data)))
+	var rec Alias
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, rec
+}
+
+// TestAliases checks promotion and demotion of model aliases
+func TestAliases(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	writeModelFiles(t, "dnn2", []byte("dnn2"), TFParams{InputNode: "input", OutputNode: "output2"})
+
+	for _, req := range []AliasRequest{{"", "dnn"}, {"dnn2", "dnn"}, {"dnn-prod", "unknown"}} {
+		if code, _ := aliasRequest(t, PromoteHandler, req.Alias, req.Model); code != http.StatusBadRequest {
+			t.Errorf("wrong status code %d of promotion %+v", code, req)
+		}
+	}
+	if code, alias := aliasRequest(t, PromoteHandler, "dnn-prod", "dnn"); code != http.StatusOK || alias.Model != "dnn" {
+		t.Fatalf("wrong promotion %d %+v", code, alias)
+	}
+	code, alias := aliasRequest(t, PromoteHandler, "dnn-prod", "dnn2")
+	if code != http.StatusOK || alias.Model != "dnn2" || len(alias.History) != 1 || alias.History[0] != "dnn" {
+		t.Fatalf("wrong promotion %d %+v", code, alias)
+	}
+
+	// requests of alias are served by promoted model
+	if _, err := predictRow(testRow("dnn-prod")); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := fake.Fetches(); len(fetches) != 1 || fetches[0] != "output2" {
+		t.Fatalf("alias request is not served by promoted model, fetches %v", fetches)
+	}
+
+	// aliases are kept in aliases file
+	aliases := Aliases{Aliases: make(map[string]Alias)}
+	if err := aliases.load(); err != nil {
+		t.Fatal(err)
+	}
+	if model := aliases.resolve("dnn-prod"); model != "dnn2" {
+		t.Fatalf("wrong model %s of loaded alias", model)
+	}
+
+	code, alias = aliasRequest(t, DemoteHandler, "dnn-prod", "")
+	if code != http.StatusOK || alias.Model != "dnn" || len(alias.History) != 0 {
+		t.Fatalf("wrong demotion %d %+v", code, alias)
+	}
+	if model := resolveModel("dnn-prod"); model != "dnn" {
+		t.Fatalf("wrong model %s of demoted alias", model)
+	}
+	for _, name := range []string{"dnn-prod", "unknown"} {
+		if code, _ := aliasRequest(t, DemoteHandler, name, ""); code != http.StatusBadRequest {
+			t.Errorf("wrong status code %d of demotion of %s", code, name)
+		}
+	}
+	if list := _aliases.list(); len(list) != 1 || list[0].Name != "dnn-prod" {
+		t.Fatalf("wrong list of aliases %+v", list)
+	}
+}
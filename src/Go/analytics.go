@@ -0,0 +1,275 @@
+package main
+
+// analytics module provides usage analytics of models
+//
+// Every prediction request is accounted to its model (aliases are resolved
+// to concrete models) in daily buckets with number of requests, scored rows
+// (i.e. batch sizes) and unique clients, where clients are users of client
+// certificates (or dashboard sessions) or IP addresses of anonymous clients,
+// "mqtt:<topic>" and "nats" for message based predictions. The /analytics
+// endpoint reports usage of every model of model area over the last day and
+// week along with the last usage time and number of idle days, such that
+// models nobody calls anymore can be retired, e.g. /analytics?idle=30 lists
+// models which are not used for 30 days. Self-tests are not accounted.
+// Analytics are kept in modelDir/.analytics.json and survive restarts.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of daily buckets kept for analytics, i.e. weekly window
+const analyticsDays = 7
+
+// max number of unique clients tracked in daily bucket of the model
+const maxUsageClients = 10000
+
+// UsageBucket represents daily usage of the model
+type UsageBucket struct {
+	Day      string          `json:"day"`      // day of the bucket, YYYY-MM-DD
+	Requests int64           `json:"requests"` // number of prediction requests
+	Rows     int64           `json:"rows"`     // number of scored rows
+	Clients  map[string]bool `json:"clients"`  // unique clients
+}
+
+// ModelUsage represents usage history of the model
+type ModelUsage struct {
+	Buckets  []*UsageBucket `json:"buckets"`  // daily buckets, the latest is the last one
+	Requests int64          `json:"requests"` // total number of requests
+	Rows     int64          `json:"rows"`     // total number of scored rows
+	LastUsed int64          `json:"lastUsed"` // time of the last request
+}
+
+// UsageWindow represents usage of the model over time window
+type UsageWindow struct {
+	Requests     int64   `json:"requests"`     // number of prediction requests
+	Rows         int64   `json:"rows"`         // number of scored rows
+	Clients      int     `json:"clients"`      // number of unique clients
+	AvgBatchSize float64 `json:"avgBatchSize"` // average number of rows per request
+}
+
+// UsageReport represents usage analytics of the model
+type UsageReport struct {
+	Model    string      `json:"model"`    // model name
+	Day      UsageWindow `json:"day"`      // usage over the last day
+	Week     UsageWindow `json:"week"`     // usage over the last week
+	Requests int64       `json:"requests"` // total number of requests
+	LastUsed string      `json:"lastUsed"` // time of the last request, empty if model is not used
+	IdleDays int         `json:"idleDays"` // number of days since the last request
+}
+
+// global usage analytics
+var (
+	_usage        = make(map[string]*ModelUsage)
+	_usageLoaded  bool
+	_usageChanged bool
+	usageLock     sync.Mutex
+)
+
+// helper function to return location of analytics file
+func analyticsFile() string {
+	return filepath.Join(_config.ModelDir, ".analytics.json")
+}
+
+// helper function to load analytics from analytics file, it should be
+// called with acquired lock
+func loadUsage() {
+	if _usageLoaded {
+		return
+	}
+	_usageLoaded = true
+	data, err := ioutil.ReadFile(analyticsFile())
+	if err != nil {
+		return
+	}
+	usage := make(map[string]*ModelUsage)
+	if err := json.Unmarshal(data, &usage); err != nil {
+		log.Println("unable to parse analytics file", err)
+		return
+	}
+	for model, u := range usage {
+		if _, ok := _usage[model]; !ok {
+			_usage[model] = u
+		}
+	}
+}
+
+// helper function to write analytics into analytics file
+func saveUsage() error {
+	usageLock.Lock()
+	if !_usageChanged {
+		usageLock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(_usage)
+	_usageChanged = false
+	usageLock.Unlock()
+	if err != nil {
+		return err
+	}
+	fname := analyticsFile()
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// helper function to identify client of the request for analytics
+func usageClient(r *http.Request) string {
+	if id := requestIdentity(r); id.User != anonymousUser {
+		return id.User
+	}
+	return requestClientIP(r)
+}
+
+// observeUsage accounts prediction request of given model with given number
+// of rows to the client
+func observeUsage(client, model string, rows int) {
+	if model == "" {
+		model = _params.Name
+	}
+	model = resolveModel(model)
+	if model == "" {
+		return
+	}
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	loadUsage()
+	u, ok := _usage[model]
+	if !ok {
+		u = &ModelUsage{}
+		_usage[model] = u
+	}
+	n := len(u.Buckets)
+	if n == 0 || u.Buckets[n-1].Day != day {
+		u.Buckets = append(u.Buckets, &UsageBucket{Day: day, Clients: make(map[string]bool)})
+		if len(u.Buckets) > analyticsDays {
+			u.Buckets = u.Buckets[len(u.Buckets)-analyticsDays:]
+		}
+		n = len(u.Buckets)
+	}
+	b := u.Buckets[n-1]
+	b.Requests++
+	b.Rows += int64(rows)
+	if client != "" && len(b.Clients) < maxUsageClients {
+		b.Clients[client] = true
+	}
+	u.Requests++
+	u.Rows += int64(rows)
+	u.LastUsed = now.Unix()
+	_usageChanged = true
+}
+
+// helper function to return number of rows of batch tensor
+func tensorRowsCount(tensor TFTensor) int {
+	if shape := tensor.Shape(); len(shape) > 0 {
+		return int(shape[0])
+	}
+	return 1
+}
+
+// helper function to summarize usage buckets since given day
+func usageWindow(buckets []*UsageBucket, since string) UsageWindow {
+	var w UsageWindow
+	clients := make(map[string]bool)
+	for _, b := range buckets {
+		if b.Day < since {
+			continue
+		}
+		w.Requests += b.Requests
+		w.Rows += b.Rows
+		for c := range b.Clients {
+			clients[c] = true
+		}
+	}
+	w.Clients = len(clients)
+	if w.Requests > 0 {
+		w.AvgBatchSize = float64(w.Rows) / float64(w.Requests)
+	}
+	return w
+}
+
+// usageReports returns usage analytics of models of model area and of
+// used models which are removed since then
+func usageReports(now time.Time) []UsageReport {
+	models := make(map[string]bool)
+	if files, err := ioutil.ReadDir(_config.ModelDir); err == nil {
+		for _, f := range files {
+			if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+				models[f.Name()] = true
+			}
+		}
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	loadUsage()
+	for model := range _usage {
+		models[model] = true
+	}
+	today := now.Format("2006-01-02")
+	weekAgo := now.AddDate(0, 0, -(analyticsDays - 1)).Format("2006-01-02")
+	var reports []UsageReport
+	for model := range models {
+		rep := UsageReport{Model: model, IdleDays: -1}
+		if u, ok := _usage[model]; ok {
+			rep.Day = usageWindow(u.Buckets, today)
+			rep.Week = usageWindow(u.Buckets, weekAgo)
+			rep.Requests = u.Requests
+			if u.LastUsed > 0 {
+				last := time.Unix(u.LastUsed, 0)
+				rep.LastUsed = last.Format(time.RFC3339)
+				rep.IdleDays = int(now.Sub(last).Hours() / 24)
+			}
+		}
+		reports = append(reports, rep)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Model < reports[j].Model })
+	return reports
+}
+
+// analyticsSaver periodically writes analytics into analytics file
+func analyticsSaver(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveUsage(); err != nil {
+			log.Println("unable to save analytics", err)
+		}
+	}
+}
+
+// AnalyticsHandler provides usage analytics of models, idle parameter
+// selects models which are not used for given number of days (idle days of
+// never used models are -1 and they are always selected)
+func AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	reports := usageReports(time.Now())
+	if v := r.URL.Query().Get("idle"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			responseError(w, "idle parameter should be number of days", err, http.StatusBadRequest)
+			return
+		}
+		var idle []UsageReport
+		for _, rep := range reports {
+			if rep.IdleDays < 0 || rep.IdleDays >= days {
+				idle = append(idle, rep)
+			}
+		}
+		reports = idle
+	}
+	if reports == nil {
+		reports = []UsageReport{}
+	}
+	responseJSON(w, reports)
+}
@@ -0,0 +1,90 @@
+package main
+
+// tests of model usage analytics, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// helper function to reset usage analytics
+func resetUsage() {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	_usage = make(map[string]*ModelUsage)
+	_usageLoaded, _usageChanged = false, false
+}
+
+// helper function to fetch usage reports of given query
+func fetchUsage(t *testing.T, router http.Handler, query string) map[string]UsageReport {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/analytics"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var reports []UsageReport
+	json.Unmarshal(w.Body.Bytes(), &reports)
+	out := make(map[string]UsageReport)
+	for _, rep := range reports {
+		out[rep.Model] = rep
+	}
+	return out
+}
+
+// TestAnalytics checks usage analytics of models
+func TestAnalytics(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	resetUsage()
+	t.Cleanup(resetUsage)
+
+	data, _ := json.Marshal(testRow("dnn"))
+	for _, addr := range []string{"10.0.0.1:1234", "10.0.0.2:1234", "10.0.0.2:4321"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/json", bytes.NewReader(data))
+		req.RemoteAddr = addr
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+		}
+	}
+	observeUsage("10.0.0.3", "dnn", 9)
+	// usage of the model ten days ago is not part of weekly window
+	usageLock.Lock()
+	old := time.Now().AddDate(0, 0, -10)
+	_usage["dnn2"] = &ModelUsage{
+		Buckets:  []*UsageBucket{{Day: old.Format("2006-01-02"), Requests: 5, Rows: 5, Clients: map[string]bool{"a": true}}},
+		Requests: 5, Rows: 5, LastUsed: old.Unix(),
+	}
+	usageLock.Unlock()
+
+	reports := fetchUsage(t, router, "")
+	dnn := reports["dnn"]
+	if dnn.Day.Requests != 4 || dnn.Day.Clients != 3 || dnn.Day.AvgBatchSize != 3 || dnn.Week.Requests != 4 || dnn.IdleDays != 0 {
+		t.Errorf("unexpected usage of dnn %+v", dnn)
+	}
+	if rep := reports["dnn2"]; rep.Week.Requests != 0 || rep.Requests != 5 || rep.IdleDays != 10 {
+		t.Errorf("unexpected usage of dnn2 %+v", rep)
+	}
+	if rep, ok := reports["img"]; !ok || rep.IdleDays != -1 || rep.LastUsed != "" {
+		t.Errorf("unused model is not reported %+v", rep)
+	}
+	idle := fetchUsage(t, router, "?idle=7")
+	if _, ok := idle["dnn"]; ok || len(idle) != 2 {
+		t.Errorf("unexpected idle models %v", idle)
+	}
+
+	// analytics survive restarts
+	if err := saveUsage(); err != nil {
+		t.Fatal(err)
+	}
+	resetUsage()
+	if rep := fetchUsage(t, router, "")["dnn"]; rep.Requests != 4 || rep.Day.Clients != 3 {
+		t.Errorf("analytics are not restored %+v", rep)
+	}
+}
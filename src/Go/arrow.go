@@ -0,0 +1,424 @@
+package main
+
+// arrow module provides Apache Arrow IPC support of batch endpoint
+//
+// Clients may POST Arrow IPC stream (or file) with
+// application/vnd.apache.arrow.stream content type to /predict/batch, e.g.
+// POST /predict/batch?model=dnn&columns=a,b,c
+// The columns parameter selects and orders table columns used as model
+// features (by default all numeric columns are used in schema order), and
+// column names are passed to the model as row keys. The results are returned
+// as Arrow IPC stream with output_0, ..., output_N float32 columns.
+//
+// Arrow data is read and written by Apache Arrow Go library, int and
+// floating point columns without nulls are converted to float32 model
+// features. Parquet files are read into Arrow table by parquet module.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+)
+
+// Arrow content types
+const (
+	arrowStreamType = "application/vnd.apache.arrow.stream"
+	arrowFileType   = "application/vnd.apache.arrow.file"
+	parquetType     = "application/vnd.apache.parquet"
+)
+
+// maximal size of buffer allocated by Arrow reader
+const arrowMaxMessageSize = 1 << 30
+
+// magic number of Arrow IPC files
+var arrowMagic = []byte("ARROW1")
+
+// ArrowColumn represents column of Arrow table
+type ArrowColumn struct {
+	Name      string
+	supported bool // numeric column which can be used as model feature
+}
+
+// ArrowTable represents Arrow table with numeric columns converted to float32
+type ArrowTable struct {
+	Columns []ArrowColumn
+	Values  [][]float32 // values of every column
+	Rows    int64       // number of table rows
+}
+
+// arrowAllocator represents memory allocator of Arrow reader, it rejects
+// buffers of malformed messages which exceed arrowMaxMessageSize (the
+// reader recovers the panic and returns it as error)
+type arrowAllocator struct {
+	memory.GoAllocator
+}
+
+// Allocate implements memory.Allocator interface
+func (a *arrowAllocator) Allocate(size int) []byte {
+	if size > arrowMaxMessageSize {
+		panic(fmt.Sprintf("arrow buffer of %d bytes exceeds limit", size))
+	}
+	return a.GoAllocator.Allocate(size)
+}
+
+// Reallocate implements memory.Allocator interface
+func (a *arrowAllocator) Reallocate(size int, b []byte) []byte {
+	if size > arrowMaxMessageSize {
+		panic(fmt.Sprintf("arrow buffer of %d bytes exceeds limit", size))
+	}
+	return a.GoAllocator.Reallocate(size, b)
+}
+
+// helper function to check if values of Arrow type can be used as model
+// features
+func arrowNumeric(dtype arrow.DataType) bool {
+	switch dtype.ID() {
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64,
+		arrow.FLOAT16, arrow.FLOAT32, arrow.FLOAT64:
+		return true
+	}
+	return false
+}
+
+// helper function to return table columns of Arrow schema
+func arrowColumns(schema *arrow.Schema) []ArrowColumn {
+	var columns []ArrowColumn
+	for _, field := range schema.Fields() {
+		columns = append(columns, ArrowColumn{Name: field.Name, supported: arrowNumeric(field.Type)})
+	}
+	return columns
+}
+
+// helper function to convert numeric values to float32
+func float32Values[T int8 | int16 | int32 | int64 | uint8 | uint16 | uint32 | uint64 | float32 | float64](values []T) []float32 {
+	out := make([]float32, len(values))
+	for i, v := range values {
+		out[i] = float32(v)
+	}
+	return out
+}
+
+// helper function to convert values of numeric Arrow array to float32
+func arrowValues(name string, arr arrow.Array) ([]float32, error) {
+	if arr.NullN() > 0 {
+		return nil, fmt.Errorf("arrow column %s has nulls", name)
+	}
+	switch a := arr.(type) {
+	case *array.Int8:
+		return float32Values(a.Int8Values()), nil
+	case *array.Int16:
+		return float32Values(a.Int16Values()), nil
+	case *array.Int32:
+		return float32Values(a.Int32Values()), nil
+	case *array.Int64:
+		return float32Values(a.Int64Values()), nil
+	case *array.Uint8:
+		return float32Values(a.Uint8Values()), nil
+	case *array.Uint16:
+		return float32Values(a.Uint16Values()), nil
+	case *array.Uint32:
+		return float32Values(a.Uint32Values()), nil
+	case *array.Uint64:
+		return float32Values(a.Uint64Values()), nil
+	case *array.Float16:
+		values := make([]float32, a.Len())
+		for i, v := range a.Values() {
+			values[i] = v.Float32()
+		}
+		return values, nil
+	case *array.Float32:
+		return float32Values(a.Float32Values()), nil
+	case *array.Float64:
+		return float32Values(a.Float64Values()), nil
+	}
+	return nil, fmt.Errorf("arrow column %s has unsupported type %s", name, arr.DataType())
+}
+
+// helper function to append numeric columns of Arrow record to the table
+func (t *ArrowTable) appendRecord(record arrow.Record) error {
+	for i, col := range t.Columns {
+		if !col.supported {
+			continue
+		}
+		values, err := arrowValues(col.Name, record.Column(i))
+		if err != nil {
+			return err
+		}
+		t.Values[i] = append(t.Values[i], values...)
+	}
+	t.Rows += record.NumRows()
+	return nil
+}
+
+// arrowReader reads record batches of Arrow IPC stream or file
+type arrowReader struct {
+	stream  *ipc.Reader     // reader of Arrow stream
+	file    *ipc.FileReader // reader of Arrow file
+	index   int             // index of next record batch of the file
+	columns []ArrowColumn   // columns of stream schema
+}
+
+// helper function to convert panic of Arrow library on malformed data into
+// error
+func recoverArrow(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("malformed arrow data: %v", r)
+	}
+}
+
+// helper function to create reader of Arrow IPC stream or file, it reads
+// stream schema
+func newArrowReader(r io.Reader) (ar *arrowReader, err error) {
+	defer recoverArrow(&err)
+	buf := bufio.NewReader(r)
+	alloc := ipc.WithAllocator(&arrowAllocator{})
+	if magic, err := buf.Peek(len(arrowMagic)); err == nil && bytes.Equal(magic, arrowMagic) {
+		// file format is read by its footer which requires random access,
+		// request bodies are read into memory
+		src, ok := r.(ipc.ReadAtSeeker)
+		if !ok {
+			limit := maxDecodedBody()
+			data, err := ioutil.ReadAll(io.LimitReader(buf, int64(limit)+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > limit {
+				return nil, errors.New("arrow file exceeds size limit")
+			}
+			src = bytes.NewReader(data)
+		}
+		file, err := ipc.NewFileReader(src, alloc)
+		if err != nil {
+			return nil, err
+		}
+		return &arrowReader{file: file, columns: arrowColumns(file.Schema())}, nil
+	}
+	stream, err := ipc.NewReader(buf, alloc)
+	if err != nil {
+		return nil, err
+	}
+	return &arrowReader{stream: stream, columns: arrowColumns(stream.Schema())}, nil
+}
+
+// helper function to read next record batch into table, it returns io.EOF
+// at the end of stream
+func (ar *arrowReader) next() (table *ArrowTable, err error) {
+	defer recoverArrow(&err)
+	var record arrow.Record
+	if ar.file != nil {
+		if ar.index >= ar.file.NumRecords() {
+			return nil, io.EOF
+		}
+		if record, err = ar.file.Record(ar.index); err != nil {
+			return nil, err
+		}
+		ar.index++
+	} else if ar.stream.Next() {
+		record = ar.stream.Record()
+	} else if err := ar.stream.Err(); err != nil {
+		return nil, err
+	} else {
+		return nil, io.EOF
+	}
+	table = &ArrowTable{Columns: ar.columns, Values: make([][]float32, len(ar.columns))}
+	if err := table.appendRecord(record); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// helper function to release memory of the reader
+func (ar *arrowReader) close() {
+	if ar.file != nil {
+		ar.file.Close()
+	} else {
+		ar.stream.Release()
+	}
+}
+
+// helper function to read Arrow IPC stream or file
+func readArrowTable(r io.Reader) (*ArrowTable, error) {
+	reader, err := newArrowReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.close()
+	table := &ArrowTable{Columns: reader.columns, Values: make([][]float32, len(reader.columns))}
+	for {
+		batch, err := reader.next()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch.Values {
+			table.Values[i] = append(table.Values[i], batch.Values[i]...)
+		}
+		table.Rows += batch.Rows
+	}
+}
+
+// helper function to select table columns of given names (by default all
+// numeric columns), it returns column indices and names
+func (t *ArrowTable) selectColumns(names []string) ([]int, []string, error) {
+	var idx []int
+	if len(names) == 0 {
+		for i, col := range t.Columns {
+			if col.supported {
+				idx = append(idx, i)
+				names = append(names, col.Name)
+			}
+		}
+	} else {
+		for _, name := range names {
+			found := false
+			for i, col := range t.Columns {
+				if col.Name == name {
+					if !col.supported {
+						return nil, nil, fmt.Errorf("arrow column %s has unsupported type", name)
+					}
+					idx = append(idx, i)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("arrow table does not have column %s", name)
+			}
+		}
+	}
+	if len(idx) == 0 {
+		return nil, nil, errors.New("arrow table does not have numeric data")
+	}
+	return idx, names, nil
+}
+
+// helper function to return flat (row-major) values of given columns
+func (t *ArrowTable) rowValues(idx []int) []float32 {
+	values := make([]float32, 0, int64(len(idx))*t.Rows)
+	for row := int64(0); row < t.Rows; row++ {
+		for _, i := range idx {
+			values = append(values, t.Values[i][row])
+		}
+	}
+	return values
+}
+
+// helper function to build batch of given table columns, it returns
+// column names and flat (row-major) values
+func (t *ArrowTable) batch(names []string) ([]string, []float32, error) {
+	idx, names, err := t.selectColumns(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Rows == 0 {
+		return nil, nil, errors.New("arrow table does not have numeric data")
+	}
+	return names, t.rowValues(idx), nil
+}
+
+// helper function to write float32 matrix as Arrow IPC stream
+func writeArrowTable(w io.Writer, rows [][]float32) error {
+	ncols := 0
+	if len(rows) > 0 {
+		ncols = len(rows[0])
+	}
+	fields := make([]arrow.Field, ncols)
+	for i := range fields {
+		fields[i] = arrow.Field{Name: fmt.Sprintf("output_%d", i), Type: arrow.PrimitiveTypes.Float32}
+	}
+	schema := arrow.NewSchema(fields, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	for c := 0; c < ncols; c++ {
+		col := builder.Field(c).(*array.Float32Builder)
+		col.Reserve(len(rows))
+		for _, row := range rows {
+			var v float32
+			if c < len(row) {
+				v = row[c]
+			}
+			col.UnsafeAppend(v)
+		}
+	}
+	record := builder.NewRecord()
+	defer record.Release()
+	writer := ipc.NewWriter(w, ipc.WithSchema(schema))
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// helper function to check if request provides Arrow data
+func isArrowRequest(r *http.Request) bool {
+	ctype := r.Header.Get("Content-Type")
+	return strings.HasPrefix(ctype, arrowStreamType) || strings.HasPrefix(ctype, arrowFileType)
+}
+
+// ArrowBatchHandler provides predictions for Arrow table or Parquet file
+func ArrowBatchHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctype := negotiateOutput(r, arrowStreamType)
+	if rejectOutputFormat(w, ctype) {
+		return
+	}
+	var table *ArrowTable
+	var err error
+	if isParquetRequest(r) {
+		if table, err = readParquetBody(r.Body); err != nil {
+			responseError(w, "unable to read parquet file", err, http.StatusBadRequest)
+			return
+		}
+	} else if table, err = readArrowTable(r.Body); err != nil {
+		responseError(w, "unable to read arrow table", err, http.StatusBadRequest)
+		return
+	}
+	var names []string
+	if columns := r.URL.Query().Get("columns"); columns != "" {
+		names = strings.Split(columns, ",")
+	}
+	keys, values, err := table.batch(names)
+	if err != nil {
+		responseError(w, "unable to read arrow table", err, http.StatusBadRequest)
+		return
+	}
+	tensor, err := makeFlatTensor(values, []int64{table.Rows, int64(len(keys))})
+	if err != nil {
+		responseError(w, "unable to read arrow table", err, http.StatusBadRequest)
+		return
+	}
+	model := r.URL.Query().Get("model")
+	if model == "" {
+		model = _params.Name
+	}
+	observeUsage(usageClient(r), model, tensorRowsCount(tensor))
+	raw := rawOutputs(model, rawRequested(r))
+	if r.URL.Query().Get("output") == "store" {
+		storeBatchProbs(w, model, keys, tensor, raw)
+		return
+	}
+	if streamRequested(r, ctype) {
+		streamBatchProbs(w, model, keys, tensor, raw)
+		return
+	}
+	probs, err := makeBatchPredictions(model, keys, tensor)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make batch predictions", err, http.StatusInternalServerError)
+		return
+	}
+	responseBatchOutput(w, ctype, model, probs, raw)
+}
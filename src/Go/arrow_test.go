@@ -0,0 +1,161 @@
+package main
+
+// tests of Arrow IPC support, they do not require TF C library
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+)
+
+// helper function to build Arrow record with float64 "a", int32 "b", utf8
+// "s" and float32 "c" columns of given number of rows, the last value of
+// "c" column is null if requested
+func testArrowRecord(nrows int, nulls bool) arrow.Record {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "a", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "b", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "s", Type: arrow.BinaryTypes.String},
+		{Name: "c", Type: arrow.PrimitiveTypes.Float32, Nullable: true},
+	}, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	for i := 0; i < nrows; i++ {
+		builder.Field(0).(*array.Float64Builder).Append(float64(i) + 0.5)
+		builder.Field(1).(*array.Int32Builder).Append(int32(-i))
+		builder.Field(2).(*array.StringBuilder).Append("")
+		if nulls && i == nrows-1 {
+			builder.Field(3).(*array.Float32Builder).AppendNull()
+		} else {
+			builder.Field(3).(*array.Float32Builder).Append(float32(i) * 2)
+		}
+	}
+	return builder.NewRecord()
+}
+
+// helper function to write Arrow stream of test record of given number of
+// rows
+func writeTestArrowStream(tb testing.TB, nrows int) []byte {
+	record := testArrowRecord(nrows, false)
+	defer record.Release()
+	var buf bytes.Buffer
+	writer := ipc.NewWriter(&buf, ipc.WithSchema(record.Schema()))
+	if err := writer.Write(record); err != nil {
+		tb.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestArrowTable checks reading of Arrow streams
+func TestArrowTable(t *testing.T) {
+	table, err := readArrowTable(bytes.NewReader(writeTestArrowStream(t, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Rows != 3 || len(table.Columns) != 4 || table.Columns[2].supported {
+		t.Fatalf("wrong arrow table %+v", table)
+	}
+	keys, values, err := table.batch(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("wrong table columns %v", keys)
+	}
+	expect := []float32{0.5, 0, 0, 1.5, -1, 2, 2.5, -2, 4}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("wrong table values %v, expected %v", values, expect)
+	}
+	if _, _, err := table.batch([]string{"s"}); err == nil {
+		t.Error("string column should be rejected")
+	}
+	if _, _, err := table.batch([]string{"x"}); err == nil {
+		t.Error("unknown column should be rejected")
+	}
+
+	// Arrow files are read as streams
+	record := testArrowRecord(3, false)
+	defer record.Release()
+	fname := filepath.Join(t.TempDir(), "test.arrow")
+	file, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := ipc.NewFileWriter(file, ipc.WithSchema(record.Schema()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(record)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	data, _ := ioutil.ReadFile(fname)
+	if ftable, err := readArrowTable(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(ftable, table) {
+		t.Fatalf("wrong table %+v of arrow file: %v", ftable, err)
+	}
+
+	// nulls and malformed streams are rejected
+	nulls := testArrowRecord(3, true)
+	defer nulls.Release()
+	var buf bytes.Buffer
+	stream := ipc.NewWriter(&buf, ipc.WithSchema(nulls.Schema()))
+	stream.Write(nulls)
+	stream.Close()
+	if _, err := readArrowTable(bytes.NewReader(buf.Bytes())); err == nil || !strings.Contains(err.Error(), "nulls") {
+		t.Errorf("nulls are not reported: %v", err)
+	}
+	if _, err := readArrowTable(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, 8, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8})); err == nil {
+		t.Error("malformed arrow stream should be rejected")
+	}
+}
+
+// TestArrowBatchHandler checks batch predictions for Arrow tables
+func TestArrowBatchHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := 5
+	req := httptest.NewRequest("POST", "/predict/batch?model=dnn&columns=c,a", bytes.NewReader(writeTestArrowStream(t, nrows)))
+	req.Header.Set("Content-Type", arrowStreamType)
+	w := httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	if ctype := w.Header().Get("Content-Type"); ctype != arrowStreamType {
+		t.Fatalf("wrong content type %s", ctype)
+	}
+	table, err := readArrowTable(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Rows != int64(nrows) || len(table.Columns) != len(testOutputs) || table.Columns[0].Name != "output_0" {
+		t.Fatalf("wrong arrow results %+v", table)
+	}
+	for i, v := range testOutputs {
+		if table.Values[i][nrows-1] != v {
+			t.Errorf("wrong output %d value %v", i, table.Values[i])
+		}
+	}
+
+	req = httptest.NewRequest("POST", "/predict/batch?model=dnn", bytes.NewReader([]byte("PAR1")))
+	req.Header.Set("Content-Type", parquetType)
+	w = httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for invalid parquet input", w.Code)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+// audio module provides audio input with spectrogram preprocessing
+//
+// Audio classification models declare audio preprocessing in their
+// params.json, e.g.
+// "audio": {"sample_rate": 16000, "frame_length": 400, "frame_step": 160,
+//           "features": "mfcc", "mel_bins": 64, "mfccs": 13}
+// and clients upload WAV or FLAC files to POST /predict/audio, e.g.
+// scurl -F 'audio=@/path/sensor.wav' -F 'model=sensor' https://localhost:8083/predict/audio
+// WAV files are decoded natively, other formats (e.g. FLAC) are converted
+// by ffmpeg (see ffmpeg option). Audio is mixed down to mono, resampled to
+// model sample rate and converted into features which follow TF signal
+// processing: spectrogram is magnitude of tf.signal.stft with periodic Hann
+// window, log_mel is logarithm of mel spectrogram of
+// tf.signal.linear_to_mel_weight_matrix and mfcc is
+// tf.signal.mfccs_from_log_mel_spectrograms. Features are fed to the model
+// as [1, frames, bins] tensor (or [1, frames, bins, 1] with "channel": true),
+// while models with their own preprocessing graph use "waveform" features,
+// i.e. [1, samples] tensor of samples in [-1, 1] range.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// maximal size of uploaded audio file
+const maxAudioSize = 64 << 20
+
+// audio features
+const (
+	audioWaveform    = "waveform"
+	audioSpectrogram = "spectrogram"
+	audioLogMel      = "log_mel"
+	audioMFCC        = "mfcc"
+)
+
+// AudioConfig represents audio preprocessing of the model
+type AudioConfig struct {
+	SampleRate  int     `json:"sample_rate"`            // sample rate of model inputs, default 16000
+	Features    string  `json:"features"`               // waveform, spectrogram, log_mel (default) or mfcc
+	FrameLength int     `json:"frame_length,omitempty"` // window length in samples, default 400
+	FrameStep   int     `json:"frame_step,omitempty"`   // window step in samples, default 160
+	FFTLength   int     `json:"fft_length,omitempty"`   // FFT length, default smallest power of 2 enclosing frame_length
+	MelBins     int     `json:"mel_bins,omitempty"`     // number of mel bins, default 64
+	LowerHz     float64 `json:"lower_hz,omitempty"`     // lower edge of mel spectrum, default 125 Hz
+	UpperHz     float64 `json:"upper_hz,omitempty"`     // upper edge of mel spectrum, default 7600 Hz (or Nyquist frequency)
+	MFCCs       int     `json:"mfccs,omitempty"`        // number of MFCCs, default 13
+	MaxSeconds  float64 `json:"max_seconds,omitempty"`  // maximum duration of the audio, default 60 seconds
+	Channel     bool    `json:"channel,omitempty"`      // add channel dimension to features
+}
+
+// helper function to fill defaults of audio configuration
+func (c AudioConfig) withDefaults() AudioConfig {
+	if c.SampleRate <= 0 {
+		c.SampleRate = 16000
+	}
+	if c.Features == "" {
+		c.Features = audioLogMel
+	}
+	if c.FrameLength <= 0 {
+		c.FrameLength = 400
+	}
+	if c.FrameStep <= 0 {
+		c.FrameStep = 160
+	}
+	if c.FFTLength <= 0 {
+		c.FFTLength = 1
+		for c.FFTLength < c.FrameLength {
+			c.FFTLength <<= 1
+		}
+	}
+	if c.MelBins <= 0 {
+		c.MelBins = 64
+	}
+	if c.LowerHz <= 0 {
+		c.LowerHz = 125
+	}
+	if nyquist := float64(c.SampleRate) / 2; c.UpperHz <= 0 || c.UpperHz > nyquist {
+		c.UpperHz = math.Min(7600, nyquist)
+	}
+	if c.MFCCs <= 0 {
+		c.MFCCs = 13
+	}
+	if c.MaxSeconds <= 0 {
+		c.MaxSeconds = 60
+	}
+	return c
+}
+
+// decodeWAV decodes PCM or float WAV data into mono samples in [-1, 1]
+// range, it returns samples and their sample rate
+func decodeWAV(data []byte) ([]float64, int, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a WAV file")
+	}
+	var format, channels, bits int
+	var rate int
+	var samples []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, errors.New("invalid WAV format chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body))
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == 0xfffe && size >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE keeps format in sub-format GUID
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+		case "data":
+			samples = body
+		}
+		// chunks are word aligned
+		pos += 8 + size + size%2
+	}
+	if channels <= 0 || rate <= 0 || samples == nil {
+		return nil, 0, errors.New("WAV file without format or data")
+	}
+	if (format != 1 && format != 3) || (format == 3 && bits != 32 && bits != 64) ||
+		(format == 1 && bits != 8 && bits != 16 && bits != 24 && bits != 32) {
+		return nil, 0, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bits)
+	}
+	width := bits / 8
+	frames := len(samples) / (width * channels)
+	out := make([]float64, frames)
+	for i := range out {
+		var sum float64
+		for c := 0; c < channels; c++ {
+			b := samples[(i*channels+c)*width:]
+			var v float64
+			switch {
+			case format == 3 && bits == 32:
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			case format == 3:
+				v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			case bits == 8:
+				v = (float64(b[0]) - 128) / 128
+			case bits == 16:
+				v = float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+			case bits == 24:
+				v = float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+			default:
+				v = float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+			}
+			sum += v
+		}
+		out[i] = sum / float64(channels)
+	}
+	return out, rate, nil
+}
+
+// helper function to convert audio file of any format into WAV via ffmpeg
+func ffmpegWAV(data []byte) ([]byte, error) {
+	bin := _config.FFmpeg
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return nil, fmt.Errorf("audio decoding requires ffmpeg: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), videoDecodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0", "-f", "wav", "-acodec", "pcm_s16le", "-ac", "1", "pipe:1")
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("unable to decode audio: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// helper function to resample samples to given rate by linear interpolation
+func resample(samples []float64, from, to int) []float64 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	n := int(int64(len(samples)) * int64(to) / int64(from))
+	out := make([]float64, n)
+	ratio := float64(from) / float64(to)
+	for i := range out {
+		pos := float64(i) * ratio
+		j := int(pos)
+		if j+1 >= len(samples) {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = samples[j]*(1-frac) + samples[j+1]*frac
+	}
+	return out
+}
+
+// helper function to compute in-place radix-2 FFT of given values
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := x[start+k]
+				v := x[start+k+size/2] * wk
+				x[start+k] = u + v
+				x[start+k+size/2] = u - v
+				wk *= w
+			}
+		}
+	}
+}
+
+// stftMagnitude computes magnitude spectrogram of samples, i.e. frames x
+// (fft_length/2+1) matrix, frames which do not fit into samples are dropped
+func stftMagnitude(samples []float64, c AudioConfig) ([][]float64, error) {
+	if c.FFTLength&(c.FFTLength-1) != 0 || c.FFTLength < c.FrameLength {
+		return nil, fmt.Errorf("FFT length %d should be power of 2 not smaller than frame length %d", c.FFTLength, c.FrameLength)
+	}
+	if len(samples) < c.FrameLength {
+		return nil, fmt.Errorf("audio of %d samples is shorter than frame length %d", len(samples), c.FrameLength)
+	}
+	// periodic Hann window
+	window := make([]float64, c.FrameLength)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(c.FrameLength))
+	}
+	nframes := 1 + (len(samples)-c.FrameLength)/c.FrameStep
+	bins := c.FFTLength/2 + 1
+	out := make([][]float64, nframes)
+	buf := make([]complex128, c.FFTLength)
+	for f := range out {
+		for i := range buf {
+			buf[i] = 0
+		}
+		for i, w := range window {
+			buf[i] = complex(samples[f*c.FrameStep+i]*w, 0)
+		}
+		fft(buf)
+		out[f] = make([]float64, bins)
+		for i := range out[f] {
+			out[f][i] = cmplx.Abs(buf[i])
+		}
+	}
+	return out, nil
+}
+
+// helper function to convert frequency into mel scale (HTK formula)
+func hzToMel(hz float64) float64 {
+	return 1127 * math.Log(1+hz/700)
+}
+
+// melWeights computes bins x mel_bins matrix of triangular mel filters in
+// the same way as tf.signal.linear_to_mel_weight_matrix
+func melWeights(bins int, c AudioConfig) [][]float64 {
+	nyquist := float64(c.SampleRate) / 2
+	lower, upper := hzToMel(c.LowerHz), hzToMel(c.UpperHz)
+	edges := make([]float64, c.MelBins+2)
+	for i := range edges {
+		edges[i] = lower + (upper-lower)*float64(i)/float64(c.MelBins+1)
+	}
+	weights := make([][]float64, bins)
+	for i := range weights {
+		weights[i] = make([]float64, c.MelBins)
+		if i == 0 {
+			// DC bin does not contribute to mel spectrum
+			continue
+		}
+		mel := hzToMel(nyquist * float64(i) / float64(bins-1))
+		for m := 0; m < c.MelBins; m++ {
+			lo := (mel - edges[m]) / (edges[m+1] - edges[m])
+			hi := (edges[m+2] - mel) / (edges[m+2] - edges[m+1])
+			weights[i][m] = math.Max(0, math.Min(lo, hi))
+		}
+	}
+	return weights
+}
+
+// audioFeatures converts samples into features of given configuration,
+// it returns flat features and their shape without batch dimension
+func audioFeatures(samples []float64, c AudioConfig) ([]float32, []int64, error) {
+	if c.Features == audioWaveform {
+		out := make([]float32, len(samples))
+		for i, v := range samples {
+			out[i] = float32(v)
+		}
+		return out, []int64{int64(len(out))}, nil
+	}
+	spec, err := stftMagnitude(samples, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows := spec
+	switch c.Features {
+	case audioSpectrogram:
+	case audioLogMel, audioMFCC:
+		weights := melWeights(len(spec[0]), c)
+		rows = make([][]float64, len(spec))
+		for f, frame := range spec {
+			mel := make([]float64, c.MelBins)
+			for i, v := range frame {
+				for m, w := range weights[i] {
+					mel[m] += v * w
+				}
+			}
+			for m := range mel {
+				mel[m] = math.Log(mel[m] + 1e-6)
+			}
+			rows[f] = mel
+			if c.Features == audioMFCC {
+				rows[f] = mfcc(mel, c.MFCCs)
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported audio features %s", c.Features)
+	}
+	var out []float32
+	for _, row := range rows {
+		for _, v := range row {
+			out = append(out, float32(v))
+		}
+	}
+	return out, []int64{int64(len(rows)), int64(len(rows[0]))}, nil
+}
+
+// helper function to compute MFCCs of log mel spectrum in the same way as
+// tf.signal.mfccs_from_log_mel_spectrograms, i.e. scaled DCT-II
+func mfcc(logMel []float64, n int) []float64 {
+	if n > len(logMel) {
+		n = len(logMel)
+	}
+	size := float64(len(logMel))
+	scale := 1 / math.Sqrt(2*size)
+	out := make([]float64, n)
+	for k := range out {
+		var sum float64
+		for i, v := range logMel {
+			sum += v * math.Cos(math.Pi*float64(k)*(2*float64(i)+1)/(2*size))
+		}
+		out[k] = 2 * sum * scale
+	}
+	return out
+}
+
+// audioTensor converts audio file into input tensor of the model
+func audioTensor(data []byte, c AudioConfig) (TFTensor, error) {
+	c = c.withDefaults()
+	if !bytes.HasPrefix(data, []byte("RIFF")) {
+		var err error
+		if data, err = ffmpegWAV(data); err != nil {
+			return nil, err
+		}
+	}
+	samples, rate, err := decodeWAV(data)
+	if err != nil {
+		return nil, err
+	}
+	if seconds := float64(len(samples)) / float64(rate); seconds > c.MaxSeconds {
+		return nil, fmt.Errorf("audio of %.1f seconds is longer than %v seconds", seconds, c.MaxSeconds)
+	}
+	samples = resample(samples, rate, c.SampleRate)
+	values, shape, err := audioFeatures(samples, c)
+	if err != nil {
+		return nil, err
+	}
+	shape = append([]int64{1}, shape...)
+	if c.Channel {
+		shape = append(shape, 1)
+	}
+	return makeFlatTensor(values, shape)
+}
+
+// AudioHandler provides predictions of audio classification models
+func AudioHandler(w http.ResponseWriter, r *http.Request) {
+	model := resolveModel(r.FormValue("model"))
+	if model == "" {
+		responseError(w, "audio predictions require audio model", nil, http.StatusBadRequest)
+		return
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model params", err, http.StatusBadRequest)
+		return
+	}
+	if params.Audio == nil {
+		msg := fmt.Sprintf("model %s does not support audio predictions", model)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	topN := 5
+	if v := r.FormValue("top_n"); v != "" {
+		if topN, err = strconv.Atoi(v); err != nil || topN <= 0 {
+			responseError(w, fmt.Sprintf("invalid top_n %s", v), err, http.StatusBadRequest)
+			return
+		}
+	}
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		responseError(w, "unable to read audio", err, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxAudioSize+1))
+	if err == nil && len(data) > maxAudioSize {
+		err = fmt.Errorf("audio exceeds %d bytes", maxAudioSize)
+	}
+	if err != nil {
+		responseError(w, "unable to read audio", err, http.StatusBadRequest)
+		return
+	}
+	tensor, err := audioTensor(data, *params.Audio)
+	if err != nil {
+		responseError(w, "invalid audio", err, http.StatusBadRequest)
+		return
+	}
+	observeUsage(usageClient(r), model, 1)
+	rows, err := makeBatchPredictions(model, nil, tensor)
+	if err == nil && len(rows) == 0 {
+		err = fmt.Errorf("model %s produced empty output", model)
+	}
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
+		return
+	}
+	probs := rows[0]
+	raw := rawOutputs(model, rawRequested(r))
+	labels := decisionLabels(model, params)
+	if raw || len(labels) == 0 {
+		setOutputShapeHeader(w, model, "")
+		setRawOutputsHeader(w, raw)
+		responsePredictions(w, model, "", probs, raw)
+		return
+	}
+	decision, _ := decide(model, probs)
+	responseJSON(w, ClassifyResult{
+		Filename: header.Filename,
+		Labels:   bestLabels(labels, probs, topN),
+		Decision: decision,
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+// tests of audio predictions, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// helper function to create 16-bit stereo WAV file with sine of given
+// frequency and duration
+func testWAV(freq float64, rate int, seconds float64) []byte {
+	n := int(float64(rate) * seconds)
+	var data bytes.Buffer
+	for i := 0; i < n; i++ {
+		v := int16(0.5 * math.MaxInt16 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+		binary.Write(&data, binary.LittleEndian, v)
+		binary.Write(&data, binary.LittleEndian, v)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{uint32(16), uint16(1), uint16(2), uint32(rate), uint32(rate * 4), uint16(4), uint16(16)} {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// TestDecodeWAV checks decoding of WAV files
+func TestDecodeWAV(t *testing.T) {
+	samples, rate, err := decodeWAV(testWAV(440, 8000, 0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 8000 || len(samples) != 4000 {
+		t.Fatalf("wrong WAV rate %d or samples %d", rate, len(samples))
+	}
+	var peak float64
+	for _, v := range samples {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	if math.Abs(peak-0.5) > 0.01 {
+		t.Errorf("wrong peak amplitude %v", peak)
+	}
+	if _, _, err := decodeWAV([]byte("fLaC")); err == nil {
+		t.Error("non WAV data is decoded")
+	}
+	if out := resample(samples, 8000, 16000); len(out) != 8000 {
+		t.Errorf("wrong number of resampled samples %d", len(out))
+	}
+}
+
+// TestAudioFeatures checks spectrogram, log mel and MFCC features
+func TestAudioFeatures(t *testing.T) {
+	c := AudioConfig{SampleRate: 8000, Features: audioSpectrogram, FrameLength: 256, FrameStep: 128}.withDefaults()
+	samples, _, _ := decodeWAV(testWAV(1000, 8000, 0.5))
+	values, shape, err := audioFeatures(samples, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shape) != 2 || shape[0] != 30 || shape[1] != 129 || len(values) != 30*129 {
+		t.Fatalf("wrong spectrogram shape %v", shape)
+	}
+	// 1 kHz sine has its peak at bin 1000/(8000/256) = 32
+	best := 0
+	for i, v := range values[:129] {
+		if v > values[best] {
+			best = i
+		}
+	}
+	if best != 32 {
+		t.Errorf("wrong spectrogram peak bin %d", best)
+	}
+	for _, tt := range []struct {
+		features string
+		bins     int64
+	}{{audioLogMel, 64}, {audioMFCC, 13}} {
+		c.Features = tt.features
+		_, shape, err := audioFeatures(samples, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shape[0] != 30 || shape[1] != tt.bins {
+			t.Errorf("wrong %s shape %v", tt.features, shape)
+		}
+	}
+	c.Features = "chroma"
+	if _, _, err := audioFeatures(samples, c); err == nil {
+		t.Error("unknown features are accepted")
+	}
+	if _, _, err := audioFeatures(samples[:100], AudioConfig{}.withDefaults()); err == nil {
+		t.Error("audio shorter than frame is accepted")
+	}
+}
+
+// TestMelWeights checks triangular mel filters
+func TestMelWeights(t *testing.T) {
+	c := AudioConfig{SampleRate: 16000, MelBins: 8}.withDefaults()
+	weights := melWeights(257, c)
+	for m := 0; m < c.MelBins; m++ {
+		var peak float64
+		for _, w := range weights {
+			peak = math.Max(peak, w[m])
+		}
+		if peak <= 0.5 || peak > 1 {
+			t.Errorf("wrong peak %v of mel filter %d", peak, m)
+		}
+	}
+	for _, w := range weights[0] {
+		if w != 0 {
+			t.Fatal("DC bin contributes to mel spectrum")
+		}
+	}
+}
+
+// helper function to create audio request with given form fields
+func audioRequest(t *testing.T, audio []byte, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	part, err := writer.CreateFormFile("audio", "sensor.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(audio)
+	writer.Close()
+	req := httptest.NewRequest("POST", "/predict/audio", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// TestFakeAudio checks audio predictions
+func TestFakeAudio(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	params.Audio = &AudioConfig{SampleRate: 16000, Features: audioMFCC, Channel: true}
+	writeModelFiles(t, "sensor", []byte("sensor"), params)
+
+	// 8 kHz audio is resampled to 16 kHz, i.e. 1 + (8000-400)/160 frames
+	req := audioRequest(t, testWAV(440, 8000, 0.5), map[string]string{"model": "sensor", "top_n": "2"})
+	rr := httptest.NewRecorder()
+	AudioHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var res ClassifyResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Filename != "sensor.wav" || len(res.Labels) != 2 || res.Labels[0].Label != "c" {
+		t.Errorf("wrong audio result %+v", res)
+	}
+	shape := fake.Feeds()["input"].Shape()
+	if len(shape) != 4 || shape[0] != 1 || shape[1] != 48 || shape[2] != 13 || shape[3] != 1 {
+		t.Errorf("wrong input shape %v", shape)
+	}
+
+	// models without audio configuration are rejected
+	req = audioRequest(t, testWAV(440, 8000, 0.5), map[string]string{"model": "dnn"})
+	rr = httptest.NewRecorder()
+	AudioHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of model without audio", rr.Code)
+	}
+	// too long audio is rejected
+	params.Audio.MaxSeconds = 0.25
+	writeModelFiles(t, "sensor", []byte("sensor"), params)
+	resetModelCache("sensor")
+	req = audioRequest(t, testWAV(440, 8000, 0.5), map[string]string{"model": "sensor"})
+	rr = httptest.NewRecorder()
+	AudioHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of too long audio", rr.Code)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+// backup module provides periodic backups of model area
+//
+// When "backupDestination" is configured, either directory (e.g. mounted
+// bucket "/mnt/backups") or HTTP object store (e.g. S3 compatible gateway
+// "https://store.example.com/tfaas-backups", authorized with "backupToken"
+// option), the leader replica snapshots model area every "backupInterval"
+// seconds (default 1 hour). Only new or changed models (according to
+// checksums of their model areas) are uploaded as model.<model>.<time>.tar.gz
+// bundles (UTC time with milliseconds), and every backup which uploads
+// bundles writes catalog.<time>.tar.gz with catalog.json (model parameters
+// and backup index, i.e. bundles of every model) and aliases.json. For every model and for the
+// catalog only "backupRetention" (default 7) most recent objects are kept,
+// bundles of deleted models are kept until they expire in the same way.
+// The backup index is kept in modelDir/.backups.json, GET /admin/backups
+// provides it and POST /admin/backups runs backup immediately.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default interval in seconds of model backups
+const defaultBackupInterval = 3600
+
+// default number of kept backups of every model and catalog
+const defaultBackupRetention = 7
+
+// BackupRecord represents backup object
+type BackupRecord struct {
+	Object   string `json:"object"`             // object name in backup destination
+	Checksum string `json:"checksum,omitempty"` // checksum of model area
+	Time     string `json:"time"`               // backup time
+}
+
+// BackupIndex represents index of backup objects
+type BackupIndex struct {
+	Models   map[string][]BackupRecord `json:"models"`   // backups of every model
+	Catalogs []BackupRecord            `json:"catalogs"` // backups of catalog
+	Last     string                    `json:"last"`     // time of the last backup run
+	Error    string                    `json:"error"`    // error of the last backup run
+}
+
+// backupLock serializes backup runs
+var backupLock sync.Mutex
+
+// helper function to return location of backup index
+func backupIndexFile() string {
+	return filepath.Join(_config.ModelDir, ".backups.json")
+}
+
+// helper function to load backup index
+func loadBackupIndex() BackupIndex {
+	index := BackupIndex{Models: make(map[string][]BackupRecord)}
+	data, err := ioutil.ReadFile(backupIndexFile())
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			log.Println("unable to parse backup index", err)
+		}
+	}
+	if index.Models == nil {
+		index.Models = make(map[string][]BackupRecord)
+	}
+	return index
+}
+
+// helper function to write backup index
+func (index *BackupIndex) write() error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	fname := backupIndexFile()
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// helper function to create store of backup destination
+func backupStore() (ModelStore, error) {
+	store, err := newModelStore(_config.BackupDestination)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := store.(*httpStore); ok {
+		s.token = _config.BackupToken
+	}
+	return store, nil
+}
+
+// helper function to return number of kept backups
+func backupRetention() int {
+	if _config.BackupRetention > 0 {
+		return _config.BackupRetention
+	}
+	return defaultBackupRetention
+}
+
+// helper function to upload data of given writer function into backup
+// store, the data is spooled to temporary file first
+func putBackup(store ModelStore, name string, write func(io.Writer) error) error {
+	file, err := ioutil.TempFile("", "backup-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return store.Put(name, file)
+}
+
+// helper function to remove backups beyond retention, it returns kept records
+func expireBackups(store ModelStore, records []BackupRecord) []BackupRecord {
+	limit := backupRetention()
+	if len(records) <= limit {
+		return records
+	}
+	for _, rec := range records[:len(records)-limit] {
+		if err := store.Delete(rec.Object); err != nil && err != errModelNotInStore {
+			log.Printf("unable to remove backup %s: %v", rec.Object, err)
+		}
+	}
+	return records[len(records)-limit:]
+}
+
+// helper function to write catalog archive of the backup
+func writeBackupCatalog(w io.Writer, index BackupIndex) error {
+	models, err := TFModels()
+	if err != nil {
+		return err
+	}
+	catalog, err := json.MarshalIndent(map[string]interface{}{"models": models, "backups": index.Models}, "", "  ")
+	if err != nil {
+		return err
+	}
+	amap := make(map[string]Alias)
+	for _, a := range _aliases.list() {
+		amap[a.Name] = a
+	}
+	aliases, err := json.MarshalIndent(amap, "", "  ")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, "catalog.json", catalog); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "aliases.json", aliases); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// runBackup uploads new and changed models and catalog into backup
+// destination, it returns updated backup index
+func runBackup() (BackupIndex, error) {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+	index := loadBackupIndex()
+	now := time.Now().UTC()
+	index.Last = now.Format(time.RFC3339)
+	index.Error = ""
+	store, err := backupStore()
+	if err != nil {
+		return index, err
+	}
+	stamp := now.Format("20060102T150405.000Z")
+	files, err := ioutil.ReadDir(_config.ModelDir)
+	if err != nil {
+		return index, err
+	}
+	var uploaded, failed []string
+	for _, f := range files {
+		model := f.Name()
+		if !f.IsDir() || strings.HasPrefix(model, ".") {
+			continue
+		}
+		checksum, err := getModelChecksum(model)
+		if err != nil {
+			log.Printf("unable to compute checksum of %s model: %v", model, err)
+			failed = append(failed, model)
+			continue
+		}
+		records := index.Models[model]
+		if n := len(records); n > 0 && records[n-1].Checksum == checksum {
+			continue
+		}
+		name := fmt.Sprintf("model.%s.%s", model, stamp)
+		path := filepath.Join(_config.ModelDir, model)
+		err = putBackup(store, name, func(w io.Writer) error { return writeBundle(w, path) })
+		if err != nil {
+			log.Printf("unable to backup %s model: %v", model, err)
+			failed = append(failed, model)
+			continue
+		}
+		records = append(records, BackupRecord{Object: name, Checksum: checksum, Time: index.Last})
+		index.Models[model] = expireBackups(store, records)
+		uploaded = append(uploaded, model)
+	}
+	if len(uploaded) > 0 || len(index.Catalogs) == 0 {
+		name := fmt.Sprintf("catalog.%s", stamp)
+		err = putBackup(store, name, func(w io.Writer) error { return writeBackupCatalog(w, index) })
+		if err != nil {
+			log.Println("unable to backup catalog", err)
+			failed = append(failed, "catalog")
+		} else {
+			index.Catalogs = expireBackups(store, append(index.Catalogs, BackupRecord{Object: name, Time: index.Last}))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		index.Error = fmt.Sprintf("unable to backup %s", strings.Join(failed, ", "))
+	}
+	if err := index.write(); err != nil {
+		return index, err
+	}
+	if len(uploaded) > 0 {
+		log.Printf("backup: uploaded %d models %v to %s", len(uploaded), uploaded, _config.BackupDestination)
+	}
+	return index, nil
+}
+
+// backupScheduler periodically backs up model area
+func backupScheduler() {
+	if _config.BackupDestination == "" {
+		return
+	}
+	interval := _config.BackupInterval
+	if interval <= 0 {
+		interval = defaultBackupInterval
+	}
+	log.Printf("backup model area to %s every %d seconds", _config.BackupDestination, interval)
+	for {
+		// model area is shared by replicas, it is backed up by the leader
+		if isLeader() {
+			if index, err := runBackup(); err != nil {
+				log.Println("unable to backup model area", err)
+			} else if index.Error != "" {
+				log.Println("backup:", index.Error)
+			}
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// BackupsHandler provides backup index (GET) or runs backup (POST)
+func BackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if _config.BackupDestination == "" {
+		responseError(w, "backups are not configured", nil, http.StatusNotFound)
+		return
+	}
+	if r.Method == "GET" {
+		responseJSON(w, loadBackupIndex())
+		return
+	}
+	index, err := runBackup()
+	if err != nil {
+		responseError(w, "unable to backup model area", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, index)
+}
@@ -0,0 +1,77 @@
+package main
+
+// tests of model area backups, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to list backup objects of given prefix
+func backupObjects(t *testing.T, dir, prefix string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix) {
+			out = append(out, f.Name())
+		}
+	}
+	return out
+}
+
+// TestBackup checks incremental backups of model area and their retention
+func TestBackup(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	dest := t.TempDir()
+	_config.BackupDestination = dest
+	_config.BackupRetention = 2
+
+	index, err := runBackup()
+	if err != nil || index.Error != "" {
+		t.Fatalf("unable to backup model area: %v %s", err, index.Error)
+	}
+	if n := len(backupObjects(t, dest, "model.")); n != 3 || len(index.Catalogs) != 1 {
+		t.Fatalf("unexpected backups: %d models, %d catalogs", n, len(index.Catalogs))
+	}
+	// unchanged models are not uploaded again
+	if index, _ = runBackup(); len(backupObjects(t, dest, "model.")) != 3 || len(index.Catalogs) != 1 {
+		t.Fatal("unchanged models are backed up again")
+	}
+	// changed model is uploaded and old backups expire
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		fname := filepath.Join(_config.ModelDir, "dnn", "labels.txt")
+		ioutil.WriteFile(fname, []byte(strings.Repeat("x\n", i+1)), 0644)
+		removeModelChecksum("dnn")
+		if index, err = runBackup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if objects := backupObjects(t, dest, "model.dnn."); len(objects) != 2 || len(index.Models["dnn"]) != 2 {
+		t.Errorf("unexpected backups of changed model %v", objects)
+	}
+	if objects := backupObjects(t, dest, "catalog."); len(objects) != 2 {
+		t.Errorf("unexpected catalog backups %v", objects)
+	}
+	if len(backupObjects(t, dest, "model.dnn2.")) != 1 {
+		t.Error("backup of unchanged model expired")
+	}
+
+	// backup index is provided by admin endpoint
+	w := httptest.NewRecorder()
+	BackupsHandler(w, httptest.NewRequest("GET", "/admin/backups", nil))
+	var rec BackupIndex
+	json.Unmarshal(w.Body.Bytes(), &rec)
+	if w.Code != http.StatusOK || len(rec.Models) != 3 || len(rec.Catalogs) != 2 {
+		t.Errorf("unexpected backup index, status %d: %s", w.Code, w.Body.String())
+	}
+}
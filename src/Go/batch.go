@@ -0,0 +1,262 @@
+package main
+
+// batch module provides predictions for batches of rows
+//
+// Batch inputs are represented by flat vector of values and explicit shape,
+// e.g. {"model": "dnn", "shape": [2, 3], "values": [1,2,3,4,5,6]}, which
+// allows to construct TF tensor without intermediate [][]float32 matrix.
+// Clients may also send raw float32 values (in native byte order) with
+// application/octet-stream content type, e.g.
+// POST /predict/batch?model=dnn&shape=2,3
+// in which case request body is read directly into TF tensor.
+// Self-describing binary payload is described in binary module.
+// Batches of sequences are provided with rank-3 shape, e.g.
+// [nsamples, timesteps, features].
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BatchRow represents batch of rows provided as flat vector of values
+type BatchRow struct {
+	Keys   []string  `json:"keys"`   // row attribute names
+	Values []float32 `json:"values"` // flat vector of row values
+	Shape  []int64   `json:"shape"`  // shape of the batch, e.g. [nrows, ncols]
+	Model  string    `json:"model"`  // TF model name to use
+
+	// flat indices of values for sparse batches
+	Indices []int64 `json:"indices,omitempty"`
+}
+
+// maximum number of elements of batch tensor (1GB of float32 values), it
+// protects the server from allocation of huge tensors for small requests
+const maxShapeSize = 1 << 28
+
+// helper function to calculate number of elements for given shape
+func shapeSize(shape []int64) (int64, error) {
+	if len(shape) == 0 {
+		return 0, errors.New("empty shape")
+	}
+	size := int64(1)
+	for _, d := range shape {
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid shape %v", shape)
+		}
+		if d > maxShapeSize/size {
+			return 0, fmt.Errorf("shape %v exceeds %d elements", shape, maxShapeSize)
+		}
+		size *= d
+	}
+	return size, nil
+}
+
+// helper function to read float32 values of given shape from request body
+// into tensor, the body of unknown length (chunked upload) is read up to
+// the size of the tensor before tensor memory is allocated
+func readBodyTensor(r *http.Request, shape []int64, size int64) (TFTensor, error) {
+	if r.ContentLength >= 0 {
+		return _tf.ReadTensor(shape, r.Body)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, size*4+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size*4 {
+		return nil, fmt.Errorf("body of %d bytes does not match shape %v", len(data), shape)
+	}
+	return _tf.ReadTensor(shape, bytes.NewReader(data))
+}
+
+// helper function to parse shape string, e.g. "2,3"
+func parseShape(s string) ([]int64, error) {
+	var shape []int64
+	for _, v := range strings.Split(s, ",") {
+		d, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shape '%s': %v", s, err)
+		}
+		shape = append(shape, d)
+	}
+	return shape, nil
+}
+
+// helper function to create tensor from flat vector of values with given
+// shape, the values are copied once into tensor memory and reshaped in place
+func makeFlatTensor(values []float32, shape []int64) (TFTensor, error) {
+	size, err := shapeSize(shape)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(values)) != size {
+		return nil, fmt.Errorf("number of values %d does not match shape %v", len(values), shape)
+	}
+	return _tf.NewTensor(values, shape)
+}
+
+// helper function to generate predictions for given batch tensor
+func makeBatchPredictions(name string, keys []string, tensor TFTensor) (probs [][]float32, err error) {
+	name = resolveModel(name)
+	start := time.Now()
+	defer func() { observeModelSLO(name, time.Since(start), err) }()
+	if err := breakerCheck(name); err != nil {
+		return nil, err
+	}
+	if err := injectModelFaults(name); err != nil {
+		return nil, err
+	}
+	tfModel, err := tfVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	touchModel(name)
+	if tfModel == xgboostBackend {
+		if len(tensor.Shape()) != 2 {
+			return nil, fmt.Errorf("model %s accepts only rank-2 batches", name)
+		}
+		rows, err := tensorRows(tensor)
+		if err != nil {
+			return nil, err
+		}
+		return makeBatchPredictionsXGB(name, keys, rows)
+	}
+	graph, input, output, err := modelGraph(name, tfModel)
+	if err != nil {
+		return nil, err
+	}
+	results, err := runSession(name, graph, map[string]TFTensor{input: tensor}, []string{output})
+	if err != nil {
+		return nil, err
+	}
+	return outputRows(name, results[0], tensorRowsCount(tensor))
+}
+
+// helper function to return graph of TF model with its input and output
+// nodes
+func modelGraph(name, tfModel string) (TFGraph, string, string, error) {
+	if tfModel == "tf2" {
+		graph, err := getModel(name)
+		if err != nil {
+			return nil, "", "", err
+		}
+		// model parameters are optional for TF 2.X models
+		params, _ := getModelParams(name)
+		input, output := params.tf2Nodes()
+		return graph, input, output, nil
+	}
+	tfm, err := _cache.get(name)
+	if err != nil {
+		return nil, "", "", err
+	}
+	input, output := tfm.Params.nodes()
+	return tfm.Graph, input, output, nil
+}
+
+// helper function to read batch tensor from HTTP request
+func readBatchTensor(r *http.Request) (string, []string, TFTensor, error) {
+	if isBinaryBatchRequest(r) {
+		model, tensor, err := readBinaryBatch(r)
+		return model, nil, tensor, err
+	}
+	// custom payload formats, see decoders module
+	if decoder, mediaType, params := requestDecoder(r); decoder != nil {
+		return readDecodedBatch(r, decoder, mediaType, params)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream") {
+		model := r.URL.Query().Get("model")
+		shape, err := parseShape(r.URL.Query().Get("shape"))
+		if err != nil {
+			return model, nil, nil, err
+		}
+		size, err := shapeSize(shape)
+		if err != nil {
+			return model, nil, nil, err
+		}
+		if r.ContentLength >= 0 && r.ContentLength != size*4 {
+			return model, nil, nil, fmt.Errorf("content length %d does not match shape %v", r.ContentLength, shape)
+		}
+		// read request body directly into tensor memory
+		tensor, err := readBodyTensor(r, shape, size)
+		return model, nil, tensor, err
+	}
+	buf, err := readBuffer(r.Body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer putBuffer(buf)
+	var batch BatchRow
+	if err := json.Unmarshal(buf.Bytes(), &batch); err != nil {
+		return "", nil, nil, err
+	}
+	shape := batch.Shape
+	if len(shape) == 0 && len(batch.Keys) > 0 {
+		shape = []int64{int64(len(batch.Values) / len(batch.Keys)), int64(len(batch.Keys))}
+	}
+	values := batch.Values
+	if len(batch.Indices) > 0 {
+		size, err := shapeSize(shape)
+		if err != nil {
+			return batch.Model, nil, nil, err
+		}
+		if values, err = densify(batch.Indices, batch.Values, size); err != nil {
+			return batch.Model, nil, nil, err
+		}
+	}
+	tensor, err := makeFlatTensor(values, shape)
+	return batch.Model, batch.Keys, tensor, err
+}
+
+// BatchHandler provides predictions for batch of rows
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectLargeBatch(w, r) || decodeRequestBody(w, r) {
+		return
+	}
+	if isArrowRequest(r) || isParquetRequest(r) {
+		ArrowBatchHandler(w, r)
+		return
+	}
+	defer r.Body.Close()
+	ctype := negotiateOutput(r, jsonType)
+	if rejectOutputFormat(w, ctype) {
+		return
+	}
+	model, keys, tensor, err := readBatchTensor(r)
+	if err != nil {
+		responseError(w, "unable to read batch", err, http.StatusBadRequest)
+		return
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	sinks, err := selectResultSinks(r, model)
+	if err != nil {
+		responseError(w, "invalid result sinks", err, http.StatusBadRequest)
+		return
+	}
+	observeUsage(usageClient(r), model, tensorRowsCount(tensor))
+	raw := rawOutputs(model, rawRequested(r))
+	if r.URL.Query().Get("output") == "store" {
+		storeBatchProbs(w, model, keys, tensor, raw)
+		return
+	}
+	if streamRequested(r, ctype) {
+		streamBatchProbs(w, model, keys, tensor, raw)
+		return
+	}
+	probs, err := makeBatchPredictions(model, keys, tensor)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make batch predictions", err, http.StatusInternalServerError)
+		return
+	}
+	writeResultSinks(sinks, model, "", probs)
+	responseBatchOutput(w, ctype, model, probs, raw)
+}
@@ -0,0 +1,112 @@
+package main
+
+// tests of batch predictions, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestBatchShape checks parsing and validation of batch shapes
+func TestBatchShape(t *testing.T) {
+	if shape, err := parseShape("2, 3,4"); err != nil || !reflect.DeepEqual(shape, []int64{2, 3, 4}) {
+		t.Fatalf("wrong shape %v: %v", shape, err)
+	}
+	if _, err := parseShape("2,x"); err == nil {
+		t.Fatal("invalid shape is parsed")
+	}
+	if size, err := shapeSize([]int64{2, 3, 4}); err != nil || size != 24 {
+		t.Fatalf("wrong size %d of shape: %v", size, err)
+	}
+	for _, shape := range [][]int64{nil, {2, 0}, {-1, 3}, {4294967296, 4294967296}, {maxShapeSize, 2}} {
+		if _, err := shapeSize(shape); err == nil {
+			t.Errorf("invalid shape %v has size", shape)
+		}
+	}
+	setupFakeModels(t, 10, 0)
+	if _, err := makeFlatTensor([]float32{1, 2, 3}, []int64{2, 2}); err == nil {
+		t.Fatal("tensor is created for values which do not match shape")
+	}
+}
+
+// helper function to return flat values of fake tensor
+func flatValues(tensor TFTensor) []float32 {
+	switch v := tensor.Value().(type) {
+	case []float32:
+		return v
+	case [][]float32:
+		var out []float32
+		for _, row := range v {
+			out = append(out, row...)
+		}
+		return out
+	}
+	return nil
+}
+
+// TestBatchTensor checks that batch inputs are fed to the model as flat
+// tensors of given shape
+func TestBatchTensor(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	values := []float32{1, 2, 3, 4, 5, 6, 7, 8}
+	checkInput := func(name string, w *httptest.ResponseRecorder, shape []int64) {
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: wrong status code %d: %s", name, w.Code, w.Body.String())
+		}
+		input := fake.Feeds()["input"]
+		if !reflect.DeepEqual(flatValues(input), values) || !reflect.DeepEqual(input.Shape(), shape) {
+			t.Fatalf("%s: wrong input tensor %v shape %v", name, input.Value(), input.Shape())
+		}
+		var probs [][]float32
+		if err := json.Unmarshal(w.Body.Bytes(), &probs); err != nil || len(probs) != int(shape[0]) {
+			t.Fatalf("%s: wrong predictions %s: %v", name, w.Body.String(), err)
+		}
+	}
+
+	// shape of JSON batch is taken from keys if it is not provided
+	data, _ := json.Marshal(BatchRow{Model: "dnn", Keys: []string{"a", "b", "c", "d"}, Values: values})
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	checkInput("keys", w, []int64{2, 4})
+
+	// batch of sequences
+	data, _ = json.Marshal(BatchRow{Model: "dnn", Values: values, Shape: []int64{2, 2, 2}})
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	checkInput("sequences", w, []int64{2, 2, 2})
+
+	// raw values are read into tensor of given shape
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, values)
+	req := httptest.NewRequest("POST", "/predict/batch?model=dnn&shape=4,2", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	BatchHandler(w, req)
+	checkInput("raw", w, []int64{4, 2})
+
+	// body of unknown length is checked against the shape
+	req = httptest.NewRequest("POST", "/predict/batch?model=dnn&shape=2,4", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	BatchHandler(w, req)
+	checkInput("chunked", w, []int64{2, 4})
+
+	for _, query := range []string{"shape=3,2", "shape=4,x", "", "shape=4294967296,4294967296"} {
+		for _, length := range []int64{int64(buf.Len()), -1} {
+			req := httptest.NewRequest("POST", "/predict/batch?model=dnn&"+query, bytes.NewReader(buf.Bytes()))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.ContentLength = length
+			w := httptest.NewRecorder()
+			BatchHandler(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("wrong status code %d of raw batch with %s and content length %d", w.Code, query, length)
+			}
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+// batching module provides micro-batching of single row predictions and its
+// automatic tuning
+//
+// Concurrent single row predictions (/json API, Kafka, NATS and MQTT
+// messages) of TF models may be collected into micro-batches which run as
+// one session run, trading few milliseconds of latency for throughput.
+// Micro-batching is enabled per model by "batching" parameter in
+// params.json, e.g.
+// "batching": {"max_batch": 32, "window": 2}
+// where window is time in milliseconds to wait for rows of the batch. With
+// "batching": {"tune": true} the server picks max batch size and window of
+// the model automatically: on warm-up of the model (its first batched
+// request) it probes the model with batches of 1, 2, 4, ... 128 copies of
+// the row, measures latency and throughput of every batch size and picks the
+// smallest batch size which reaches 90% of the best throughput, while the
+// window is latency of single row (at most 100ms), such that waiting for
+// rows at most doubles latency of the request. Rows are not batched until
+// tuning is finished. Rows with sequences or overrides are never batched.
+// Batch settings and number of batched rows are reported by
+// tfaas_microbatch_* metrics.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batch tuning options
+const (
+	maxTuneBatch   = 128                    // largest probed batch size
+	tuneRuns       = 5                      // number of measured runs of every batch size
+	tuneThroughput = 0.9                    // fraction of best throughput of picked batch size
+	minBatchWindow = 100 * time.Microsecond // min tuned window
+	maxBatchWindow = 100 * time.Millisecond // max tuned window
+)
+
+// BatchingConfig represents micro-batching parameters of the model
+type BatchingConfig struct {
+	MaxBatch int  `json:"max_batch"` // max number of rows of micro-batch
+	Window   int  `json:"window"`    // time in milliseconds to wait for rows of micro-batch
+	Tune     bool `json:"tune"`      // pick max_batch and window by probing the model
+}
+
+// BatchProbe represents measurement of batch size of the tuner
+type BatchProbe struct {
+	Size       int     `json:"size"`       // batch size
+	Latency    float64 `json:"latency"`    // median latency of the batch in seconds
+	Throughput float64 `json:"throughput"` // rows per second
+}
+
+// batchItem represents row waiting for micro-batch
+type batchItem struct {
+	values []float32
+	done   chan batchResult
+}
+
+// batchResult represents predictions of the row of micro-batch
+type batchResult struct {
+	probs []float32
+	err   error
+}
+
+// microBatcher collects rows of the model into micro-batches
+type microBatcher struct {
+	model   string          // model name
+	tfModel string          // model type, tf1 or tf2
+	ncols   int             // number of row values
+	queue   chan *batchItem // rows waiting for the batcher
+	quit    chan struct{}   // closed when batcher is removed
+	batches uint64          // number of run batches
+	rows    uint64          // number of batched rows
+
+	lock     sync.Mutex
+	maxBatch int           // max number of rows of the batch
+	window   time.Duration // time to wait for rows of the batch
+	probes   []BatchProbe  // measurements of the tuner
+}
+
+// global micro-batchers of models
+var (
+	_batchers     = make(map[string]*microBatcher)
+	_batchersLock sync.Mutex
+)
+
+// helper function to return micro-batching parameters of the model, it
+// returns nil if row of the model is not batched
+func rowBatching(name string, row *Row) *BatchingConfig {
+	// self-test rows are not batched with client requests
+	if row.selfTest || row.Overrides != nil || len(row.Sequence) > 0 || len(row.Values) == 0 {
+		return nil
+	}
+	params, err := getModelParams(name)
+	if err != nil || params.Batching == nil {
+		return nil
+	}
+	if params.Batching.MaxBatch <= 1 && !params.Batching.Tune {
+		return nil
+	}
+	return params.Batching
+}
+
+// helper function to return micro-batcher of the model and rows of given
+// size, the batcher is created (and tuned) on first use
+func getBatcher(name, tfModel string, cfg *BatchingConfig, values []float32) *microBatcher {
+	key := fmt.Sprintf("%s/%d", name, len(values))
+	_batchersLock.Lock()
+	defer _batchersLock.Unlock()
+	if b, ok := _batchers[key]; ok {
+		return b
+	}
+	b := &microBatcher{
+		model:    name,
+		tfModel:  tfModel,
+		ncols:    len(values),
+		queue:    make(chan *batchItem),
+		quit:     make(chan struct{}),
+		maxBatch: cfg.MaxBatch,
+		window:   time.Duration(cfg.Window) * time.Millisecond,
+	}
+	if cfg.Tune {
+		// rows are not batched until tuning is finished
+		b.maxBatch = 1
+		go b.tune(append([]float32{}, values...))
+	}
+	_batchers[key] = b
+	go b.loop()
+	return b
+}
+
+// removeBatchers stops micro-batchers of given model
+func removeBatchers(model string) {
+	_batchersLock.Lock()
+	defer _batchersLock.Unlock()
+	for key, b := range _batchers {
+		if b.model == model {
+			close(b.quit)
+			delete(_batchers, key)
+		}
+	}
+}
+
+// helper function to make predictions of the row via micro-batcher of the
+// model
+func makeBatchedPredictions(name, tfModel string, cfg *BatchingConfig, row *Row) ([]float32, error) {
+	b := getBatcher(name, tfModel, cfg, row.Values)
+	item := &batchItem{values: row.Values, done: make(chan batchResult, 1)}
+	select {
+	case b.queue <- item:
+	case <-b.quit:
+		// batcher is removed, e.g. model is reloaded, row runs on its own
+		b.run([]*batchItem{item})
+	}
+	res := <-item.done
+	return res.probs, res.err
+}
+
+// helper function to return batch settings of the batcher
+func (b *microBatcher) settings() (int, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.maxBatch, b.window
+}
+
+// loop runs micro-batches of rows of the batcher
+func (b *microBatcher) loop() {
+	for {
+		select {
+		case item := <-b.queue:
+			b.run(b.collect(item))
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// collect collects rows of the batch until batch is full or window expires
+func (b *microBatcher) collect(first *batchItem) []*batchItem {
+	items := []*batchItem{first}
+	maxBatch, window := b.settings()
+	if maxBatch <= 1 {
+		return items
+	}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(items) < maxBatch {
+		select {
+		case item := <-b.queue:
+			items = append(items, item)
+		case <-timer.C:
+			return items
+		}
+	}
+	return items
+}
+
+// run makes predictions of the batch and passes them to waiting rows
+func (b *microBatcher) run(items []*batchItem) {
+	values := make([]float32, 0, len(items)*b.ncols)
+	for _, item := range items {
+		values = append(values, item.values...)
+	}
+	rows, err := runBatch(b.model, b.tfModel, values, len(items), b.ncols)
+	if err == nil && len(rows) != len(items) {
+		err = fmt.Errorf("model %s produced %d outputs for batch of %d rows", b.model, len(rows), len(items))
+	}
+	atomic.AddUint64(&b.batches, 1)
+	atomic.AddUint64(&b.rows, uint64(len(items)))
+	for i, item := range items {
+		res := batchResult{err: err}
+		if err == nil {
+			res.probs = rows[i]
+		}
+		item.done <- res
+	}
+}
+
+// helper function to run batch of rows of the model
+func runBatch(name, tfModel string, values []float32, nrows, ncols int) ([][]float32, error) {
+	tensor, err := makeFlatTensor(values, []int64{int64(nrows), int64(ncols)})
+	if err != nil {
+		return nil, err
+	}
+	graph, input, output, err := modelGraph(name, tfModel)
+	if err != nil {
+		return nil, err
+	}
+	results, err := runSession(name, graph, map[string]TFTensor{input: tensor}, []string{output})
+	if err != nil {
+		return nil, err
+	}
+	return outputRows(name, results[0], nrows)
+}
+
+// tune probes the model with batches of given row and picks batch settings
+func (b *microBatcher) tune(values []float32) {
+	var probes []BatchProbe
+	for size := 1; size <= maxTuneBatch; size *= 2 {
+		batch := make([]float32, 0, size*len(values))
+		for i := 0; i < size; i++ {
+			batch = append(batch, values...)
+		}
+		var latencies []time.Duration
+		var err error
+		// first run warms up the model and is not measured
+		for i := 0; i <= tuneRuns && err == nil; i++ {
+			start := time.Now()
+			_, err = runBatch(b.model, b.tfModel, batch, size, b.ncols)
+			if i > 0 {
+				latencies = append(latencies, time.Since(start))
+			}
+		}
+		if err != nil {
+			// model may not accept larger batches
+			log.Printf("stop batch tuning of model %s at batch size %d: %v", b.model, size, err)
+			break
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		latency := latencies[len(latencies)/2].Seconds()
+		probes = append(probes, BatchProbe{Size: size, Latency: latency, Throughput: float64(size) / latency})
+	}
+	if len(probes) == 0 {
+		return
+	}
+	maxBatch, window := pickBatching(probes)
+	b.lock.Lock()
+	b.maxBatch, b.window, b.probes = maxBatch, window, probes
+	b.lock.Unlock()
+	log.Printf("tuned batching of model %s: max batch %d, window %v, probes %+v", b.model, maxBatch, window, probes)
+}
+
+// helper function to pick max batch size and window from measurements of
+// the tuner
+func pickBatching(probes []BatchProbe) (int, time.Duration) {
+	var best float64
+	for _, p := range probes {
+		if p.Throughput > best {
+			best = p.Throughput
+		}
+	}
+	maxBatch := 1
+	for _, p := range probes {
+		if p.Throughput >= tuneThroughput*best {
+			maxBatch = p.Size
+			break
+		}
+	}
+	window := time.Duration(probes[0].Latency * float64(time.Second))
+	if window < minBatchWindow {
+		window = minBatchWindow
+	}
+	if window > maxBatchWindow {
+		window = maxBatchWindow
+	}
+	return maxBatch, window
+}
+
+// helper function to write metrics of micro-batching
+func writeBatchingMetrics(w io.Writer) {
+	_batchersLock.Lock()
+	var batchers []*microBatcher
+	for _, b := range _batchers {
+		batchers = append(batchers, b)
+	}
+	_batchersLock.Unlock()
+	if len(batchers) == 0 {
+		return
+	}
+	sort.Slice(batchers, func(i, j int) bool {
+		if batchers[i].model != batchers[j].model {
+			return batchers[i].model < batchers[j].model
+		}
+		return batchers[i].ncols < batchers[j].ncols
+	})
+	type metric struct {
+		name, kind, help string
+		value            func(b *microBatcher) string
+	}
+	metrics := []metric{
+		{"tfaas_microbatches_total", "counter", "number of micro-batches of single row predictions", func(b *microBatcher) string {
+			return fmt.Sprintf("%d", atomic.LoadUint64(&b.batches))
+		}},
+		{"tfaas_microbatch_rows_total", "counter", "number of rows of micro-batches", func(b *microBatcher) string {
+			return fmt.Sprintf("%d", atomic.LoadUint64(&b.rows))
+		}},
+		{"tfaas_microbatch_max_size", "gauge", "max number of rows of micro-batch", func(b *microBatcher) string {
+			maxBatch, _ := b.settings()
+			return fmt.Sprintf("%d", maxBatch)
+		}},
+		{"tfaas_microbatch_window_seconds", "gauge", "time to wait for rows of micro-batch", func(b *microBatcher) string {
+			_, window := b.settings()
+			return fmt.Sprintf("%v", window.Seconds())
+		}},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, b := range batchers {
+			labels := metricLabels("model", b.model, "features", fmt.Sprintf("%d", b.ncols))
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, m.value(b))
+		}
+	}
+}
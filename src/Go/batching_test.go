@@ -0,0 +1,125 @@
+package main
+
+// tests of batching module, they do not require TF C library
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMicroBatching checks micro-batches of concurrent single row predictions
+func TestMicroBatching(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Batching: &BatchingConfig{MaxBatch: 8, Window: 200}}
+	writeModelFiles(t, "batched", []byte("batched"), params)
+	t.Cleanup(func() { removeBatchers("batched") })
+
+	var wg sync.WaitGroup
+	nreq := 8
+	for i := 0; i < nreq; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probs, err := makePredictions(testRow("batched"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			checkProbs(t, probs)
+		}()
+	}
+	wg.Wait()
+	if runs := atomic.LoadUint64(&fake.Runs); runs >= uint64(nreq) {
+		t.Errorf("rows are not batched, %d session runs", runs)
+	}
+
+	// rows with overrides are not batched
+	row := testRow("batched")
+	row.Overrides = &Overrides{}
+	if rowBatching("batched", row) != nil {
+		t.Error("row with overrides should not be batched")
+	}
+	if rowBatching("dnn", testRow("dnn")) != nil {
+		t.Error("model without batching parameters should not be batched")
+	}
+
+	var buf bytes.Buffer
+	writeBatchingMetrics(&buf)
+	if !strings.Contains(buf.String(), `tfaas_microbatch_rows_total{model="batched",features="4"} 8`) {
+		t.Errorf("unexpected metrics %s", buf.String())
+	}
+
+	// removed batcher does not block predictions
+	b := getBatcher("batched", "tf1", params.Batching, row.Values)
+	removeBatchers("batched")
+	if _, err := makeBatchedPredictions("batched", "tf1", params.Batching, testRow("batched")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := _batchers["batched/4"]; !ok || _batchers["batched/4"] == b {
+		t.Error("new batcher should replace removed one")
+	}
+}
+
+// TestBatchTuner checks automatic tuning of micro-batching
+func TestBatchTuner(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Batching: &BatchingConfig{Tune: true}}
+	writeModelFiles(t, "tuned", []byte("tuned"), params)
+	t.Cleanup(func() { removeBatchers("tuned") })
+
+	probs, err := makePredictions(testRow("tuned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	b := getBatcher("tuned", "tf1", params.Batching, testRow("tuned").Values)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.lock.Lock()
+		probes := b.probes
+		b.lock.Unlock()
+		if len(probes) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("model is not tuned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(b.probes) != 8 || b.probes[7].Size != maxTuneBatch {
+		t.Errorf("unexpected probes %+v", b.probes)
+	}
+	maxBatch, window := b.settings()
+	if maxBatch < 1 || maxBatch > maxTuneBatch || window < minBatchWindow || window > maxBatchWindow {
+		t.Errorf("unexpected tuned settings %d %v", maxBatch, window)
+	}
+	w := httptest.NewRecorder()
+	MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `tfaas_microbatch_max_size{model="tuned",features="4"}`) {
+		t.Error("metrics of tuned batcher are not reported")
+	}
+}
+
+// TestPickBatching checks batch settings picked from measurements
+func TestPickBatching(t *testing.T) {
+	probes := []BatchProbe{
+		{Size: 1, Latency: 0.002, Throughput: 500},
+		{Size: 2, Latency: 0.0022, Throughput: 909},
+		{Size: 4, Latency: 0.0025, Throughput: 1600},
+		{Size: 8, Latency: 0.0042, Throughput: 1904},
+		{Size: 16, Latency: 0.008, Throughput: 2000},
+	}
+	maxBatch, window := pickBatching(probes)
+	if maxBatch != 8 || window != 2*time.Millisecond {
+		t.Errorf("unexpected batch settings %d %v", maxBatch, window)
+	}
+	probes[0].Latency = 1
+	if _, window := pickBatching(probes); window != maxBatchWindow {
+		t.Errorf("window is not bounded %v", window)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// binary module provides binary payload of numeric batches
+//
+// Parsing JSON floats dominates CPU usage of large batches, therefore batch
+// endpoint accepts self-describing binary payload with
+// application/x-tfaas-batch content type, e.g.
+// POST /predict/batch?model=dnn
+// The payload consists of shape header followed by packed values, all
+// numbers are little endian:
+//
+//	magic   4 bytes "TFB1"
+//	rank    uint32, number of dimensions
+//	dims    rank x int64, shape of the batch, e.g. [nrows, ncols]
+//	values  prod(dims) x float32, values in row-major order
+//
+// Values are read directly into TF tensor memory. The tfaas_client.py
+// provides encode_batch helper (and --batch option) to produce the payload,
+// numpy users may write it as
+// b"TFB1" + struct.pack("<I", a.ndim) + np.array(a.shape, "<i8").tobytes() + a.astype("<f4").tobytes()
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// binary batch content type and magic of its header
+const (
+	binaryBatchType  = "application/x-tfaas-batch"
+	binaryBatchMagic = "TFB1"
+)
+
+// maximal rank of binary batch
+const maxBinaryBatchRank = 8
+
+// helper function to check if request provides binary batch
+func isBinaryBatchRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), binaryBatchType)
+}
+
+// helper function to read shape header of binary batch, it returns shape
+// and size of the header
+func readBinaryBatchHeader(r io.Reader) ([]int64, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, fmt.Errorf("unable to read binary batch header: %v", err)
+	}
+	if string(header[:4]) != binaryBatchMagic {
+		return nil, 0, errors.New("binary batch does not start with TFB1 magic")
+	}
+	rank := binary.LittleEndian.Uint32(header[4:])
+	if rank == 0 || rank > maxBinaryBatchRank {
+		return nil, 0, fmt.Errorf("invalid rank %d of binary batch", rank)
+	}
+	dims := make([]byte, 8*rank)
+	if _, err := io.ReadFull(r, dims); err != nil {
+		return nil, 0, fmt.Errorf("unable to read binary batch shape: %v", err)
+	}
+	shape := make([]int64, rank)
+	for i := range shape {
+		shape[i] = int64(binary.LittleEndian.Uint64(dims[8*i:]))
+	}
+	return shape, int64(len(header) + len(dims)), nil
+}
+
+// helper function to read binary batch from HTTP request into tensor
+func readBinaryBatch(r *http.Request) (string, TFTensor, error) {
+	model := r.URL.Query().Get("model")
+	shape, hsize, err := readBinaryBatchHeader(r.Body)
+	if err != nil {
+		return model, nil, err
+	}
+	size, err := shapeSize(shape)
+	if err != nil {
+		return model, nil, err
+	}
+	if r.ContentLength >= 0 && r.ContentLength != hsize+size*4 {
+		return model, nil, fmt.Errorf("content length %d does not match shape %v", r.ContentLength, shape)
+	}
+	// read values directly into tensor memory
+	tensor, err := readBodyTensor(r, shape, size)
+	return model, tensor, err
+}
+
+// helper function to encode batch of given shape into binary payload
+func encodeBinaryBatch(shape []int64, values []float32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(binaryBatchMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(shape)))
+	binary.Write(&buf, binary.LittleEndian, shape)
+	binary.Write(&buf, binary.LittleEndian, values)
+	return buf.Bytes()
+}
@@ -0,0 +1,74 @@
+package main
+
+// tests of binary batches, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// helper function to create binary batch request
+func binaryBatchRequest(payload []byte) *http.Request {
+	req := httptest.NewRequest("POST", "/predict/batch?model=dnn", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", binaryBatchType)
+	return req
+}
+
+// TestBinaryBatch checks predictions of binary batches
+func TestBinaryBatch(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	values := []float32{1, 2, 3, 4, 5, 6, 7, 8}
+	rr := httptest.NewRecorder()
+	BatchHandler(rr, binaryBatchRequest(encodeBinaryBatch([]int64{2, testNumKeys}, values)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var probs [][]float32
+	if err := json.Unmarshal(rr.Body.Bytes(), &probs); err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 2 {
+		t.Fatalf("wrong number of rows %d", len(probs))
+	}
+	checkProbs(t, probs[1])
+	input := fake.Feeds()["input"]
+	if !reflect.DeepEqual(input.Shape(), []int64{2, testNumKeys}) {
+		t.Errorf("wrong input shape %v", input.Shape())
+	}
+	if rows, _ := tensorRows(input); !reflect.DeepEqual(rows[1], values[4:]) {
+		t.Errorf("wrong input values %v", rows)
+	}
+
+	// malformed payloads
+	payload := encodeBinaryBatch([]int64{2, testNumKeys}, values)
+	bad := append([]byte("TFB0"), payload[4:]...)
+	for name, data := range map[string][]byte{
+		"magic":     bad,
+		"truncated": payload[:len(payload)-4],
+		"header":    payload[:6],
+		"shape":     encodeBinaryBatch([]int64{3, testNumKeys}, values),
+		"rank":      encodeBinaryBatch(make([]int64, 9), nil),
+		"overflow":  encodeBinaryBatch([]int64{4294967296, 4294967296}, nil),
+	} {
+		rr := httptest.NewRecorder()
+		BatchHandler(rr, binaryBatchRequest(data))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: wrong status %d of malformed payload", name, rr.Code)
+		}
+	}
+
+	// payload of unknown length must match its shape
+	for name, data := range map[string][]byte{"valid": payload, "truncated": payload[:len(payload)-4], "extra": append(payload, 0, 0, 0, 0)} {
+		req := binaryBatchRequest(data)
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		BatchHandler(rr, req)
+		if (name == "valid") != (rr.Code == http.StatusOK) {
+			t.Errorf("%s: wrong status %d of payload of unknown length", name, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// breaker module provides per-model circuit breakers
+//
+// When model keeps failing to load or to run (bad graph, OOM, etc.) its
+// breaker trips after breakerThreshold consecutive failures, and requests
+// to the model fail fast with clear error during breakerCooldown seconds
+// instead of paying the full load-and-crash cost. After the cooldown the
+// breaker lets single probe request through, its success closes the
+// breaker while its failure trips it again. Upload of new model version
+// resets the breaker. Errors caused by invalid client inputs, e.g. feeds of
+// wrong shape, are not model failures and do not count. Open breakers are
+// reported by /status API.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// default number of consecutive failures which trips the breaker
+const defaultBreakerThreshold = 5
+
+// default cooldown in seconds of tripped breaker
+const defaultBreakerCooldown = 30
+
+// breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// Breaker represents circuit breaker of the model
+type Breaker struct {
+	Model     string `json:"model"`     // model name
+	State     string `json:"state"`     // breaker state: closed, open or half-open
+	Failures  int    `json:"failures"`  // number of consecutive failures
+	LastError string `json:"lastError"` // last model error
+	OpenedAt  int64  `json:"openedAt"`  // time when breaker was tripped
+	Trips     int    `json:"trips"`     // number of times breaker was tripped
+}
+
+// global breakers
+var (
+	_breakers    = make(map[string]*Breaker)
+	breakersLock sync.Mutex
+)
+
+// helper function to return breaker threshold and cooldown
+func breakerSettings() (int, time.Duration) {
+	threshold := _config.BreakerThreshold
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+	cooldown := _config.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return threshold, time.Duration(cooldown) * time.Second
+}
+
+// helper function to check if requests to given model are allowed
+func breakerCheck(model string) error {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := _breakers[model]
+	if !ok || b.State == breakerClosed {
+		return nil
+	}
+	// single probe request is allowed per cooldown period
+	_, cooldown := breakerSettings()
+	retry := time.Unix(b.OpenedAt, 0).Add(cooldown)
+	if !time.Now().Before(retry) {
+		b.State = breakerHalfOpen
+		b.OpenedAt = time.Now().Unix()
+		return nil
+	}
+	wait := int(time.Until(retry).Seconds()) + 1
+	return fmt.Errorf("model %s is unavailable after %d consecutive failures (last error: %s), retry in %ds", model, b.Failures, b.LastError, wait)
+}
+
+// helper function to record failure of given model
+func breakerFailure(model string, err error) {
+	threshold, _ := breakerSettings()
+	if threshold < 0 || err == nil {
+		return
+	}
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := _breakers[model]
+	if !ok {
+		b = &Breaker{Model: model, State: breakerClosed}
+		_breakers[model] = b
+	}
+	b.Failures++
+	b.LastError = err.Error()
+	if b.State == breakerHalfOpen {
+		// failed probe request
+		b.State = breakerOpen
+		b.OpenedAt = time.Now().Unix()
+		return
+	}
+	if b.State == breakerClosed && b.Failures >= threshold {
+		b.State = breakerOpen
+		b.OpenedAt = time.Now().Unix()
+		b.Trips++
+		msg := fmt.Sprintf("circuit breaker is open after %d consecutive failures: %v", b.Failures, err)
+		log.Printf("model %s %s", model, msg)
+		publish(EventBreakerOpen, model, msg)
+	}
+}
+
+// helper function to record success of given model
+func breakerSuccess(model string) {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := _breakers[model]
+	if !ok {
+		return
+	}
+	if b.State != breakerClosed {
+		log.Printf("model %s circuit breaker is closed", model)
+	}
+	delete(_breakers, model)
+}
+
+// helper function to remove breaker of given model
+func removeBreaker(model string) {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	delete(_breakers, model)
+}
+
+// helper function to list open and half-open breakers
+func openBreakers() []Breaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	out := []Breaker{}
+	for _, b := range _breakers {
+		if b.State != breakerClosed {
+			out = append(out, *b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
@@ -0,0 +1,105 @@
+package main
+
+// tests of circuit breakers, they do not require TF C library
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFakeBreaker checks that repeatedly failing model fails fast
+func TestFakeBreaker(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.BreakerThreshold = 2
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	writeModelFiles(t, "broken", []byte{}, params)
+	for i := 0; i < 2; i++ {
+		_, err := makePredictions(testRow("broken"))
+		if err == nil || strings.Contains(err.Error(), "unavailable") {
+			t.Fatalf("unexpected error of request %d: %v", i, err)
+		}
+	}
+	_, err := makePredictions(testRow("broken"))
+	if err == nil || !strings.Contains(err.Error(), "unavailable after 2 consecutive failures") {
+		t.Fatalf("breaker should be open: %v", err)
+	}
+	if breakers := openBreakers(); len(breakers) != 1 || breakers[0].Model != "broken" || breakers[0].State != breakerOpen {
+		t.Errorf("unexpected breakers %+v", breakers)
+	}
+	// other models are not affected
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+
+	// model is fixed but breaker is still open
+	writeModelFiles(t, "broken", []byte("broken"), params)
+	if _, err := makePredictions(testRow("broken")); err == nil {
+		t.Fatal("breaker should fail requests during cooldown")
+	}
+	// after cooldown probe request closes the breaker
+	breakersLock.Lock()
+	_breakers["broken"].OpenedAt = time.Now().Add(-time.Minute).Unix()
+	breakersLock.Unlock()
+	probs, err := makePredictions(testRow("broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if breakers := openBreakers(); len(breakers) != 0 {
+		t.Errorf("breaker should be closed %+v", breakers)
+	}
+
+	// failed probe request trips breaker again
+	writeModelFiles(t, "broken", []byte{}, params)
+	resetModelCache("broken")
+	for i := 0; i < 2; i++ {
+		makePredictions(testRow("broken"))
+	}
+	breakersLock.Lock()
+	_breakers["broken"].OpenedAt = time.Now().Add(-time.Minute).Unix()
+	breakersLock.Unlock()
+	if _, err := makePredictions(testRow("broken")); err == nil || strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("probe request should reach the model: %v", err)
+	}
+	if _, err := makePredictions(testRow("broken")); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("breaker should be open after failed probe: %v", err)
+	}
+	// upload of new model version resets breaker
+	resetModelCache("broken")
+	if breakers := openBreakers(); len(breakers) != 0 {
+		t.Errorf("breaker should be reset %+v", breakers)
+	}
+}
+
+// TestFakeBreakerInputErrors checks that invalid inputs do not trip breaker
+func TestFakeBreakerInputErrors(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_config.BreakerThreshold = 2
+	fake.InputShape = []int64{-1, testNumKeys + 1}
+	for i := 0; i < 3; i++ {
+		_, err := makePredictions(testRow("dnn"))
+		if err == nil || !errors.Is(err, errInvalidInput) || !strings.Contains(err.Error(), "input shape is [-1 5]") {
+			t.Fatalf("unexpected error of request %d: %v", i, err)
+		}
+	}
+	if breakers := openBreakers(); len(breakers) != 0 {
+		t.Fatalf("invalid inputs trip breaker %+v", breakers)
+	}
+	fake.InputShape = nil
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+
+	// TF errors of invalid inputs are input errors
+	for msg, input := range map[string]bool{
+		"Matrix size-incompatible: In[0]: [1,3], In[1]: [4,10]": true,
+		"indices[0] = 7 is not in [0, 5)":                       true,
+		"OOM when allocating tensor with shape[1000,1000]":      false,
+	} {
+		if err := sessionError(errors.New(msg)); errors.Is(err, errInvalidInput) != input || err.Error() != msg {
+			t.Errorf("wrong classification of error %v", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+// buffers module provides pooled buffers for hot prediction paths
+//
+// Large probability vectors produce a lot of garbage when encoded via
+// encoding/json, therefore predict and batch handlers read request bodies
+// into pooled buffers and encode their results directly into pooled byte
+// slices.
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// max capacity of buffers we put back to the pool, bigger buffers are
+// released to avoid keeping rare huge requests in memory
+const maxPooledBufferSize = 16 << 20
+
+// pool of byte buffers
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// pool of byte slices used to encode responses
+var bytesPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// helper function to get buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// helper function to return buffer back to the pool
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// helper function to read given reader into pooled buffer, the caller
+// should return buffer to the pool via putBuffer
+func readBuffer(r io.Reader) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// helper function to round value to given number of significant digits
+func roundSignificant(v float32, digits int) float32 {
+	var buf [32]byte
+	s := strconv.AppendFloat(buf[:0], float64(v), 'e', digits-1, 32)
+	if f, err := strconv.ParseFloat(string(s), 32); err == nil {
+		return float32(f)
+	}
+	return v
+}
+
+// helper function to append float32 value to given buffer in the same
+// format as encoding/json does, non finite values are written as null,
+// values are rounded to given number of significant digits (if positive)
+func appendFloat32(b []byte, v float32, digits int) []byte {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(b, "null"...)
+	}
+	if digits > 0 {
+		v = roundSignificant(v, digits)
+		f = float64(v)
+	}
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 32)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// helper function to append JSON array of float32 values to given buffer,
+// see appendFloat32 for digits
+func appendFloats(b []byte, values []float32, digits int) []byte {
+	b = append(b, '[')
+	for i, v := range values {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendFloat32(b, v, digits)
+	}
+	return append(b, ']')
+}
+
+// helper function to write pooled byte slice as JSON response
+func responseBytes(w http.ResponseWriter, encode func([]byte) []byte) {
+	bp := bytesPool.Get().(*[]byte)
+	b := encode((*bp)[:0])
+	b = append(b, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	if cap(b) <= maxPooledBufferSize {
+		*bp = b[:0]
+		bytesPool.Put(bp)
+	}
+}
+
+// helper function to write JSON response with given probabilities rounded
+// to given number of significant digits
+func responseProbs(w http.ResponseWriter, probs []float32, digits int) {
+	responseBytes(w, func(b []byte) []byte {
+		return appendFloats(b, probs, digits)
+	})
+}
+
+// helper function to write JSON response with given batch of probabilities
+// rounded to given number of significant digits
+func responseBatchProbs(w http.ResponseWriter, probs [][]float32, digits int) {
+	responseBytes(w, func(b []byte) []byte {
+		b = append(b, '[')
+		for i, p := range probs {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendFloats(b, p, digits)
+		}
+		return append(b, ']')
+	})
+}
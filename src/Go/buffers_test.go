@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+// discardWriter implements http.ResponseWriter which discards all data
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(code int)        {}
+
+// helper function to generate probabilities vector of given size
+func testProbs(size int) []float32 {
+	probs := make([]float32, size)
+	for i := range probs {
+		probs[i] = rand.Float32()
+	}
+	return probs
+}
+
+// TestAppendFloats checks that pooled encoding matches encoding/json
+func TestAppendFloats(t *testing.T) {
+	probs := append(testProbs(100), 0, 1, -1, 1e-7, 3.5e-12, 1e22, 123456.75, -0.000123)
+	expect, err := json.Marshal(probs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := appendFloats(nil, probs, 0)
+	if string(data) != string(expect) {
+		t.Errorf("wrong encoding\n%s\n%s", data, expect)
+	}
+}
+
+// TestAppendFloatsPrecision checks rounding of values to significant digits
+func TestAppendFloatsPrecision(t *testing.T) {
+	data := appendFloats(nil, []float32{0.123456, 1, 98765.4, 1.23456e-8, -0.0004567}, 3)
+	expect := "[0.123,1,98800,1.23e-8,-0.000457]"
+	if string(data) != expect {
+		t.Errorf("wrong encoding %s, expected %s", data, expect)
+	}
+}
+
+// BenchmarkResponseJSON measures encoding of probabilities via encoding/json
+func BenchmarkResponseJSON(b *testing.B) {
+	probs := testProbs(10000)
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		responseJSON(w, probs)
+	}
+}
+
+// BenchmarkResponseProbs measures encoding of probabilities via pooled buffers
+func BenchmarkResponseProbs(b *testing.B) {
+	probs := testProbs(10000)
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		responseProbs(w, probs, 0)
+	}
+}
+
+// BenchmarkResponseBatchJSON measures encoding of batch via encoding/json
+func BenchmarkResponseBatchJSON(b *testing.B) {
+	var probs [][]float32
+	for i := 0; i < 1000; i++ {
+		probs = append(probs, testProbs(10))
+	}
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		responseJSON(w, probs)
+	}
+}
+
+// BenchmarkResponseBatchProbs measures encoding of batch via pooled buffers
+func BenchmarkResponseBatchProbs(b *testing.B) {
+	var probs [][]float32
+	for i := 0; i < 1000; i++ {
+		probs = append(probs, testProbs(10))
+	}
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		responseBatchProbs(w, probs, 0)
+	}
+}
+
+// helper function to generate JSON request body with given number of values
+func testBody(size int) []byte {
+	row := Row{Values: testProbs(size), Model: "test"}
+	data, _ := json.Marshal(row)
+	return data
+}
+
+// BenchmarkReadAll measures reading of request body via ioutil.ReadAll
+func BenchmarkReadAll(b *testing.B) {
+	body := testBody(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := ioutil.ReadAll(bytes.NewReader(body))
+		if err != nil || len(data) != len(body) {
+			b.Fatal("unable to read body", err)
+		}
+	}
+}
+
+// BenchmarkReadBuffer measures reading of request body via pooled buffers
+func BenchmarkReadBuffer(b *testing.B) {
+	body := testBody(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := readBuffer(bytes.NewReader(body))
+		if err != nil || buf.Len() != len(body) {
+			b.Fatal("unable to read body", err)
+		}
+		putBuffer(buf)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+// bundle module provides support of model bundles
+//
+// A model bundle is a (gzip'ed) tarball which contains either model files
+// (model.pb, labels.txt, params.json and optional assets) at top level, or
+// one or more model directories with such files.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to check if given data is gzip'ed
+func isGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// helper function to decompress gzip'ed file into temporary tarball, it
+// returns name of original file if it is not gzip'ed
+func gunzipFile(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 3)
+	n, _ := io.ReadFull(file, head)
+	if !isGzip(head[:n]) {
+		return fname, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	tarball, err := ioutil.TempFile("", "bundle-*.tar")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tarball, reader)
+	tarball.Close()
+	if err != nil {
+		os.Remove(tarball.Name())
+		return "", err
+	}
+	return tarball.Name(), nil
+}
+
+// helper function to check if given path contains model files at top level
+func isModelArea(path string) bool {
+	for _, fname := range []string{"params.json", "saved_model.pb"} {
+		if _, err := os.Stat(filepath.Join(path, fname)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to install models from given tarball into model area,
+// the name is used for bundles which contain model files at top level and
+// if it is not provided the model name is taken from params.json
+func installBundle(tarball, name string) ([]string, error) {
+	return installBundleParams(tarball, name, nil)
+}
+
+// helper function to install models from given tarball with parameters
+// which override (or provide) params.json of bundle with model files at
+// top level
+func installBundleParams(tarball, name string, override map[string]interface{}) ([]string, error) {
+	var models []string
+	staging, err := stagingDir()
+	if err != nil {
+		return models, err
+	}
+	defer os.RemoveAll(staging)
+	bdir := filepath.Join(staging, "bundle")
+	entries, err := Untar(tarball, bdir)
+	if err != nil {
+		return models, err
+	}
+	var paths []string
+	if len(override) > 0 {
+		if !isModelArea(bdir) && len(entries) > 1 {
+			return models, errors.New("model parameters can be provided only for bundles of single model")
+		}
+		if !isModelArea(bdir) && len(entries) == 1 {
+			bdir = filepath.Join(bdir, entries[0])
+			if name == "" {
+				name = entries[0]
+			}
+		}
+		if err := overrideParams(filepath.Join(bdir, "params.json"), override); err != nil {
+			return models, err
+		}
+	}
+	if isModelArea(bdir) {
+		if name == "" {
+			var params TFParams
+			data, err := ioutil.ReadFile(filepath.Join(bdir, "params.json"))
+			if err == nil {
+				err = json.Unmarshal(data, &params)
+			}
+			if err != nil {
+				return models, fmt.Errorf("unable to read model name from bundle params.json: %v", err)
+			}
+			name = params.Name
+		}
+		if name == "" {
+			return models, errors.New("bundle does not provide model name")
+		}
+		models = append(models, name)
+		paths = append(paths, bdir)
+	} else {
+		for _, model := range entries {
+			models = append(models, model)
+			paths = append(paths, filepath.Join(bdir, model))
+		}
+	}
+	// validate all models first and only then install them into model area
+	for i, model := range models {
+		if err := validateModel(paths[i], model); err != nil {
+			return models, fmt.Errorf("invalid %s model: %v", model, err)
+		}
+	}
+	for i, model := range models {
+		if err := installModel(paths[i], model); err != nil {
+			return models, fmt.Errorf("unable to install %s model: %v", model, err)
+		}
+	}
+	return models, nil
+}
+
+// helper function to merge given parameters into params.json file
+func overrideParams(fname string, override map[string]interface{}) error {
+	params := make(map[string]interface{})
+	if data, err := ioutil.ReadFile(fname); err == nil {
+		if err := json.Unmarshal(data, &params); err != nil {
+			return fmt.Errorf("unable to parse %s: %v", filepath.Base(fname), err)
+		}
+	}
+	for key, value := range override {
+		params[key] = value
+	}
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, data, 0644)
+}
+
+// helper function to write tar.gz bundle of given model area
+func writeBundle(w io.Writer, path string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarDir(tw, path, ""); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// helper function to write files of given model area into tarball under
+// given prefix, internal (hidden) files are skipped
+func writeTarDir(tw *tar.Writer, path, prefix string) error {
+	return filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, fname)
+		if err != nil {
+			return err
+		}
+		// skip model area itself and internal (hidden) files
+		if rel == "." {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = prefix + filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// DownloadHandler provides tar.gz bundle of the model
+func DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	model := resolveModel(vars["name"])
+	if !modelExists(model) {
+		msg := fmt.Sprintf("model %s does not exist", model)
+		responseError(w, msg, errors.New(msg), http.StatusNotFound)
+		return
+	}
+	if checkModelETag(w, r, model) {
+		return
+	}
+	// bundle is streamed to the client, therefore errors of partially
+	// written bundle can only be logged
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", model))
+	w.WriteHeader(http.StatusOK)
+	if err := writeBundle(w, filepath.Join(_config.ModelDir, model)); err != nil {
+		log.Printf("unable to write bundle of model %s: %v", model, err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+// tests of model bundles, they do not require TF C library
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to create gzipped bundle with directories of given models,
+// the params of every model are changed by given function
+func multiBundle(t *testing.T, models []string, change func(*TFParams)) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range models {
+		params := TFParams{Name: name, Model: "model.pb", Labels: "labels.txt", InputNode: "input", OutputNode: "output"}
+		if change != nil {
+			change(&params)
+		}
+		data, _ := json.Marshal(params)
+		files := map[string][]byte{"params.json": data, "model.pb": []byte(name), "labels.txt": []byte("a\nb\nc\n")}
+		tw.WriteHeader(&tar.Header{Name: name + "/", Mode: 0755, Typeflag: tar.TypeDir})
+		for fname, data := range files {
+			tw.WriteHeader(&tar.Header{Name: name + "/" + fname, Mode: 0644, Size: int64(len(data))})
+			tw.Write(data)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// helper function to upload given bundle
+func uploadTestBundle(bundle []byte, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	UploadBundleHandler(w, httptest.NewRequest("POST", "/upload"+query, bytes.NewReader(bundle)))
+	return w
+}
+
+// TestBundles checks upload of bundles with single and multiple models and
+// download of model bundles
+func TestBundles(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+
+	// model files at top level use model name of request or params.json
+	if w := uploadTestBundle(testBundle(t, "m1"), ""); w.Code != http.StatusOK || !modelExists("m1") {
+		t.Fatalf("unable to upload bundle %d %s", w.Code, w.Body.String())
+	}
+	if w := uploadTestBundle(testBundle(t, "m2"), "?name=m2"); w.Code != http.StatusOK || !modelExists("m2") {
+		t.Fatalf("unable to upload named bundle %d %s", w.Code, w.Body.String())
+	}
+	if w := uploadTestBundle(testBundle(t, "m2"), "?name=m3"); w.Code != http.StatusBadRequest || modelExists("m3") {
+		t.Fatalf("wrong upload of bundle with other model name %d %s", w.Code, w.Body.String())
+	}
+
+	// bundle with several models is installed only if all models are valid
+	invalid := func(p *TFParams) {
+		if p.Name == "m5" {
+			p.Fallback = &Fallback{Model: "m5"}
+		}
+	}
+	if w := uploadTestBundle(multiBundle(t, []string{"m4", "m5"}, invalid), ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong upload of bundle with invalid model %d %s", w.Code, w.Body.String())
+	}
+	if modelExists("m4") || modelExists("m5") {
+		t.Fatal("models of invalid bundle are installed")
+	}
+	if w := uploadTestBundle(multiBundle(t, []string{"m4", "m5"}, nil), ""); w.Code != http.StatusOK {
+		t.Fatalf("unable to upload bundle of models %d %s", w.Code, w.Body.String())
+	}
+	if !modelExists("m4") || !modelExists("m5") {
+		t.Fatal("models of bundle are not installed")
+	}
+	if w := uploadTestBundle([]byte("not a bundle"), ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong upload of invalid bundle %d %s", w.Code, w.Body.String())
+	}
+
+	// bundle of model directory made by tar -C m6 -czf bundle.tgz .
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir})
+	data, _ := json.Marshal(TFParams{Name: "m6", Model: "model.pb", Labels: "labels.txt", InputNode: "input", OutputNode: "output"})
+	for fname, data := range map[string][]byte{"params.json": data, "model.pb": []byte("m6"), "labels.txt": []byte("a\nb\nc\n")} {
+		tw.WriteHeader(&tar.Header{Name: "./" + fname, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	if w := uploadTestBundle(buf.Bytes(), ""); w.Code != http.StatusOK || modelDefinition(t, "m6") != "m6" {
+		t.Fatalf("unable to upload bundle of model directory %d %s", w.Code, w.Body.String())
+	}
+
+	// errors of bundle installation are reported to the client
+	w := uploadTestBundle(multiBundle(t, []string{"m7", "../m8"}, nil), "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid file path ../m8") {
+		t.Fatalf("wrong error of invalid bundle %d %s", w.Code, w.Body.String())
+	}
+
+	// downloaded bundle is installed as new model
+	w = httptest.NewRecorder()
+	DownloadHandler(w, mux.SetURLVars(httptest.NewRequest("GET", "/models/dnn/download", nil), map[string]string{"name": "dnn"}))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("unable to download bundle %d %s", w.Code, w.Body.String())
+	}
+	fname := t.TempDir() + "/dnn.tar.gz"
+	ioutil.WriteFile(fname, w.Body.Bytes(), 0644)
+	tarball, err := gunzipFile(fname)
+	if err != nil || tarball == fname {
+		t.Fatalf("downloaded bundle is not gzipped: %v", err)
+	}
+	defer os.Remove(tarball)
+	if models, err := installBundleParams(tarball, "dnn3", map[string]interface{}{"name": "dnn3"}); err != nil || len(models) != 1 || models[0] != "dnn3" {
+		t.Fatalf("unable to install downloaded bundle %v: %v", models, err)
+	}
+	if def := modelDefinition(t, "dnn3"); def != "dnn" {
+		t.Fatalf("wrong model definition %s of downloaded bundle", def)
+	}
+	params, err := getModelParams("dnn3")
+	if err != nil || params.Name != "dnn3" || params.InputNode != "input" {
+		t.Fatalf("wrong params of downloaded bundle %+v: %v", params, err)
+	}
+
+	w = httptest.NewRecorder()
+	DownloadHandler(w, mux.SetURLVars(httptest.NewRequest("GET", "/models/unknown/download", nil), map[string]string{"name": "unknown"}))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code %d of download of unknown model", w.Code)
+	}
+}
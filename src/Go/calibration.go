@@ -0,0 +1,197 @@
+package main
+
+// calibration module provides calibration curves of deployed models
+//
+// POST /calibration/<model> with labeled dataset (rows in batch format, see
+// batch module, and class index of every row), e.g.
+// {"keys": ["attr1", "attr2"], "shape": [3, 2], "values": [1, 2, 3, 4, 5, 6],
+//  "labels": [1, 0, 1], "class": 1, "bins": 10}
+// scores every row by the model and returns reliability curve of the
+// probability of given class (default 1): the probabilities are split into
+// "bins" equal-width bins (default 10) and every bin provides number of
+// rows, mean predicted probability and observed fraction of rows of the
+// class, along with Brier score and expected calibration error, e.g.
+// {"model": "dnn", "class": 1, "rows": 3, "brier": 0.08, "ece": 0.05,
+//  "bins": [{"lower": 0, "upper": 0.1, "count": 0, "predicted": 0, "observed": 0},
+//           ..., {"lower": 0.9, "upper": 1, "count": 2, "predicted": 0.93, "observed": 1}]}
+// The probability of the class is the output of given index, models with
+// single output provide probability of class 1.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// default number of bins of calibration curve
+const defaultCalibrationBins = 10
+
+// maximum number of bins of calibration curve
+const maxCalibrationBins = 1000
+
+// LabeledDataset represents dataset rows with their class labels
+type LabeledDataset struct {
+	Dataset
+	Labels []int `json:"labels"` // class index of every row
+	Class  *int  `json:"class"`  // evaluated class, default 1
+}
+
+// CalibrationRequest represents labeled dataset of calibration curve
+type CalibrationRequest struct {
+	LabeledDataset
+	Bins int `json:"bins"` // number of bins of calibration curve
+}
+
+// CalibrationBin represents bin of calibration curve
+type CalibrationBin struct {
+	Lower     float64 `json:"lower"`     // lower edge of predicted probability
+	Upper     float64 `json:"upper"`     // upper edge of predicted probability
+	Count     int     `json:"count"`     // number of rows in the bin
+	Predicted float64 `json:"predicted"` // mean predicted probability of rows
+	Observed  float64 `json:"observed"`  // fraction of rows of evaluated class
+}
+
+// CalibrationReport represents calibration curve of the model
+type CalibrationReport struct {
+	Model string           `json:"model"` // model name
+	Class int              `json:"class"` // evaluated class
+	Rows  int              `json:"rows"`  // number of scored rows
+	Brier float64          `json:"brier"` // Brier score
+	ECE   float64          `json:"ece"`   // expected calibration error
+	Bins  []CalibrationBin `json:"bins"`  // bins of calibration curve
+}
+
+// helper function to return evaluated class of labeled dataset
+func (d *LabeledDataset) class() int {
+	if d.Class == nil {
+		return 1
+	}
+	return *d.Class
+}
+
+// helper function to check rows, labels and class of labeled dataset
+func (d *LabeledDataset) check() error {
+	rows, err := d.rows()
+	if err != nil {
+		return err
+	}
+	if len(d.Labels) != len(rows) {
+		return fmt.Errorf("%d labels do not match %d rows", len(d.Labels), len(rows))
+	}
+	if d.class() < 0 {
+		return fmt.Errorf("invalid class %d", d.class())
+	}
+	return nil
+}
+
+// helper function to return probabilities of evaluated class of model
+// outputs and flags of rows of this class
+func (d *LabeledDataset) classScores(model string, outputs [][]float32) ([]float64, []bool, error) {
+	class := d.class()
+	scores := make([]float64, len(outputs))
+	positives := make([]bool, len(outputs))
+	for i, probs := range outputs {
+		switch {
+		case len(probs) == 1 && class == 1:
+			scores[i] = float64(probs[0])
+		case len(probs) > 1 && class < len(probs):
+			scores[i] = float64(probs[class])
+		default:
+			return nil, nil, fmt.Errorf("model %s with %d outputs does not provide probability of class %d", model, len(probs), class)
+		}
+		positives[i] = d.Labels[i] == class
+	}
+	return scores, positives, nil
+}
+
+// helper function to compute calibration curve of given probabilities
+func calibrationCurve(scores []float64, positives []bool, nbins int) CalibrationReport {
+	report := CalibrationReport{Rows: len(scores), Bins: make([]CalibrationBin, nbins)}
+	for i := range report.Bins {
+		report.Bins[i].Lower = float64(i) / float64(nbins)
+		report.Bins[i].Upper = float64(i+1) / float64(nbins)
+	}
+	for i, p := range scores {
+		var y float64
+		if positives[i] {
+			y = 1
+		}
+		report.Brier += (p - y) * (p - y)
+		idx := int(p * float64(nbins))
+		if idx >= nbins {
+			idx = nbins - 1
+		}
+		if idx < 0 {
+			idx = 0
+		}
+		bin := &report.Bins[idx]
+		bin.Count++
+		bin.Predicted += p
+		bin.Observed += y
+	}
+	for i := range report.Bins {
+		bin := &report.Bins[i]
+		if bin.Count == 0 {
+			continue
+		}
+		bin.Predicted /= float64(bin.Count)
+		bin.Observed /= float64(bin.Count)
+		report.ECE += float64(bin.Count) * math.Abs(bin.Predicted-bin.Observed)
+	}
+	if len(scores) > 0 {
+		report.Brier /= float64(len(scores))
+		report.ECE /= float64(len(scores))
+	}
+	return report
+}
+
+// CalibrationHandler computes calibration curve of the model on labeled data
+func CalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	model, err := datasetModel(mux.Vars(r)["model"])
+	if err != nil {
+		responseError(w, "unknown model", err, http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseError(w, "unable to read calibration request", err, http.StatusBadRequest)
+		return
+	}
+	var req CalibrationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		responseError(w, "unable to unmarshal calibration request", err, http.StatusBadRequest)
+		return
+	}
+	nbins := req.Bins
+	if nbins <= 0 {
+		nbins = defaultCalibrationBins
+	}
+	if nbins > maxCalibrationBins {
+		err := fmt.Errorf("%d bins exceed maximum %d", nbins, maxCalibrationBins)
+		responseError(w, "invalid calibration request", err, http.StatusBadRequest)
+		return
+	}
+	if err := req.check(); err != nil {
+		responseError(w, "invalid labeled dataset", err, http.StatusBadRequest)
+		return
+	}
+	outputs, err := scoreDataset(model, &req.Dataset)
+	if err != nil {
+		responseError(w, "unable to score dataset", err, http.StatusInternalServerError)
+		return
+	}
+	scores, positives, err := req.classScores(model, outputs)
+	if err != nil {
+		responseError(w, "unable to evaluate model outputs", err, http.StatusUnprocessableEntity)
+		return
+	}
+	report := calibrationCurve(scores, positives, nbins)
+	report.Model = model
+	report.Class = req.class()
+	responseJSON(w, report)
+}
@@ -0,0 +1,79 @@
+package main
+
+// tests of calibration module, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestCalibrationCurve checks bins, Brier score and calibration error
+func TestCalibrationCurve(t *testing.T) {
+	scores := []float64{0.05, 0.15, 0.95, 1}
+	positives := []bool{false, false, true, false}
+	report := calibrationCurve(scores, positives, 10)
+	if report.Rows != 4 || len(report.Bins) != 10 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if math.Abs(report.Brier-(0.0025+0.0225+0.0025+1)/4) > 1e-9 {
+		t.Errorf("unexpected Brier score %v", report.Brier)
+	}
+	last := report.Bins[9]
+	if last.Count != 2 || math.Abs(last.Predicted-0.975) > 1e-9 || last.Observed != 0.5 || last.Upper != 1 {
+		t.Errorf("unexpected last bin %+v", last)
+	}
+	if math.Abs(report.ECE-(0.05+0.15+2*0.475)/4) > 1e-9 {
+		t.Errorf("unexpected calibration error %v", report.ECE)
+	}
+}
+
+// TestCalibrationHandler checks calibration curve of the model
+func TestCalibrationHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	row := testRow("dnn")
+	class := 2
+	dataset := Dataset{Keys: row.Keys, Values: append(append([]float32{}, row.Values...), row.Values...), Shape: []int64{2, testNumKeys}}
+	call := func(model string, req CalibrationRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(req)
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/calibration/"+model, bytes.NewReader(data)), map[string]string{"model": model})
+		w := httptest.NewRecorder()
+		CalibrationHandler(w, r)
+		return w
+	}
+	w := call("dnn", CalibrationRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{2, 0}, Class: &class}, Bins: 4})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+	}
+	var report CalibrationReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// fake model scores every row with 0.5 probability of class 2
+	if report.Model != "dnn" || report.Class != 2 || report.Rows != 2 || math.Abs(report.Brier-0.25) > 1e-6 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if bin := report.Bins[2]; len(report.Bins) != 4 || bin.Count != 2 || bin.Observed != 0.5 {
+		t.Errorf("unexpected bins %+v", report.Bins)
+	}
+
+	wrong := 5
+	for _, c := range []struct {
+		model string
+		req   CalibrationRequest
+		code  int
+	}{
+		{"unknown", CalibrationRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{1, 0}}}, http.StatusNotFound},
+		{"dnn", CalibrationRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{1}}}, http.StatusBadRequest},
+		{"dnn", CalibrationRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{1, 0}, Class: &wrong}}, http.StatusUnprocessableEntity},
+	} {
+		if w := call(c.model, c.req); w.Code != c.code {
+			t.Errorf("unexpected status %d of model %s, expected %d", w.Code, c.model, c.code)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+// capture module provides traffic capture and replay
+//
+// When captureDir is configured the server records (optionally sampled)
+// prediction requests together with their responses into daily files
+// captureDir/capture-YYYYMMDD.jsonl, one JSON record per line. The captured
+// traffic can be replayed against another instance or model version:
+// tfaas -replay capture-20201010.jsonl -replayTarget https://host:8083 -replayModel dnn_v2
+// the replay compares response statuses and predictions (with floating
+// point tolerance) and prints summary report. Sensitive features of models
+// are redacted in captured requests, see redaction module.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum size of request or response body to capture
+const maxCaptureBody = 10 * 1024 * 1024
+
+// tolerance of predictions comparison during replay
+const replayTolerance = 1e-4
+
+// default list of captured endpoints
+var defaultCaptureEndpoints = []string{"/json", "/proto", "/image", "/predict/json", "/predict/proto", "/predict/image", "/predict/batch"}
+
+// CaptureRecord represents captured request and its response
+type CaptureRecord struct {
+	Time            int64   `json:"time"`                      // request time (unix seconds)
+	Method          string  `json:"method"`                    // HTTP method
+	Path            string  `json:"path"`                      // API endpoint without server base path
+	Query           string  `json:"query,omitempty"`           // request query
+	ContentType     string  `json:"contentType,omitempty"`     // request content type
+	ContentEncoding string  `json:"contentEncoding,omitempty"` // request content encoding
+	Body            []byte  `json:"body"`                      // request body
+	Redacted        bool    `json:"redacted,omitempty"`        // request body has redacted sensitive features
+	Status          int     `json:"status"`                    // response status
+	Duration        float64 `json:"duration"`                  // request duration in milliseconds
+	Response        []byte  `json:"response,omitempty"`        // response body
+}
+
+// CaptureWriter writes captured records into daily files
+type CaptureWriter struct {
+	Dir  string
+	date string
+	file *os.File
+	lock sync.Mutex
+}
+
+// global capture writer, it is nil when capture is disabled
+var _capture *CaptureWriter
+
+// write writes capture record into capture file of the day
+func (c *CaptureWriter) write(rec CaptureRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	date := time.Unix(rec.Time, 0).Format("20060102")
+	if c.file == nil || c.date != date {
+		if c.file != nil {
+			c.file.Close()
+		}
+		fname := filepath.Join(c.Dir, fmt.Sprintf("capture-%s.jsonl", date))
+		c.file, err = os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			c.file = nil
+			return err
+		}
+		c.date = date
+	}
+	_, err = c.file.Write(append(data, '\n'))
+	return err
+}
+
+// helper function to initialize traffic capture
+func initCapture() {
+	_capture = nil
+	if _config.CaptureDir == "" {
+		return
+	}
+	if err := os.MkdirAll(_config.CaptureDir, 0755); err != nil {
+		log.Println("unable to create capture area", err)
+		return
+	}
+	log.Printf("capture traffic into %s sample rate %v", _config.CaptureDir, captureSampleRate())
+	_capture = &CaptureWriter{Dir: _config.CaptureDir}
+}
+
+// helper function to return capture sample rate
+func captureSampleRate() float64 {
+	if _config.CaptureSampleRate > 0 && _config.CaptureSampleRate < 1 {
+		return _config.CaptureSampleRate
+	}
+	return 1
+}
+
+// helper function to check if request to given path should be captured
+func captured(path string) bool {
+	endpoints := _config.CaptureEndpoints
+	if len(endpoints) == 0 {
+		endpoints = defaultCaptureEndpoints
+	}
+	return InList(path, endpoints)
+}
+
+// captureResponseWriter records response status and body
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records response status
+func (w *captureResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records response body up to maxCaptureBody bytes
+func (w *captureResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(data) <= maxCaptureBody {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// captureMiddleware records sampled requests of prediction endpoints
+func captureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _capture == nil || r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := r.URL.Path
+		if base := strings.TrimRight(_config.Base, "/"); base != "" {
+			path = strings.TrimPrefix(path, base)
+		}
+		if !captured(path) || rand.Float64() >= captureSampleRate() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCaptureBody+1))
+		// handlers should see the whole body regardless of capture
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || len(body) > maxCaptureBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		cw := &captureResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		body, redacted := redactBody(body, path, r.URL.RawQuery)
+		rec := CaptureRecord{
+			Time:            start.Unix(),
+			Method:          r.Method,
+			Path:            path,
+			Query:           r.URL.RawQuery,
+			ContentType:     r.Header.Get("Content-Type"),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+			Body:            body,
+			Redacted:        redacted,
+			Status:          cw.status,
+			Duration:        float64(time.Since(start)) / float64(time.Millisecond),
+			Response:        cw.body.Bytes(),
+		}
+		if err := _capture.write(rec); err != nil {
+			log.Println("unable to write capture record", err)
+		}
+	})
+}
+
+// ReplayReport represents summary of replayed traffic
+type ReplayReport struct {
+	Requests         int     `json:"requests"`         // number of replayed requests
+	Failures         int     `json:"failures"`         // number of requests which failed to be sent
+	StatusMismatches int     `json:"statusMismatches"` // number of responses with different status
+	Mismatches       int     `json:"mismatches"`       // number of responses with different content
+	Redacted         int     `json:"redacted"`         // number of skipped records with redacted sensitive features
+	CapturedLatency  float64 `json:"capturedLatency"`  // average latency of captured requests in milliseconds
+	ReplayedLatency  float64 `json:"replayedLatency"`  // average latency of replayed requests in milliseconds
+}
+
+// helper function to replace model name in request query and JSON body
+func replaceModel(rec *CaptureRecord, model string) {
+	if values, err := url.ParseQuery(rec.Query); err == nil && values.Get("model") != "" {
+		values.Set("model", model)
+		rec.Query = values.Encode()
+	}
+	if !strings.HasPrefix(rec.ContentType, "application/json") && rec.ContentType != "" {
+		return
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body, &body); err != nil {
+		return
+	}
+	body["model"] = model
+	if data, err := json.Marshal(body); err == nil {
+		rec.Body = data
+	}
+}
+
+// helper function to compare JSON values with floating point tolerance
+func sameJSON(a, b interface{}) bool {
+	switch va := a.(type) {
+	case float64:
+		vb, ok := b.(float64)
+		return ok && math.Abs(va-vb) <= replayTolerance*math.Max(1, math.Abs(va))
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !sameJSON(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for k, v := range va {
+			if !sameJSON(v, vb[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// helper function to compare captured and replayed responses
+func sameResponse(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) == nil && json.Unmarshal(b, &vb) == nil {
+		return sameJSON(va, vb)
+	}
+	return bytes.Equal(a, b)
+}
+
+// helper function to replay single captured request
+func replayRecord(client *http.Client, target string, rec CaptureRecord) (int, []byte, error) {
+	rurl := strings.TrimRight(target, "/") + rec.Path
+	if rec.Query != "" {
+		rurl += "?" + rec.Query
+	}
+	req, err := http.NewRequest(rec.Method, rurl, bytes.NewReader(rec.Body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if rec.ContentType != "" {
+		req.Header.Set("Content-Type", rec.ContentType)
+	}
+	if rec.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", rec.ContentEncoding)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// replay re-sends captured requests from given file to target server,
+// optionally replacing model name of the requests
+func replay(client *http.Client, fname, target, model string) (ReplayReport, error) {
+	var report ReplayReport
+	if target == "" {
+		return report, errors.New("replay requires target server URL")
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+	var captured, replayed float64
+	decoder := json.NewDecoder(file)
+	for {
+		var rec CaptureRecord
+		if err := decoder.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		if rec.Redacted {
+			// requests with redacted features can not be reproduced
+			report.Redacted++
+			continue
+		}
+		if model != "" {
+			replaceModel(&rec, model)
+		}
+		report.Requests++
+		start := time.Now()
+		status, data, err := replayRecord(client, target, rec)
+		if err != nil {
+			log.Printf("unable to replay %s %s: %v", rec.Method, rec.Path, err)
+			report.Failures++
+			continue
+		}
+		captured += rec.Duration
+		replayed += float64(time.Since(start)) / float64(time.Millisecond)
+		if status != rec.Status {
+			report.StatusMismatches++
+		} else if !sameResponse(rec.Response, data) {
+			report.Mismatches++
+		}
+	}
+	if n := report.Requests - report.Failures; n > 0 {
+		report.CapturedLatency = captured / float64(n)
+		report.ReplayedLatency = replayed / float64(n)
+	}
+	return report, nil
+}
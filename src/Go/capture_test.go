@@ -0,0 +1,98 @@
+package main
+
+// tests of traffic capture and replay, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestCaptureReplay checks capture of prediction requests and their replay
+func TestCaptureReplay(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_config.CaptureDir = filepath.Join(_config.ModelDir, ".capture")
+	initCapture()
+	t.Cleanup(func() { _capture = nil })
+	router := mux.NewRouter()
+	router.HandleFunc("/json", PredictHandler).Methods("POST")
+	router.HandleFunc("/models", ModelsHandler).Methods("GET", "POST")
+	router.Use(captureMiddleware)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	for _, model := range []string{"dnn", "unknown"} {
+		data, _ := json.Marshal(testRow(model))
+		resp, err := http.Post(srv.URL+"/json", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// requests of other endpoints are not captured
+	resp, err := http.Post(srv.URL+"/models", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	files, _ := filepath.Glob(filepath.Join(_config.CaptureDir, "capture-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected capture files %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	var rec CaptureRecord
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Path != "/json" || rec.Status != http.StatusOK || len(rec.Body) == 0 || len(rec.Response) == 0 {
+		t.Fatalf("unexpected capture record %+v", rec)
+	}
+
+	// stop capture to not record replayed traffic
+	_capture = nil
+
+	// replay traffic as is
+	report, err := replay(http.DefaultClient, files[0], srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 2 || report.Failures != 0 || report.StatusMismatches != 0 || report.Mismatches != 0 {
+		t.Errorf("unexpected replay report %+v", report)
+	}
+
+	// replay traffic against another model with different outputs
+	fake.Outputs = []float32{0.5, 0.3, 0.2}
+	report, err = replay(http.DefaultClient, files[0], srv.URL, "dnn2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 2 || report.StatusMismatches != 1 || report.Mismatches != 1 {
+		t.Errorf("unexpected replay report %+v", report)
+	}
+}
+
+// TestSameResponse checks comparison of responses
+func TestSameResponse(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`[{"label":"a","probability":0.5}]`, `[{"label":"a","probability":0.50000001}]`, true},
+		{`[{"label":"a","probability":0.5}]`, `[{"label":"a","probability":0.6}]`, false},
+		{`[{"label":"a","probability":0.5}]`, `[{"label":"b","probability":0.5}]`, false},
+		{`[1,2]`, `[1,2,3]`, false},
+		{"binary", "binary", true},
+	}
+	for _, test := range tests {
+		if sameResponse([]byte(test.a), []byte(test.b)) != test.same {
+			t.Errorf("unexpected comparison of %s and %s", test.a, test.b)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+// compare module provides side-by-side scoring report of two models
+//
+// POST /compare with a dataset (rows in batch format, see batch module) and
+// two models, e.g.
+// {"models": ["dnn", "dnn_v2"], "keys": ["attr1", "attr2"],
+//  "shape": [3, 2], "values": [1, 2, 3, 4, 5, 6], "top": 5}
+// scores every row by both models (without their fallbacks) and returns
+// agreement rate of their decisions (index of the largest output, or output
+// above 0.5 for models with single output), Pearson correlation and mean
+// absolute difference of outputs, and "top" rows (default 10) with the
+// largest disagreement of outputs, e.g.
+// {"models": ["dnn", "dnn_v2"], "rows": 3, "agreement": 0.667,
+//  "correlation": 0.91, "meanAbsDiff": 0.12,
+//  "disagreements": [{"row": 2, "values": [5, 6], "difference": 0.3,
+//                     "outputs": [[0.4, 0.6], [0.7, 0.3]]}]}
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// maximum number of rows of scored dataset
+const maxDatasetRows = 100000
+
+// default number of reported rows with the largest disagreement
+const defaultCompareTop = 10
+
+// Dataset represents rows of the dataset in batch format
+type Dataset struct {
+	Keys   []string  `json:"keys"`   // row attribute names
+	Values []float32 `json:"values"` // flat vector of row values
+	Shape  []int64   `json:"shape"`  // shape of the dataset, i.e. [nrows, ncols]
+}
+
+// CompareRequest represents dataset and models to compare
+type CompareRequest struct {
+	Dataset
+	Models []string `json:"models"` // names of two compared models
+	Top    int      `json:"top"`    // number of reported rows with the largest disagreement
+}
+
+// Disagreement represents row scored differently by compared models
+type Disagreement struct {
+	Row        int         `json:"row"`        // row index in the dataset
+	Values     []float32   `json:"values"`     // row values
+	Outputs    [][]float32 `json:"outputs"`    // outputs of compared models
+	Difference float64     `json:"difference"` // max absolute difference of outputs
+}
+
+// CompareReport represents side-by-side scoring report of two models
+type CompareReport struct {
+	Models        []string       `json:"models"`        // names of compared models
+	Rows          int            `json:"rows"`          // number of scored rows
+	Agreement     float64        `json:"agreement"`     // fraction of rows with the same decision
+	Correlation   float64        `json:"correlation"`   // Pearson correlation of outputs
+	MeanAbsDiff   float64        `json:"meanAbsDiff"`   // mean absolute difference of outputs
+	Disagreements []Disagreement `json:"disagreements"` // rows with the largest disagreement
+}
+
+// helper function to split dataset into rows
+func (d *Dataset) rows() ([][]float32, error) {
+	if len(d.Shape) != 2 {
+		return nil, fmt.Errorf("shape %v is not [nrows, ncols]", d.Shape)
+	}
+	size, err := shapeSize(d.Shape)
+	if err != nil {
+		return nil, err
+	}
+	if size != int64(len(d.Values)) {
+		return nil, fmt.Errorf("shape %v does not match %d values", d.Shape, len(d.Values))
+	}
+	nrows, ncols := int(d.Shape[0]), int(d.Shape[1])
+	if nrows > maxDatasetRows {
+		return nil, fmt.Errorf("dataset has %d rows, maximum is %d", nrows, maxDatasetRows)
+	}
+	if len(d.Keys) > 0 && len(d.Keys) != ncols {
+		return nil, fmt.Errorf("%d keys do not match %d values of the row", len(d.Keys), ncols)
+	}
+	rows := make([][]float32, nrows)
+	for i := range rows {
+		rows[i] = d.Values[i*ncols : (i+1)*ncols]
+	}
+	return rows, nil
+}
+
+// helper function to resolve model of the dataset scoring, the model is
+// fetched from model store if it is not present in model area
+func datasetModel(name string) (string, error) {
+	model := resolveModel(name)
+	if err := fetchModel(model); err != nil {
+		return model, err
+	}
+	if !modelExists(model) {
+		return model, fmt.Errorf("model %s does not exist", name)
+	}
+	return model, nil
+}
+
+// helper function to score rows of the dataset by given model, the model
+// fallback is not used
+func scoreDataset(model string, d *Dataset) ([][]float32, error) {
+	rows, err := d.rows()
+	if err != nil {
+		return nil, err
+	}
+	outputs := make([][]float32, len(rows))
+	for i, values := range rows {
+		probs, err := predictRow(&Row{Keys: d.Keys, Values: values, Model: model})
+		if err != nil {
+			return nil, fmt.Errorf("unable to score row %d by model %s: %v", i, model, err)
+		}
+		outputs[i] = probs
+	}
+	return outputs, nil
+}
+
+// helper function to return decision of the model output, i.e. index of
+// the largest output or 1 for single output above 0.5
+func decision(probs []float32) int {
+	if len(probs) == 1 {
+		if probs[0] > 0.5 {
+			return 1
+		}
+		return 0
+	}
+	best := 0
+	for i, p := range probs {
+		if p > probs[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// helper function to compute Pearson correlation of given values, it
+// returns 0 if any of values is constant
+func correlation(x, y []float64) float64 {
+	n := float64(len(x))
+	if n == 0 {
+		return 0
+	}
+	var sx, sy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+	}
+	mx, my := sx/n, sy/n
+	var cov, vx, vy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		cov += dx * dy
+		vx += dx * dx
+		vy += dy * dy
+	}
+	if vx == 0 || vy == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+// helper function to compare outputs of two models over dataset rows
+func compareOutputs(rows, outputsA, outputsB [][]float32, top int) (CompareReport, error) {
+	report := CompareReport{Rows: len(rows), Disagreements: []Disagreement{}}
+	var x, y []float64
+	var agree int
+	var totalDiff float64
+	for i := range rows {
+		a, b := outputsA[i], outputsB[i]
+		if len(a) != len(b) {
+			return report, fmt.Errorf("row %d has %d outputs of first model and %d outputs of second model", i, len(a), len(b))
+		}
+		if decision(a) == decision(b) {
+			agree++
+		}
+		var diff float64
+		for j := range a {
+			x = append(x, float64(a[j]))
+			y = append(y, float64(b[j]))
+			d := math.Abs(float64(a[j]) - float64(b[j]))
+			totalDiff += d
+			if d > diff {
+				diff = d
+			}
+		}
+		if diff > 0 {
+			report.Disagreements = append(report.Disagreements, Disagreement{Row: i, Values: rows[i], Outputs: [][]float32{a, b}, Difference: diff})
+		}
+	}
+	if len(rows) > 0 {
+		report.Agreement = float64(agree) / float64(len(rows))
+	}
+	if len(x) > 0 {
+		report.MeanAbsDiff = totalDiff / float64(len(x))
+	}
+	report.Correlation = correlation(x, y)
+	sort.SliceStable(report.Disagreements, func(i, j int) bool {
+		return report.Disagreements[i].Difference > report.Disagreements[j].Difference
+	})
+	if len(report.Disagreements) > top {
+		report.Disagreements = report.Disagreements[:top]
+	}
+	return report, nil
+}
+
+// CompareHandler scores dataset by two models and reports their differences
+func CompareHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseError(w, "unable to read compare request", err, http.StatusBadRequest)
+		return
+	}
+	var req CompareRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		responseError(w, "unable to unmarshal compare request", err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Models) != 2 {
+		err := errors.New("compare request should provide two models")
+		responseError(w, "invalid compare request", err, http.StatusBadRequest)
+		return
+	}
+	rows, err := req.rows()
+	if err != nil {
+		responseError(w, "invalid dataset", err, http.StatusBadRequest)
+		return
+	}
+	var outputs [2][][]float32
+	for i, model := range req.Models {
+		if req.Models[i], err = datasetModel(model); err != nil {
+			responseError(w, "unknown model", err, http.StatusNotFound)
+			return
+		}
+		if outputs[i], err = scoreDataset(req.Models[i], &req.Dataset); err != nil {
+			responseError(w, "unable to score dataset", err, http.StatusInternalServerError)
+			return
+		}
+	}
+	top := req.Top
+	if top <= 0 {
+		top = defaultCompareTop
+	}
+	report, err := compareOutputs(rows, outputs[0], outputs[1], top)
+	if err != nil {
+		responseError(w, "unable to compare models", err, http.StatusUnprocessableEntity)
+		return
+	}
+	report.Models = req.Models
+	responseJSON(w, report)
+}
@@ -0,0 +1,77 @@
+package main
+
+// tests of compare module, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCompareOutputs checks side-by-side report of model outputs
+func TestCompareOutputs(t *testing.T) {
+	rows := [][]float32{{1}, {2}, {3}, {4}}
+	outputsA := [][]float32{{0.9, 0.1}, {0.2, 0.8}, {0.6, 0.4}, {0.3, 0.7}}
+	outputsB := [][]float32{{0.9, 0.1}, {0.3, 0.7}, {0.1, 0.9}, {0.3, 0.7}}
+	report, err := compareOutputs(rows, outputsA, outputsB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 4 || report.Agreement != 0.75 {
+		t.Errorf("unexpected agreement %+v", report)
+	}
+	if math.Abs(report.MeanAbsDiff-0.15) > 1e-6 || report.Correlation <= 0 || report.Correlation >= 1 {
+		t.Errorf("unexpected differences %+v", report)
+	}
+	if len(report.Disagreements) != 1 || report.Disagreements[0].Row != 2 || math.Abs(report.Disagreements[0].Difference-0.5) > 1e-6 {
+		t.Errorf("unexpected disagreements %+v", report.Disagreements)
+	}
+	if _, err := compareOutputs(rows[:1], outputsA[:1], [][]float32{{1}}, 1); err == nil {
+		t.Error("outputs of different size are compared")
+	}
+	if decision([]float32{0.7}) != 1 || decision([]float32{0.3}) != 0 {
+		t.Error("unexpected decision of single output")
+	}
+}
+
+// TestCompareHandler checks scoring of dataset by two models
+func TestCompareHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	row := testRow("dnn")
+	req := CompareRequest{
+		Dataset: Dataset{Keys: row.Keys, Values: append(append([]float32{}, row.Values...), row.Values...), Shape: []int64{2, testNumKeys}},
+		Models:  []string{"dnn", "dnn2"},
+	}
+	data, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	CompareHandler(w, httptest.NewRequest("POST", "/compare", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+	}
+	var report CompareReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 2 || report.Agreement != 1 || len(report.Disagreements) != 0 || report.Models[1] != "dnn2" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	for _, c := range []struct {
+		req  CompareRequest
+		code int
+	}{
+		{CompareRequest{Dataset: req.Dataset, Models: []string{"dnn"}}, http.StatusBadRequest},
+		{CompareRequest{Dataset: Dataset{Values: []float32{1, 2, 3}, Shape: []int64{2, 2}}, Models: req.Models}, http.StatusBadRequest},
+		{CompareRequest{Dataset: req.Dataset, Models: []string{"dnn", "unknown"}}, http.StatusNotFound},
+	} {
+		data, _ := json.Marshal(c.req)
+		w := httptest.NewRecorder()
+		CompareHandler(w, httptest.NewRequest("POST", "/compare", bytes.NewReader(data)))
+		if w.Code != c.code {
+			t.Errorf("unexpected status %d of request %+v, expected %d", w.Code, c.req, c.code)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+// compression module provides compressed request bodies of batch endpoints
+//
+// Large binary and Arrow batches are expensive to compress with gzip,
+// therefore batch and tensor endpoints accept bodies compressed with zstd or
+// snappy (besides gzip), e.g.
+// zstd -c batch.bin | scurl -X POST -H "Content-Type: application/x-tfaas-batch" \
+//     -H "Content-Encoding: zstd" --data-binary @- "https://localhost:8083/predict/batch?model=dnn"
+// The codec is negotiated via Content-Encoding header, requests with other
+// codings are rejected with 415 status and Accept-Encoding header which
+// lists supported codings. Decompressed bodies are limited by
+// maxDecodedBody option (in MB, default 1024). Zstd and snappy codecs are
+// provided by github.com/klauspost/compress package.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings of request bodies
+const (
+	codingGzip         = "gzip"
+	codingZstd         = "zstd"
+	codingSnappy       = "snappy"
+	codingSnappyFramed = "x-snappy-framed"
+)
+
+// window size of zstd frames produced with default settings
+const zstdDefaultWindow = 8 << 20
+
+// stream identifier of snappy framing format
+const snappyStreamID = "\xff\x06\x00\x00sNaPpY"
+
+// content codings accepted by batch endpoints
+const acceptedCodings = "zstd, snappy, x-snappy-framed, gzip"
+
+// default limit in MB of decompressed request bodies
+const defaultMaxDecodedBody = 1024
+
+// helper function to return limit of decompressed request bodies
+func maxDecodedBody() int {
+	limit := _config.MaxDecodedBody
+	if limit <= 0 {
+		limit = defaultMaxDecodedBody
+	}
+	return limit << 20
+}
+
+// helper function to decode request body of given coding
+func decodeBody(coding string, body io.Reader, limit int) ([]byte, error) {
+	var reader io.Reader
+	switch coding {
+	case codingGzip:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case codingZstd:
+		// decoder memory is bounded by the limit, but it should fit window
+		// of zstd frames produced with default settings
+		memory := uint64(limit)
+		if memory < zstdDefaultWindow {
+			memory = zstdDefaultWindow
+		}
+		dec, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(memory))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		reader = dec
+	default:
+		// snappy coding is either framed stream, recognized by its stream
+		// identifier, or raw block
+		buf := bufio.NewReader(body)
+		if id, err := buf.Peek(len(snappyStreamID)); coding == codingSnappyFramed || (err == nil && string(id) == snappyStreamID) {
+			reader = snappy.NewReader(buf)
+			break
+		}
+		// compressed block is bounded by encoded size of the limit
+		data, err := ioutil.ReadAll(io.LimitReader(buf, int64(snappy.MaxEncodedLen(limit))+1))
+		if err != nil {
+			return nil, err
+		}
+		if size, err := snappy.DecodedLen(data); err != nil {
+			return nil, err
+		} else if size > limit {
+			return nil, errors.New("snappy: decoded data exceeds limit")
+		}
+		return snappy.Decode(nil, data)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err == nil && len(data) > limit {
+		err = fmt.Errorf("%s: decoded data exceeds limit", coding)
+	}
+	return data, err
+}
+
+// helper function to replace compressed request body by decoded one, it
+// writes error response and returns true if request can't be decoded
+func decodeRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	coding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch coding {
+	case "", "identity":
+		return false
+	case codingGzip, codingZstd, codingSnappy, codingSnappyFramed:
+	default:
+		w.Header().Set("Accept-Encoding", acceptedCodings)
+		msg := fmt.Sprintf("unsupported content encoding %s", coding)
+		responseError(w, msg, nil, http.StatusUnsupportedMediaType)
+		return true
+	}
+	data, err := decodeBody(coding, r.Body, maxDecodedBody())
+	r.Body.Close()
+	if err != nil {
+		msg := fmt.Sprintf("unable to decode %s request body", coding)
+		responseError(w, msg, err, http.StatusBadRequest)
+		return true
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	r.Header.Del("Content-Encoding")
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+// tests of compressed requests, they do not require TF C library
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// helper function to compress given data with all supported codings
+func compressedBodies(t *testing.T, data []byte) map[string][]byte {
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write(data)
+	gzWriter.Close()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var framed bytes.Buffer
+	snappyWriter := snappy.NewBufferedWriter(&framed)
+	snappyWriter.Write(data)
+	snappyWriter.Close()
+	return map[string][]byte{
+		"":                data,
+		"gzip":            gz.Bytes(),
+		"zstd":            encoder.EncodeAll(data, nil),
+		"snappy":          snappy.Encode(nil, data),
+		"x-snappy-framed": framed.Bytes(),
+	}
+}
+
+// TestDecodeBody checks decoding of compressed bodies and limit of decoded
+// data
+func TestDecodeBody(t *testing.T) {
+	data := bytes.Repeat([]byte("TFaaS compressed body "), 1000)
+	for coding, body := range compressedBodies(t, data) {
+		if coding == "" {
+			continue
+		}
+		if out, err := decodeBody(coding, bytes.NewReader(body), len(data)); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: wrong decoded body: %v", coding, err)
+		}
+		if _, err := decodeBody(coding, bytes.NewReader(body), len(data)-1); err == nil {
+			t.Errorf("%s: decoded body is not limited: %v", coding, err)
+		}
+		corrupted := append([]byte{}, body...)
+		corrupted[len(corrupted)/2] ^= 0xff
+		if out, err := decodeBody(coding, bytes.NewReader(corrupted), len(data)); err == nil && bytes.Equal(out, data) {
+			t.Errorf("%s: corrupted body is decoded", coding)
+		}
+	}
+	// framed snappy stream is recognized by its stream identifier
+	framed := compressedBodies(t, data)["x-snappy-framed"]
+	if out, err := decodeBody("snappy", bytes.NewReader(framed), len(data)); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("wrong decoded framed snappy stream: %v", err)
+	}
+}
+
+// TestCompressedBatch checks batch requests with compressed bodies
+func TestCompressedBatch(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	values := []float32{1, 2, 3, 4, 5, 6, 7, 8}
+	payload := encodeBinaryBatch([]int64{2, testNumKeys}, values)
+	for coding, body := range compressedBodies(t, payload) {
+		req := binaryBatchRequest(body)
+		req.Header.Set("Content-Encoding", coding)
+		rr := httptest.NewRecorder()
+		BatchHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: wrong status %d: %s", coding, rr.Code, rr.Body.String())
+		}
+		var probs [][]float32
+		if err := json.Unmarshal(rr.Body.Bytes(), &probs); err != nil || len(probs) != 2 {
+			t.Errorf("%s: wrong batch response %s", coding, rr.Body.String())
+		}
+	}
+
+	// unsupported codings are rejected with list of supported ones
+	req := binaryBatchRequest(payload)
+	req.Header.Set("Content-Encoding", "br")
+	rr := httptest.NewRecorder()
+	BatchHandler(rr, req)
+	if rr.Code != http.StatusUnsupportedMediaType || rr.Header().Get("Accept-Encoding") != acceptedCodings {
+		t.Errorf("wrong response %d %v of unsupported coding", rr.Code, rr.Header())
+	}
+	// corrupted bodies
+	req = binaryBatchRequest(payload)
+	req.Header.Set("Content-Encoding", "zstd")
+	rr = httptest.NewRecorder()
+	BatchHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of corrupted body", rr.Code)
+	}
+}
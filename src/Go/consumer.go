@@ -0,0 +1,529 @@
+package main
+
+// consumer module provides Kafka consumer mode of the server
+//
+// When "kafkaURL" (Kafka REST proxy URL) and "kafkaTopics" are configured
+// the server joins "kafkaGroup" consumer group (default tfaas), consumes
+// JSON Row records of input topics, scores them and produces results to
+// output topics, e.g.
+// "kafkaTopics": [{"input": "features", "model": "dnn", "output": "scores"}]
+// Without model the model of the Row is used, without output topic results
+// are produced to tfaas-predictions topic.
+//
+// Consumed records are buffered in the queue of "kafkaQueueSize" records
+// (default 1000) scored by "kafkaWorkers" workers (default 4). The consumer
+// pauses fetching of records when the queue is full (or the server drains)
+// and resumes it when the queue is half empty, such that slow models do not
+// cause unbounded memory growth. Offsets of records are committed only after
+// their results are produced (failed productions are retried), i.e. records
+// are delivered at least once and are never lost silently. Consumer lag of
+// assigned partitions, queue depth and pause state are exported by /metrics.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaults of Kafka consumer mode
+const (
+	defaultKafkaGroup     = "tfaas"
+	defaultKafkaOutput    = "tfaas-predictions"
+	defaultKafkaQueueSize = 1000
+	defaultKafkaWorkers   = 4
+)
+
+// intervals of Kafka consumer mode
+const (
+	kafkaPollTimeout  = time.Second      // long poll timeout of records fetch
+	kafkaRetryDelay   = 5 * time.Second  // delay of retries of failed REST proxy calls
+	kafkaPauseDelay   = time.Second      // delay of queue checks of paused consumer
+	kafkaLagInterval  = 15 * time.Second // interval of offsets commits and lag updates
+	kafkaMaxBackoff   = 30 * time.Second // max delay of retries of failed productions
+	kafkaMaxFetchSize = 1 << 20          // max size in bytes of fetched records
+)
+
+// Kafka REST proxy content type of API requests
+const kafkaV2ContentType = "application/vnd.kafka.v2+json"
+
+// KafkaTopic represents input topic of Kafka consumer mode
+type KafkaTopic struct {
+	Input  string `json:"input"`  // input topic
+	Model  string `json:"model"`  // model name, default model of the Row
+	Output string `json:"output"` // output topic, default tfaas-predictions
+}
+
+// KafkaMessage represents record consumed via REST proxy
+type KafkaMessage struct {
+	Topic     string          `json:"topic"`     // record topic
+	Key       json.RawMessage `json:"key"`       // record key
+	Value     json.RawMessage `json:"value"`     // record value
+	Partition int             `json:"partition"` // record partition
+	Offset    int64           `json:"offset"`    // record offset
+}
+
+// KafkaResult represents record produced to output topic
+type KafkaResult struct {
+	Topic       string    `json:"topic"`                 // input topic of the record
+	Partition   int       `json:"partition"`             // input partition of the record
+	Offset      int64     `json:"offset"`                // input offset of the record
+	Model       string    `json:"model"`                 // model name
+	Predictions []float32 `json:"predictions,omitempty"` // model predictions
+	Error       string    `json:"error,omitempty"`       // prediction error
+	EventID     string    `json:"eventID,omitempty"`     // client event identifier of the record
+	ResultKey   string    `json:"resultKey"`             // idempotent key of the result, see resultkeys module
+}
+
+// KafkaPartition represents consumed partition of input topic
+type KafkaPartition struct {
+	Topic     string         // topic name
+	Partition int            // partition number
+	Consumed  int64          // offset of the last fetched record
+	Committed int64          // offset of the last committed record
+	End       int64          // end offset (offset of the next produced record)
+	inflight  map[int64]bool // offsets of queued records
+}
+
+// KafkaConsumer represents consumer of Kafka consumer mode
+type KafkaConsumer struct {
+	URL        string       // Kafka REST proxy URL
+	Group      string       // consumer group
+	Topics     []KafkaTopic // input topics
+	baseURI    string       // URI of consumer instance
+	queue      chan KafkaMessage
+	low, high  int   // queue depths of consumer resume and pause
+	paused     int32 // consumer is paused
+	pauses     uint64
+	consumed   uint64
+	processed  uint64
+	failed     uint64
+	lock       sync.Mutex
+	partitions map[string]*KafkaPartition
+}
+
+// global consumer of Kafka consumer mode
+var _kafkaConsumer *KafkaConsumer
+
+// helper function to create Kafka consumer
+func newKafkaConsumer(rurl, group string, topics []KafkaTopic, queueSize int) *KafkaConsumer {
+	if group == "" {
+		group = defaultKafkaGroup
+	}
+	if queueSize <= 0 {
+		queueSize = defaultKafkaQueueSize
+	}
+	return &KafkaConsumer{
+		URL:        strings.TrimRight(rurl, "/"),
+		Group:      group,
+		Topics:     topics,
+		queue:      make(chan KafkaMessage, queueSize),
+		low:        queueSize / 2,
+		high:       queueSize,
+		partitions: make(map[string]*KafkaPartition),
+	}
+}
+
+// helper function to call Kafka REST proxy API
+func (c *KafkaConsumer) call(method, api, accept string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", kafkaV2ContentType)
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := kafkaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errKafkaInstanceNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka REST proxy %s responded with status %s", api, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// error of expired consumer instance of REST proxy
+var errKafkaInstanceNotFound = errors.New("kafka consumer instance is not found")
+
+// helper function to create consumer instance and subscribe it to input topics
+func (c *KafkaConsumer) subscribe() error {
+	b := make([]byte, 4)
+	rand.Read(b)
+	host, _ := os.Hostname()
+	spec := map[string]string{
+		"name":               fmt.Sprintf("%s-%s", host, hex.EncodeToString(b)),
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}
+	var instance struct {
+		ID      string `json:"instance_id"`
+		BaseURI string `json:"base_uri"`
+	}
+	api := fmt.Sprintf("%s/consumers/%s", c.URL, c.Group)
+	if err := c.call("POST", api, kafkaV2ContentType, spec, &instance); err != nil {
+		return err
+	}
+	var topics []string
+	for _, t := range c.Topics {
+		topics = append(topics, t.Input)
+	}
+	if err := c.call("POST", instance.BaseURI+"/subscription", kafkaV2ContentType, map[string]interface{}{"topics": topics}, nil); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.baseURI = instance.BaseURI
+	// partitions are reassigned to new consumer instance
+	c.partitions = make(map[string]*KafkaPartition)
+	c.lock.Unlock()
+	log.Printf("consume Kafka topics %v of %s as %s", topics, c.URL, instance.ID)
+	return nil
+}
+
+// helper function to return URI of consumer instance
+func (c *KafkaConsumer) instance() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.baseURI
+}
+
+// helper function to forget expired consumer instance
+func (c *KafkaConsumer) expire(err error) {
+	if err == errKafkaInstanceNotFound {
+		c.lock.Lock()
+		c.baseURI = ""
+		c.lock.Unlock()
+	}
+}
+
+// helper function to keep track of fetched record
+func (c *KafkaConsumer) track(msg KafkaMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := fmt.Sprintf("%s/%d", msg.Topic, msg.Partition)
+	p, ok := c.partitions[key]
+	if !ok {
+		p = &KafkaPartition{Topic: msg.Topic, Partition: msg.Partition, Consumed: msg.Offset, Committed: msg.Offset - 1, inflight: make(map[int64]bool)}
+		c.partitions[key] = p
+	}
+	p.inflight[msg.Offset] = true
+	if msg.Offset > p.Consumed {
+		p.Consumed = msg.Offset
+	}
+	if p.End <= p.Consumed {
+		p.End = p.Consumed + 1
+	}
+}
+
+// helper function to mark record as processed
+func (c *KafkaConsumer) done(msg KafkaMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p, ok := c.partitions[fmt.Sprintf("%s/%d", msg.Topic, msg.Partition)]; ok {
+		delete(p.inflight, msg.Offset)
+	}
+}
+
+// step performs one iteration of fetch loop of the consumer, it returns
+// delay of the next iteration
+func (c *KafkaConsumer) step() time.Duration {
+	base := c.instance()
+	if base == "" {
+		if err := c.subscribe(); err != nil {
+			log.Println("unable to subscribe Kafka consumer", err)
+			return kafkaRetryDelay
+		}
+		base = c.instance()
+	}
+	depth := len(c.queue)
+	if atomic.LoadInt32(&c.paused) == 1 {
+		if depth > c.low || drainMode().Draining {
+			// keep consumer instance of REST proxy alive
+			if err := c.call("GET", base+"/subscription", kafkaV2ContentType, nil, nil); err != nil {
+				c.expire(err)
+			}
+			return kafkaPauseDelay
+		}
+		atomic.StoreInt32(&c.paused, 0)
+		log.Printf("resume Kafka consumer, queue depth %d", depth)
+	}
+	if depth >= c.high || drainMode().Draining {
+		atomic.StoreInt32(&c.paused, 1)
+		atomic.AddUint64(&c.pauses, 1)
+		log.Printf("pause Kafka consumer, queue depth %d", depth)
+		return 0
+	}
+	var records []KafkaMessage
+	api := fmt.Sprintf("%s/records?timeout=%d&max_bytes=%d", base, kafkaPollTimeout.Milliseconds(), kafkaMaxFetchSize)
+	if err := c.call("GET", api, kafkaJSONContentType, nil, &records); err != nil {
+		log.Println("unable to fetch Kafka records", err)
+		c.expire(err)
+		return kafkaRetryDelay
+	}
+	for _, msg := range records {
+		c.track(msg)
+		atomic.AddUint64(&c.consumed, 1)
+		c.queue <- msg
+	}
+	return 0
+}
+
+// helper function to return input topic of the record
+func (c *KafkaConsumer) topic(name string) KafkaTopic {
+	for _, t := range c.Topics {
+		if t.Input == name {
+			return t
+		}
+	}
+	return KafkaTopic{Input: name}
+}
+
+// helper function to score consumed record
+func (c *KafkaConsumer) score(msg KafkaMessage) (string, KafkaResult) {
+	t := c.topic(msg.Topic)
+	output := t.Output
+	if output == "" {
+		output = defaultKafkaOutput
+	}
+	result := KafkaResult{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset, Model: t.Model}
+	key := fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+	result.ResultKey = key
+	row := &Row{}
+	if err := json.Unmarshal(msg.Value, row); err != nil {
+		result.Error = fmt.Sprintf("unable to unmarshal Row: %v", err)
+		deadLetter("kafka", msg.Topic, key, result.Model, deadLetterValidation, msg.Value, err)
+		return output, result
+	}
+	if result.Model != "" {
+		row.Model = result.Model
+	}
+	if row.Model == "" {
+		row.Model = _params.Name
+	}
+	result.Model = row.Model
+	result.EventID = row.EventID
+	result.ResultKey = resultKey(msg.Topic, msg.Partition, msg.Offset, row.EventID)
+	if err := validatePayload(row.Model, msg.Value); err != nil {
+		result.Error = fmt.Sprintf("payload does not match input schema: %v", err)
+		deadLetter("kafka", msg.Topic, key, row.Model, deadLetterValidation, msg.Value, err)
+		return output, result
+	}
+	observeUsage("kafka:"+msg.Topic, row.Model, 1)
+	probs, _, err := predictWithFallback(row)
+	if err != nil {
+		publish(EventPredictionFailed, row.Model, err.Error())
+		result.Error = fmt.Sprintf("unable to make predictions: %v", err)
+		deadLetter("kafka", msg.Topic, key, row.Model, deadLetterInference, msg.Value, err)
+		return output, result
+	}
+	logPrediction(row, row.Model, probs)
+	result.Predictions = probs
+	return output, result
+}
+
+// helper function to score queued records
+func (c *KafkaConsumer) worker() {
+	for msg := range c.queue {
+		output, result := c.score(msg)
+		if result.Error != "" {
+			atomic.AddUint64(&c.failed, 1)
+		}
+		if _resultKeys.seen(result.ResultKey) {
+			// result of replayed record is already produced
+			atomic.AddUint64(&c.processed, 1)
+			c.done(msg)
+			continue
+		}
+		delay := time.Second
+		for {
+			err := kafkaProduce(c.URL, output, []KafkaRecord{{Key: result.ResultKey, Value: result}})
+			if err == nil {
+				break
+			}
+			log.Println("unable to produce Kafka result", output, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > kafkaMaxBackoff {
+				delay = kafkaMaxBackoff
+			}
+		}
+		if err := _resultKeys.add(result.ResultKey); err != nil {
+			log.Println("unable to record Kafka result key", result.ResultKey, err)
+		}
+		atomic.AddUint64(&c.processed, 1)
+		c.done(msg)
+	}
+}
+
+// helper function to commit offsets of processed records, offsets of
+// partitions with queued records are committed up to the first of them
+func (c *KafkaConsumer) commit() error {
+	base := c.instance()
+	if base == "" {
+		return nil
+	}
+	type offset struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+	}
+	var offsets []offset
+	var parts []*KafkaPartition
+	c.lock.Lock()
+	for _, p := range c.partitions {
+		last := p.Consumed
+		for o := range p.inflight {
+			if o-1 < last {
+				last = o - 1
+			}
+		}
+		if last > p.Committed {
+			offsets = append(offsets, offset{p.Topic, p.Partition, last})
+			parts = append(parts, p)
+		}
+	}
+	c.lock.Unlock()
+	if len(offsets) == 0 {
+		return nil
+	}
+	if err := c.call("POST", base+"/offsets", kafkaV2ContentType, map[string]interface{}{"offsets": offsets}, nil); err != nil {
+		c.expire(err)
+		return err
+	}
+	c.lock.Lock()
+	for i, p := range parts {
+		p.Committed = offsets[i].Offset
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// helper function to update end offsets of consumed partitions
+func (c *KafkaConsumer) updateLag() {
+	c.lock.Lock()
+	var parts []KafkaPartition
+	for _, p := range c.partitions {
+		parts = append(parts, *p)
+	}
+	c.lock.Unlock()
+	for _, p := range parts {
+		var offsets struct {
+			End int64 `json:"end_offset"`
+		}
+		api := fmt.Sprintf("%s/topics/%s/partitions/%d/offsets", c.URL, p.Topic, p.Partition)
+		if err := c.call("GET", api, kafkaV2ContentType, nil, &offsets); err != nil {
+			log.Println("unable to get Kafka offsets", err)
+			continue
+		}
+		c.lock.Lock()
+		if cp, ok := c.partitions[fmt.Sprintf("%s/%d", p.Topic, p.Partition)]; ok {
+			cp.End = offsets.End
+		}
+		c.lock.Unlock()
+	}
+}
+
+// helper function to return consumed partitions ordered by topic and partition
+func (c *KafkaConsumer) report() []KafkaPartition {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var parts []KafkaPartition
+	for _, p := range c.partitions {
+		parts = append(parts, *p)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].Topic != parts[j].Topic {
+			return parts[i].Topic < parts[j].Topic
+		}
+		return parts[i].Partition < parts[j].Partition
+	})
+	return parts
+}
+
+// helper function to write metrics of Kafka consumer
+func writeKafkaMetrics(w io.Writer) {
+	c := _kafkaConsumer
+	if c == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP tfaas_kafka_consumer_lag number of records of partition which are not consumed yet\n")
+	fmt.Fprintf(w, "# TYPE tfaas_kafka_consumer_lag gauge\n")
+	for _, p := range c.report() {
+		lag := p.End - p.Consumed - 1
+		if lag < 0 {
+			lag = 0
+		}
+		fmt.Fprintf(w, "tfaas_kafka_consumer_lag%s %d\n", metricLabels("topic", p.Topic, "partition", fmt.Sprintf("%d", p.Partition)), lag)
+	}
+	fmt.Fprintf(w, "# HELP tfaas_kafka_queue_depth number of queued records of Kafka consumer\n")
+	fmt.Fprintf(w, "# TYPE tfaas_kafka_queue_depth gauge\n")
+	fmt.Fprintf(w, "tfaas_kafka_queue_depth %d\n", len(c.queue))
+	fmt.Fprintf(w, "# HELP tfaas_kafka_paused Kafka consumer is paused by full queue\n")
+	fmt.Fprintf(w, "# TYPE tfaas_kafka_paused gauge\n")
+	fmt.Fprintf(w, "tfaas_kafka_paused %d\n", atomic.LoadInt32(&c.paused))
+	fmt.Fprintf(w, "# HELP tfaas_kafka_pauses_total number of pauses of Kafka consumer\n")
+	fmt.Fprintf(w, "# TYPE tfaas_kafka_pauses_total counter\n")
+	fmt.Fprintf(w, "tfaas_kafka_pauses_total %d\n", atomic.LoadUint64(&c.pauses))
+	fmt.Fprintf(w, "# HELP tfaas_kafka_records_total number of Kafka records\n")
+	fmt.Fprintf(w, "# TYPE tfaas_kafka_records_total counter\n")
+	fmt.Fprintf(w, "tfaas_kafka_records_total%s %d\n", metricLabels("state", "consumed"), atomic.LoadUint64(&c.consumed))
+	fmt.Fprintf(w, "tfaas_kafka_records_total%s %d\n", metricLabels("state", "processed"), atomic.LoadUint64(&c.processed))
+	fmt.Fprintf(w, "tfaas_kafka_records_total%s %d\n", metricLabels("state", "failed"), atomic.LoadUint64(&c.failed))
+}
+
+// initKafkaConsumer starts Kafka consumer mode of the server
+func initKafkaConsumer() {
+	if _config.KafkaURL == "" || len(_config.KafkaTopics) == 0 {
+		return
+	}
+	c := newKafkaConsumer(_config.KafkaURL, _config.KafkaGroup, _config.KafkaTopics, _config.KafkaQueueSize)
+	_kafkaConsumer = c
+	workers := _config.KafkaWorkers
+	if workers <= 0 {
+		workers = defaultKafkaWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go c.worker()
+	}
+	go func() {
+		for {
+			time.Sleep(c.step())
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(kafkaLagInterval)
+			if err := c.commit(); err != nil {
+				log.Println("unable to commit Kafka offsets", err)
+			}
+			c.updateLag()
+		}
+	}()
+}
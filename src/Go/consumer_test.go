@@ -0,0 +1,161 @@
+package main
+
+// tests of Kafka consumer mode, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeKafkaProxy represents minimal Kafka REST proxy of consumer tests
+type fakeKafkaProxy struct {
+	records  []KafkaMessage
+	produced []KafkaResult
+	offsets  map[string]int64
+	lock     sync.Mutex
+}
+
+// ServeHTTP implements http.Handler interface of fake REST proxy
+func (p *fakeKafkaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/consumers/tfaas":
+		fmt.Fprintf(w, `{"instance_id": "c1", "base_uri": "http://%s/consumers/tfaas/instances/c1"}`, r.Host)
+	case strings.HasSuffix(r.URL.Path, "/subscription"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(r.URL.Path, "/records"):
+		// deliver two records per fetch
+		n := len(p.records)
+		if n > 2 {
+			n = 2
+		}
+		json.NewEncoder(w).Encode(p.records[:n])
+		p.records = p.records[n:]
+	case strings.HasSuffix(r.URL.Path, "/offsets") && r.Method == "POST":
+		var req struct {
+			Offsets []struct {
+				Topic     string
+				Partition int
+				Offset    int64
+			}
+		}
+		json.Unmarshal(body, &req)
+		for _, o := range req.Offsets {
+			p.offsets[fmt.Sprintf("%s/%d", o.Topic, o.Partition)] = o.Offset
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(r.URL.Path, "/offsets"):
+		w.Write([]byte(`{"beginning_offset": 0, "end_offset": 100}`))
+	case strings.HasPrefix(r.URL.Path, "/topics/"):
+		var req struct{ Records []KafkaRecord }
+		json.Unmarshal(body, &req)
+		for _, rec := range req.Records {
+			var res KafkaResult
+			data, _ := json.Marshal(rec.Value)
+			json.Unmarshal(data, &res)
+			p.produced = append(p.produced, res)
+		}
+		w.Write([]byte(`{"offsets": []}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// TestFakeKafkaConsumer checks backpressure, results and offsets of Kafka consumer
+func TestFakeKafkaConsumer(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	proxy := &fakeKafkaProxy{offsets: make(map[string]int64)}
+	for i := 0; i < 6; i++ {
+		row := testRow("")
+		row.EventID = fmt.Sprintf("evt%d", i)
+		data, _ := json.Marshal(row)
+		if i == 5 {
+			data = []byte(`"not a row"`)
+		}
+		proxy.records = append(proxy.records, KafkaMessage{Topic: "features", Partition: i % 2, Offset: int64(10 + i/2), Value: data})
+	}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	c := newKafkaConsumer(srv.URL, "", []KafkaTopic{{Input: "features", Model: "dnn", Output: "scores"}}, 4)
+	_kafkaConsumer = c
+	defer func() { _kafkaConsumer = nil }()
+
+	// the queue is filled without workers and the consumer pauses
+	for i := 0; i < 3; i++ {
+		c.step()
+	}
+	if len(c.queue) != 4 || c.paused != 1 || c.pauses != 1 {
+		t.Fatalf("consumer is not paused, queue %d paused %d", len(c.queue), c.paused)
+	}
+	if c.step(); len(c.queue) != 4 {
+		t.Errorf("paused consumer fetches records, queue %d", len(c.queue))
+	}
+
+	// nothing is committed before records are processed
+	c.commit()
+	if len(proxy.offsets) != 0 {
+		t.Errorf("offsets of queued records are committed %v", proxy.offsets)
+	}
+	go c.worker()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the consumer resumes with drained queue
+	c.step()
+	if c.paused != 0 || c.consumed != 6 {
+		t.Errorf("consumer is not resumed, paused %d consumed %d", c.paused, c.consumed)
+	}
+	for atomic.LoadUint64(&c.processed) < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(c.queue)
+
+	proxy.lock.Lock()
+	if len(proxy.produced) != 6 {
+		t.Fatalf("wrong number of produced results %d", len(proxy.produced))
+	}
+	for _, res := range proxy.produced {
+		if res.Offset == 12 && res.Partition == 1 {
+			if res.Error == "" {
+				t.Errorf("invalid record is not reported %+v", res)
+			}
+			continue
+		}
+		if res.Model != "dnn" || res.EventID == "" || res.Error != "" {
+			t.Errorf("wrong result %+v", res)
+		}
+		checkProbs(t, res.Predictions)
+	}
+	proxy.lock.Unlock()
+
+	if err := c.commit(); err != nil {
+		t.Fatal(err)
+	}
+	c.updateLag()
+	if proxy.offsets["features/0"] != 12 || proxy.offsets["features/1"] != 12 {
+		t.Errorf("wrong committed offsets %v", proxy.offsets)
+	}
+	var buf bytes.Buffer
+	writeKafkaMetrics(&buf)
+	for _, m := range []string{
+		`tfaas_kafka_consumer_lag{topic="features",partition="0"} 87`,
+		`tfaas_kafka_records_total{state="failed"} 1`,
+		`tfaas_kafka_pauses_total 1`,
+	} {
+		if !strings.Contains(buf.String(), m) {
+			t.Errorf("metric %s is missing in\n%s", m, buf.String())
+		}
+	}
+}
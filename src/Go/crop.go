@@ -0,0 +1,93 @@
+package main
+
+// crop module provides region of interest cropping of images
+//
+// Images may have large irrelevant borders which hurt model accuracy.
+// Clients may provide crop rectangle of image predictions via crop form
+// field (or query parameter) in x,y,width,height form, e.g.
+// -F 'crop=100,50,640,480', while models may declare central crop fraction
+// in their params.json, e.g. "central_crop": 0.8, which keeps central 80%
+// of both image dimensions in the same way as tf.image.central_crop does.
+// Crop rectangle refers to the image after orientation correction (see exif
+// module) and takes precedence over central crop of the model. Cropping is
+// applied before the image is passed to TF.
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ROI represents region of interest of the image
+type ROI struct {
+	Rect    image.Rectangle // crop rectangle in pixels
+	Central float64         // fraction of central crop
+}
+
+// helper function to parse crop rectangle in x,y,width,height form
+func parseCrop(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid crop %q, expected x,y,width,height", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid crop %q, expected x,y,width,height", s)
+		}
+		v[i] = n
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("empty crop %q", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// requestROI returns region of interest of image prediction request of the
+// model with given parameters, it returns nil if image should not be cropped
+func requestROI(r *http.Request, params TFParams) (*ROI, error) {
+	if v := r.FormValue("crop"); v != "" {
+		rect, err := parseCrop(v)
+		if err != nil {
+			return nil, err
+		}
+		return &ROI{Rect: rect}, nil
+	}
+	if params.CentralCrop < 0 || params.CentralCrop > 1 {
+		return nil, fmt.Errorf("invalid central crop %v of %s model", params.CentralCrop, params.Name)
+	}
+	if params.CentralCrop > 0 && params.CentralCrop < 1 {
+		return &ROI{Central: params.CentralCrop}, nil
+	}
+	return nil, nil
+}
+
+// rect returns crop rectangle of the image with given bounds
+func (roi *ROI) rect(bounds image.Rectangle) (image.Rectangle, error) {
+	if roi.Central > 0 {
+		w, h := bounds.Dx(), bounds.Dy()
+		x0 := int((float64(w) - float64(w)*roi.Central) / 2)
+		y0 := int((float64(h) - float64(h)*roi.Central) / 2)
+		return image.Rect(x0, y0, w-x0, h-y0).Add(bounds.Min), nil
+	}
+	rect := roi.Rect.Add(bounds.Min)
+	if !rect.In(bounds) {
+		return rect, fmt.Errorf("crop %v is outside of %dx%d image", roi.Rect, bounds.Dx(), bounds.Dy())
+	}
+	return rect, nil
+}
+
+// helper function to crop image to region of interest
+func cropImage(img *image.NRGBA, roi *ROI) (image.Image, error) {
+	if roi == nil {
+		return img, nil
+	}
+	rect, err := roi.rect(img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+	return img.SubImage(rect), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+// tests of image cropping, they do not require TF C library
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// helper function to create 32x32 PNG image with pixel coordinates encoded
+// in red and green channels
+func gradientPNG(t *testing.T) *bytes.Buffer {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// TestParseCrop checks parsing of crop rectangles
+func TestParseCrop(t *testing.T) {
+	rect, err := parseCrop("8, 4,10,6")
+	if err != nil || rect != image.Rect(8, 4, 18, 10) {
+		t.Errorf("wrong crop %v: %v", rect, err)
+	}
+	for _, s := range []string{"1,2,3", "a,b,c,d", "1,2,0,4", "-1,0,2,2"} {
+		if _, err := parseCrop(s); err == nil {
+			t.Errorf("crop %q should be rejected", s)
+		}
+	}
+}
+
+// TestFakeImageCrop checks cropping of images before tensor creation
+func TestFakeImageCrop(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	tests := []struct {
+		roi           *ROI
+		height, width int64
+		x, y          float32 // coordinates of the first pixel
+	}{
+		{&ROI{Rect: image.Rect(8, 4, 18, 10)}, 6, 10, 8, 4},
+		{&ROI{Central: 0.5}, 16, 16, 8, 8},
+		{nil, 32, 32, 0, 0},
+	}
+	for _, tt := range tests {
+		tensor, err := makeTensorFromImage(gradientPNG(t), "png", 3, tt.roi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shape := tensor.Shape()
+		values := tensor.Value().([]float32)
+		if shape[1] != tt.height || shape[2] != tt.width || values[0] != tt.x || values[1] != tt.y {
+			t.Errorf("wrong crop %+v, shape %v first pixel %v", tt.roi, shape, values[:3])
+		}
+	}
+	roi := &ROI{Rect: image.Rect(30, 0, 40, 10)}
+	if _, err := makeTensorFromImage(gradientPNG(t), "png", 3, roi); err == nil {
+		t.Error("crop outside of image should be rejected")
+	}
+
+	// crop of image requests
+	req := imageRequest(t, "img")
+	req.URL.RawQuery = "crop=0,0,100,100"
+	rr := httptest.NewRecorder()
+	ImageHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of crop outside of image", rr.Code)
+	}
+	req = imageRequest(t, "img")
+	req.URL.RawQuery = "crop=0,0,16,16"
+	rr = httptest.NewRecorder()
+	ImageHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+// deadletter module provides dead-letter handling of streaming inputs
+//
+// Messages of streaming modes (Kafka, NATS and MQTT) which fail validation
+// (malformed rows or payloads violating input schema of the model) or
+// inference are published together with error metadata to dead-letter
+// destination configured by "deadLetter" option, e.g.
+// "deadLetter": {"type": "kafka", "url": "http://kafka-rest:8082", "topic": "tfaas-dead-letters"}
+// "deadLetter": {"type": "nats", "url": "nats://nats:4222", "topic": "tfaas.deadletters"}
+// "deadLetter": {"type": "file", "path": "/data/tfaas/deadletters.json"}
+// Without url Kafka and NATS destinations use URLs of the streaming modes.
+// Every dead letter is JSON record with source, topic, key, model, stage
+// (validation or inference), error and original payload of the message, and
+// dead letters are counted by tfaas_dead_letters_total metric.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stages of failed streaming messages
+const (
+	deadLetterValidation = "validation"
+	deadLetterInference  = "inference"
+)
+
+// default dead-letter topics of Kafka and NATS destinations
+const (
+	defaultDeadLetterTopic   = "tfaas-dead-letters"
+	defaultDeadLetterSubject = "tfaas.deadletters"
+)
+
+// DeadLetterConfig represents dead-letter destination of streaming modes
+type DeadLetterConfig struct {
+	Type  string `json:"type"`  // destination type: kafka, nats or file
+	URL   string `json:"url"`   // Kafka REST proxy or NATS URL, default URL of the streaming mode
+	Topic string `json:"topic"` // Kafka topic or NATS subject of dead letters
+	Path  string `json:"path"`  // file of dead letters (JSON lines)
+}
+
+// DeadLetter represents failed message of streaming mode
+type DeadLetter struct {
+	Source    string `json:"source"`        // streaming mode: kafka, nats or mqtt
+	Topic     string `json:"topic"`         // input topic or subject of the message
+	Key       string `json:"key,omitempty"` // key of the message, e.g. topic/partition/offset of Kafka records
+	Model     string `json:"model"`         // model name
+	Stage     string `json:"stage"`         // failed stage: validation or inference
+	Error     string `json:"error"`         // error message
+	Payload   string `json:"payload"`       // original payload of the message
+	Host      string `json:"host"`          // host name of the server
+	Timestamp int64  `json:"timestamp"`     // failure time stamp (unix seconds)
+}
+
+// DeadLetterSink represents dead-letter destination
+type DeadLetterSink interface {
+	Send(letter DeadLetter) error
+}
+
+// KafkaDeadLetters sends dead letters to Kafka topic via REST proxy
+type KafkaDeadLetters struct {
+	URL   string // Kafka REST proxy URL
+	Topic string // dead-letter topic
+}
+
+// Send implements DeadLetterSink interface
+func (s *KafkaDeadLetters) Send(letter DeadLetter) error {
+	return kafkaProduce(s.URL, s.Topic, []KafkaRecord{{Key: letter.Key, Value: letter}})
+}
+
+// NATSDeadLetters publishes dead letters to NATS subject
+type NATSDeadLetters struct {
+	Conn    *NATSConn // NATS connection
+	Subject string    // dead-letter subject
+}
+
+// Send implements DeadLetterSink interface
+func (s *NATSDeadLetters) Send(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return s.Conn.publish(s.Subject, data)
+}
+
+// FileDeadLetters appends dead letters to file as JSON lines
+type FileDeadLetters struct {
+	Path string
+	lock sync.Mutex
+}
+
+// Send implements DeadLetterSink interface
+func (s *FileDeadLetters) Send(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return appendLine(s.Path, data)
+}
+
+// global dead-letter destination and counters of dead letters
+var (
+	_deadLetters       DeadLetterSink
+	_deadLetterCounts  = make(map[string]uint64)
+	_deadLetterFailed  uint64
+	_deadLetterCountMu sync.Mutex
+)
+
+// helper function to create dead-letter destination from its configuration
+func newDeadLetterSink(cfg DeadLetterConfig) (DeadLetterSink, error) {
+	switch cfg.Type {
+	case "kafka":
+		if cfg.URL == "" {
+			cfg.URL = _config.KafkaURL
+		}
+		if cfg.Topic == "" {
+			cfg.Topic = defaultDeadLetterTopic
+		}
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("kafka dead-letter destination requires url")
+		}
+		return &KafkaDeadLetters{URL: cfg.URL, Topic: cfg.Topic}, nil
+	case "nats":
+		if cfg.URL == "" {
+			cfg.URL = _config.NATSURL
+		}
+		if cfg.Topic == "" {
+			cfg.Topic = defaultDeadLetterSubject
+		}
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("nats dead-letter destination requires url")
+		}
+		return &NATSDeadLetters{Conn: newNATSConn(cfg.URL), Subject: cfg.Topic}, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file dead-letter destination requires path")
+		}
+		return &FileDeadLetters{Path: cfg.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown dead-letter destination type '%s'", cfg.Type)
+}
+
+// initDeadLetters sets up dead-letter destination of streaming modes
+func initDeadLetters() error {
+	if _config.DeadLetter == nil {
+		return nil
+	}
+	sink, err := newDeadLetterSink(*_config.DeadLetter)
+	if err != nil {
+		return err
+	}
+	_deadLetters = sink
+	return nil
+}
+
+// helper function to publish failed message of streaming mode to
+// dead-letter destination
+func deadLetter(source, topic, key, model, stage string, payload []byte, err error) {
+	_deadLetterCountMu.Lock()
+	_deadLetterCounts[source+"/"+stage]++
+	_deadLetterCountMu.Unlock()
+	if _deadLetters == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	letter := DeadLetter{
+		Source:    source,
+		Topic:     topic,
+		Key:       key,
+		Model:     model,
+		Stage:     stage,
+		Error:     err.Error(),
+		Payload:   string(payload),
+		Host:      host,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := _deadLetters.Send(letter); err != nil {
+		_deadLetterCountMu.Lock()
+		_deadLetterFailed++
+		_deadLetterCountMu.Unlock()
+		log.Printf("unable to send dead letter of %s %s: %v", source, topic, err)
+	}
+}
+
+// helper function to write metrics of dead letters
+func writeDeadLetterMetrics(w io.Writer) {
+	_deadLetterCountMu.Lock()
+	defer _deadLetterCountMu.Unlock()
+	if len(_deadLetterCounts) == 0 {
+		return
+	}
+	var keys []string
+	for k := range _deadLetterCounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP tfaas_dead_letters_total number of failed messages of streaming modes\n")
+	fmt.Fprintf(w, "# TYPE tfaas_dead_letters_total counter\n")
+	for _, k := range keys {
+		parts := strings.SplitN(k, "/", 2)
+		fmt.Fprintf(w, "tfaas_dead_letters_total%s %d\n", metricLabels("source", parts[0], "stage", parts[1]), _deadLetterCounts[k])
+	}
+	fmt.Fprintf(w, "# HELP tfaas_dead_letters_failed_total number of dead letters which were not delivered\n")
+	fmt.Fprintf(w, "# TYPE tfaas_dead_letters_failed_total counter\n")
+	fmt.Fprintf(w, "tfaas_dead_letters_failed_total %d\n", _deadLetterFailed)
+}
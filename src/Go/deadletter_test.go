@@ -0,0 +1,80 @@
+package main
+
+// tests of dead-letter handling, they do not require TF C library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFakeDeadLetters checks dead letters of failed streaming messages
+func TestFakeDeadLetters(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	path := filepath.Join(t.TempDir(), "deadletters.json")
+	_config.DeadLetter = &DeadLetterConfig{Type: "file", Path: path}
+	defer func() { _config.DeadLetter = nil; _deadLetters = nil }()
+	if err := initDeadLetters(); err != nil {
+		t.Fatal(err)
+	}
+
+	topics := []MQTTTopic{{Input: "lab/+/features/+"}}
+	row, _ := json.Marshal(testRow(""))
+	if _, res := mqttPredict(topics, "lab/d1/features/dnn", row); res.Error != "" {
+		t.Fatalf("valid message failed: %s", res.Error)
+	}
+	mqttPredict(topics, "lab/d1/features/dnn", []byte("not a row"))
+	mqttPredict(topics, "lab/d1/features/missing", row)
+	natsPredict("dnn", NATSMsg{Subject: "tfaas.predict.dnn", Data: []byte(`{"values": "x"}`)})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	expect := []DeadLetter{
+		{Source: "mqtt", Topic: "lab/d1/features/dnn", Model: "dnn", Stage: deadLetterValidation, Payload: "not a row"},
+		{Source: "mqtt", Topic: "lab/d1/features/missing", Model: "missing", Stage: deadLetterInference, Payload: string(row)},
+		{Source: "nats", Topic: "tfaas.predict.dnn", Model: "dnn", Stage: deadLetterValidation, Payload: `{"values": "x"}`},
+	}
+	if len(letters) != len(expect) {
+		t.Fatalf("wrong number of dead letters %d: %+v", len(letters), letters)
+	}
+	for i, e := range expect {
+		l := letters[i]
+		if l.Source != e.Source || l.Topic != e.Topic || l.Model != e.Model || l.Stage != e.Stage || l.Payload != e.Payload || l.Error == "" {
+			t.Errorf("wrong dead letter %+v, expected %+v", l, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	writeDeadLetterMetrics(&buf)
+	for _, m := range []string{
+		`tfaas_dead_letters_total{source="mqtt",stage="validation"}`,
+		`tfaas_dead_letters_total{source="mqtt",stage="inference"}`,
+		`tfaas_dead_letters_total{source="nats",stage="validation"}`,
+	} {
+		if !strings.Contains(buf.String(), m) {
+			t.Errorf("metric %s is missing in\n%s", m, buf.String())
+		}
+	}
+
+	for _, cfg := range []DeadLetterConfig{{Type: "file"}, {Type: "kafka"}, {Type: "queue"}} {
+		if _, err := newDeadLetterSink(cfg); err == nil {
+			t.Errorf("invalid destination %+v is accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// decision module provides per-class decision thresholds
+//
+// Imbalanced classifiers rarely use the same threshold for every class and
+// clients should not re-implement thresholding logic on their own. Models
+// may declare thresholds of their classes in params.json, e.g.
+// "thresholds": {"cat": 0.7, "dog": 0.4}, "threshold": 0.5
+// where classes are labels of labels.txt (or output indices of models
+// without labels) and "threshold" applies to classes without their own
+// threshold. Predictions of such models provide "decision" field with
+// classes whose probability reaches their threshold, e.g. /json returns
+// {"probabilities": [0.2, 0.8], "decision": ["dog"]} instead of plain array
+// of probabilities. Image classification of models with top_k (see topk
+// module) decides only among k best classes. Raw outputs (see raw module)
+// don't provide decisions.
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Predictions represents model outputs with accepted classes
+type Predictions struct {
+	Probabilities []float32 `json:"probabilities"` // model outputs
+	Decision      []string  `json:"decision"`      // classes which reached their thresholds
+}
+
+// labels of models used by decisions
+var (
+	_decisionLabels    = make(map[string][]string)
+	decisionLabelsLock sync.Mutex
+)
+
+// helper function to check if model declares decision thresholds
+func (p TFParams) hasThresholds() bool {
+	return len(p.Thresholds) > 0 || p.Threshold > 0
+}
+
+// helper function to return threshold of given class, it returns false for
+// classes without threshold
+func (p TFParams) classThreshold(class string) (float32, bool) {
+	if t, ok := p.Thresholds[class]; ok {
+		return t, true
+	}
+	return p.Threshold, p.Threshold > 0
+}
+
+// helper function to read labels of the model, models without labels file
+// have no labels
+func decisionLabels(model string, params TFParams) []string {
+	decisionLabelsLock.Lock()
+	defer decisionLabelsLock.Unlock()
+	if labels, ok := _decisionLabels[model]; ok {
+		return labels
+	}
+	var labels []string
+	if params.Labels != "" {
+		file, err := os.Open(filepath.Join(_config.ModelDir, model, params.Labels))
+		if err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				labels = append(labels, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Printf("unable to read labels of %s model: %v", model, err)
+				labels = nil
+			}
+			file.Close()
+		}
+	}
+	_decisionLabels[model] = labels
+	return labels
+}
+
+// helper function to forget labels of the model
+func removeDecisionLabels(model string) {
+	decisionLabelsLock.Lock()
+	defer decisionLabelsLock.Unlock()
+	delete(_decisionLabels, model)
+}
+
+// helper function to return class name of given output index
+func className(labels []string, idx int) string {
+	if idx >= 0 && idx < len(labels) {
+		return labels[idx]
+	}
+	return strconv.Itoa(idx)
+}
+
+// decide returns classes of model outputs which reached their thresholds,
+// it returns false if model does not declare thresholds
+func decide(model string, probs []float32) ([]string, bool) {
+	if model == "" {
+		model = _params.Name
+	}
+	model = resolveModel(model)
+	params, err := getModelParams(model)
+	if err != nil || !params.hasThresholds() {
+		return nil, false
+	}
+	labels := decisionLabels(model, params)
+	decision := []string{}
+	for i, p := range probs {
+		class := className(labels, i)
+		if t, ok := params.classThreshold(class); ok && p >= t {
+			decision = append(decision, class)
+		}
+	}
+	return decision, true
+}
+
+// decideLabels returns labels of image classification which reached their
+// thresholds, it returns nil if model does not declare thresholds
+func decideLabels(params TFParams, labels []LabelResult) []string {
+	if !params.hasThresholds() {
+		return nil
+	}
+	decision := []string{}
+	for _, l := range labels {
+		if t, ok := params.classThreshold(l.Label); ok && l.Probability >= t {
+			decision = append(decision, l.Label)
+		}
+	}
+	return decision
+}
+
+// responsePredictions writes model outputs with decision of given model
+// (or its fallback model) if the model declares thresholds, otherwise it
+// writes plain outputs
+func responsePredictions(w http.ResponseWriter, model, fallback string, probs []float32, raw bool) {
+	digits := outputDigits(raw)
+	if fallback != "" {
+		model = fallback
+	}
+	if raw || fallback == "default" {
+		responseProbs(w, probs, digits)
+		return
+	}
+	decision, ok := decide(model, probs)
+	if !ok {
+		responseProbs(w, probs, digits)
+		return
+	}
+	classes, err := json.Marshal(decision)
+	if err != nil {
+		responseError(w, "unable to marshal decision", err, http.StatusInternalServerError)
+		return
+	}
+	responseBytes(w, func(b []byte) []byte {
+		b = append(b, `{"probabilities":`...)
+		b = appendFloats(b, probs, digits)
+		b = append(b, `,"decision":`...)
+		b = append(b, classes...)
+		return append(b, '}')
+	})
+}
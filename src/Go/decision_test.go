@@ -0,0 +1,82 @@
+package main
+
+// tests of decision thresholds, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestFakeDecision checks decision of /json predictions
+func TestFakeDecision(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	params.Thresholds = map[string]float32{"a": 0.1, "c": 0.6}
+	params.Threshold = 0.25
+	params.ImgChannels = int64(len(testLabels))
+	writeModelFiles(t, "thr", []byte("thr"), params)
+
+	predict := func(model, query string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(testRow(model))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/json"+query, bytes.NewReader(data))
+		rr := httptest.NewRecorder()
+		PredictHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+	var res Predictions
+	if err := json.Unmarshal(predict("thr", "").Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, res.Probabilities)
+	if expect := []string{"a", "b"}; !reflect.DeepEqual(res.Decision, expect) {
+		t.Errorf("wrong decision %v, expected %v", res.Decision, expect)
+	}
+
+	// models without thresholds and raw outputs return plain probabilities
+	for _, rr := range []*httptest.ResponseRecorder{predict("dnn", ""), predict("thr", "?raw=true")} {
+		var probs []float32
+		if err := json.Unmarshal(rr.Body.Bytes(), &probs); err != nil {
+			t.Fatalf("unexpected response %s: %v", rr.Body.String(), err)
+		}
+		checkProbs(t, probs)
+	}
+
+	// image classification provides decision among labels
+	rr := httptest.NewRecorder()
+	ImageHandler(rr, imageRequest(t, "thr"))
+	var cres ClassifyResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &cres); err != nil {
+		t.Fatalf("unexpected response %s: %v", rr.Body.String(), err)
+	}
+	if expect := []string{"a", "b"}; !reflect.DeepEqual(cres.Decision, expect) {
+		t.Errorf("wrong image decision %v, expected %v", cres.Decision, expect)
+	}
+}
+
+// TestDecisionClasses checks class names of models without labels
+func TestDecisionClasses(t *testing.T) {
+	params := TFParams{Thresholds: map[string]float32{"1": 0.5}}
+	if th, ok := params.classThreshold("1"); !ok || th != 0.5 {
+		t.Errorf("wrong threshold %v of class 1", th)
+	}
+	if _, ok := params.classThreshold("0"); ok {
+		t.Error("class without threshold should not be decided")
+	}
+	if name := className(nil, 2); name != "2" {
+		t.Errorf("wrong class name %s", name)
+	}
+	labels := []LabelResult{{Label: "x", Probability: 0.9}, {Label: "1", Probability: 0.6}}
+	if decision := decideLabels(params, labels); !reflect.DeepEqual(decision, []string{"1"}) {
+		t.Errorf("wrong decision %v", decision)
+	}
+}
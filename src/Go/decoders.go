@@ -0,0 +1,155 @@
+package main
+
+// decoders module provides plugins of custom input decoders
+//
+// Sites may add support of their own payload formats, e.g. detector DAQ
+// frames, to /predict/batch endpoint without changes of HTTP layer. Decoders
+// are registered for media types either by Go code compiled into the server,
+// e.g. file daq.go of this package with
+// func init() { registerDecoder("application/x-daq-frame", &DAQDecoder{}) }
+// or by Go plugins listed in "decoderPlugins" configuration option, e.g.
+// "decoderPlugins": ["/opt/tfaas/plugins/daq.so"]
+// Plugins (go build -buildmode=plugin) export list of media types and decode
+// function which only use standard types:
+// var ContentTypes = []string{"application/x-daq-frame"}
+// func Decode(contentType string, body io.Reader, params map[string]string) ([]string, []float32, []int64, error)
+// which returns feature names (may be empty), flat vector of values and
+// shape of the batch. Requests with registered media type, e.g.
+// curl -H "Content-Type: application/x-daq-frame; version=2" --data-binary @frame.bin "/predict/batch?model=dnn"
+// are decoded by the plugin, parameters of the media type and query of the
+// request (e.g. version and model) are passed to the decoder.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+// DecodedBatch represents batch of rows produced by decoder
+type DecodedBatch struct {
+	Keys   []string  // feature names
+	Values []float32 // flat vector of row values
+	Shape  []int64   // shape of the batch, e.g. [nrows, ncols]
+}
+
+// Decoder represents decoder of custom input format
+type Decoder interface {
+	Decode(contentType string, body io.Reader, params map[string]string) (DecodedBatch, error)
+}
+
+// DecodeFunc represents decode function of decoder plugins
+type DecodeFunc func(contentType string, body io.Reader, params map[string]string) ([]string, []float32, []int64, error)
+
+// Decode implements Decoder interface
+func (f DecodeFunc) Decode(contentType string, body io.Reader, params map[string]string) (DecodedBatch, error) {
+	keys, values, shape, err := f(contentType, body, params)
+	return DecodedBatch{Keys: keys, Values: values, Shape: shape}, err
+}
+
+// registry of input decoders by media types
+var (
+	_decoders     = make(map[string]Decoder)
+	_decodersLock sync.RWMutex
+)
+
+// registerDecoder registers decoder of given media type
+func registerDecoder(mediaType string, decoder Decoder) {
+	_decodersLock.Lock()
+	defer _decodersLock.Unlock()
+	_decoders[mediaType] = decoder
+}
+
+// helper function to return names of media types of registered decoders
+func decoderTypes() []string {
+	_decodersLock.RLock()
+	defer _decodersLock.RUnlock()
+	var types []string
+	for t := range _decoders {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// helper function to find decoder of the request, it returns nil decoder if
+// media type of the request has no registered decoder
+func requestDecoder(r *http.Request) (Decoder, string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", nil
+	}
+	_decodersLock.RLock()
+	decoder, ok := _decoders[mediaType]
+	_decodersLock.RUnlock()
+	if !ok {
+		return nil, "", nil
+	}
+	for k, v := range r.URL.Query() {
+		if _, ok := params[k]; !ok && len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
+	return decoder, mediaType, params
+}
+
+// helper function to read batch of the request with custom decoder
+func readDecodedBatch(r *http.Request, decoder Decoder, mediaType string, params map[string]string) (string, []string, TFTensor, error) {
+	model := params["model"]
+	batch, err := decoder.Decode(mediaType, r.Body, params)
+	if err != nil {
+		return model, nil, nil, fmt.Errorf("unable to decode %s payload: %v", mediaType, err)
+	}
+	shape := batch.Shape
+	if len(shape) == 0 && len(batch.Keys) > 0 {
+		shape = []int64{int64(len(batch.Values) / len(batch.Keys)), int64(len(batch.Keys))}
+	}
+	if len(shape) == 0 {
+		shape = []int64{1, int64(len(batch.Values))}
+	}
+	tensor, err := makeFlatTensor(batch.Values, shape)
+	return model, batch.Keys, tensor, err
+}
+
+// helper function to load decoder plugin
+func loadDecoderPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("ContentTypes")
+	if err != nil {
+		return err
+	}
+	types, ok := sym.(*[]string)
+	if !ok {
+		return fmt.Errorf("ContentTypes of plugin %s is not []string", path)
+	}
+	sym, err = p.Lookup("Decode")
+	if err != nil {
+		return err
+	}
+	decode, ok := sym.(func(string, io.Reader, map[string]string) ([]string, []float32, []int64, error))
+	if !ok {
+		return fmt.Errorf("Decode function of plugin %s has wrong signature", path)
+	}
+	for _, t := range *types {
+		registerDecoder(t, DecodeFunc(decode))
+	}
+	log.Printf("decoder plugin %s provides %v", path, *types)
+	return nil
+}
+
+// initDecoders loads decoder plugins of the server
+func initDecoders(plugins []string) error {
+	for _, path := range plugins {
+		if err := loadDecoderPlugin(path); err != nil {
+			return fmt.Errorf("unable to load decoder plugin %s: %v", path, err)
+		}
+	}
+	return nil
+}
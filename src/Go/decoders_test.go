@@ -0,0 +1,106 @@
+package main
+
+// tests of custom input decoders, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// test media type of DAQ frames
+const testFrameType = "application/x-test-frame"
+
+// testFrameDecoder decodes frames of little-endian uint16 ADC counts, the
+// gain parameter scales counts into row values
+type testFrameDecoder struct {
+	params map[string]string
+}
+
+// Decode implements Decoder interface
+func (d *testFrameDecoder) Decode(contentType string, body io.Reader, params map[string]string) (DecodedBatch, error) {
+	d.params = params
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return DecodedBatch{}, err
+	}
+	if len(data)%(2*testNumKeys) != 0 {
+		return DecodedBatch{}, fmt.Errorf("truncated frame of %d bytes", len(data))
+	}
+	gain := float32(1)
+	if params["gain"] == "2" {
+		gain = 2
+	}
+	var batch DecodedBatch
+	for i := 0; i < len(data); i += 2 {
+		batch.Values = append(batch.Values, gain*float32(binary.LittleEndian.Uint16(data[i:])))
+	}
+	batch.Shape = []int64{int64(len(batch.Values) / testNumKeys), testNumKeys}
+	return batch, nil
+}
+
+// TestDecoders checks batch predictions of custom payload formats
+func TestDecoders(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	decoder := &testFrameDecoder{}
+	registerDecoder(testFrameType, decoder)
+	defer func() {
+		_decodersLock.Lock()
+		delete(_decoders, testFrameType)
+		_decodersLock.Unlock()
+	}()
+	if types := decoderTypes(); !reflect.DeepEqual(types, []string{testFrameType}) {
+		t.Fatalf("wrong decoder types %v", types)
+	}
+
+	frame := make([]byte, 2*2*testNumKeys)
+	for i := 0; i < 2*testNumKeys; i++ {
+		binary.LittleEndian.PutUint16(frame[2*i:], uint16(i+1))
+	}
+	req := httptest.NewRequest("POST", "/predict/batch?model=dnn", bytes.NewReader(frame))
+	req.Header.Set("Content-Type", testFrameType+"; gain=2")
+	rr := httptest.NewRecorder()
+	BatchHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var probs [][]float32
+	if err := json.Unmarshal(rr.Body.Bytes(), &probs); err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != 2 {
+		t.Fatalf("wrong number of rows %d", len(probs))
+	}
+	checkProbs(t, probs[1])
+	if decoder.params["gain"] != "2" || decoder.params["model"] != "dnn" {
+		t.Errorf("wrong decoder params %v", decoder.params)
+	}
+	input := fake.Feeds()["input"]
+	if !reflect.DeepEqual(input.Shape(), []int64{2, testNumKeys}) {
+		t.Errorf("wrong input shape %v", input.Shape())
+	}
+	if rows, _ := tensorRows(input); rows[1][0] != 2*float32(testNumKeys+1) {
+		t.Errorf("wrong input values %v", rows)
+	}
+
+	// decoder errors are client errors
+	req = httptest.NewRequest("POST", "/predict/batch?model=dnn", bytes.NewReader(frame[:3]))
+	req.Header.Set("Content-Type", testFrameType)
+	rr = httptest.NewRecorder()
+	BatchHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of truncated frame", rr.Code)
+	}
+
+	// decoder plugins
+	if err := initDecoders([]string{"/nonexistent/decoder.so"}); err == nil {
+		t.Error("missing decoder plugin should be rejected")
+	}
+}
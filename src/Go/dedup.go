@@ -0,0 +1,186 @@
+package main
+
+// dedup module provides deduplication of identical prediction requests
+//
+// Impatient clients often retry requests which are still in progress and
+// double-submit identical payloads within seconds. With "dedupWindow" option,
+// e.g. "dedupWindow": 2000 (milliseconds), identical prediction requests
+// (same client, endpoint, query, content type and payload) are collapsed:
+// the model runs only once and every caller gets its response, including
+// requests arriving within the window after the first one has finished.
+// Replayed responses carry Deduplicated: true header. Server errors (5xx)
+// are shared only by requests waiting for them and are not replayed later.
+// Payloads larger than 1MB, requests with Cache-Control: no-cache header and
+// streamed requests (newline delimited JSON, see stream module) are not
+// deduplicated. Collapsed requests are counted by
+// tfaas_deduplicated_requests_total metric.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// max size of deduplicated payloads
+const maxDedupBody = 1024 * 1024
+
+// dedupCall represents in-flight or recently finished prediction request
+type dedupCall struct {
+	done    chan struct{} // closed when response is recorded
+	status  int           // response status
+	header  http.Header   // response headers
+	body    []byte        // response body
+	expires time.Time     // time until finished response is replayed
+}
+
+// global in-flight requests and counter of collapsed requests
+var (
+	_dedupCalls     = make(map[string]*dedupCall)
+	_dedupCallsLock sync.Mutex
+	_deduplicated   uint64
+)
+
+// helper function to return deduplication window
+func dedupWindow() time.Duration {
+	return time.Duration(_config.DedupWindow) * time.Millisecond
+}
+
+// helper function to read request payload for deduplication, it returns nil
+// payload if request can't be deduplicated and restores request body
+func dedupPayload(r *http.Request) []byte {
+	if r.Body == nil || strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return nil
+	}
+	if r.ContentLength > maxDedupBody {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDedupBody+1))
+	if err != nil || len(data) > maxDedupBody {
+		// pass read part and rest of the body to the handler
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+		return nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data
+}
+
+// helper function to return deduplication key of the request
+func dedupKey(r *http.Request, payload []byte) string {
+	h := sha256.New()
+	id := requestIdentity(r)
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", id.User, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"))
+	for _, name := range []string{"Accept", "Content-Encoding", eventIDHeader, resultSinksHeader} {
+		fmt.Fprintf(h, "%s\n", r.Header.Get(name))
+	}
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// helper function to write recorded response of deduplicated request
+func (c *dedupCall) replay(w http.ResponseWriter) {
+	for name, values := range c.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Deduplicated", "true")
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// deduplicated wraps prediction handler with deduplication of identical
+// requests
+func deduplicated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _config.DedupWindow <= 0 {
+			handler(w, r)
+			return
+		}
+		// streamed responses are flushed by chunks and are not recorded
+		if streamRequested(r, negotiateOutput(r, "")) {
+			handler(w, r)
+			return
+		}
+		payload := dedupPayload(r)
+		if payload == nil {
+			handler(w, r)
+			return
+		}
+		key := dedupKey(r, payload)
+
+		now := time.Now()
+		_dedupCallsLock.Lock()
+		for k, c := range _dedupCalls {
+			if !c.expires.IsZero() && now.After(c.expires) {
+				delete(_dedupCalls, k)
+			}
+		}
+		call, ok := _dedupCalls[key]
+		if !ok {
+			call = &dedupCall{done: make(chan struct{})}
+			_dedupCalls[key] = call
+		}
+		_dedupCallsLock.Unlock()
+
+		if ok {
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			atomic.AddUint64(&_deduplicated, 1)
+			call.replay(w)
+			return
+		}
+
+		// headers of middlewares, e.g. request identifiers, are not replayed
+		before := w.Header().Clone()
+		rw := &idempotentResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			p := recover()
+			if p != nil {
+				status = http.StatusInternalServerError
+			}
+			_dedupCallsLock.Lock()
+			call.status = status
+			call.header = make(http.Header)
+			for name, values := range w.Header() {
+				if strings.Join(before[name], "\n") != strings.Join(values, "\n") {
+					call.header[name] = values
+				}
+			}
+			call.body = rw.body.Bytes()
+			call.expires = time.Now().Add(dedupWindow())
+			if status >= 500 {
+				// failed requests are retried by later callers
+				delete(_dedupCalls, key)
+			}
+			_dedupCallsLock.Unlock()
+			close(call.done)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		handler(rw, r)
+	}
+}
+
+// helper function to write metrics of deduplicated requests
+func writeDedupMetrics(w io.Writer) {
+	if _config.DedupWindow <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP tfaas_deduplicated_requests_total number of identical prediction requests served by response of in-flight or recent request\n")
+	fmt.Fprintf(w, "# TYPE tfaas_deduplicated_requests_total counter\n")
+	fmt.Fprintf(w, "tfaas_deduplicated_requests_total %d\n", atomic.LoadUint64(&_deduplicated))
+}
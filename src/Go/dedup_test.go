@@ -0,0 +1,121 @@
+package main
+
+// tests of request deduplication, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDeduplication checks that identical in-flight requests run once
+func TestDeduplication(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.DedupWindow = 1000
+	var calls uint64
+	release := make(chan struct{})
+	handler := deduplicated(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[0.2,0.8]`))
+	})
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler(rr, httptest.NewRequest("POST", "/json", strings.NewReader(`{"values":[1,2]}`)))
+		}(recorders[i])
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("identical requests are executed %d times", calls)
+	}
+	replayed := 0
+	for _, rr := range recorders {
+		if rr.Code != http.StatusOK || rr.Body.String() != `[0.2,0.8]` || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("wrong response %d %s %v", rr.Code, rr.Body.String(), rr.Header())
+		}
+		if rr.Header().Get("Deduplicated") == "true" {
+			replayed++
+		}
+	}
+	if replayed != len(recorders)-1 {
+		t.Errorf("wrong number of replayed responses %d", replayed)
+	}
+
+	// different payloads and opted out requests are executed
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/json", strings.NewReader(`{"values":[1,3]}`)))
+	req := httptest.NewRequest("POST", "/json", strings.NewReader(`{"values":[1,2]}`))
+	req.Header.Set("Cache-Control", "no-cache")
+	handler(httptest.NewRecorder(), req)
+	if calls != 3 {
+		t.Errorf("distinct requests are executed %d times", calls)
+	}
+}
+
+// TestDeduplicationWindow checks replay of recent predictions
+func TestDeduplicationWindow(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_config.DedupWindow = 200
+	data, _ := json.Marshal(testRow("dnn"))
+	handler := deduplicated(PredictHandler)
+	predict := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+	first := predict()
+	second := predict()
+	if atomic.LoadUint64(&fake.Runs) != 1 || second.Header().Get("Deduplicated") != "true" || second.Body.String() != first.Body.String() {
+		t.Fatalf("recent prediction is not replayed, runs %d", fake.Runs)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if rr := predict(); rr.Header().Get("Deduplicated") != "" || atomic.LoadUint64(&fake.Runs) != 2 {
+		t.Errorf("expired prediction is replayed, runs %d", fake.Runs)
+	}
+	var buf bytes.Buffer
+	writeDedupMetrics(&buf)
+	if !strings.Contains(buf.String(), "tfaas_deduplicated_requests_total") {
+		t.Errorf("wrong metrics %s", buf.String())
+	}
+}
+
+// TestDeduplicationStreams checks that streamed requests are not recorded
+func TestDeduplicationStreams(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.DedupWindow = 1000
+	t.Cleanup(func() { _dedupCalls = make(map[string]*dedupCall) })
+	calls := 0
+	handler := deduplicated(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if _, ok := w.(*idempotentResponseWriter); ok {
+			t.Error("streamed response is recorded")
+		}
+		w.Write([]byte("[0.2,0.8]\n"))
+	})
+	for i := 0; i < 2; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/predict/batch?stream=true", strings.NewReader(`{"values":[1,2]}`)))
+		req := httptest.NewRequest("POST", "/predict/batch", strings.NewReader(`{"values":[1,2]}`))
+		req.Header.Set("Accept", ndjsonType)
+		handler(httptest.NewRecorder(), req)
+	}
+	if calls != 4 {
+		t.Errorf("streamed requests are executed %d times", calls)
+	}
+}
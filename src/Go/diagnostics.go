@@ -0,0 +1,222 @@
+package main
+
+// diagnostics module provides startup dependency checks
+//
+// At startup the server verifies version of libtensorflow, model area
+// existence and permissions, TLS files and reachability of remote model
+// storage (MLflow tracking servers), prints diagnostic table and exits
+// with non-zero status if any of the checks fails. The checks can be run
+// without starting the server via tfaas -config config.json -check, and
+// they can be disabled via skipStartupChecks configuration option.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// minimal version of libtensorflow supported by TF Go bindings
+const minTensorflowVersion = "2.9.0"
+
+// timeout of remote storage checks
+const diagnosticTimeout = 5 * time.Second
+
+// diagnostic statuses
+const (
+	diagnosticOK   = "ok"
+	diagnosticSkip = "skip"
+	diagnosticFail = "FAIL"
+)
+
+// Diagnostic represents result of startup check
+type Diagnostic struct {
+	Check   string `json:"check"`   // name of the check
+	Status  string `json:"status"`  // check status: ok, skip or FAIL
+	Details string `json:"details"` // check details
+}
+
+// helper function to compare versions, e.g. 2.9.1 and 2.11.0-rc1, it
+// returns -1, 0, 1 if first version is lower, equal or greater than second
+func compareVersions(v1, v2 string) int {
+	parse := func(v string) []int {
+		var out []int
+		for _, part := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+			// ignore suffixes like -rc1
+			if idx := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); idx != -1 {
+				part = part[:idx]
+			}
+			n, _ := strconv.Atoi(part)
+			out = append(out, n)
+		}
+		return out
+	}
+	a, b := parse(v1), parse(v2)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// helper function to check version of TF library
+func checkTensorflow() Diagnostic {
+	d := Diagnostic{Check: "tensorflow", Status: diagnosticOK}
+	if tfBackend() == "stub" {
+		d.Details = "stub backend with canned outputs"
+		return d
+	}
+	version := _tf.Version()
+	if compareVersions(version, minTensorflowVersion) < 0 {
+		d.Status = diagnosticFail
+		d.Details = fmt.Sprintf("libtensorflow %s is older than required %s", version, minTensorflowVersion)
+		return d
+	}
+	d.Details = fmt.Sprintf("libtensorflow %s", version)
+	return d
+}
+
+// helper function to check model area
+func checkModelDir() Diagnostic {
+	d := Diagnostic{Check: "modelDir", Status: diagnosticFail}
+	if _config.ModelDir == "" {
+		d.Details = "modelDir is not configured"
+		return d
+	}
+	info, err := os.Stat(_config.ModelDir)
+	if err != nil {
+		d.Details = err.Error()
+		return d
+	}
+	if !info.IsDir() {
+		d.Details = fmt.Sprintf("%s is not a directory", _config.ModelDir)
+		return d
+	}
+	if _, err := ioutil.ReadDir(_config.ModelDir); err != nil {
+		d.Details = err.Error()
+		return d
+	}
+	d.Status = diagnosticOK
+	if isReadOnly() {
+		d.Details = fmt.Sprintf("%s (read-only mode)", _config.ModelDir)
+		return d
+	}
+	file, err := ioutil.TempFile(_config.ModelDir, ".check-*")
+	if err != nil {
+		d.Status = diagnosticFail
+		d.Details = fmt.Sprintf("%s is not writable: %v", _config.ModelDir, err)
+		return d
+	}
+	file.Close()
+	os.Remove(file.Name())
+	d.Details = fmt.Sprintf("%s (writable)", _config.ModelDir)
+	return d
+}
+
+// helper function to check TLS files
+func checkTLS() Diagnostic {
+	d := Diagnostic{Check: "tls", Status: diagnosticFail}
+	if _config.ServerCrt == "" && _config.ServerKey == "" {
+		d.Status = diagnosticSkip
+		d.Details = "no server certificates, serve plain HTTP"
+		return d
+	}
+	for _, fname := range []string{_config.ServerCrt, _config.ServerKey} {
+		if _, err := os.Stat(fname); err != nil {
+			d.Details = fmt.Sprintf("unable to read '%s': %v", fname, err)
+			return d
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(_config.ServerCrt, _config.ServerKey)
+	if err != nil {
+		d.Details = err.Error()
+		return d
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		d.Details = err.Error()
+		return d
+	}
+	if time.Now().After(leaf.NotAfter) {
+		d.Details = fmt.Sprintf("server certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+		return d
+	}
+	if _, err := clientCAPool(); err != nil {
+		d.Details = fmt.Sprintf("unable to load client CAs: %v", err)
+		return d
+	}
+	d.Status = diagnosticOK
+	d.Details = fmt.Sprintf("certificate %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	if _config.ClientCAs == "" {
+		d.Details += ", client certificates are not verified"
+	}
+	return d
+}
+
+// helper function to check reachability of remote model storage
+func checkRemote(name, rurl string) Diagnostic {
+	d := Diagnostic{Check: name, Status: diagnosticOK}
+	client := http.Client{Timeout: diagnosticTimeout}
+	if _client != nil {
+		client.Transport = _client.Transport
+	}
+	resp, err := client.Get(rurl)
+	if err != nil {
+		d.Status = diagnosticFail
+		d.Details = fmt.Sprintf("%s is unreachable: %v", rurl, err)
+		return d
+	}
+	resp.Body.Close()
+	d.Details = fmt.Sprintf("%s is reachable (HTTP %d)", rurl, resp.StatusCode)
+	return d
+}
+
+// startupChecks performs all startup checks
+func startupChecks() []Diagnostic {
+	diags := []Diagnostic{checkTensorflow(), checkResources(), checkModelDir(), checkTLS()}
+	for _, m := range _config.MLflow {
+		diags = append(diags, checkRemote("mlflow "+m.Name, m.URL))
+	}
+	return diags
+}
+
+// helper function to print diagnostic table
+func printDiagnostics(w io.Writer, diags []Diagnostic) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAILS")
+	for _, d := range diags {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Check, d.Status, d.Details)
+	}
+	tw.Flush()
+}
+
+// runStartupChecks performs and prints startup checks, it returns false if
+// any of the checks failed
+func runStartupChecks(w io.Writer) bool {
+	diags := startupChecks()
+	printDiagnostics(w, diags)
+	for _, d := range diags {
+		if d.Status == diagnosticFail {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+// tests of startup checks, they do not require TF C library
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCompareVersions checks comparison of versions
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		v1, v2 string
+		cmp    int
+	}{
+		{"2.9.1", "2.9.0", 1},
+		{"2.11.0-rc1", "2.9.0", 1},
+		{"2.4", "2.9.0", -1},
+		{"1.15.5", "2.9.0", -1},
+		{"2.9", "2.9.0", 0},
+		{"v2.10.0", "2.10.0", 0},
+	}
+	for _, test := range tests {
+		if cmp := compareVersions(test.v1, test.v2); cmp != test.cmp {
+			t.Errorf("compare %s and %s: expect %d got %d", test.v1, test.v2, test.cmp, cmp)
+		}
+	}
+}
+
+// helper function to write self-signed certificate valid until given time
+func writeTestCert(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tfaas"},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := filepath.Join(dir, "server.crt")
+	pkey := filepath.Join(dir, "server.key")
+	ioutil.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(pkey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return crt, pkey
+}
+
+// TestStartupChecks checks startup diagnostics
+func TestStartupChecks(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	if d := checkTensorflow(); d.Status != diagnosticOK {
+		t.Errorf("unexpected tensorflow check %+v", d)
+	}
+	if d := checkModelDir(); d.Status != diagnosticOK || !strings.Contains(d.Details, "writable") {
+		t.Errorf("unexpected modelDir check %+v", d)
+	}
+	if d := checkTLS(); d.Status != diagnosticSkip {
+		t.Errorf("unexpected tls check %+v", d)
+	}
+	dir := _config.ModelDir
+	_config.ServerCrt, _config.ServerKey = writeTestCert(t, dir, time.Now().Add(time.Hour))
+	if d := checkTLS(); d.Status != diagnosticOK {
+		t.Errorf("unexpected tls check %+v", d)
+	}
+	_config.ServerCrt, _config.ServerKey = writeTestCert(t, dir, time.Now().Add(-time.Hour))
+	if d := checkTLS(); d.Status != diagnosticFail || !strings.Contains(d.Details, "expired") {
+		t.Errorf("unexpected tls check of expired certificate %+v", d)
+	}
+	_config.ServerKey = filepath.Join(dir, "missing.key")
+	if d := checkTLS(); d.Status != diagnosticFail {
+		t.Errorf("unexpected tls check of missing key %+v", d)
+	}
+	_config.ServerCrt, _config.ServerKey = "", ""
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	_config.MLflow = []MLflowModel{{Name: "dnn", URL: srv.URL}}
+	var buf bytes.Buffer
+	if !runStartupChecks(&buf) {
+		t.Errorf("startup checks failed:\n%s", buf.String())
+	}
+	srv.Close()
+	_config.ModelDir = filepath.Join(dir, "missing")
+	buf.Reset()
+	if runStartupChecks(&buf) {
+		t.Errorf("startup checks should fail:\n%s", buf.String())
+	}
+	out := buf.String()
+	for _, check := range []string{"CHECK", "modelDir", "mlflow dnn", "FAIL"} {
+		if !strings.Contains(out, check) {
+			t.Errorf("diagnostics do not contain %s:\n%s", check, out)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+// disk module provides information about disk usage of model area
+//
+// With "minFreeSpace" option (in MB) uploads are rejected when model area
+// has less free space than the option plus size of the upload, and bundles
+// are extracted into model area only while this free space is left, such
+// that uploads of unknown size or compressed bundles can't fill the disk.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// ModelDiskUsage represents disk usage of the model
+type ModelDiskUsage struct {
+	Model    string `json:"model"`    // model name
+	Size     int64  `json:"size"`     // size of current model version
+	Versions int64  `json:"versions"` // size of previous model versions
+}
+
+// DiskUsage represents disk usage of model area
+type DiskUsage struct {
+	ModelDir    string           `json:"modelDir"`    // location of model area
+	Models      []ModelDiskUsage `json:"models"`      // disk usage of individual models
+	Total       int64            `json:"total"`       // total size of model area
+	Free        uint64           `json:"free"`        // free space on model area file system
+	MinFree     uint64           `json:"minFree"`     // minimal free space required for uploads
+	UsedPercent float64          `json:"usedPercent"` // used space of model area file system in percent
+}
+
+// interval in bytes of free space checks while writing into model area
+const freeSpaceCheckInterval = 16 << 20
+
+// error of insufficient free space in model area
+var errNoFreeSpace = errors.New("not enough free space")
+
+// helper function to return minimal free space (in bytes) required for uploads
+func minFreeSpace() uint64 {
+	return uint64(_config.MinFreeSpace) * 1024 * 1024
+}
+
+// helper function to return free space of model area file system
+func freeSpace() (uint64, error) {
+	usage, err := disk.Usage(_config.ModelDir)
+	if err != nil {
+		return 0, err
+	}
+	return usage.Free, nil
+}
+
+// helper function to check if we have enough space to store given
+// number of bytes in model area
+func checkFreeSpace(size int64) error {
+	if _config.MinFreeSpace <= 0 {
+		return nil
+	}
+	free, err := freeSpace()
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+	if free < uint64(size)+minFreeSpace() {
+		return fmt.Errorf("%w in %s: free=%d bytes required=%d bytes", errNoFreeSpace, _config.ModelDir, free, uint64(size)+minFreeSpace())
+	}
+	return nil
+}
+
+// helper function to return number of bytes which can be written into
+// model area, it returns -1 if free space is not limited
+func availableSpace() (int64, error) {
+	if _config.MinFreeSpace <= 0 {
+		return -1, nil
+	}
+	free, err := freeSpace()
+	if err != nil {
+		return 0, err
+	}
+	if free < minFreeSpace() {
+		return 0, nil
+	}
+	return int64(free - minFreeSpace()), nil
+}
+
+// spaceLimitedWriter fails writes which would leave less than minimal free
+// space in model area, the free space is checked again after every
+// freeSpaceCheckInterval bytes
+type spaceLimitedWriter struct {
+	writer    io.Writer
+	available int64 // bytes which can be written before next check
+}
+
+// helper function to limit writes into model area by its free space
+func newSpaceLimitedWriter(w io.Writer) io.Writer {
+	if _config.MinFreeSpace <= 0 {
+		return w
+	}
+	return &spaceLimitedWriter{writer: w}
+}
+
+// Write implements io.Writer interface
+func (s *spaceLimitedWriter) Write(p []byte) (int, error) {
+	size := int64(len(p))
+	if size > s.available {
+		available, err := availableSpace()
+		if err != nil {
+			return 0, err
+		}
+		if size > available {
+			return 0, fmt.Errorf("%w in %s: available=%d bytes required=%d bytes", errNoFreeSpace, _config.ModelDir, available, size)
+		}
+		s.available = available
+		if s.available > freeSpaceCheckInterval && size <= freeSpaceCheckInterval {
+			s.available = freeSpaceCheckInterval
+		}
+	}
+	n, err := s.writer.Write(p)
+	s.available -= int64(n)
+	return n, err
+}
+
+// helper function to calculate disk usage of model area
+func diskUsage() (DiskUsage, error) {
+	usage := DiskUsage{ModelDir: _config.ModelDir, MinFree: minFreeSpace()}
+	files, err := ioutil.ReadDir(_config.ModelDir)
+	if err != nil {
+		return usage, err
+	}
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		rec := ModelDiskUsage{
+			Model:    f.Name(),
+			Size:     dirSize(filepath.Join(_config.ModelDir, f.Name())),
+			Versions: dirSize(versionsDir(f.Name())),
+		}
+		usage.Models = append(usage.Models, rec)
+	}
+	usage.Total = dirSize(_config.ModelDir)
+	if stat, err := disk.Usage(_config.ModelDir); err == nil {
+		usage.Free = stat.Free
+		usage.UsedPercent = stat.UsedPercent
+	}
+	return usage, nil
+}
+
+// helper function to check free space of model area on server start
+func checkDiskSpace() {
+	free, err := freeSpace()
+	if err != nil {
+		log.Println("unable to check free space of", _config.ModelDir, err)
+		return
+	}
+	log.Printf("model area %s has %d bytes of free space", _config.ModelDir, free)
+	if err := checkFreeSpace(0); err != nil {
+		log.Println("WARNING: uploads are disabled,", err)
+	}
+}
+
+// DiskHandler provides disk usage of model area
+func DiskHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := diskUsage()
+	if err != nil {
+		responseError(w, "unable to get disk usage", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, usage)
+}
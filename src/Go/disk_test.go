@@ -0,0 +1,126 @@
+package main
+
+// tests of disk usage of model area, they do not require TF C library
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// helper function to create gzipped bundle with model file of given size
+func largeBundle(t *testing.T, name string, size int) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: name + "/model.pb", Mode: 0644, Size: int64(size)})
+	tw.Write(make([]byte, size))
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// helper function to leave about 2MB of free space for uploads
+func limitFreeSpace(t *testing.T) {
+	free, err := freeSpace()
+	if err != nil {
+		t.Skip("unable to get free space", err)
+	}
+	_config.MinFreeSpace = int(free>>20) - 2
+	if _config.MinFreeSpace <= 0 {
+		t.Skip("not enough free space to run the test")
+	}
+}
+
+// TestSpaceLimitedWriter checks that extraction of bundles stops before it
+// exhausts free space of model area
+func TestSpaceLimitedWriter(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	if available, err := availableSpace(); available != -1 || err != nil {
+		t.Fatalf("free space is limited without minFreeSpace: %d %v", available, err)
+	}
+	limitFreeSpace(t)
+	tarball := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	ioutil.WriteFile(tarball, largeBundle(t, "small", 100<<10), 0644)
+	fname, _ := gunzipFile(tarball)
+	if _, err := Untar(fname, filepath.Join(_config.ModelDir, "small")); err != nil {
+		t.Fatalf("small bundle is not extracted: %v", err)
+	}
+	ioutil.WriteFile(tarball, largeBundle(t, "large", 8<<20), 0644)
+	fname, _ = gunzipFile(tarball)
+	_, err := Untar(fname, filepath.Join(_config.ModelDir, "large"))
+	if !errors.Is(err, errNoFreeSpace) {
+		t.Fatalf("large bundle is extracted: %v", err)
+	}
+}
+
+// TestUploadFreeSpace checks uploads of unknown size and compressed
+// bundles which exceed free space of model area
+func TestUploadFreeSpace(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	limitFreeSpace(t)
+	for _, body := range [][]byte{largeBundle(t, "large", 8<<20), make([]byte, 8<<20)} {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		UploadHandler(w, req)
+		if w.Code != http.StatusInsufficientStorage {
+			t.Errorf("wrong status code %d of upload with %d bytes: %s", w.Code, len(body), w.Body.String())
+		}
+	}
+	if modelExists("large") {
+		t.Error("large model is installed")
+	}
+}
+
+// TestDiskHandler checks disk usage of models and their versions
+func TestDiskHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	archiveModel("dnn2")
+	writeModelFiles(t, "dnn2", []byte("dnn2 v2"), TFParams{InputNode: "input", OutputNode: "output"})
+	w := httptest.NewRecorder()
+	DiskHandler(w, httptest.NewRequest("GET", "/admin/disk", nil))
+	var usage DiskUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unable to get disk usage %d %s: %v", w.Code, w.Body.String(), err)
+	}
+	if len(usage.Models) != 3 || usage.ModelDir != _config.ModelDir || usage.Free == 0 {
+		t.Fatalf("wrong disk usage %+v", usage)
+	}
+	var total int64
+	for _, m := range usage.Models {
+		if m.Size != dirSize(filepath.Join(_config.ModelDir, m.Model)) {
+			t.Errorf("wrong size of model %+v", m)
+		}
+		if (m.Model == "dnn2") != (m.Versions > 0) {
+			t.Errorf("wrong size of versions of model %+v", m)
+		}
+		total += m.Size + m.Versions
+	}
+	if usage.Total < total {
+		t.Errorf("total size %d is less than size of models %d", usage.Total, total)
+	}
+}
+
+// TestCheckFreeSpace checks that uploads are rejected when they leave less
+// than minimal free space of model area
+func TestCheckFreeSpace(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	if err := checkFreeSpace(1 << 40); err != nil {
+		t.Fatalf("free space is checked without minFreeSpace: %v", err)
+	}
+	limitFreeSpace(t)
+	if err := checkFreeSpace(1 << 10); err != nil {
+		t.Fatalf("small upload is rejected: %v", err)
+	}
+	if err := checkFreeSpace(8 << 20); !errors.Is(err, errNoFreeSpace) {
+		t.Fatalf("large upload is accepted: %v", err)
+	}
+}
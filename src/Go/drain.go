@@ -0,0 +1,106 @@
+package main
+
+// drain module provides maintenance (drain) mode of the server
+//
+// POST /admin/drain with optional {"message": "...", "retryAfter": 120}
+// puts the server into drain mode: readiness probe starts failing such that
+// load balancer stops sending traffic to the server, and prediction
+// endpoints return 503 Service Unavailable with Retry-After header.
+// DELETE /admin/drain brings the server back into service.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// default drain message
+const defaultDrainMessage = "server is under maintenance"
+
+// default Retry-After value in seconds of drain mode
+const defaultDrainRetryAfter = 60
+
+// DrainMode represents drain mode of the server
+type DrainMode struct {
+	Draining   bool   `json:"draining"`   // server is draining
+	Message    string `json:"message"`    // message returned to clients
+	RetryAfter int    `json:"retryAfter"` // Retry-After value in seconds
+	Since      int64  `json:"since"`      // time when drain mode was enabled
+}
+
+// global drain mode and its lock
+var (
+	_drain    DrainMode
+	drainLock sync.RWMutex
+)
+
+// helper function to return current drain mode
+func drainMode() DrainMode {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+	return _drain
+}
+
+// helper function to enable or disable drain mode
+func setDrainMode(mode DrainMode) DrainMode {
+	if mode.Draining {
+		if mode.Message == "" {
+			mode.Message = _config.DrainMessage
+		}
+		if mode.Message == "" {
+			mode.Message = defaultDrainMessage
+		}
+		if mode.RetryAfter <= 0 {
+			mode.RetryAfter = _config.DrainRetryAfter
+		}
+		if mode.RetryAfter <= 0 {
+			mode.RetryAfter = defaultDrainRetryAfter
+		}
+		mode.Since = time.Now().Unix()
+	} else {
+		mode = DrainMode{}
+	}
+	drainLock.Lock()
+	defer drainLock.Unlock()
+	_drain = mode
+	return mode
+}
+
+// drainable wraps prediction handler which is rejected in drain mode
+func drainable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mode := drainMode(); mode.Draining {
+			w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfter))
+			responseError(w, mode.Message, nil, http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// DrainHandler provides, enables or disables drain mode of the server
+func DrainHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "POST":
+		var mode DrainMode
+		if err := json.NewDecoder(r.Body).Decode(&mode); err != nil && err != io.EOF {
+			responseError(w, "unable to decode drain request", err, http.StatusBadRequest)
+			return
+		}
+		mode.Draining = true
+		mode = setDrainMode(mode)
+		log.Printf("enable drain mode, message '%s' retry after %ds", mode.Message, mode.RetryAfter)
+		publish(EventDrain, "", fmt.Sprintf("drain mode is enabled: %s", mode.Message))
+	case "DELETE":
+		setDrainMode(DrainMode{})
+		log.Println("disable drain mode")
+		publish(EventDrain, "", "drain mode is disabled")
+	}
+	responseJSON(w, drainMode())
+}
@@ -0,0 +1,71 @@
+package main
+
+// tests of drain mode, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDrainMode checks that drain mode fails readiness probe and rejects
+// predictions with Retry-After header
+func TestDrainMode(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	t.Cleanup(func() { setDrainMode(DrainMode{}) })
+	data, _ := json.Marshal(testRow("dnn"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/drain", bytes.NewBufferString(`{"message": "upgrade", "retryAfter": 30}`)))
+	var mode DrainMode
+	json.Unmarshal(w.Body.Bytes(), &mode)
+	if w.Code != http.StatusOK || !mode.Draining || mode.Message != "upgrade" || mode.Since == 0 {
+		t.Fatalf("unable to enable drain mode, status %d mode %+v", w.Code, mode)
+	}
+	for _, path := range []string{"/json", "/predict/json", "/ready"} {
+		w := httptest.NewRecorder()
+		method := "POST"
+		if path == "/ready" {
+			method = "GET"
+		}
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+			t.Errorf("%s: unexpected status %d retry after '%s' in drain mode", path, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/models", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d of models in drain mode", w.Code)
+	}
+
+	// default drain options
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/drain", nil))
+	json.Unmarshal(w.Body.Bytes(), &mode)
+	if mode.Message != defaultDrainMessage || mode.RetryAfter != defaultDrainRetryAfter {
+		t.Errorf("unexpected default drain mode %+v", mode)
+	}
+
+	// back into service
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/drain", nil))
+	if w.Code != http.StatusOK || drainMode().Draining {
+		t.Fatalf("unable to disable drain mode, status %d", w.Code)
+	}
+	for _, path := range []string{"/json", "/ready"} {
+		w := httptest.NewRecorder()
+		method := "POST"
+		if path == "/ready" {
+			method = "GET"
+		}
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d after drain mode", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+// dtypes module provides conversion of model outputs of various data types
+//
+// Models do not always produce float32 outputs, e.g. quantized models emit
+// uint8 or float16 tensors. Outputs of any numeric Go type provided by TF
+// layer are converted into float32 matrices, while reduced precision
+// (float16, bfloat16) and quantized (quint8, qint16, quint16, qint32) tensors
+// which TF Go bindings can't represent as Go values are decoded from their
+// raw contents by TF layer. Quantized values are returned as is, i.e. they
+// are not dequantized. Outputs of other data types, e.g. strings, are
+// reported as errors.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// helper function to convert IEEE 754 half precision value into float32
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch {
+	case exp == 0x1f:
+		// infinities and NaNs
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	case exp == 0:
+		// zeros and subnormal numbers, i.e. frac * 2^-24
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
+
+// helper function to convert bfloat16 value into float32
+func bfloat16ToFloat32(h uint16) float32 {
+	return math.Float32frombits(uint32(h) << 16)
+}
+
+// helper function to decode raw tensor contents of given data type into
+// float32 values, the contents are in host (little endian) byte order
+func decodeRawValues(dtype string, data []byte) ([]float32, error) {
+	size := map[string]int{
+		"float16": 2, "bfloat16": 2, "qint16": 2, "quint16": 2,
+		"quint8": 1, "qint32": 4,
+	}[dtype]
+	if size == 0 {
+		return nil, fmt.Errorf("unsupported data type %s", dtype)
+	}
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("size %d of %s tensor contents is not multiple of %d", len(data), dtype, size)
+	}
+	values := make([]float32, len(data)/size)
+	for i := range values {
+		b := data[i*size:]
+		switch dtype {
+		case "float16":
+			values[i] = float16ToFloat32(binary.LittleEndian.Uint16(b))
+		case "bfloat16":
+			values[i] = bfloat16ToFloat32(binary.LittleEndian.Uint16(b))
+		case "qint16":
+			values[i] = float32(int16(binary.LittleEndian.Uint16(b)))
+		case "quint16":
+			values[i] = float32(binary.LittleEndian.Uint16(b))
+		case "quint8":
+			values[i] = float32(b[0])
+		case "qint32":
+			values[i] = float32(int32(binary.LittleEndian.Uint32(b)))
+		}
+	}
+	return values, nil
+}
+
+// helper function to convert numeric value of any Go type into float32
+func numericValue(rv reflect.Value) (float32, bool) {
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return float32(rv.Float()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float32(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float32(rv.Uint()), true
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
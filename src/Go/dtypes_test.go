@@ -0,0 +1,85 @@
+package main
+
+// tests of output data types, they do not require TF C library
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// TestFloat16 checks decoding of half precision and bfloat16 values
+func TestFloat16(t *testing.T) {
+	tests := map[uint16]float32{
+		0x0000: 0,
+		0x3c00: 1,
+		0xc000: -2,
+		0x3800: 0.5,
+		0x7bff: 65504,
+		0x0001: 1.0 / (1 << 24),
+		0x8200: -1.0 / (1 << 15),
+	}
+	for h, v := range tests {
+		if f := float16ToFloat32(h); f != v {
+			t.Errorf("float16 %#04x: got %v, expected %v", h, f, v)
+		}
+	}
+	if f := float16ToFloat32(0x7c00); !math.IsInf(float64(f), 1) {
+		t.Errorf("float16 0x7c00 should be +Inf, got %v", f)
+	}
+	if f := float16ToFloat32(0x7e00); !math.IsNaN(float64(f)) {
+		t.Errorf("float16 0x7e00 should be NaN, got %v", f)
+	}
+	if f := bfloat16ToFloat32(0x3f80); f != 1 {
+		t.Errorf("bfloat16 0x3f80: got %v, expected 1", f)
+	}
+}
+
+// TestDecodeRawValues checks decoding of raw tensor contents
+func TestDecodeRawValues(t *testing.T) {
+	data := binary.LittleEndian.AppendUint16(nil, 0x3800)
+	data = binary.LittleEndian.AppendUint16(data, 0xc000)
+	values, err := decodeRawValues("float16", data)
+	if err != nil || len(values) != 2 || values[0] != 0.5 || values[1] != -2 {
+		t.Fatalf("wrong float16 values %v: %v", values, err)
+	}
+	values, err = decodeRawValues("qint16", data)
+	if err != nil || values[0] != 0x3800 || values[1] != -0x4000 {
+		t.Fatalf("wrong qint16 values %v: %v", values, err)
+	}
+	values, err = decodeRawValues("quint8", []byte{0, 255})
+	if err != nil || values[1] != 255 {
+		t.Fatalf("wrong quint8 values %v: %v", values, err)
+	}
+	if _, err := decodeRawValues("qint32", []byte{1, 2, 3}); err == nil {
+		t.Error("truncated contents should be rejected")
+	}
+	if _, err := decodeRawValues("complex64", data); err == nil {
+		t.Error("unsupported data type should be rejected")
+	}
+}
+
+// TestTensorRowsTypes checks conversion of outputs of various types
+func TestTensorRowsTypes(t *testing.T) {
+	tests := []interface{}{
+		[][]uint8{{0, 255}, {128, 1}},
+		[][]float64{{0, 255}, {128, 1}},
+		[][]int64{{0, 255}, {128, 1}},
+	}
+	for _, v := range tests {
+		rows, err := tensorRows(&fakeTensor{value: v, shape: []int64{2, 2}})
+		if err != nil {
+			t.Fatalf("%T: %v", v, err)
+		}
+		if len(rows) != 2 || rows[0][1] != 255 || rows[1][0] != 128 {
+			t.Errorf("%T: wrong rows %v", v, rows)
+		}
+	}
+	rows, err := tensorRows(&fakeTensor{value: []bool{true, false}, shape: []int64{2}})
+	if err != nil || len(rows) != 1 || rows[0][0] != 1 || rows[0][1] != 0 {
+		t.Errorf("wrong bool rows %v: %v", rows, err)
+	}
+	if _, err := tensorRows(&fakeTensor{value: []string{"a"}, shape: []int64{1}}); err == nil {
+		t.Error("string outputs should be rejected")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// encryption module provides encrypted models at rest
+//
+// Model files (TF 1.X graphs and XGBoost models) may be stored encrypted
+// with AES-GCM. Such models declare name of their key in params.json, e.g.
+// "encryption_key": "higgs", and the server resolves keys from "modelKeys"
+// option, e.g. "modelKeys": {"higgs": "vault:secret/data/keys#higgs"}, where
+// values are base64 or hex encoded 16, 24 or 32 bytes keys or references to
+// secrets (see secrets module). Encrypted files are decrypted only into
+// memory at load time and are never written decrypted to disk. TF 2.X saved
+// models are loaded by TF library from model directory and therefore can not
+// be encrypted. Model files are encrypted by the server itself, e.g.
+//
+//	tfaas -encrypt model.pb -encryptKey env:MODEL_KEY
+//
+// writes model.pb.enc file which consists of magic header, nonce and
+// ciphertext of the original file.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// magic header of encrypted model files
+var encryptedMagic = []byte("TFAASENC1")
+
+// helper function to decode AES key given by its value or secret reference
+func decodeModelKey(value string) ([]byte, error) {
+	v, err := resolveSecret(value)
+	if err != nil {
+		return nil, err
+	}
+	registerSecret(v)
+	v = strings.TrimSpace(v)
+	key, err := hex.DecodeString(v)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, errors.New("model key should be hex or base64 encoded")
+		}
+	}
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("model key has %d bytes, expected 16, 24 or 32", n)
+	}
+	return key, nil
+}
+
+// helper function to return AES key of given name
+func modelKey(name string) ([]byte, error) {
+	value, ok := _config.ModelKeys[name]
+	if !ok {
+		return nil, fmt.Errorf("model key %s is not configured", name)
+	}
+	key, err := decodeModelKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("model key %s: %v", name, err)
+	}
+	return key, nil
+}
+
+// helper function to create AES-GCM cipher of given key
+func modelCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// helper function to encrypt model data with given key
+func encryptModelData(data, key []byte) ([]byte, error) {
+	aead, err := modelCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, encryptedMagic...), nonce...)
+	return aead.Seal(out, nonce, data, encryptedMagic), nil
+}
+
+// helper function to decrypt model data with given key
+func decryptModelData(data, key []byte) ([]byte, error) {
+	aead, err := modelCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, encryptedMagic) || len(data) < len(encryptedMagic)+aead.NonceSize() {
+		return nil, errors.New("model file is not encrypted")
+	}
+	data = data[len(encryptedMagic):]
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, encryptedMagic)
+	if err != nil {
+		return nil, errors.New("unable to decrypt model file, wrong key or corrupted file")
+	}
+	return plain, nil
+}
+
+// helper function to read model file, files of models with encryption key
+// are decrypted in memory
+func readModelFile(fname, keyName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil || keyName == "" {
+		return data, err
+	}
+	key, err := modelKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptModelData(data, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return plain, nil
+}
+
+// helper function to encrypt model file with given key, it writes
+// <fname>.enc file
+func encryptModelFile(fname, keyRef string) (string, error) {
+	key, err := decodeModelKey(keyRef)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	out, err := encryptModelData(data, key)
+	if err != nil {
+		return "", err
+	}
+	ofile := fname + ".enc"
+	return ofile, ioutil.WriteFile(ofile, out, 0600)
+}
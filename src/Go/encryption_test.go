@@ -0,0 +1,78 @@
+package main
+
+// tests of encrypted models, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// test key of encrypted models
+const testModelKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// TestEncryptedModel checks loading and validation of encrypted models
+func TestEncryptedModel(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	os.Setenv("TFAAS_TEST_MODEL_KEY", testModelKey)
+	defer os.Unsetenv("TFAAS_TEST_MODEL_KEY")
+	_config.ModelKeys = map[string]string{"higgs": "env:TFAAS_TEST_MODEL_KEY"}
+	writeModelFiles(t, "secret", []byte("graph"), TFParams{InputNode: "input", OutputNode: "output", EncryptionKey: "higgs"})
+	path := filepath.Join(_config.ModelDir, "secret")
+	fname := filepath.Join(path, "model.pb")
+	ofile, err := encryptModelFile(fname, testModelKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(ofile, fname); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(fname)
+	if !bytes.HasPrefix(data, encryptedMagic) || bytes.Contains(data, []byte("graph")) {
+		t.Fatalf("model file is not encrypted")
+	}
+	if plain, err := readModelFile(fname, "higgs"); err != nil || string(plain) != "graph" {
+		t.Fatalf("unable to decrypt model file %v", err)
+	}
+	if err := validateModel(path, "secret"); err != nil {
+		t.Errorf("unable to validate encrypted model %v", err)
+	}
+
+	// encrypted model serves predictions and stays encrypted on disk
+	initLimiter("1000-S")
+	router := handlers()
+	row, _ := json.Marshal(testRow("secret"))
+	req := httptest.NewRequest("POST", "/json", bytes.NewReader(row))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d of encrypted model prediction %s", rr.Code, rr.Body.String())
+	}
+	files, _ := ioutil.ReadDir(path)
+	if len(files) != 3 {
+		t.Errorf("unexpected files in model area %v", files)
+	}
+
+	// wrong, missing or malformed keys are rejected
+	_config.ModelKeys["higgs"] = strings.Repeat("ab", 32)
+	if err := validateModel(path, "secret"); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("encrypted model is validated with wrong key %v", err)
+	}
+	_config.ModelKeys["higgs"] = "abcd"
+	if _, err := readModelFile(fname, "higgs"); err == nil {
+		t.Errorf("short key is accepted")
+	}
+	if _, err := readModelFile(fname, "cms"); err == nil {
+		t.Errorf("missing key is accepted")
+	}
+	_config.ModelKeys["higgs"] = testModelKey
+	if _, err := readModelFile(filepath.Join(path, "labels.txt"), "higgs"); err == nil {
+		t.Errorf("plain file is decrypted")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+// errorsamples module provides store of failing prediction requests
+//
+// With "errorSamples" option, e.g. "errorSamples": 20, the server keeps the
+// last N failing prediction requests (server errors, 5xx) of every model in
+// memory: endpoint, query, content type, request payload (up to 1MB,
+// sensitive features are redacted, see redaction module), response status,
+// error message and time stamp. Model authors reproduce serving failures
+// with original payloads instead of asking clients to re-send their data:
+// GET /admin/errors lists number of kept samples of every model,
+// GET /admin/errors/<model> returns samples of the model (newest first) and
+// DELETE /admin/errors/<model> removes them, e.g.
+// curl https://host/admin/errors/dnn | jq -r '.[0].body' | base64 -d > input.json
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maximum size of kept payload of failing request
+const maxErrorSampleBody = 1024 * 1024
+
+// prediction endpoints of kept failing requests
+var errorSampleEndpoints = []string{"/json", "/proto", "/image", "/tensor", "/predict/json", "/predict/proto", "/predict/image", "/predict/batch", "/predict/multi"}
+
+// ErrorSample represents failing request of the model
+type ErrorSample struct {
+	Time            int64  `json:"time"`                      // request time (unix seconds)
+	Model           string `json:"model"`                     // model name
+	Path            string `json:"path"`                      // API endpoint without server base path
+	Query           string `json:"query,omitempty"`           // request query
+	ContentType     string `json:"contentType,omitempty"`     // request content type
+	ContentEncoding string `json:"contentEncoding,omitempty"` // request content encoding
+	Body            []byte `json:"body"`                      // request payload
+	Truncated       bool   `json:"truncated,omitempty"`       // payload is too large to be kept
+	Redacted        bool   `json:"redacted,omitempty"`        // payload has redacted sensitive features
+	Status          int    `json:"status"`                    // response status
+	Error           string `json:"error"`                     // error response of the server
+}
+
+// errorRing represents ring buffer of failing requests of the model
+type errorRing struct {
+	samples []ErrorSample
+	next    int
+}
+
+// global store of failing requests
+var (
+	_errorSamples     = make(map[string]*errorRing)
+	_errorSamplesLock sync.Mutex
+)
+
+// add adds sample to the ring, the oldest sample is replaced when the ring
+// is full
+func (r *errorRing) add(sample ErrorSample, size int) {
+	if len(r.samples) < size {
+		r.samples = append(r.samples, sample)
+		return
+	}
+	r.samples[r.next%len(r.samples)] = sample
+	r.next = (r.next + 1) % len(r.samples)
+}
+
+// list returns samples of the ring, newest first
+func (r *errorRing) list() []ErrorSample {
+	out := make([]ErrorSample, 0, len(r.samples))
+	for i := len(r.samples) - 1; i >= 0; i-- {
+		out = append(out, r.samples[(r.next+i)%len(r.samples)])
+	}
+	return out
+}
+
+// helper function to keep failing request of the model
+func addErrorSample(sample ErrorSample) {
+	_errorSamplesLock.Lock()
+	defer _errorSamplesLock.Unlock()
+	ring, ok := _errorSamples[sample.Model]
+	if !ok {
+		ring = &errorRing{}
+		_errorSamples[sample.Model] = ring
+	}
+	ring.add(sample, _config.ErrorSamples)
+}
+
+// helper function to return model of prediction request, the model is
+// looked up in JSON payload, form of image request or query
+func errorSampleModel(r *http.Request, body []byte) string {
+	var rec struct {
+		Model string `json:"model"`
+	}
+	model := r.URL.Query().Get("model")
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		if json.Unmarshal(trimmed, &rec) == nil && rec.Model != "" {
+			model = rec.Model
+		}
+	}
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["model"]) > 0 {
+		model = r.MultipartForm.Value["model"][0]
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	return resolveModel(model)
+}
+
+// errorSamplesMiddleware keeps failing requests of prediction endpoints
+func errorSamplesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _config.ErrorSamples <= 0 || r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := r.URL.Path
+		if base := strings.TrimRight(_config.Base, "/"); base != "" {
+			path = strings.TrimPrefix(path, base)
+		}
+		if !InList(path, errorSampleEndpoints) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorSampleBody+1))
+		// handlers should see the whole body regardless of kept payload
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		truncated := err != nil || len(body) > maxErrorSampleBody
+		start := time.Now()
+		cw := &captureResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status < http.StatusInternalServerError {
+			return
+		}
+		sample := ErrorSample{
+			Time:            start.Unix(),
+			Model:           errorSampleModel(r, body),
+			Path:            path,
+			Query:           strings.TrimPrefix(redactURI("?"+r.URL.RawQuery), "?"),
+			ContentType:     r.Header.Get("Content-Type"),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+			Truncated:       truncated,
+			Status:          cw.status,
+			Error:           strings.TrimSpace(cw.body.String()),
+		}
+		if !truncated {
+			sample.Body, sample.Redacted = redactBody(body, path, r.URL.RawQuery)
+		}
+		addErrorSample(sample)
+	})
+}
+
+// ErrorSamplesHandler provides or removes failing requests of models
+func ErrorSamplesHandler(w http.ResponseWriter, r *http.Request) {
+	model, ok := mux.Vars(r)["model"]
+	_errorSamplesLock.Lock()
+	defer _errorSamplesLock.Unlock()
+	if !ok {
+		counts := make(map[string]int)
+		for name, ring := range _errorSamples {
+			counts[name] = len(ring.samples)
+		}
+		responseJSON(w, counts)
+		return
+	}
+	ring, found := _errorSamples[model]
+	if r.Method == "DELETE" {
+		delete(_errorSamples, model)
+		responseJSON(w, map[string]interface{}{"model": model, "removed": found})
+		return
+	}
+	if !found {
+		responseJSON(w, []ErrorSample{})
+		return
+	}
+	responseJSON(w, ring.list())
+}
@@ -0,0 +1,97 @@
+package main
+
+// tests of errorsamples module, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestErrorRing checks wrap-around of failing requests of the model
+func TestErrorRing(t *testing.T) {
+	ring := &errorRing{}
+	for i := 1; i <= 5; i++ {
+		ring.add(ErrorSample{Status: i}, 3)
+	}
+	samples := ring.list()
+	if len(samples) != 3 {
+		t.Fatalf("unexpected samples %+v", samples)
+	}
+	for i, status := range []int{5, 4, 3} {
+		if samples[i].Status != status {
+			t.Errorf("unexpected sample %d %+v, expected status %d", i, samples[i], status)
+		}
+	}
+}
+
+// TestErrorSamples checks failing requests kept by the middleware
+func TestErrorSamples(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	orig := _config
+	t.Cleanup(func() {
+		_config = orig
+		_errorSamplesLock.Lock()
+		_errorSamples = make(map[string]*errorRing)
+		_errorSamplesLock.Unlock()
+	})
+	_config.ErrorSamples = 2
+	handler := errorSamplesMiddleware(http.HandlerFunc(PredictHandler))
+
+	// successful predictions are not kept
+	payload, _ := json.Marshal(testRow("dnn"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(payload)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+	}
+
+	payload, _ = json.Marshal(testRow("unknown"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/json?format=json", bytes.NewReader(payload)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ErrorSamplesHandler(w, httptest.NewRequest("GET", "/admin/errors", nil))
+	var counts map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts["unknown"] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/errors/unknown", nil), map[string]string{"model": "unknown"})
+	w = httptest.NewRecorder()
+	ErrorSamplesHandler(w, req)
+	var samples []ErrorSample
+	if err := json.Unmarshal(w.Body.Bytes(), &samples); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("unexpected samples %+v", samples)
+	}
+	s := samples[0]
+	if s.Path != "/json" || s.Query != "format=json" || s.Status != http.StatusInternalServerError || s.Error == "" {
+		t.Errorf("unexpected sample %+v", s)
+	}
+	if !bytes.Equal(s.Body, payload) {
+		t.Errorf("unexpected payload %s, expected %s", s.Body, payload)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/admin/errors/unknown", nil), map[string]string{"model": "unknown"})
+	w = httptest.NewRecorder()
+	ErrorSamplesHandler(w, req)
+	_errorSamplesLock.Lock()
+	n := len(_errorSamples)
+	_errorSamplesLock.Unlock()
+	if n != 0 {
+		t.Errorf("samples are not removed, %s", w.Body.String())
+	}
+}
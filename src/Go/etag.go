@@ -0,0 +1,274 @@
+package main
+
+// etag module provides ETag support of model endpoints
+//
+// The strong ETag of the model is sha256 checksum of the model bundle
+// content, i.e. relative names and content of all (non hidden) files of the
+// model area. It is shared by /models/{name}, /models/{name}/download and
+// /params/{model} endpoints, clients may send If-None-Match header with
+// known ETag to avoid re-downloading of unchanged model.
+//
+// The /models catalog has weak ETag derived from names and modification
+// times of model areas and their params.json files and from nodes
+// discovered in loaded models. Its JSON is cached until the catalog changes,
+// such that dashboards polling it do not force repeated marshaling of large
+// catalogs. Model metadata responses carry Cache-Control header with
+// "metadataMaxAge" seconds (default 0, i.e. clients revalidate with ETag).
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// modelChecksum represents cached checksum of the model area
+type modelChecksum struct {
+	Checksum string    // sha256 checksum of the model content
+	ModTime  time.Time // modification time of the model area
+}
+
+// global cache of model checksums, it is indexed by model area path
+var (
+	modelChecksums     = make(map[string]modelChecksum)
+	modelChecksumsLock sync.Mutex
+)
+
+// ModelInfo represents model meta-data
+type ModelInfo struct {
+	Name     string   `json:"name"`     // model name
+	Checksum string   `json:"checksum"` // sha256 checksum of the model content
+	Size     int64    `json:"size"`     // size of the model on disk
+	Params   TFParams `json:"params"`   // model parameters
+
+	DiscoveredNodes *DiscoveredNodes `json:"discoveredNodes,omitempty"` // input and output nodes discovered in TF graph
+}
+
+// helper function to compute checksum of the model area, files are
+// processed in lexical order and hidden files are skipped
+func computeChecksum(path string) (string, error) {
+	var files []string
+	err := filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fname != path && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, fname)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, fname := range files {
+		rel, err := filepath.Rel(path, fname)
+		if err != nil {
+			return "", err
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			return "", err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return "", err
+		}
+		// file name and size delimit content of consecutive files
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), info.Size())
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// helper function to get checksum of given model, the checksum is cached
+// until model area is changed
+func getModelChecksum(model string) (string, error) {
+	path := filepath.Join(_config.ModelDir, model)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	modelChecksumsLock.Lock()
+	cached, ok := modelChecksums[path]
+	modelChecksumsLock.Unlock()
+	if ok && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Checksum, nil
+	}
+	checksum, err := computeChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	modelChecksumsLock.Lock()
+	modelChecksums[path] = modelChecksum{Checksum: checksum, ModTime: info.ModTime()}
+	modelChecksumsLock.Unlock()
+	return checksum, nil
+}
+
+// helper function to remove cached checksum of given model
+func removeModelChecksum(model string) {
+	modelChecksumsLock.Lock()
+	defer modelChecksumsLock.Unlock()
+	delete(modelChecksums, filepath.Join(_config.ModelDir, model))
+}
+
+// helper function to check if If-None-Match header matches given etag
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		// If-None-Match uses weak comparison
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to set ETag header of the response, it writes
+// 304 Not Modified response and returns true if client has the same etag
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatch(header, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// helper function to check model ETag, it returns true if response is
+// already written
+func checkModelETag(w http.ResponseWriter, r *http.Request, model string) bool {
+	checksum, err := getModelChecksum(model)
+	if err != nil {
+		responseError(w, "unable to compute model checksum", err, http.StatusInternalServerError)
+		return true
+	}
+	return checkETag(w, r, fmt.Sprintf("\"%s\"", checksum))
+}
+
+// helper function to set Cache-Control header of model metadata responses
+func setCacheControl(w http.ResponseWriter) {
+	if _config.MetadataMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, must-revalidate", _config.MetadataMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
+
+// cached JSON of model catalog
+var (
+	catalogETag string
+	catalogBody []byte
+	catalogLock sync.Mutex
+)
+
+// helper function to compute weak ETag of model catalog without reading
+// model parameters
+func catalogFingerprint() (string, error) {
+	files, err := ioutil.ReadDir(_config.ModelDir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		fmt.Fprintf(h, "%s %d\n", f.Name(), f.ModTime().UnixNano())
+		if info, err := os.Stat(filepath.Join(_config.ModelDir, f.Name(), "params.json")); err == nil {
+			fmt.Fprintf(h, "params %d %d\n", info.ModTime().UnixNano(), info.Size())
+		}
+		if d, ok := getDiscoveredNodes(f.Name()); ok {
+			fmt.Fprintf(h, "nodes %s %s\n", d.InputNode, d.OutputNode)
+		}
+	}
+	return fmt.Sprintf("W/\"%s\"", hex.EncodeToString(h.Sum(nil))[:32]), nil
+}
+
+// helper function to return JSON of model catalog with given ETag
+func catalogJSON(etag string) ([]byte, error) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	if etag == catalogETag && catalogBody != nil {
+		return catalogBody, nil
+	}
+	models, err := TFModels()
+	if err != nil {
+		return nil, err
+	}
+	// report nodes discovered in graphs of loaded models
+	for i, m := range models {
+		if d, ok := getDiscoveredNodes(m.Name); ok {
+			models[i].InputNode, models[i].OutputNode = d.InputNode, d.OutputNode
+		}
+	}
+	data, err := json.Marshal(models)
+	if err != nil {
+		return nil, err
+	}
+	catalogETag, catalogBody = etag, append(data, '\n')
+	return catalogBody, nil
+}
+
+// ModelHandler provides model meta-data
+func ModelHandler(w http.ResponseWriter, r *http.Request) {
+	model := resolveModel(mux.Vars(r)["name"])
+	if !modelExists(model) {
+		msg := fmt.Sprintf("model %s does not exist", model)
+		responseError(w, msg, errors.New(msg), http.StatusNotFound)
+		return
+	}
+	checksum, err := getModelChecksum(model)
+	if err != nil {
+		responseError(w, "unable to compute model checksum", err, http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w)
+	if checkETag(w, r, fmt.Sprintf("\"%s\"", checksum)) {
+		return
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model parameters", err, http.StatusInternalServerError)
+		return
+	}
+	size := dirSize(filepath.Join(_config.ModelDir, model))
+	info := ModelInfo{Name: model, Checksum: checksum, Size: size, Params: params}
+	if params.InputNode == "" || params.OutputNode == "" {
+		// nodes are discovered when TF 1.X model is loaded
+		if backend, err := tfVersion(model); err == nil && backend == "tf1" {
+			_cache.get(model)
+		}
+		if d, ok := getDiscoveredNodes(model); ok {
+			info.DiscoveredNodes = &d
+		}
+	}
+	responseJSON(w, info)
+}
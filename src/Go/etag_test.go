@@ -0,0 +1,111 @@
+package main
+
+// tests of ETag support, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to send GET request with optional If-None-Match header
+func etagRequest(handler http.HandlerFunc, key, model, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/models/"+model, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	req = mux.SetURLVars(req, map[string]string{key: model})
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// TestModelETag checks ETag and If-None-Match support of model endpoints
+func TestModelETag(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	w := etagRequest(ModelHandler, "name", "dnn", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var info ModelInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	etag := w.Header().Get("ETag")
+	if etag != "\""+info.Checksum+"\"" || info.Params.Name != "dnn" || info.Size == 0 {
+		t.Fatalf("unexpected model info %+v etag %s", info, etag)
+	}
+	handlers := map[string]http.HandlerFunc{"name": ModelHandler, "model": ParamsHandler}
+	for key, handler := range handlers {
+		for _, header := range []string{etag, "W/" + etag, "\"abc\", " + etag, "*"} {
+			if w := etagRequest(handler, key, "dnn", header); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("If-None-Match %s: unexpected status %d", header, w.Code)
+			}
+		}
+		if w := etagRequest(handler, key, "dnn", "\"abc\""); w.Code != http.StatusOK {
+			t.Errorf("unexpected status %d for stale etag", w.Code)
+		}
+	}
+	if w := etagRequest(DownloadHandler, "name", "dnn", etag); w.Code != http.StatusNotModified {
+		t.Errorf("unexpected download status %d", w.Code)
+	}
+	if w := etagRequest(ModelHandler, "name", "dnn2", ""); w.Header().Get("ETag") == etag {
+		t.Error("different models should have different etags")
+	}
+
+	// model update changes its etag
+	fname := filepath.Join(_config.ModelDir, "dnn", "model.pb")
+	if err := ioutil.WriteFile(fname, []byte("new dnn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resetModelCache("dnn")
+	w = etagRequest(DownloadHandler, "name", "dnn", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("unexpected status %d etag %s of updated model", w.Code, w.Header().Get("ETag"))
+	}
+	if w := etagRequest(ModelHandler, "name", "unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for unknown model", w.Code)
+	}
+}
+
+// TestModelsETag checks conditional GET of model catalog
+func TestModelsETag(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	w := etagRequest(ModelsHandler, "", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("unexpected status %d headers %v", w.Code, w.Header())
+	}
+	var models []TFParams
+	if err := json.Unmarshal(w.Body.Bytes(), &models); err != nil || len(models) != 3 {
+		t.Fatalf("unexpected models %v: %v", models, err)
+	}
+	etag := w.Header().Get("ETag")
+	if len(etag) < 3 || etag[:2] != "W/" {
+		t.Fatalf("unexpected catalog etag %s", etag)
+	}
+	if w := etagRequest(ModelsHandler, "", "", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unexpected status %d of unchanged catalog", w.Code)
+	}
+
+	// new model changes the catalog
+	writeModelFiles(t, "dnn3", []byte("dnn3"), TFParams{InputNode: "input", OutputNode: "output"})
+	_config.MetadataMaxAge = 30
+	w = etagRequest(ModelsHandler, "", "", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("unexpected status %d etag %s of changed catalog", w.Code, w.Header().Get("ETag"))
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &models); err != nil || len(models) != 4 {
+		t.Errorf("unexpected models %v: %v", models, err)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=30, must-revalidate" {
+		t.Errorf("unexpected Cache-Control %s", cc)
+	}
+	if w := etagRequest(ModelHandler, "name", "dnn3", ""); w.Header().Get("Cache-Control") != "max-age=30, must-revalidate" {
+		t.Errorf("unexpected model Cache-Control %s", w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// eventid module provides predict-time feature logging of client events
+//
+// Clients may attach their own event identifier to the row, e.g.
+// {"model": "dnn", "keys": [...], "values": [...], "eventID": "run1:lumi2:evt3"}
+// The identifier is returned untouched in Event-ID header of /json responses
+// (or in "eventID" field of multi-model and MQTT results), and rows with
+// event identifier are logged together with their predictions, e.g.
+// prediction {"eventID":"run1:lumi2:evt3","model":"dnn","time":1700000000,"features":{...},"predictions":[0.2,0.8]}
+// such that offline systems can join predictions back to originating events
+// without relying on order of requests. Sensitive features of the model are
+// redacted in logged features, see redaction module.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// response header with client event identifier
+const eventIDHeader = "Event-ID"
+
+// maximum length of client event identifier
+const maxEventIDLength = 256
+
+// PredictionLog represents logged prediction of client event
+type PredictionLog struct {
+	EventID     string                 `json:"eventID"`     // client event identifier
+	Model       string                 `json:"model"`       // model name
+	Time        int64                  `json:"time"`        // prediction time (unix seconds)
+	Features    map[string]interface{} `json:"features"`    // row features
+	Predictions []float32              `json:"predictions"` // model predictions
+}
+
+// helper function to validate client event identifier of the row
+func checkEventID(row *Row) error {
+	if len(row.EventID) > maxEventIDLength {
+		return fmt.Errorf("event ID is longer than %d characters", maxEventIDLength)
+	}
+	return nil
+}
+
+// helper function to set event identifier header of the response
+func setEventIDHeader(w http.ResponseWriter, row *Row) {
+	if row.EventID != "" {
+		w.Header().Set(eventIDHeader, row.EventID)
+	}
+}
+
+// helper function to log predictions of the row with client event identifier
+func logPrediction(row *Row, model string, probs []float32) {
+	if row.EventID == "" {
+		return
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	rec := PredictionLog{EventID: row.EventID, Model: model, Time: time.Now().Unix(), Predictions: probs}
+	data, err := json.Marshal(row)
+	if err == nil {
+		err = json.Unmarshal(data, &rec.Features)
+	}
+	if err != nil {
+		log.Println("unable to log prediction of event", row.EventID, err)
+		return
+	}
+	delete(rec.Features, "eventID")
+	delete(rec.Features, "model")
+	if sensitive, mode := sensitiveFeatures(model); len(sensitive) > 0 {
+		redactRecord(rec.Features, sensitive, mode)
+	}
+	data, err = json.Marshal(rec)
+	if err != nil {
+		log.Println("unable to log prediction of event", row.EventID, err)
+		return
+	}
+	log.Printf("prediction %s", data)
+}
@@ -0,0 +1,77 @@
+package main
+
+// tests of client event identifiers, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestFakeEventID checks propagation of client event identifiers
+func TestFakeEventID(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	row := testRow("dnn")
+	row.EventID = "run1:lumi2:evt3"
+	data, _ := json.Marshal(row)
+	rr := httptest.NewRecorder()
+	PredictHandler(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	if id := rr.Header().Get(eventIDHeader); id != row.EventID {
+		t.Errorf("wrong event ID header %q", id)
+	}
+
+	// logged prediction can be joined with the event
+	var rec PredictionLog
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, "prediction {"); i >= 0 {
+			if err := json.Unmarshal([]byte(line[i+len("prediction "):]), &rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if rec.EventID != row.EventID || rec.Model != "dnn" {
+		t.Fatalf("wrong prediction log %+v in %s", rec, buf.String())
+	}
+	checkProbs(t, rec.Predictions)
+	if _, ok := rec.Features["values"]; !ok {
+		t.Errorf("features are not logged %v", rec.Features)
+	}
+
+	// multi-model results carry the event
+	res, err := makeMultiPredictions(&MultiRow{Row: *row, Models: []string{"dnn", "dnn2"}}, "")
+	if err != nil || res.EventID != row.EventID {
+		t.Errorf("wrong multi-model result %+v %v", res, err)
+	}
+
+	// rows without event are not logged
+	buf.Reset()
+	row.EventID = ""
+	if _, _, err := predictWithFallback(row); err != nil {
+		t.Fatal(err)
+	}
+	logPrediction(row, "dnn", testOutputs)
+	if strings.Contains(buf.String(), "prediction {") {
+		t.Errorf("prediction without event is logged: %s", buf.String())
+	}
+
+	// too long identifiers are rejected
+	row.EventID = strings.Repeat("x", maxEventIDLength+1)
+	data, _ = json.Marshal(row)
+	rr = httptest.NewRecorder()
+	PredictHandler(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of too long event ID", rr.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+// events module provides internal publish/subscribe system for server events
+//
+// Server components publish events (model loaded, prediction failed, etc.)
+// and the event bus delivers them asynchronously to configured sinks. Every
+// sink has its own queue, such that slow sink does not delay other sinks,
+// and events are dropped for the sink whose queue is full, e.g.
+// "eventSinks": [
+//     {"type": "log"},
+//     {"type": "webhook", "url": "https://host/hook", "events": ["upload"]},
+//     {"type": "kafka", "url": "http://kafka-rest:8082", "topic": "tfaas"},
+//     {"type": "nats", "url": "nats://nats:4222", "topic": "tfaas.events"}]
+// New sink types can be added via registerSinkType function.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// server events
+const (
+	EventUpload           = "upload"
+	EventReload           = "reload"
+	EventPromotion        = "promotion"
+	EventDemotion         = "demotion"
+	EventRollback         = "rollback"
+	EventEviction         = "eviction"
+	EventLoadFailure      = "loadFailure"
+	EventPredictionFailed = "predictionFailed"
+	EventSelfTestFailed   = "selfTestFailed"
+	EventDrain            = "drain"
+	EventBreakerOpen      = "breakerOpen"
+	EventMemoryPressure   = "memoryPressure"
+	EventLeaderChange     = "leaderChange"
+)
+
+// size of event queue of every sink
+const eventQueueSize = 1000
+
+// Event represents server event
+type Event struct {
+	Event     string `json:"event"`     // event name
+	Model     string `json:"model"`     // model name
+	Message   string `json:"message"`   // event message
+	Host      string `json:"host"`      // host name of the server
+	Timestamp int64  `json:"timestamp"` // event time stamp (unix seconds)
+}
+
+// EventSink represents destination of server events
+type EventSink interface {
+	Publish(evt Event) error
+}
+
+// EventSinkConfig represents configuration of event sink
+type EventSinkConfig struct {
+	Type   string   `json:"type"`   // sink type: log, webhook, kafka, nats
+	URL    string   `json:"url"`    // sink URL
+	Topic  string   `json:"topic"`  // sink topic (Kafka topic or NATS subject)
+	Format string   `json:"format"` // format of the message, e.g. mattermost for webhooks
+	Events []string `json:"events"` // list of events to send, empty list means all events
+}
+
+// SinkFactory creates event sink from its configuration
+type SinkFactory func(cfg EventSinkConfig) (EventSink, error)
+
+// subscription represents event sink subscribed to set of events
+type subscription struct {
+	sink   EventSink
+	events []string
+	queue  chan Event
+}
+
+// EventBus dispatches published events to subscribed sinks
+type EventBus struct {
+	subscriptions []*subscription
+	started       bool
+	mutex         sync.RWMutex
+}
+
+// global event bus and registry of event sink factories
+var (
+	_eventBus   EventBus
+	_sinkTypes  = make(map[string]SinkFactory)
+	sinkTypesMu sync.Mutex
+)
+
+// registerSinkType registers new type of event sinks
+func registerSinkType(name string, factory SinkFactory) {
+	sinkTypesMu.Lock()
+	defer sinkTypesMu.Unlock()
+	_sinkTypes[name] = factory
+}
+
+// helper function to create event sink from its configuration
+func newEventSink(cfg EventSinkConfig) (EventSink, error) {
+	sinkTypesMu.Lock()
+	factory, ok := _sinkTypes[cfg.Type]
+	sinkTypesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown event sink type '%s'", cfg.Type)
+	}
+	return factory(cfg)
+}
+
+// subscribe adds given sink to the event bus and starts delivery of events
+// from its queue
+func (b *EventBus) subscribe(sink EventSink, events []string) {
+	sub := &subscription{sink: sink, events: events, queue: make(chan Event, eventQueueSize)}
+	b.mutex.Lock()
+	b.subscriptions = append(b.subscriptions, sub)
+	b.mutex.Unlock()
+	go sub.dispatch()
+}
+
+// start enables publishing of events to subscribed sinks
+func (b *EventBus) start() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.started = true
+}
+
+// dispatch delivers events from subscription queue to its sink
+func (s *subscription) dispatch() {
+	for evt := range s.queue {
+		if err := s.sink.Publish(evt); err != nil {
+			log.Printf("unable to publish %s event: %v", evt.Event, err)
+		}
+	}
+}
+
+// publish puts given event into queues of sinks subscribed to it, the event
+// is dropped for sinks with full queue or if event bus is not started
+func (b *EventBus) publish(evt Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if !b.started {
+		return
+	}
+	for _, sub := range b.subscriptions {
+		if len(sub.events) > 0 && !InList(evt.Event, sub.events) {
+			continue
+		}
+		select {
+		case sub.queue <- evt:
+		default:
+			log.Printf("event queue of %T sink is full, drop %s event for model %s", sub.sink, evt.Event, evt.Model)
+		}
+	}
+}
+
+// helper function to publish server event
+func publish(event, model, msg string) {
+	host, _ := os.Hostname()
+	evt := Event{Event: event, Model: model, Message: msg, Host: host, Timestamp: time.Now().Unix()}
+	_eventBus.publish(evt)
+}
+
+// helper function to initialize event bus with configured sinks
+func initEventBus() {
+	for _, hook := range _config.Webhooks {
+		h := hook
+		_eventBus.subscribe(&h, h.Events)
+	}
+	for _, cfg := range _config.EventSinks {
+		sink, err := newEventSink(cfg)
+		if err != nil {
+			log.Println("unable to create event sink", cfg.Type, err)
+			continue
+		}
+		_eventBus.subscribe(sink, cfg.Events)
+	}
+	_eventBus.start()
+}
+
+// LogSink writes events to server log
+type LogSink struct{}
+
+// Publish implements EventSink interface
+func (s *LogSink) Publish(evt Event) error {
+	log.Printf("event %s model %s: %s", evt.Event, evt.Model, evt.Message)
+	return nil
+}
+
+// register default event sinks
+func init() {
+	registerSinkType("log", func(cfg EventSinkConfig) (EventSink, error) {
+		return &LogSink{}, nil
+	})
+	registerSinkType("webhook", func(cfg EventSinkConfig) (EventSink, error) {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook sink requires url")
+		}
+		return &Webhook{URL: cfg.URL, Events: cfg.Events, Format: cfg.Format}, nil
+	})
+	registerSinkType("kafka", func(cfg EventSinkConfig) (EventSink, error) {
+		if cfg.URL == "" || cfg.Topic == "" {
+			return nil, fmt.Errorf("kafka sink requires url and topic")
+		}
+		return &KafkaSink{URL: cfg.URL, Topic: cfg.Topic}, nil
+	})
+	registerSinkType("nats", func(cfg EventSinkConfig) (EventSink, error) {
+		if cfg.URL == "" || cfg.Topic == "" {
+			return nil, fmt.Errorf("nats sink requires url and topic")
+		}
+		return &NATSSink{Conn: newNATSConn(cfg.URL), Subject: cfg.Topic}, nil
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+// tests of events module, they do not require TF C library
+
+import (
+	"testing"
+	"time"
+)
+
+// chanSink sends published events to its channel
+type chanSink struct {
+	events chan Event
+}
+
+// Publish implements EventSink interface
+func (s *chanSink) Publish(evt Event) error {
+	s.events <- evt
+	return nil
+}
+
+// blockingSink waits for release of every published event
+type blockingSink struct {
+	release chan struct{}
+}
+
+// Publish implements EventSink interface
+func (s *blockingSink) Publish(evt Event) error {
+	<-s.release
+	return nil
+}
+
+// TestEventBus checks that events are delivered to subscribed sinks and
+// blocked sink does not delay other sinks
+func TestEventBus(t *testing.T) {
+	var bus EventBus
+	blocked := &blockingSink{release: make(chan struct{})}
+	defer close(blocked.release)
+	all := &chanSink{events: make(chan Event, eventQueueSize)}
+	uploads := &chanSink{events: make(chan Event, eventQueueSize)}
+	bus.subscribe(blocked, nil)
+	bus.subscribe(all, nil)
+	bus.subscribe(uploads, []string{EventUpload})
+
+	bus.publish(Event{Event: EventUpload, Model: "dnn"})
+	select {
+	case evt := <-all.events:
+		t.Fatalf("event %+v is published before event bus is started", evt)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// queue of blocked sink is filled up, while other sinks receive events
+	bus.start()
+	for n := 0; n < 2; n++ {
+		for i := 0; i < eventQueueSize; i++ {
+			bus.publish(Event{Event: EventReload, Model: "dnn"})
+		}
+		for i := 0; i < eventQueueSize; i++ {
+			select {
+			case <-all.events:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("sink received %d events of %d", i, eventQueueSize)
+			}
+		}
+	}
+	bus.publish(Event{Event: EventUpload, Model: "dnn"})
+	select {
+	case evt := <-uploads.events:
+		if evt.Event != EventUpload {
+			t.Fatalf("wrong event %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload event is not delivered")
+	}
+	select {
+	case evt := <-uploads.events:
+		t.Fatalf("unsubscribed event %+v is delivered", evt)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
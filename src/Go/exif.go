@@ -0,0 +1,159 @@
+package main
+
+// exif module provides orientation correction and color conversion of images
+//
+// Photos taken by handheld devices are stored as captured by the sensor with
+// EXIF orientation tag which tells viewers how to rotate them, while TF
+// image decoding ignores it. Some JPEG images (e.g. from print workflows)
+// use CMYK color space which TF can't decode properly. Classification of
+// such images silently degrades, therefore the server rotates JPEG images
+// according to their EXIF orientation and converts CMYK images into RGB
+// before tensor creation. Other images are passed to TF as is.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/jpeg" // register JPEG decoder
+	"image/png"
+)
+
+// EXIF orientation tag
+const exifOrientationTag = 0x0112
+
+// helper function to read EXIF orientation of JPEG image, it returns 1
+// (normal orientation) if image does not provide it
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xd9 || marker == 0xda {
+			// end of image or start of scan, no more metadata
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + size
+		if size < 2 || end > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// helper function to read orientation tag of the first IFD of TIFF
+// structure of EXIF segment
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+			return v
+		}
+		return 1
+	}
+	return 1
+}
+
+// helper function to return RGB image with given EXIF orientation applied
+func orientImage(img image.Image, orientation int) *image.NRGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// orientations 5-8 transpose the image
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			out.SetNRGBA(dx, dy, c.(color.NRGBA))
+		}
+	}
+	return out
+}
+
+// normalizeImage corrects orientation and color space of JPEG image and
+// crops the image to region of interest (see crop module), it returns image
+// data and its format which should be used to create tensor
+func normalizeImage(data []byte, format string, roi *ROI) ([]byte, string, error) {
+	isJPEG := len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8
+	if !isJPEG && roi == nil {
+		return data, format, nil
+	}
+	orientation := 1
+	if isJPEG {
+		orientation = jpegOrientation(data)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// let TF report invalid images
+		return data, format, nil
+	}
+	if orientation == 1 && config.ColorModel != color.CMYKModel && roi == nil {
+		return data, format, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := cropImage(orientImage(img, orientation), roi)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "png", nil
+}
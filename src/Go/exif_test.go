@@ -0,0 +1,111 @@
+package main
+
+// tests of image orientation and color conversion, they do not require TF C
+// library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// helper function to create JPEG image with red left half and blue right
+// half and given EXIF orientation
+func orientedJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	// EXIF segment with big endian TIFF structure and single IFD entry
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, exifOrientationTag)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(append(out, app1...), segment...)
+	return append(out, data[2:]...)
+}
+
+// TestJPEGOrientation checks reading of EXIF orientation
+func TestJPEGOrientation(t *testing.T) {
+	for _, o := range []uint16{1, 3, 6, 8} {
+		if v := jpegOrientation(orientedJPEG(t, o)); v != int(o) {
+			t.Errorf("wrong orientation %d, expected %d", v, o)
+		}
+	}
+	if v := jpegOrientation([]byte("not an image")); v != 1 {
+		t.Errorf("wrong orientation %d of invalid image", v)
+	}
+}
+
+// TestFakeImageOrientation checks that rotated images are corrected before
+// tensor creation
+func TestFakeImageOrientation(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	// orientation 6 requires rotation by 90 degrees clockwise, i.e. red half
+	// becomes the top one
+	tensor, err := makeTensorFromImage(bytes.NewBuffer(orientedJPEG(t, 6)), "jpg", 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shape := tensor.Shape()
+	if len(shape) != 4 || shape[1] != 16 || shape[2] != 8 {
+		t.Fatalf("image is not rotated, shape %v", shape)
+	}
+	values := tensor.Value().([]float32)
+	pixel := func(x, y int) []float32 {
+		i := (y*8 + x) * 3
+		return values[i : i+3]
+	}
+	if p := pixel(4, 2); p[0] < 200 || p[2] > 50 {
+		t.Errorf("top of rotated image should be red %v", p)
+	}
+	if p := pixel(4, 13); p[2] < 200 || p[0] > 50 {
+		t.Errorf("bottom of rotated image should be blue %v", p)
+	}
+
+	// images with normal orientation are passed as is
+	data := orientedJPEG(t, 1)
+	if out, format, err := normalizeImage(data, "jpg", nil); err != nil || format != "jpg" || !bytes.Equal(out, data) {
+		t.Errorf("image should not be changed, format %s error %v", format, err)
+	}
+}
+
+// TestOrientImageCMYK checks conversion of CMYK images into RGB
+func TestOrientImageCMYK(t *testing.T) {
+	img := image.NewCMYK(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.CMYK{C: 0, M: 255, Y: 255, K: 0}) // red
+	img.Set(1, 0, color.CMYK{C: 255, M: 255, Y: 0, K: 0}) // blue
+	out := orientImage(img, 1)
+	if c := out.NRGBAAt(0, 0); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("wrong conversion of red pixel %v", c)
+	}
+	if c := out.NRGBAAt(1, 0); c != (color.NRGBA{0, 0, 255, 255}) {
+		t.Errorf("wrong conversion of blue pixel %v", c)
+	}
+	// orientation 8 rotates image counterclockwise
+	out = orientImage(img, 8)
+	if b := out.Bounds(); b.Dx() != 1 || b.Dy() != 2 || out.NRGBAAt(0, 0).B != 255 {
+		t.Errorf("wrong rotation %v", out.Pix)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+// fallback module provides fallback responses of failing models
+//
+// Models may declare fallback in their params.json, e.g.
+// "fallback": {"model": "dnn_simple", "outputs": [0.5, 0.5], "timeout": 200}
+// When primary inference fails or does not finish within timeout (in
+// milliseconds) the server uses predictions of fallback model, and if it
+// fails too, constant outputs. Responses based on fallback are flagged by
+// X-TFaaS-Fallback header (fallback model name or "default") and counted
+// by tfaas_fallbacks_total metric.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// name of HTTP header which flags fallback responses
+const fallbackHeader = "X-TFaaS-Fallback"
+
+// Fallback represents fallback of the model
+type Fallback struct {
+	Model   string    `json:"model,omitempty"`   // fallback model name
+	Outputs []float32 `json:"outputs,omitempty"` // constant outputs used if fallback model fails
+	Timeout int       `json:"timeout,omitempty"` // timeout in milliseconds of primary inference
+}
+
+// fallbackKey identifies counter of fallback responses
+type fallbackKey struct {
+	model string // model name
+	kind  string // fallback kind: model or default
+}
+
+// global counters of fallback responses
+var (
+	fallbackCounters = make(map[fallbackKey]*uint64)
+	fallbackLock     sync.Mutex
+)
+
+// helper function to count fallback response of given model
+func countFallback(model, kind string) {
+	key := fallbackKey{model, kind}
+	fallbackLock.Lock()
+	counter, ok := fallbackCounters[key]
+	if !ok {
+		counter = new(uint64)
+		fallbackCounters[key] = counter
+	}
+	fallbackLock.Unlock()
+	atomic.AddUint64(counter, 1)
+}
+
+// FallbackCount represents number of fallback responses of the model
+type FallbackCount struct {
+	Model string // model name
+	Kind  string // fallback kind: model or default
+	Count uint64 // number of fallback responses
+}
+
+// helper function to return sorted counters of fallback responses
+func fallbackCounts() []FallbackCount {
+	fallbackLock.Lock()
+	defer fallbackLock.Unlock()
+	var out []FallbackCount
+	for key, counter := range fallbackCounters {
+		out = append(out, FallbackCount{Model: key.model, Kind: key.kind, Count: atomic.LoadUint64(counter)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Model == out[j].Model {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Model < out[j].Model
+	})
+	return out
+}
+
+// helper function to make predictions within given timeout in milliseconds,
+// the inference can not be interrupted and keeps running after the timeout
+func predictWithTimeout(row *Row, timeout int) ([]float32, error) {
+	if timeout <= 0 {
+		return predictRow(row)
+	}
+	type result struct {
+		probs []float32
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		probs, err := predictRow(row)
+		ch <- result{probs, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.probs, res.err
+	case <-time.After(time.Duration(timeout) * time.Millisecond):
+		return nil, fmt.Errorf("inference did not finish within %dms", timeout)
+	}
+}
+
+// helper function to make predictions with fallback of the model, it
+// returns predictions, used fallback (if any) and error
+func predictWithFallback(row *Row) ([]float32, string, error) {
+	name := _params.Name
+	if row.Model != "" {
+		name = row.Model
+	}
+	name = resolveModel(name)
+	if err := fetchModel(name); err != nil {
+		return nil, "", err
+	}
+	params, err := getModelParams(name)
+	if err != nil || params.Fallback == nil {
+		probs, err := predictRow(row)
+		return probs, "", err
+	}
+	fb := params.Fallback
+	probs, err := predictWithTimeout(row, fb.Timeout)
+	if err == nil {
+		return probs, "", nil
+	}
+	if fb.Model != "" && fb.Model != name {
+		r := *row
+		r.Model = fb.Model
+		probs, ferr := predictRow(&r)
+		if ferr == nil {
+			log.Printf("model %s failed: %v, use fallback model %s", name, err, fb.Model)
+			countFallback(name, "model")
+			return probs, fb.Model, nil
+		}
+		log.Printf("model %s failed: %v, fallback model %s failed: %v", name, err, fb.Model, ferr)
+	}
+	if len(fb.Outputs) > 0 {
+		log.Printf("model %s failed: %v, use fallback outputs", name, err)
+		countFallback(name, "default")
+		return append([]float32{}, fb.Outputs...), "default", nil
+	}
+	return nil, "", err
+}
+
+// helper function to flag fallback response
+func setFallbackHeader(w http.ResponseWriter, fallback string) {
+	if fallback != "" {
+		w.Header().Set(fallbackHeader, fallback)
+	}
+}
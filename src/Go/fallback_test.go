@@ -0,0 +1,94 @@
+package main
+
+// tests of model fallbacks, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFakeFallback checks fallback model and default outputs of failing model
+func TestFakeFallback(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+
+	// model with broken graph falls back to dnn2 model
+	params := TFParams{InputNode: "input", OutputNode: "output", Fallback: &Fallback{Model: "dnn2", Outputs: []float32{0.5, 0.5}}}
+	writeModelFiles(t, "broken", []byte{}, params)
+	data, err := json.Marshal(testRow("broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK || w.Header().Get(fallbackHeader) != "dnn2" {
+		t.Fatalf("unexpected fallback response %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+	var probs []float32
+	if err := json.Unmarshal(w.Body.Bytes(), &probs); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	// default outputs are used if fallback model fails too
+	params.Fallback.Model = "missing"
+	writeModelFiles(t, "broken", []byte{}, params)
+	resetModelCache("broken")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK || w.Header().Get(fallbackHeader) != "default" || strings.TrimSpace(w.Body.String()) != "[0.5,0.5]" {
+		t.Fatalf("unexpected default response %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	// successful predictions are not flagged
+	data, _ = json.Marshal(testRow("dnn"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK || w.Header().Get(fallbackHeader) != "" {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, metric := range []string{
+		`tfaas_fallbacks_total{model="broken",kind="model"} 1`,
+		`tfaas_fallbacks_total{model="broken",kind="default"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), metric) {
+			t.Errorf("metrics do not contain %s:\n%s", metric, w.Body.String())
+		}
+	}
+
+	// model can not fall back to itself
+	params.Fallback.Model = "broken"
+	writeModelFiles(t, "broken", []byte("broken"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "broken"), "broken"); err == nil {
+		t.Error("model with fallback to itself should be rejected")
+	}
+}
+
+// TestFakeFallbackTimeout checks fallback of slow model
+func TestFakeFallbackTimeout(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Fallback: &Fallback{Outputs: []float32{1}, Timeout: 10}}
+	writeModelFiles(t, "slow", []byte("slow"), params)
+	if _, err := _faults.add(Fault{Type: faultLatency, Model: "slow", Latency: 200}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _faults.remove("") })
+	start := time.Now()
+	probs, fallback, err := predictWithFallback(testRow("slow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallback != "default" || len(probs) != 1 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("unexpected fallback %s %v after %v", fallback, probs, time.Since(start))
+	}
+}
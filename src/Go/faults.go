@@ -0,0 +1,246 @@
+package main
+
+// faults module provides fault injection for resilience testing
+//
+// When faultInjection is enabled in server configuration administrators may
+// inject faults via POST /admin/faults, e.g.
+// {"type": "latency", "model": "dnn", "latency": 500, "percentage": 10}
+// {"type": "error", "endpoint": "/json", "status": 503, "percentage": 5}
+// {"type": "load", "model": "dnn", "duration": 600}
+// Latency faults delay requests, error faults fail requests (with given HTTP
+// status for endpoint faults) and load faults fail model loading. Faults
+// may be restricted to the model or the endpoint and to the percentage of
+// traffic, and they expire after given duration (in seconds). The list of
+// faults is available via GET /admin/faults, they are removed via
+// DELETE /admin/faults and DELETE /admin/faults/{id}.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fault types
+const (
+	faultLatency = "latency"
+	faultError   = "error"
+	faultLoad    = "load"
+)
+
+// Fault represents injected fault
+type Fault struct {
+	ID         string  `json:"id"`         // fault identifier
+	Type       string  `json:"type"`       // fault type: latency, error or load
+	Model      string  `json:"model"`      // model name, empty for all models
+	Endpoint   string  `json:"endpoint"`   // API endpoint of endpoint faults, empty for model faults
+	Latency    int     `json:"latency"`    // latency in milliseconds of latency faults
+	Status     int     `json:"status"`     // HTTP status of endpoint error faults, default 500
+	Percentage float64 `json:"percentage"` // percentage of affected requests, default 100
+	Duration   int     `json:"duration"`   // duration of the fault in seconds, 0 means until removed
+	Expires    int64   `json:"expires"`    // fault expiration time (unix seconds)
+}
+
+// Faults holds all injected faults
+type Faults struct {
+	Faults []Fault
+	mutex  sync.RWMutex
+}
+
+// global injected faults
+var _faults Faults
+
+// helper function to validate fault
+func (f *Fault) validate() error {
+	switch f.Type {
+	case faultLatency:
+		if f.Latency <= 0 {
+			return errors.New("latency fault requires positive latency")
+		}
+	case faultError:
+		if f.Status == 0 {
+			f.Status = http.StatusInternalServerError
+		}
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("invalid status %d of error fault", f.Status)
+		}
+	case faultLoad:
+		if f.Endpoint != "" {
+			return errors.New("load fault can not be restricted to endpoint")
+		}
+	default:
+		return fmt.Errorf("unsupported fault type '%s'", f.Type)
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return fmt.Errorf("invalid fault percentage %v", f.Percentage)
+	}
+	if f.Percentage == 0 {
+		f.Percentage = 100
+	}
+	if f.Duration < 0 {
+		return fmt.Errorf("invalid fault duration %d", f.Duration)
+	}
+	return nil
+}
+
+// add adds new fault
+func (fs *Faults) add(f Fault) (Fault, error) {
+	if err := f.validate(); err != nil {
+		return f, err
+	}
+	f.ID = newJobID()
+	f.Expires = 0
+	if f.Duration > 0 {
+		f.Expires = time.Now().Unix() + int64(f.Duration)
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.Faults = append(fs.Faults, f)
+	return f, nil
+}
+
+// remove removes fault with given id, empty id removes all faults
+func (fs *Faults) remove(id string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if id == "" {
+		fs.Faults = nil
+		return true
+	}
+	for i, f := range fs.Faults {
+		if f.ID == id {
+			fs.Faults = append(fs.Faults[:i], fs.Faults[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list returns active faults
+func (fs *Faults) list() []Fault {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	now := time.Now().Unix()
+	faults := []Fault{}
+	for _, f := range fs.Faults {
+		if f.Expires == 0 || f.Expires > now {
+			faults = append(faults, f)
+		}
+	}
+	return faults
+}
+
+// match returns faults of given type which should be applied to request of
+// given endpoint and model
+func (fs *Faults) match(kind, endpoint, model string) []Fault {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	if len(fs.Faults) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	var faults []Fault
+	for _, f := range fs.Faults {
+		if f.Type != kind || (f.Expires > 0 && f.Expires <= now) {
+			continue
+		}
+		// endpoint faults are applied by middleware and model faults are
+		// applied during inference
+		if (endpoint == "") != (f.Endpoint == "") || (endpoint != "" && f.Endpoint != endpoint) {
+			continue
+		}
+		if f.Model != "" && f.Model != model {
+			continue
+		}
+		if f.Percentage < 100 && rand.Float64()*100 >= f.Percentage {
+			continue
+		}
+		faults = append(faults, f)
+	}
+	return faults
+}
+
+// helper function to inject latency and error faults into model inference
+func injectModelFaults(model string) error {
+	for _, f := range _faults.match(faultLatency, "", model) {
+		time.Sleep(time.Duration(f.Latency) * time.Millisecond)
+	}
+	if faults := _faults.match(faultError, "", model); len(faults) > 0 {
+		return fmt.Errorf("injected fault %s of model %s", faults[0].ID, model)
+	}
+	return nil
+}
+
+// helper function to inject model load faults
+func injectLoadFault(model string) error {
+	if faults := _faults.match(faultLoad, "", model); len(faults) > 0 {
+		return fmt.Errorf("injected load fault %s of model %s", faults[0].ID, model)
+	}
+	return nil
+}
+
+// faultMiddleware injects faults of API endpoints
+func faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if base := strings.TrimRight(_config.Base, "/"); base != "" {
+			path = strings.TrimPrefix(path, base)
+		}
+		// admin endpoints are never affected to be able to remove faults
+		if strings.HasPrefix(path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// model of endpoint faults can be matched only by query parameter
+		model := r.URL.Query().Get("model")
+		for _, f := range _faults.match(faultLatency, path, model) {
+			time.Sleep(time.Duration(f.Latency) * time.Millisecond)
+		}
+		if faults := _faults.match(faultError, path, model); len(faults) > 0 {
+			msg := fmt.Sprintf("injected fault %s", faults[0].ID)
+			responseError(w, msg, errors.New(msg), faults[0].Status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FaultsHandler lists, injects or removes faults
+func FaultsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "POST":
+		if !_config.FaultInjection {
+			responseError(w, "fault injection is disabled", nil, http.StatusForbidden)
+			return
+		}
+		var f Fault
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			responseError(w, "unable to decode fault", err, http.StatusBadRequest)
+			return
+		}
+		f, err := _faults.add(f)
+		if err != nil {
+			responseError(w, "invalid fault", err, http.StatusBadRequest)
+			return
+		}
+		log.Printf("inject fault %+v", f)
+		responseJSON(w, f)
+		return
+	case "DELETE":
+		id := mux.Vars(r)["id"]
+		if !_faults.remove(id) {
+			responseError(w, fmt.Sprintf("fault %s is not found", id), nil, http.StatusNotFound)
+			return
+		}
+		log.Printf("remove fault '%s'", id)
+	}
+	responseJSON(w, _faults.list())
+}
@@ -0,0 +1,102 @@
+package main
+
+// tests of fault injection, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to inject fault via admin API
+func injectFault(t *testing.T, f Fault) (Fault, int) {
+	data, _ := json.Marshal(f)
+	w := httptest.NewRecorder()
+	FaultsHandler(w, httptest.NewRequest("POST", "/admin/faults", bytes.NewReader(data)))
+	var fault Fault
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &fault); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fault, w.Code
+}
+
+// TestFaultInjection checks model and endpoint faults
+func TestFaultInjection(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	t.Cleanup(func() { _faults.remove("") })
+	if _, code := injectFault(t, Fault{Type: faultError, Model: "dnn"}); code != http.StatusForbidden {
+		t.Fatalf("fault injection should be disabled, status %d", code)
+	}
+	_config.FaultInjection = true
+	for _, f := range []Fault{{Type: "crash"}, {Type: faultLatency}, {Type: faultError, Status: 200}, {Type: faultLoad, Endpoint: "/json"}, {Type: faultError, Percentage: 200}} {
+		if _, code := injectFault(t, f); code != http.StatusBadRequest {
+			t.Errorf("invalid fault %+v is accepted", f)
+		}
+	}
+
+	// error fault of the model
+	fault, _ := injectFault(t, Fault{Type: faultError, Model: "dnn"})
+	if fault.ID == "" || fault.Percentage != 100 {
+		t.Fatalf("unexpected fault %+v", fault)
+	}
+	if _, err := makePredictions(testRow("dnn")); err == nil {
+		t.Error("model error fault is not injected")
+	}
+	if _, err := makePredictions(testRow("dnn2")); err != nil {
+		t.Errorf("fault affects another model: %v", err)
+	}
+
+	// latency fault of the model
+	injectFault(t, Fault{Type: faultLatency, Model: "dnn2", Latency: 50})
+	start := time.Now()
+	if _, err := makePredictions(testRow("dnn2")); err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("model latency fault is not injected, err %v", err)
+	}
+
+	// load fault of the model
+	injectFault(t, Fault{Type: faultLoad, Model: "img"})
+	if _, err := _cache.get("img"); err == nil {
+		t.Error("model load fault is not injected")
+	}
+
+	// endpoint faults
+	router := mux.NewRouter()
+	router.HandleFunc("/json", PredictHandler).Methods("POST")
+	router.Use(faultMiddleware)
+	injectFault(t, Fault{Type: faultError, Endpoint: "/json", Status: http.StatusServiceUnavailable})
+	data, _ := json.Marshal(testRow("dnn2"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d of endpoint fault", w.Code)
+	}
+
+	// remove faults
+	w = httptest.NewRecorder()
+	FaultsHandler(w, mux.SetURLVars(httptest.NewRequest("DELETE", "/admin/faults/"+fault.ID, nil), map[string]string{"id": fault.ID}))
+	var faults []Fault
+	json.Unmarshal(w.Body.Bytes(), &faults)
+	if w.Code != http.StatusOK || len(faults) != 3 {
+		t.Fatalf("unexpected status %d faults %+v", w.Code, faults)
+	}
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Errorf("removed fault is still injected: %v", err)
+	}
+	w = httptest.NewRecorder()
+	FaultsHandler(w, httptest.NewRequest("DELETE", "/admin/faults", nil))
+	if len(_faults.list()) != 0 {
+		t.Error("faults are not removed")
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d without faults", w.Code)
+	}
+}
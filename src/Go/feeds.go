@@ -0,0 +1,137 @@
+package main
+
+// feeds module provides constant feeds of TF models
+//
+// Some graphs require extra feeds which do not depend on request, e.g.
+// dropout keep_prob=1.0 or is_training=false. Such feeds are declared in
+// params.json of the model, e.g.
+//   "const_feeds": [{"node": "keep_prob", "dtype": "float", "value": 1.0},
+//                   {"node": "is_training", "dtype": "bool", "value": false}]
+// and the server adds them to every session run of the model. Feeds of the
+// request take precedence over constant feeds with the same node name.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// ConstFeed represents constant tensor fed into every session run of the model
+type ConstFeed struct {
+	Node  string      `json:"node"`  // operation name, e.g. keep_prob or keep_prob:0
+	Dtype string      `json:"dtype"` // tensor type: float, double, int32, int64 or bool
+	Value interface{} `json:"value"` // scalar value of the tensor, e.g. 1.0 or false
+}
+
+// helper function to convert JSON number into integer value
+func integerValue(value interface{}) (int64, error) {
+	v, ok := value.(float64)
+	if !ok || v != math.Trunc(v) {
+		return 0, fmt.Errorf("value %v is not an integer", value)
+	}
+	return int64(v), nil
+}
+
+// helper function to convert constant feed value into Go value of its dtype
+func (f ConstFeed) scalar() (interface{}, error) {
+	switch f.Dtype {
+	case "float", "float32", "":
+		if v, ok := f.Value.(float64); ok {
+			return float32(v), nil
+		}
+	case "double", "float64":
+		if v, ok := f.Value.(float64); ok {
+			return v, nil
+		}
+	case "int32":
+		v, err := integerValue(f.Value)
+		if err != nil || v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("value %v is not int32", f.Value)
+		}
+		return int32(v), nil
+	case "int64":
+		return integerValue(f.Value)
+	case "bool":
+		if v, ok := f.Value.(bool); ok {
+			return v, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dtype %s of constant feed %s", f.Dtype, f.Node)
+	}
+	return nil, fmt.Errorf("value %v of constant feed %s is not %s", f.Value, f.Node, f.Dtype)
+}
+
+// helper function to create tensors of constant feeds
+func constFeedTensors(feeds []ConstFeed) (map[string]TFTensor, error) {
+	tensors := make(map[string]TFTensor)
+	for _, f := range feeds {
+		if f.Node == "" {
+			return nil, errors.New("constant feed without node name")
+		}
+		if _, _, err := parseOutputName(f.Node); err != nil {
+			return nil, err
+		}
+		value, err := f.scalar()
+		if err != nil {
+			return nil, err
+		}
+		tensor, err := _tf.NewScalarTensor(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create constant feed %s: %v", f.Node, err)
+		}
+		tensors[f.Node] = tensor
+	}
+	return tensors, nil
+}
+
+// global cache of constant feeds tensors
+var (
+	constFeeds     = make(map[string]map[string]TFTensor)
+	constFeedsLock sync.RWMutex
+)
+
+// helper function to get constant feeds of given model
+func getConstFeeds(model string) (map[string]TFTensor, error) {
+	constFeedsLock.RLock()
+	tensors, ok := constFeeds[model]
+	constFeedsLock.RUnlock()
+	if ok {
+		return tensors, nil
+	}
+	// models without params.json do not have constant feeds
+	params, err := getModelParams(model)
+	if err == nil && len(params.ConstFeeds) > 0 {
+		tensors, err = constFeedTensors(params.ConstFeeds)
+		if err != nil {
+			return nil, fmt.Errorf("model %s: %v", model, err)
+		}
+	}
+	constFeedsLock.Lock()
+	defer constFeedsLock.Unlock()
+	constFeeds[model] = tensors
+	return tensors, nil
+}
+
+// helper function to remove constant feeds of given model
+func removeConstFeeds(model string) {
+	constFeedsLock.Lock()
+	defer constFeedsLock.Unlock()
+	delete(constFeeds, model)
+}
+
+// helper function to add constant feeds of the model to feeds of session run
+func withConstFeeds(model string, feeds map[string]TFTensor) (map[string]TFTensor, error) {
+	tensors, err := getConstFeeds(model)
+	if err != nil || len(tensors) == 0 {
+		return feeds, err
+	}
+	out := make(map[string]TFTensor, len(feeds)+len(tensors))
+	for name, t := range tensors {
+		out[name] = t
+	}
+	for name, t := range feeds {
+		out[name] = t
+	}
+	return out, nil
+}
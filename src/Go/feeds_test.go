@@ -0,0 +1,84 @@
+package main
+
+// tests of constant feeds, they do not require TF C library
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestConstFeedScalar checks conversion of constant feed values
+func TestConstFeedScalar(t *testing.T) {
+	tests := []struct {
+		feed   ConstFeed
+		expect interface{}
+	}{
+		{ConstFeed{Node: "keep_prob", Value: 1.0}, float32(1)},
+		{ConstFeed{Node: "keep_prob", Dtype: "double", Value: 0.5}, 0.5},
+		{ConstFeed{Node: "seq_len", Dtype: "int32", Value: 10.0}, int32(10)},
+		{ConstFeed{Node: "seq_len", Dtype: "int64", Value: 10.0}, int64(10)},
+		{ConstFeed{Node: "is_training", Dtype: "bool", Value: false}, false},
+	}
+	for _, test := range tests {
+		value, err := test.feed.scalar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != test.expect {
+			t.Errorf("feed %+v: expect %v (%T) got %v (%T)", test.feed, test.expect, test.expect, value, value)
+		}
+	}
+	for _, feed := range []ConstFeed{
+		{Node: "keep_prob", Dtype: "float", Value: "1.0"},
+		{Node: "seq_len", Dtype: "int32", Value: 1.5},
+		{Node: "is_training", Dtype: "bool", Value: 0.0},
+		{Node: "name", Dtype: "string", Value: "abc"},
+	} {
+		if _, err := feed.scalar(); err == nil {
+			t.Errorf("feed %+v should fail", feed)
+		}
+	}
+}
+
+// TestFakeConstFeeds checks that constant feeds are added to session runs
+func TestFakeConstFeeds(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", ConstFeeds: []ConstFeed{
+		{Node: "keep_prob", Dtype: "float", Value: 1.0},
+		{Node: "is_training", Dtype: "bool", Value: false},
+	}}
+	writeModelFiles(t, "dropout", []byte("dropout"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "dropout"), "dropout"); err != nil {
+		t.Fatal(err)
+	}
+	probs, err := makePredictions(testRow("dropout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	feeds := fake.Feeds()
+	if len(feeds) != 3 || feeds["input"] == nil {
+		t.Fatalf("unexpected feeds %v", feeds)
+	}
+	if v := feeds["keep_prob"].Value(); v != float32(1) {
+		t.Errorf("unexpected keep_prob %v", v)
+	}
+	if v := feeds["is_training"].Value(); v != false {
+		t.Errorf("unexpected is_training %v", v)
+	}
+
+	// models without constant feeds get request feeds only
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	if feeds := fake.Feeds(); len(feeds) != 1 {
+		t.Errorf("unexpected feeds of model without constant feeds %v", feeds)
+	}
+
+	// invalid constant feeds are rejected at upload
+	params.ConstFeeds = []ConstFeed{{Node: "keep_prob", Dtype: "float", Value: "one"}}
+	writeModelFiles(t, "dropout", []byte("dropout"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "dropout"), "dropout"); err == nil {
+		t.Error("model with invalid constant feed should be rejected")
+	}
+}
@@ -13,10 +13,10 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
-	tf "github.com/galeone/tensorflow/tensorflow/go"
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 	"github.com/shirou/gopsutil/cpu"
@@ -82,7 +82,7 @@ func DataHandler(w http.ResponseWriter, r *http.Request) {
 
 // ImageHandler send prediction from TF ML model
 func ImageHandler(w http.ResponseWriter, r *http.Request) {
-	model := r.FormValue("model")
+	model := resolveModel(r.FormValue("model"))
 	if model == "" {
 		msg := fmt.Sprintf("unable to read %s model", model)
 		responseError(w, msg, nil, http.StatusInternalServerError)
@@ -94,6 +94,11 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 		responseError(w, msg, nil, http.StatusInternalServerError)
 		return
 	}
+	if tfModel == xgboostBackend {
+		msg := fmt.Sprintf("model %s does not support image predictions", model)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
 	if tfModel == "tf1" {
 		log.Println("use ImageTF1Handler")
 		ImageTF1Handler(w, r)
@@ -105,7 +110,7 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 
 // ImageTF2Handler send prediction from TF2 ML model
 func ImageTF2Handler(w http.ResponseWriter, r *http.Request) {
-	model := r.FormValue("model")
+	model := resolveModel(r.FormValue("model"))
 	if model == "" {
 		msg := fmt.Sprintf("unable to read %s model", model)
 		responseError(w, msg, nil, http.StatusInternalServerError)
@@ -139,16 +144,23 @@ func ImageTF2Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Make tensor
+	roi, err := requestROI(r, params)
+	if err != nil {
+		responseError(w, "invalid crop", err, http.StatusBadRequest)
+		return
+	}
 	imgFormat := imageName[len(imageName)-1]
-	tensor, err := makeTensorFromImage(&imageBuffer, imgFormat, imgChannels)
+	tensor, err := makeTensorFromImage(&imageBuffer, imgFormat, imgChannels, roi)
 	if err != nil {
 		responseError(w, "Invalid image", err, http.StatusBadRequest)
 		return
 	}
 
 	// Run inference
+	observeUsage(usageClient(r), model, 1)
 	probs, err := makePredictionsTensor(model, tensor)
 	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
 		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
 		return
 	}
@@ -156,12 +168,18 @@ func ImageTF2Handler(w http.ResponseWriter, r *http.Request) {
 	if VERBOSE > 0 {
 		log.Println("image tensor", tensor, "probs", probs)
 	}
-	responseJSON(w, probs)
+	raw := rawOutputs(model, rawRequested(r))
+	if params.Segmentation != nil && !raw {
+		responseSegmentation(w, r, model, fileName, params, probs)
+		return
+	}
+	setOutputShapeHeader(w, model, "")
+	responsePredictions(w, model, "", probs, raw)
 }
 
 // ImageTF1Handler send prediction from TF ML model
 func ImageTF1Handler(w http.ResponseWriter, r *http.Request) {
-	model := r.FormValue("model")
+	model := resolveModel(r.FormValue("model"))
 	if model == "" {
 		msg := fmt.Sprintf("unable to read %s model", model)
 		responseError(w, msg, nil, http.StatusInternalServerError)
@@ -201,70 +219,111 @@ func ImageTF1Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Make tensor
+	roi, err := requestROI(r, params)
+	if err != nil {
+		responseError(w, "invalid crop", err, http.StatusBadRequest)
+		return
+	}
 	imgFormat := imageName[len(imageName)-1]
-	tensor, err := makeTensorFromImage(&imageBuffer, imgFormat, imgChannels)
+	tensor, err := makeTensorFromImage(&imageBuffer, imgFormat, imgChannels, roi)
 	if err != nil {
 		responseError(w, "Invalid image", err, http.StatusBadRequest)
 		return
 	}
 
+	// per-request overrides of model parameters
+	var overrides *Overrides
+	if v := r.FormValue("overrides"); v != "" {
+		if err := json.Unmarshal([]byte(v), &overrides); err != nil {
+			responseError(w, "unable to unmarshal overrides", err, http.StatusBadRequest)
+			return
+		}
+		if err := overrides.check(model); err != nil {
+			responseError(w, "invalid overrides", err, http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Run inference
-	session, err := tf.NewSession(tfm.Graph, _sessionOptions)
-	if err != nil {
-		responseError(w, "Unable to create new session", err, http.StatusInternalServerError)
+	modelParams := overrides.apply(tfm.Params)
+	input, outputNode := modelParams.nodes()
+	observeUsage(usageClient(r), model, 1)
+	raw := rawOutputs(model, rawRequested(r))
+	if !raw && tfm.Params.TopK > 0 && tfm.Params.Segmentation == nil && (overrides == nil || !overrides.Softmax) {
+		// best labels are computed by TopK operation of the graph
+		topN := overrides.topN(5)
+		if topN > tfm.Params.TopK {
+			topN = tfm.Params.TopK
+		}
+		labels, err := classifyTopK(model, tfm, input, outputNode, tensor, topN)
+		if err != nil {
+			publish(EventPredictionFailed, model, err.Error())
+			responseError(w, "Could not run inference", err, http.StatusInternalServerError)
+			return
+		}
+		responseJSON(w, ClassifyResult{
+			Filename: fileName,
+			Labels:   labels,
+			Decision: decideLabels(tfm.Params, labels),
+		})
 		return
 	}
-	defer session.Close()
-	if VERBOSE > 0 {
-		devices, err := session.ListDevices()
-		if err == nil {
-			log.Println("devices", devices)
-		} else {
-			log.Println("node availability", err)
-		}
+	output, err := runSession(model, tfm.Graph,
+		map[string]TFTensor{input: tensor},
+		[]string{outputNode})
+	var row []float32
+	if err == nil {
+		row, err = outputRow(model, output[0])
 	}
-	output, err := session.Run(
-		map[tf.Output]*tf.Tensor{
-			tfm.Graph.Operation(tfm.Params.InputNode).Output(0): tensor,
-		},
-		[]tf.Output{
-			tfm.Graph.Operation(tfm.Params.OutputNode).Output(0),
-		},
-		nil)
 	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
 		responseError(w, "Could not run inference", err, http.StatusInternalServerError)
 		return
 	}
+	if raw {
+		// full output vector without labels
+		setOutputShapeHeader(w, model, "")
+		setRawOutputsHeader(w, raw)
+		responseProbs(w, row, 0)
+		return
+	}
+	if tfm.Params.Segmentation != nil {
+		responseSegmentation(w, r, model, fileName, tfm.Params, row)
+		return
+	}
 	// our model probabilities
-	probs := output[0].Value().([][]float32)[0]
+	probs := overrides.postProcess(row)
 
 	// make prediction response
-	topN := 5
+	topN := overrides.topN(5)
 	if len(tfm.Labels) < topN {
 		topN = len(tfm.Labels)
 	}
+	decision, _ := decide(model, probs)
 	responseJSON(w, ClassifyResult{
 		Filename: fileName,
 		Labels:   findBestLabels(tfm.Labels, probs, topN),
+		Decision: decision,
 	})
 }
 
 // PredictProtobufHandler send prediction from TF ML model
 func PredictProtobufHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+	buf, err := readBuffer(r.Body)
 	if err != nil {
 		responseError(w, "unable to read incoming data", err, http.StatusInternalServerError)
 		return
 	}
+	defer putBuffer(buf)
 	// example how to unmarshal Row message
 	recs := &tfaaspb.Row{}
-	if err := proto.Unmarshal(body, recs); err != nil {
+	if err := proto.Unmarshal(buf.Bytes(), recs); err != nil {
 		responseError(w, "unable to unmarshal Row", err, http.StatusInternalServerError)
 		return
 	}
 	if VERBOSE > 0 {
-		log.Println("received", recs)
+		log.Println("received", redactedRow(&Row{Keys: recs.Key, Values: recs.Value, Model: recs.Model}))
 	}
 
 	// convert tfaaspb.Row into Row
@@ -276,17 +335,21 @@ func PredictProtobufHandler(w http.ResponseWriter, r *http.Request) {
 	for _, v := range recs.Value {
 		values = append(values, v)
 	}
-	records := &Row{Keys: keys, Values: values, Model: recs.Model}
+	records := &Row{Keys: keys, Values: values, Model: recs.Model, Raw: rawRequested(r)}
 
 	// generate predictions
-	probs, err := makePredictions(records)
+	observeUsage(usageClient(r), records.Model, 1)
+	probs, fallback, err := predictWithFallback(records)
 	if err != nil {
+		publish(EventPredictionFailed, records.Model, err.Error())
 		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
 		return
 	}
+	setFallbackHeader(w, fallback)
+	setOutputShapeHeader(w, records.Model, fallback)
 
 	if VERBOSE > 0 {
-		log.Println("response inputs", records, "probs", probs)
+		log.Println("response inputs", redactedRow(records), "probs", probs)
 	}
 
 	// wrap our probabilities into Predictions class
@@ -307,28 +370,51 @@ func PredictProtobufHandler(w http.ResponseWriter, r *http.Request) {
 // PredictHandler send prediction from TF ML model
 func PredictHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+	buf, err := readBuffer(r.Body)
 	if err != nil {
 		responseError(w, "unable to read incoming data", err, http.StatusInternalServerError)
 		return
 	}
+	defer putBuffer(buf)
 	// unmarshal incoming JSON message into Row data structure
 	recs := &Row{}
-	if err := json.Unmarshal(body, recs); err != nil {
+	if err := json.Unmarshal(buf.Bytes(), recs); err != nil {
 		responseError(w, "unable to unmarshal Row", err, http.StatusInternalServerError)
 		return
 	}
+	if err := checkEventID(recs); err != nil {
+		responseError(w, "invalid Row", err, http.StatusBadRequest)
+		return
+	}
+	setEventIDHeader(w, recs)
+	if err := validatePayload(recs.Model, buf.Bytes()); err != nil {
+		responseError(w, fmt.Sprintf("payload does not match input schema: %v", err), err, http.StatusBadRequest)
+		return
+	}
 	if VERBOSE > 0 {
-		log.Println("received", recs)
+		log.Println("received", redactedRow(recs))
+	}
+	sinks, err := selectResultSinks(r, recs.Model)
+	if err != nil {
+		responseError(w, "invalid result sinks", err, http.StatusBadRequest)
+		return
 	}
 
 	// generate predictions
-	probs, err := makePredictions(recs)
+	observeUsage(usageClient(r), recs.Model, 1)
+	recs.Raw = rawOutputs(recs.Model, recs.Raw || rawRequested(r))
+	probs, fallback, err := predictWithFallback(recs)
 	if err != nil {
+		publish(EventPredictionFailed, recs.Model, err.Error())
 		responseError(w, "PredictHandler: unable to make predictions", err, http.StatusInternalServerError)
 		return
 	}
-	responseJSON(w, probs)
+	logPrediction(recs, recs.Model, probs)
+	writeResultSinks(sinks, recs.Model, recs.EventID, [][]float32{probs})
+	setFallbackHeader(w, fallback)
+	setOutputShapeHeader(w, recs.Model, fallback)
+	setRawOutputsHeader(w, recs.Raw)
+	responsePredictions(w, recs.Model, fallback, probs, recs.Raw)
 }
 
 // POST methods
@@ -360,7 +446,29 @@ func formData(r *http.Request) bool {
 
 // UploadHandler uploads TF models into the server
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	// check that we have enough space to store the model
+	if err := checkFreeSpace(r.ContentLength); err != nil {
+		responseError(w, "insufficient storage", err, http.StatusInsufficientStorage)
+		return
+	}
+	// body of unknown size can't exceed free space of model area
+	if r.ContentLength < 0 {
+		if available, err := availableSpace(); err == nil && available >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, available)
+		}
+	}
 	if formData(r) {
+		// we received model bundle via form file
+		if bundleFile, _, err := r.FormFile("bundle"); err == nil {
+			defer bundleFile.Close()
+			bundle, err := ioutil.ReadAll(bundleFile)
+			if err != nil {
+				responseError(w, "unable to read bundle", err, http.StatusInternalServerError)
+				return
+			}
+			uploadBundle(w, bundle, r.FormValue("name"))
+			return
+		}
 		// we received request for upload via form values
 		UploadFormHandler(w, r)
 		return
@@ -385,26 +493,62 @@ func UploadBundleHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		bundle, err = ioutil.ReadAll(r.Body)
 	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		responseError(w, "insufficient storage", err, http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		msg := "unable to read body"
 		responseError(w, msg, err, http.StatusInternalServerError)
 		return
 	}
-	//     fname := fmt.Sprintf("/tmp/bundle.tar")
-	fname := fmt.Sprintf("%s/bundle.tar", os.TempDir())
+	uploadBundle(w, bundle, r.URL.Query().Get("name"))
+}
+
+// helper function to install given model bundle and write response
+func uploadBundle(w http.ResponseWriter, bundle []byte, name string) {
+	file, err := ioutil.TempFile("", "bundle-*.tar")
+	if err != nil {
+		responseError(w, "unable to create bundle file", err, http.StatusInternalServerError)
+		return
+	}
+	fname := file.Name()
 	defer os.Remove(fname)
-	err = ioutil.WriteFile(fname, bundle, 0600)
+	_, err = file.Write(bundle)
+	file.Close()
 	if err != nil {
 		msg := fmt.Sprintf("unable to write %s", fname)
 		responseError(w, msg, err, http.StatusInternalServerError)
 		return
 	}
-	err = Untar(fname, _config.ModelDir)
+	installBundleFile(w, fname, name)
+}
+
+// helper function to install model bundle stored in given file and write
+// response, the bundle can be provided as tar or tar.gz file
+func installBundleFile(w http.ResponseWriter, fname, name string) {
+	tarball, err := gunzipFile(fname)
 	if err != nil {
-		msg := fmt.Sprintf("unable to untar %s", fname)
-		responseError(w, msg, err, http.StatusInternalServerError)
+		responseError(w, "unable to decompress bundle", err, http.StatusBadRequest)
+		return
+	}
+	if tarball != fname {
+		defer os.Remove(tarball)
+	}
+	models, err := installBundle(tarball, name)
+	if errors.Is(err, errNoFreeSpace) {
+		responseError(w, "insufficient storage", err, http.StatusInsufficientStorage)
 		return
 	}
+	if err != nil {
+		msg := fmt.Sprintf("unable to install model bundle: %v", err)
+		responseError(w, msg, err, http.StatusBadRequest)
+		return
+	}
+	for _, model := range models {
+		startSelfTest(model)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -426,14 +570,14 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 				responseError(w, emsg, nil, http.StatusInternalServerError)
 				return
 			}
-			path = fmt.Sprintf("%s/%s", _config.ModelDir, mkey)
-			// create requested area for TF model
-			err := os.MkdirAll(path, 0744)
+			// create staging area for TF model
+			var err error
+			path, err = stagingDir()
 			if err != nil {
-				msg := fmt.Sprintf("unable to create %s", path)
-				responseError(w, msg, err, http.StatusInternalServerError)
+				responseError(w, "unable to create staging area", err, http.StatusInternalServerError)
 				return
 			}
+			defer os.RemoveAll(path)
 			continue
 		}
 		// read other parameters which represent files
@@ -502,8 +646,36 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Println("Uploaded", fileName)
 	}
+	// read optional golden test set of the model
+	if goldenFile, _, err := r.FormFile("golden"); err == nil {
+		defer goldenFile.Close()
+		fname := params.Golden
+		if fname == "" {
+			fname = "golden.json"
+		}
+		fileName := fmt.Sprintf("%s/%s", path, fname)
+		data, err := ioutil.ReadAll(goldenFile)
+		if err != nil {
+			responseError(w, "unable to read golden file", err, http.StatusInternalServerError)
+			return
+		}
+		err = ioutil.WriteFile(fileName, data, 0644)
+		if err != nil {
+			responseError(w, "unable to write file", err, http.StatusInternalServerError)
+			return
+		}
+		log.Println("Uploaded", fileName)
+	}
+	// install validated model into model area
+	err := installModel(path, mkey)
+	if err != nil {
+		msg := fmt.Sprintf("unable to install %s model", mkey)
+		responseError(w, msg, err, http.StatusBadRequest)
+		return
+	}
 	// set current parameters set
 	_params = params
+	startSelfTest(mkey)
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -512,13 +684,16 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 func ParamsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		vars := mux.Vars(r)
-		model := vars["model"]
+		model := resolveModel(vars["model"])
 		fname := fmt.Sprintf("%s/%s/params.json", _config.ModelDir, model)
 		if _, err := os.Stat(fname); err != nil {
 			msg := "unable to read params.json model file"
 			responseError(w, msg, err, http.StatusInternalServerError)
 			return
 		}
+		if checkModelETag(w, r, model) {
+			return
+		}
 		data, err := ioutil.ReadFile(fname)
 		if err != nil {
 			msg := fmt.Sprintf("unable to read %s model file", fname)
@@ -550,13 +725,26 @@ func ParamsHandler(w http.ResponseWriter, r *http.Request) {
 
 // ModelsHandler returns a list of known models
 func ModelsHandler(w http.ResponseWriter, r *http.Request) {
-	models, err := TFModels()
+	// catalog is marshaled only when it is changed
+	etag, err := catalogFingerprint()
+	if err != nil {
+		msg := fmt.Sprintf("Unable to get TF models")
+		responseError(w, msg, err, http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w)
+	if checkETag(w, r, etag) {
+		return
+	}
+	data, err := catalogJSON(etag)
 	if err != nil {
 		msg := fmt.Sprintf("Unable to get TF models")
 		responseError(w, msg, err, http.StatusInternalServerError)
 		return
 	}
-	responseJSON(w, models)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 // DefaultHandler authenticate incoming requests and route them to appropriate handler
@@ -591,6 +779,18 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	tmplData["Uptime"] = time.Since(Time0).Seconds()
 	tmplData["getRequests"] = TotalGetRequests
 	tmplData["postRequests"] = TotalPostRequests
+	tmplData["selfTests"] = _selfTests.list()
+	tmplData["janitor"] = janitorReport()
+	tmplData["sessionPools"] = sessionPoolsStats()
+	tmplData["backend"] = tfBackend()
+	tmplData["tfVersion"] = _tf.Version()
+	tmplData["slo"] = sloReports()
+	tmplData["readOnly"] = isReadOnly()
+	tmplData["drain"] = drainMode()
+	tmplData["breakers"] = openBreakers()
+	tmplData["memoryPressure"] = underMemoryPressure()
+	tmplData["limits"] = _limits
+	tmplData["leader"] = leaderInfo()
 	data, err := json.Marshal(tmplData)
 	if err != nil {
 		msg := "unable to marshal data"
@@ -602,6 +802,32 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// ReadyHandler provides readiness probe of the server, it fails if any
+// of the models did not pass its self-tests
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if mode := drainMode(); mode.Draining {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		rec := make(map[string]interface{})
+		rec["status"] = "draining"
+		rec["message"] = mode.Message
+		json.NewEncoder(w).Encode(rec)
+		return
+	}
+	failed := _selfTests.failed()
+	if len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		rec := make(map[string]interface{})
+		rec["status"] = "not ready"
+		rec["failedSelfTests"] = failed
+		json.NewEncoder(w).Encode(rec)
+		return
+	}
+	responseJSON(w, map[string]string{"status": "ready"})
+}
+
 // NetronHandler provides hook to netron visualization library for graphs,
 // see https://github.com/lutzroeder/Netron
 func NetronHandler(w http.ResponseWriter, r *http.Request) {
@@ -680,6 +906,11 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	_cache.remove(model)
+	if err := unpushModel(model); err != nil {
+		responseError(w, fmt.Sprintf("unable to remove %s from model store", model), err, http.StatusInternalServerError)
+		return
+	}
+	resetModelCache(model)
+	_selfTests.remove(model)
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,262 @@
+package main
+
+// hashing module provides server-side feature hashing of string features
+//
+// Very high-cardinality categorical features (user ids, URLs, ...) are
+// usually hashed into fixed number of buckets by training pipelines, e.g. by
+// TF categorical_column_with_hash_bucket feature columns. Models may declare
+// hashed features in their params.json, e.g.
+// "hashing": [{"feature": "user", "buckets": 1000},
+//             {"feature": "url", "buckets": 100, "seed": [1, 2], "onehot": true}]
+// and clients send raw strings in "categorical" field of the row, e.g.
+// {"model": "ads", "keys": ["age"], "values": [42], "categorical": {"user": "u123", "url": "a.com"}}
+// Hashed features are appended to row values in the order of their
+// declaration, either as bucket index or as one-hot vector of buckets. The
+// bucket matches TF hashing: features without seed use the fingerprint of
+// tf.strings.to_hash_bucket_fast (used by feature columns), while features
+// with seed use keyed hash of tf.strings.to_hash_bucket_strong(key=seed).
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// maximum number of buckets of one-hot encoded features
+const maxOneHotBuckets = 1 << 20
+
+// HashedFeature represents string feature hashed into buckets
+type HashedFeature struct {
+	Feature string   `json:"feature"`          // name of string feature of the row
+	Buckets int64    `json:"buckets"`          // number of hash buckets
+	Seed    []uint64 `json:"seed,omitempty"`   // key of strong hashing, e.g. [1, 2]
+	OneHot  bool     `json:"onehot,omitempty"` // provide one-hot vector of buckets instead of bucket index
+}
+
+// bucket returns hash bucket of given value
+func (h HashedFeature) bucket(value string) (int64, error) {
+	if h.Buckets <= 0 {
+		return 0, fmt.Errorf("invalid number of buckets %d of %s feature", h.Buckets, h.Feature)
+	}
+	var sum uint64
+	switch len(h.Seed) {
+	case 0:
+		sum = fingerprint64([]byte(value))
+	case 2:
+		sum = sipHash24(h.Seed[0], h.Seed[1], []byte(value))
+	default:
+		return 0, fmt.Errorf("seed of %s feature should have two values", h.Feature)
+	}
+	return int64(sum % uint64(h.Buckets)), nil
+}
+
+// helper function to append hashed features to values of the row
+func hashRow(model string, row *Row) (*Row, error) {
+	params, err := getModelParams(model)
+	if err != nil || len(params.Hashing) == 0 {
+		return nil, fmt.Errorf("model %s does not declare hashed features", model)
+	}
+	for name := range row.Categorical {
+		if !hasHashedFeature(params.Hashing, name) {
+			return nil, fmt.Errorf("model %s does not declare %s feature", model, name)
+		}
+	}
+	r := *row
+	r.Keys = append([]string{}, row.Keys...)
+	r.Values = append([]float32{}, row.Values...)
+	for _, h := range params.Hashing {
+		value, ok := row.Categorical[h.Feature]
+		if !ok {
+			return nil, fmt.Errorf("missing %s feature", h.Feature)
+		}
+		b, err := h.bucket(value)
+		if err != nil {
+			return nil, err
+		}
+		if !h.OneHot {
+			r.Keys = append(r.Keys, h.Feature)
+			r.Values = append(r.Values, float32(b))
+			continue
+		}
+		if h.Buckets > maxOneHotBuckets {
+			return nil, fmt.Errorf("too many buckets %d of one-hot %s feature", h.Buckets, h.Feature)
+		}
+		for i := int64(0); i < h.Buckets; i++ {
+			r.Keys = append(r.Keys, fmt.Sprintf("%s_%d", h.Feature, i))
+			if i == b {
+				r.Values = append(r.Values, 1)
+			} else {
+				r.Values = append(r.Values, 0)
+			}
+		}
+	}
+	r.Categorical = nil
+	return &r, nil
+}
+
+// helper function to check if feature is declared among hashed features
+func hasHashedFeature(features []HashedFeature, name string) bool {
+	for _, h := range features {
+		if h.Feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+// constants of fingerprint hashing
+const (
+	fpK0 uint64 = 0xc3a5c85c97cb3127
+	fpK1 uint64 = 0xb492b66fbe98f273
+	fpK2 uint64 = 0x9ae16a3b2f90404f
+)
+
+// helper function to read little endian 64-bit word
+func fpWord(s []byte) uint64 {
+	return binary.LittleEndian.Uint64(s)
+}
+
+// helper function to mix bits of the value
+func fpShiftMix(v uint64) uint64 {
+	return v ^ (v >> 47)
+}
+
+// helper function to hash two words with given multiplier
+func fpHash16(u, v, mul uint64) uint64 {
+	a := (u ^ v) * mul
+	a ^= a >> 47
+	b := (v ^ a) * mul
+	b ^= b >> 47
+	return b * mul
+}
+
+// helper function to hash 32 bytes with two seeds
+func fpWeakHash32(s []byte, a, b uint64) (uint64, uint64) {
+	w, x, y, z := fpWord(s), fpWord(s[8:]), fpWord(s[16:]), fpWord(s[24:])
+	a += w
+	b = bits.RotateLeft64(b+a+z, -21)
+	c := a
+	a += x + y
+	b += bits.RotateLeft64(a, -44)
+	return a + z, b + c
+}
+
+// fingerprint64 implements 64-bit fingerprint (FarmHash Fingerprint64) of
+// TF string hashing, e.g. tf.strings.to_hash_bucket_fast
+func fingerprint64(s []byte) uint64 {
+	n := uint64(len(s))
+	switch {
+	case n == 0:
+		return fpK2
+	case n < 4:
+		y := uint32(s[0]) + uint32(s[n>>1])<<8
+		z := uint32(n) + uint32(s[n-1])<<2
+		return fpShiftMix(uint64(y)*fpK2^uint64(z)*fpK0) * fpK2
+	case n < 8:
+		mul := fpK2 + n*2
+		a := uint64(binary.LittleEndian.Uint32(s))
+		return fpHash16(n+a<<3, uint64(binary.LittleEndian.Uint32(s[n-4:])), mul)
+	case n <= 16:
+		mul := fpK2 + n*2
+		a := fpWord(s) + fpK2
+		b := fpWord(s[n-8:])
+		c := bits.RotateLeft64(b, -37)*mul + a
+		d := (bits.RotateLeft64(a, -25) + b) * mul
+		return fpHash16(c, d, mul)
+	case n <= 32:
+		mul := fpK2 + n*2
+		a := fpWord(s) * fpK1
+		b := fpWord(s[8:])
+		c := fpWord(s[n-8:]) * mul
+		d := fpWord(s[n-16:]) * fpK2
+		return fpHash16(bits.RotateLeft64(a+b, -43)+bits.RotateLeft64(c, -30)+d, a+bits.RotateLeft64(b+fpK2, -18)+c, mul)
+	case n <= 64:
+		mul := fpK2 + n*2
+		a := fpWord(s) * fpK2
+		b := fpWord(s[8:])
+		c := fpWord(s[n-8:]) * mul
+		d := fpWord(s[n-16:]) * fpK2
+		y := bits.RotateLeft64(a+b, -43) + bits.RotateLeft64(c, -30) + d
+		z := fpHash16(y, a+bits.RotateLeft64(b+fpK2, -18)+c, mul)
+		e := fpWord(s[16:]) * mul
+		f := fpWord(s[24:])
+		g := (y + fpWord(s[n-32:])) * mul
+		h := (z + fpWord(s[n-24:])) * mul
+		return fpHash16(bits.RotateLeft64(e+f, -43)+bits.RotateLeft64(g, -30)+h, e+bits.RotateLeft64(f+a, -18)+g, mul)
+	}
+	// longer strings are processed in 64 bytes chunks
+	var seed uint64 = 81
+	var v0, v1, w0, w1 uint64
+	x := seed*fpK2 + fpWord(s)
+	y := seed*fpK1 + 113
+	z := fpShiftMix(y*fpK2+113) * fpK2
+	last := s[n-64:]
+	for len(s) > 64 {
+		x = bits.RotateLeft64(x+y+v0+fpWord(s[8:]), -37) * fpK1
+		y = bits.RotateLeft64(y+v1+fpWord(s[48:]), -42) * fpK1
+		x ^= w1
+		y += v0 + fpWord(s[40:])
+		z = bits.RotateLeft64(z+w0, -33) * fpK1
+		v0, v1 = fpWeakHash32(s, v1*fpK1, x+w0)
+		w0, w1 = fpWeakHash32(s[32:], z+w1, y+fpWord(s[16:]))
+		x, z = z, x
+		s = s[64:]
+	}
+	mul := fpK1 + (z&0xff)<<1
+	s = last
+	w0 += (n - 1) & 63
+	v0 += w0
+	w0 += v0
+	x = bits.RotateLeft64(x+y+v0+fpWord(s[8:]), -37) * mul
+	y = bits.RotateLeft64(y+v1+fpWord(s[48:]), -42) * mul
+	x ^= w1 * 9
+	y += v0*9 + fpWord(s[40:])
+	z = bits.RotateLeft64(z+w0, -33) * mul
+	v0, v1 = fpWeakHash32(s, v1*mul, x+w0)
+	w0, w1 = fpWeakHash32(s[32:], z+w1, y+fpWord(s[16:]))
+	x, z = z, x
+	return fpHash16(fpHash16(v0, w0, mul)+fpShiftMix(y)*fpK0+z, fpHash16(v1, w1, mul)+x, mul)
+}
+
+// sipHash24 implements SipHash-2-4 keyed hash of TF strong string hashing,
+// e.g. tf.strings.to_hash_bucket_strong
+func sipHash24(k0, k1 uint64, s []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	n := len(s)
+	for ; len(s) >= 8; s = s[8:] {
+		m := fpWord(s)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	// last block keeps remaining bytes and length of the input
+	m := uint64(n) << 56
+	for i, c := range s {
+		m |= uint64(c) << (8 * uint(i))
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
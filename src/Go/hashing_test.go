@@ -0,0 +1,97 @@
+package main
+
+// tests of feature hashing, they do not require TF C library
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFingerprint64 checks fingerprint against reference FarmHash values
+func TestFingerprint64(t *testing.T) {
+	tests := []struct {
+		in   string
+		hash uint64
+	}{
+		{"", 0x9ae16a3b2f90404f},
+		{"a", 0xb3454265b6df75e3},
+		{"abcd", 0x1a5502de4a1f8101},
+		{"abcdefgh", 0xfee9d22990c82909},
+		{"0123456789^0123456789", 0xdebcba8e6f3eabd1},
+		{"Discard medicine more than two years old.", 0xe8f89ab6df9bdd25},
+		{"You remind me of a TV show, but that's all right: I watch it anyway.", 0xabcdb319fcf2826c},
+	}
+	for _, tt := range tests {
+		if h := fingerprint64([]byte(tt.in)); h != tt.hash {
+			t.Errorf("fingerprint64(%q)=%#x, expected %#x", tt.in, h, tt.hash)
+		}
+	}
+}
+
+// TestSipHash24 checks keyed hash against reference SipHash values
+func TestSipHash24(t *testing.T) {
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	if h := sipHash24(k0, k1, nil); h != 0x726fdb47dd0e0e31 {
+		t.Errorf("wrong hash of empty input %#x", h)
+	}
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if h := sipHash24(k0, k1, msg); h != 0xa129ca6149be45e5 {
+		t.Errorf("wrong hash %#x", h)
+	}
+}
+
+// TestFakeHashedFeatures checks predictions of rows with string features
+func TestFakeHashedFeatures(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	params.Hashing = []HashedFeature{
+		{Feature: "user", Buckets: 1000},
+		{Feature: "url", Buckets: 4, Seed: []uint64{1, 2}, OneHot: true},
+	}
+	writeModelFiles(t, "ads", []byte("ads"), params)
+
+	row := testRow("ads")
+	row.Categorical = map[string]string{"user": "abcd", "url": "a.com"}
+	r, err := hashRow("ads", row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Values) != testNumKeys+1+4 || len(r.Keys) != len(r.Values) {
+		t.Fatalf("wrong hashed row %v %v", r.Keys, r.Values)
+	}
+	if v := r.Values[testNumKeys]; v != float32(0x1a5502de4a1f8101%1000) {
+		t.Errorf("wrong bucket %v of user feature", v)
+	}
+	var ones int
+	for _, v := range r.Values[testNumKeys+1:] {
+		if v == 1 {
+			ones++
+		}
+	}
+	if ones != 1 || r.Keys[testNumKeys+1] != "url_0" {
+		t.Errorf("wrong one-hot url feature %v %v", r.Keys, r.Values)
+	}
+	probs, err := makePredictions(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	// undeclared and missing features are rejected
+	row.Categorical = map[string]string{"user": "abcd", "country": "ch"}
+	if _, err := makePredictions(row); err == nil || !strings.Contains(err.Error(), "country") {
+		t.Errorf("undeclared feature should be rejected, got %v", err)
+	}
+	row.Categorical = map[string]string{"user": "abcd"}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("missing feature should be rejected")
+	}
+	row = testRow("dnn")
+	row.Categorical = map[string]string{"user": "abcd"}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("model without hashed features should reject string features")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// hedge module provides adaptive timeouts and hedged requests of proxy mode
+//
+// The proxy tracks latencies (time to response headers) of recent requests
+// of every backend. Backend requests time out after three times p99 latency
+// of the backend (at least 100ms), bounded by "proxyMaxTimeout" seconds
+// (default 30) which is also used until the backend has enough samples.
+// With "proxyHedge": true option the request which is not answered by its
+// backend within p95 latency of the backend (or fails) is sent to the next
+// backend of its ranking as well, the first successful response is returned
+// to the client and the other request is canceled. This tames tail latency
+// of geographically spread deployments at the cost of few percents of extra
+// backend requests. Only payloads up to 4MB are hedged. Hedged requests, won
+// hedges and timeouts are reported by tfaas_proxy_* metrics.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// adaptive timeouts and hedging options
+const (
+	proxyLatencyWindow     = 256                    // number of tracked latencies of backend
+	proxyLatencySamples    = 20                     // min number of latencies to adapt timeouts and hedge
+	proxyMinTimeout        = 100 * time.Millisecond // min adaptive timeout of backend requests
+	defaultProxyMaxTimeout = 30                     // seconds
+	maxHedgeBody           = 4 * 1024 * 1024        // max size of hedged payloads
+)
+
+// proxyStartKey represents context key of start time of proxied request
+type proxyStartKey struct{}
+
+// counters of hedged requests and backend timeouts
+var (
+	_proxyHedged    uint64
+	_proxyHedgeWins uint64
+	_proxyTimeouts  uint64
+)
+
+// HTTP client of hedged requests, timeouts are set per request
+var proxyClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// observe records latency of backend response
+func (b *ProxyBackend) observe(latency time.Duration) {
+	_backendsLock.Lock()
+	defer _backendsLock.Unlock()
+	if len(b.latencies) < proxyLatencyWindow {
+		b.latencies = append(b.latencies, latency)
+		return
+	}
+	b.latencies[b.next] = latency
+	b.next = (b.next + 1) % proxyLatencyWindow
+}
+
+// quantile returns quantile of recent latencies of the backend, it returns
+// false if backend does not have enough samples
+func (b *ProxyBackend) quantile(q float64) (time.Duration, bool) {
+	_backendsLock.Lock()
+	latencies := append([]time.Duration{}, b.latencies...)
+	_backendsLock.Unlock()
+	if len(latencies) < proxyLatencySamples {
+		return 0, false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(q * float64(len(latencies)-1))
+	return latencies[idx], true
+}
+
+// helper function to return upper bound of backend timeouts
+func proxyMaxTimeout() time.Duration {
+	if _config.ProxyMaxTimeout > 0 {
+		return time.Duration(_config.ProxyMaxTimeout) * time.Second
+	}
+	return defaultProxyMaxTimeout * time.Second
+}
+
+// timeout returns adaptive timeout of backend requests
+func (b *ProxyBackend) timeout() time.Duration {
+	max := proxyMaxTimeout()
+	p99, ok := b.quantile(0.99)
+	if !ok {
+		return max
+	}
+	timeout := 3 * p99
+	if timeout < proxyMinTimeout {
+		timeout = proxyMinTimeout
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+// helper function to read payload of hedged request, it returns false and
+// restores request body if payload is too large to be hedged
+func hedgeBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil {
+		return nil, true
+	}
+	if r.ContentLength > maxHedgeBody {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHedgeBody+1))
+	if err != nil || len(data) > maxHedgeBody {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+		return nil, false
+	}
+	return data, true
+}
+
+// cancelBody cancels context of backend request when response is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes response body and cancels its request
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// proxyResult represents outcome of backend request
+type proxyResult struct {
+	backend *ProxyBackend
+	resp    *http.Response
+	err     error
+	latency time.Duration
+	hedge   bool
+}
+
+// helper function to send request to the backend
+func sendProxyRequest(ctx context.Context, b *ProxyBackend, r *http.Request, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout())
+	req, err := http.NewRequestWithContext(ctx, r.Method, b.URL+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Connection")
+	req.Header.Set("X-Forwarded-For", requestClientIP(r))
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddUint64(&_proxyTimeouts, 1)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// helper function to write backend response to the client
+func writeProxyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// hedgedForward sends request to the first backend and hedges it to the
+// second backend when the first one is slow or fails
+func hedgedForward(w http.ResponseWriter, r *http.Request, backends []*ProxyBackend, body []byte) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	results := make(chan proxyResult, 2)
+	send := func(b *ProxyBackend, hedge bool) {
+		go func() {
+			start := time.Now()
+			resp, err := sendProxyRequest(ctx, b, r, body)
+			results <- proxyResult{backend: b, resp: resp, err: err, latency: time.Since(start), hedge: hedge}
+		}()
+	}
+	send(backends[0], false)
+	pending, hedged := 1, false
+	var hedgeTimer <-chan time.Time
+	if delay, ok := backends[0].quantile(0.95); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+	hedge := func() {
+		hedged, hedgeTimer = true, nil
+		atomic.AddUint64(&_proxyHedged, 1)
+		send(backends[1], true)
+		pending++
+	}
+
+	var last proxyResult
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedge()
+		case res := <-results:
+			pending--
+			if res.err == nil && res.resp.StatusCode < 500 {
+				res.backend.observe(res.latency)
+				if res.hedge {
+					atomic.AddUint64(&_proxyHedgeWins, 1)
+				}
+				// release response of canceled request
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if res := <-results; res.resp != nil {
+							res.resp.Body.Close()
+						}
+					}
+				}(pending)
+				writeProxyResponse(w, res.resp)
+				return
+			}
+			if res.err != nil && ctx.Err() == nil {
+				markBackendDown(res.backend)
+			}
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			last = res
+			if !hedged {
+				// failed request is hedged right away
+				hedge()
+			}
+		}
+	}
+	if last.resp != nil {
+		// both backends failed, pass server error of the last one
+		writeProxyResponse(w, last.resp)
+		return
+	}
+	responseError(w, "proxy backend failure", last.err, http.StatusBadGateway)
+}
+
+// helper function to write metrics of proxy mode
+func writeProxyMetrics(w io.Writer) {
+	_backendsLock.Lock()
+	backends := append([]*ProxyBackend{}, _backends...)
+	_backendsLock.Unlock()
+	if len(backends) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP tfaas_proxy_backend_latency_p95_seconds p95 latency of recent requests of proxy backend\n")
+	fmt.Fprintf(w, "# TYPE tfaas_proxy_backend_latency_p95_seconds gauge\n")
+	for _, b := range backends {
+		if p95, ok := b.quantile(0.95); ok {
+			fmt.Fprintf(w, "tfaas_proxy_backend_latency_p95_seconds%s %v\n", metricLabels("backend", b.URL), p95.Seconds())
+		}
+	}
+	fmt.Fprintf(w, "# HELP tfaas_proxy_hedged_requests_total number of hedged requests of proxy mode\n")
+	fmt.Fprintf(w, "# TYPE tfaas_proxy_hedged_requests_total counter\n")
+	fmt.Fprintf(w, "tfaas_proxy_hedged_requests_total %d\n", atomic.LoadUint64(&_proxyHedged))
+	fmt.Fprintf(w, "# HELP tfaas_proxy_hedge_wins_total number of hedged requests answered before original ones\n")
+	fmt.Fprintf(w, "# TYPE tfaas_proxy_hedge_wins_total counter\n")
+	fmt.Fprintf(w, "tfaas_proxy_hedge_wins_total %d\n", atomic.LoadUint64(&_proxyHedgeWins))
+	fmt.Fprintf(w, "# HELP tfaas_proxy_timeouts_total number of timed out backend requests of proxy mode\n")
+	fmt.Fprintf(w, "# TYPE tfaas_proxy_timeouts_total counter\n")
+	fmt.Fprintf(w, "tfaas_proxy_timeouts_total %d\n", atomic.LoadUint64(&_proxyTimeouts))
+}
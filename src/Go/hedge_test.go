@@ -0,0 +1,111 @@
+package main
+
+// tests of hedged proxy requests, they do not require TF C library
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestProxyHedging checks hedged requests and adaptive timeouts of proxy mode
+func TestProxyHedging(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var delay int64 // delay of the primary backend in milliseconds
+	var status int64 = http.StatusOK
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Duration(atomic.LoadInt64(&delay)) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("secondary "), body...))
+	}))
+	defer secondary.Close()
+	if err := initProxy([]string{primary.URL, secondary.URL}); err != nil {
+		t.Fatal(err)
+	}
+	defer initProxy(nil)
+	_config.ProxyHedge = true
+	atomic.StoreUint64(&_proxyHedged, 0)
+	atomic.StoreUint64(&_proxyHedgeWins, 0)
+
+	// find routing key of the primary backend
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := strings.Repeat("k", i+1); rankBackends(k)[0].URL == primary.URL {
+			key = k
+		}
+	}
+	backend := rankBackends(key)[0]
+	handler := proxyMiddleware(http.NotFoundHandler())
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/json", strings.NewReader("payload"))
+		req.Header.Set(defaultRoutingKeyHeader, key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// requests are not hedged until backend has enough latencies
+	for i := 0; i < proxyLatencySamples; i++ {
+		if rr := send(); rr.Body.String() != "primary" {
+			t.Fatalf("wrong response %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	if n := atomic.LoadUint64(&_proxyHedged); n != 0 {
+		t.Fatalf("fast requests are hedged %d times", n)
+	}
+	if timeout := backend.timeout(); timeout != proxyMinTimeout {
+		t.Errorf("wrong adaptive timeout %v", timeout)
+	}
+
+	// slow request is hedged to the next backend
+	atomic.StoreInt64(&delay, 50)
+	start := time.Now()
+	if rr := send(); rr.Code != http.StatusOK || rr.Body.String() != "secondary payload" {
+		t.Fatalf("wrong hedged response %d %s", rr.Code, rr.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 45*time.Millisecond {
+		t.Errorf("hedged request takes %v", elapsed)
+	}
+	if atomic.LoadUint64(&_proxyHedged) != 1 || atomic.LoadUint64(&_proxyHedgeWins) != 1 {
+		t.Errorf("wrong hedge counters %d %d", _proxyHedged, _proxyHedgeWins)
+	}
+
+	// failed request is hedged right away
+	atomic.StoreInt64(&delay, 0)
+	atomic.StoreInt64(&status, http.StatusInternalServerError)
+	if rr := send(); rr.Code != http.StatusOK || rr.Body.String() != "secondary payload" {
+		t.Fatalf("wrong response of failed backend %d %s", rr.Code, rr.Body.String())
+	}
+
+	// requests without hedging time out after adaptive timeout
+	_config.ProxyHedge = false
+	atomic.StoreInt64(&status, http.StatusOK)
+	atomic.StoreInt64(&delay, 500)
+	timeouts := atomic.LoadUint64(&_proxyTimeouts)
+	if rr := send(); rr.Code != http.StatusBadGateway {
+		t.Errorf("wrong status %d of timed out request", rr.Code)
+	}
+	if atomic.LoadUint64(&_proxyTimeouts) != timeouts+1 {
+		t.Error("timeout is not counted")
+	}
+
+	var buf bytes.Buffer
+	writeProxyMetrics(&buf)
+	if !strings.Contains(buf.String(), "tfaas_proxy_hedge_wins_total 2") || !strings.Contains(buf.String(), "tfaas_proxy_backend_latency_p95_seconds") {
+		t.Errorf("wrong metrics %s", buf.String())
+	}
+}
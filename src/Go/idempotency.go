@@ -0,0 +1,191 @@
+package main
+
+// idempotency module provides idempotency keys of mutating requests
+//
+// Clients may send Idempotency-Key header with uploads, deletes, promotions
+// and other requests which modify model area. The outcome (status, content
+// type and body) of the first request with given key is kept for
+// "idempotencyTTL" seconds (default 24 hours) and retried requests with the
+// same key, method, path and client identity get the stored response with
+// Idempotent-Replayed: true header instead of being executed again, e.g.
+// flaky CI pipelines do not create duplicate versions or double-delete
+// models. Retries which reuse the key with different payload are rejected
+// with 422 status and requests arriving while the first one is still in
+// progress with 409 status. Server errors (5xx) are not stored, such requests
+// can be retried. Keys are kept in memory of the server replica.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// default time in seconds to keep outcomes of idempotent requests
+const defaultIdempotencyTTL = 24 * 3600
+
+// max length of idempotency keys
+const maxIdempotencyKey = 255
+
+// IdempotentResponse represents stored outcome of idempotent request
+type IdempotentResponse struct {
+	Fingerprint string    // sha256 of request payload
+	Status      int       // response status, 0 while request is in progress
+	ContentType string    // response content type
+	Body        []byte    // response body
+	Expires     time.Time // expiration time of the record
+}
+
+// global store of idempotent responses
+var (
+	_idempotency     = make(map[string]*IdempotentResponse)
+	_idempotencyLock sync.Mutex
+)
+
+// helper function to return lifetime of idempotent responses
+func idempotencyTTL() time.Duration {
+	if _config.IdempotencyTTL > 0 {
+		return time.Duration(_config.IdempotencyTTL) * time.Second
+	}
+	return defaultIdempotencyTTL * time.Second
+}
+
+// helper function to remove expired idempotent responses, it should be
+// called with acquired lock
+func purgeIdempotency(now time.Time) {
+	for key, rec := range _idempotency {
+		if rec.Status != 0 && now.After(rec.Expires) {
+			delete(_idempotency, key)
+		}
+	}
+}
+
+// idempotentResponseWriter records response of idempotent request
+type idempotentResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records response status
+func (w *idempotentResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records response body
+func (w *idempotentResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher interface
+func (w *idempotentResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// helper function to fingerprint request payload, the body is hashed while
+// handler reads it
+func fingerprintReader(r *http.Request) func() string {
+	h := sha256.New()
+	io.WriteString(h, r.Header.Get("Content-Type")+"\n"+r.URL.RawQuery+"\n")
+	if r.Body != nil {
+		// handlers may close the body before reading it completely, the
+		// original body is closed by HTTP server
+		r.Body = ioutil.NopCloser(io.TeeReader(r.Body, h))
+	}
+	return func() string {
+		// consume remaining body which handler did not read
+		if r.Body != nil {
+			io.Copy(ioutil.Discard, r.Body)
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// idempotent wraps mutating handler with support of idempotency keys
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == "GET" || r.Method == "HEAD" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			responseError(w, "idempotency key is too long", nil, http.StatusBadRequest)
+			return
+		}
+		id := requestIdentity(r)
+		scope := id.User + " " + r.Method + " " + r.URL.Path + " " + key
+		fingerprint := fingerprintReader(r)
+
+		now := time.Now()
+		_idempotencyLock.Lock()
+		purgeIdempotency(now)
+		rec, ok := _idempotency[scope]
+		if !ok {
+			rec = &IdempotentResponse{}
+			_idempotency[scope] = rec
+		}
+		stored := *rec
+		_idempotencyLock.Unlock()
+
+		if ok {
+			switch {
+			case stored.Status == 0:
+				responseError(w, "request with this idempotency key is in progress", nil, http.StatusConflict)
+			case stored.Fingerprint != fingerprint():
+				responseError(w, "idempotency key is reused with different request payload", nil, http.StatusUnprocessableEntity)
+			default:
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		iw := &idempotentResponseWriter{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				// panicked requests can be retried with the same key
+				_idempotencyLock.Lock()
+				delete(_idempotency, scope)
+				_idempotencyLock.Unlock()
+				panic(p)
+			}
+		}()
+		handler(iw, r)
+		status := iw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// remaining body is consumed without holding the lock
+		sum := fingerprint()
+		_idempotencyLock.Lock()
+		defer _idempotencyLock.Unlock()
+		if status >= 500 {
+			// failed requests can be retried with the same key
+			delete(_idempotency, scope)
+			return
+		}
+		rec.Fingerprint = sum
+		rec.Status = status
+		rec.ContentType = w.Header().Get("Content-Type")
+		rec.Body = iw.body.Bytes()
+		rec.Expires = time.Now().Add(idempotencyTTL())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+// tests of idempotency keys, they do not require TF C library
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// helper function to send request with idempotency key
+func idempotentRequest(router http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestIdempotency checks that retried requests with the same idempotency key
+// get outcome of the original request
+func TestIdempotency(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	_idempotency = make(map[string]*IdempotentResponse)
+
+	// retried deletion gets the original response instead of an error
+	w := idempotentRequest(router, "DELETE", "/delete/dnn", "ci-42", "")
+	if w.Code != http.StatusOK || modelExists("dnn") {
+		t.Fatalf("unexpected status %d of model deletion", w.Code)
+	}
+	body := w.Body.String()
+	w = idempotentRequest(router, "DELETE", "/delete/dnn", "ci-42", "")
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Errorf("unexpected retry status %d body %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retried response is not marked as replayed")
+	}
+	// the same key of another path is independent request
+	w = idempotentRequest(router, "DELETE", "/delete/img", "ci-42", "")
+	if w.Code != http.StatusOK || modelExists("img") || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("unexpected status %d of deletion with the same key", w.Code)
+	}
+
+	// key reused with different payload is rejected
+	w = idempotentRequest(router, "POST", "/admin/promote", "ci-43", `{"alias": "prod", "model": "dnn2"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d of promotion: %s", w.Code, w.Body.String())
+	}
+	w = idempotentRequest(router, "POST", "/admin/promote", "ci-43", `{"alias": "prod", "model": "dnn"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected status %d of reused key", w.Code)
+	}
+	w = idempotentRequest(router, "POST", "/admin/promote", "ci-43", `{"alias": "prod", "model": "dnn2"}`)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("unexpected status %d of retried promotion", w.Code)
+	}
+
+	// requests in progress are not executed twice
+	scope := anonymousUser + " DELETE /delete/dnn2 ci-44"
+	_idempotency[scope] = &IdempotentResponse{}
+	w = idempotentRequest(router, "DELETE", "/delete/dnn2", "ci-44", "")
+	if w.Code != http.StatusConflict || !modelExists("dnn2") {
+		t.Errorf("unexpected status %d of request in progress", w.Code)
+	}
+}
+
+// lockProbeReader records if idempotency lock is held while body is read
+type lockProbeReader struct {
+	locked bool
+	done   bool
+}
+
+// Read implements io.Reader interface
+func (r *lockProbeReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	r.done = true
+	if _idempotencyLock.TryLock() {
+		_idempotencyLock.Unlock()
+	} else {
+		r.locked = true
+	}
+	return copy(p, "payload"), nil
+}
+
+// TestIdempotencyFailures checks that unread bodies are consumed without
+// lock and that panicked requests can be retried
+func TestIdempotencyFailures(t *testing.T) {
+	_idempotency = make(map[string]*IdempotentResponse)
+	t.Cleanup(func() { _idempotency = make(map[string]*IdempotentResponse) })
+
+	// handler rejects request without reading its body
+	reject := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		responseError(w, "rejected", nil, http.StatusBadRequest)
+	})
+	body := &lockProbeReader{}
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Idempotency-Key", "upload-1")
+	reject(httptest.NewRecorder(), req)
+	if !body.done || body.locked {
+		t.Errorf("remaining body is consumed with lock %v, read %v", body.locked, body.done)
+	}
+
+	calls := 0
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failure")
+		}
+		w.Write([]byte("ok"))
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic of the handler is not propagated")
+			}
+		}()
+		req := httptest.NewRequest("POST", "/promote", nil)
+		req.Header.Set("Idempotency-Key", "promote-1")
+		handler(httptest.NewRecorder(), req)
+	}()
+	req = httptest.NewRequest("POST", "/promote", nil)
+	req.Header.Set("Idempotency-Key", "promote-1")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK || calls != 2 {
+		t.Errorf("retry of panicked request gets status %d after %d calls", w.Code, calls)
+	}
+}
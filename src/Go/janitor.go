@@ -0,0 +1,136 @@
+package main
+
+// janitor module provides garbage collection of old model versions
+//
+// The janitor runs periodically and removes model versions beyond
+// versionsLimit count or older than versionsMaxAge, the pinned versions
+// are never removed.
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default interval in seconds to run janitor
+const defaultJanitorInterval = 3600
+
+// JanitorReport represents report of the janitor run
+type JanitorReport struct {
+	Time           string   `json:"time"`           // time of janitor run
+	Removed        []string `json:"removed"`        // list of removed model versions
+	ReclaimedBytes int64    `json:"reclaimedBytes"` // reclaimed disk space
+	TotalRemoved   int      `json:"totalRemoved"`   // total number of removed versions since server start
+	TotalReclaimed int64    `json:"totalReclaimed"` // total reclaimed disk space since server start
+}
+
+// global janitor report and its lock
+var (
+	_janitorReport JanitorReport
+	janitorLock    sync.RWMutex
+)
+
+// helper function to return last janitor report
+func janitorReport() JanitorReport {
+	janitorLock.RLock()
+	defer janitorLock.RUnlock()
+	return _janitorReport
+}
+
+// helper function to calculate size of given directory
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// helper function to select model versions to be removed, versions are
+// sorted from oldest to newest one
+func expiredVersions(versions []ModelVersion, limit int, maxAge int64) []ModelVersion {
+	var unpinned []ModelVersion
+	for _, v := range versions {
+		if !v.Pinned {
+			unpinned = append(unpinned, v)
+		}
+	}
+	var out []ModelVersion
+	now := time.Now().Unix()
+	for i, v := range unpinned {
+		if i < len(unpinned)-limit {
+			out = append(out, v)
+		} else if maxAge > 0 && now-v.Time > maxAge {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// helper function to remove old versions of all models
+func pruneVersions() JanitorReport {
+	report := JanitorReport{Time: time.Now().String()}
+	vdir := filepath.Join(_config.ModelDir, ".versions")
+	files, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("janitor: unable to read", vdir, err)
+		}
+		return report
+	}
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		versions, err := modelVersions(f.Name())
+		if err != nil {
+			log.Println("janitor: unable to read model versions", f.Name(), err)
+			continue
+		}
+		for _, v := range expiredVersions(versions, versionsLimit(), int64(_config.VersionsMaxAge)) {
+			if err := os.RemoveAll(v.Path); err != nil {
+				log.Println("janitor: unable to remove", v.Path, err)
+				continue
+			}
+			report.Removed = append(report.Removed, v.Model+"/"+v.Version)
+			report.ReclaimedBytes += v.Size
+		}
+	}
+	return report
+}
+
+// janitor periodically removes old model versions
+func janitor(interval int) {
+	if interval <= 0 {
+		interval = defaultJanitorInterval
+	}
+	for {
+		// model area is shared by replicas, it is cleaned up by the leader
+		if !isLeader() {
+			time.Sleep(time.Duration(interval) * time.Second)
+			continue
+		}
+		report := pruneVersions()
+		janitorLock.Lock()
+		report.TotalRemoved = _janitorReport.TotalRemoved + len(report.Removed)
+		report.TotalReclaimed = _janitorReport.TotalReclaimed + report.ReclaimedBytes
+		_janitorReport = report
+		janitorLock.Unlock()
+		if len(report.Removed) > 0 {
+			log.Printf("janitor: removed %d model versions %v, reclaimed %d bytes", len(report.Removed), report.Removed, report.ReclaimedBytes)
+		}
+		if expired := expireUploadSessions(); len(expired) > 0 {
+			log.Println("janitor: removed abandoned upload sessions", expired)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// tests of janitor of model versions, they do not require TF C library
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// helper function to create version of the model archived given time ago
+func writeModelVersion(t *testing.T, model, version string, age time.Duration) {
+	path := filepath.Join(versionsDir(model), version)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "model.pb"), []byte(version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	os.Chtimes(path, mtime, mtime)
+}
+
+// TestPruneVersions checks that janitor keeps versionsLimit newest versions
+// of every model and removes expired versions except pinned ones
+func TestPruneVersions(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	if report := pruneVersions(); len(report.Removed) != 0 {
+		t.Fatalf("versions are removed from empty versions area %+v", report)
+	}
+	_config.VersionsLimit = 2
+	for i := 1; i <= 4; i++ {
+		writeModelVersion(t, "dnn", fmt.Sprintf("2024010100000%d", i), time.Minute)
+	}
+	writeModelVersion(t, "dnn2", "20240101000001", 48*time.Hour)
+	writeModelVersion(t, "dnn2", "20240101000002", time.Minute)
+	if err := pinVersion("dnn", "20240101000001", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the oldest unpinned version of dnn is beyond the limit
+	report := pruneVersions()
+	if len(report.Removed) != 1 || report.Removed[0] != "dnn/20240101000002" || report.ReclaimedBytes != 14 {
+		t.Fatalf("wrong janitor report %+v", report)
+	}
+	versions, _ := modelVersions("dnn")
+	if len(versions) != 3 || !versions[0].Pinned || versions[1].Version != "20240101000003" {
+		t.Fatalf("wrong versions of model %+v", versions)
+	}
+
+	// versions older than max age are removed within the limit as well
+	_config.VersionsMaxAge = 3600
+	report = pruneVersions()
+	if len(report.Removed) != 1 || report.Removed[0] != "dnn2/20240101000001" {
+		t.Fatalf("wrong janitor report %+v", report)
+	}
+	if versions, _ := modelVersions("dnn2"); len(versions) != 1 || versions[0].Version != "20240101000002" {
+		t.Fatalf("wrong versions of model %+v", versions)
+	}
+	if report := pruneVersions(); len(report.Removed) != 0 {
+		t.Fatalf("versions are removed twice %+v", report)
+	}
+}
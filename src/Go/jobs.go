@@ -0,0 +1,796 @@
+package main
+
+// jobs module provides asynchronous batch scoring of large datasets
+//
+// Large datasets are submitted as jobs instead of being scored within HTTP
+// request, e.g.
+// POST /jobs?model=dnn (body: JSON batch, CSV with header or Arrow stream)
+// returns job ID, the job status and progress are available via
+// GET /jobs/{id}, and once job is done its results are downloaded as CSV via
+// GET /jobs/{id}/results. Datasets are read from the job file chunk by chunk
+// and results are written as chunks are scored, therefore jobs do not keep
+// whole dataset in memory. The number of concurrently running jobs is
+// limited by maxJobs configuration, and finished jobs (with their files) are
+// removed after jobRetention seconds.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// default jobs options
+const (
+	defaultMaxJobs      = 2
+	defaultJobRetention = 86400
+	jobChunkSize        = 1000 // number of rows scored at once
+)
+
+// job states
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// Job represents asynchronous batch scoring job
+type Job struct {
+	ID        string `json:"id"`        // job identifier
+	Model     string `json:"model"`     // model name
+	Status    string `json:"status"`    // job status
+	Rows      int64  `json:"rows"`      // number of dataset rows
+	Processed int64  `json:"processed"` // number of scored rows
+	Progress  string `json:"progress"`  // progress of the job in percents
+	Error     string `json:"error"`     // error of failed job
+	Submitted int64  `json:"submitted"` // job submission time
+	Started   int64  `json:"started"`   // job start time
+	Finished  int64  `json:"finished"`  // job finish time
+
+	ctype   string             // content type of the dataset
+	query   map[string]string  // dataset options, e.g. shape or columns
+	input   string             // dataset file
+	output  string             // results file
+	client  string             // client of the job for usage analytics
+	cancel  context.CancelFunc // cancel function of the job
+	context context.Context    // job context
+}
+
+// JobManager keeps track of jobs and limits number of running jobs
+type JobManager struct {
+	Jobs  map[string]*Job
+	slots chan struct{}
+	mutex sync.RWMutex
+}
+
+// jobRecord represents job record of state store
+type jobRecord struct {
+	Job
+	Input  string `json:"input"`  // dataset file
+	Output string `json:"output"` // results file
+	Host   string `json:"host"`   // host name of the server which runs the job
+}
+
+// global job manager
+var _jobs = JobManager{Jobs: make(map[string]*Job)}
+
+// helper function to return location of jobs area
+func jobsDir() string {
+	if _config.JobsDir != "" {
+		return _config.JobsDir
+	}
+	return filepath.Join(os.TempDir(), "tfaas-jobs")
+}
+
+// helper function to return number of concurrent jobs
+func maxJobs() int {
+	if _config.MaxJobs > 0 {
+		return _config.MaxJobs
+	}
+	// do not run more jobs than available CPUs
+	if cpus := availableCPUs(); cpus < defaultMaxJobs {
+		return cpus
+	}
+	return defaultMaxJobs
+}
+
+// helper function to return job retention time
+func jobRetention() time.Duration {
+	if _config.JobRetention > 0 {
+		return time.Duration(_config.JobRetention) * time.Second
+	}
+	return defaultJobRetention * time.Second
+}
+
+// helper function to generate new job identifier
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// helper function to return snapshot of the job
+func (m *JobManager) get(id string) (Job, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	job, ok := m.Jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	out := *job
+	if out.Rows > 0 {
+		out.Progress = fmt.Sprintf("%.1f", 100*float64(out.Processed)/float64(out.Rows))
+	}
+	return out, true
+}
+
+// helper function to list all jobs
+func (m *JobManager) list() []Job {
+	m.mutex.RLock()
+	var ids []string
+	for id := range m.Jobs {
+		ids = append(ids, id)
+	}
+	m.mutex.RUnlock()
+	var out []Job
+	for _, id := range ids {
+		if job, ok := m.get(id); ok {
+			out = append(out, job)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Submitted < out[j].Submitted })
+	return out
+}
+
+// helper function to update job under lock
+func (m *JobManager) update(id string, f func(job *Job)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if job, ok := m.Jobs[id]; ok {
+		f(job)
+	}
+}
+
+// helper function to submit new job
+func (m *JobManager) submit(job *Job) {
+	m.mutex.Lock()
+	if m.slots == nil {
+		m.slots = make(chan struct{}, maxJobs())
+	}
+	job.context, job.cancel = context.WithCancel(context.Background())
+	job.Status = JobQueued
+	job.Submitted = time.Now().Unix()
+	m.Jobs[job.ID] = job
+	m.mutex.Unlock()
+	m.persist(job.ID)
+	go m.run(job)
+}
+
+// helper function to run the job once there is a free slot
+func (m *JobManager) run(job *Job) {
+	select {
+	case m.slots <- struct{}{}:
+	case <-job.context.Done():
+		m.finish(job.ID, job.context.Err())
+		return
+	}
+	defer func() { <-m.slots }()
+	m.update(job.ID, func(j *Job) {
+		j.Status = JobRunning
+		j.Started = time.Now().Unix()
+	})
+	m.persist(job.ID)
+	m.finish(job.ID, runJob(job))
+}
+
+// helper function to score the job, panic of the job fails the job instead
+// of the whole server
+func runJob(job *Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("job %s model %s panic: %v\n%s", job.ID, job.Model, p, debug.Stack())
+			err = fmt.Errorf("job failure: %v", p)
+		}
+	}()
+	return scoreJob(job)
+}
+
+// helper function to set final status of the job
+func (m *JobManager) finish(id string, err error) {
+	m.update(id, func(j *Job) {
+		j.Finished = time.Now().Unix()
+		switch {
+		case err == nil:
+			j.Status = JobDone
+		case errors.Is(err, context.Canceled):
+			j.Status = JobCanceled
+		default:
+			j.Status = JobFailed
+			j.Error = err.Error()
+		}
+		log.Printf("job %s model %s is %s", j.ID, j.Model, j.Status)
+	})
+	m.persist(id)
+}
+
+// helper function to remove the job and its files
+func (m *JobManager) remove(id string) bool {
+	m.mutex.Lock()
+	job, ok := m.Jobs[id]
+	if ok {
+		delete(m.Jobs, id)
+	}
+	m.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	job.cancel()
+	os.Remove(job.input)
+	os.Remove(job.output)
+	if _stateStore != nil {
+		err := _stateStore.Update(func(tx StateTx) error {
+			return tx.Delete(jobsBucket, id)
+		})
+		if err != nil {
+			log.Printf("unable to remove record of job %s: %v", id, err)
+		}
+	}
+	return true
+}
+
+// helper function to write job record to state store
+func (m *JobManager) persist(id string) {
+	if _stateStore == nil {
+		return
+	}
+	m.mutex.RLock()
+	job, ok := m.Jobs[id]
+	var rec jobRecord
+	if ok {
+		rec = jobRecord{Job: *job, Input: job.input, Output: job.output}
+		rec.Host, _ = os.Hostname()
+	}
+	m.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = _stateStore.Update(func(tx StateTx) error {
+			return tx.Put(jobsBucket, id, data)
+		})
+	}
+	if err != nil {
+		log.Printf("unable to write record of job %s: %v", id, err)
+	}
+}
+
+// load restores jobs of state store, jobs interrupted by restart of the
+// server are marked as failed
+func (m *JobManager) load() error {
+	if _stateStore == nil {
+		return nil
+	}
+	records, err := _stateStore.List(jobsBucket)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	var interrupted []string
+	m.mutex.Lock()
+	for id, data := range records {
+		var rec jobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("unable to read record of job %s: %v", id, err)
+			continue
+		}
+		if sharedStateStore() && rec.Host != host {
+			// job of other replica
+			continue
+		}
+		job := rec.Job
+		job.input, job.output = rec.Input, rec.Output
+		job.context, job.cancel = context.WithCancel(context.Background())
+		if job.Status == JobQueued || job.Status == JobRunning {
+			job.Status = JobFailed
+			job.Error = "job is interrupted by server restart"
+			job.Finished = time.Now().Unix()
+			os.Remove(job.input)
+			os.Remove(job.output)
+			interrupted = append(interrupted, id)
+		}
+		m.Jobs[id] = &job
+	}
+	m.mutex.Unlock()
+	for _, id := range interrupted {
+		m.persist(id)
+	}
+	return nil
+}
+
+// helper function to remove finished jobs older than retention time
+func (m *JobManager) expire(retention time.Duration) []string {
+	var expired []string
+	cutoff := time.Now().Add(-retention).Unix()
+	for _, job := range m.list() {
+		if job.Finished > 0 && job.Finished < cutoff {
+			if m.remove(job.ID) {
+				expired = append(expired, job.ID)
+			}
+		}
+	}
+	return expired
+}
+
+// helper function to clean up jobs area, jobs are not preserved across
+// server restarts unless they are kept in state store
+func cleanJobs() {
+	if _stateStore == nil {
+		if err := os.RemoveAll(jobsDir()); err != nil {
+			log.Println("unable to clean up jobs area", err)
+		}
+		return
+	}
+	files := make(map[string]bool)
+	_jobs.mutex.RLock()
+	for _, job := range _jobs.Jobs {
+		files[job.input] = true
+		files[job.output] = true
+	}
+	_jobs.mutex.RUnlock()
+	entries, _ := os.ReadDir(jobsDir())
+	for _, entry := range entries {
+		path := filepath.Join(jobsDir(), entry.Name())
+		if !files[path] {
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// jobsJanitor periodically removes expired jobs
+func jobsJanitor() {
+	for {
+		time.Sleep(time.Minute)
+		if expired := _jobs.expire(jobRetention()); len(expired) > 0 {
+			log.Println("remove expired jobs", expired)
+		}
+	}
+}
+
+// jobDataset reads rows of job dataset in chunks
+type jobDataset struct {
+	keys  []string                  // feature names
+	shape []int64                   // shape of dataset rows, e.g. [ncols]
+	next  func() ([]float32, error) // reads flat values of next rows, io.EOF at the end of dataset
+}
+
+// helper function to read CSV dataset with header of column names
+func readCSVDataset(r io.Reader) (*jobDataset, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	keys := append([]string{}, header...)
+	line := 1
+	next := func() ([]float32, error) {
+		values := make([]float32, 0, jobChunkSize*len(keys))
+		for i := 0; i < jobChunkSize; i++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			line++
+			for _, v := range record {
+				f, err := strconv.ParseFloat(strings.TrimSpace(v), 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+				values = append(values, float32(f))
+			}
+		}
+		if len(values) == 0 {
+			return nil, io.EOF
+		}
+		return values, nil
+	}
+	return &jobDataset{keys: keys, shape: []int64{int64(len(keys))}, next: next}, nil
+}
+
+// helper function to read Arrow dataset record batch by record batch
+func readArrowDataset(r io.Reader, columns string) (*jobDataset, error) {
+	reader, err := newArrowReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if columns != "" {
+		names = strings.Split(columns, ",")
+	}
+	schema := &ArrowTable{Columns: reader.columns}
+	idx, keys, err := schema.selectColumns(names)
+	if err != nil {
+		return nil, err
+	}
+	next := func() ([]float32, error) {
+		table, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		return table.rowValues(idx), nil
+	}
+	return &jobDataset{keys: keys, shape: []int64{int64(len(keys))}, next: next}, nil
+}
+
+// helper function to skip JSON value, it returns number of elements of
+// skipped array
+func skipJSONValue(dec *json.Decoder) (int64, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if tok != json.Delim('[') && tok != json.Delim('{') {
+		return 0, nil
+	}
+	var n int64
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		if depth == 1 && tok != json.Delim(']') && tok != json.Delim('}') {
+			n++
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+	}
+	return n, nil
+}
+
+// helper function to position JSON decoder at the value of given key of
+// top level object, the values of other keys are passed to given function
+// (empty key walks through the whole object)
+func seekJSONKey(dec *json.Decoder, key string, other func(key string) error) (bool, error) {
+	if tok, err := dec.Token(); err != nil {
+		return false, err
+	} else if tok != json.Delim('{') {
+		return false, errors.New("JSON dataset should be an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		name, _ := tok.(string)
+		if key != "" && strings.EqualFold(name, key) {
+			return true, nil
+		}
+		if err := other(name); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// helper function to read JSON batch dataset, the batch attributes are read
+// first and then its values are streamed from the file
+func readJSONDataset(file *os.File) (*jobDataset, error) {
+	// read batch attributes and count values, sparse batches are read as
+	// whole since their size is limited by densify
+	var batch BatchRow
+	var nvalues, nindices int64
+	dec := json.NewDecoder(file)
+	_, err := seekJSONKey(dec, "", func(key string) error {
+		var err error
+		switch strings.ToLower(key) {
+		case "values":
+			nvalues, err = skipJSONValue(dec)
+		case "indices":
+			nindices, err = skipJSONValue(dec)
+		case "keys":
+			err = dec.Decode(&batch.Keys)
+		case "shape":
+			err = dec.Decode(&batch.Shape)
+		default:
+			_, err = skipJSONValue(dec)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	shape := batch.Shape
+	if len(shape) == 0 && len(batch.Keys) > 0 {
+		shape = []int64{nvalues / int64(len(batch.Keys)), int64(len(batch.Keys))}
+	}
+	size, err := shapeSize(shape)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	chunk := jobChunkSize * (size / shape[0])
+	if nindices > 0 {
+		if nindices > maxDenseSize {
+			return nil, fmt.Errorf("number of indices %d exceeds %d", nindices, maxDenseSize)
+		}
+		if err := json.NewDecoder(file).Decode(&batch); err != nil {
+			return nil, err
+		}
+		values, err := densify(batch.Indices, batch.Values, size)
+		if err != nil {
+			return nil, err
+		}
+		next := func() ([]float32, error) {
+			if len(values) == 0 {
+				return nil, io.EOF
+			}
+			n := chunk
+			if n > int64(len(values)) {
+				n = int64(len(values))
+			}
+			out := values[:n]
+			values = values[n:]
+			return out, nil
+		}
+		return &jobDataset{keys: batch.Keys, shape: shape[1:], next: next}, nil
+	}
+	if nvalues != size {
+		return nil, fmt.Errorf("number of values %d does not match shape %v", nvalues, shape)
+	}
+	dec = json.NewDecoder(file)
+	if _, err := seekJSONKey(dec, "values", func(string) error {
+		_, err := skipJSONValue(dec)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("values of JSON dataset should be an array")
+	}
+	next := func() ([]float32, error) {
+		values := make([]float32, 0, chunk)
+		for int64(len(values)) < chunk && dec.More() {
+			var v float32
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 {
+			return nil, io.EOF
+		}
+		return values, nil
+	}
+	return &jobDataset{keys: batch.Keys, shape: shape[1:], next: next}, nil
+}
+
+// helper function to open job dataset
+func openJobDataset(job *Job, file *os.File) (*jobDataset, error) {
+	switch {
+	case strings.HasPrefix(job.ctype, arrowStreamType) || strings.HasPrefix(job.ctype, arrowFileType):
+		return readArrowDataset(file, job.query["columns"])
+	case strings.HasPrefix(job.ctype, "text/csv"):
+		return readCSVDataset(file)
+	}
+	return readJSONDataset(file)
+}
+
+// helper function to read job dataset chunk by chunk, the given function is
+// called with number of rows and flat values of every chunk
+func readJobDataset(job *Job, f func(keys []string, shape []int64, values []float32) error) error {
+	file, err := os.Open(job.input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dataset, err := openJobDataset(job, file)
+	if err != nil {
+		return err
+	}
+	rowSize := int64(1)
+	if len(dataset.shape) > 0 {
+		if rowSize, err = shapeSize(dataset.shape); err != nil {
+			return err
+		}
+	}
+	for {
+		if err := job.context.Err(); err != nil {
+			return err
+		}
+		values, err := dataset.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if int64(len(values))%rowSize != 0 {
+			return fmt.Errorf("number of values %d does not match row shape %v", len(values), dataset.shape)
+		}
+		shape := append([]int64{int64(len(values)) / rowSize}, dataset.shape...)
+		if err := f(dataset.keys, shape, values); err != nil {
+			return err
+		}
+	}
+}
+
+// helper function to score job dataset in chunks, the dataset is validated
+// and its rows are counted before scoring, and results are written as
+// chunks are scored
+func scoreJob(job *Job) error {
+	var nrows int64
+	err := readJobDataset(job, func(keys []string, shape []int64, values []float32) error {
+		nrows += shape[0]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_jobs.update(job.ID, func(j *Job) { j.Rows = nrows })
+	observeUsage(job.client, job.Model, int(nrows))
+	file, err := os.Create(job.output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	var processed int64
+	ncols := -1
+	err = readJobDataset(job, func(keys []string, shape []int64, values []float32) error {
+		rowSize := int64(len(values)) / shape[0]
+		for start := int64(0); start < shape[0]; start += jobChunkSize {
+			if err := job.context.Err(); err != nil {
+				return err
+			}
+			end := start + jobChunkSize
+			if end > shape[0] {
+				end = shape[0]
+			}
+			chunkShape := append([]int64{end - start}, shape[1:]...)
+			tensor, err := makeFlatTensor(values[start*rowSize:end*rowSize], chunkShape)
+			if err != nil {
+				return err
+			}
+			probs, err := makeBatchPredictions(job.Model, keys, tensor)
+			if err != nil {
+				publish(EventPredictionFailed, job.Model, err.Error())
+				return err
+			}
+			if ncols < 0 && len(probs) > 0 {
+				ncols = len(probs[0])
+				if err := writeOutputsHeader(writer, ncols); err != nil {
+					return err
+				}
+			}
+			if err := writeOutputsRecords(writer, probs, ncols, processed); err != nil {
+				return err
+			}
+			processed += end - start
+			_jobs.update(job.ID, func(j *Job) { j.Processed = processed })
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ncols < 0 {
+		writeOutputsHeader(writer, 0)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// JobSubmitHandler submits new scoring job
+func JobSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	model := r.URL.Query().Get("model")
+	if model == "" {
+		model = _params.Name
+	}
+	if model == "" {
+		responseError(w, "model should be provided", nil, http.StatusBadRequest)
+		return
+	}
+	if err := os.MkdirAll(jobsDir(), 0755); err != nil {
+		responseError(w, "unable to create jobs area", err, http.StatusInternalServerError)
+		return
+	}
+	job := &Job{ID: newJobID(), Model: model, ctype: r.Header.Get("Content-Type"), query: make(map[string]string), client: usageClient(r)}
+	for key := range r.URL.Query() {
+		job.query[key] = r.URL.Query().Get(key)
+	}
+	job.input = filepath.Join(jobsDir(), job.ID+".input")
+	job.output = filepath.Join(jobsDir(), job.ID+".csv")
+	file, err := os.Create(job.input)
+	if err != nil {
+		responseError(w, "unable to store dataset", err, http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(file, r.Body)
+	file.Close()
+	if err != nil {
+		os.Remove(job.input)
+		responseError(w, "unable to store dataset", err, http.StatusBadRequest)
+		return
+	}
+	_jobs.submit(job)
+	log.Printf("submit job %s model %s", job.ID, model)
+	snapshot, _ := _jobs.get(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// JobsHandler provides list of jobs
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, _jobs.list())
+}
+
+// JobHandler provides status of the job, or cancels and removes it
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if r.Method == "DELETE" {
+		if !_jobs.remove(id) {
+			responseError(w, fmt.Sprintf("job %s is not found", id), nil, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	job, ok := _jobs.get(id)
+	if !ok {
+		responseError(w, fmt.Sprintf("job %s is not found", id), nil, http.StatusNotFound)
+		return
+	}
+	responseJSON(w, job)
+}
+
+// JobResultsHandler provides results of finished job
+func JobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok := _jobs.get(id)
+	if !ok {
+		responseError(w, fmt.Sprintf("job %s is not found", id), nil, http.StatusNotFound)
+		return
+	}
+	if job.Status != JobDone {
+		msg := fmt.Sprintf("job %s is %s", id, job.Status)
+		responseError(w, msg, nil, http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", id))
+	http.ServeFile(w, r, job.output)
+}
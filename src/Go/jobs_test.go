@@ -0,0 +1,158 @@
+package main
+
+// tests of asynchronous scoring jobs, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to submit job with given dataset
+func submitTestJob(t *testing.T, ctype string, data []byte) Job {
+	req := httptest.NewRequest("POST", "/jobs?model=dnn", bytes.NewReader(data))
+	req.Header.Set("Content-Type", ctype)
+	w := httptest.NewRecorder()
+	JobSubmitHandler(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var job Job
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// helper function to wait until job is finished
+func waitTestJob(t *testing.T, id string) Job {
+	for i := 0; i < 500; i++ {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		JobHandler(w, req)
+		var job Job
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		if job.Finished > 0 {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not finished", id)
+	return Job{}
+}
+
+// TestJobs checks submission, progress and results of scoring jobs
+func TestJobs(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.JobsDir = t.TempDir()
+
+	// JSON batch which is scored in several chunks
+	nrows := 2*jobChunkSize + 10
+	batch := BatchRow{Model: "dnn", Shape: []int64{int64(nrows), testNumKeys}}
+	for i := 0; i < nrows; i++ {
+		batch.Values = append(batch.Values, testRow("dnn").Values...)
+	}
+	data, _ := json.Marshal(batch)
+	job := waitTestJob(t, submitTestJob(t, "application/json", data).ID)
+	if job.Status != JobDone || job.Rows != int64(nrows) || job.Processed != int64(nrows) || job.Progress != "100.0" {
+		t.Fatalf("wrong job status %+v", job)
+	}
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+job.ID+"/results", nil), map[string]string{"id": job.ID})
+	w := httptest.NewRecorder()
+	JobResultsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nrows+1 || len(records[0]) != len(testOutputs)+1 {
+		t.Fatalf("wrong number of results %d", len(records))
+	}
+	if records[nrows][0] != strconv.Itoa(nrows-1) {
+		t.Fatalf("wrong event number %s of last result", records[nrows][0])
+	}
+
+	// CSV dataset with invalid value fails
+	csvData := "a,b,c,d\n1,2,3,4\n5,6,x,8\n"
+	job = waitTestJob(t, submitTestJob(t, "text/csv", []byte(csvData)).ID)
+	if job.Status != JobFailed || !strings.Contains(job.Error, "line 3") {
+		t.Fatalf("wrong status of failed job %+v", job)
+	}
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+job.ID+"/results", nil), map[string]string{"id": job.ID})
+	w = httptest.NewRecorder()
+	JobResultsHandler(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wrong status code %d for results of failed job", w.Code)
+	}
+
+	// finished jobs expire
+	if len(_jobs.list()) < 2 {
+		t.Fatalf("wrong list of jobs %+v", _jobs.list())
+	}
+	_jobs.expire(-time.Minute)
+	if jobs := _jobs.list(); len(jobs) != 0 {
+		t.Fatalf("finished jobs should expire %+v", jobs)
+	}
+}
+
+// TestJobDatasets checks scoring of datasets of different formats, and that
+// malformed datasets fail their jobs without breaking the server
+func TestJobDatasets(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_config.JobsDir = t.TempDir()
+	tests := []struct {
+		name  string
+		ctype string
+		data  []byte
+		rows  int64
+		input []float32 // model input of the last chunk
+	}{
+		{"keys", "application/json", []byte(`{"keys":["a","b","c","d"],"values":[1,2,3,4,5,6,7,8]}`), 2, []float32{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"sparse", "application/json", []byte(`{"indices":[1,6],"values":[1,2],"shape":[2,4]}`), 2, []float32{0, 1, 0, 0, 0, 0, 2, 0}},
+		{"arrow", arrowStreamType, writeTestArrowStream(t, 3), 3, []float32{0.5, 0, 0, 1.5, -1, 2, 2.5, -2, 4}},
+	}
+	for _, test := range tests {
+		job := waitTestJob(t, submitTestJob(t, test.ctype, test.data).ID)
+		if job.Status != JobDone || job.Rows != test.rows || job.Processed != test.rows {
+			t.Fatalf("%s: wrong job status %+v", test.name, job)
+		}
+		if input := flatValues(fake.Feeds()["input"]); !reflect.DeepEqual(input, test.input) {
+			t.Fatalf("%s: wrong model input %v", test.name, input)
+		}
+	}
+
+	for name, data := range map[string]string{
+		"overflow": `{"shape":[4294967296,4294967296],"values":[]}`,
+		"values":   `{"shape":[2,4],"values":[1,2,3]}`,
+		"type":     `{"shape":[2],"values":[1,"x"]}`,
+		"array":    `{"shape":[1],"values":{"a":1}}`,
+		"object":   `[1,2,3]`,
+	} {
+		job := waitTestJob(t, submitTestJob(t, "application/json", []byte(data)).ID)
+		if job.Status != JobFailed || job.Error == "" {
+			t.Fatalf("%s: wrong status of malformed dataset %+v", name, job)
+		}
+	}
+
+	// panic of the job (here job without context) fails the job
+	job := &Job{ID: "panic", Model: "dnn", input: filepath.Join(_config.JobsDir, "panic.input")}
+	ioutil.WriteFile(job.input, []byte(`{"shape":[1,4],"values":[1,2,3,4]}`), 0644)
+	if err := runJob(job); err == nil || !strings.Contains(err.Error(), "job failure") {
+		t.Fatalf("panic of the job is not reported: %v", err)
+	}
+}
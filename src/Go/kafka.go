@@ -0,0 +1,60 @@
+package main
+
+// kafka module provides Kafka integration via Kafka REST proxy
+// see https://docs.confluent.io/platform/current/kafka-rest/api.html
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kafka REST proxy content type for JSON records
+const kafkaJSONContentType = "application/vnd.kafka.json.v2+json"
+
+// Kafka REST proxy HTTP client
+var kafkaClient = &http.Client{Timeout: 10 * time.Second}
+
+// KafkaRecord represents Kafka record sent via REST proxy
+type KafkaRecord struct {
+	Key   string      `json:"key,omitempty"` // record key
+	Value interface{} `json:"value"`         // record value
+}
+
+// helper function to produce records to Kafka topic via REST proxy
+func kafkaProduce(rurl, topic string, records []KafkaRecord) error {
+	data, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	api := fmt.Sprintf("%s/topics/%s", strings.TrimRight(rurl, "/"), topic)
+	req, err := http.NewRequest("POST", api, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaJSONContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := kafkaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka REST proxy %s responded with status %s", api, resp.Status)
+	}
+	return nil
+}
+
+// KafkaSink publishes events to Kafka topic
+type KafkaSink struct {
+	URL   string // Kafka REST proxy URL
+	Topic string // Kafka topic
+}
+
+// Publish implements EventSink interface
+func (s *KafkaSink) Publish(evt Event) error {
+	return kafkaProduce(s.URL, s.Topic, []KafkaRecord{{Key: evt.Model, Value: evt}})
+}
@@ -0,0 +1,490 @@
+package main
+
+// ldap module provides LDAP (e.g. CERN e-groups) based authorization
+//
+// Authenticated users are resolved to their groups via minimal LDAP v3
+// client, e.g.
+//
+//	"policy": {
+//	    "ldap": {"url": "ldaps://xldap.cern.ch:636",
+//	             "baseDN": "OU=Users,OU=Organic Units,DC=cern,DC=ch",
+//	             "filter": "(cn={login})", "attribute": "memberOf"},
+//	    "roles": [{"group": "cms-higgs-admins", "roles": ["admin"], "namespaces": ["higgs"]},
+//	              {"group": "cms-members", "roles": ["predict"]}]
+//	}
+//
+// The filter may use {user} (certificate subject) and {login} (first CN of
+// certificate subject) placeholders, values of the attribute which are DNs
+// are reduced to their first CN, e.g. CN=cms-members,OU=e-groups,... gives
+// cms-members group. Resolved groups are cached for "cacheTTL" seconds
+// (default 300) and are available to policy rules too. Roles map groups to
+// actions per namespace: predict allows read and predict, upload allows
+// read, write and delete, admin allows all actions. Bind password can be
+// provided via LDAP_BIND_PASSWORD environment variable.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default time in seconds to cache LDAP groups of the user
+const defaultLDAPCacheTTL = 300
+
+// LDAPConfig represents configuration of LDAP group resolution
+type LDAPConfig struct {
+	URL          string `json:"url"`          // LDAP server URL, e.g. ldaps://host:636
+	BindDN       string `json:"bindDN"`       // bind DN, anonymous bind if empty
+	BindPassword string `json:"bindPassword"` // bind password, default LDAP_BIND_PASSWORD
+	BaseDN       string `json:"baseDN"`       // search base DN
+	Filter       string `json:"filter"`       // search filter with {user} and {login} placeholders
+	Attribute    string `json:"attribute"`    // attribute with user groups, e.g. memberOf
+	CacheTTL     int    `json:"cacheTTL"`     // time in seconds to cache user groups
+}
+
+// RoleBinding maps group to roles in namespaces
+type RoleBinding struct {
+	Group      string   `json:"group"`      // group pattern
+	Roles      []string `json:"roles"`      // roles: predict, upload or admin
+	Namespaces []string `json:"namespaces"` // namespace patterns, empty list means all namespaces
+}
+
+// actions allowed by roles
+var roleActions = map[string][]string{
+	"predict": {actionRead, actionPredict},
+	"upload":  {actionRead, actionWrite, actionDelete},
+	"admin":   {actionRead, actionPredict, actionWrite, actionDelete, actionAdmin},
+}
+
+// helper function to check if role bindings allow given input
+func allowRoles(bindings []RoleBinding, in PolicyInput) bool {
+	for _, b := range bindings {
+		if !matchPatterns([]string{b.Group}, in.Groups...) || !matchPatterns(b.Namespaces, in.Namespace) {
+			continue
+		}
+		for _, role := range b.Roles {
+			if InList(in.Action, roleActions[role]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ldapGroups represents cached groups of the user
+type ldapGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+// global cache of LDAP groups
+var (
+	ldapCache     = make(map[string]ldapGroups)
+	ldapCacheLock sync.Mutex
+)
+
+// helper function to return LDAP groups of given identity, groups are cached
+func (c *LDAPConfig) userGroups(id Identity) ([]string, error) {
+	ldapCacheLock.Lock()
+	cached, ok := ldapCache[id.User]
+	ldapCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.groups, nil
+	}
+	groups, err := c.search(id)
+	if err != nil {
+		return nil, err
+	}
+	ttl := c.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultLDAPCacheTTL
+	}
+	ldapCacheLock.Lock()
+	ldapCache[id.User] = ldapGroups{groups: groups, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	ldapCacheLock.Unlock()
+	return groups, nil
+}
+
+// helper function to escape special characters of LDAP filter values
+func ldapEscape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// helper function to return group name of attribute value, DNs are reduced
+// to their first CN
+func groupName(value string) string {
+	if !strings.Contains(value, "=") {
+		return value
+	}
+	rdn := strings.SplitN(value, ",", 2)[0]
+	if parts := strings.SplitN(rdn, "=", 2); len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "cn") {
+		return strings.TrimSpace(parts[1])
+	}
+	return value
+}
+
+// helper function to search LDAP groups of given identity
+func (c *LDAPConfig) search(id Identity) ([]string, error) {
+	if id.User == anonymousUser {
+		return nil, nil
+	}
+	filter := strings.NewReplacer("{user}", ldapEscape(id.User), "{login}", ldapEscape(id.Login)).Replace(c.Filter)
+	encoded, err := ldapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ldapDial(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// bind request
+	password := c.BindPassword
+	if password == "" {
+		password = os.Getenv("LDAP_BIND_PASSWORD")
+	}
+	bind := berTLV(0x60, berInt(0x02, 3), berTLV(0x04, []byte(c.BindDN)), berTLV(0x80, []byte(password)))
+	if _, err := conn.Write(ldapMessage(1, bind)); err != nil {
+		return nil, err
+	}
+	tag, op, err := readLDAPMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ldapResult(tag, 0x61, op); err != nil {
+		return nil, fmt.Errorf("LDAP bind: %v", err)
+	}
+
+	// search request of the whole subtree
+	attr := c.Attribute
+	if attr == "" {
+		attr = "memberOf"
+	}
+	search := berTLV(0x63,
+		berTLV(0x04, []byte(c.BaseDN)),
+		berInt(0x0a, 2), berInt(0x0a, 0), berInt(0x02, 0), berInt(0x02, 0),
+		berTLV(0x01, []byte{0}),
+		encoded,
+		berTLV(0x30, berTLV(0x04, []byte(attr))))
+	if _, err := conn.Write(ldapMessage(2, search)); err != nil {
+		return nil, err
+	}
+	var groups []string
+	for {
+		tag, op, err := readLDAPMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64: // search result entry
+			values, err := entryValues(op, attr)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				groups = append(groups, groupName(v))
+			}
+		case 0x65: // search result done
+			conn.Write(ldapMessage(3, berTLV(0x42)))
+			if err := ldapResult(tag, 0x65, op); err != nil {
+				return nil, fmt.Errorf("LDAP search: %v", err)
+			}
+			return groups, nil
+		}
+	}
+}
+
+// helper function to connect to LDAP server
+func ldapDial(rurl string) (net.Conn, error) {
+	uri, err := url.Parse(rurl)
+	if err != nil {
+		return nil, err
+	}
+	host := uri.Host
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if uri.Scheme == "ldaps" {
+		if !strings.Contains(host, ":") {
+			host += ":636"
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: uri.Hostname()})
+	}
+	if !strings.Contains(host, ":") {
+		host += ":389"
+	}
+	return dialer.Dial("tcp", host)
+}
+
+// helper function to encode BER element with given tag and content
+func berTLV(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	out := []byte{tag}
+	switch n := len(body); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, body...)
+}
+
+// helper function to encode BER integer with given tag
+func berInt(tag byte, v int) []byte {
+	var body []byte
+	for {
+		body = append([]byte{byte(v)}, body...)
+		v >>= 8
+		if v == 0 && body[0] < 0x80 {
+			break
+		}
+	}
+	return berTLV(tag, body)
+}
+
+// helper function to decode BER integer
+func berDecodeInt(data []byte) int {
+	v := 0
+	for _, b := range data {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// helper function to encode LDAP message with given id and operation
+func ldapMessage(id int, op []byte) []byte {
+	return berTLV(0x30, berInt(0x02, id), op)
+}
+
+// helper function to read BER element from given reader
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size := int(b)
+	if b&0x80 != 0 {
+		n := int(b & 0x7f)
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		size = 0
+		for i := 0; i < n; i++ {
+			if b, err = r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			size = size<<8 | int(b)
+		}
+	}
+	if size > mqttMaxPacketSize {
+		return 0, nil, fmt.Errorf("BER element of %d bytes is too large", size)
+	}
+	content := make([]byte, size)
+	_, err = io.ReadFull(r, content)
+	return tag, content, err
+}
+
+// helper function to split BER content into its elements
+func berElements(data []byte) ([]byte, [][]byte, error) {
+	var tags []byte
+	var contents [][]byte
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return tags, contents, nil
+		}
+		tag, content, err := readBER(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		tags = append(tags, tag)
+		contents = append(contents, content)
+	}
+}
+
+// helper function to read LDAP message, it returns tag and content of its
+// protocol operation
+func readLDAPMessage(r *bufio.Reader) (byte, []byte, error) {
+	tag, content, err := readBER(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, fmt.Errorf("unexpected LDAP message tag %x", tag)
+	}
+	tags, contents, err := berElements(content)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(tags) < 2 {
+		return 0, nil, errors.New("malformed LDAP message")
+	}
+	return tags[1], contents[1], nil
+}
+
+// helper function to check LDAP result of given operation
+func ldapResult(tag, expect byte, op []byte) error {
+	if tag != expect {
+		return fmt.Errorf("unexpected LDAP operation %x", tag)
+	}
+	_, contents, err := berElements(op)
+	if err != nil {
+		return err
+	}
+	if len(contents) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	if code := berDecodeInt(contents[0]); code != 0 {
+		return fmt.Errorf("result code %d %s", code, contents[2])
+	}
+	return nil
+}
+
+// helper function to return values of given attribute of search result entry
+func entryValues(op []byte, attr string) ([]string, error) {
+	_, contents, err := berElements(op)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) < 2 {
+		return nil, errors.New("malformed LDAP search result entry")
+	}
+	_, attrs, err := berElements(contents[1])
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, a := range attrs {
+		_, parts, err := berElements(a)
+		if err != nil || len(parts) < 2 {
+			return nil, errors.New("malformed LDAP attribute")
+		}
+		if !strings.EqualFold(string(parts[0]), attr) {
+			continue
+		}
+		_, vals, err := berElements(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			values = append(values, string(v))
+		}
+	}
+	return values, nil
+}
+
+// helper function to encode LDAP filter, it supports and (&), or (|), not
+// (!), equality (attr=value) and presence (attr=*) filters
+func ldapFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseLDAPFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q at the end of LDAP filter", rest)
+	}
+	return encoded, nil
+}
+
+// helper function to parse LDAP filter, it returns encoded filter and
+// remaining part of the input
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("LDAP filter %q should start with (", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, s, errors.New("unterminated LDAP filter")
+	}
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			part, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, rest, err
+			}
+			parts = append(parts, part)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") || len(parts) == 0 {
+			return nil, s, errors.New("malformed LDAP filter")
+		}
+		return berTLV(tag, parts...), s[1:], nil
+	}
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, s, errors.New("unterminated LDAP filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.Index(item, "=")
+	if eq <= 0 {
+		return nil, rest, fmt.Errorf("malformed LDAP filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if value == "*" {
+		return berTLV(0x87, []byte(attr)), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, rest, fmt.Errorf("substring LDAP filters are not supported: %q", item)
+	}
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, rest, err
+	}
+	return berTLV(0xa3, berTLV(0x04, []byte(attr)), berTLV(0x04, []byte(unescaped))), rest, nil
+}
+
+// helper function to decode \XX escapes of LDAP filter values
+func ldapUnescape(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", fmt.Errorf("malformed escape in LDAP filter value %q", value)
+		}
+		c, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("malformed escape in LDAP filter value %q", value)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+// tests of LDAP group resolution and role authorization, they do not require TF C library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// helper function to run fake LDAP server which returns memberOf values of
+// given logins, it returns server URL and channel of searched filters
+func fakeLDAPServer(t *testing.T, members map[string][]string) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	filters := make(chan string, 10)
+	result := func(tag byte) []byte {
+		return berTLV(tag, berInt(0x0a, 0), berTLV(0x04), berTLV(0x04))
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					_, msg, err := readBER(reader)
+					if err != nil {
+						return
+					}
+					tags, parts, err := berElements(msg)
+					if err != nil || len(parts) < 2 {
+						return
+					}
+					id := berDecodeInt(parts[0])
+					switch tags[1] {
+					case 0x60: // bind
+						conn.Write(ldapMessage(id, result(0x61)))
+					case 0x63: // search with (cn=<login>) equality filter
+						ftags, fields, err := berElements(parts[1])
+						if err != nil || len(fields) < 7 || ftags[6] != 0xa3 {
+							return
+						}
+						_, items, _ := berElements(fields[6])
+						filters <- string(items[0]) + "=" + string(items[1])
+						var values [][]byte
+						for _, g := range members[string(items[1])] {
+							values = append(values, berTLV(0x04, []byte(g)))
+						}
+						attr := berTLV(0x30, berTLV(0x04, []byte("memberOf")), berTLV(0x31, values...))
+						entry := berTLV(0x64, berTLV(0x04, []byte("CN="+string(items[1]))), berTLV(0x30, attr))
+						conn.Write(ldapMessage(id, entry))
+						conn.Write(ldapMessage(id, result(0x65)))
+					default:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "ldap://" + ln.Addr().String(), filters
+}
+
+// TestLDAPFilter checks encoding of LDAP filters
+func TestLDAPFilter(t *testing.T) {
+	encoded, err := ldapFilter("(&(objectClass=user)(cn=a\\2ab)(!(mail=*)))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := berTLV(0xa0,
+		berTLV(0xa3, berTLV(0x04, []byte("objectClass")), berTLV(0x04, []byte("user"))),
+		berTLV(0xa3, berTLV(0x04, []byte("cn")), berTLV(0x04, []byte("a*b"))),
+		berTLV(0xa2, berTLV(0x87, []byte("mail"))))
+	if !bytes.Equal(encoded, expect) {
+		t.Errorf("unexpected encoded filter %x, expected %x", encoded, expect)
+	}
+	for _, filter := range []string{"cn=a", "(cn=a", "(&)", "(cn=a*)", "(cn=a)x", "(cn=\\2)"} {
+		if _, err := ldapFilter(filter); err == nil {
+			t.Errorf("malformed filter %q is accepted", filter)
+		}
+	}
+	if v := ldapEscape("a*(b)\\"); v != "a\\2a\\28b\\29\\5c" {
+		t.Errorf("unexpected escaped value %s", v)
+	}
+}
+
+// TestLDAPRoles checks role authorization with groups resolved via LDAP
+func TestLDAPRoles(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	writeModelFiles(t, "dnn", []byte("dnn"), TFParams{InputNode: "input", OutputNode: "output", Namespace: "higgs"})
+	ldapCache = make(map[string]ldapGroups)
+	rurl, filters := fakeLDAPServer(t, map[string][]string{
+		"alice": {"CN=higgs-admins,OU=e-groups,DC=example,DC=org"},
+		"bob":   {"CN=members,OU=e-groups,DC=example,DC=org"},
+	})
+	_config.Policy = &PolicyConfig{
+		LDAP: &LDAPConfig{URL: rurl, BaseDN: "DC=example,DC=org", Filter: "(cn={login})"},
+		Roles: []RoleBinding{
+			{Group: "higgs-admins", Roles: []string{"admin"}, Namespaces: []string{"higgs"}},
+			{Group: "members", Roles: []string{"predict"}},
+		},
+	}
+	initLimiter("1000-S")
+	router := handlers()
+	row, _ := json.Marshal(testRow("dnn"))
+	row2, _ := json.Marshal(testRow("dnn2"))
+	tests := []struct {
+		user, method, url, body string
+		code                    int
+	}{
+		{"bob", "POST", "/json", string(row2), http.StatusOK},
+		{"bob", "DELETE", "/delete/dnn", "", http.StatusForbidden},
+		{"alice", "POST", "/json", string(row2), http.StatusForbidden},
+		{"alice", "POST", "/json", string(row), http.StatusOK},
+		{"alice", "DELETE", "/delete/dnn", "", http.StatusOK},
+		{"mallory", "POST", "/json", string(row2), http.StatusForbidden},
+		{"", "GET", "/models", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if code := policyRequest(router, tt.user, tt.method, tt.url, tt.body); code != tt.code {
+			t.Errorf("%s %s %s: status %d, expected %d", tt.user, tt.method, tt.url, code, tt.code)
+		}
+	}
+	// groups are cached, i.e. LDAP is queried once per user
+	if n := len(filters); n != 3 {
+		t.Errorf("unexpected number of LDAP searches %d", n)
+	}
+	if f := <-filters; f != "cn=bob" {
+		t.Errorf("unexpected LDAP filter %s", f)
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+// leader module provides leader election of server replicas
+//
+// When several replicas share model area or model store, cluster-wide
+// background jobs (janitor of model versions and upload sessions, scheduled
+// self-tests, MLflow pollers) should run on exactly one of them. The
+// "leaderElection" option defines where replicas hold the leader lease:
+//   - "k8s://<namespace>/<lease>"  Kubernetes Lease object (in-cluster API)
+//   - "consul://<host:port>/<key>" Consul session lock
+//   - "etcd://<host:port>/<key>"   etcd v3 lease (JSON gateway)
+//   - "file://<path>" or "<path>"  lease file in shared directory
+// The lease is valid for "leaderLease" seconds (default 15) and renewed by
+// the leader every third of that period, requests to the backend time out
+// after a quarter of the lease and the leader stops running cluster-wide
+// jobs once its lease was not renewed for the whole period, draining leader
+// releases the lease to let other replica take over. Without leader election every
+// replica runs background jobs. Identity of the replica is taken from
+// POD_NAME environment variable or host name and process id.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default leader lease duration in seconds
+const defaultLeaderLease = 15
+
+// Elector represents backend of leader election
+type Elector interface {
+	Acquire(id string, ttl time.Duration) (bool, error) // acquire or renew leader lease
+	Release(id string) error                            // release leader lease
+}
+
+// global leader state
+var (
+	_leader     int32 = 1 // every replica is leader without leader election
+	_leaderID   string
+	leaderLock  sync.Mutex
+	leaderSince time.Time
+
+	_leaderRenewed int64 // time of the last lease renewal in unix nanoseconds
+)
+
+// helper function to check if this replica runs cluster-wide jobs, the
+// leader whose lease was not renewed within lease duration, e.g. when the
+// backend hangs, may be replaced by other replica and does not run them
+func isLeader() bool {
+	if atomic.LoadInt32(&_leader) != 1 {
+		return false
+	}
+	if _config.LeaderElection == "" {
+		return true
+	}
+	renewed := time.Unix(0, atomic.LoadInt64(&_leaderRenewed))
+	return time.Since(renewed) < leaderLease()
+}
+
+// helper function to return identity of this replica
+func replicaID() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// LeaderInfo represents leader election status of the replica
+type LeaderInfo struct {
+	Enabled bool   `json:"enabled"` // leader election is enabled
+	ID      string `json:"id"`      // replica identity
+	Leader  bool   `json:"leader"`  // replica is the leader
+	Since   int64  `json:"since"`   // time when replica became the leader
+}
+
+// helper function to return leader election status
+func leaderInfo() LeaderInfo {
+	leaderLock.Lock()
+	defer leaderLock.Unlock()
+	info := LeaderInfo{Enabled: _config.LeaderElection != "", ID: _leaderID, Leader: isLeader()}
+	if info.Leader && !leaderSince.IsZero() {
+		info.Since = leaderSince.Unix()
+	}
+	return info
+}
+
+// helper function to update leader state
+func setLeader(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&_leader, v) == v {
+		return
+	}
+	leaderLock.Lock()
+	if leader {
+		leaderSince = time.Now()
+	} else {
+		leaderSince = time.Time{}
+	}
+	leaderLock.Unlock()
+	msg := "replica lost leadership"
+	if leader {
+		msg = "replica became the leader"
+	}
+	log.Printf("%s %s", _leaderID, msg)
+	publish(EventLeaderChange, "", fmt.Sprintf("%s %s", _leaderID, msg))
+}
+
+// helper function to create elector for given URI
+func newElector(uri string) (Elector, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "k8s":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("invalid Kubernetes lease %s, should be k8s://<namespace>/<lease>", uri)
+		}
+		return newK8sElector(u.Host, key, leaderClientTimeout())
+	case "consul":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("invalid Consul lock %s, should be consul://<host:port>/<key>", uri)
+		}
+		return &consulElector{url: "http://" + u.Host, key: key, client: leaderClient()}, nil
+	case "etcd":
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("invalid etcd lease %s, should be etcd://<host:port>/<key>", uri)
+		}
+		return &etcdElector{url: "http://" + u.Host, key: key, client: leaderClient()}, nil
+	case "file", "":
+		path := strings.TrimPrefix(uri, "file://")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		return &fileElector{path: path}, nil
+	}
+	return nil, fmt.Errorf("unsupported leader election backend %s", u.Scheme)
+}
+
+// helper function to return leader lease duration
+func leaderLease() time.Duration {
+	lease := _config.LeaderLease
+	if lease <= 0 {
+		lease = defaultLeaderLease
+	}
+	return time.Duration(lease) * time.Second
+}
+
+// helper function to return timeout of leader election requests, it is
+// shorter than renewal period such that hanging backend does not delay
+// renewals
+func leaderClientTimeout() time.Duration {
+	return leaderLease() / 4
+}
+
+// helper function to create HTTP client of leader election backends
+func leaderClient() *http.Client {
+	return &http.Client{Timeout: leaderClientTimeout()}
+}
+
+// helper function to run single round of leader election, draining
+// replica hands over leadership to other replicas
+func electLeader(elector Elector, ttl time.Duration) {
+	if drainMode().Draining {
+		if isLeader() {
+			if err := elector.Release(_leaderID); err != nil {
+				log.Println("unable to release leader lease", err)
+			}
+		}
+		setLeader(false)
+		return
+	}
+	leader, err := elector.Acquire(_leaderID, ttl)
+	if err != nil {
+		log.Println("unable to acquire leader lease", err)
+	}
+	if leader && err == nil {
+		atomic.StoreInt64(&_leaderRenewed, time.Now().UnixNano())
+	}
+	setLeader(leader && err == nil)
+}
+
+// initLeaderElection starts leader election of the replica
+func initLeaderElection() error {
+	_leaderID = replicaID()
+	if _config.LeaderElection == "" {
+		return nil
+	}
+	elector, err := newElector(_config.LeaderElection)
+	if err != nil {
+		return err
+	}
+	// replica does not run cluster-wide jobs until it acquires the lease
+	atomic.StoreInt32(&_leader, 0)
+	ttl := leaderLease()
+	log.Printf("leader election via %s, replica %s, lease %v", _config.LeaderElection, _leaderID, ttl)
+	electLeader(elector, ttl)
+	go func() {
+		for {
+			time.Sleep(ttl / 3)
+			electLeader(elector, ttl)
+		}
+	}()
+	return nil
+}
+
+// fileElector implements Elector via lease file in shared directory
+type fileElector struct {
+	path string
+}
+
+// fileLease represents content of lease file
+type fileLease struct {
+	Holder  string `json:"holder"`  // identity of lease holder
+	Expires int64  `json:"expires"` // lease expiration time in unix nanoseconds
+}
+
+// helper function to lock lease file, stale locks of crashed replicas are
+// removed after given time
+func (e *fileElector) lock(ttl time.Duration) (bool, error) {
+	lock := e.path + ".lock"
+	// lock is held only for short time, retry few times before giving up
+	for i := 0; i < 10; i++ {
+		file, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return true, file.Close()
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > ttl {
+			os.Remove(lock)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false, nil
+}
+
+// helper function to update lease file under the lock
+func (e *fileElector) update(fn func(lease *fileLease) bool, ttl time.Duration) (bool, error) {
+	locked, err := e.lock(ttl)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer os.Remove(e.path + ".lock")
+	var lease fileLease
+	if data, err := ioutil.ReadFile(e.path); err == nil {
+		if err := json.Unmarshal(data, &lease); err != nil {
+			log.Println("invalid leader lease file", e.path, err)
+		}
+	}
+	if !fn(&lease) {
+		return false, nil
+	}
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	tmp := e.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, e.path)
+}
+
+// Acquire implements Elector interface
+func (e *fileElector) Acquire(id string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	return e.update(func(lease *fileLease) bool {
+		if lease.Holder != id && lease.Holder != "" && now.UnixNano() < lease.Expires {
+			return false
+		}
+		lease.Holder = id
+		lease.Expires = now.Add(ttl).UnixNano()
+		return true
+	}, ttl)
+}
+
+// Release implements Elector interface
+func (e *fileElector) Release(id string) error {
+	_, err := e.update(func(lease *fileLease) bool {
+		if lease.Holder != id {
+			return false
+		}
+		*lease = fileLease{}
+		return true
+	}, leaderLease())
+	return err
+}
+
+// helper function to perform JSON request of leader election backends
+func leaderRequest(client *http.Client, method, rurl, token string, in, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, rurl, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s %s", method, rurl, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// location of Kubernetes service account credentials
+const k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// time format of Kubernetes MicroTime fields
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// k8sElector implements Elector via Kubernetes Lease object
+type k8sElector struct {
+	url       string       // URL of the Lease object
+	tokenFile string       // file of service account token
+	client    *http.Client // HTTP client of Kubernetes API
+}
+
+// k8sLease represents Kubernetes Lease object
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// helper function to create Kubernetes elector from in-cluster configuration
+func newK8sElector(namespace, name string, timeout time.Duration) (*k8sElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Kubernetes leader election requires in-cluster environment")
+	}
+	elector := &k8sElector{tokenFile: filepath.Join(k8sServiceAccount, "token")}
+	if _, err := elector.token(); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(k8sServiceAccount, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	elector.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	elector.url = fmt.Sprintf("https://%s:%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", host, port, namespace, name)
+	return elector, nil
+}
+
+// helper function to read service account token, projected tokens are
+// rotated by kubelet and therefore the token is read for every request
+func (e *k8sElector) token() (string, error) {
+	token, err := ioutil.ReadFile(e.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// helper function to perform request of Kubernetes API
+func (e *k8sElector) request(method, rurl string, in, out interface{}) (int, error) {
+	token, err := e.token()
+	if err != nil {
+		return 0, err
+	}
+	return leaderRequest(e.client, method, rurl, token, in, out)
+}
+
+// Acquire implements Elector interface
+func (e *k8sElector) Acquire(id string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC().Format(k8sMicroTime)
+	var lease k8sLease
+	code, err := e.request("GET", e.url, nil, &lease)
+	if code == http.StatusNotFound {
+		// create new lease
+		idx := strings.LastIndex(e.url, "/leases/")
+		lease = k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = e.url[idx+len("/leases/"):]
+		lease.Spec.HolderIdentity = id
+		lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+		lease.Spec.AcquireTime = now
+		lease.Spec.RenewTime = now
+		code, err = e.request("POST", e.url[:idx+len("/leases")], lease, nil)
+		if code == http.StatusConflict {
+			// other replica created the lease first
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if lease.Spec.HolderIdentity != id && lease.Spec.HolderIdentity != "" {
+		renew, err := time.Parse(k8sMicroTime, lease.Spec.RenewTime)
+		expires := renew.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && time.Now().Before(expires) {
+			return false, nil
+		}
+	}
+	if lease.Spec.HolderIdentity != id {
+		lease.Spec.HolderIdentity = id
+		lease.Spec.AcquireTime = now
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+	lease.Spec.RenewTime = now
+	// resourceVersion guarantees that concurrent updates conflict
+	code, err = e.request("PUT", e.url, lease, nil)
+	if code == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release implements Elector interface
+func (e *k8sElector) Release(id string) error {
+	var lease k8sLease
+	if _, err := e.request("GET", e.url, nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != id {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err := e.request("PUT", e.url, lease, nil)
+	return err
+}
+
+// consulElector implements Elector via Consul session lock
+type consulElector struct {
+	url     string       // Consul agent URL
+	key     string       // key of the lock
+	session string       // Consul session ID
+	client  *http.Client // HTTP client of Consul agent
+}
+
+// helper function to create new Consul session
+func (e *consulElector) createSession(ttl time.Duration) error {
+	in := map[string]string{"Name": "tfaas-leader", "TTL": fmt.Sprintf("%ds", int(ttl.Seconds())), "Behavior": "release"}
+	var out struct{ ID string }
+	if _, err := leaderRequest(e.client, "PUT", e.url+"/v1/session/create", os.Getenv("CONSUL_HTTP_TOKEN"), in, &out); err != nil {
+		return err
+	}
+	e.session = out.ID
+	return nil
+}
+
+// Acquire implements Elector interface
+func (e *consulElector) Acquire(id string, ttl time.Duration) (bool, error) {
+	token := os.Getenv("CONSUL_HTTP_TOKEN")
+	if e.session != "" {
+		// renew session, it is invalidated by Consul once its TTL expires
+		code, err := leaderRequest(e.client, "PUT", e.url+"/v1/session/renew/"+e.session, token, nil, nil)
+		if code == http.StatusNotFound {
+			e.session = ""
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if e.session == "" {
+		if err := e.createSession(ttl); err != nil {
+			return false, err
+		}
+	}
+	var acquired bool
+	rurl := fmt.Sprintf("%s/v1/kv/%s?acquire=%s", e.url, e.key, e.session)
+	if _, err := leaderRequest(e.client, "PUT", rurl, token, id, &acquired); err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// Release implements Elector interface
+func (e *consulElector) Release(id string) error {
+	if e.session == "" {
+		return nil
+	}
+	rurl := fmt.Sprintf("%s/v1/kv/%s?release=%s", e.url, e.key, e.session)
+	_, err := leaderRequest(e.client, "PUT", rurl, os.Getenv("CONSUL_HTTP_TOKEN"), id, nil)
+	return err
+}
+
+// etcdElector implements Elector via etcd v3 lease and JSON gateway
+type etcdElector struct {
+	url    string       // etcd URL
+	key    string       // key of the lock
+	lease  string       // etcd lease ID
+	client *http.Client // HTTP client of etcd gateway
+}
+
+// helper function to encode etcd keys and values
+func etcdBytes(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// Acquire implements Elector interface
+func (e *etcdElector) Acquire(id string, ttl time.Duration) (bool, error) {
+	if e.lease != "" {
+		// keep lease alive, expired lease is reported with zero TTL
+		var out struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if _, err := leaderRequest(e.client, "POST", e.url+"/v3/lease/keepalive", "", map[string]string{"ID": e.lease}, &out); err != nil {
+			return false, err
+		}
+		if out.Result.TTL == "" || out.Result.TTL == "0" {
+			e.lease = ""
+		}
+	}
+	if e.lease == "" {
+		var out struct {
+			ID string `json:"ID"`
+		}
+		if _, err := leaderRequest(e.client, "POST", e.url+"/v3/lease/grant", "", map[string]int{"TTL": int(ttl.Seconds())}, &out); err != nil {
+			return false, err
+		}
+		e.lease = out.ID
+	}
+	// put the key if it does not exist, otherwise read its holder
+	key := etcdBytes(e.key)
+	txn := map[string]interface{}{
+		"compare": []map[string]string{{"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": map[string]string{"key": key, "value": etcdBytes(id), "lease": e.lease}}},
+		"failure": []map[string]interface{}{{"request_range": map[string]string{"key": key}}},
+	}
+	var out struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange struct {
+				Kvs []struct {
+					Value string `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}
+	if _, err := leaderRequest(e.client, "POST", e.url+"/v3/kv/txn", "", txn, &out); err != nil {
+		return false, err
+	}
+	if out.Succeeded {
+		return true, nil
+	}
+	for _, r := range out.Responses {
+		for _, kv := range r.ResponseRange.Kvs {
+			if kv.Value == etcdBytes(id) && kv.Lease == e.lease {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Release implements Elector interface
+func (e *etcdElector) Release(id string) error {
+	if e.lease == "" {
+		return nil
+	}
+	_, err := leaderRequest(e.client, "POST", e.url+"/v3/lease/revoke", "", map[string]string{"ID": e.lease}, nil)
+	e.lease = ""
+	return err
+}
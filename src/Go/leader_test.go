@@ -0,0 +1,197 @@
+package main
+
+// tests of leader election, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFileElector checks leader lease in shared directory
+func TestFileElector(t *testing.T) {
+	elector, err := newElector(filepath.Join(t.TempDir(), "leases", "tfaas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := 200 * time.Millisecond
+	if ok, err := elector.Acquire("a", ttl); !ok || err != nil {
+		t.Fatalf("replica a did not acquire free lease: %v %v", ok, err)
+	}
+	if ok, _ := elector.Acquire("b", ttl); ok {
+		t.Fatal("replica b acquired lease held by replica a")
+	}
+	if ok, _ := elector.Acquire("a", ttl); !ok {
+		t.Fatal("replica a did not renew its lease")
+	}
+	// expired lease is taken over by other replica
+	time.Sleep(ttl)
+	if ok, _ := elector.Acquire("b", ttl); !ok {
+		t.Fatal("replica b did not acquire expired lease")
+	}
+	if err := elector.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := elector.Acquire("a", ttl); ok {
+		t.Fatal("release of replica a removed lease of replica b")
+	}
+	if err := elector.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := elector.Acquire("a", ttl); !ok {
+		t.Fatal("replica a did not acquire released lease")
+	}
+}
+
+// TestElectLeader checks that draining leader hands over the lease
+func TestElectLeader(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	t.Cleanup(func() { setLeader(true); setDrainMode(DrainMode{}) })
+	elector, err := newElector("file://" + filepath.Join(t.TempDir(), "lease"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_leaderID = "a"
+	setLeader(false)
+	electLeader(elector, time.Minute)
+	if !isLeader() || !leaderInfo().Leader {
+		t.Fatal("replica did not become the leader")
+	}
+	setDrainMode(DrainMode{Draining: true})
+	electLeader(elector, time.Minute)
+	if isLeader() {
+		t.Fatal("draining replica kept leadership")
+	}
+	if ok, _ := elector.Acquire("b", time.Minute); !ok {
+		t.Fatal("draining replica did not release the lease")
+	}
+	if _, err := newElector("zk://host/key"); err == nil {
+		t.Error("unsupported backend is accepted")
+	}
+}
+
+// TestK8sElector checks leader election via Kubernetes Lease API
+func TestK8sElector(t *testing.T) {
+	var lock sync.Mutex
+	var lease *k8sLease
+	version := 0
+	token := "token"
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if lease == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(lease)
+		case "POST", "PUT":
+			var in k8sLease
+			json.NewDecoder(r.Body).Decode(&in)
+			if r.Method == "POST" && lease != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			if r.Method == "PUT" && in.Metadata.ResourceVersion != lease.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			version++
+			in.Metadata.ResourceVersion = strings.Repeat("v", version)
+			lease = &in
+			json.NewEncoder(w).Encode(lease)
+		}
+	}))
+	defer server.Close()
+	url := server.URL + "/apis/coordination.k8s.io/v1/namespaces/default/leases/tfaas"
+	a := &k8sElector{url: url, tokenFile: tokenFile, client: server.Client()}
+	b := &k8sElector{url: url, tokenFile: tokenFile, client: server.Client()}
+	if ok, err := a.Acquire("a", 15*time.Second); !ok || err != nil {
+		t.Fatalf("replica a did not create the lease: %v %v", ok, err)
+	}
+	if lease.Metadata.Name != "tfaas" || lease.Spec.HolderIdentity != "a" {
+		t.Fatalf("unexpected lease %+v", lease)
+	}
+	if ok, _ := b.Acquire("b", 15*time.Second); ok {
+		t.Fatal("replica b acquired lease held by replica a")
+	}
+	// rotated service account token is used by next requests
+	lock.Lock()
+	token = "rotated"
+	lock.Unlock()
+	if err := ioutil.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.Acquire("a", 15*time.Second); !ok || err != nil {
+		t.Fatalf("replica a did not renew the lease: %v %v", ok, err)
+	}
+	// expired lease is taken over by other replica
+	lock.Lock()
+	lease.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(k8sMicroTime)
+	lock.Unlock()
+	if ok, err := b.Acquire("b", 15*time.Second); !ok || err != nil {
+		t.Fatalf("replica b did not acquire expired lease: %v %v", ok, err)
+	}
+	if lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("unexpected lease transitions %d", lease.Spec.LeaseTransitions)
+	}
+	if err := b.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := a.Acquire("a", 15*time.Second); !ok {
+		t.Fatal("replica a did not acquire released lease")
+	}
+}
+
+// TestLeaderRenewal checks that leader without renewed lease stops running
+// cluster-wide jobs and requests to hanging backend time out
+func TestLeaderRenewal(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	t.Cleanup(func() { setLeader(true) })
+	_config.LeaderElection = "consul://localhost:8500/tfaas"
+	_config.LeaderLease = 1
+	_leaderID = "a"
+	setLeader(false)
+	electLeader(&fileElector{path: filepath.Join(t.TempDir(), "lease")}, leaderLease())
+	if !isLeader() {
+		t.Fatal("replica did not become the leader")
+	}
+	atomic.StoreInt64(&_leaderRenewed, time.Now().Add(-2*time.Second).UnixNano())
+	if isLeader() {
+		t.Fatal("leader without renewed lease runs cluster-wide jobs")
+	}
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	elector, err := newElector("consul://" + strings.TrimPrefix(server.URL, "http://") + "/tfaas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if ok, err := elector.Acquire("a", leaderLease()); ok || err == nil {
+		t.Fatalf("lease acquired from hanging backend: %v %v", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed >= leaderLease()/3 {
+		t.Errorf("request to hanging backend took %v", elapsed)
+	}
+}
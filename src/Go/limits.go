@@ -0,0 +1,178 @@
+package main
+
+// limits module provides detection of container resource limits
+//
+// In containers (Docker, Kubernetes) the server should not assume resources
+// of the whole node. At startup it reads CPU quota and memory limit of its
+// cgroup (v2 or v1) and uses them to size GOMAXPROCS, TF intra/inter-op
+// thread pools (unless configProto is provided or intraOpThreads and
+// interOpThreads are configured), number of concurrent jobs and default
+// threshold of memory watchdog (90% of memory limit). Detection can be
+// disabled via ignoreCgroupLimits configuration option.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// default location of cgroup file system
+const cgroupRoot = "/sys/fs/cgroup"
+
+// memory limits above this value mean unlimited memory, e.g. cgroup v1
+// reports 9223372036854771712 for unlimited containers
+const unlimitedMemory = uint64(1) << 60
+
+// fraction of container memory used as default memory watchdog threshold
+const memoryLimitFraction = 0.9
+
+// ResourceLimits represents resources available to the server
+type ResourceLimits struct {
+	CPUs     float64 `json:"cpus"`     // number of CPUs available to the server
+	HostCPUs int     `json:"hostCPUs"` // number of CPUs of the host
+	Memory   uint64  `json:"memory"`   // memory limit in bytes, 0 means unlimited
+	Source   string  `json:"source"`   // source of limits: cgroup2, cgroup1 or host
+}
+
+// global resource limits
+var _limits = ResourceLimits{CPUs: float64(runtime.NumCPU()), HostCPUs: runtime.NumCPU(), Source: "host"}
+
+// helper function to read content of cgroup file
+func readCgroupFile(root, name string) (string, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(root, name))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// helper function to parse memory limit value
+func parseMemoryLimit(value string) uint64 {
+	if value == "max" {
+		return 0
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || v >= unlimitedMemory {
+		return 0
+	}
+	return v
+}
+
+// helper function to detect resource limits from cgroup file system in
+// given root directory
+func detectLimits(root string) ResourceLimits {
+	limits := ResourceLimits{CPUs: float64(runtime.NumCPU()), HostCPUs: runtime.NumCPU(), Source: "host"}
+	var quota, period float64
+	if v, ok := readCgroupFile(root, "cpu.max"); ok {
+		// cgroup v2: "max 100000" or "200000 100000"
+		limits.Source = "cgroup2"
+		fields := strings.Fields(v)
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, _ = strconv.ParseFloat(fields[0], 64)
+			period, _ = strconv.ParseFloat(fields[1], 64)
+		}
+		if v, ok := readCgroupFile(root, "memory.max"); ok {
+			limits.Memory = parseMemoryLimit(v)
+		}
+	} else if v, ok := readCgroupFile(root, "cpu/cpu.cfs_quota_us"); ok {
+		// cgroup v1: quota is -1 for unlimited containers
+		limits.Source = "cgroup1"
+		quota, _ = strconv.ParseFloat(v, 64)
+		if v, ok := readCgroupFile(root, "cpu/cpu.cfs_period_us"); ok {
+			period, _ = strconv.ParseFloat(v, 64)
+		}
+		if v, ok := readCgroupFile(root, "memory/memory.limit_in_bytes"); ok {
+			limits.Memory = parseMemoryLimit(v)
+		}
+	}
+	if quota > 0 && period > 0 && quota/period < limits.CPUs {
+		limits.CPUs = quota / period
+	}
+	return limits
+}
+
+// helper function to return number of whole CPUs available to the server
+func availableCPUs() int {
+	n := int(math.Ceil(_limits.CPUs))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// helper function to return TF intra-op and inter-op threads
+func tfThreads() (int, int) {
+	intra, inter := _config.IntraOpThreads, _config.InterOpThreads
+	cpus := availableCPUs()
+	if intra <= 0 {
+		intra = cpus
+	}
+	if inter <= 0 {
+		inter = 1
+		if cpus > 2 {
+			inter = 2
+		}
+	}
+	return intra, inter
+}
+
+// helper function to encode TF ConfigProto message with given threads,
+// intra_op_parallelism_threads and inter_op_parallelism_threads are fields
+// 2 and 5 of ConfigProto
+func threadsConfigProto(intra, inter int) []byte {
+	var out []byte
+	for _, f := range []struct{ field, value int }{{2, intra}, {5, inter}} {
+		out = binary.AppendUvarint(out, uint64(f.field<<3))
+		out = binary.AppendUvarint(out, uint64(f.value))
+	}
+	return out
+}
+
+// helper function to return TF session config of the server, it returns
+// nil if TF defaults should be used
+func sessionConfigProto() []byte {
+	if _limits.Source == "host" && _config.IntraOpThreads <= 0 && _config.InterOpThreads <= 0 {
+		return nil
+	}
+	return threadsConfigProto(tfThreads())
+}
+
+// initLimits detects resource limits and adjusts server defaults
+func initLimits() {
+	if _config.IgnoreCgroupLimits {
+		return
+	}
+	_limits = detectLimits(cgroupRoot)
+	cpus := availableCPUs()
+	if cpus < runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(cpus)
+	}
+	if _config.MemoryLimit == 0 && _limits.Memory > 0 {
+		_config.MemoryLimit = int(float64(_limits.Memory>>20) * memoryLimitFraction)
+	}
+	log.Printf("resource limits %s: cpus %.2f of %d, memory %s, GOMAXPROCS %d, memoryLimit %dMB", _limits.Source, _limits.CPUs, _limits.HostCPUs, memoryString(_limits.Memory), runtime.GOMAXPROCS(0), _config.MemoryLimit)
+}
+
+// helper function to format memory limit
+func memoryString(memory uint64) string {
+	if memory == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%dMB", memory>>20)
+}
+
+// helper function to check detected resource limits
+func checkResources() Diagnostic {
+	intra, inter := tfThreads()
+	return Diagnostic{
+		Check:   "resources",
+		Status:  diagnosticOK,
+		Details: fmt.Sprintf("%s: cpus %.2f of %d, memory %s, TF threads intra %d inter %d", _limits.Source, _limits.CPUs, _limits.HostCPUs, memoryString(_limits.Memory), intra, inter),
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+// tests of resource limits detection, they do not require TF C library
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// helper function to write cgroup files into given root
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		fname := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestDetectLimits checks detection of cgroup v1 and v2 limits
+func TestDetectLimits(t *testing.T) {
+	root := t.TempDir()
+	if limits := detectLimits(root); limits.Source != "host" || limits.CPUs != float64(runtime.NumCPU()) || limits.Memory != 0 {
+		t.Errorf("unexpected host limits %+v", limits)
+	}
+
+	v2 := filepath.Join(root, "v2")
+	writeCgroupFiles(t, v2, map[string]string{"cpu.max": "50000 100000", "memory.max": "536870912"})
+	limits := detectLimits(v2)
+	if limits.Source != "cgroup2" || limits.CPUs != 0.5 || limits.Memory != 512<<20 {
+		t.Errorf("unexpected cgroup2 limits %+v", limits)
+	}
+	writeCgroupFiles(t, v2, map[string]string{"cpu.max": "max 100000", "memory.max": "max"})
+	if limits := detectLimits(v2); limits.CPUs != float64(runtime.NumCPU()) || limits.Memory != 0 {
+		t.Errorf("unexpected unlimited cgroup2 limits %+v", limits)
+	}
+
+	v1 := filepath.Join(root, "v1")
+	writeCgroupFiles(t, v1, map[string]string{
+		"cpu/cpu.cfs_quota_us":         "25000",
+		"cpu/cpu.cfs_period_us":        "100000",
+		"memory/memory.limit_in_bytes": "1073741824",
+	})
+	limits = detectLimits(v1)
+	if limits.Source != "cgroup1" || limits.CPUs != 0.25 || limits.Memory != 1<<30 {
+		t.Errorf("unexpected cgroup1 limits %+v", limits)
+	}
+	writeCgroupFiles(t, v1, map[string]string{
+		"cpu/cpu.cfs_quota_us":         "-1",
+		"memory/memory.limit_in_bytes": "9223372036854771712",
+	})
+	if limits := detectLimits(v1); limits.CPUs != float64(runtime.NumCPU()) || limits.Memory != 0 {
+		t.Errorf("unexpected unlimited cgroup1 limits %+v", limits)
+	}
+}
+
+// TestThreadsConfig checks TF threads sizing by available CPUs
+func TestThreadsConfig(t *testing.T) {
+	orig := _limits
+	t.Cleanup(func() { _limits = orig; _config = Configuration{} })
+	_config = Configuration{}
+	_limits = ResourceLimits{CPUs: 0.5, HostCPUs: 64, Source: "cgroup2"}
+	if intra, inter := tfThreads(); intra != 1 || inter != 1 {
+		t.Errorf("unexpected threads %d %d", intra, inter)
+	}
+	if maxJobs() != 1 {
+		t.Errorf("unexpected number of jobs %d", maxJobs())
+	}
+	_limits.CPUs = 3.5
+	if config := sessionConfigProto(); !bytes.Equal(config, []byte{0x10, 4, 0x28, 2}) {
+		t.Errorf("unexpected config proto %v", config)
+	}
+	_config.IntraOpThreads = 200
+	if config := threadsConfigProto(tfThreads()); !bytes.Equal(config, []byte{0x10, 0xc8, 0x01, 0x28, 2}) {
+		t.Errorf("unexpected config proto %v", config)
+	}
+	_config = Configuration{}
+	_limits = ResourceLimits{CPUs: 64, HostCPUs: 64, Source: "host"}
+	if config := sessionConfigProto(); config != nil {
+		t.Errorf("host without limits should use TF defaults %v", config)
+	}
+}
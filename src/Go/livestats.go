@@ -0,0 +1,122 @@
+package main
+
+// livestats module provides feed of live serving statistics
+//
+// GET /events streams server-sent events (see sse module) with serving
+// statistics of every second: number of finished requests (QPS), number of
+// server errors (5xx) and client errors (4xx), mean and max latency of
+// requests in milliseconds, e.g.
+// event: stats
+// data: {"time":1700000000,"requests":120,"errors":0,"clientErrors":2,"latency":3.1,"maxLatency":12.5}
+// Statistics of the last minute are sent on connect, such that the dashboard
+// draws live graphs without polling of /metrics endpoint.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// number of seconds of statistics kept by the feed
+const liveStatsWindow = 60
+
+// LiveStats represents serving statistics of one second
+type LiveStats struct {
+	Time         int64   `json:"time"`         // unix time of the second
+	Requests     uint64  `json:"requests"`     // number of finished requests
+	Errors       uint64  `json:"errors"`       // number of server errors (5xx)
+	ClientErrors uint64  `json:"clientErrors"` // number of client errors (4xx)
+	Latency      float64 `json:"latency"`      // mean latency in milliseconds
+	MaxLatency   float64 `json:"maxLatency"`   // max latency in milliseconds
+}
+
+// global statistics of current second, recent seconds and subscribers
+var (
+	_liveStats       LiveStats
+	_liveLatency     time.Duration // total latency of current second
+	_liveHistory     []LiveStats
+	_liveSubscribers = make(map[chan LiveStats]struct{})
+	_liveStatsLock   sync.Mutex
+)
+
+// recordLiveStats records finished request in live statistics
+func recordLiveStats(latency time.Duration, status int) {
+	_liveStatsLock.Lock()
+	defer _liveStatsLock.Unlock()
+	_liveStats.Requests++
+	switch {
+	case status >= 500:
+		_liveStats.Errors++
+	case status >= 400:
+		_liveStats.ClientErrors++
+	}
+	_liveLatency += latency
+	if ms := float64(latency) / float64(time.Millisecond); ms > _liveStats.MaxLatency {
+		_liveStats.MaxLatency = ms
+	}
+}
+
+// liveStatsSampler closes statistics of every second
+func liveStatsSampler() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		sampleLiveStats(t)
+	}
+}
+
+// helper function to close statistics of current second and pass them to
+// subscribers of the feed
+func sampleLiveStats(t time.Time) {
+	_liveStatsLock.Lock()
+	defer _liveStatsLock.Unlock()
+	stats := _liveStats
+	stats.Time = t.Unix()
+	if stats.Requests > 0 {
+		stats.Latency = float64(_liveLatency) / float64(time.Millisecond) / float64(stats.Requests)
+	}
+	_liveStats, _liveLatency = LiveStats{}, 0
+	_liveHistory = append(_liveHistory, stats)
+	if len(_liveHistory) > liveStatsWindow {
+		_liveHistory = _liveHistory[len(_liveHistory)-liveStatsWindow:]
+	}
+	for ch := range _liveSubscribers {
+		select {
+		case ch <- stats:
+		default:
+			// slow subscriber misses statistics
+		}
+	}
+}
+
+// LiveEventsHandler streams live serving statistics as server-sent events
+func LiveEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan LiveStats, liveStatsWindow)
+	_liveStatsLock.Lock()
+	history := append([]LiveStats{}, _liveHistory...)
+	_liveSubscribers[ch] = struct{}{}
+	_liveStatsLock.Unlock()
+	defer func() {
+		_liveStatsLock.Lock()
+		delete(_liveSubscribers, ch)
+		_liveStatsLock.Unlock()
+	}()
+
+	setEventStreamHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	for _, stats := range history {
+		if err := writeJSONEvent(w, "stats", stats); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case stats := <-ch:
+			if err := writeJSONEvent(w, "stats", stats); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// tests of livestats module, they do not require TF C library
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLiveStats checks feed of live serving statistics
+func TestLiveStats(t *testing.T) {
+	t.Cleanup(func() {
+		_liveStatsLock.Lock()
+		_liveHistory = nil
+		_liveStatsLock.Unlock()
+	})
+	_liveStatsLock.Lock()
+	_liveStats, _liveLatency, _liveHistory = LiveStats{}, 0, nil
+	_liveStatsLock.Unlock()
+
+	recordLiveStats(2*time.Millisecond, 200)
+	recordLiveStats(4*time.Millisecond, 500)
+	recordLiveStats(6*time.Millisecond, 404)
+	sampleLiveStats(time.Unix(100, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// wait for subscriber of the feed
+		for {
+			_liveStatsLock.Lock()
+			n := len(_liveSubscribers)
+			_liveStatsLock.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		recordLiveStats(time.Millisecond, 200)
+		sampleLiveStats(time.Unix(101, 0))
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	w := httptest.NewRecorder()
+	LiveEventsHandler(w, httptest.NewRequest("GET", "/events", nil).WithContext(ctx))
+	if w.Header().Get("Content-Type") != eventStreamType {
+		t.Fatalf("unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+
+	var stats []LiveStats
+	for _, block := range splitEvents(w.Body.String()) {
+		var s LiveStats
+		if err := json.Unmarshal([]byte(block), &s); err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, s)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+	expect := LiveStats{Time: 100, Requests: 3, Errors: 1, ClientErrors: 1, Latency: 4, MaxLatency: 6}
+	if stats[0] != expect {
+		t.Errorf("unexpected statistics %+v, expected %+v", stats[0], expect)
+	}
+	if stats[1].Time != 101 || stats[1].Requests != 1 {
+		t.Errorf("unexpected statistics of subscriber %+v", stats[1])
+	}
+}
+
+// helper function to return data of stats events
+func splitEvents(body string) []string {
+	var out []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			out = append(out, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return out
+}
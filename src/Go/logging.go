@@ -75,6 +75,17 @@ func (writer logWriter) Write(data []byte) (int, error) {
 	return fmt.Print(utcMsg(data))
 }
 
+// helper function to return IP address of the client of the request
+func requestClientIP(r *http.Request) string {
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff != "" {
+		return strings.Split(xff, ":")[0]
+	} else if r.RemoteAddr != "" {
+		return strings.Split(r.RemoteAddr, ":")[0]
+	}
+	return ""
+}
+
 // helper function to log every single user request, here we pass pointer to status code
 // as it may change through the handler while we use defer logRequest
 func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, status int, tstamp int64, bytesOut int64) {
@@ -83,26 +94,22 @@ func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, status
 	if referer == "" {
 		referer = "-"
 	}
-	var clientip string
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		clientip = strings.Split(xff, ":")[0]
-	} else if r.RemoteAddr != "" {
-		clientip = strings.Split(r.RemoteAddr, ":")[0]
-	}
+	clientip := requestClientIP(r)
 	addr := r.RemoteAddr
 	refMsg := fmt.Sprintf("[ref: \"%s\" \"%v\"]", referer, r.Header.Get("User-Agent"))
 	respMsg := fmt.Sprintf("[req: %v]", time.Since(start))
-	uri, err := url.QueryUnescape(r.RequestURI)
+	// sensitive features of models should not appear in logs
+	requestURI := redactURI(r.RequestURI)
+	uri, err := url.QueryUnescape(requestURI)
 	if err != nil {
 		log.Println("unable to unescape request uri", err)
-		uri = r.RequestURI
+		uri = requestURI
 	}
 	log.Printf("%s %d %s %s %s %s %s %s\n", r.Proto, status, addr, r.Method, uri, dataMsg, refMsg, respMsg)
 	rec := LogRecord{
 		Method:         r.Method,
-		URI:            r.RequestURI,
-		API:            getAPI(r.RequestURI),
+		URI:            requestURI,
+		API:            getAPI(requestURI),
 		BytesIn:        r.ContentLength,
 		BytesOut:       bytesOut,
 		Proto:          r.Proto,
@@ -111,7 +118,7 @@ func logRequest(w http.ResponseWriter, r *http.Request, start time.Time, status
 		Referer:        referer,
 		UserAgent:      r.Header.Get("User-Agent"),
 		XForwardedHost: r.Header.Get("X-Forwarded-Host"),
-		XForwardedFor:  xff,
+		XForwardedFor:  r.Header.Get("X-Forwarded-For"),
 		ClientIP:       clientip,
 		RemoteAddr:     r.RemoteAddr,
 		RequestTime:    time.Since(start).Seconds(),
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -20,12 +23,96 @@ func main() {
 	flag.StringVar(&config, "config", "config.json", "configuration file for our server")
 	var version bool
 	flag.BoolVar(&version, "version", false, "Show version")
+	var check bool
+	flag.BoolVar(&check, "check", false, "Run startup checks and exit")
+	var replayFile, replayTarget, replayModel string
+	flag.StringVar(&replayFile, "replay", "", "replay captured traffic from given file")
+	flag.StringVar(&replayTarget, "replayTarget", "", "URL of the server to replay captured traffic")
+	flag.StringVar(&replayModel, "replayModel", "", "model name to use in replayed requests")
+	var encryptFile, encryptKey string
+	flag.StringVar(&encryptFile, "encrypt", "", "encrypt given model file into <file>.enc and exit")
+	flag.StringVar(&encryptKey, "encryptKey", "", "AES key of model encryption, hex/base64 value or env:, file: or vault: reference")
+	var exportFile, restoreFile string
+	flag.StringVar(&exportFile, "export", "", "export server state (models, aliases and configuration) into given archive and exit")
+	flag.StringVar(&restoreFile, "restore", "", "restore server state from given archive and exit")
 	flag.Parse()
 
 	if version {
 		fmt.Println(info())
 		os.Exit(0)
 	}
+	if check {
+		if err := parseConfig(config); err != nil {
+			log.Fatal(err)
+		}
+		_client = httpClient()
+		setReadOnly(_config.ReadOnly)
+		initLimits()
+		initTFLayer()
+		if !runStartupChecks(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if encryptFile != "" {
+		if strings.HasPrefix(encryptKey, "vault:") {
+			// Vault address and token may be provided by configuration
+			parseConfig(config)
+		}
+		ofile, err := encryptModelFile(encryptFile, encryptKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("encrypted model file", ofile)
+		os.Exit(0)
+	}
+	if exportFile != "" {
+		if err := parseConfig(config); err != nil {
+			log.Fatal(err)
+		}
+		if err := initStateStore(); err != nil {
+			log.Fatal(err)
+		}
+		if err := _aliases.load(); err != nil {
+			log.Fatal(err)
+		}
+		file, err := os.Create(exportFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		manifest, err := exportState(file)
+		if err == nil {
+			err = file.Close()
+		}
+		if err != nil {
+			os.Remove(exportFile)
+			log.Fatal(err)
+		}
+		fmt.Printf("exported %d models and %d aliases into %s\n", len(manifest.Models), manifest.Aliases, exportFile)
+		os.Exit(0)
+	}
+	if restoreFile != "" {
+		_client = httpClient()
+		report, err := restoreState(restoreFile, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		if len(report.Failed) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if replayFile != "" {
+		report, err := replay(httpClient(), replayFile, replayTarget, replayModel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
 	server(config)
 
 }
@@ -0,0 +1,251 @@
+package main
+
+// manifest module provides bulk registration of models
+//
+// New instances can be bootstrapped from manifest which lists many models,
+// e.g.
+//
+//	{"skipExisting": true,
+//	 "models": [
+//	   {"name": "dnn", "url": "https://store.example.com/dnn.tar.gz", "sha256": "..."},
+//	   {"name": "img", "url": "file:///data/bundles/img.tar", "params": {"inputNode": "input_1"}},
+//	   {"mlflow": {"url": "http://mlflow:5000", "name": "higgs", "stage": "Production"}}]}
+//
+// Every entry is either model bundle (tar or tar.gz file, see bundle module)
+// fetched from HTTP(S) URL or local file, with optional sha256 checksum and
+// parameters which override params.json of the bundle, or MLflow model (see
+// mlflow module). The manifest is posted to /models/import endpoint (either
+// in request body or as {"url": "<manifest url>"} reference) or given by
+// "importManifest" option and imported at server start-up. Entries are
+// imported independently and the response reports outcome of every entry.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ImportEntry represents model entry of import manifest
+type ImportEntry struct {
+	Name   string                 `json:"name"`   // model name, default is name of bundle params.json
+	URL    string                 `json:"url"`    // URL or path of model bundle
+	SHA256 string                 `json:"sha256"` // optional checksum of model bundle
+	Params map[string]interface{} `json:"params"` // parameters which override bundle params.json
+	MLflow *MLflowModel           `json:"mlflow"` // MLflow model to import
+}
+
+// ImportManifest represents manifest of bulk model import
+type ImportManifest struct {
+	URL          string        `json:"url"`          // URL or path of manifest to import
+	SkipExisting bool          `json:"skipExisting"` // do not import models which exist in model area
+	Models       []ImportEntry `json:"models"`       // models to import
+}
+
+// ImportResult represents outcome of manifest entry import
+type ImportResult struct {
+	Name   string   `json:"name"`             // model name of the entry
+	Source string   `json:"source"`           // bundle URL or MLflow model
+	Status string   `json:"status"`           // imported, skipped or failed
+	Models []string `json:"models,omitempty"` // installed models
+	Error  string   `json:"error,omitempty"`  // import error
+}
+
+// ImportReport represents outcome of manifest import
+type ImportReport struct {
+	Imported int            `json:"imported"` // number of imported entries
+	Skipped  int            `json:"skipped"`  // number of skipped entries
+	Failed   int            `json:"failed"`   // number of failed entries
+	Results  []ImportResult `json:"results"`  // outcome of every entry
+}
+
+// helper function to open given URL or local file, file:// URLs and plain
+// paths refer to files of the server
+func openSource(uri string) (io.ReadCloser, error) {
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		client := _client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(uri)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", uri, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(strings.TrimPrefix(uri, "file://"))
+}
+
+// helper function to load manifest from given URL or file
+func loadManifest(uri string) (ImportManifest, error) {
+	var manifest ImportManifest
+	reader, err := openSource(uri)
+	if err != nil {
+		return manifest, err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("unable to parse manifest %s: %v", uri, err)
+	}
+	return manifest, nil
+}
+
+// helper function to download model bundle of the entry into temporary file
+// and verify its checksum
+func (e *ImportEntry) download() (string, error) {
+	reader, err := openSource(e.URL)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	file, err := ioutil.TempFile("", "bundle-*.tar")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), reader)
+	file.Close()
+	if err == nil && e.SHA256 != "" && !strings.EqualFold(e.SHA256, hex.EncodeToString(hash.Sum(nil))) {
+		err = errors.New("checksum mismatch of model bundle")
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// helper function to import model bundle of the entry
+func (e *ImportEntry) importBundle() ([]string, error) {
+	fname, err := e.download()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fname)
+	tarball, err := gunzipFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress bundle: %v", err)
+	}
+	if tarball != fname {
+		defer os.Remove(tarball)
+	}
+	return installBundleParams(tarball, e.Name, e.Params)
+}
+
+// importEntry imports given manifest entry
+func importEntry(e ImportEntry, skipExisting bool) ImportResult {
+	res := ImportResult{Name: e.Name, Source: e.URL}
+	if e.MLflow != nil {
+		res.Name = e.MLflow.modelName()
+		res.Source = fmt.Sprintf("mlflow:%s/%s", strings.TrimRight(e.MLflow.URL, "/"), e.MLflow.Name)
+	}
+	switch {
+	case e.MLflow == nil && e.URL == "":
+		res.Status, res.Error = "failed", "entry should provide url or mlflow model"
+		return res
+	case e.MLflow != nil && e.URL != "":
+		res.Status, res.Error = "failed", "entry should provide either url or mlflow model"
+		return res
+	}
+	if skipExisting && modelExists(res.Name) {
+		res.Status = "skipped"
+		return res
+	}
+	var err error
+	if e.MLflow != nil {
+		_, err = e.MLflow.importModel()
+		res.Models = []string{res.Name}
+	} else {
+		res.Models, err = e.importBundle()
+	}
+	if err != nil {
+		res.Status, res.Error, res.Models = "failed", err.Error(), nil
+		log.Printf("unable to import %s: %v", res.Source, err)
+		return res
+	}
+	res.Status = "imported"
+	if e.MLflow == nil {
+		for _, model := range res.Models {
+			startSelfTest(model)
+		}
+	}
+	return res
+}
+
+// importManifest imports all entries of given manifest
+func importManifest(manifest ImportManifest) ImportReport {
+	report := ImportReport{Results: []ImportResult{}}
+	for _, e := range manifest.Models {
+		res := importEntry(e, manifest.SkipExisting)
+		switch res.Status {
+		case "imported":
+			report.Imported++
+		case "skipped":
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Results = append(report.Results, res)
+	}
+	log.Printf("import manifest: %d imported, %d skipped, %d failed", report.Imported, report.Skipped, report.Failed)
+	return report
+}
+
+// helper function to import manifest of "importManifest" option at server
+// start-up, models which exist in model area are not imported again
+func importStartupManifest() {
+	if _config.ImportManifest == "" {
+		return
+	}
+	if isReadOnly() {
+		log.Println("skip import of manifest", _config.ImportManifest, "in read-only mode")
+		return
+	}
+	if !isLeader() {
+		log.Println("skip import of manifest", _config.ImportManifest, "on non-leader replica")
+		return
+	}
+	manifest, err := loadManifest(_config.ImportManifest)
+	if err != nil {
+		log.Println("unable to load manifest", err)
+		return
+	}
+	manifest.SkipExisting = true
+	importManifest(manifest)
+}
+
+// ImportHandler registers models listed in manifest
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var manifest ImportManifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		responseError(w, "unable to decode manifest", err, http.StatusBadRequest)
+		return
+	}
+	if manifest.URL != "" {
+		skip := manifest.SkipExisting
+		m, err := loadManifest(manifest.URL)
+		if err != nil {
+			responseError(w, "unable to load manifest", err, http.StatusBadRequest)
+			return
+		}
+		manifest = m
+		manifest.SkipExisting = manifest.SkipExisting || skip
+	}
+	if len(manifest.Models) == 0 {
+		responseError(w, "manifest does not list models", nil, http.StatusBadRequest)
+		return
+	}
+	responseJSON(w, importManifest(manifest))
+}
@@ -0,0 +1,95 @@
+package main
+
+// tests of bulk model import, they do not require TF C library
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestImportManifest checks registration of models listed in manifest
+func TestImportManifest(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+
+	bundle := testBundle(t, "remote")
+	sum := sha256.Sum256(bundle)
+	var manifestURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/remote.tar.gz":
+			w.Write(bundle)
+		case "/manifest.json":
+			fmt.Fprintf(w, `{"models": [{"name": "bootstrap", "url": "%s/remote.tar.gz", "params": {"name": "bootstrap"}}]}`, manifestURL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	manifestURL = srv.URL
+	local := filepath.Join(t.TempDir(), "local.tar.gz")
+	ioutil.WriteFile(local, testBundle(t, "local"), 0644)
+
+	manifest := ImportManifest{Models: []ImportEntry{
+		{URL: srv.URL + "/remote.tar.gz", SHA256: hex.EncodeToString(sum[:])},
+		{Name: "renamed", URL: "file://" + local, Params: map[string]interface{}{"name": "renamed", "description": "imported"}},
+		{Name: "corrupted", URL: srv.URL + "/remote.tar.gz", SHA256: "00"},
+		{Name: "missing", URL: srv.URL + "/missing.tar.gz"},
+		{Name: "empty"},
+	}}
+	data, _ := json.Marshal(manifest)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/models/import", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var report ImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Imported != 2 || report.Failed != 3 || len(report.Results) != 5 {
+		t.Fatalf("unexpected import report %+v", report)
+	}
+	for i, status := range []string{"imported", "imported", "failed", "failed", "failed"} {
+		if report.Results[i].Status != status {
+			t.Errorf("entry %d: status %s, expected %s", i, report.Results[i].Status, status)
+		}
+	}
+	if !modelExists("remote") || !modelExists("renamed") || modelExists("corrupted") {
+		t.Fatal("models of manifest are not installed")
+	}
+	params, err := getModelParams("renamed")
+	if err != nil || params.Description != "imported" || params.Model != "model.pb" {
+		t.Errorf("parameters of manifest entry are not applied %+v %v", params, err)
+	}
+
+	// manifest referenced by URL, existing models are skipped
+	data, _ = json.Marshal(ImportManifest{URL: srv.URL + "/manifest.json"})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/models/import", bytes.NewReader(data)))
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.Imported != 1 || !modelExists("bootstrap") {
+		t.Fatalf("unable to import manifest by URL, status %d %s", w.Code, w.Body.String())
+	}
+	data, _ = json.Marshal(ImportManifest{URL: srv.URL + "/manifest.json", SkipExisting: true})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/models/import", bytes.NewReader(data)))
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Skipped != 1 || report.Imported != 0 {
+		t.Errorf("existing model is not skipped %+v", report)
+	}
+
+	// manifest without models is rejected
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/models/import", bytes.NewBufferString(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code %d of empty manifest", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+// metrics module provides server metrics in Prometheus text format
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// helper function to format labels of Prometheus metric
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// MetricsHandler provides server metrics in Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "# HELP tfaas_uptime_seconds time since server start\n")
+	fmt.Fprintf(w, "# TYPE tfaas_uptime_seconds gauge\n")
+	fmt.Fprintf(w, "tfaas_uptime_seconds %f\n", time.Since(Time0).Seconds())
+	fmt.Fprintf(w, "# HELP tfaas_requests_total number of received requests\n")
+	fmt.Fprintf(w, "# TYPE tfaas_requests_total counter\n")
+	fmt.Fprintf(w, "tfaas_requests_total%s %d\n", metricLabels("method", "GET"), atomic.LoadUint64(&TotalGetRequests))
+	fmt.Fprintf(w, "tfaas_requests_total%s %d\n", metricLabels("method", "POST"), atomic.LoadUint64(&TotalPostRequests))
+	fmt.Fprintf(w, "tfaas_requests_total%s %d\n", metricLabels("method", "DELETE"), atomic.LoadUint64(&TotalDeleteRequests))
+
+	accounts := _accounting.report()
+	fmt.Fprintf(w, "# HELP tfaas_client_cpu_seconds_total CPU time apportioned to clients\n")
+	fmt.Fprintf(w, "# TYPE tfaas_client_cpu_seconds_total counter\n")
+	for _, acc := range accounts.Clients {
+		fmt.Fprintf(w, "tfaas_client_cpu_seconds_total%s %f\n", metricLabels("client", acc.Client), acc.CPUSeconds)
+	}
+	if accounts.GPU {
+		fmt.Fprintf(w, "# HELP tfaas_client_gpu_seconds_total GPU time apportioned to clients\n")
+		fmt.Fprintf(w, "# TYPE tfaas_client_gpu_seconds_total counter\n")
+		for _, acc := range accounts.Clients {
+			fmt.Fprintf(w, "tfaas_client_gpu_seconds_total%s %f\n", metricLabels("client", acc.Client), acc.GPUSeconds)
+		}
+	}
+
+	if counts := fallbackCounts(); len(counts) > 0 {
+		fmt.Fprintf(w, "# HELP tfaas_fallbacks_total number of fallback responses of failing models\n")
+		fmt.Fprintf(w, "# TYPE tfaas_fallbacks_total counter\n")
+		for _, c := range counts {
+			fmt.Fprintf(w, "tfaas_fallbacks_total%s %d\n", metricLabels("model", c.Model, "kind", c.Kind), c.Count)
+		}
+	}
+
+	writeKafkaMetrics(w)
+	writeDeadLetterMetrics(w)
+	writeResultKeysMetrics(w)
+	writeResultSinkMetrics(w)
+	writeDedupMetrics(w)
+	writeProxyMetrics(w)
+	writeBatchingMetrics(w)
+
+	reports := sloReports()
+	if len(reports) == 0 {
+		return
+	}
+	metrics := []struct {
+		name, help string
+		value      func(SLOReport) float64
+	}{
+		{"tfaas_slo_requests", "number of requests in SLO window", func(r SLOReport) float64 { return float64(r.Requests) }},
+		{"tfaas_slo_latency_compliance", "fraction of requests faster than SLO latency", func(r SLOReport) float64 { return r.LatencyCompliance }},
+		{"tfaas_slo_error_compliance", "fraction of successful requests", func(r SLOReport) float64 { return r.ErrorCompliance }},
+		{"tfaas_slo_latency_burn_rate", "burn rate of SLO latency budget", func(r SLOReport) float64 { return r.LatencyBurnRate }},
+		{"tfaas_slo_error_burn_rate", "burn rate of SLO errors budget", func(r SLOReport) float64 { return r.ErrorBurnRate }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		for _, rep := range reports {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, metricLabels("endpoint", rep.Endpoint, "model", rep.Model), m.value(rep))
+		}
+	}
+}
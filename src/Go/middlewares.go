@@ -117,6 +117,13 @@ func (rw *responseWriter) WriteHeader(code int) {
 	return
 }
 
+// Flush implements http.Flusher interface for streamed responses
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // loggingMiddleware logs the incoming HTTP request and its duration.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -137,6 +144,11 @@ func loggingMiddleware(next http.Handler) http.Handler {
 			status = 200
 		}
 		next.ServeHTTP(wrapped, r)
+		observeEndpointSLO(r.URL.Path, time.Since(start), wrapped.status)
+		if r.URL.Path != basePath("/events") {
+			// the feed itself is long-lived request
+			recordLiveStats(time.Since(start), wrapped.status)
+		}
 		var dataSize int64
 		logRequest(w, r, start, wrapped.status, tstamp, dataSize)
 	})
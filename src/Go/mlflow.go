@@ -0,0 +1,303 @@
+package main
+
+// mlflow module provides integration with MLflow model registry
+//
+// The server can import TF models registered in MLflow, e.g.
+// "mlflow": [{"url": "http://mlflow:5000", "name": "dnn", "stage": "Production",
+//             "model": "dnn_prod", "artifactPath": "data/model", "interval": 600}]
+// For every entry the latest model version of given stage is downloaded from
+// MLflow tracking server and installed into model area. If interval is set the
+// server periodically polls MLflow registry for new model versions.
+// The MLFLOW_TRACKING_TOKEN environment variable can be used to provide
+// authorization token for MLflow tracking server.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MLflowModel represents MLflow model registry entry we import
+type MLflowModel struct {
+	URL          string `json:"url"`          // MLflow tracking server URL
+	Name         string `json:"name"`         // MLflow registered model name
+	Stage        string `json:"stage"`        // MLflow model stage, e.g. Production
+	Model        string `json:"model"`        // TFaaS model name, default is MLflow model name
+	ArtifactPath string `json:"artifactPath"` // path to TF model within model artifacts, e.g. data/model
+	Interval     int    `json:"interval"`     // polling interval in seconds
+}
+
+// MLflowModelVersion represents MLflow model version record
+type MLflowModelVersion struct {
+	Name         string `json:"name"`          // model name
+	Version      string `json:"version"`       // model version
+	CurrentStage string `json:"current_stage"` // model stage
+	Source       string `json:"source"`        // model artifacts source
+	RunID        string `json:"run_id"`        // model run id
+}
+
+// MLflowFile represents MLflow artifact file record
+type MLflowFile struct {
+	Path  string `json:"path"`   // artifact path
+	IsDir bool   `json:"is_dir"` // artifact is directory
+	Size  int64  `json:"file_size"`
+}
+
+// keep track of imported MLflow model versions
+var (
+	_mlflowVersions = make(map[string]string)
+	mlflowLock      sync.Mutex
+)
+
+// helper function to return TFaaS model name of MLflow model
+func (m *MLflowModel) modelName() string {
+	if m.Model != "" {
+		return m.Model
+	}
+	return m.Name
+}
+
+// helper function to place GET request to MLflow tracking server
+func (m *MLflowModel) get(api string, args url.Values) (*http.Response, error) {
+	rurl := fmt.Sprintf("%s/%s?%s", strings.TrimRight(m.URL, "/"), api, args.Encode())
+	req, err := http.NewRequest("GET", rurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("MLFLOW_TRACKING_TOKEN"); token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := _client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("MLflow request %s failed with status %s", rurl, resp.Status)
+	}
+	return resp, nil
+}
+
+// helper function to fetch JSON data from MLflow tracking server
+func (m *MLflowModel) fetch(api string, args url.Values, rec interface{}) error {
+	resp, err := m.get(api, args)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(rec)
+}
+
+// latestVersion returns latest model version of given stage
+func (m *MLflowModel) latestVersion() (MLflowModelVersion, error) {
+	var version MLflowModelVersion
+	args := url.Values{}
+	args.Set("name", m.Name)
+	if m.Stage != "" {
+		args.Set("stages", m.Stage)
+	}
+	var rec struct {
+		ModelVersions []MLflowModelVersion `json:"model_versions"`
+	}
+	err := m.fetch("api/2.0/mlflow/registered-models/get-latest-versions", args, &rec)
+	if err != nil {
+		return version, err
+	}
+	if len(rec.ModelVersions) == 0 {
+		return version, fmt.Errorf("MLflow model %s does not have versions in stage '%s'", m.Name, m.Stage)
+	}
+	return rec.ModelVersions[0], nil
+}
+
+// helper function to list (recursively) run artifacts of given path
+func (m *MLflowModel) listArtifacts(runID, path string) ([]MLflowFile, error) {
+	var out []MLflowFile
+	args := url.Values{}
+	args.Set("run_id", runID)
+	args.Set("path", path)
+	var rec struct {
+		Files []MLflowFile `json:"files"`
+	}
+	if err := m.fetch("api/2.0/mlflow/artifacts/list", args, &rec); err != nil {
+		return out, err
+	}
+	for _, f := range rec.Files {
+		if f.IsDir {
+			files, err := m.listArtifacts(runID, f.Path)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, files...)
+			continue
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// helper function to download run artifact into given file
+func (m *MLflowModel) downloadArtifact(runID, path, fname string) error {
+	args := url.Values{}
+	args.Set("run_uuid", runID)
+	args.Set("path", path)
+	resp, err := m.get("get-artifact", args)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
+
+// helper function to get artifacts path of model version relative to its run,
+// e.g. source s3://bucket/1/<run_id>/artifacts/model gives model path
+func artifactsPath(source string) string {
+	if strings.HasPrefix(source, "runs:/") {
+		arr := strings.SplitN(strings.TrimPrefix(source, "runs:/"), "/", 2)
+		if len(arr) == 2 {
+			return arr[1]
+		}
+		return ""
+	}
+	if idx := strings.Index(source, "/artifacts/"); idx != -1 {
+		return source[idx+len("/artifacts/"):]
+	}
+	return filepath.Base(source)
+}
+
+// importModel imports latest MLflow model version into model area, it
+// returns imported version or empty string if model is already up to date
+func (m *MLflowModel) importModel() (string, error) {
+	if m.URL == "" || m.Name == "" {
+		return "", errors.New("MLflow model should provide url and name")
+	}
+	version, err := m.latestVersion()
+	if err != nil {
+		return "", err
+	}
+	name := m.modelName()
+	key := fmt.Sprintf("%s/%s", m.URL, name)
+	mlflowLock.Lock()
+	defer mlflowLock.Unlock()
+	if _mlflowVersions[key] == version.Version && modelExists(name) {
+		return "", nil
+	}
+	if version.RunID == "" {
+		return "", fmt.Errorf("MLflow model %s version %s does not provide run id", m.Name, version.Version)
+	}
+	staging, err := stagingDir()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	// download TF model artifacts into staging area
+	prefix := artifactsPath(version.Source)
+	if m.ArtifactPath != "" {
+		prefix = strings.Trim(fmt.Sprintf("%s/%s", prefix, m.ArtifactPath), "/")
+	}
+	files, err := m.listArtifacts(version.RunID, prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("MLflow model %s version %s does not have artifacts in %s", m.Name, version.Version, prefix)
+	}
+	for _, f := range files {
+		rel := strings.TrimPrefix(strings.TrimPrefix(f.Path, prefix), "/")
+		fname := filepath.Join(staging, filepath.Clean("/"+rel))
+		if err := m.downloadArtifact(version.RunID, f.Path, fname); err != nil {
+			return "", err
+		}
+	}
+
+	// provide model parameters if MLflow artifacts do not have them, model
+	// parameters of artifacts should use TFaaS model name
+	pfile := filepath.Join(staging, "params.json")
+	if _, err := os.Stat(pfile); err == nil {
+		if err := overrideParams(pfile, map[string]interface{}{"name": name}); err != nil {
+			return "", err
+		}
+	} else if os.IsNotExist(err) {
+		params := TFParams{
+			Name:        name,
+			Description: fmt.Sprintf("MLflow model %s version %s stage %s", m.Name, version.Version, version.CurrentStage),
+			TimeStamp:   time.Now().String(),
+		}
+		data, err := json.MarshalIndent(params, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(pfile, data, 0644); err != nil {
+			return "", err
+		}
+	}
+	if err := installModel(staging, name); err != nil {
+		return "", err
+	}
+	_mlflowVersions[key] = version.Version
+	log.Printf("imported MLflow model %s version %s as %s", m.Name, version.Version, name)
+	startSelfTest(name)
+	return version.Version, nil
+}
+
+// mlflowPoller imports given MLflow model and polls MLflow registry for its
+// new versions
+func mlflowPoller(m MLflowModel) {
+	for {
+		// model area is not changed in read-only mode
+		if isReadOnly() {
+			log.Println("skip import of MLflow model", m.Name, "in read-only mode")
+		} else if !isLeader() {
+			log.Println("skip import of MLflow model", m.Name, "on non-leader replica")
+		} else if _, err := m.importModel(); err != nil {
+			log.Println("unable to import MLflow model", m.Name, err)
+		}
+		if m.Interval <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(m.Interval) * time.Second)
+	}
+}
+
+// MLflowHandler imports given MLflow model into the server
+func MLflowHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var m MLflowModel
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		responseError(w, "unable to decode MLflow request", err, http.StatusBadRequest)
+		return
+	}
+	version, err := m.importModel()
+	if err != nil {
+		responseError(w, "unable to import MLflow model", err, http.StatusBadRequest)
+		return
+	}
+	rec := make(map[string]string)
+	rec["model"] = m.modelName()
+	rec["version"] = version
+	if version == "" {
+		rec["status"] = "up to date"
+	} else {
+		rec["status"] = "imported"
+	}
+	responseJSON(w, rec)
+}
@@ -0,0 +1,176 @@
+package main
+
+// tests of MLflow model registry integration, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMLflow represents MLflow tracking server with single registered model
+type fakeMLflow struct {
+	Version   MLflowModelVersion
+	Artifacts map[string]string // artifacts of the run, file path and its content
+	Token     string            // last authorization header
+	mutex     sync.Mutex
+}
+
+// ServeHTTP implements http.Handler interface
+func (f *fakeMLflow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Token = r.Header.Get("Authorization")
+	switch r.URL.Path {
+	case "/api/2.0/mlflow/registered-models/get-latest-versions":
+		var versions []MLflowModelVersion
+		if r.FormValue("name") == f.Version.Name && r.FormValue("stages") == f.Version.CurrentStage {
+			versions = append(versions, f.Version)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"model_versions": versions})
+	case "/api/2.0/mlflow/artifacts/list":
+		// list files and directories right under requested path
+		path := r.FormValue("path")
+		files := []MLflowFile{}
+		dirs := make(map[string]bool)
+		for fname, data := range f.Artifacts {
+			if !strings.HasPrefix(fname, path+"/") {
+				continue
+			}
+			rel := strings.TrimPrefix(fname, path+"/")
+			if idx := strings.Index(rel, "/"); idx != -1 {
+				dir := path + "/" + rel[:idx]
+				if !dirs[dir] {
+					files = append(files, MLflowFile{Path: dir, IsDir: true})
+				}
+				dirs[dir] = true
+				continue
+			}
+			files = append(files, MLflowFile{Path: fname, Size: int64(len(data))})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+	case "/get-artifact":
+		data, ok := f.Artifacts[r.FormValue("path")]
+		if !ok || r.FormValue("run_uuid") != f.Version.RunID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(data))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// helper function to start fake MLflow tracking server
+func startFakeMLflow(t *testing.T) (*fakeMLflow, *httptest.Server) {
+	if _client == nil {
+		_client = http.DefaultClient
+		t.Cleanup(func() { _client = nil })
+	}
+	params, _ := json.Marshal(TFParams{Model: "model.pb", Labels: "labels.txt", InputNode: "input", OutputNode: "output"})
+	mlflow := &fakeMLflow{
+		Version: MLflowModelVersion{Name: "dnn", Version: "1", CurrentStage: "Production", RunID: "abc", Source: "s3://bucket/1/abc/artifacts/model"},
+		Artifacts: map[string]string{
+			"model/data/model/params.json":      string(params),
+			"model/data/model/model.pb":         "mlflow v1",
+			"model/data/model/labels.txt":       "a\nb\nc\n",
+			"model/data/model/assets/vocab.txt": "hello\n",
+			"model/MLmodel":                     "flavors: {}",
+		},
+	}
+	server := httptest.NewServer(mlflow)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		mlflowLock.Lock()
+		_mlflowVersions = make(map[string]string)
+		mlflowLock.Unlock()
+	})
+	return mlflow, server
+}
+
+// TestMLflowImport checks import of latest versions of MLflow models
+func TestMLflowImport(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	mlflow, server := startFakeMLflow(t)
+	t.Setenv("MLFLOW_TRACKING_TOKEN", "secret")
+	m := MLflowModel{URL: server.URL, Name: "dnn", Stage: "Production", Model: "mlflow", ArtifactPath: "data/model"}
+
+	version, err := m.importModel()
+	if err != nil || version != "1" {
+		t.Fatalf("unable to import MLflow model, version %s: %v", version, err)
+	}
+	if def := modelDefinition(t, "mlflow"); def != "mlflow v1" {
+		t.Fatalf("wrong definition %s of imported model", def)
+	}
+	if _, err := os.Stat(filepath.Join(_config.ModelDir, "mlflow", "assets", "vocab.txt")); err != nil {
+		t.Fatalf("nested artifacts are not imported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(_config.ModelDir, "mlflow", "MLmodel")); !os.IsNotExist(err) {
+		t.Fatalf("artifacts outside of artifact path are imported: %v", err)
+	}
+	if mlflow.Token != "Bearer secret" {
+		t.Fatalf("wrong authorization header '%s'", mlflow.Token)
+	}
+	if _, err := predictRow(testRow("mlflow")); err != nil {
+		t.Fatal(err)
+	}
+
+	// model is imported again only when its version changes
+	if version, err := m.importModel(); err != nil || version != "" {
+		t.Fatalf("model is imported again, version %s: %v", version, err)
+	}
+	mlflow.mutex.Lock()
+	mlflow.Version.Version = "2"
+	mlflow.Artifacts["model/data/model/model.pb"] = "mlflow v2"
+	mlflow.mutex.Unlock()
+	data, _ := json.Marshal(m)
+	w := httptest.NewRecorder()
+	MLflowHandler(w, httptest.NewRequest("POST", "/mlflow", bytes.NewReader(data)))
+	var rec map[string]string
+	json.Unmarshal(w.Body.Bytes(), &rec)
+	if w.Code != http.StatusOK || rec["status"] != "imported" || rec["version"] != "2" || rec["model"] != "mlflow" {
+		t.Fatalf("wrong import of new model version %d %s", w.Code, w.Body.String())
+	}
+	if def := modelDefinition(t, "mlflow"); def != "mlflow v2" {
+		t.Fatalf("wrong definition %s of imported model", def)
+	}
+	if versions, _ := modelVersions("mlflow"); len(versions) != 1 {
+		t.Fatalf("previous model version is not kept %+v", versions)
+	}
+
+	// unknown stage and missing artifacts
+	for _, bad := range []MLflowModel{
+		{URL: server.URL, Name: "dnn", Stage: "Staging"},
+		{URL: server.URL, Name: "dnn", Stage: "Production", ArtifactPath: "unknown"},
+		{Name: "dnn"},
+	} {
+		data, _ := json.Marshal(bad)
+		w := httptest.NewRecorder()
+		MLflowHandler(w, httptest.NewRequest("POST", "/mlflow", bytes.NewReader(data)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("wrong status code %d of import of %+v", w.Code, bad)
+		}
+	}
+}
+
+// TestArtifactsPath checks artifacts path of MLflow model sources
+func TestArtifactsPath(t *testing.T) {
+	tests := map[string]string{
+		"s3://bucket/1/abc/artifacts/model":  "model",
+		"runs:/abc/model/data":               "model/data",
+		"runs:/abc":                          "",
+		"/mlruns/1/abc/artifacts/tf/model":   "tf/model",
+		"mlflow-artifacts:/models/dnn/model": "model",
+	}
+	for source, path := range tests {
+		if p := artifactsPath(source); p != path {
+			t.Errorf("wrong artifacts path %s of %s, expected %s", p, source, path)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// tests of MQTT ingestion mode, they do not require TF C library
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTopicMatch checks matching of MQTT topic filters
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"lab/d1/features", "lab/d1/features", true},
+		{"lab/d1/features", "lab/d2/features", false},
+		{"lab/+/features", "lab/d2/features", true},
+		{"lab/+/features", "lab/d2/features/dnn", false},
+		{"lab/#", "lab/d2/features/dnn", true},
+		{"lab/+", "lab", false},
+	}
+	for _, tt := range tests {
+		if topicMatch(tt.filter, tt.topic) != tt.match {
+			t.Errorf("filter %s topic %s expected match %v", tt.filter, tt.topic, tt.match)
+		}
+	}
+}
+
+// TestMQTTIngestion checks scoring of MQTT messages
+func TestMQTTIngestion(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_config.MQTTURL = "mqtt://user:secret@" + listener.Addr().String()
+	_config.MQTTTopics = []MQTTTopic{
+		{Input: "lab/d1/features", Model: "dnn", Output: "lab/d1/scores"},
+		{Input: "lab/+/features/+"},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		initMQTT()
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	ptype, _, body, err := readMQTTPacket(reader)
+	if err != nil || ptype != mqttConnect {
+		t.Fatalf("unexpected CONNECT packet %d: %v", ptype, err)
+	}
+	if !strings.Contains(string(body), "secret") || body[7]&0xc0 != 0xc0 {
+		t.Errorf("CONNECT packet does not provide credentials %q", body)
+	}
+	writeMQTTPacket(conn, mqttConnAck, 0, []byte{0, 0})
+	ptype, flags, body, err := readMQTTPacket(reader)
+	if err != nil || ptype != mqttSubscribe || flags != 0x02 {
+		t.Fatalf("unexpected SUBSCRIBE packet %d: %v", ptype, err)
+	}
+	if !strings.Contains(string(body), "lab/d1/features") || !strings.Contains(string(body), "lab/+/features/+") {
+		t.Errorf("SUBSCRIBE packet does not provide topics %q", body)
+	}
+	<-done
+
+	send := func(topic string, data []byte) (string, MQTTResult) {
+		writeMQTTPacket(conn, mqttPublish, 0, append(appendMQTTString(nil, topic), data...))
+		ptype, _, body, err := readMQTTPacket(reader)
+		if err != nil || ptype != mqttPublish {
+			t.Fatalf("unexpected PUBLISH packet %d: %v", ptype, err)
+		}
+		size := int(binary.BigEndian.Uint16(body))
+		var result MQTTResult
+		if err := json.Unmarshal(body[2+size:], &result); err != nil {
+			t.Fatal(err)
+		}
+		return string(body[2 : 2+size]), result
+	}
+	data, err := json.Marshal(testRow(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, result := send("lab/d1/features", data)
+	if output != "lab/d1/scores" || result.Model != "dnn" || result.Error != "" {
+		t.Fatalf("unexpected result %s %+v", output, result)
+	}
+	checkProbs(t, result.Predictions)
+	output, result = send("lab/d2/features/dnn2", data)
+	if output != "tfaas/predictions/dnn2" || result.Topic != "lab/d2/features/dnn2" || result.Model != "dnn2" {
+		t.Fatalf("unexpected result %s %+v", output, result)
+	}
+	checkProbs(t, result.Predictions)
+	if _, result = send("lab/d2/features/dnn", []byte("{")); !strings.Contains(result.Error, "unable to unmarshal Row") {
+		t.Errorf("unexpected error %+v", result)
+	}
+}
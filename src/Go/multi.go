@@ -0,0 +1,95 @@
+package main
+
+// multi module provides predictions of several models for the same row
+//
+// POST /predict/multi with
+// {"models": ["dnn", "dnn2"], "keys": [...], "values": [...]}
+// scores the row against every model concurrently and returns map of
+// model predictions, e.g.
+// {"predictions": {"dnn": [0.2, 0.8], "dnn2": [0.3, 0.7]}}
+// Models which failed to make predictions are reported in "errors" map, the
+// request fails only if none of the models succeeded.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// MultiRow represents row which is scored against several models
+type MultiRow struct {
+	Row
+	Models []string `json:"models"` // list of models to use
+}
+
+// MultiResult represents predictions of several models
+type MultiResult struct {
+	Predictions map[string][]float32 `json:"predictions"`       // model predictions
+	Errors      map[string]string    `json:"errors,omitempty"`  // model errors
+	EventID     string               `json:"eventID,omitempty"` // client event identifier of the row
+}
+
+// helper function to make predictions of given row for list of models, the
+// predictions are accounted to given client in usage analytics
+func makeMultiPredictions(mrow *MultiRow, client string) (MultiResult, error) {
+	res := MultiResult{
+		Predictions: make(map[string][]float32),
+		Errors:      make(map[string]string),
+		EventID:     mrow.EventID,
+	}
+	if len(mrow.Models) == 0 {
+		return res, errors.New("no models are provided")
+	}
+	if err := checkEventID(&mrow.Row); err != nil {
+		return res, err
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	for _, model := range mrow.Models {
+		if seen[model] {
+			continue
+		}
+		seen[model] = true
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			row := mrow.Row
+			row.Model = model
+			observeUsage(client, model, 1)
+			probs, err := makePredictions(&row)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				res.Errors[model] = err.Error()
+				publish(EventPredictionFailed, model, err.Error())
+				return
+			}
+			logPrediction(&row, model, probs)
+			res.Predictions[model] = probs
+		}(model)
+	}
+	wg.Wait()
+	if len(res.Predictions) == 0 {
+		return res, fmt.Errorf("all models failed: %v", res.Errors)
+	}
+	return res, nil
+}
+
+// MultiPredictHandler provides predictions of several models for the same row
+func MultiPredictHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var mrow MultiRow
+	if err := json.NewDecoder(r.Body).Decode(&mrow); err != nil {
+		responseError(w, "unable to unmarshal MultiRow", err, http.StatusBadRequest)
+		return
+	}
+	res, err := makeMultiPredictions(&mrow, usageClient(r))
+	if err != nil {
+		responseError(w, "MultiPredictHandler: unable to make predictions", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, res)
+}
@@ -0,0 +1,49 @@
+package main
+
+// tests of multi-model predictions, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestFakeMultiPredictions checks predictions of several models for the same row
+func TestFakeMultiPredictions(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	mrow := MultiRow{Row: *testRow(""), Models: []string{"dnn", "dnn2", "dnn", "missing"}}
+	data, err := json.Marshal(mrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/multi", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var res MultiResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Predictions) != 2 || len(res.Errors) != 1 || res.Errors["missing"] == "" {
+		t.Fatalf("unexpected multi-model result %+v", res)
+	}
+	for _, model := range []string{"dnn", "dnn2"} {
+		checkProbs(t, res.Predictions[model])
+	}
+	if fake.Runs != 2 {
+		t.Errorf("wrong number of session runs %d", fake.Runs)
+	}
+
+	// request fails if none of the models succeeded
+	data, _ = json.Marshal(MultiRow{Row: *testRow(""), Models: []string{"missing"}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/multi", bytes.NewReader(data)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code %d of failed models", w.Code)
+	}
+}
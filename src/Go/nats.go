@@ -0,0 +1,348 @@
+package main
+
+// nats module provides minimal client of NATS messaging system
+// see https://docs.nats.io/reference/reference-protocols/nats-protocol
+//
+// Besides event sink it provides NATS request/reply serving mode: when
+// "natsURL" is configured the server subscribes to <natsPrefix>.<model>
+// subjects (default prefix is tfaas.predict) within "natsQueue" queue group
+// (default tfaas), such that requests are balanced among server replicas,
+// and replies to JSON Row messages with JSON list of predictions or
+// {"error": "..."} message.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default subject prefix of NATS serving mode
+const defaultNATSPrefix = "tfaas.predict"
+
+// default queue group of NATS serving mode
+const defaultNATSQueue = "tfaas"
+
+// NATSMsg represents message delivered by NATS server
+type NATSMsg struct {
+	Subject string // message subject
+	Reply   string // reply subject
+	Data    []byte // message payload
+}
+
+// natsSub represents NATS subscription
+type natsSub struct {
+	subject string            // subscription subject
+	queue   string            // queue group
+	handler func(msg NATSMsg) // message handler
+}
+
+// NATSConn represents connection to NATS server
+type NATSConn struct {
+	URL    string   // NATS server URL, e.g. nats://host:4222
+	conn   net.Conn // network connection
+	writer *bufio.Writer
+	mutex  sync.Mutex
+	subs   []natsSub // subscriptions, their index+1 is subscription id
+}
+
+// newNATSConn creates new (lazy) NATS connection
+func newNATSConn(rurl string) *NATSConn {
+	return &NATSConn{URL: rurl}
+}
+
+// connect establishes connection to NATS server
+func (c *NATSConn) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	uri, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	host := uri.Host
+	if host == "" {
+		host = c.URL
+	}
+	if !strings.Contains(host, ":") {
+		host = fmt.Sprintf("%s:4222", host)
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	// server sends INFO message upon connection
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS server greeting: %s", line)
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "tfaas", "lang": "go"}
+	if uri.User != nil {
+		opts["user"] = uri.User.Username()
+		if pass, ok := uri.User.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\n", data)
+	// restore subscriptions of previous connection
+	for i, sub := range c.subs {
+		writeSub(writer, sub, i+1)
+	}
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	c.conn = conn
+	c.writer = writer
+	go c.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop reads server messages and answers server pings
+func (c *NATSConn) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.reset(conn)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			c.mutex.Lock()
+			if c.conn == conn {
+				c.writer.WriteString("PONG\r\n")
+				c.writer.Flush()
+			}
+			c.mutex.Unlock()
+		case strings.HasPrefix(line, "MSG "):
+			msg, sid, err := readMsg(reader, line)
+			if err != nil {
+				log.Println("unable to read NATS message", err)
+				c.reset(conn)
+				return
+			}
+			c.mutex.Lock()
+			var handler func(NATSMsg)
+			if sid > 0 && sid <= len(c.subs) {
+				handler = c.subs[sid-1].handler
+			}
+			c.mutex.Unlock()
+			if handler != nil {
+				go handler(msg)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			log.Println("NATS error", line)
+		}
+	}
+}
+
+// helper function to read message payload of given MSG line, i.e.
+// MSG <subject> <sid> [reply-to] <#bytes>
+func readMsg(reader *bufio.Reader, line string) (NATSMsg, int, error) {
+	var msg NATSMsg
+	fields := strings.Fields(line)
+	if len(fields) != 4 && len(fields) != 5 {
+		return msg, 0, fmt.Errorf("malformed NATS message %s", line)
+	}
+	msg.Subject = fields[1]
+	sid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return msg, 0, err
+	}
+	if len(fields) == 5 {
+		msg.Reply = fields[3]
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return msg, 0, err
+	}
+	// payload is followed by CRLF
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return msg, 0, err
+	}
+	msg.Data = data[:size]
+	return msg, sid, nil
+}
+
+// helper function to write SUB command of given subscription
+func writeSub(writer *bufio.Writer, sub natsSub, sid int) {
+	if sub.queue != "" {
+		fmt.Fprintf(writer, "SUB %s %s %d\r\n", sub.subject, sub.queue, sid)
+	} else {
+		fmt.Fprintf(writer, "SUB %s %d\r\n", sub.subject, sid)
+	}
+}
+
+// subscribe subscribes given handler to NATS subject within queue group,
+// subscriptions are restored when connection is re-established
+func (c *NATSConn) subscribe(subject, queue string, handler func(msg NATSMsg)) error {
+	if subject == "" {
+		return errors.New("empty NATS subject")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sub := natsSub{subject: subject, queue: queue, handler: handler}
+	c.subs = append(c.subs, sub)
+	if c.conn == nil {
+		// new connection subscribes to all subjects
+		return c.connect()
+	}
+	writeSub(c.writer, sub, len(c.subs))
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.writer = nil
+		return err
+	}
+	return nil
+}
+
+// keepAlive re-establishes lost connection with given interval
+func (c *NATSConn) keepAlive(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		c.mutex.Lock()
+		if err := c.connect(); err != nil {
+			log.Println("unable to connect to NATS server", c.URL, err)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// reset closes given connection if it is still in use
+func (c *NATSConn) reset(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == conn {
+		c.conn.Close()
+		c.conn = nil
+		c.writer = nil
+	}
+}
+
+// publish sends given payload to NATS subject
+func (c *NATSConn) publish(subject string, data []byte) error {
+	if subject == "" {
+		return errors.New("empty NATS subject")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.connect(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.writer, "PUB %s %d\r\n", subject, len(data))
+	c.writer.Write(data)
+	c.writer.WriteString("\r\n")
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.writer = nil
+		return err
+	}
+	return nil
+}
+
+// NATSSink publishes events to NATS subject
+type NATSSink struct {
+	Conn    *NATSConn // NATS connection
+	Subject string    // NATS subject
+}
+
+// Publish implements EventSink interface
+func (s *NATSSink) Publish(evt Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return s.Conn.publish(s.Subject, data)
+}
+
+// helper function to answer NATS prediction request of given model
+func natsPredict(model string, msg NATSMsg) []byte {
+	row := &Row{}
+	if err := json.Unmarshal(msg.Data, row); err != nil {
+		deadLetter("nats", msg.Subject, row.EventID, model, deadLetterValidation, msg.Data, err)
+		return natsError("unable to unmarshal Row", err)
+	}
+	row.Model = model
+	if mode := drainMode(); mode.Draining {
+		return natsError(mode.Message, nil)
+	}
+	if err := validatePayload(model, msg.Data); err != nil {
+		deadLetter("nats", msg.Subject, row.EventID, model, deadLetterValidation, msg.Data, err)
+		return natsError("payload does not match input schema", err)
+	}
+	observeUsage("nats", model, 1)
+	probs, _, err := predictWithFallback(row)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		deadLetter("nats", msg.Subject, row.EventID, model, deadLetterInference, msg.Data, err)
+		return natsError("unable to make predictions", err)
+	}
+	logPrediction(row, model, probs)
+	return appendFloats(nil, probs, outputDigits(rawOutputs(model, row.Raw)))
+}
+
+// helper function to encode NATS error reply
+func natsError(msg string, err error) []byte {
+	if err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return data
+}
+
+// initNATSServing subscribes the server to NATS prediction subjects
+func initNATSServing() {
+	if _config.NATSURL == "" {
+		return
+	}
+	prefix := _config.NATSPrefix
+	if prefix == "" {
+		prefix = defaultNATSPrefix
+	}
+	queue := _config.NATSQueue
+	if queue == "" {
+		queue = defaultNATSQueue
+	}
+	conn := newNATSConn(_config.NATSURL)
+	handler := func(msg NATSMsg) {
+		if msg.Reply == "" {
+			return
+		}
+		model := strings.TrimPrefix(msg.Subject, prefix+".")
+		if err := conn.publish(msg.Reply, natsPredict(model, msg)); err != nil {
+			log.Println("unable to reply to NATS request", msg.Subject, err)
+		}
+	}
+	log.Printf("serve predictions via NATS %s subjects %s.<model> queue %s", _config.NATSURL, prefix, queue)
+	if err := conn.subscribe(prefix+".*", queue, handler); err != nil {
+		// connection is retried by keep alive loop
+		log.Println("unable to connect to NATS server", _config.NATSURL, err)
+	}
+	go conn.keepAlive(10 * time.Second)
+}
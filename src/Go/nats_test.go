@@ -0,0 +1,101 @@
+package main
+
+// tests of NATS serving mode, they do not require TF C library
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to read NATS command of given verb, it returns command
+// fields and payload of PUB commands
+func readNATSCommand(t *testing.T, reader *bufio.Reader, verb string) ([]string, []byte) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != verb {
+			continue
+		}
+		if verb != "PUB" {
+			return fields, nil
+		}
+		size, _ := strconv.Atoi(fields[len(fields)-1])
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			t.Fatal(err)
+		}
+		return fields, data[:size]
+	}
+}
+
+// TestNATSServing checks NATS request/reply predictions
+func TestNATSServing(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_config.NATSURL = "nats://" + listener.Addr().String()
+	_config.NATSQueue = "workers"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		initNATSServing()
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "INFO {}\r\n")
+	reader := bufio.NewReader(conn)
+	fields, _ := readNATSCommand(t, reader, "SUB")
+	if strings.Join(fields, " ") != "SUB tfaas.predict.* workers 1" {
+		t.Fatalf("unexpected subscription %v", fields)
+	}
+	<-done
+
+	send := func(model, reply string, data []byte) []byte {
+		fmt.Fprintf(conn, "MSG tfaas.predict.%s 1 %s %d\r\n%s\r\n", model, reply, len(data), data)
+		fields, payload := readNATSCommand(t, reader, "PUB")
+		if fields[1] != reply {
+			t.Fatalf("unexpected reply subject %v", fields)
+		}
+		return payload
+	}
+	data, err := json.Marshal(testRow(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var probs []float32
+	if err := json.Unmarshal(send("dnn", "_INBOX.1", data), &probs); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	var rec map[string]string
+	if err := json.Unmarshal(send("unknown", "_INBOX.2", data), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec["error"], "unable to make predictions") {
+		t.Errorf("unexpected error reply %v", rec)
+	}
+	if err := json.Unmarshal(send("dnn", "_INBOX.3", []byte("{")), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec["error"], "unable to unmarshal Row") {
+		t.Errorf("unexpected error reply %v", rec)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+// nodes module provides discovery of input and output nodes of TF graphs
+//
+// When params.json of TF 1.X model omits input_node or output_node the
+// server walks the imported graph and picks Placeholder operation as input
+// node and terminal operation (whose outputs are not consumed by other
+// operations) as output node. The choice is logged and reported by
+// /models and /models/{name} APIs.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// TFNode represents operation of TF graph
+type TFNode struct {
+	Name      string // operation name
+	Type      string // operation type, e.g. Placeholder
+	Consumers int    // number of consumers of operation outputs
+	Outputs   int    // number of operation outputs
+}
+
+// DiscoveredNodes represents input and output nodes discovered in TF graph
+type DiscoveredNodes struct {
+	InputNode  string   `json:"input_node"`  // chosen input node
+	OutputNode string   `json:"output_node"` // chosen output node
+	Inputs     []string `json:"inputs"`      // candidates of input node
+	Outputs    []string `json:"outputs"`     // candidates of output node
+}
+
+// types of terminal operations which are never model outputs
+var nonOutputTypes = []string{
+	"Placeholder", "PlaceholderWithDefault", "Const", "NoOp", "Assert",
+	"VariableV2", "VarHandleOp", "Assign", "AssignVariableOp",
+	"SaveV2", "RestoreV2", "MergeV2Checkpoints",
+}
+
+// global cache of discovered nodes
+var (
+	discoveredNodes     = make(map[string]DiscoveredNodes)
+	discoveredNodesLock sync.RWMutex
+)
+
+// helper function to discover input and output nodes of TF graph
+func discoverNodes(nodes []TFNode) (DiscoveredNodes, error) {
+	var d DiscoveredNodes
+	for _, node := range nodes {
+		if node.Type == "Placeholder" {
+			// keras learning phase is a placeholder of training flag
+			if !strings.Contains(node.Name, "learning_phase") {
+				d.Inputs = append(d.Inputs, node.Name)
+			}
+			continue
+		}
+		if node.Consumers > 0 || InList(node.Type, nonOutputTypes) || strings.HasPrefix(node.Name, "save/") {
+			continue
+		}
+		d.Outputs = append(d.Outputs, node.Name)
+	}
+	if len(d.Inputs) == 0 {
+		return d, errors.New("graph does not have placeholder input nodes")
+	}
+	if len(d.Outputs) == 0 {
+		return d, errors.New("graph does not have terminal output nodes")
+	}
+	// inputs usually come first and outputs last in the graph
+	d.InputNode = d.Inputs[0]
+	d.OutputNode = d.Outputs[len(d.Outputs)-1]
+	return d, nil
+}
+
+// discoverNodes fills in missing input and output nodes of the model
+func (m *TFModel) discoverNodes() error {
+	d, err := discoverNodes(m.Graph.Nodes())
+	if err != nil {
+		return err
+	}
+	if m.Params.InputNode == "" {
+		m.Params.InputNode = d.InputNode
+	}
+	if m.Params.OutputNode == "" {
+		m.Params.OutputNode = d.OutputNode
+	}
+	d.InputNode, d.OutputNode = m.Params.InputNode, m.Params.OutputNode
+	log.Printf("model %s uses discovered input node %s (candidates %v) output node %s (candidates %v)", m.Params.Name, d.InputNode, d.Inputs, d.OutputNode, d.Outputs)
+	discoveredNodesLock.Lock()
+	defer discoveredNodesLock.Unlock()
+	discoveredNodes[m.Params.Name] = d
+	return nil
+}
+
+// helper function to check output indices of model input and output
+// operations against graph nodes
+func checkOutputIndices(nodes []TFNode, names ...string) error {
+	for _, name := range names {
+		opName, idx, err := parseOutputName(name)
+		if err != nil {
+			return err
+		}
+		if idx < 0 {
+			return fmt.Errorf("negative output index of operation %s", opName)
+		}
+		for _, node := range nodes {
+			// nodes with unknown number of outputs are not checked
+			if node.Name == opName && node.Outputs > 0 && idx >= node.Outputs {
+				return fmt.Errorf("operation %s has %d outputs, output index %d is out of range", opName, node.Outputs, idx)
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to get discovered nodes of given model
+func getDiscoveredNodes(name string) (DiscoveredNodes, bool) {
+	discoveredNodesLock.RLock()
+	defer discoveredNodesLock.RUnlock()
+	d, ok := discoveredNodes[name]
+	return d, ok
+}
+
+// helper function to remove discovered nodes of given model
+func removeDiscoveredNodes(name string) {
+	discoveredNodesLock.Lock()
+	defer discoveredNodesLock.Unlock()
+	delete(discoveredNodes, name)
+}
@@ -0,0 +1,154 @@
+package main
+
+// tests of input and output nodes discovery, they do not require TF C library
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// nodes of typical frozen Keras graph
+var testNodes = []TFNode{
+	{Name: "dense_1_input", Type: "Placeholder", Consumers: 1},
+	{Name: "keras_learning_phase", Type: "Placeholder", Consumers: 1},
+	{Name: "dense_1/kernel", Type: "Const", Consumers: 1},
+	{Name: "dense_1/MatMul", Type: "MatMul", Consumers: 1},
+	{Name: "dense_1/Sigmoid", Type: "Sigmoid", Consumers: 1},
+	{Name: "save/RestoreV2", Type: "RestoreV2"},
+	{Name: "save/control_dependency", Type: "Identity"},
+	{Name: "init", Type: "NoOp"},
+	{Name: "output_node0", Type: "Identity"},
+}
+
+// TestDiscoverNodes checks discovery of input and output nodes
+func TestDiscoverNodes(t *testing.T) {
+	d, err := discoverNodes(testNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.InputNode != "dense_1_input" || d.OutputNode != "output_node0" || len(d.Inputs) != 1 || len(d.Outputs) != 1 {
+		t.Errorf("unexpected discovered nodes %+v", d)
+	}
+	if _, err := discoverNodes(testNodes[2:]); err == nil {
+		t.Error("graph without placeholders should fail")
+	}
+	if _, err := discoverNodes(testNodes[:1]); err == nil {
+		t.Error("graph without outputs should fail")
+	}
+}
+
+// TestFakeDiscoveredNodes checks predictions and models API of the model
+// without input and output nodes in its parameters
+func TestFakeDiscoveredNodes(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	fake.Nodes = testNodes
+	writeModelFiles(t, "nonodes", []byte("nonodes"), TFParams{})
+	if err := validateModel(filepath.Join(_config.ModelDir, "nonodes"), "nonodes"); err != nil {
+		t.Fatal(err)
+	}
+	probs, err := makePredictions(testRow("nonodes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/models/nonodes", nil), map[string]string{"name": "nonodes"})
+	w := httptest.NewRecorder()
+	ModelHandler(w, req)
+	var info ModelInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || info.DiscoveredNodes == nil || info.DiscoveredNodes.InputNode != "dense_1_input" || info.DiscoveredNodes.OutputNode != "output_node0" {
+		t.Errorf("unexpected model info %+v", info)
+	}
+	w = httptest.NewRecorder()
+	ModelsHandler(w, httptest.NewRequest("GET", "/models", nil))
+	var models []TFParams
+	json.Unmarshal(w.Body.Bytes(), &models)
+	for _, m := range models {
+		if m.Name == "nonodes" && (m.InputNode != "dense_1_input" || m.OutputNode != "output_node0") {
+			t.Errorf("models API does not report discovered nodes %+v", m)
+		}
+	}
+
+	// graph without placeholders can not be validated
+	fake.Nodes = testNodes[2:]
+	resetModelCache("nonodes")
+	if err := validateModel(filepath.Join(_config.ModelDir, "nonodes"), "nonodes"); err == nil {
+		t.Error("model without discoverable nodes should be rejected")
+	}
+	if _, err := makePredictions(testRow("nonodes")); err == nil {
+		t.Error("model without discoverable nodes should fail")
+	}
+}
+
+// TestOutputIndexName checks operation names with output indices
+func TestOutputIndexName(t *testing.T) {
+	tests := []struct {
+		name   string
+		idx    int
+		expect string
+	}{
+		{"output", 0, "output"},
+		{"output", 1, "output:1"},
+		{"output:2", 1, "output:2"},
+		{"StatefulPartitionedCall", 3, "StatefulPartitionedCall:3"},
+	}
+	for _, test := range tests {
+		if name := outputIndexName(test.name, test.idx); name != test.expect {
+			t.Errorf("name %s index %d: expect %s got %s", test.name, test.idx, test.expect, name)
+		}
+	}
+}
+
+// TestFakeOutputIndices checks predictions of the model which output is
+// the second output of its output operation
+func TestFakeOutputIndices(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	fake.Nodes = []TFNode{
+		{Name: "input", Type: "Placeholder", Consumers: 1, Outputs: 1},
+		{Name: "split", Type: "Split", Outputs: 2},
+	}
+	params := TFParams{InputNode: "input", OutputNode: "split", OutputIndex: 1}
+	writeModelFiles(t, "split", []byte("split"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "split"), "split"); err != nil {
+		t.Fatal(err)
+	}
+	probs, err := makePredictions(testRow("split"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if fetches := fake.Fetches(); len(fetches) != 1 || fetches[0] != "split:1" {
+		t.Errorf("unexpected fetches %v", fetches)
+	}
+	row := testRow("split")
+	tensor, err := _tf.NewTensor(row.Values, []int64{1, int64(len(row.Values))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeBatchPredictions("split", row.Keys, tensor); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := fake.Fetches(); len(fetches) != 1 || fetches[0] != "split:1" {
+		t.Errorf("unexpected batch fetches %v", fetches)
+	}
+
+	// output index beyond number of operation outputs
+	params.OutputIndex = 2
+	writeModelFiles(t, "split", []byte("split"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "split"), "split"); err == nil {
+		t.Error("model with out of range output index should be rejected")
+	}
+	params.OutputIndex, params.OutputNode = 0, "split:x"
+	writeModelFiles(t, "split", []byte("split"), params)
+	if err := validateModel(filepath.Join(_config.ModelDir, "split"), "split"); err == nil {
+		t.Error("model with invalid output name should be rejected")
+	}
+}
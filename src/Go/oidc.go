@@ -0,0 +1,458 @@
+package main
+
+// oidc module provides OAuth2/OIDC login of the web dashboard
+//
+// When "oidcIssuer" and "oidcClientID" are configured dashboard pages
+// redirect users without client certificate to /login which starts the
+// authorization-code flow against the issuer, e.g.
+//
+//	"oidcIssuer": "https://auth.example.org/realms/example",
+//	"oidcClientID": "tfaas",
+//	"oidcClientSecret": "secret",
+//	"oidcRedirectURL": "https://tfaas.example.org/oauth2/callback"
+//
+// The /oauth2/callback endpoint exchanges code for ID token, checks its
+// issuer, audience, expiration and nonce (the token is received directly
+// from the token endpoint over TLS, see OIDC core 3.1.3.7) and stores user,
+// login and groups claims in HMAC signed, HttpOnly and Secure session
+// cookie. Session identity is used by authorization policy when request has
+// no client certificate, i.e. dashboard has the same access control as the
+// API. Cookies are signed with "oidcCookieSecret" (or OIDC_COOKIE_SECRET
+// environment variable), otherwise with random key which does not survive
+// server restarts and is not shared among replicas.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// names of OIDC cookies
+const (
+	sessionCookie   = "tfaas_session"
+	oidcStateCookie = "tfaas_oidc_state"
+)
+
+// default lifetime of dashboard sessions in seconds
+const defaultOIDCSessionTTL = 8 * 3600
+
+// lifetime of authorization request state in seconds
+const oidcStateTTL = 600
+
+// OIDCProvider represents OIDC discovery document of the issuer
+type OIDCProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// Session represents dashboard session stored in the cookie
+type Session struct {
+	User    string   `json:"user"`    // user name
+	Login   string   `json:"login"`   // user login
+	Groups  []string `json:"groups"`  // user groups
+	Expires int64    `json:"expires"` // expiration time of the session
+}
+
+// oidcState represents state of authorization request
+type oidcState struct {
+	State   string `json:"state"`   // state parameter
+	Nonce   string `json:"nonce"`   // nonce of ID token
+	Next    string `json:"next"`    // page to return after login
+	Expires int64  `json:"expires"` // expiration time of the request
+}
+
+// HTTP client of OIDC requests
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// global OIDC state
+var (
+	_oidcProvider *OIDCProvider
+	_oidcLock     sync.Mutex
+	_cookieKey    []byte
+)
+
+// helper function to check if OIDC login is enabled
+func oidcEnabled() bool {
+	return _config.OIDCIssuer != "" && _config.OIDCClientID != ""
+}
+
+// helper function to check if request is OIDC login request
+func oidcPath(r *http.Request) bool {
+	p := requestPath(r)
+	return p == "/login" || p == "/logout" || p == "/oauth2/callback"
+}
+
+// helper function to check if request is dashboard page request
+func dashboardPath(r *http.Request) bool {
+	p := requestPath(r)
+	return p == "/" || strings.HasPrefix(p, "/netron/")
+}
+
+// helper function to discover OIDC provider endpoints, discovery document
+// is cached after first successful request
+func oidcProvider() (*OIDCProvider, error) {
+	_oidcLock.Lock()
+	defer _oidcLock.Unlock()
+	if _oidcProvider != nil && _oidcProvider.Issuer == strings.TrimSuffix(_config.OIDCIssuer, "/") {
+		return _oidcProvider, nil
+	}
+	rurl := strings.TrimSuffix(_config.OIDCIssuer, "/") + "/.well-known/openid-configuration"
+	resp, err := oidcClient.Get(rurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery %s: %s", rurl, resp.Status)
+	}
+	var provider OIDCProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery %s does not provide authorization and token endpoints", rurl)
+	}
+	provider.Issuer = strings.TrimSuffix(provider.Issuer, "/")
+	if provider.Issuer != strings.TrimSuffix(_config.OIDCIssuer, "/") {
+		return nil, fmt.Errorf("OIDC issuer %s does not match configured issuer %s", provider.Issuer, _config.OIDCIssuer)
+	}
+	_oidcProvider = &provider
+	return _oidcProvider, nil
+}
+
+// helper function to return key of cookie signatures
+func cookieKey() []byte {
+	_oidcLock.Lock()
+	defer _oidcLock.Unlock()
+	if secret := _config.OIDCCookieSecret; secret != "" {
+		return []byte(secret)
+	}
+	if secret := os.Getenv("OIDC_COOKIE_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	if _cookieKey == nil {
+		_cookieKey = make([]byte, 32)
+		rand.Read(_cookieKey)
+	}
+	return _cookieKey
+}
+
+// helper function to encode and sign cookie value
+func signCookie(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, cookieKey())
+	mac.Write(data)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(data) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// helper function to verify and decode signed cookie value
+func verifyCookie(value string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed cookie")
+	}
+	enc := base64.RawURLEncoding
+	data, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, cookieKey())
+	mac.Write(data)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("invalid cookie signature")
+	}
+	return json.Unmarshal(data, v)
+}
+
+// helper function to set cookie with given value and lifetime
+func setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     basePath("/"),
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// helper function to return dashboard session of the request
+func requestSession(r *http.Request) (Session, error) {
+	var s Session
+	if !oidcEnabled() {
+		return s, errors.New("OIDC login is not configured")
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return s, err
+	}
+	if err := verifyCookie(cookie.Value, &s); err != nil {
+		return s, err
+	}
+	if time.Now().Unix() > s.Expires {
+		return s, errors.New("session is expired")
+	}
+	return s, nil
+}
+
+// helper function to return redirect URL of OIDC client
+func oidcRedirectURL(r *http.Request) string {
+	if _config.OIDCRedirectURL != "" {
+		return _config.OIDCRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, basePath("/oauth2/callback"))
+}
+
+// helper function to return local page to return after login
+func nextPage(next string) string {
+	// only local pages are allowed to avoid open redirects
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return basePath("/")
+	}
+	return next
+}
+
+// helper function to generate random token
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoginHandler starts OIDC authorization-code flow
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		responseError(w, "OIDC login is not configured", nil, http.StatusNotFound)
+		return
+	}
+	provider, err := oidcProvider()
+	if err != nil {
+		responseError(w, "unable to discover OIDC provider", err, http.StatusBadGateway)
+		return
+	}
+	state := oidcState{
+		State:   randomToken(),
+		Nonce:   randomToken(),
+		Next:    nextPage(r.URL.Query().Get("next")),
+		Expires: time.Now().Add(oidcStateTTL * time.Second).Unix(),
+	}
+	value, err := signCookie(state)
+	if err != nil {
+		responseError(w, "unable to create OIDC state", err, http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, oidcStateCookie, value, oidcStateTTL)
+	scopes := _config.OIDCScopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", _config.OIDCClientID)
+	params.Set("redirect_uri", oidcRedirectURL(r))
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state.State)
+	params.Set("nonce", state.Nonce)
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+params.Encode(), http.StatusFound)
+}
+
+// helper function to exchange authorization code for ID token claims
+func exchangeCode(provider *OIDCProvider, code, redirectURL string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", _config.OIDCClientID)
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if _config.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(_config.OIDCClientID), url.QueryEscape(_config.OIDCClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC token endpoint %s: %s", provider.TokenEndpoint, resp.Status)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// helper function to return list of strings of given claim
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// helper function to validate ID token claims
+func validateClaims(claims map[string]interface{}, provider *OIDCProvider, nonce string) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != provider.Issuer {
+		return fmt.Errorf("unexpected ID token issuer %s", iss)
+	}
+	if !InList(_config.OIDCClientID, claimStrings(claims["aud"])) {
+		return errors.New("ID token is not issued to this client")
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) < time.Now().Unix() {
+		return errors.New("ID token is expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return errors.New("ID token nonce mismatch")
+	}
+	return nil
+}
+
+// CallbackHandler completes OIDC authorization-code flow and creates
+// dashboard session
+func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		responseError(w, "OIDC login is not configured", nil, http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		responseError(w, fmt.Sprintf("OIDC login failed: %s %s", e, query.Get("error_description")), nil, http.StatusUnauthorized)
+		return
+	}
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err == nil {
+		err = verifyCookie(cookie.Value, &state)
+	}
+	if err == nil && (state.State != query.Get("state") || time.Now().Unix() > state.Expires) {
+		err = errors.New("state mismatch or expired login request")
+	}
+	if err != nil {
+		responseError(w, "invalid OIDC login request", err, http.StatusBadRequest)
+		return
+	}
+	setCookie(w, oidcStateCookie, "", -1)
+	provider, err := oidcProvider()
+	if err != nil {
+		responseError(w, "unable to discover OIDC provider", err, http.StatusBadGateway)
+		return
+	}
+	claims, err := exchangeCode(provider, query.Get("code"), oidcRedirectURL(r))
+	if err != nil {
+		responseError(w, "unable to exchange OIDC authorization code", err, http.StatusBadGateway)
+		return
+	}
+	if err := validateClaims(claims, provider, state.Nonce); err != nil {
+		responseError(w, "invalid OIDC ID token", err, http.StatusUnauthorized)
+		return
+	}
+	session := Session{}
+	for _, key := range []string{"preferred_username", "email", "sub"} {
+		if v, ok := claims[key].(string); ok && v != "" {
+			session.User = v
+			break
+		}
+	}
+	session.Login, _ = claims["preferred_username"].(string)
+	groupsClaim := _config.OIDCGroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	session.Groups = claimStrings(claims[groupsClaim])
+	ttl := _config.OIDCSessionTTL
+	if ttl <= 0 {
+		ttl = defaultOIDCSessionTTL
+	}
+	session.Expires = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	value, err := signCookie(session)
+	if err != nil {
+		responseError(w, "unable to create session", err, http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, sessionCookie, value, ttl)
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+// LogoutHandler removes dashboard session
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, sessionCookie, "", -1)
+	target := basePath("/")
+	if oidcEnabled() {
+		if provider, err := oidcProvider(); err == nil && provider.EndSessionEndpoint != "" {
+			target = provider.EndSessionEndpoint + "?client_id=" + url.QueryEscape(_config.OIDCClientID)
+		}
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcMiddleware redirects unauthenticated dashboard requests to login page
+func oidcMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidcEnabled() && dashboardPath(r) && verifiedCertificate(r) == nil {
+			if _, err := requestSession(r); err != nil {
+				login := basePath("/login") + "?next=" + url.QueryEscape(r.URL.RequestURI())
+				http.Redirect(w, r, login, http.StatusFound)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+// tests of OIDC dashboard login, they do not require TF C library
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to run fake OIDC provider, nonce of ID tokens is taken
+// from given function
+func fakeOIDCProvider(t *testing.T, nonce func() string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(OIDCProvider{
+				Issuer:                srv.URL,
+				AuthorizationEndpoint: srv.URL + "/auth",
+				TokenEndpoint:         srv.URL + "/token",
+			})
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			if user != "tfaas" || pass != "secret" || r.FormValue("code") != "abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss":                srv.URL,
+				"aud":                "tfaas",
+				"exp":                time.Now().Add(time.Hour).Unix(),
+				"nonce":              nonce(),
+				"preferred_username": "alice",
+				"groups":             []string{"ml"},
+			})
+			enc := base64.RawURLEncoding
+			token := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString(claims) + ".sig"
+			json.NewEncoder(w).Encode(map[string]string{"id_token": token, "token_type": "Bearer"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// helper function to send request with given cookies
+func oidcRequest(router http.Handler, method, rurl string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, rurl, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// helper function to find response cookie with given name
+func responseCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// TestOIDCLogin checks authorization-code flow of dashboard login
+func TestOIDCLogin(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var nonce string
+	provider := fakeOIDCProvider(t, func() string { return nonce })
+	_config.OIDCIssuer = provider.URL
+	_config.OIDCClientID = "tfaas"
+	_config.OIDCClientSecret = "secret"
+	_config.Policy = &PolicyConfig{Rules: []PolicyRule{{Effect: "allow", Groups: []string{"ml"}}}}
+	initLimiter("1000-S")
+	router := handlers()
+
+	// dashboard redirects to login page
+	rr := oidcRequest(router, "GET", "/")
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/login?next=%2F" {
+		t.Fatalf("unexpected dashboard response %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	// login redirects to the issuer
+	rr = oidcRequest(router, "GET", "/login?next=/netron/")
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || rr.Code != http.StatusFound || !strings.HasPrefix(loc.String(), provider.URL+"/auth?") {
+		t.Fatalf("unexpected login response %d %s", rr.Code, loc)
+	}
+	query := loc.Query()
+	if query.Get("client_id") != "tfaas" || query.Get("response_type") != "code" || query.Get("redirect_uri") != "http://example.com/oauth2/callback" {
+		t.Errorf("unexpected authorization request %s", loc)
+	}
+	nonce = query.Get("nonce")
+	state := responseCookie(rr, oidcStateCookie)
+	if state == nil || !state.Secure || !state.HttpOnly {
+		t.Fatalf("unexpected state cookie %+v", state)
+	}
+	// callback with wrong state is rejected
+	rr = oidcRequest(router, "GET", "/oauth2/callback?code=abc&state=xyz", state)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d of callback with wrong state", rr.Code)
+	}
+	// callback creates session and returns to requested page
+	rr = oidcRequest(router, "GET", "/oauth2/callback?code=abc&state="+query.Get("state"), state)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/netron/" {
+		t.Fatalf("unexpected callback response %d %s", rr.Code, rr.Body.String())
+	}
+	session := responseCookie(rr, sessionCookie)
+	if session == nil || !session.Secure || !session.HttpOnly {
+		t.Fatalf("unexpected session cookie %+v", session)
+	}
+	// session identity is authorized by policy
+	if rr := oidcRequest(router, "GET", "/models", session); rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d of request with session", rr.Code)
+	}
+	if rr := oidcRequest(router, "GET", "/models"); rr.Code != http.StatusForbidden {
+		t.Errorf("unexpected status %d of request without session", rr.Code)
+	}
+	forged := *session
+	forged.Value = strings.Replace(forged.Value, ".", "x.", 1)
+	if rr := oidcRequest(router, "GET", "/models", &forged); rr.Code != http.StatusForbidden {
+		t.Errorf("unexpected status %d of request with forged session", rr.Code)
+	}
+	// logout removes session
+	rr = oidcRequest(router, "GET", "/logout", session)
+	if c := responseCookie(rr, sessionCookie); rr.Code != http.StatusFound || c == nil || c.MaxAge >= 0 {
+		t.Errorf("unexpected logout response %d %+v", rr.Code, c)
+	}
+}
+
+// TestNextPage checks that login redirects only to local pages
+func TestNextPage(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	for next, expect := range map[string]string{
+		"/netron/":            "/netron/",
+		"//evil.example.com":  "/",
+		"https://example.com": "/",
+		"/\\evil.example.com": "/",
+	} {
+		if v := nextPage(next); v != expect {
+			t.Errorf("next page of %s is %s, expected %s", next, v, expect)
+		}
+	}
+}
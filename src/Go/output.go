@@ -0,0 +1,154 @@
+package main
+
+// output module provides output format negotiation of batch predictions
+//
+// Clients pick encoding of batch results via Accept header (or format query
+// parameter for clients which can't set headers, e.g. format=csv):
+// - application/json (json), default, JSON array of rows of outputs
+// - text/csv (csv), CSV table with row index and output_<i> columns
+// - application/x-protobuf (protobuf), tfaaspb.DataFrame where every Row
+//   provides outputs of the row in its value field
+// - application/vnd.apache.arrow.stream (arrow), Arrow IPC stream with
+//   output_<i> float32 columns, default for Arrow batches
+// - application/x-ndjson (ndjson), newline delimited JSON streamed in chunks
+//   of rows, see stream module
+// Media ranges and q-values are honored, e.g. "text/*;q=0.5, */*;q=0.1",
+// requests which accept none of supported formats are rejected with 406.
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vkuznet/TFaaS/tfaaspb"
+)
+
+// content types of batch outputs
+const (
+	jsonType     = "application/json"
+	csvType      = "text/csv"
+	protobufType = "application/x-protobuf"
+)
+
+// supported batch output formats and their short names
+var outputFormats = map[string]string{
+	"json":     jsonType,
+	"csv":      csvType,
+	"protobuf": protobufType,
+	"arrow":    arrowStreamType,
+	"ndjson":   ndjsonType,
+}
+
+// helper function to match media range of Accept header against supported
+// output formats, def is the format used for wildcards
+func matchOutputFormat(mtype, def string) string {
+	switch mtype {
+	case "*/*":
+		return def
+	case "application/*":
+		if strings.HasPrefix(def, "application/") {
+			return def
+		}
+		return jsonType
+	case "text/*":
+		return csvType
+	case "application/protobuf", "application/vnd.google.protobuf":
+		return protobufType
+	}
+	for _, ctype := range outputFormats {
+		if mtype == ctype {
+			return ctype
+		}
+	}
+	return ""
+}
+
+// negotiateOutput returns content type of batch outputs acceptable by the
+// client, the default one is used when client accepts any format and empty
+// string is returned if none of supported formats is acceptable
+func negotiateOutput(r *http.Request, def string) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return outputFormats[strings.ToLower(format)]
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return def
+	}
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mtype, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if ctype := matchOutputFormat(mtype, def); ctype != "" && q > bestQ {
+			best, bestQ = ctype, q
+		}
+	}
+	return best
+}
+
+// helper function to reject requests without acceptable output format
+func rejectOutputFormat(w http.ResponseWriter, ctype string) bool {
+	if ctype != "" {
+		return false
+	}
+	var formats []string
+	for _, f := range []string{"json", "csv", "protobuf", "arrow", "ndjson"} {
+		formats = append(formats, outputFormats[f])
+	}
+	msg := "supported output formats are " + strings.Join(formats, ", ")
+	responseError(w, msg, nil, http.StatusNotAcceptable)
+	return true
+}
+
+// helper function to encode batch outputs as tfaaspb.DataFrame
+func batchProtobuf(probs [][]float32) ([]byte, error) {
+	frame := &tfaaspb.DataFrame{}
+	for _, p := range probs {
+		frame.Row = append(frame.Row, &tfaaspb.Row{Value: p})
+	}
+	return proto.Marshal(frame)
+}
+
+// responseBatchOutput writes batch outputs of the model in given format,
+// raw outputs are not rounded (see raw module)
+func responseBatchOutput(w http.ResponseWriter, ctype, model string, probs [][]float32, raw bool) {
+	w.Header().Add("Vary", "Accept")
+	setOutputShapeHeader(w, model, "")
+	setRawOutputsHeader(w, raw)
+	switch ctype {
+	case csvType:
+		w.Header().Set("Content-Type", csvType)
+		w.WriteHeader(http.StatusOK)
+		if err := writeOutputsCSV(w, probs); err != nil {
+			log.Println("unable to write CSV outputs", err)
+		}
+	case protobufType:
+		data, err := batchProtobuf(probs)
+		if err != nil {
+			responseError(w, "unable to marshal data", err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", protobufType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case arrowStreamType:
+		w.Header().Set("Content-Type", arrowStreamType)
+		w.WriteHeader(http.StatusOK)
+		if err := writeArrowTable(w, probs); err != nil {
+			log.Println("unable to write arrow table", err)
+		}
+	default:
+		responseBatchProbs(w, probs, outputDigits(raw))
+	}
+}
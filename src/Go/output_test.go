@@ -0,0 +1,106 @@
+package main
+
+// tests of output format negotiation, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vkuznet/TFaaS/tfaaspb"
+)
+
+// TestNegotiateOutput checks selection of output format by Accept header
+func TestNegotiateOutput(t *testing.T) {
+	tests := []struct {
+		accept, query, def, expect string
+	}{
+		{"", "", jsonType, jsonType},
+		{"", "", arrowStreamType, arrowStreamType},
+		{"*/*", "", arrowStreamType, arrowStreamType},
+		{"text/csv", "", jsonType, csvType},
+		{"application/xml, text/*;q=0.5", "", jsonType, csvType},
+		{"application/json;q=0.2, application/x-protobuf", "", jsonType, protobufType},
+		{"application/vnd.apache.arrow.stream, */*;q=0.1", "", jsonType, arrowStreamType},
+		{"application/x-ndjson", "", jsonType, ndjsonType},
+		{"application/*", "", arrowStreamType, arrowStreamType},
+		{"application/xml", "", jsonType, ""},
+		{"text/csv;q=0", "", jsonType, ""},
+		{"application/json", "format=CSV", jsonType, csvType},
+		{"", "format=xml", jsonType, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/predict/batch?"+tt.query, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if ctype := negotiateOutput(req, tt.def); ctype != tt.expect {
+			t.Errorf("accept %q, query %q: got %q, expected %q", tt.accept, tt.query, ctype, tt.expect)
+		}
+	}
+}
+
+// TestBatchOutputFormats checks encodings of batch predictions
+func TestBatchOutputFormats(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := 3
+	batch := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(streamBatch(t, nrows)))
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		BatchHandler(w, req)
+		return w
+	}
+
+	w := batch("text/csv")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != csvType {
+		t.Fatalf("wrong CSV response %d: %s", w.Code, w.Body.String())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nrows+1 || len(records[0]) != len(testOutputs)+1 {
+		t.Fatalf("wrong CSV records %v", records)
+	}
+
+	w = batch(protobufType)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != protobufType {
+		t.Fatalf("wrong protobuf response %d: %s", w.Code, w.Body.String())
+	}
+	frame := &tfaaspb.DataFrame{}
+	if err := proto.Unmarshal(w.Body.Bytes(), frame); err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Row) != nrows {
+		t.Fatalf("wrong number of protobuf rows %d", len(frame.Row))
+	}
+	checkProbs(t, frame.Row[0].Value)
+
+	w = batch(arrowStreamType)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong arrow response %d: %s", w.Code, w.Body.String())
+	}
+	table, err := readArrowTable(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Rows != int64(nrows) || len(table.Columns) != len(testOutputs) {
+		t.Fatalf("wrong arrow results %+v", table)
+	}
+
+	w = batch("application/json, */*")
+	var probs [][]float32
+	if err := json.Unmarshal(w.Body.Bytes(), &probs); err != nil || len(probs) != nrows {
+		t.Fatalf("wrong JSON response %s: %v", w.Body.String(), err)
+	}
+
+	w = batch("application/xml")
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("wrong status code %d for unsupported format", w.Code)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+// overrides module provides per-request overrides of model parameters
+//
+// Advanced clients may override selected model parameters per request
+// instead of registering near-duplicate models, e.g.
+// {"model": "dnn", "keys": [...], "values": [...],
+//  "overrides": {"output_node": "logits", "softmax": true}}
+// Only parameters listed in "overridable" allow-list of params.json of the
+// model can be overridden, e.g. "overridable": ["output_node", "softmax"].
+// Image classification requests pass overrides as JSON in "overrides" form
+// field, e.g. -F 'overrides={"top_n": 3}'.
+
+import (
+	"fmt"
+	"math"
+)
+
+// names of overridable model parameters
+const (
+	overrideOutputNode  = "output_node"
+	overrideOutputIndex = "output_index"
+	overrideTopN        = "top_n"
+	overrideSoftmax     = "softmax"
+)
+
+// Overrides represents per-request overrides of model parameters
+type Overrides struct {
+	OutputNode  string `json:"output_node,omitempty"`  // output node (TF 1.X) or output name (TF 2.X)
+	OutputIndex *int   `json:"output_index,omitempty"` // output index of output operation
+	TopN        int    `json:"top_n,omitempty"`        // number of labels of image classification
+	Softmax     bool   `json:"softmax,omitempty"`      // apply softmax to model outputs
+}
+
+// helper function to list overridden parameters
+func (o *Overrides) names() []string {
+	var out []string
+	if o == nil {
+		return out
+	}
+	if o.OutputNode != "" {
+		out = append(out, overrideOutputNode)
+	}
+	if o.OutputIndex != nil {
+		out = append(out, overrideOutputIndex)
+	}
+	if o.TopN != 0 {
+		out = append(out, overrideTopN)
+	}
+	if o.Softmax {
+		out = append(out, overrideSoftmax)
+	}
+	return out
+}
+
+// check verifies that overridden parameters are allowed by given model
+func (o *Overrides) check(model string) error {
+	names := o.names()
+	if len(names) == 0 {
+		return nil
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		return fmt.Errorf("model %s does not allow overrides: %v", model, err)
+	}
+	for _, name := range names {
+		if !InList(name, params.Overridable) {
+			return fmt.Errorf("model %s does not allow to override %s", model, name)
+		}
+	}
+	if o.OutputNode != "" {
+		if _, _, err := parseOutputName(o.OutputNode); err != nil {
+			return err
+		}
+	}
+	if o.OutputIndex != nil && *o.OutputIndex < 0 {
+		return fmt.Errorf("negative output index %d", *o.OutputIndex)
+	}
+	if o.TopN < 0 {
+		return fmt.Errorf("negative top_n %d", o.TopN)
+	}
+	return nil
+}
+
+// apply returns copy of model parameters with overridden output
+func (o *Overrides) apply(params TFParams) TFParams {
+	if o == nil {
+		return params
+	}
+	if o.OutputNode != "" {
+		params.OutputNode = o.OutputNode
+		params.OutputName = o.OutputNode
+	}
+	if o.OutputIndex != nil {
+		params.OutputIndex = *o.OutputIndex
+	}
+	return params
+}
+
+// topN returns number of labels of image classification
+func (o *Overrides) topN(def int) int {
+	if o == nil || o.TopN == 0 {
+		return def
+	}
+	return o.TopN
+}
+
+// postProcess applies post-processing to model outputs
+func (o *Overrides) postProcess(probs []float32) []float32 {
+	if o == nil || !o.Softmax || len(probs) == 0 {
+		return probs
+	}
+	max := probs[0]
+	for _, p := range probs {
+		if p > max {
+			max = p
+		}
+	}
+	out := make([]float32, len(probs))
+	var sum float64
+	for i, p := range probs {
+		e := math.Exp(float64(p - max))
+		out[i] = float32(e)
+		sum += e
+	}
+	for i := range out {
+		out[i] = float32(float64(out[i]) / sum)
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package main
+
+// tests of per-request overrides, they do not require TF C library
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestOverridesPostProcess checks softmax post-processing
+func TestOverridesPostProcess(t *testing.T) {
+	var o *Overrides
+	if probs := o.postProcess(testOutputs); len(probs) != len(testOutputs) || probs[0] != testOutputs[0] {
+		t.Errorf("nil overrides should not change outputs %v", probs)
+	}
+	o = &Overrides{Softmax: true}
+	probs := o.postProcess([]float32{1, 2, 3})
+	var sum float64
+	for _, p := range probs {
+		sum += float64(p)
+	}
+	if math.Abs(sum-1) > 1e-6 || !(probs[0] < probs[1] && probs[1] < probs[2]) {
+		t.Errorf("wrong softmax %v", probs)
+	}
+}
+
+// TestFakeOverrides checks per-request overrides of model parameters
+func TestFakeOverrides(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Overridable: []string{"output_node", "softmax", "top_n"}}
+	params.ImgChannels = int64(len(testLabels))
+	writeModelFiles(t, "multi", []byte("multi"), params)
+
+	row := testRow("multi")
+	row.Overrides = &Overrides{OutputNode: "logits", Softmax: true}
+	probs, err := makePredictions(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches := fake.Fetches(); len(fetches) != 1 || fetches[0] != "logits" {
+		t.Errorf("output node is not overridden %v", fetches)
+	}
+	if len(probs) != len(testOutputs) || probs[2] <= probs[0] || probs[0] == testOutputs[0] {
+		t.Errorf("softmax is not applied %v", probs)
+	}
+
+	// parameters outside of allow-list can not be overridden
+	idx := 1
+	row.Overrides = &Overrides{OutputIndex: &idx}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("output index should not be overridable")
+	}
+	row = testRow("dnn")
+	row.Overrides = &Overrides{Softmax: true}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("model without allow-list should reject overrides")
+	}
+
+	// image classification with top_n override
+	req := imageRequest(t, "multi")
+	req.URL.RawQuery = url.Values{"overrides": []string{`{"top_n": 1}`}}.Encode()
+	w := httptest.NewRecorder()
+	ImageTF1Handler(w, req)
+	var res ClassifyResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(res.Labels) != 1 || res.Labels[0].Label != "c" {
+		t.Errorf("unexpected classification result %d %+v", w.Code, res)
+	}
+	req = imageRequest(t, "img")
+	req.URL.RawQuery = url.Values{"overrides": []string{`{"top_n": 1}`}}.Encode()
+	w = httptest.NewRecorder()
+	ImageTF1Handler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code %d of not allowed overrides", w.Code)
+	}
+}
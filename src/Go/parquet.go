@@ -0,0 +1,118 @@
+package main
+
+// parquet module provides Apache Parquet support of batch endpoint
+//
+// Clients may POST Parquet file with application/vnd.apache.parquet content
+// type to /predict/batch, e.g.
+// POST /predict/batch?model=dnn&columns=a,b,c
+// The file is scored as Arrow table (see arrow module): the columns
+// parameter selects and orders numeric columns used as model features and
+// the results are returned as Arrow IPC stream.
+//
+// Parquet files are read by Apache Arrow Go library, numeric columns
+// without nulls are converted to float32 model features and other columns
+// are skipped.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+)
+
+// helper function to read Parquet file
+func readParquetTable(data []byte) (table *ArrowTable, err error) {
+	defer recoverArrow(&err)
+	pf, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer pf.Close()
+	reader, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := reader.Schema()
+	if err != nil {
+		return nil, err
+	}
+	table = &ArrowTable{Columns: arrowColumns(schema), Rows: pf.NumRows()}
+	table.Values = make([][]float32, len(table.Columns))
+	nsupported := 0
+	for i, col := range table.Columns {
+		// only flat numeric columns are read
+		if col.supported && !reader.Manifest.Fields[i].IsLeaf() {
+			table.Columns[i].supported = false
+		}
+		if table.Columns[i].supported {
+			nsupported++
+		}
+	}
+	if table.Rows < 0 || table.Rows*int64(nsupported) > int64(maxDecodedBody()/4) {
+		return nil, fmt.Errorf("parquet file has too many rows %d", table.Rows)
+	}
+	for i, col := range table.Columns {
+		if !col.supported {
+			continue
+		}
+		values, err := readParquetColumn(reader, col.Name, reader.Manifest.Fields[i].ColIndex, table.Rows)
+		if err != nil {
+			return nil, err
+		}
+		table.Values[i] = values
+	}
+	return table, nil
+}
+
+// helper function to read values of leaf column of Parquet file
+func readParquetColumn(reader *pqarrow.FileReader, name string, leaf int, rows int64) ([]float32, error) {
+	cr, err := reader.GetColumn(context.Background(), leaf)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Release()
+	chunked, err := cr.NextBatch(rows)
+	if err != nil {
+		return nil, err
+	}
+	defer chunked.Release()
+	values := make([]float32, 0, rows)
+	for _, chunk := range chunked.Chunks() {
+		v, err := arrowValues(name, chunk)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v...)
+	}
+	if int64(len(values)) != rows {
+		return nil, fmt.Errorf("parquet column %s has %d values, expected %d", name, len(values), rows)
+	}
+	return values, nil
+}
+
+// helper function to read Parquet file from request body, the file is
+// read into memory since its metadata is stored at the end of the file
+func readParquetBody(body io.Reader) (*ArrowTable, error) {
+	limit := maxDecodedBody()
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, errors.New("parquet file exceeds size limit")
+	}
+	return readParquetTable(data)
+}
+
+// helper function to check if request provides Parquet file
+func isParquetRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), parquetType)
+}
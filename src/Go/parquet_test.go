@@ -0,0 +1,139 @@
+package main
+
+// tests of Parquet support, they do not require TF C library
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet"
+	"github.com/apache/arrow/go/v14/parquet/compress"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+)
+
+// parquetTestOptions represents layout of Parquet file written by tests
+type parquetTestOptions struct {
+	codec compress.Compression // compression codec of pages
+	v2    bool                 // write data pages v2
+	nulls bool                 // column b contains nulls
+}
+
+// helper function to write Parquet file with double "a", optional int32
+// "b", string "s", float "c" and int64 "d" columns in two row groups of given
+// number of rows
+func writeTestParquet(tb testing.TB, nrows int, opts parquetTestOptions) []byte {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "a", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "b", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		{Name: "s", Type: arrow.BinaryTypes.String},
+		{Name: "c", Type: arrow.PrimitiveTypes.Float32},
+		{Name: "d", Type: arrow.PrimitiveTypes.Int64},
+	}, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	for i := 0; i < nrows; i++ {
+		builder.Field(0).(*array.Float64Builder).Append(float64(i) / 2)
+		if opts.nulls && i == nrows-1 {
+			builder.Field(1).(*array.Int32Builder).AppendNull()
+		} else {
+			builder.Field(1).(*array.Int32Builder).Append(int32(10 * (i%3 + 1)))
+		}
+		builder.Field(2).(*array.StringBuilder).Append("x")
+		builder.Field(3).(*array.Float32Builder).Append(float32(i))
+		builder.Field(4).(*array.Int64Builder).Append(int64(-i))
+	}
+	record := builder.NewRecord()
+	defer record.Release()
+	table := array.NewTableFromRecords(schema, []arrow.Record{record})
+	defer table.Release()
+	version := parquet.DataPageV1
+	if opts.v2 {
+		version = parquet.DataPageV2
+	}
+	props := parquet.NewWriterProperties(parquet.WithCompression(opts.codec), parquet.WithDataPageVersion(version))
+	var buf bytes.Buffer
+	if err := pqarrow.WriteTable(table, &buf, int64(nrows/2), props, pqarrow.DefaultWriterProps()); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestParquetTable checks reading of Parquet files
+func TestParquetTable(t *testing.T) {
+	nrows := 20
+	for _, codec := range []compress.Compression{compress.Codecs.Uncompressed, compress.Codecs.Snappy, compress.Codecs.Gzip, compress.Codecs.Zstd} {
+		for _, v2 := range []bool{false, true} {
+			data := writeTestParquet(t, nrows, parquetTestOptions{codec: codec, v2: v2})
+			table, err := readParquetTable(data)
+			if err != nil {
+				t.Fatalf("codec %v v2 %v: %v", codec, v2, err)
+			}
+			if table.Rows != int64(nrows) || len(table.Columns) != 5 || table.Columns[2].supported {
+				t.Fatalf("codec %v v2 %v: wrong table %+v", codec, v2, table.Columns)
+			}
+			for i := 0; i < nrows; i++ {
+				expect := []float32{float32(i) / 2, float32(10 * (i%3 + 1)), 0, float32(i), float32(-i)}
+				for c, v := range expect {
+					if c != 2 && table.Values[c][i] != v {
+						t.Fatalf("codec %v v2 %v: wrong value %v of column %s row %d, expected %v", codec, v2, table.Values[c][i], table.Columns[c].Name, i, v)
+					}
+				}
+			}
+		}
+	}
+
+	data := writeTestParquet(t, nrows, parquetTestOptions{})
+	if _, err := readParquetTable(data[:len(data)-1]); err == nil {
+		t.Error("truncated file is read")
+	}
+	if _, err := readParquetTable(data[100:]); err == nil {
+		t.Error("file without magic is read")
+	}
+	for _, v2 := range []bool{false, true} {
+		data := writeTestParquet(t, nrows, parquetTestOptions{v2: v2, nulls: true})
+		if _, err := readParquetTable(data); err == nil || !strings.Contains(err.Error(), "nulls") {
+			t.Errorf("nulls of v2 %v page are not reported: %v", v2, err)
+		}
+	}
+	// corrupted footer and pages are reported
+	for i := 4; i < len(data)-8; i++ {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0xFF
+		readParquetTable(corrupted)
+	}
+}
+
+// TestParquetBatchHandler checks batch predictions for Parquet files
+func TestParquetBatchHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := 10
+	data := writeTestParquet(t, nrows, parquetTestOptions{codec: compress.Codecs.Snappy})
+	req := httptest.NewRequest("POST", "/predict/batch?model=dnn&columns=a,b,c,d", bytes.NewReader(data))
+	req.Header.Set("Content-Type", parquetType)
+	w := httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	table, err := readArrowTable(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Rows != int64(nrows) || len(table.Columns) != len(testOutputs) {
+		t.Fatalf("wrong arrow results %+v", table)
+	}
+
+	req = httptest.NewRequest("POST", "/predict/batch?model=dnn&columns=s", bytes.NewReader(data))
+	req.Header.Set("Content-Type", parquetType)
+	w = httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for string column", w.Code)
+	}
+}
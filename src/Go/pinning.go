@@ -0,0 +1,119 @@
+package main
+
+// pinning module provides CPU pinning of TF threads of models
+//
+// On large multi-socket nodes latency-critical models may keep their TF
+// threads on CPUs of single socket to avoid cross-socket memory traffic.
+// Models select CPUs via "cpu_set" parameter in params.json in taskset
+// format, e.g. "cpu_set": "0-15,32-47", or via "numa_node" parameter, e.g.
+// "numa_node": 0, which pins the model to CPUs of given NUMA node. Sessions
+// of pinned models are created on OS thread bound to the CPU set, such that
+// TF thread pools of the sessions inherit its CPU affinity, and thread pools
+// are sized by the CPU set (using low-latency session preset unless model
+// selects another one, see presets module). CPU pinning is supported on
+// Linux only.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// location of NUMA nodes in sysfs
+var numaRoot = "/sys/devices/system/node"
+
+// helper function to parse CPU list in taskset format, e.g. 0-3,8,10-11
+func parseCPUList(value string) ([]int, error) {
+	var cpus []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(strings.TrimSpace(value), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := part, part
+		if idx := strings.Index(part, "-"); idx > 0 {
+			lo, hi = part[:idx], part[idx+1:]
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list '%s'", value)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid CPU list '%s'", value)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty CPU list '%s'", value)
+	}
+	return cpus, nil
+}
+
+// helper function to read CPUs of given NUMA node
+func numaNodeCPUs(node int) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(numaRoot, fmt.Sprintf("node%d", node), "cpulist"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown NUMA node %d: %v", node, err)
+	}
+	return parseCPUList(string(data))
+}
+
+// helper function to return CPU set of the model, it returns nil if model
+// is not pinned
+func modelCPUSet(params TFParams) ([]int, error) {
+	switch {
+	case params.CPUSet != "" && params.NUMANode != nil:
+		return nil, fmt.Errorf("cpu_set and numa_node parameters are mutually exclusive")
+	case params.CPUSet != "":
+		return parseCPUList(params.CPUSet)
+	case params.NUMANode != nil:
+		return numaNodeCPUs(*params.NUMANode)
+	}
+	return nil, nil
+}
+
+// helper function to run fn on OS thread bound to given CPUs, threads
+// created by fn (e.g. TF thread pools) inherit CPU affinity of the thread
+func pinnedCall(cpus []int, fn func() error) error {
+	if len(cpus) == 0 {
+		return fn()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// the thread is not unlocked and terminates with the goroutine, such
+		// that its affinity is never used by other goroutines
+		runtime.LockOSThread()
+		defer func() {
+			if p := recover(); p != nil {
+				errc <- fmt.Errorf("pinned call failure: %v", p)
+			}
+		}()
+		if err := setThreadAffinity(cpus); err != nil {
+			errc <- fmt.Errorf("unable to pin thread to CPUs %v: %v", cpus, err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// helper function to create TF session bound to given CPUs
+func newPinnedSession(graph TFGraph, config []byte, cpus []int) (TFSession, error) {
+	var session TFSession
+	err := pinnedCall(cpus, func() error {
+		var err error
+		session, err = _tf.NewSession(graph, config)
+		return err
+	})
+	return session, err
+}
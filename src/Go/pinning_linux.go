@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+// pinning_linux module implements CPU affinity of OS threads on Linux
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// helper function to bind calling OS thread to given CPUs
+func setThreadAffinity(cpus []int) error {
+	var mask [16]uint64 // up to 1024 CPUs, size of glibc cpu_set_t
+	for _, cpu := range cpus {
+		if cpu >= len(mask)*64 {
+			return syscall.EINVAL
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
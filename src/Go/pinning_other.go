@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// pinning_other module reports that CPU pinning is not supported
+
+import "errors"
+
+// helper function to bind calling OS thread to given CPUs
+func setThreadAffinity(cpus []int) error {
+	return errors.New("CPU pinning is supported on Linux only")
+}
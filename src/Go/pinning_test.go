@@ -0,0 +1,78 @@
+package main
+
+// tests of pinning module, they do not require TF C library
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestParseCPUList checks parsing of CPU lists
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-3, 8,10-11,2\n")
+	if err != nil || !reflect.DeepEqual(cpus, []int{0, 1, 2, 3, 8, 10, 11}) {
+		t.Errorf("unexpected CPUs %v %v", cpus, err)
+	}
+	for _, value := range []string{"", "a", "3-1", "-1", "0-"} {
+		if _, err := parseCPUList(value); err == nil {
+			t.Errorf("invalid CPU list '%s' is accepted", value)
+		}
+	}
+}
+
+// TestModelCPUSet checks CPU sets of models
+func TestModelCPUSet(t *testing.T) {
+	orig := numaRoot
+	numaRoot = t.TempDir()
+	t.Cleanup(func() { numaRoot = orig })
+	os.MkdirAll(filepath.Join(numaRoot, "node1"), 0755)
+	ioutil.WriteFile(filepath.Join(numaRoot, "node1", "cpulist"), []byte("16-19\n"), 0644)
+
+	node := 1
+	cpus, err := modelCPUSet(TFParams{NUMANode: &node})
+	if err != nil || !reflect.DeepEqual(cpus, []int{16, 17, 18, 19}) {
+		t.Errorf("unexpected CPUs of NUMA node %v %v", cpus, err)
+	}
+	node = 2
+	if _, err := modelCPUSet(TFParams{NUMANode: &node}); err == nil {
+		t.Error("unknown NUMA node is accepted")
+	}
+	if _, err := modelCPUSet(TFParams{NUMANode: &node, CPUSet: "0"}); err == nil {
+		t.Error("both CPU set and NUMA node are accepted")
+	}
+	if cpus, err := modelCPUSet(TFParams{}); cpus != nil || err != nil {
+		t.Errorf("model without pinning has CPUs %v %v", cpus, err)
+	}
+}
+
+// TestPinnedSessions checks sessions of models pinned to CPUs
+func TestPinnedSessions(t *testing.T) {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("CPU affinity of the process is unknown")
+	}
+	var allowed []int
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Cpus_allowed_list:") {
+			allowed, _ = parseCPUList(strings.TrimPrefix(line, "Cpus_allowed_list:"))
+		}
+	}
+	if len(allowed) == 0 {
+		t.Skip("CPU affinity of the process is unknown")
+	}
+	fake := setupFakeModels(t, 10, 1)
+	params := TFParams{InputNode: "input", OutputNode: "output", CPUSet: strconv.Itoa(allowed[0])}
+	writeModelFiles(t, "pinned", []byte("pinned"), params)
+	if _, err := makePredictions(testRow("pinned")); err != nil {
+		t.Fatal(err)
+	}
+	if config := fake.SessionConfig(); !bytes.Equal(config, []byte{0x10, 1, 0x28, 1, 0x48, 1}) {
+		t.Errorf("unexpected session config of pinned model %v", config)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+// pipeline module provides server-side chains of models
+//
+// Pipelines are declared in server configuration, e.g.
+// "pipelines": [{"name": "higgs", "steps": [
+//     {"model": "encoder", "outputs": ["z1", "z2"]},
+//     {"model": "classifier", "append": true}]}]
+// POST /predict/pipeline/higgs with regular row runs the first model on the
+// row, its outputs become features (named by "outputs", default
+// <model>_<index>) of the next model, and so on. Steps with "append" option
+// receive features of the previous step input together with its outputs.
+// The response contains predictions of the last model while intermediate
+// tensors never leave the server.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// PipelineStep represents single model of the pipeline
+type PipelineStep struct {
+	Model   string   `json:"model"`   // model name or alias
+	Outputs []string `json:"outputs"` // feature names of model outputs used by the next step
+	Append  bool     `json:"append"`  // append outputs of previous step to its input features
+}
+
+// Pipeline represents chain of models
+type Pipeline struct {
+	Name  string         `json:"name"`  // pipeline name
+	Steps []PipelineStep `json:"steps"` // pipeline steps
+}
+
+// global pipelines
+var _pipelines map[string]Pipeline
+
+// helper function to validate and register pipelines
+func initPipelines(pipelines []Pipeline) error {
+	out := make(map[string]Pipeline)
+	for _, p := range pipelines {
+		if p.Name == "" {
+			return errors.New("pipeline without name")
+		}
+		if _, ok := out[p.Name]; ok {
+			return fmt.Errorf("duplicate pipeline %s", p.Name)
+		}
+		if len(p.Steps) == 0 {
+			return fmt.Errorf("pipeline %s does not have steps", p.Name)
+		}
+		for i, step := range p.Steps {
+			if step.Model == "" {
+				return fmt.Errorf("step %d of pipeline %s does not have model", i, p.Name)
+			}
+		}
+		out[p.Name] = p
+	}
+	_pipelines = out
+	return nil
+}
+
+// helper function to build input row of the next step from outputs of the
+// previous one
+func (s PipelineStep) nextRow(row *Row, probs []float32, next PipelineStep) (*Row, error) {
+	if len(s.Outputs) > 0 && len(s.Outputs) != len(probs) {
+		return nil, fmt.Errorf("model %s produced %d outputs while pipeline declares %d", s.Model, len(probs), len(s.Outputs))
+	}
+	out := &Row{Model: next.Model}
+	if next.Append {
+		out.Keys = append(out.Keys, row.Keys...)
+		out.Values = append(out.Values, row.Values...)
+	}
+	for i, p := range probs {
+		key := fmt.Sprintf("%s_%d", s.Model, i)
+		if len(s.Outputs) > 0 {
+			key = s.Outputs[i]
+		}
+		out.Keys = append(out.Keys, key)
+		out.Values = append(out.Values, p)
+	}
+	return out, nil
+}
+
+// helper function to run pipeline for given row
+func runPipeline(p Pipeline, row *Row) ([]float32, error) {
+	r := *row
+	r.Model = p.Steps[0].Model
+	input := &r
+	var probs []float32
+	for i, step := range p.Steps {
+		var err error
+		probs, err = makePredictions(input)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s step %d (%s): %v", p.Name, i, step.Model, err)
+		}
+		if i == len(p.Steps)-1 {
+			break
+		}
+		if input, err = step.nextRow(input, probs, p.Steps[i+1]); err != nil {
+			return nil, fmt.Errorf("pipeline %s step %d (%s): %v", p.Name, i, step.Model, err)
+		}
+	}
+	return probs, nil
+}
+
+// PipelineHandler provides predictions of given pipeline
+func PipelineHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	name := mux.Vars(r)["name"]
+	p, ok := _pipelines[name]
+	if !ok {
+		responseError(w, fmt.Sprintf("pipeline %s is not found", name), nil, http.StatusNotFound)
+		return
+	}
+	row := &Row{}
+	if err := json.NewDecoder(r.Body).Decode(row); err != nil {
+		responseError(w, "unable to unmarshal Row", err, http.StatusBadRequest)
+		return
+	}
+	// pipeline requests are accounted to models of every step
+	client := usageClient(r)
+	for _, step := range p.Steps {
+		observeUsage(client, step.Model, 1)
+	}
+	probs, err := runPipeline(p, row)
+	if err != nil {
+		publish(EventPredictionFailed, name, err.Error())
+		responseError(w, "PipelineHandler: unable to make predictions", err, http.StatusInternalServerError)
+		return
+	}
+	responseProbs(w, probs, outputDigits(row.Raw || rawRequested(r)))
+}
+
+// PipelinesHandler provides list of configured pipelines
+func PipelinesHandler(w http.ResponseWriter, r *http.Request) {
+	pipelines := []Pipeline{}
+	for _, p := range _config.Pipelines {
+		pipelines = append(pipelines, p)
+	}
+	responseJSON(w, pipelines)
+}
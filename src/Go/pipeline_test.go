@@ -0,0 +1,88 @@
+package main
+
+// tests of model pipelines, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestInitPipelines checks validation of pipelines configuration
+func TestInitPipelines(t *testing.T) {
+	for _, pipelines := range [][]Pipeline{
+		{{Steps: []PipelineStep{{Model: "dnn"}}}},
+		{{Name: "p"}},
+		{{Name: "p", Steps: []PipelineStep{{}}}},
+		{{Name: "p", Steps: []PipelineStep{{Model: "dnn"}}}, {Name: "p", Steps: []PipelineStep{{Model: "dnn"}}}},
+	} {
+		if err := initPipelines(pipelines); err == nil {
+			t.Errorf("pipelines %+v should be rejected", pipelines)
+		}
+	}
+}
+
+// TestFakePipeline checks predictions of chain of models
+func TestFakePipeline(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_config.Pipelines = []Pipeline{
+		{Name: "chain", Steps: []PipelineStep{
+			{Model: "dnn", Outputs: []string{"a", "b", "c"}},
+			{Model: "dnn2", Append: true},
+			{Model: "dnn"},
+		}},
+		{Name: "mismatch", Steps: []PipelineStep{
+			{Model: "dnn", Outputs: []string{"a"}},
+			{Model: "dnn2"},
+		}},
+	}
+	if err := initPipelines(_config.Pipelines); err != nil {
+		t.Fatal(err)
+	}
+	initLimiter("1000-S")
+	router := handlers()
+
+	data, err := json.Marshal(testRow(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/pipeline/chain", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var probs []float32
+	if err := json.Unmarshal(w.Body.Bytes(), &probs); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if fake.Runs != 3 {
+		t.Errorf("wrong number of session runs %d", fake.Runs)
+	}
+	// the last step gets outputs of the second one only
+	feeds := fake.Feeds()
+	if shape := feeds["input"].Shape(); len(shape) != 2 || shape[1] != int64(len(testOutputs)) {
+		t.Errorf("unexpected input shape of the last step %v", shape)
+	}
+
+	// step outputs should match declared outputs
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/pipeline/mismatch", bytes.NewReader(data)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code %d of mismatched pipeline", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/pipeline/missing", bytes.NewReader(data)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("wrong status code %d of missing pipeline", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/pipelines", nil))
+	var pipelines []Pipeline
+	json.Unmarshal(w.Body.Bytes(), &pipelines)
+	if len(pipelines) != 2 || pipelines[0].Name != "chain" {
+		t.Errorf("unexpected pipelines %+v", pipelines)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+// policy module provides pluggable authorization policy of the server
+//
+// When "policy" is configured every request is authorized by evaluating
+// (identity, action, model, namespace) input either with embedded rules or
+// with external OPA endpoint, e.g.
+//
+//	"policy": {
+//	    "default": "deny",
+//	    "groups": {"admins": ["CN=alice,OU=Users,DC=example,DC=org"]},
+//	    "rules": [
+//	        {"effect": "allow", "groups": ["admins"]},
+//	        {"effect": "allow", "actions": ["read", "predict"], "namespaces": ["higgs"]},
+//	        {"effect": "allow", "users": ["anonymous"], "paths": ["/ready"]}
+//	    ],
+//	    "opa": "http://opa:8181/v1/data/tfaas/allow"
+//	}
+//
+// Identity is the subject of client certificate verified against "clientCAs"
+// certificates, user of dashboard session (see oidc module) or "anonymous"
+// and its groups. Actions are read (GET requests), predict (prediction,
+// tensor, validation, comparison and evaluation endpoints which only run
+// models), write (other modifications), delete and admin (/admin APIs).
+// Model comes from URL, model parameter or "model"/"models" fields of JSON
+// prediction requests and namespace is "namespace" of model params.json.
+// Rules are evaluated in order, the first matching rule decides, patterns
+// support shell globs and empty lists match anything. When OPA endpoint is
+// set it receives {"input": {...}} and should return {"result": true} or
+// {"result": {"allow": true}}, failing OPA requests deny access. Groups
+// may also be resolved via LDAP and mapped to roles, see ldap module, in
+// which case roles, rules and OPA should all allow the request.
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// policy actions
+const (
+	actionRead    = "read"
+	actionPredict = "predict"
+	actionWrite   = "write"
+	actionDelete  = "delete"
+	actionAdmin   = "admin"
+)
+
+// identity of requests without client certificate
+const anonymousUser = "anonymous"
+
+// PolicyRule represents rule of embedded authorization policy
+type PolicyRule struct {
+	Effect     string   `json:"effect"`     // rule effect: allow or deny
+	Users      []string `json:"users"`      // user patterns
+	Groups     []string `json:"groups"`     // group patterns
+	Actions    []string `json:"actions"`    // actions: read, predict, write, delete, admin
+	Models     []string `json:"models"`     // model patterns
+	Namespaces []string `json:"namespaces"` // namespace patterns
+	Paths      []string `json:"paths"`      // URL path patterns
+}
+
+// PolicyConfig represents authorization policy configuration
+type PolicyConfig struct {
+	Default string              `json:"default"` // effect when no rule matches, default deny
+	Groups  map[string][]string `json:"groups"`  // static groups of users
+	Rules   []PolicyRule        `json:"rules"`   // embedded rules
+	OPA     string              `json:"opa"`     // URL of OPA decision endpoint
+	LDAP    *LDAPConfig         `json:"ldap"`    // LDAP resolution of user groups
+	Roles   []RoleBinding       `json:"roles"`   // role bindings of groups
+}
+
+// PolicyInput represents input of authorization policy
+type PolicyInput struct {
+	User      string   `json:"user"`      // user identity
+	Groups    []string `json:"groups"`    // user groups
+	Action    string   `json:"action"`    // requested action
+	Model     string   `json:"model"`     // model name
+	Namespace string   `json:"namespace"` // model namespace
+	Method    string   `json:"method"`    // HTTP method
+	Path      string   `json:"path"`      // URL path
+}
+
+// Identity represents identity of the client
+type Identity struct {
+	User   string   // user name or certificate subject
+	Login  string   // user login, i.e. first CN of certificate subject
+	Groups []string // user groups
+}
+
+// HTTP client of OPA requests
+var opaClient = &http.Client{Timeout: 5 * time.Second}
+
+// helper function to check if policy is enabled
+func policyEnabled() bool {
+	p := _config.Policy
+	return p != nil && (len(p.Rules) > 0 || len(p.Roles) > 0 || p.OPA != "")
+}
+
+// helper function to return client certificate verified against configured
+// client CAs, certificates which are not verified do not identify clients
+func verifiedCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// helper function to return identity of the client
+func requestIdentity(r *http.Request) Identity {
+	id := Identity{User: anonymousUser}
+	if cert := verifiedCertificate(r); cert != nil {
+		subject := cert.Subject
+		id.User = subject.String()
+		for _, attr := range subject.Names {
+			if attr.Type.Equal(asn1.ObjectIdentifier{2, 5, 4, 3}) {
+				id.Login = fmt.Sprintf("%v", attr.Value)
+				break
+			}
+		}
+		if id.Login == "" {
+			id.Login = subject.CommonName
+		}
+	} else if s, err := requestSession(r); err == nil {
+		id.User, id.Login, id.Groups = s.User, s.Login, s.Groups
+	}
+	if p := _config.Policy; p != nil {
+		for group, users := range p.Groups {
+			if InList(id.User, users) {
+				id.Groups = append(id.Groups, group)
+			}
+		}
+		if p.LDAP != nil {
+			groups, err := p.LDAP.userGroups(id)
+			if err != nil {
+				log.Println("unable to resolve LDAP groups of", id.User, err)
+			}
+			id.Groups = append(id.Groups, groups...)
+		}
+	}
+	return id
+}
+
+// helper function to return path of the request without base path
+func requestPath(r *http.Request) string {
+	p := r.URL.Path
+	if base := strings.TrimSuffix(_config.Base, "/"); base != "" {
+		p = strings.TrimPrefix(p, base)
+	}
+	if p == "" {
+		p = "/"
+	}
+	return p
+}
+
+// prediction endpoints and prefixes of prediction endpoints, they only run
+// models on provided inputs
+var (
+	predictPaths    = []string{"/json", "/proto", "/image", "/tensor", "/compare"}
+	predictPrefixes = []string{"/predict/", "/validate/", "/calibration/", "/roc/"}
+)
+
+// helper function to check if request path is prediction endpoint
+func isPredictPath(p string) bool {
+	for _, prefix := range predictPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return InList(p, predictPaths)
+}
+
+// helper function to classify action of the request
+func requestAction(r *http.Request) string {
+	p := requestPath(r)
+	switch {
+	case strings.HasPrefix(p, "/admin/"):
+		return actionAdmin
+	case isPredictPath(p) || (p == "/jobs" && r.Method == "POST"):
+		return actionPredict
+	case r.Method == "GET" || r.Method == "HEAD":
+		return actionRead
+	case r.Method == "DELETE":
+		return actionDelete
+	}
+	return actionWrite
+}
+
+// helper function to find models of the request, prediction requests
+// without model use default model of the server while models of requests
+// which can not be inspected (e.g. compressed or protobuf payloads) are
+// unknown and match only wildcard rules
+func requestModels(r *http.Request, action string) []string {
+	vars := mux.Vars(r)
+	if strings.HasPrefix(requestPath(r), "/predict/pipeline/") {
+		// pipeline request uses models of all its steps
+		var models []string
+		for _, step := range _pipelines[vars["name"]].Steps {
+			models = append(models, resolveModel(step.Model))
+		}
+		return models
+	}
+	for _, key := range []string{"model", "name"} {
+		if v := vars[key]; v != "" {
+			return []string{resolveModel(v)}
+		}
+	}
+	if v := r.URL.Query().Get("model"); v != "" {
+		return []string{resolveModel(v)}
+	}
+	if action != actionPredict || r.Body == nil {
+		return nil
+	}
+	var models []string
+	p := requestPath(r)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if v := r.FormValue("model"); v != "" {
+			models = append(models, resolveModel(v))
+		}
+	} else if r.Header.Get("Content-Encoding") != "" || p == "/proto" || p == "/predict/proto" {
+		return nil
+	} else {
+		// peek model names of JSON requests and restore request body
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			var rec struct {
+				Model  string   `json:"model"`
+				Models []string `json:"models"`
+			}
+			if err := json.Unmarshal(trimmed, &rec); err != nil {
+				return nil
+			}
+			if rec.Model != "" {
+				models = append(models, resolveModel(rec.Model))
+			}
+			for _, m := range rec.Models {
+				models = append(models, resolveModel(m))
+			}
+		}
+	}
+	if len(models) == 0 && _params.Name != "" {
+		models = append(models, _params.Name)
+	}
+	return models
+}
+
+// helper function to match value against glob patterns, empty patterns
+// match any value
+func matchPatterns(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		for _, v := range values {
+			if ok, _ := path.Match(p, v); ok || p == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to check if rule matches policy input
+func (rule *PolicyRule) matches(in PolicyInput) bool {
+	return matchPatterns(rule.Users, in.User) &&
+		matchPatterns(rule.Groups, in.Groups...) &&
+		matchPatterns(rule.Actions, in.Action) &&
+		matchPatterns(rule.Models, in.Model) &&
+		matchPatterns(rule.Namespaces, in.Namespace) &&
+		matchPatterns(rule.Paths, in.Path)
+}
+
+// helper function to evaluate embedded rules
+func (p *PolicyConfig) evalRules(in PolicyInput) bool {
+	for _, rule := range p.Rules {
+		if rule.matches(in) {
+			return rule.Effect == "allow"
+		}
+	}
+	return p.Default == "allow"
+}
+
+// helper function to evaluate policy with OPA endpoint
+func (p *PolicyConfig) evalOPA(in PolicyInput) (bool, error) {
+	data, err := json.Marshal(map[string]PolicyInput{"input": in})
+	if err != nil {
+		return false, err
+	}
+	resp, err := opaClient.Post(p.OPA, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA %s: %s", p.OPA, resp.Status)
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+	var allow bool
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return allow, nil
+	}
+	var obj struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(out.Result, &obj); err != nil {
+		return false, errors.New("OPA result is neither boolean nor object with allow field")
+	}
+	return obj.Allow, nil
+}
+
+// helper function to evaluate authorization policy
+func (p *PolicyConfig) allow(in PolicyInput) bool {
+	if len(p.Roles) > 0 && !allowRoles(p.Roles, in) {
+		return false
+	}
+	if len(p.Rules) > 0 && !p.evalRules(in) {
+		return false
+	}
+	if p.OPA == "" {
+		return len(p.Rules) > 0 || len(p.Roles) > 0
+	}
+	allow, err := p.evalOPA(in)
+	if err != nil {
+		log.Println("unable to evaluate OPA policy", err)
+		return false
+	}
+	return allow
+}
+
+// helper function to authorize request, it returns nil if request is allowed
+func authorize(r *http.Request) error {
+	id := requestIdentity(r)
+	action := requestAction(r)
+	in := PolicyInput{User: id.User, Groups: id.Groups, Action: action, Method: r.Method, Path: requestPath(r)}
+	models := requestModels(r, action)
+	if len(models) == 0 {
+		models = []string{""}
+	}
+	for _, model := range models {
+		in.Model, in.Namespace = model, ""
+		if model != "" {
+			if params, err := getModelParams(model); err == nil {
+				in.Namespace = params.Namespace
+			}
+		}
+		if !_config.Policy.allow(in) {
+			if model == "" {
+				return fmt.Errorf("%s is not allowed to %s %s", id.User, action, in.Path)
+			}
+			return fmt.Errorf("%s is not allowed to %s model %s", id.User, action, model)
+		}
+	}
+	return nil
+}
+
+// policyMiddleware authorizes requests with configured policy
+func policyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// login requests are allowed to obtain identity
+		if policyEnabled() && !(oidcEnabled() && oidcPath(r)) {
+			if err := authorize(r); err != nil {
+				responseError(w, fmt.Sprintf("access denied: %v", err), err, http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
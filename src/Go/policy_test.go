@@ -0,0 +1,148 @@
+package main
+
+// tests of authorization policy, they do not require TF C library
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// helper function to send request on behalf of given user
+func policyRequest(router http.Handler, user, method, url, body string) int {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if user != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: user}}
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+// TestPolicyRules checks embedded authorization rules
+func TestPolicyRules(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	writeModelFiles(t, "dnn", []byte("dnn"), TFParams{InputNode: "input", OutputNode: "output", Namespace: "higgs"})
+	_config.Policy = &PolicyConfig{
+		Groups: map[string][]string{"admins": {"CN=alice"}},
+		Rules: []PolicyRule{
+			{Effect: "allow", Groups: []string{"admins"}},
+			{Effect: "deny", Users: []string{"CN=mallory"}},
+			{Effect: "allow", Actions: []string{actionRead, actionPredict}, Namespaces: []string{"higgs"}},
+			{Effect: "allow", Users: []string{anonymousUser}, Paths: []string{"/ready"}},
+		},
+	}
+	initLimiter("1000-S")
+	router := handlers()
+	row, _ := json.Marshal(testRow("dnn"))
+	row2, _ := json.Marshal(testRow("dnn2"))
+	tests := []struct {
+		user, method, url, body string
+		code                    int
+	}{
+		{"", "POST", "/json", string(row), http.StatusOK},
+		{"", "POST", "/json", string(row2), http.StatusForbidden},
+		{"", "POST", "/predict/multi", `{"models":["dnn","dnn2"],"keys":["a"],"values":[1]}`, http.StatusForbidden},
+		{"", "POST", "/tensor", `{"model":"dnn","shape":[1,4],"data":[1,2,3,4]}`, http.StatusOK},
+		{"", "POST", "/tensor", `{"model":"dnn2","shape":[1,4],"data":[1,2,3,4]}`, http.StatusForbidden},
+		{"", "POST", "/validate/dnn", string(row), http.StatusOK},
+		{"", "POST", "/validate/dnn2", string(row), http.StatusForbidden},
+		{"", "POST", "/compare", `{"models":["dnn","dnn2"],"keys":["a"],"values":[1]}`, http.StatusForbidden},
+		{"", "GET", "/models/dnn", "", http.StatusOK},
+		{"", "GET", "/models/dnn2", "", http.StatusForbidden},
+		{"", "GET", "/ready", "", http.StatusOK},
+		{"", "GET", "/models", "", http.StatusForbidden},
+		{"mallory", "POST", "/json", string(row), http.StatusForbidden},
+		{"", "DELETE", "/delete/dnn", "", http.StatusForbidden},
+		{"alice", "POST", "/json", string(row2), http.StatusOK},
+		{"alice", "DELETE", "/delete/dnn2", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := policyRequest(router, tt.user, tt.method, tt.url, tt.body); code != tt.code {
+			t.Errorf("%s %s %s: status %d, expected %d", tt.user, tt.method, tt.url, code, tt.code)
+		}
+	}
+	// certificates which are not verified by client CAs do not identify users
+	req := httptest.NewRequest("DELETE", "/delete/dnn", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if id := requestIdentity(req); id.User != anonymousUser {
+		t.Errorf("unverified certificate identifies user %+v", id)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden || !modelExists("dnn") {
+		t.Errorf("unverified certificate is authorized: status %d", rr.Code)
+	}
+
+	_config.Policy.Default = "allow"
+	if code := policyRequest(router, "", "GET", "/models", ""); code != http.StatusOK {
+		t.Errorf("default allow policy: status %d", code)
+	}
+}
+
+// TestRequestAction checks classification of request actions
+func TestRequestAction(t *testing.T) {
+	tests := map[string]string{
+		"POST /json":             actionPredict,
+		"POST /tensor":           actionPredict,
+		"POST /validate/dnn":     actionPredict,
+		"POST /compare":          actionPredict,
+		"POST /calibration/dnn":  actionPredict,
+		"POST /roc/dnn":          actionPredict,
+		"POST /jobs":             actionPredict,
+		"GET /jobs":              actionRead,
+		"POST /upload":           actionWrite,
+		"DELETE /delete/dnn":     actionDelete,
+		"POST /admin/config":     actionAdmin,
+		"GET /models/dnn/labels": actionRead,
+	}
+	for req, action := range tests {
+		parts := strings.Split(req, " ")
+		if a := requestAction(httptest.NewRequest(parts[0], parts[1], nil)); a != action {
+			t.Errorf("%s: wrong action %s, expected %s", req, a, action)
+		}
+	}
+}
+
+// TestPolicyOPA checks authorization via OPA endpoint
+func TestPolicyOPA(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var inputs []PolicyInput
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input PolicyInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		inputs = append(inputs, req.Input)
+		allow := req.Input.User == "CN=bob" && req.Input.Action == actionPredict
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]bool{"allow": allow}})
+	}))
+	defer opa.Close()
+	_config.Policy = &PolicyConfig{OPA: opa.URL}
+	initLimiter("1000-S")
+	router := handlers()
+	row, _ := json.Marshal(testRow("dnn"))
+	if code := policyRequest(router, "bob", "POST", "/json", string(row)); code != http.StatusOK {
+		t.Errorf("unexpected status %d of allowed request", code)
+	}
+	if code := policyRequest(router, "bob", "DELETE", "/delete/dnn", ""); code != http.StatusForbidden {
+		t.Errorf("unexpected status %d of denied request", code)
+	}
+	if len(inputs) != 2 || inputs[0].Model != "dnn" || inputs[1].Action != actionDelete {
+		t.Errorf("unexpected OPA inputs %+v", inputs)
+	}
+	opa.Close()
+	if code := policyRequest(router, "bob", "POST", "/json", string(row)); code != http.StatusForbidden {
+		t.Errorf("unexpected status %d when OPA is unavailable", code)
+	}
+}
@@ -0,0 +1,231 @@
+//go:build !notf
+
+package main
+
+// tests of inference path, use them with race detector, e.g.
+// go test -race -v .
+// go test -run xxx -bench Predict -benchmem .
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+	"github.com/galeone/tensorflow/tensorflow/go/op"
+)
+
+// helper function to write TF graph and its meta-data into model area
+func writeTestModel(tb testing.TB, name string, graph *tf.Graph, params TFParams) {
+	var buf bytes.Buffer
+	if _, err := graph.WriteTo(&buf); err != nil {
+		tb.Fatal(err)
+	}
+	writeModelFiles(tb, name, buf.Bytes(), params)
+}
+
+// helper function to create TF model which applies softmax to linear
+// transformation of its inputs
+func writeRowModel(tb testing.TB, name string) {
+	s := op.NewScope()
+	input := op.Placeholder(s, tf.Float, op.PlaceholderShape(tf.MakeShape(-1, testNumKeys)))
+	var weights [][]float32
+	for i := 0; i < testNumKeys; i++ {
+		var row []float32
+		for j := range testLabels {
+			row = append(row, float32(i+j)/10)
+		}
+		weights = append(weights, row)
+	}
+	logits := op.MatMul(s, input, op.Const(s, weights))
+	op.Softmax(s, logits)
+	graph, err := s.Finalize()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	writeTestModel(tb, name, graph, TFParams{InputNode: "Placeholder", OutputNode: "Softmax"})
+}
+
+// helper function to create TF image model which applies softmax to
+// average color of the image
+func writeImageModel(tb testing.TB, name string) {
+	s := op.NewScope()
+	input := op.Placeholder(s, tf.Float)
+	mean := op.Mean(s, input, op.Const(s, []int32{1, 2}))
+	op.Softmax(s, mean)
+	graph, err := s.Finalize()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	params := TFParams{InputNode: "Placeholder", OutputNode: "Softmax", ImgChannels: int64(len(testLabels))}
+	writeTestModel(tb, name, graph, params)
+}
+
+// helper function to setup model area with TF models and server caches for tests
+func setupTestModels(tb testing.TB, cacheLimit, poolSize int) {
+	setupTestArea(tb, cacheLimit, poolSize)
+	writeRowModel(tb, "dnn")
+	writeRowModel(tb, "dnn2")
+	writeImageModel(tb, "img")
+}
+
+// TestPredictRow checks predictions for single row
+func TestPredictRow(t *testing.T) {
+	setupTestModels(t, 10, 0)
+	probs, err := makePredictions(testRow("dnn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+}
+
+// TestPredictBatch checks predictions for batch of rows
+func TestPredictBatch(t *testing.T) {
+	setupTestModels(t, 10, 0)
+	nrows := 5
+	var values []float32
+	for i := 0; i < nrows; i++ {
+		values = append(values, testRow("dnn").Values...)
+	}
+	tensor, err := makeFlatTensor(values, []int64{int64(nrows), testNumKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probs, err := makeBatchPredictions("dnn", nil, tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != nrows {
+		t.Fatalf("wrong number of predictions %d, expected %d", len(probs), nrows)
+	}
+	for _, p := range probs {
+		checkProbs(t, p)
+	}
+}
+
+// TestPredictImage checks predictions for image model
+func TestPredictImage(t *testing.T) {
+	setupTestModels(t, 10, 0)
+	w := httptest.NewRecorder()
+	ImageTF1Handler(w, imageRequest(t, "img"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var res ClassifyResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Labels) != len(testLabels) {
+		t.Fatalf("wrong classification result %+v", res)
+	}
+}
+
+// TestConcurrentPredictions checks concurrent predictions of several
+// models with model cache evictions and session pools
+func TestConcurrentPredictions(t *testing.T) {
+	setupTestModels(t, 1, 2)
+	models := []string{"dnn", "dnn2"}
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				model := models[(i+j)%len(models)]
+				probs, err := makePredictions(testRow(model))
+				if err == nil && len(probs) != len(testLabels) {
+					err = fmt.Errorf("wrong number of probabilities %v", probs)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if j%5 == 0 {
+					resetModelCache(model)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, stats := range sessionPoolsStats() {
+		if stats.Busy != 0 || stats.Waiting != 0 {
+			t.Errorf("session pool is not released %+v", stats)
+		}
+	}
+}
+
+// BenchmarkPredictRow measures single row predictions
+func BenchmarkPredictRow(b *testing.B) {
+	setupTestModels(b, 10, 0)
+	row := testRow("dnn")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := makePredictions(row); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPredictRowPool measures parallel single row predictions with
+// session pool
+func BenchmarkPredictRowPool(b *testing.B) {
+	setupTestModels(b, 10, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		row := testRow("dnn")
+		for pb.Next() {
+			if _, err := makePredictions(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPredictBatch measures batch predictions
+func BenchmarkPredictBatch(b *testing.B) {
+	setupTestModels(b, 10, 0)
+	nrows := 1000
+	var values []float32
+	for i := 0; i < nrows; i++ {
+		values = append(values, testRow("dnn").Values...)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tensor, err := makeFlatTensor(values, []int64{int64(nrows), testNumKeys})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := makeBatchPredictions("dnn", nil, tensor); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPredictImage measures image predictions
+func BenchmarkPredictImage(b *testing.B) {
+	setupTestModels(b, 10, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		req := imageRequest(b, "img")
+		w := httptest.NewRecorder()
+		b.StartTimer()
+		ImageTF1Handler(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// presets module provides named TF session presets of models
+//
+// Instead of tuning TF threading knobs (intra-op and inter-op thread pools)
+// models may select named session preset via "session_preset" parameter in
+// params.json, e.g. "session_preset": "low-latency". Supported presets are
+// - low-latency: single request uses all available CPUs for every operation
+//   (intra-op threads), operations are run one at a time (one inter-op thread)
+// - high-throughput: every operation runs on single thread, while many
+//   operations of concurrent requests run in parallel on all available CPUs
+// - single-core: model uses single thread, e.g. small models co-hosted with
+//   many other models
+// Threads are sized by CPUs available to the server (see limits module) and
+// sessions of models with presets get their own thread pools. Presets take
+// precedence over server wide configProto, intraOpThreads and
+// interOpThreads options which are used by models without presets.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// session presets and their intra-op and inter-op threads
+var sessionPresets = map[string]func(cpus int) (int, int){
+	"low-latency": func(cpus int) (int, int) {
+		return cpus, 1
+	},
+	"high-throughput": func(cpus int) (int, int) {
+		return 1, cpus
+	},
+	"single-core": func(cpus int) (int, int) {
+		return 1, 1
+	},
+}
+
+// helper function to return names of session presets
+func sessionPresetNames() []string {
+	var names []string
+	for name := range sessionPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// helper function to encode TF ConfigProto of given session preset for
+// given number of CPUs, besides threads it sets use_per_session_threads
+// (field 9 of ConfigProto) such that sessions of the model do not share
+// global thread pools
+func presetConfigProto(preset string, cpus int) ([]byte, error) {
+	threads, ok := sessionPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown session preset '%s', supported presets %v", preset, sessionPresetNames())
+	}
+	config := threadsConfigProto(threads(cpus))
+	config = binary.AppendUvarint(config, uint64(9<<3))
+	return binary.AppendUvarint(config, 1), nil
+}
+
+// helper function to return TF session config and CPU set of given model,
+// it returns nil config if model does not use session preset (or CPU
+// pinning) and server config should be used
+func modelSessionConfig(model string) ([]byte, []int, error) {
+	params, err := getModelParams(model)
+	if err != nil {
+		return nil, nil, nil
+	}
+	cpuSet, err := modelCPUSet(params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("model %s: %v", model, err)
+	}
+	preset, cpus := params.SessionPreset, availableCPUs()
+	if len(cpuSet) > 0 {
+		// pinned models are sized by their CPU set
+		cpus = len(cpuSet)
+		if preset == "" {
+			preset = "low-latency"
+		}
+	}
+	if preset == "" {
+		return nil, nil, nil
+	}
+	config, err := presetConfigProto(preset, cpus)
+	if err != nil {
+		return nil, nil, fmt.Errorf("model %s: %v", model, err)
+	}
+	return config, cpuSet, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+// tests of presets module, they do not require TF C library
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestPresetConfigProto checks encoding of session presets
+func TestPresetConfigProto(t *testing.T) {
+	orig := _limits
+	t.Cleanup(func() { _limits = orig })
+	_limits = ResourceLimits{CPUs: 8, HostCPUs: 64, Source: "cgroup2"}
+	expect := map[string][]byte{
+		"low-latency":     {0x10, 8, 0x28, 1, 0x48, 1},
+		"high-throughput": {0x10, 1, 0x28, 8, 0x48, 1},
+		"single-core":     {0x10, 1, 0x28, 1, 0x48, 1},
+	}
+	for preset, config := range expect {
+		data, err := presetConfigProto(preset, availableCPUs())
+		if err != nil || !bytes.Equal(data, config) {
+			t.Errorf("unexpected config of %s preset %v %v", preset, data, err)
+		}
+	}
+	if _, err := presetConfigProto("fast", 1); err == nil {
+		t.Error("unknown preset should be rejected")
+	}
+}
+
+// TestSessionPresets checks sessions of models with session presets
+func TestSessionPresets(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	writeModelFiles(t, "fast", []byte("fast"), TFParams{InputNode: "input", OutputNode: "output", SessionPreset: "single-core"})
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	if config := fake.SessionConfig(); config != nil {
+		t.Errorf("model without preset should use server config %v", config)
+	}
+	if _, err := makePredictions(testRow("fast")); err != nil {
+		t.Fatal(err)
+	}
+	if config := fake.SessionConfig(); !bytes.Equal(config, []byte{0x10, 1, 0x28, 1, 0x48, 1}) {
+		t.Errorf("unexpected session config %v", config)
+	}
+
+	// models with unknown presets are rejected
+	writeModelFiles(t, "bad", []byte("bad"), TFParams{InputNode: "input", OutputNode: "output", SessionPreset: "fast"})
+	if _, err := makePredictions(testRow("bad")); err == nil {
+		t.Error("model with unknown preset should fail")
+	}
+	if err := validateModel(filepath.Join(_config.ModelDir, "bad"), "bad"); err == nil {
+		t.Error("model with unknown preset should not be valid")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+// proxy module provides proxy (sharding) mode of the server
+//
+// The server with proxyBackends option, e.g.
+// "proxyBackends": ["http://tfaas-0:8083", "http://tfaas-1:8083"]
+// forwards prediction requests to its backends instead of serving them.
+// Requests with routing key header (routingKeyHeader option, default
+// X-Routing-Key), e.g. id of analysis job, are routed by rendezvous hashing
+// of the key, such that all requests of the same job hit the same backend
+// which improves locality of prediction caches and states of stateful
+// models, e.g.
+// scurl -H "X-Routing-Key: job-123" -d @input.json https://localhost:8083/json
+// Adding or removing backends remaps only keys of affected backends, and
+// keys of failed backend move to the next backend of their ranking until it
+// recovers. Requests without routing key are balanced among backends in
+// round-robin fashion. Backend requests have adaptive timeouts and may be
+// hedged, see hedge module.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default routing key header
+const defaultRoutingKeyHeader = "X-Routing-Key"
+
+// time to skip failed backend
+const proxyBackendCooldown = 10 * time.Second
+
+// proxied endpoints of the server
+var proxiedEndpoints = []string{"/json", "/proto", "/image", "/tensor", "/predict/"}
+
+// ProxyBackend represents backend server of proxy mode
+type ProxyBackend struct {
+	URL       string                 // URL of the backend
+	proxy     *httputil.ReverseProxy // reverse proxy to the backend
+	downUntil time.Time              // time until failed backend is skipped
+	latencies []time.Duration        // recent response latencies of the backend
+	next      int                    // position of next latency in the window
+}
+
+// global backends of proxy mode
+var (
+	_backends     []*ProxyBackend
+	_backendsLock sync.Mutex
+	_backendsNext uint64
+)
+
+// helper function to setup backends of proxy mode
+func initProxy(backends []string) error {
+	var out []*ProxyBackend
+	for _, b := range backends {
+		u, err := url.Parse(b)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy backend %q", b)
+		}
+		backend := &ProxyBackend{URL: strings.TrimRight(b, "/")}
+		backend.proxy = httputil.NewSingleHostReverseProxy(u)
+		backend.proxy.ModifyResponse = func(resp *http.Response) error {
+			if start, ok := resp.Request.Context().Value(proxyStartKey{}).(time.Time); ok {
+				backend.observe(time.Since(start))
+			}
+			return nil
+		}
+		backend.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				atomic.AddUint64(&_proxyTimeouts, 1)
+			}
+			if !errors.Is(r.Context().Err(), context.Canceled) {
+				markBackendDown(backend)
+			}
+			responseError(w, "proxy backend failure", err, http.StatusBadGateway)
+		}
+		out = append(out, backend)
+	}
+	_backendsLock.Lock()
+	_backends = out
+	_backendsLock.Unlock()
+	if len(out) > 0 {
+		log.Printf("proxy mode with %d backends", len(out))
+	}
+	return nil
+}
+
+// helper function to skip failed backend for a while
+func markBackendDown(backend *ProxyBackend) {
+	_backendsLock.Lock()
+	defer _backendsLock.Unlock()
+	backend.downUntil = time.Now().Add(proxyBackendCooldown)
+	log.Printf("proxy backend %s is down", backend.URL)
+}
+
+// helper function to compute rendezvous weight of backend for given key
+func rendezvousWeight(key, backend string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(backend))
+	return h.Sum64()
+}
+
+// helper function to choose backend of the request with given routing key,
+// it returns nil if proxy mode is disabled
+func chooseBackend(key string) *ProxyBackend {
+	if backends := rankBackends(key); len(backends) > 0 {
+		return backends[0]
+	}
+	return nil
+}
+
+// helper function to rank backends of the request with given routing key,
+// requests are sent to the first backend and hedged to the second one
+func rankBackends(key string) []*ProxyBackend {
+	_backendsLock.Lock()
+	defer _backendsLock.Unlock()
+	if len(_backends) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var alive []*ProxyBackend
+	for _, b := range _backends {
+		if now.After(b.downUntil) {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		// all backends failed, give them another chance
+		alive = _backends
+	}
+	ranked := make([]*ProxyBackend, len(alive))
+	if key == "" {
+		n := atomic.AddUint64(&_backendsNext, 1)
+		for i := range alive {
+			ranked[i] = alive[(n-1+uint64(i))%uint64(len(alive))]
+		}
+		return ranked
+	}
+	copy(ranked, alive)
+	sort.Slice(ranked, func(i, j int) bool {
+		return rendezvousWeight(key, ranked[i].URL) > rendezvousWeight(key, ranked[j].URL)
+	})
+	return ranked
+}
+
+// helper function to return routing key header of the server
+func routingKeyHeader() string {
+	if _config.RoutingKeyHeader != "" {
+		return _config.RoutingKeyHeader
+	}
+	return defaultRoutingKeyHeader
+}
+
+// helper function to check if request path is proxied endpoint
+func proxied(path string) bool {
+	if base := strings.TrimRight(_config.Base, "/"); base != "" {
+		path = strings.TrimPrefix(path, base)
+	}
+	for _, e := range proxiedEndpoints {
+		if path == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(path, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxy middleware forwards prediction requests to backends in proxy mode
+func proxyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !proxied(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		backends := rankBackends(r.Header.Get(routingKeyHeader()))
+		if len(backends) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _config.Verbose > 0 {
+			log.Printf("proxy %s to %s", r.URL.Path, backends[0].URL)
+		}
+		if _config.ProxyHedge && len(backends) > 1 {
+			if body, ok := hedgeBody(r); ok {
+				hedgedForward(w, r, backends, body)
+				return
+			}
+		}
+		backend := backends[0]
+		ctx, cancel := context.WithTimeout(r.Context(), backend.timeout())
+		defer cancel()
+		ctx = context.WithValue(ctx, proxyStartKey{}, time.Now())
+		backend.proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
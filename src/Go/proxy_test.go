@@ -0,0 +1,86 @@
+package main
+
+// tests of proxy mode, they do not require TF C library
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// helper function to send request via proxy middleware and return backend name
+func proxyRequest(t *testing.T, handler http.Handler, path, key string) string {
+	req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+	if key != "" {
+		req.Header.Set(defaultRoutingKeyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body, _ := ioutil.ReadAll(rr.Body)
+	return string(body)
+}
+
+// TestProxyRouting checks sticky routing of requests with routing keys
+func TestProxyRouting(t *testing.T) {
+	var backends []string
+	var servers []*httptest.Server
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("backend%d", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+		backends = append(backends, srv.URL)
+	}
+	if err := initProxy(backends); err != nil {
+		t.Fatal(err)
+	}
+	defer initProxy(nil)
+	handler := proxyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local"))
+	}))
+
+	// requests of the same key hit the same backend
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("job-%d", i)
+		first := proxyRequest(t, handler, "/json", key)
+		if !strings.HasPrefix(first, "backend") {
+			t.Fatalf("request is not proxied: %s", first)
+		}
+		for _, path := range []string{"/predict/batch", "/tensor", "/json"} {
+			if got := proxyRequest(t, handler, path, key); got != first {
+				t.Errorf("key %s is routed to %s and %s", key, first, got)
+			}
+		}
+	}
+	// requests without key are balanced among backends
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[proxyRequest(t, handler, "/json", "")] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("requests without key are not balanced %v", seen)
+	}
+	// other endpoints are served locally
+	if got := proxyRequest(t, handler, "/models", "job-1"); got != "local" {
+		t.Errorf("wrong handler %s of local endpoint", got)
+	}
+
+	// keys of failed backend move to other backends
+	failed := proxyRequest(t, handler, "/json", "job-1")
+	idx := int(failed[len(failed)-1] - '0')
+	servers[idx].Close()
+	proxyRequest(t, handler, "/json", "job-1")
+	got := proxyRequest(t, handler, "/json", "job-1")
+	if got == failed || !strings.HasPrefix(got, "backend") {
+		t.Errorf("key of failed backend %s is routed to %s", failed, got)
+	}
+
+	if err := initProxy([]string{"tfaas:8083"}); err == nil {
+		t.Error("backend without scheme is accepted")
+	}
+}
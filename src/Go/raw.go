@@ -0,0 +1,55 @@
+package main
+
+// raw module provides passthrough of raw model outputs
+//
+// Downstream tooling, e.g. calibration, must see exact model outputs rather
+// than post-processed ones. Clients may request raw outputs per request via
+// raw=true query parameter (or "raw": true of JSON row, raw form field of
+// image requests), while models may always provide them via "raw_outputs":
+// true of their params.json. Raw outputs are returned untouched: softmax
+// overrides are not applied, values are not rounded to precision option and
+// image classification returns full output vector without label pairing,
+// sorting or truncation to top_n labels.
+
+import (
+	"net/http"
+	"strings"
+)
+
+// helper function to check if client requested raw outputs
+func rawRequested(r *http.Request) bool {
+	v := r.URL.Query().Get("raw")
+	if v == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		v = r.FormValue("raw")
+	}
+	return v == "true" || v == "1"
+}
+
+// helper function to check if outputs of given model should be returned
+// untouched, either requested by the client or declared by the model
+func rawOutputs(model string, requested bool) bool {
+	if requested {
+		return true
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	params, err := getModelParams(resolveModel(model))
+	return err == nil && params.RawOutputs
+}
+
+// helper function to return number of significant digits of outputs, raw
+// outputs are not rounded
+func outputDigits(raw bool) int {
+	if raw {
+		return 0
+	}
+	return _config.Precision
+}
+
+// helper function to mark response with raw outputs
+func setRawOutputsHeader(w http.ResponseWriter, raw bool) {
+	if raw {
+		w.Header().Set("Raw-Outputs", "true")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// tests of raw outputs passthrough, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestFakeRawOutputs checks that raw outputs are neither post-processed
+// nor rounded
+func TestFakeRawOutputs(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	fake.Outputs = []float32{0.123456, 0.3, 0.576544}
+	orig := _config.Precision
+	defer func() { _config.Precision = orig }()
+	_config.Precision = 2
+	params := TFParams{InputNode: "input", OutputNode: "output", Overridable: []string{"softmax"}}
+	writeModelFiles(t, "logits", []byte("logits"), params)
+
+	predict := func(query string, row *Row) (string, http.Header) {
+		data, err := json.Marshal(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/json"+query, bytes.NewReader(data))
+		rr := httptest.NewRecorder()
+		PredictHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr.Body.String(), rr.Header()
+	}
+	row := testRow("logits")
+	row.Overrides = &Overrides{Softmax: true}
+	if body, hdr := predict("", row); body == "[0.12,0.3,0.58]\n" || hdr.Get("Raw-Outputs") != "" {
+		t.Errorf("softmax is not applied %s", body)
+	}
+	expect := "[0.123456,0.3,0.576544]\n"
+	if body, hdr := predict("?raw=true", row); body != expect || hdr.Get("Raw-Outputs") != "true" {
+		t.Errorf("wrong raw outputs %s, expected %s", body, expect)
+	}
+	row.Raw = true
+	if body, _ := predict("", row); body != expect {
+		t.Errorf("wrong raw outputs %s, expected %s", body, expect)
+	}
+	row = testRow("logits")
+	if body, _ := predict("", row); body != "[0.12,0.3,0.58]\n" {
+		t.Errorf("outputs are not rounded %s", body)
+	}
+
+	// models may always provide raw outputs
+	params.RawOutputs = true
+	writeModelFiles(t, "raw", []byte("raw"), params)
+	if body, _ := predict("", testRow("raw")); body != expect {
+		t.Errorf("wrong raw outputs of the model %s, expected %s", body, expect)
+	}
+}
+
+// TestFakeRawImageOutputs checks raw outputs of image classification
+func TestFakeRawImageOutputs(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	req := imageRequest(t, "img")
+	req.URL.RawQuery = "raw=true"
+	rr := httptest.NewRecorder()
+	ImageHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var probs []float32
+	if err := json.Unmarshal(rr.Body.Bytes(), &probs); err != nil {
+		t.Fatal(err)
+	}
+	// full output vector in model order
+	if len(probs) != len(testOutputs) || probs[0] != testOutputs[0] || probs[2] != testOutputs[2] {
+		t.Errorf("wrong raw outputs %v, expected %v", probs, testOutputs)
+	}
+}
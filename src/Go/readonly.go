@@ -0,0 +1,66 @@
+package main
+
+// readonly module provides read-only mode of the server
+//
+// In read-only mode the server rejects requests which mutate model area,
+// i.e. uploads, deletions, rollbacks, alias changes and model imports,
+// while predictions keep working. The mode is enabled by readOnly
+// configuration option and can be toggled at run time via
+// POST /admin/readonly with {"readOnly": true|false}.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// global read-only flag
+var _readOnly int32
+
+// ReadOnlyRequest represents request to toggle read-only mode
+type ReadOnlyRequest struct {
+	ReadOnly bool `json:"readOnly"` // read-only mode of the server
+}
+
+// helper function to check if server is in read-only mode
+func isReadOnly() bool {
+	return atomic.LoadInt32(&_readOnly) == 1
+}
+
+// helper function to set read-only mode of the server
+func setReadOnly(readOnly bool) {
+	var flag int32
+	if readOnly {
+		flag = 1
+	}
+	atomic.StoreInt32(&_readOnly, flag)
+}
+
+// mutating wraps handler which modifies model area, the handler is rejected
+// in read-only mode unless it is used to read data, retries of requests with
+// Idempotency-Key header get outcome of the original request
+func mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isReadOnly() && r.Method != "GET" && r.Method != "HEAD" {
+			responseError(w, "server is in read-only mode", nil, http.StatusForbidden)
+			return
+		}
+		idempotent(handler)(w, r)
+	}
+}
+
+// ReadOnlyHandler provides and toggles read-only mode of the server
+func ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var req ReadOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			responseError(w, "unable to decode read-only request", err, http.StatusBadRequest)
+			return
+		}
+		setReadOnly(req.ReadOnly)
+		log.Printf("set read-only mode %v", req.ReadOnly)
+	}
+	responseJSON(w, ReadOnlyRequest{ReadOnly: isReadOnly()})
+}
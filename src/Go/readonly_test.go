@@ -0,0 +1,71 @@
+package main
+
+// tests of read-only mode, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestReadOnly checks that read-only mode rejects changes of model area
+// while predictions keep working
+func TestReadOnly(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	t.Cleanup(func() { setReadOnly(false) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/readonly", bytes.NewBufferString(`{"readOnly": true}`)))
+	var rec ReadOnlyRequest
+	json.Unmarshal(w.Body.Bytes(), &rec)
+	if w.Code != http.StatusOK || !rec.ReadOnly || !isReadOnly() {
+		t.Fatalf("unable to enable read-only mode, status %d", w.Code)
+	}
+	requests := []struct {
+		method, path, body string
+	}{
+		{"DELETE", "/delete/dnn", ""},
+		{"POST", "/upload", "bundle"},
+		{"POST", "/upload/sessions", `{"size": 1}`},
+		{"POST", "/models/dnn/rollback", ""},
+		{"POST", "/admin/promote", `{"alias": "prod", "model": "dnn"}`},
+		{"POST", "/params", `{}`},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(req.method, req.path, bytes.NewBufferString(req.body)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: unexpected status %d in read-only mode", req.method, req.path, w.Code)
+		}
+	}
+	if !modelExists("dnn") {
+		t.Fatal("model is removed in read-only mode")
+	}
+	data, _ := json.Marshal(testRow("dnn"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d of prediction in read-only mode", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/models/dnn", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d of model meta-data in read-only mode", w.Code)
+	}
+
+	// disable read-only mode
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/readonly", bytes.NewBufferString(`{"readOnly": false}`)))
+	if w.Code != http.StatusOK || isReadOnly() {
+		t.Fatalf("unable to disable read-only mode, status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/delete/dnn", nil))
+	if w.Code != http.StatusOK || modelExists("dnn") {
+		t.Errorf("unexpected status %d of model deletion", w.Code)
+	}
+}
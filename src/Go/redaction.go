@@ -0,0 +1,252 @@
+package main
+
+// redaction module provides redaction of sensitive model inputs
+//
+// Models may declare sensitive features in params.json, e.g.
+// "sensitive": ["patient_id", "age"], "redaction": "hash"
+// Values of such features (and "text" input if it is listed) are replaced
+// by keyed hash (default) or dropped in captured traffic, access logs and
+// debug output, such that request logging can be enabled without storing
+// personal data. Hashes are HMAC-SHA256 with "redactionKey" option (which
+// may be secret reference, see secrets module), otherwise with random key of
+// the server process, i.e. hashes allow to correlate records without
+// revealing values. Sensitive inputs which can not be inspected, e.g.
+// protobuf requests, are dropped from captured traffic altogether.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	tfaaspb "github.com/vkuznet/TFaaS/tfaaspb"
+)
+
+// redaction modes of sensitive features
+const (
+	redactHash = "hash"
+	redactDrop = "drop"
+)
+
+// global random key of hashes when redactionKey is not configured
+var (
+	_redactionKey     []byte
+	_redactionKeyOnce sync.Once
+)
+
+// helper function to return sensitive features of given model and its
+// redaction mode
+func sensitiveFeatures(model string) ([]string, string) {
+	if model == "" {
+		model = _params.Name
+	}
+	if model == "" {
+		return nil, ""
+	}
+	params, err := getModelParams(resolveModel(model))
+	if err != nil || len(params.Sensitive) == 0 {
+		return nil, ""
+	}
+	mode := params.Redaction
+	if mode != redactDrop {
+		mode = redactHash
+	}
+	return params.Sensitive, mode
+}
+
+// helper function to hash sensitive value
+func hashValue(v interface{}) string {
+	key := []byte(_config.RedactionKey)
+	if len(key) == 0 {
+		_redactionKeyOnce.Do(func() {
+			_redactionKey = make([]byte, 32)
+			rand.Read(_redactionKey)
+		})
+		key = _redactionKey
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%v", v)
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// helper function to redact value of sensitive feature, it returns false
+// if value should be dropped
+func redactValue(v interface{}, mode string) (interface{}, bool) {
+	if mode == redactDrop {
+		return nil, false
+	}
+	return hashValue(v), true
+}
+
+// helper function to redact JSON record of the row or batch of rows, i.e.
+// record with keys and values (or sequence) fields
+func redactRecord(rec map[string]interface{}, sensitive []string, mode string) {
+	// top level inputs, e.g. text of NLP models
+	for _, name := range sensitive {
+		if v, ok := rec[name]; ok && name != "keys" && name != "values" && name != "model" {
+			if nv, keep := redactValue(v, mode); keep {
+				rec[name] = nv
+			} else {
+				delete(rec, name)
+			}
+		}
+	}
+	keys, _ := rec["keys"].([]interface{})
+	if len(keys) == 0 {
+		return
+	}
+	var columns []int
+	var kept []interface{}
+	for i, k := range keys {
+		if name, ok := k.(string); ok && InList(name, sensitive) {
+			columns = append(columns, i)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	if len(columns) == 0 {
+		return
+	}
+	// values of rows (or batch rows) and timesteps of sequences are laid
+	// out in order of keys
+	redactColumns := func(values []interface{}) []interface{} {
+		var out []interface{}
+		for i, v := range values {
+			if !containsInt(columns, i%len(keys)) {
+				out = append(out, v)
+				continue
+			}
+			if nv, keep := redactValue(v, mode); keep {
+				out = append(out, nv)
+			}
+		}
+		return out
+	}
+	if values, ok := rec["values"].([]interface{}); ok && len(values)%len(keys) == 0 {
+		rec["values"] = redactColumns(values)
+	} else if ok {
+		// values which do not match keys can not be attributed to features
+		delete(rec, "values")
+	}
+	if steps, ok := rec["sequence"].([]interface{}); ok {
+		for i, step := range steps {
+			if values, ok := step.([]interface{}); ok && len(values) == len(keys) {
+				steps[i] = redactColumns(values)
+			} else {
+				steps[i] = nil
+			}
+		}
+	}
+	if mode == redactDrop {
+		rec["keys"] = kept
+	}
+}
+
+// helper function to check if list contains given integer
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to redact request body of given path, it returns
+// redacted body and flag if body was changed
+func redactBody(body []byte, path, query string) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(trimmed, &rec); err != nil {
+			return body, false
+		}
+		model, _ := rec["model"].(string)
+		if model == "" {
+			if q, err := url.ParseQuery(query); err == nil {
+				model = q.Get("model")
+			}
+		}
+		sensitive, mode := sensitiveFeatures(model)
+		if len(sensitive) == 0 {
+			return body, false
+		}
+		redactRecord(rec, sensitive, mode)
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, true
+		}
+		return data, true
+	}
+	if path == "/proto" || path == "/predict/proto" {
+		// protobuf rows are dropped if their model has sensitive features
+		row := &tfaaspb.Row{}
+		if err := proto.Unmarshal(body, row); err != nil {
+			return body, false
+		}
+		if sensitive, _ := sensitiveFeatures(row.Model); len(sensitive) > 0 {
+			return nil, true
+		}
+	}
+	return body, false
+}
+
+// helper function to redact query parameters named after sensitive
+// features of request URI
+func redactURI(uri string) string {
+	parts := strings.SplitN(uri, "?", 2)
+	if len(parts) != 2 {
+		return uri
+	}
+	query, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return uri
+	}
+	sensitive, mode := sensitiveFeatures(query.Get("model"))
+	changed := false
+	for _, name := range sensitive {
+		values, ok := query[name]
+		if !ok {
+			continue
+		}
+		changed = true
+		if mode == redactDrop {
+			query.Del(name)
+			continue
+		}
+		for i, v := range values {
+			values[i] = hashValue(v)
+		}
+	}
+	if !changed {
+		return uri
+	}
+	return parts[0] + "?" + query.Encode()
+}
+
+// helper function to represent row in debug output with redacted
+// sensitive features
+func redactedRow(row *Row) string {
+	sensitive, mode := sensitiveFeatures(row.Model)
+	if len(sensitive) == 0 {
+		return row.String()
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return "<redacted>"
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return "<redacted>"
+	}
+	redactRecord(rec, sensitive, mode)
+	data, _ = json.Marshal(rec)
+	return string(data)
+}
@@ -0,0 +1,100 @@
+package main
+
+// tests of sensitive features redaction, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	tfaaspb "github.com/vkuznet/TFaaS/tfaaspb"
+)
+
+// TestRedactBody checks redaction of sensitive features of request bodies
+func TestRedactBody(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Sensitive: []string{"ssn", "text"}}
+	writeModelFiles(t, "pii", []byte("pii"), params)
+	params.Redaction = redactDrop
+	writeModelFiles(t, "pii2", []byte("pii2"), params)
+	_config.RedactionKey = "secret"
+
+	tests := []struct {
+		body, expect string
+	}{
+		{`{"model":"pii","keys":["ssn","x"],"values":[123456789,1]}`,
+			`{"keys":["ssn","x"],"model":"pii","values":["` + hashValue(123456789.0) + `",1]}`},
+		{`{"model":"pii2","keys":["ssn","x"],"values":[123456789,1,987654321,2]}`,
+			`{"keys":["x"],"model":"pii2","values":[1,2]}`},
+		{`{"model":"pii2","keys":["x","ssn"],"sequence":[[1,123456789],[2,987654321]]}`,
+			`{"keys":["x"],"model":"pii2","sequence":[[1],[2]]}`},
+		{`{"model":"pii","text":"john doe"}`, `{"model":"pii","text":"` + hashValue("john doe") + `"}`},
+		{`{"model":"pii","keys":["ssn","x"],"values":[123456789]}`, `{"keys":["ssn","x"],"model":"pii"}`},
+	}
+	for _, tt := range tests {
+		data, redacted := redactBody([]byte(tt.body), "/json", "")
+		if !redacted || string(data) != tt.expect {
+			t.Errorf("redacted body %s, expected %s", data, tt.expect)
+		}
+	}
+	// rows of models without sensitive features are kept as is
+	body := `{"model":"dnn","keys":["ssn"],"values":[123456789]}`
+	if data, redacted := redactBody([]byte(body), "/json", ""); redacted || string(data) != body {
+		t.Errorf("unexpected redaction of %s", data)
+	}
+	// protobuf rows of sensitive models are dropped
+	data, _ := proto.Marshal(&tfaaspb.Row{Key: []string{"ssn"}, Value: []float32{1}, Model: "pii"})
+	if data, redacted := redactBody(data, "/proto", ""); !redacted || data != nil {
+		t.Errorf("protobuf row of sensitive model is kept")
+	}
+	// query parameters and debug output are redacted too
+	if uri := redactURI("/predict/json?model=pii2&ssn=123456789&x=1"); uri != "/predict/json?model=pii2&x=1" {
+		t.Errorf("unexpected redacted URI %s", uri)
+	}
+	row := &Row{Model: "pii", Keys: []string{"ssn", "x"}, Values: []float32{123456789, 1}}
+	if s := redactedRow(row); strings.Contains(s, "123456789") || strings.Contains(s, "1.23456792e+08") {
+		t.Errorf("debug output contains sensitive value %s", s)
+	}
+}
+
+// TestRedactCapture checks that captured traffic does not contain sensitive features
+func TestRedactCapture(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	writeModelFiles(t, "pii", []byte("pii"), TFParams{InputNode: "input", OutputNode: "output", Sensitive: []string{"attr1"}})
+	_config.CaptureDir = filepath.Join(_config.ModelDir, ".capture")
+	initCapture()
+	t.Cleanup(func() { _capture = nil })
+	initLimiter("1000-S")
+	router := handlers()
+	row := testRow("pii")
+	row.Values[1] = 424242
+	data, _ := json.Marshal(row)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	files, _ := filepath.Glob(filepath.Join(_config.CaptureDir, "capture-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected capture files %v", files)
+	}
+	captured, _ := ioutil.ReadFile(files[0])
+	var rec CaptureRecord
+	if err := json.Unmarshal(captured, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Redacted || bytes.Contains(rec.Body, []byte("424242")) || !bytes.Contains(rec.Body, []byte("hmac:")) {
+		t.Errorf("unexpected captured body %s", rec.Body)
+	}
+	// redacted requests are not replayed
+	report, err := replay(http.DefaultClient, files[0], "http://localhost:1", "")
+	if err != nil || report.Redacted != 1 || report.Requests != 0 {
+		t.Errorf("unexpected replay report %+v %v", report, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+// rename_linux module implements atomic exchange of directories on Linux
+
+import "golang.org/x/sys/unix"
+
+// helper function to atomically exchange given paths
+func exchangePaths(a, b string) error {
+	return unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// rename_other module reports that atomic exchange of directories is not
+// supported
+
+import "errors"
+
+// helper function to atomically exchange given paths
+func exchangePaths(a, b string) error {
+	return errors.New("atomic exchange of paths is supported on Linux only")
+}
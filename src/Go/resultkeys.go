@@ -0,0 +1,214 @@
+package main
+
+// resultkeys module provides idempotent result keys of streaming modes
+//
+// Results produced by Kafka and MQTT modes carry deterministic "resultKey":
+// <topic>:<eventID> for rows with client event identifier (see eventid
+// module), otherwise <topic>/<partition>/<offset> of Kafka records. Kafka
+// results use it as record key. Result keys of produced results are kept
+// for "resultKeysTTL" seconds (default 24 hours) and replayed messages, e.g.
+// Kafka records consumed again after restart of the server or rebalance of
+// consumer group, are not produced again but only acknowledged, such that
+// downstream consumers do not double-count predictions. With "resultKeysFile"
+// option keys are journaled into the file and survive restarts of the
+// server, otherwise they are kept in memory. Results produced right before
+// a crash may still be duplicated, i.e. outputs are exactly-once-ish.
+// Skipped duplicates are counted by tfaas_duplicate_results_total metric.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default time in seconds to keep result keys
+const defaultResultKeysTTL = 24 * 3600
+
+// ResultKeys represents journal of result keys of produced results
+type ResultKeys struct {
+	Path  string           // journal file, keys are kept in memory if empty
+	TTL   time.Duration    // lifetime of result keys
+	keys  map[string]int64 // expiration times (unix seconds) of keys
+	lines int              // number of journal lines
+	lock  sync.Mutex
+}
+
+// resultKeyRecord represents journal line of result key
+type resultKeyRecord struct {
+	Key     string `json:"key"`     // result key
+	Expires int64  `json:"expires"` // expiration time (unix seconds)
+}
+
+// global result keys and counter of skipped duplicates
+var (
+	_resultKeys       *ResultKeys
+	_duplicateResults uint64
+)
+
+// helper function to create result keys and load their journal
+func newResultKeys(path string, ttl time.Duration) (*ResultKeys, error) {
+	if ttl <= 0 {
+		ttl = defaultResultKeysTTL * time.Second
+	}
+	r := &ResultKeys{Path: path, TTL: ttl, keys: make(map[string]int64)}
+	if path == "" {
+		return r, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec resultKeyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// truncated line of interrupted write
+			continue
+		}
+		r.lines++
+		if rec.Expires > now {
+			r.keys[rec.Key] = rec.Expires
+		}
+	}
+	return r, scanner.Err()
+}
+
+// helper function to return result key of streaming message
+func resultKey(topic string, partition int, offset int64, eventID string) string {
+	if eventID != "" {
+		return fmt.Sprintf("%s:%s", topic, eventID)
+	}
+	if offset < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d/%d", topic, partition, offset)
+}
+
+// seen checks if result with given key was already produced
+func (r *ResultKeys) seen(key string) bool {
+	if r == nil || key == "" {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	expires, ok := r.keys[key]
+	if ok && expires > time.Now().Unix() {
+		atomic.AddUint64(&_duplicateResults, 1)
+		return true
+	}
+	return false
+}
+
+// add records key of produced result
+func (r *ResultKeys) add(key string) error {
+	if r == nil || key == "" {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	expires := now.Add(r.TTL).Unix()
+	r.keys[key] = expires
+	if r.Path == "" {
+		if len(r.keys)%1000 == 0 {
+			r.purge(now.Unix())
+		}
+		return nil
+	}
+	data, err := json.Marshal(resultKeyRecord{Key: key, Expires: expires})
+	if err != nil {
+		return err
+	}
+	if err := appendLine(r.Path, data); err != nil {
+		return err
+	}
+	r.lines++
+	if r.lines > 2*len(r.keys)+1000 {
+		// rewrite journal without expired keys
+		r.purge(now.Unix())
+		if err := r.compact(); err != nil {
+			log.Println("unable to compact result keys", r.Path, err)
+		}
+	}
+	return nil
+}
+
+// helper function to remove expired keys, it should be called with acquired lock
+func (r *ResultKeys) purge(now int64) {
+	for key, expires := range r.keys {
+		if expires <= now {
+			delete(r.keys, key)
+		}
+	}
+}
+
+// helper function to rewrite journal with kept keys, it should be called
+// with acquired lock
+func (r *ResultKeys) compact() error {
+	tmp := r.Path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for key, expires := range r.keys {
+		data, _ := json.Marshal(resultKeyRecord{Key: key, Expires: expires})
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	r.lines = len(r.keys)
+	return os.Rename(tmp, r.Path)
+}
+
+// helper function to append line to the file
+func appendLine(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// initResultKeys sets up result keys of streaming modes
+func initResultKeys() error {
+	if _config.KafkaURL == "" && _config.MQTTURL == "" {
+		return nil
+	}
+	keys, err := newResultKeys(_config.ResultKeysFile, time.Duration(_config.ResultKeysTTL)*time.Second)
+	if err != nil {
+		return err
+	}
+	_resultKeys = keys
+	return nil
+}
+
+// helper function to write metrics of result keys
+func writeResultKeysMetrics(w io.Writer) {
+	if _resultKeys == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP tfaas_duplicate_results_total number of replayed streaming messages whose results were not produced again\n")
+	fmt.Fprintf(w, "# TYPE tfaas_duplicate_results_total counter\n")
+	fmt.Fprintf(w, "tfaas_duplicate_results_total %d\n", atomic.LoadUint64(&_duplicateResults))
+}
@@ -0,0 +1,112 @@
+package main
+
+// tests of result keys of streaming modes, they do not require TF C library
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestResultKeysJournal checks persistence and expiration of result keys
+func TestResultKeysJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resultkeys.json")
+	keys, err := newResultKeys(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"features/0/1", "features:evt1"} {
+		if keys.seen(k) {
+			t.Errorf("unknown key %s is seen", k)
+		}
+		if err := keys.add(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !keys.seen("features:evt1") {
+		t.Error("produced result key is not seen")
+	}
+
+	// keys survive restarts
+	keys, err = newResultKeys(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys.seen("features/0/1") || !keys.seen("features:evt1") || keys.seen("features/0/2") {
+		t.Errorf("wrong keys after reload %v", keys.keys)
+	}
+
+	// expired keys are dropped and journal is compacted
+	keys.keys["features/0/1"] = time.Now().Unix() - 1
+	if keys.seen("features/0/1") {
+		t.Error("expired key is seen")
+	}
+	keys.lines = 5000
+	if err := keys.add("features/0/3"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = newResultKeys(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.lines != 2 || keys.seen("features/0/1") || !keys.seen("features/0/3") {
+		t.Errorf("wrong compacted journal with %d lines %v", keys.lines, keys.keys)
+	}
+
+	if k := resultKey("features", 1, 7, ""); k != "features/1/7" {
+		t.Errorf("wrong result key %s", k)
+	}
+	if k := resultKey("lab/d1", 0, -1, "evt1"); k != "lab/d1:evt1" {
+		t.Errorf("wrong result key %s", k)
+	}
+}
+
+// TestFakeKafkaReplay checks that replayed Kafka records are not produced again
+func TestFakeKafkaReplay(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	keys, _ := newResultKeys(filepath.Join(t.TempDir(), "resultkeys.json"), 0)
+	_resultKeys = keys
+	defer func() { _resultKeys = nil }()
+	proxy := &fakeKafkaProxy{offsets: make(map[string]int64)}
+	for i := 0; i < 4; i++ {
+		row := testRow("dnn")
+		if i%2 == 0 {
+			row.EventID = fmt.Sprintf("evt%d", i)
+		}
+		data, _ := json.Marshal(row)
+		proxy.records = append(proxy.records, KafkaMessage{Topic: "features", Offset: int64(i), Value: data})
+	}
+	// consumer restarts from committed offset and replays the records
+	proxy.records = append(proxy.records, proxy.records...)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	c := newKafkaConsumer(srv.URL, "", []KafkaTopic{{Input: "features"}}, 10)
+	go c.worker()
+	for i := 0; i < 4; i++ {
+		c.step()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&c.processed) < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(c.queue)
+
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	expect := []string{"features:evt0", "features/0/1", "features:evt2", "features/0/3"}
+	if len(proxy.produced) != len(expect) {
+		t.Fatalf("wrong number of produced results %d", len(proxy.produced))
+	}
+	for i, res := range proxy.produced {
+		if res.ResultKey != expect[i] {
+			t.Errorf("wrong result key %s, expected %s", res.ResultKey, expect[i])
+		}
+	}
+	if atomic.LoadUint64(&_duplicateResults) < 4 {
+		t.Errorf("duplicates are not counted %d", _duplicateResults)
+	}
+}
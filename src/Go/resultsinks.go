@@ -0,0 +1,325 @@
+package main
+
+// resultsinks module provides plugins of output sinks of predictions
+//
+// Besides HTTP responses, predictions of /json and /predict/batch endpoints
+// may be written to named output sinks, e.g. database ingest API,
+// Elasticsearch or site-specific monitoring service, configured by
+// "resultSinks" option, e.g.
+// "resultSinks": [
+//     {"name": "monitoring", "type": "http", "url": "https://monit.host/api/predictions"},
+//     {"name": "es", "type": "elasticsearch", "url": "https://es:9200", "index": "tfaas"},
+//     {"name": "stream", "type": "kafka", "url": "http://kafka-rest:8082", "topic": "tfaas-results"},
+//     {"name": "archive", "type": "file", "path": "/data/tfaas/results.json"}]
+// Sinks are selected per model by "sinks" parameter in params.json, e.g.
+// "sinks": ["monitoring", "es"]
+// or per request by Result-Sinks header (or sinks query parameter), e.g.
+// curl -H "Result-Sinks: archive" ..., where "none" disables sinks of the
+// model. Results are written asynchronously and do not delay responses,
+// written and failed results are counted by tfaas_result_sink_records_total
+// metric. New sink types can be added via registerResultSinkType function.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// request header with names of output sinks
+const resultSinksHeader = "Result-Sinks"
+
+// size of the queue of results to write
+const resultQueueSize = 1000
+
+// ResultSinkConfig represents configuration of output sink
+type ResultSinkConfig struct {
+	Name  string `json:"name"`  // sink name used by models and requests
+	Type  string `json:"type"`  // sink type: http, elasticsearch, kafka, file or log
+	URL   string `json:"url"`   // sink URL
+	Topic string `json:"topic"` // Kafka topic
+	Index string `json:"index"` // Elasticsearch index
+	Path  string `json:"path"`  // file of results (JSON lines)
+}
+
+// ResultRecord represents predictions written to output sinks
+type ResultRecord struct {
+	Model       string      `json:"model"`             // model name
+	EventID     string      `json:"eventID,omitempty"` // client event identifier, see eventid module
+	Rows        int         `json:"rows"`              // number of predicted rows
+	Predictions [][]float32 `json:"predictions"`       // predictions of every row
+	Host        string      `json:"host"`              // host name of the server
+	Timestamp   int64       `json:"timestamp"`         // prediction time stamp (unix seconds)
+}
+
+// ResultSink represents output sink of predictions
+type ResultSink interface {
+	Write(rec ResultRecord) error
+}
+
+// ResultSinkFactory creates output sink from its configuration
+type ResultSinkFactory func(cfg ResultSinkConfig) (ResultSink, error)
+
+// resultDelivery represents result queued for named output sink
+type resultDelivery struct {
+	name string
+	rec  ResultRecord
+}
+
+// global output sinks, registry of their types and counters of results
+var (
+	_resultSinks        = make(map[string]ResultSink)
+	_resultSinkTypes    = make(map[string]ResultSinkFactory)
+	_resultSinkCounts   = make(map[string]uint64)
+	_resultSinksLock    sync.RWMutex
+	_resultSinksQueue   chan resultDelivery
+	_resultSinkCountsMu sync.Mutex
+)
+
+// registerResultSinkType registers new type of output sinks
+func registerResultSinkType(name string, factory ResultSinkFactory) {
+	_resultSinksLock.Lock()
+	defer _resultSinksLock.Unlock()
+	_resultSinkTypes[name] = factory
+}
+
+// helper function to create output sink from its configuration
+func newResultSink(cfg ResultSinkConfig) (ResultSink, error) {
+	_resultSinksLock.RLock()
+	factory, ok := _resultSinkTypes[cfg.Type]
+	_resultSinksLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown result sink type '%s'", cfg.Type)
+	}
+	return factory(cfg)
+}
+
+// initResultSinks creates configured output sinks and starts their writer
+func initResultSinks(configs []ResultSinkConfig) error {
+	sinks := make(map[string]ResultSink)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return fmt.Errorf("result sink of type '%s' has no name", cfg.Type)
+		}
+		if _, ok := sinks[cfg.Name]; ok {
+			return fmt.Errorf("duplicate result sink '%s'", cfg.Name)
+		}
+		sink, err := newResultSink(cfg)
+		if err != nil {
+			return fmt.Errorf("result sink '%s': %v", cfg.Name, err)
+		}
+		sinks[cfg.Name] = sink
+	}
+	_resultSinksLock.Lock()
+	_resultSinks = sinks
+	if len(sinks) > 0 && _resultSinksQueue == nil {
+		_resultSinksQueue = make(chan resultDelivery, resultQueueSize)
+		go writeResults(_resultSinksQueue)
+	}
+	_resultSinksLock.Unlock()
+	return nil
+}
+
+// helper function to write queued results to output sinks
+func writeResults(queue chan resultDelivery) {
+	for d := range queue {
+		_resultSinksLock.RLock()
+		sink, ok := _resultSinks[d.name]
+		_resultSinksLock.RUnlock()
+		if !ok {
+			continue
+		}
+		status := "ok"
+		if err := sink.Write(d.rec); err != nil {
+			status = "failed"
+			log.Printf("unable to write results of model %s to sink %s: %v", d.rec.Model, d.name, err)
+		}
+		countResult(d.name, status)
+	}
+}
+
+// helper function to count results of output sink
+func countResult(name, status string) {
+	_resultSinkCountsMu.Lock()
+	_resultSinkCounts[name+"/"+status]++
+	_resultSinkCountsMu.Unlock()
+}
+
+// helper function to select output sinks of the request, sinks requested by
+// the client take precedence over sinks of the model
+func selectResultSinks(r *http.Request, model string) ([]string, error) {
+	value := r.Header.Get(resultSinksHeader)
+	if value == "" {
+		value = r.URL.Query().Get("sinks")
+	}
+	var names []string
+	if value == "" {
+		if params, err := getModelParams(model); err == nil {
+			names = params.Sinks
+		}
+	} else if value != "none" {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	_resultSinksLock.RLock()
+	defer _resultSinksLock.RUnlock()
+	for _, name := range names {
+		if _, ok := _resultSinks[name]; !ok {
+			return nil, fmt.Errorf("unknown result sink '%s'", name)
+		}
+	}
+	return names, nil
+}
+
+// helper function to queue predictions for given output sinks, results are
+// dropped if queue is full
+func writeResultSinks(names []string, model, eventID string, probs [][]float32) {
+	if len(names) == 0 || _resultSinksQueue == nil {
+		return
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	host, _ := os.Hostname()
+	rec := ResultRecord{
+		Model:       model,
+		EventID:     eventID,
+		Rows:        len(probs),
+		Predictions: probs,
+		Host:        host,
+		Timestamp:   time.Now().Unix(),
+	}
+	for _, name := range names {
+		select {
+		case _resultSinksQueue <- resultDelivery{name: name, rec: rec}:
+		default:
+			countResult(name, "dropped")
+			log.Printf("result sinks queue is full, drop results of model %s for sink %s", model, name)
+		}
+	}
+}
+
+// helper function to write metrics of output sinks
+func writeResultSinkMetrics(w io.Writer) {
+	_resultSinkCountsMu.Lock()
+	defer _resultSinkCountsMu.Unlock()
+	if len(_resultSinkCounts) == 0 {
+		return
+	}
+	var keys []string
+	for k := range _resultSinkCounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP tfaas_result_sink_records_total number of results of output sinks\n")
+	fmt.Fprintf(w, "# TYPE tfaas_result_sink_records_total counter\n")
+	for _, k := range keys {
+		parts := strings.SplitN(k, "/", 2)
+		fmt.Fprintf(w, "tfaas_result_sink_records_total%s %d\n", metricLabels("sink", parts[0], "status", parts[1]), _resultSinkCounts[k])
+	}
+}
+
+// HTTPResultSink posts results as JSON documents to HTTP API
+type HTTPResultSink struct {
+	URL string
+}
+
+// Write implements ResultSink interface
+func (s *HTTPResultSink) Write(rec ResultRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(s.URL, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// FileResultSink appends results to file as JSON lines
+type FileResultSink struct {
+	Path string
+	lock sync.Mutex
+}
+
+// Write implements ResultSink interface
+func (s *FileResultSink) Write(rec ResultRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return appendLine(s.Path, data)
+}
+
+// KafkaResultSink produces results to Kafka topic via REST proxy
+type KafkaResultSink struct {
+	URL   string
+	Topic string
+}
+
+// Write implements ResultSink interface
+func (s *KafkaResultSink) Write(rec ResultRecord) error {
+	return kafkaProduce(s.URL, s.Topic, []KafkaRecord{{Key: rec.EventID, Value: rec}})
+}
+
+// LogResultSink writes results to server log
+type LogResultSink struct{}
+
+// Write implements ResultSink interface
+func (s *LogResultSink) Write(rec ResultRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	log.Printf("results %s", data)
+	return nil
+}
+
+// register default output sinks
+func init() {
+	registerResultSinkType("log", func(cfg ResultSinkConfig) (ResultSink, error) {
+		return &LogResultSink{}, nil
+	})
+	registerResultSinkType("http", func(cfg ResultSinkConfig) (ResultSink, error) {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("http sink requires url")
+		}
+		return &HTTPResultSink{URL: cfg.URL}, nil
+	})
+	registerResultSinkType("elasticsearch", func(cfg ResultSinkConfig) (ResultSink, error) {
+		if cfg.URL == "" || cfg.Index == "" {
+			return nil, fmt.Errorf("elasticsearch sink requires url and index")
+		}
+		// documents are indexed via Elasticsearch document API
+		return &HTTPResultSink{URL: fmt.Sprintf("%s/%s/_doc", strings.TrimRight(cfg.URL, "/"), cfg.Index)}, nil
+	})
+	registerResultSinkType("kafka", func(cfg ResultSinkConfig) (ResultSink, error) {
+		if cfg.URL == "" || cfg.Topic == "" {
+			return nil, fmt.Errorf("kafka sink requires url and topic")
+		}
+		return &KafkaResultSink{URL: cfg.URL, Topic: cfg.Topic}, nil
+	})
+	registerResultSinkType("file", func(cfg ResultSinkConfig) (ResultSink, error) {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file sink requires path")
+		}
+		return &FileResultSink{Path: cfg.Path}, nil
+	})
+}
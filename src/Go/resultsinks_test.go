@@ -0,0 +1,109 @@
+package main
+
+// tests of output sinks, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testResultSink passes written results to the channel
+type testResultSink struct {
+	name    string
+	results chan ResultRecord
+}
+
+// Write implements ResultSink interface
+func (s *testResultSink) Write(rec ResultRecord) error {
+	rec.Host = s.name
+	s.results <- rec
+	return nil
+}
+
+// helper function to wait for result written to output sink
+func waitResult(t *testing.T, results chan ResultRecord) ResultRecord {
+	select {
+	case rec := <-results:
+		return rec
+	case <-time.After(5 * time.Second):
+		t.Fatal("result was not written to output sink")
+	}
+	return ResultRecord{}
+}
+
+// TestResultSinks checks selection of output sinks per model and per request
+func TestResultSinks(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", Sinks: []string{"monitoring"}}
+	writeModelFiles(t, "monitored", []byte("monitored"), params)
+
+	results := make(chan ResultRecord, 10)
+	registerResultSinkType("test", func(cfg ResultSinkConfig) (ResultSink, error) {
+		return &testResultSink{name: cfg.Name, results: results}, nil
+	})
+	configs := []ResultSinkConfig{{Name: "monitoring", Type: "test"}, {Name: "archive", Type: "test"}}
+	if err := initResultSinks(configs); err != nil {
+		t.Fatal(err)
+	}
+	defer initResultSinks(nil)
+	for _, cfg := range []ResultSinkConfig{{Type: "test"}, {Name: "x", Type: "unknown"}, {Name: "x", Type: "file"}} {
+		if err := initResultSinks([]ResultSinkConfig{cfg}); err == nil {
+			t.Errorf("invalid result sink %+v is accepted", cfg)
+		}
+	}
+	if err := initResultSinks(configs); err != nil {
+		t.Fatal(err)
+	}
+
+	// sinks of the model
+	row := testRow("monitored")
+	row.EventID = "evt1"
+	data, _ := json.Marshal(row)
+	rr := httptest.NewRecorder()
+	PredictHandler(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	rec := waitResult(t, results)
+	if rec.Host != "monitoring" || rec.Model != "monitored" || rec.EventID != "evt1" || rec.Rows != 1 {
+		t.Fatalf("wrong result %+v", rec)
+	}
+	checkProbs(t, rec.Predictions[0])
+
+	// sinks of the request take precedence
+	req := httptest.NewRequest("POST", "/predict/batch", strings.NewReader(`{"model": "dnn", "shape": [2, 4], "values": [1, 2, 3, 4, 5, 6, 7, 8]}`))
+	req.Header.Set(resultSinksHeader, "archive")
+	rr = httptest.NewRecorder()
+	BatchHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	if rec := waitResult(t, results); rec.Host != "archive" || rec.Model != "dnn" || rec.Rows != 2 {
+		t.Fatalf("wrong result %+v", rec)
+	}
+	req = httptest.NewRequest("POST", "/json?sinks=none", bytes.NewReader(data))
+	rr = httptest.NewRecorder()
+	PredictHandler(rr, req)
+	req = httptest.NewRequest("POST", "/json?sinks=unknown", bytes.NewReader(data))
+	rr = httptest.NewRecorder()
+	PredictHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of unknown sink", rr.Code)
+	}
+	select {
+	case rec := <-results:
+		t.Errorf("result %+v is written to disabled sinks", rec)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var buf bytes.Buffer
+	writeResultSinkMetrics(&buf)
+	if !strings.Contains(buf.String(), `tfaas_result_sink_records_total{sink="monitoring",status="ok"}`) {
+		t.Errorf("wrong metrics %s", buf.String())
+	}
+}
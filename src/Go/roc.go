@@ -0,0 +1,175 @@
+package main
+
+// roc module provides threshold sweep of deployed models
+//
+// POST /roc/<model> with labeled dataset (see calibration module), e.g.
+// {"keys": ["attr1", "attr2"], "shape": [3, 2], "values": [1, 2, 3, 4, 5, 6],
+//  "labels": [1, 0, 1], "class": 1, "points": 100}
+// scores every row by the model and sweeps threshold of the probability of
+// given class (default 1) over scored probabilities. Every point of the
+// sweep provides ROC (false and true positive rates) and precision-recall
+// coordinates along with confusion counts, such that working point of the
+// model is chosen against the serving stack used in production. The number
+// of returned points is limited by "points" (default 100), while area under
+// ROC curve and average precision are computed over all thresholds, e.g.
+// {"model": "dnn", "class": 1, "rows": 3, "positives": 2, "auc": 1,
+//  "averagePrecision": 1,
+//  "points": [{"threshold": 0.9, "tpr": 0.5, "fpr": 0, "precision": 1,
+//              "recall": 0.5, "f1": 0.667, "tp": 1, "fp": 0}, ...]}
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// default number of points of threshold sweep
+const defaultSweepPoints = 100
+
+// ROCRequest represents labeled dataset of threshold sweep
+type ROCRequest struct {
+	LabeledDataset
+	Points int `json:"points"` // max number of returned points
+}
+
+// ThresholdPoint represents working point of the model at given threshold,
+// rows with probability above or equal to threshold are classified as class
+type ThresholdPoint struct {
+	Threshold float64 `json:"threshold"` // threshold of class probability
+	TPR       float64 `json:"tpr"`       // true positive rate
+	FPR       float64 `json:"fpr"`       // false positive rate
+	Precision float64 `json:"precision"` // fraction of classified rows of the class
+	Recall    float64 `json:"recall"`    // fraction of rows of the class classified, same as TPR
+	F1        float64 `json:"f1"`        // harmonic mean of precision and recall
+	TP        int     `json:"tp"`        // number of true positives
+	FP        int     `json:"fp"`        // number of false positives
+}
+
+// ROCReport represents threshold sweep of the model
+type ROCReport struct {
+	Model            string           `json:"model"`            // model name
+	Class            int              `json:"class"`            // evaluated class
+	Rows             int              `json:"rows"`             // number of scored rows
+	Positives        int              `json:"positives"`        // number of rows of evaluated class
+	AUC              float64          `json:"auc"`              // area under ROC curve
+	AveragePrecision float64          `json:"averagePrecision"` // area under precision-recall curve
+	Points           []ThresholdPoint `json:"points"`           // points of threshold sweep
+}
+
+// helper function to sweep threshold over given probabilities, it returns
+// error if rows do not contain both classes
+func thresholdSweep(scores []float64, positives []bool, npoints int) (ROCReport, error) {
+	report := ROCReport{Rows: len(scores), Points: []ThresholdPoint{}}
+	for _, p := range positives {
+		if p {
+			report.Positives++
+		}
+	}
+	negatives := len(scores) - report.Positives
+	if report.Positives == 0 || negatives == 0 {
+		return report, errors.New("labeled dataset should provide rows of both evaluated and other classes")
+	}
+	idx := make([]int, len(scores))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return scores[idx[i]] > scores[idx[j]] })
+
+	// every distinct probability is a threshold
+	var points []ThresholdPoint
+	var tp, fp int
+	var prevTPR, prevFPR, prevRecall float64
+	for i, k := range idx {
+		if positives[k] {
+			tp++
+		} else {
+			fp++
+		}
+		if i+1 < len(idx) && scores[idx[i+1]] == scores[k] {
+			continue
+		}
+		pt := ThresholdPoint{
+			Threshold: scores[k],
+			TPR:       float64(tp) / float64(report.Positives),
+			FPR:       float64(fp) / float64(negatives),
+			Precision: float64(tp) / float64(tp+fp),
+			TP:        tp,
+			FP:        fp,
+		}
+		pt.Recall = pt.TPR
+		if pt.Precision+pt.Recall > 0 {
+			pt.F1 = 2 * pt.Precision * pt.Recall / (pt.Precision + pt.Recall)
+		}
+		report.AUC += (pt.FPR - prevFPR) * (pt.TPR + prevTPR) / 2
+		report.AveragePrecision += (pt.Recall - prevRecall) * pt.Precision
+		prevTPR, prevFPR, prevRecall = pt.TPR, pt.FPR, pt.Recall
+		points = append(points, pt)
+	}
+
+	// evenly spaced points of the sweep, the last point is always kept
+	if len(points) <= npoints {
+		report.Points = points
+		return report, nil
+	}
+	for i := 0; i < npoints; i++ {
+		report.Points = append(report.Points, points[i*(len(points)-1)/(npoints-1)])
+	}
+	return report, nil
+}
+
+// ROCHandler computes ROC and precision-recall points of the model on
+// labeled data
+func ROCHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	model, err := datasetModel(mux.Vars(r)["model"])
+	if err != nil {
+		responseError(w, "unknown model", err, http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseError(w, "unable to read threshold sweep request", err, http.StatusBadRequest)
+		return
+	}
+	var req ROCRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		responseError(w, "unable to unmarshal threshold sweep request", err, http.StatusBadRequest)
+		return
+	}
+	npoints := req.Points
+	if npoints <= 0 {
+		npoints = defaultSweepPoints
+	}
+	if npoints < 2 {
+		err := fmt.Errorf("sweep should have at least 2 points, got %d", npoints)
+		responseError(w, "invalid threshold sweep request", err, http.StatusBadRequest)
+		return
+	}
+	if err := req.check(); err != nil {
+		responseError(w, "invalid labeled dataset", err, http.StatusBadRequest)
+		return
+	}
+	outputs, err := scoreDataset(model, &req.Dataset)
+	if err != nil {
+		responseError(w, "unable to score dataset", err, http.StatusInternalServerError)
+		return
+	}
+	scores, positives, err := req.classScores(model, outputs)
+	if err != nil {
+		responseError(w, "unable to evaluate model outputs", err, http.StatusUnprocessableEntity)
+		return
+	}
+	report, err := thresholdSweep(scores, positives, npoints)
+	if err != nil {
+		responseError(w, "unable to sweep threshold", err, http.StatusUnprocessableEntity)
+		return
+	}
+	report.Model = model
+	report.Class = req.class()
+	responseJSON(w, report)
+}
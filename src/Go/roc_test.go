@@ -0,0 +1,82 @@
+package main
+
+// tests of roc module, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestThresholdSweep checks ROC and precision-recall points
+func TestThresholdSweep(t *testing.T) {
+	scores := []float64{0.7, 0.9, 0.6, 0.8, 0.5}
+	positives := []bool{true, true, false, false, false}
+	report, err := thresholdSweep(scores, positives, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 5 || report.Positives != 2 || len(report.Points) != 5 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if math.Abs(report.AUC-5.0/6) > 1e-9 || math.Abs(report.AveragePrecision-5.0/6) > 1e-9 {
+		t.Errorf("unexpected AUC %v or average precision %v", report.AUC, report.AveragePrecision)
+	}
+	pt := report.Points[2]
+	if pt.Threshold != 0.7 || pt.TP != 2 || pt.FP != 1 || pt.TPR != 1 || math.Abs(pt.FPR-1.0/3) > 1e-9 || math.Abs(pt.Precision-2.0/3) > 1e-9 || math.Abs(pt.F1-0.8) > 1e-9 {
+		t.Errorf("unexpected point %+v", pt)
+	}
+
+	// limited number of points keeps the last one
+	report, _ = thresholdSweep(scores, positives, 3)
+	if len(report.Points) != 3 || report.Points[1].Threshold != 0.7 || report.Points[2].Threshold != 0.5 {
+		t.Errorf("unexpected points %+v", report.Points)
+	}
+
+	// tied probabilities give single threshold
+	report, _ = thresholdSweep([]float64{0.5, 0.5}, []bool{true, false}, 100)
+	if len(report.Points) != 1 || report.AUC != 0.5 {
+		t.Errorf("unexpected sweep of tied probabilities %+v", report)
+	}
+	if _, err := thresholdSweep([]float64{0.5, 0.6}, []bool{true, true}, 100); err == nil {
+		t.Error("sweep of single class is computed")
+	}
+}
+
+// TestROCHandler checks threshold sweep of the model
+func TestROCHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	row := testRow("dnn")
+	class := 2
+	dataset := Dataset{Keys: row.Keys, Values: append(append([]float32{}, row.Values...), row.Values...), Shape: []int64{2, testNumKeys}}
+	call := func(req ROCRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(req)
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/roc/dnn", bytes.NewReader(data)), map[string]string{"model": "dnn"})
+		w := httptest.NewRecorder()
+		ROCHandler(w, r)
+		return w
+	}
+	w := call(ROCRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{2, 0}, Class: &class}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+	}
+	var report ROCReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// fake model scores every row with 0.5 probability of class 2
+	if report.Model != "dnn" || report.Class != 2 || report.Positives != 1 || report.AUC != 0.5 || len(report.Points) != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if w := call(ROCRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{0, 0}, Class: &class}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected status %d of single class dataset", w.Code)
+	}
+	if w := call(ROCRequest{LabeledDataset: LabeledDataset{Dataset: dataset, Labels: []int{2, 0}}, Points: 1}); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d of single point sweep", w.Code)
+	}
+}
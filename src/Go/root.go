@@ -0,0 +1,144 @@
+package main
+
+// root module provides batch scoring of ROOT TTree files
+//
+// Clients upload ROOT file together with tree name and branch selection,
+// e.g.
+// curl -X POST -F 'file=@events.root' -F 'model=dnn' -F 'tree=events' \
+//      -F 'branches=pt,eta,phi' https://localhost:8083/predict/root
+// The server reads selected branches of every event, scores all events with
+// given model and returns CSV file with event number and model outputs.
+// Only scalar numeric branches are supported. ROOT files are read via
+// go-hep.org/x/hep/groot library which is enabled by groot build tag, e.g.
+// go get go-hep.org/x/hep@latest && go build -tags groot
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errors of ROOT adapter
+var errRootUnsupported = errors.New("server is built without ROOT support, use groot build tag")
+
+// maximum size of uploaded ROOT file kept in memory, the rest is stored on disk
+const maxRootMemory = 32 << 20
+
+// helper function to write model outputs of every event as CSV
+func writeOutputsCSV(w io.Writer, probs [][]float32) error {
+	writer := csv.NewWriter(w)
+	ncols := 0
+	if len(probs) > 0 {
+		ncols = len(probs[0])
+	}
+	if err := writeOutputsHeader(writer, ncols); err != nil {
+		return err
+	}
+	if err := writeOutputsRecords(writer, probs, ncols, 0); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// helper function to write CSV header of given number of model outputs
+func writeOutputsHeader(writer *csv.Writer, ncols int) error {
+	header := []string{"event"}
+	for i := 0; i < ncols; i++ {
+		header = append(header, fmt.Sprintf("output_%d", i))
+	}
+	return writer.Write(header)
+}
+
+// helper function to write model outputs as CSV records, events are
+// numbered from given offset
+func writeOutputsRecords(writer *csv.Writer, probs [][]float32, ncols int, offset int64) error {
+	record := make([]string, ncols+1)
+	for i, row := range probs {
+		record[0] = strconv.FormatInt(offset+int64(i), 10)
+		for j := 0; j < ncols; j++ {
+			record[j+1] = ""
+			if j < len(row) {
+				record[j+1] = strconv.FormatFloat(float64(row[j]), 'g', -1, 32)
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RootHandler provides predictions for events of ROOT TTree
+func RootHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxRootMemory); err != nil {
+		responseError(w, "unable to parse form", err, http.StatusBadRequest)
+		return
+	}
+	model := r.FormValue("model")
+	if model == "" {
+		model = _params.Name
+	}
+	treeName := r.FormValue("tree")
+	var branches []string
+	for _, b := range strings.Split(r.FormValue("branches"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			branches = append(branches, b)
+		}
+	}
+	if treeName == "" || len(branches) == 0 {
+		responseError(w, "tree and branches should be provided", nil, http.StatusBadRequest)
+		return
+	}
+	rootFile, _, err := r.FormFile("file")
+	if err != nil {
+		responseError(w, "unable to read ROOT file", err, http.StatusBadRequest)
+		return
+	}
+	defer rootFile.Close()
+	// ROOT files require random access, therefore we store them on disk
+	file, err := ioutil.TempFile("", "tfaas-*.root")
+	if err != nil {
+		responseError(w, "unable to create ROOT file", err, http.StatusInternalServerError)
+		return
+	}
+	fname := file.Name()
+	defer os.Remove(fname)
+	_, err = io.Copy(file, rootFile)
+	file.Close()
+	if err != nil {
+		responseError(w, "unable to write ROOT file", err, http.StatusInternalServerError)
+		return
+	}
+	values, nevents, err := readRootTree(fname, treeName, branches)
+	if err == errRootUnsupported {
+		responseError(w, err.Error(), nil, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		responseError(w, "unable to read ROOT tree", err, http.StatusBadRequest)
+		return
+	}
+	tensor, err := makeFlatTensor(values, []int64{nevents, int64(len(branches))})
+	if err != nil {
+		responseError(w, "unable to read ROOT tree", err, http.StatusBadRequest)
+		return
+	}
+	observeUsage(usageClient(r), model, int(nevents))
+	probs, err := makeBatchPredictions(model, branches, tensor)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make batch predictions", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", treeName))
+	w.WriteHeader(http.StatusOK)
+	writeOutputsCSV(w, probs)
+}
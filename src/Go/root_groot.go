@@ -0,0 +1,96 @@
+//go:build groot
+
+package main
+
+// root_groot module reads ROOT TTrees via go-hep.org/x/hep/groot library
+
+import (
+	"fmt"
+
+	"go-hep.org/x/hep/groot"
+	"go-hep.org/x/hep/groot/rtree"
+)
+
+// helper function to read given branches of ROOT tree, it returns flat
+// (row-major) values of all events and number of events
+func readRootTree(fname, treeName string, branches []string) ([]float32, int64, error) {
+	file, err := groot.Open(fname)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	obj, err := file.Get(treeName)
+	if err != nil {
+		return nil, 0, err
+	}
+	tree, ok := obj.(rtree.Tree)
+	if !ok {
+		return nil, 0, fmt.Errorf("object %s is not a tree", treeName)
+	}
+	all := make(map[string]rtree.ReadVar)
+	for _, rvar := range rtree.NewReadVars(tree) {
+		all[rvar.Name] = rvar
+	}
+	var rvars []rtree.ReadVar
+	for _, name := range branches {
+		rvar, ok := all[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("tree %s does not have branch %s", treeName, name)
+		}
+		rvars = append(rvars, rvar)
+	}
+	reader, err := rtree.NewReader(tree, rvars)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	values := make([]float32, 0, tree.Entries()*int64(len(rvars)))
+	var nevents int64
+	err = reader.Read(func(ctx rtree.RCtx) error {
+		for _, rvar := range rvars {
+			v, err := rootValue(rvar)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		nevents++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return values, nevents, nil
+}
+
+// helper function to convert value of scalar branch into float32
+func rootValue(rvar rtree.ReadVar) (float32, error) {
+	switch v := rvar.Value.(type) {
+	case *float32:
+		return *v, nil
+	case *float64:
+		return float32(*v), nil
+	case *int8:
+		return float32(*v), nil
+	case *int16:
+		return float32(*v), nil
+	case *int32:
+		return float32(*v), nil
+	case *int64:
+		return float32(*v), nil
+	case *uint8:
+		return float32(*v), nil
+	case *uint16:
+		return float32(*v), nil
+	case *uint32:
+		return float32(*v), nil
+	case *uint64:
+		return float32(*v), nil
+	case *bool:
+		if *v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("branch %s has unsupported type %T", rvar.Name, rvar.Value)
+}
@@ -0,0 +1,10 @@
+//go:build !groot
+
+package main
+
+// root_nogroot module is used when server is built without ROOT support
+
+// helper function to read given branches of ROOT tree
+func readRootTree(fname, treeName string, branches []string) ([]float32, int64, error) {
+	return nil, 0, errRootUnsupported
+}
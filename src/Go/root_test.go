@@ -0,0 +1,40 @@
+package main
+
+// tests of ROOT adapter, they do not require TF C library
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWriteOutputsCSV checks CSV representation of model outputs
+func TestWriteOutputsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeOutputsCSV(&buf, [][]float32{{0.25, 0.75}, {1, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	expect := "event,output_0,output_1\n0,0.25,0.75\n1,1,0\n"
+	if buf.String() != expect {
+		t.Errorf("wrong CSV output %q, expected %q", buf.String(), expect)
+	}
+}
+
+// TestRootHandlerValidation checks validation of ROOT scoring requests
+func TestRootHandlerValidation(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("model", "dnn")
+	writer.WriteField("tree", "events")
+	writer.Close()
+	req := httptest.NewRequest("POST", "/predict/root", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	RootHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for request without branches", w.Code)
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+// schemas module provides formal schemas of model input payloads
+//
+// Models may declare schema of their JSON input payloads in params.json,
+// e.g. "input_schema": "schema.json", where the schema file of the model
+// directory is either JSON Schema or Avro schema (files with .avsc
+// extension or records with "fields"). The schema is served by
+// GET /models/<model>/schema (Schema-Format header tells jsonschema or avro)
+// and payloads of /json and /validate/<model> requests are validated
+// against it, e.g. the payload which violates the contract is rejected with
+// error like: values: expected at most 4 items, got 5
+// Models without input schema but with feature schema (see validate module)
+// serve JSON Schema of rows generated from their features.
+//
+// The following subset of JSON Schema is supported: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength,
+// maxLength, pattern, allOf, anyOf, oneOf and local $ref references. Avro
+// schemas validate plain JSON values (unions match any of their branches)
+// of primitive, record, enum, array, map and fixed types.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// formats of input schemas
+const (
+	jsonSchemaFormat = "jsonschema"
+	avroSchemaFormat = "avro"
+)
+
+// maximum number of reported schema violations
+const maxSchemaViolations = 20
+
+// InputSchema represents formal schema of model input payloads
+type InputSchema struct {
+	Format string      // schema format: jsonschema or avro
+	Data   []byte      // schema document
+	root   interface{} // parsed schema document
+}
+
+// cache of input schemas of models, nil schemas are cached for models
+// without input schema
+var (
+	_inputSchemas     = make(map[string]*InputSchema)
+	_inputSchemasLock sync.Mutex
+)
+
+// helper function to parse input schema document
+func parseInputSchema(fname string, data []byte) (*InputSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("unable to parse schema %s: %v", fname, err)
+	}
+	schema := &InputSchema{Format: jsonSchemaFormat, Data: data, root: root}
+	if m, ok := root.(map[string]interface{}); strings.HasSuffix(fname, ".avsc") || (ok && m["fields"] != nil) {
+		schema.Format = avroSchemaFormat
+	}
+	return schema, nil
+}
+
+// helper function to get input schema of the model, it returns nil schema
+// for models without input schema
+func getInputSchema(model string) (*InputSchema, error) {
+	_inputSchemasLock.Lock()
+	defer _inputSchemasLock.Unlock()
+	if schema, ok := _inputSchemas[model]; ok {
+		return schema, nil
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		return nil, err
+	}
+	var schema *InputSchema
+	if params.InputSchema != "" {
+		fname := filepath.Join(_config.ModelDir, model, params.InputSchema)
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		if schema, err = parseInputSchema(params.InputSchema, data); err != nil {
+			return nil, err
+		}
+	}
+	_inputSchemas[model] = schema
+	return schema, nil
+}
+
+// helper function to remove input schema of the model from the cache
+func removeInputSchema(model string) {
+	_inputSchemasLock.Lock()
+	defer _inputSchemasLock.Unlock()
+	delete(_inputSchemas, model)
+}
+
+// helper function to generate JSON Schema of rows from model features
+func featuresJSONSchema(model string, features []FeatureSchema) map[string]interface{} {
+	var names []interface{}
+	for _, f := range features {
+		names = append(names, f.Name)
+	}
+	n := len(features)
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   fmt.Sprintf("input rows of %s model", model),
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"model":  map[string]interface{}{"type": "string"},
+			"keys":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"enum": names}, "minItems": n, "maxItems": n},
+			"values": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "number"}, "minItems": n, "maxItems": n},
+		},
+		"required": []interface{}{"values"},
+	}
+}
+
+// helper function to validate payload against input schema of the model,
+// it returns list of schema violations
+func (s *InputSchema) validate(payload []byte) ([]string, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	v := schemaValidator{root: s.root, names: make(map[string]interface{})}
+	if s.Format == avroSchemaFormat {
+		collectAvroNames(s.root, "", v.names)
+		v.avro(s.root, value, "", "")
+	} else {
+		v.jsonSchema(s.root, value, "")
+	}
+	return v.errors, nil
+}
+
+// helper function to validate payload of the request of given model
+func validatePayload(model string, payload []byte) error {
+	if model == "" {
+		model = _params.Name
+	}
+	schema, err := getInputSchema(resolveModel(model))
+	if err != nil || schema == nil {
+		// missing models are reported by prediction handlers
+		return nil
+	}
+	violations, err := schema.validate(payload)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return errors.New(strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// schemaValidator collects violations of JSON Schema or Avro schema
+type schemaValidator struct {
+	root   interface{}            // schema document
+	names  map[string]interface{} // named Avro types
+	errors []string               // schema violations
+}
+
+// helper function to add schema violation of given path
+func (v *schemaValidator) fail(path, msg string, args ...interface{}) {
+	if len(v.errors) >= maxSchemaViolations {
+		return
+	}
+	if path == "" {
+		path = "payload"
+	}
+	v.errors = append(v.errors, fmt.Sprintf("%s: %s", path, fmt.Sprintf(msg, args...)))
+}
+
+// helper function to join JSON path with given element
+func joinPath(path string, elem interface{}) string {
+	if i, ok := elem.(int); ok {
+		return fmt.Sprintf("%s[%d]", path, i)
+	}
+	if path == "" {
+		return fmt.Sprintf("%v", elem)
+	}
+	return fmt.Sprintf("%s.%v", path, elem)
+}
+
+// helper function to return JSON type name of the value
+func jsonValueType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// helper function to resolve local $ref of JSON Schema
+func (v *schemaValidator) resolve(ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	node := v.root
+	for _, p := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if p == "" {
+			continue
+		}
+		p = strings.ReplaceAll(strings.ReplaceAll(p, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// helper function to validate value against JSON Schema
+func (v *schemaValidator) jsonSchema(schema, value interface{}, path string) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if b, ok := schema.(bool); ok && !b {
+			v.fail(path, "value is not allowed")
+		}
+		return
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		node, ok := v.resolve(ref)
+		if !ok {
+			v.fail(path, "unresolved schema reference %s", ref)
+			return
+		}
+		v.jsonSchema(node, value, path)
+	}
+	vtype := jsonValueType(value)
+	if t, ok := s["type"]; ok {
+		var types []interface{}
+		if list, ok := t.([]interface{}); ok {
+			types = list
+		} else {
+			types = []interface{}{t}
+		}
+		match := false
+		for _, t := range types {
+			if t == vtype || (t == "number" && vtype == "integer") {
+				match = true
+			}
+		}
+		if !match {
+			v.fail(path, "expected %v, got %s", t, vtype)
+			return
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, value) {
+		v.fail(path, "expected %v, got %v", c, value)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, value)
+		}
+		if !found {
+			v.fail(path, "value %v is not one of %v", value, enum)
+		}
+	}
+	switch val := value.(type) {
+	case float64:
+		if m, ok := s["minimum"].(float64); ok && val < m {
+			v.fail(path, "value %v is below minimum %v", val, m)
+		}
+		if m, ok := s["maximum"].(float64); ok && val > m {
+			v.fail(path, "value %v is above maximum %v", val, m)
+		}
+		if m, ok := s["exclusiveMinimum"].(float64); ok && val <= m {
+			v.fail(path, "value %v is not above %v", val, m)
+		}
+		if m, ok := s["exclusiveMaximum"].(float64); ok && val >= m {
+			v.fail(path, "value %v is not below %v", val, m)
+		}
+	case string:
+		n := float64(len([]rune(val)))
+		if m, ok := s["minLength"].(float64); ok && n < m {
+			v.fail(path, "expected at least %v characters, got %v", m, n)
+		}
+		if m, ok := s["maxLength"].(float64); ok && n > m {
+			v.fail(path, "expected at most %v characters, got %v", m, n)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err != nil {
+				v.fail(path, "invalid pattern %s of the schema", p)
+			} else if !re.MatchString(val) {
+				v.fail(path, "value %q does not match pattern %s", val, p)
+			}
+		}
+	case []interface{}:
+		n := float64(len(val))
+		if m, ok := s["minItems"].(float64); ok && n < m {
+			v.fail(path, "expected at least %v items, got %v", m, n)
+		}
+		if m, ok := s["maxItems"].(float64); ok && n > m {
+			v.fail(path, "expected at most %v items, got %v", m, n)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				v.jsonSchema(items, item, joinPath(path, i))
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, ok := val[name]; !ok {
+						v.fail(joinPath(path, name), "required property is missing")
+					}
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k]; ok {
+				v.jsonSchema(p, val[k], joinPath(path, k))
+			} else if extra, ok := s["additionalProperties"]; ok {
+				if b, ok := extra.(bool); ok && !b {
+					v.fail(joinPath(path, k), "property is not allowed")
+				} else {
+					v.jsonSchema(extra, val[k], joinPath(path, k))
+				}
+			}
+		}
+	}
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.jsonSchema(sub, value, path)
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		subs, ok := s[key].([]interface{})
+		if !ok {
+			continue
+		}
+		matches := 0
+		for _, sub := range subs {
+			probe := schemaValidator{root: v.root}
+			probe.jsonSchema(sub, value, path)
+			if len(probe.errors) == 0 {
+				matches++
+			}
+		}
+		if matches == 0 || (key == "oneOf" && matches > 1) {
+			v.fail(path, "value matches %d schemas of %s", matches, key)
+		}
+	}
+}
+
+// helper function to compare JSON values
+func jsonEqual(a, b interface{}) bool {
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	return string(da) == string(db)
+}
+
+// helper function to validate value against Avro schema
+func (v *schemaValidator) avro(schema, value interface{}, path, namespace string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		// union matches any of its branches
+		for _, branch := range s {
+			probe := schemaValidator{names: v.names}
+			probe.avro(branch, value, path, namespace)
+			if len(probe.errors) == 0 {
+				return
+			}
+		}
+		v.fail(path, "value does not match any type of union %v", avroTypeNames(s))
+	case string:
+		v.avroPrimitive(s, value, path, namespace)
+	case map[string]interface{}:
+		t, _ := s["type"].(string)
+		if ns, ok := s["namespace"].(string); ok {
+			namespace = ns
+		}
+		switch t {
+		case "record", "error":
+			val, ok := value.(map[string]interface{})
+			if !ok {
+				v.fail(path, "expected record, got %s", jsonValueType(value))
+				return
+			}
+			fields, _ := s["fields"].([]interface{})
+			known := make(map[string]bool)
+			for _, f := range fields {
+				field, _ := f.(map[string]interface{})
+				name, _ := field["name"].(string)
+				known[name] = true
+				fv, ok := val[name]
+				if !ok {
+					if _, hasDefault := field["default"]; !hasDefault && !avroNullable(field["type"]) {
+						v.fail(joinPath(path, name), "required field is missing")
+					}
+					continue
+				}
+				v.avro(field["type"], fv, joinPath(path, name), namespace)
+			}
+			keys := make([]string, 0, len(val))
+			for k := range val {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if !known[k] {
+					v.fail(joinPath(path, k), "field is not defined in the record")
+				}
+			}
+		case "enum":
+			symbols, _ := s["symbols"].([]interface{})
+			for _, sym := range symbols {
+				if sym == value {
+					return
+				}
+			}
+			v.fail(path, "value %v is not one of %v", value, symbols)
+		case "array":
+			val, ok := value.([]interface{})
+			if !ok {
+				v.fail(path, "expected array, got %s", jsonValueType(value))
+				return
+			}
+			for i, item := range val {
+				v.avro(s["items"], item, joinPath(path, i), namespace)
+			}
+		case "map":
+			val, ok := value.(map[string]interface{})
+			if !ok {
+				v.fail(path, "expected map, got %s", jsonValueType(value))
+				return
+			}
+			keys := make([]string, 0, len(val))
+			for k := range val {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				v.avro(s["values"], val[k], joinPath(path, k), namespace)
+			}
+		case "fixed":
+			val, ok := value.(string)
+			size, _ := s["size"].(float64)
+			if !ok || len(val) != int(size) {
+				v.fail(path, "expected fixed of %v bytes", size)
+			}
+		default:
+			// primitive types with logical types or attributes
+			v.avro(s["type"], value, path, namespace)
+		}
+	default:
+		v.fail(path, "invalid Avro schema %v", schema)
+	}
+}
+
+// helper function to collect named types of Avro schema
+func collectAvroNames(schema interface{}, namespace string, names map[string]interface{}) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, branch := range s {
+			collectAvroNames(branch, namespace, names)
+		}
+	case map[string]interface{}:
+		if ns, ok := s["namespace"].(string); ok {
+			namespace = ns
+		}
+		if name, ok := s["name"].(string); ok && (s["fields"] != nil || s["symbols"] != nil || s["size"] != nil) {
+			names[name] = s
+			if namespace != "" && !strings.Contains(name, ".") {
+				names[namespace+"."+name] = s
+			}
+		}
+		if fields, ok := s["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if field, ok := f.(map[string]interface{}); ok {
+					collectAvroNames(field["type"], namespace, names)
+				}
+			}
+		}
+		collectAvroNames(s["items"], namespace, names)
+		collectAvroNames(s["values"], namespace, names)
+		if t, ok := s["type"].(map[string]interface{}); ok {
+			collectAvroNames(t, namespace, names)
+		}
+	}
+}
+
+// helper function to validate value against Avro primitive or named type
+func (v *schemaValidator) avroPrimitive(t string, value interface{}, path, namespace string) {
+	vtype := jsonValueType(value)
+	switch t {
+	case "null":
+		if value != nil {
+			v.fail(path, "expected null, got %s", vtype)
+		}
+	case "boolean":
+		if vtype != "boolean" {
+			v.fail(path, "expected boolean, got %s", vtype)
+		}
+	case "int", "long":
+		if vtype != "integer" {
+			v.fail(path, "expected %s, got %s", t, vtype)
+		} else if f := value.(float64); t == "int" && (f < math.MinInt32 || f > math.MaxInt32) {
+			v.fail(path, "value %v is out of int range", f)
+		}
+	case "float", "double":
+		if vtype != "integer" && vtype != "number" {
+			v.fail(path, "expected %s, got %s", t, vtype)
+		}
+	case "string", "bytes":
+		if vtype != "string" {
+			v.fail(path, "expected %s, got %s", t, vtype)
+		}
+	default:
+		named, ok := v.names[t]
+		if !ok && namespace != "" {
+			named, ok = v.names[namespace+"."+t]
+		}
+		if !ok {
+			v.fail(path, "unknown Avro type %s", t)
+			return
+		}
+		v.avro(named, value, path, namespace)
+	}
+}
+
+// helper function to check if Avro type allows null values
+func avroNullable(t interface{}) bool {
+	if t == "null" {
+		return true
+	}
+	if union, ok := t.([]interface{}); ok {
+		for _, b := range union {
+			if b == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to return names of Avro union types
+func avroTypeNames(union []interface{}) []string {
+	var names []string
+	for _, t := range union {
+		if m, ok := t.(map[string]interface{}); ok {
+			if name, ok := m["name"].(string); ok {
+				names = append(names, name)
+			} else {
+				names = append(names, fmt.Sprintf("%v", m["type"]))
+			}
+			continue
+		}
+		names = append(names, fmt.Sprintf("%v", t))
+	}
+	return names
+}
+
+// SchemaHandler provides input schema of the model
+func SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	model := resolveModel(mux.Vars(r)["name"])
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model params", err, http.StatusNotFound)
+		return
+	}
+	schema, err := getInputSchema(model)
+	if err != nil {
+		responseError(w, "unable to read input schema", err, http.StatusInternalServerError)
+		return
+	}
+	if schema == nil {
+		if len(params.Schema) == 0 {
+			msg := fmt.Sprintf("model %s has no input schema", model)
+			responseError(w, msg, nil, http.StatusNotFound)
+			return
+		}
+		data, _ := json.MarshalIndent(featuresJSONSchema(model, params.Schema), "", "  ")
+		schema = &InputSchema{Format: jsonSchemaFormat, Data: data}
+	}
+	w.Header().Set("Schema-Format", schema.Format)
+	if schema.Format == jsonSchemaFormat {
+		w.Header().Set("Content-Type", "application/schema+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(schema.Data)
+}
@@ -0,0 +1,145 @@
+package main
+
+// tests of input schemas, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// JSON Schema of test rows
+var testJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "properties": {
+    "model": {"type": "string"},
+    "keys": {"type": "array", "items": {"$ref": "#/$defs/key"}},
+    "values": {"type": "array", "items": {"type": "number", "minimum": 0}, "minItems": 4, "maxItems": 4},
+    "eventID": {"type": "string", "pattern": "^run[0-9]+:"}
+  },
+  "required": ["values"],
+  "additionalProperties": false,
+  "$defs": {"key": {"type": "string", "enum": ["attr0", "attr1", "attr2", "attr3"]}}
+}`
+
+// Avro schema of test rows
+var testAvroSchema = `{
+  "type": "record", "name": "Row", "namespace": "tfaas",
+  "fields": [
+    {"name": "model", "type": ["null", "string"]},
+    {"name": "keys", "type": {"type": "array", "items": "string"}, "default": []},
+    {"name": "values", "type": {"type": "array", "items": "float"}},
+    {"name": "source", "type": {"type": "enum", "name": "Source", "symbols": ["DAQ", "MC"]}, "default": "DAQ"},
+    {"name": "origin", "type": ["null", "Source"], "default": null},
+    {"name": "run", "type": "int", "default": 0}
+  ]
+}`
+
+// TestInputSchemaValidation checks validation of payloads against JSON Schema and Avro schema
+func TestInputSchemaValidation(t *testing.T) {
+	jsonSchema, err := parseInputSchema("schema.json", []byte(testJSONSchema))
+	if err != nil || jsonSchema.Format != jsonSchemaFormat {
+		t.Fatalf("unable to parse JSON Schema %v %+v", err, jsonSchema)
+	}
+	avroSchema, err := parseInputSchema("row.avsc", []byte(testAvroSchema))
+	if err != nil || avroSchema.Format != avroSchemaFormat {
+		t.Fatalf("unable to parse Avro schema %v %+v", err, avroSchema)
+	}
+	tests := []struct {
+		schema  *InputSchema
+		payload string
+		errors  []string
+	}{
+		{jsonSchema, `{"model": "dnn", "keys": ["attr0"], "values": [1, 2, 3, 4], "eventID": "run1:evt2"}`, nil},
+		{jsonSchema, `{"values": [1, 2, 3]}`, []string{"values: expected at least 4 items, got 3"}},
+		{jsonSchema, `{"keys": ["pt"], "values": [1, 2, -3, 4]}`, []string{
+			"keys[0]: value pt is not one of [attr0 attr1 attr2 attr3]",
+			"values[2]: value -3 is below minimum 0"}},
+		{jsonSchema, `{"model": 1, "text": "x"}`, []string{
+			"values: required property is missing",
+			"model: expected string, got integer",
+			"text: property is not allowed"}},
+		{jsonSchema, `{"values": [1, 2, 3, 4], "eventID": "evt2"}`, []string{`eventID: value "evt2" does not match pattern ^run[0-9]+:`}},
+		{jsonSchema, `[1, 2]`, []string{"payload: expected object, got array"}},
+		{avroSchema, `{"model": "dnn", "values": [1.5, 2], "source": "MC", "origin": "DAQ", "run": 7}`, nil},
+		{avroSchema, `{"model": null, "values": [1.5]}`, nil},
+		{avroSchema, `{"keys": [1], "source": "TB", "run": 1.5}`, []string{
+			"keys[0]: expected string, got integer",
+			"values: required field is missing",
+			"source: value TB is not one of [DAQ MC]",
+			"run: expected int, got number"}},
+		{avroSchema, `{"values": [], "origin": "TB", "text": "x"}`, []string{
+			"origin: value does not match any type of union [null Source]",
+			"text: field is not defined in the record"}},
+	}
+	for _, tt := range tests {
+		errs, err := tt.schema.validate([]byte(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(errs, "\n") != strings.Join(tt.errors, "\n") {
+			t.Errorf("wrong violations of %s\n%s\nexpected\n%s", tt.payload, strings.Join(errs, "\n"), strings.Join(tt.errors, "\n"))
+		}
+	}
+}
+
+// TestFakeInputSchema checks serving of input schemas and validation of requests
+func TestFakeInputSchema(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", InputSchema: "schema.json"}
+	writeModelFiles(t, "contract", []byte("contract"), params)
+	fname := filepath.Join(_config.ModelDir, "contract", "schema.json")
+	if err := ioutil.WriteFile(fname, []byte(testJSONSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lo := 0.0
+	params = TFParams{InputNode: "input", OutputNode: "output", Schema: []FeatureSchema{{Name: "pt", Min: &lo}, {Name: "eta"}}}
+	writeModelFiles(t, "features", []byte("features"), params)
+
+	schema := func(model string) (int, string, map[string]interface{}) {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/models/"+model+"/schema", nil), map[string]string{"name": model})
+		rr := httptest.NewRecorder()
+		SchemaHandler(rr, req)
+		var doc map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &doc)
+		return rr.Code, rr.Header().Get("Schema-Format"), doc
+	}
+	if code, format, doc := schema("contract"); code != http.StatusOK || format != jsonSchemaFormat || doc["$defs"] == nil {
+		t.Errorf("wrong schema of model %d %s %v", code, format, doc)
+	}
+	code, format, doc := schema("features")
+	if code != http.StatusOK || format != jsonSchemaFormat {
+		t.Fatalf("wrong generated schema %d %s %v", code, format, doc)
+	}
+	generated := &InputSchema{Format: jsonSchemaFormat, root: doc}
+	if errs, _ := generated.validate([]byte(`{"keys": ["pt", "phi"], "values": [1]}`)); len(errs) != 2 {
+		t.Errorf("wrong violations of generated schema %v", errs)
+	}
+	if code, _, _ := schema("dnn"); code != http.StatusNotFound {
+		t.Errorf("wrong status %d of model without schema", code)
+	}
+
+	// prediction requests are validated against the schema
+	predict := func(body string) int {
+		rr := httptest.NewRecorder()
+		PredictHandler(rr, httptest.NewRequest("POST", "/json", bytes.NewReader([]byte(body))))
+		return rr.Code
+	}
+	if code := predict(`{"model": "contract", "values": [1, 2, 3, 4]}`); code != http.StatusOK {
+		t.Errorf("wrong status %d of valid payload", code)
+	}
+	if code := predict(`{"model": "contract", "values": [1, 2, 3, 4], "raw": true}`); code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of invalid payload", code)
+	}
+	if code, res := validateRequest(t, "contract", `{"values": [1, 2, 3]}`); code != http.StatusUnprocessableEntity || len(res.Errors) != 1 {
+		t.Errorf("wrong validation of invalid payload %d %+v", code, res)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+// secrets module provides resolution of secrets of server configuration
+//
+// Credentials of the configuration (OIDC client and cookie secrets, LDAP
+// bind password, model store token, credentials of NATS/MQTT/webhook/event
+// sink URLs and TLS server certificate and key) may refer to secrets instead
+// of holding them in plain text:
+//
+//	"env:NAME"                  value of NAME environment variable
+//	"file:/path"                content of (mounted) file without trailing newline
+//	"vault:secret/data/tfaas#k" field k of HashiCorp Vault secret, KV v1 or v2
+//
+// Vault address and token are taken from "vaultAddr" and "vaultToken"
+// options (the token may itself be env: or file: reference) or VAULT_ADDR and
+// VAULT_TOKEN environment variables. Secrets are kept in memory only, e.g.
+// TLS key is loaded without writing it to disk, and resolved secrets are
+// redacted in server logs.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefixes of secret references
+var secretPrefixes = []string{"env:", "file:", "vault:"}
+
+// HTTP client of Vault requests
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// global list of secrets redacted in logs
+var (
+	_secrets     []string
+	_secretsLock sync.RWMutex
+)
+
+// helper function to check if value refers to a secret
+func isSecretRef(value string) bool {
+	for _, prefix := range secretPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to register secret value to be redacted in logs
+func registerSecret(value string) {
+	// too short values would redact unrelated parts of log messages
+	if len(value) < 4 {
+		return
+	}
+	_secretsLock.Lock()
+	defer _secretsLock.Unlock()
+	if !InList(value, _secrets) {
+		_secrets = append(_secrets, value)
+	}
+}
+
+// helper function to redact registered secrets in given message
+func redact(msg string) string {
+	_secretsLock.RLock()
+	defer _secretsLock.RUnlock()
+	for _, s := range _secrets {
+		msg = strings.ReplaceAll(msg, s, "***")
+	}
+	return msg
+}
+
+// redactWriter redacts secrets of log messages
+type redactWriter struct {
+	w io.Writer
+}
+
+// Write implements io.Writer interface
+func (r redactWriter) Write(data []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redact(string(data)))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// helper function to resolve secret reference, plain values are returned
+// as is
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, "vault:"):
+		return vaultSecret(strings.TrimPrefix(value, "vault:"))
+	}
+	return value, nil
+}
+
+// helper function to read field of Vault secret given as path#field
+func vaultSecret(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("vault secret reference %q should be path#field", ref)
+	}
+	addr := _config.VaultAddr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", errors.New("vault address is not configured")
+	}
+	token := _config.VaultToken
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	} else if isSecretRef(token) && !strings.HasPrefix(token, "vault:") {
+		var err error
+		if token, err = resolveSecret(token); err != nil {
+			return "", err
+		}
+	}
+	rurl := strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(parts[0], "/")
+	req, err := http.NewRequest("GET", rurl, nil)
+	if err != nil {
+		return "", err
+	}
+	registerSecret(token)
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", parts[0], resp.Status)
+	}
+	var rec struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return "", err
+	}
+	data := rec.Data
+	// KV v2 secrets keep fields in nested data record
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	v, ok := data[parts[1]].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", parts[0], parts[1])
+	}
+	return v, nil
+}
+
+// helper function to resolve secret in place and register it for redaction
+func resolveSecretField(value *string) error {
+	if *value == "" {
+		return nil
+	}
+	v, err := resolveSecret(*value)
+	if err != nil {
+		return err
+	}
+	*value = v
+	registerSecret(v)
+	return nil
+}
+
+// helper function to resolve URL in place, URLs given by reference and
+// passwords of URLs are registered for redaction
+func resolveSecretURL(value *string) error {
+	ref := isSecretRef(*value)
+	v, err := resolveSecret(*value)
+	if err != nil {
+		return err
+	}
+	*value = v
+	if ref {
+		registerSecret(v)
+	}
+	if uri, err := url.Parse(*value); err == nil && uri.User != nil {
+		if pass, ok := uri.User.Password(); ok {
+			registerSecret(pass)
+		}
+	}
+	return nil
+}
+
+// helper function to resolve secrets of server configuration
+func resolveSecrets(c *Configuration) error {
+	fields := map[string]*string{
+		"oidcClientSecret":  &c.OIDCClientSecret,
+		"oidcCookieSecret":  &c.OIDCCookieSecret,
+		"modelStoreToken":   &c.ModelStoreToken,
+		"backupToken":       &c.BackupToken,
+		"resultsStoreToken": &c.ResultsStoreToken,
+		"redactionKey":      &c.RedactionKey,
+	}
+	if c.Policy != nil && c.Policy.LDAP != nil {
+		fields["policy.ldap.bindPassword"] = &c.Policy.LDAP.BindPassword
+	}
+	for name, value := range fields {
+		if err := resolveSecretField(value); err != nil {
+			return fmt.Errorf("unable to resolve %s: %v", name, err)
+		}
+	}
+	urls := map[string]*string{"natsURL": &c.NATSURL, "mqttURL": &c.MQTTURL, "stateStore": &c.StateStore}
+	for i := range c.Webhooks {
+		urls[fmt.Sprintf("webhooks[%d].url", i)] = &c.Webhooks[i].URL
+	}
+	for i := range c.EventSinks {
+		urls[fmt.Sprintf("eventSinks[%d].url", i)] = &c.EventSinks[i].URL
+	}
+	for i := range c.ResultSinks {
+		urls[fmt.Sprintf("resultSinks[%d].url", i)] = &c.ResultSinks[i].URL
+	}
+	for name, value := range urls {
+		if err := resolveSecretURL(value); err != nil {
+			return fmt.Errorf("unable to resolve %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// helper function to read content of given file or secret reference
+func loadSecretFile(value string) ([]byte, error) {
+	if isSecretRef(value) {
+		v, err := resolveSecret(value)
+		return []byte(v), err
+	}
+	return ioutil.ReadFile(value)
+}
+
+// helper function to load CA certificates used to verify client
+// certificates, it returns nil if client CAs are not configured
+func clientCAPool() (*x509.CertPool, error) {
+	if _config.ClientCAs == "" {
+		return nil, nil
+	}
+	data, err := loadSecretFile(_config.ClientCAs)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates found in %s", _config.ClientCAs)
+	}
+	return pool, nil
+}
+
+// helper function to load TLS certificate of the server, it returns nil if
+// server certificate or key is not configured
+func serverCertificate() (*tls.Certificate, error) {
+	crt, key := _config.ServerCrt, _config.ServerKey
+	if crt == "" || key == "" {
+		return nil, nil
+	}
+	for _, v := range []string{crt, key} {
+		// server without certificate files runs plain HTTP
+		if _, err := os.Stat(v); err != nil && !isSecretRef(v) {
+			return nil, nil
+		}
+	}
+	crtPEM, err := loadSecretFile(crt)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := loadSecretFile(key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
+	// do not keep copies of the key in memory longer than needed
+	for i := range keyPEM {
+		keyPEM[i] = 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
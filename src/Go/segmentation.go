@@ -0,0 +1,200 @@
+package main
+
+// segmentation module provides masks of image segmentation models
+//
+// Segmentation models output class scores of every pixel, i.e. [1, H, W, C]
+// tensors (or [1, H, W, 1] probabilities of binary masks), or class ids of
+// every pixel, i.e. [1, H, W] tensors. Such models declare segmentation in
+// their params.json, e.g.
+// "segmentation": {"format": "png", "colors": {"person": "#ff0000", "0": "#000000"}}
+// and image endpoints return predicted mask instead of labels, either as
+// run-length encoded class ids of pixels in row-major order (rle format,
+// default) or as base64 encoded PNG image (png format) where every class is
+// painted by its color. Colors are keyed by class labels (or class ids), the
+// classes without color use PASCAL VOC color map. Clients may choose mask
+// format via mask form field (or query parameter), e.g. -F 'mask=png'.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mask formats
+const (
+	maskRLE = "rle"
+	maskPNG = "png"
+)
+
+// SegmentationConfig represents segmentation outputs of the model
+type SegmentationConfig struct {
+	Format string            `json:"format,omitempty"` // mask format: rle (default) or png
+	Colors map[string]string `json:"colors,omitempty"` // colors of classes in #rrggbb form keyed by labels or class ids
+}
+
+// MaskRLE represents run-length encoded mask, i.e. Counts[i] consecutive
+// pixels (in row-major order) have Values[i] class id
+type MaskRLE struct {
+	Size   []int `json:"size"`   // mask size [height, width]
+	Counts []int `json:"counts"` // lengths of runs
+	Values []int `json:"values"` // class ids of runs
+}
+
+// SegmentationResult represents predicted mask of the image
+type SegmentationResult struct {
+	Filename string   `json:"filename"`
+	Width    int      `json:"width"`             // mask width
+	Height   int      `json:"height"`            // mask height
+	Classes  []string `json:"classes,omitempty"` // labels of class ids
+	RLE      *MaskRLE `json:"rle,omitempty"`     // run-length encoded mask
+	PNG      string   `json:"png,omitempty"`     // base64 encoded PNG mask
+}
+
+// segmentMask converts outputs of single image of given shape into class
+// ids of pixels, it returns mask with its height and width
+func segmentMask(values []float32, shape []int64) ([]int, int, int, error) {
+	var h, w, c int64
+	switch len(shape) {
+	case 2:
+		h, w, c = shape[0], shape[1], 0
+	case 3:
+		h, w, c = shape[0], shape[1], shape[2]
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported shape %v of segmentation outputs", shape)
+	}
+	size := h * w
+	if c > 0 {
+		size *= c
+	}
+	if size == 0 || int64(len(values)) != size {
+		return nil, 0, 0, fmt.Errorf("%d segmentation outputs do not match shape %v", len(values), shape)
+	}
+	mask := make([]int, h*w)
+	for i := range mask {
+		switch {
+		case c == 0:
+			// class ids
+			mask[i] = int(values[i])
+		case c == 1:
+			// probability of binary mask
+			if values[i] >= 0.5 {
+				mask[i] = 1
+			}
+		default:
+			// best class of the pixel
+			scores := values[int64(i)*c : int64(i+1)*c]
+			best := 0
+			for j, s := range scores {
+				if s > scores[best] {
+					best = j
+				}
+			}
+			mask[i] = best
+		}
+	}
+	return mask, int(h), int(w), nil
+}
+
+// encodeRLE encodes mask of given size as run-length encoded mask
+func encodeRLE(mask []int, h, w int) *MaskRLE {
+	rle := &MaskRLE{Size: []int{h, w}, Counts: []int{}, Values: []int{}}
+	for i, v := range mask {
+		if i > 0 && v == mask[i-1] {
+			rle.Counts[len(rle.Counts)-1]++
+			continue
+		}
+		rle.Counts = append(rle.Counts, 1)
+		rle.Values = append(rle.Values, v)
+	}
+	return rle
+}
+
+// helper function to return color of class id in PASCAL VOC color map
+func vocColor(id int) color.NRGBA {
+	var r, g, b uint8
+	for j := uint(0); j < 8; j++ {
+		r |= uint8(id&1) << (7 - j)
+		g |= uint8(id>>1&1) << (7 - j)
+		b |= uint8(id>>2&1) << (7 - j)
+		id >>= 3
+	}
+	return color.NRGBA{r, g, b, 255}
+}
+
+// helper function to parse color in #rrggbb form
+func parseColor(s string) (color.NRGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+// encodePNG paints mask of given size with class colors and encodes it as
+// PNG image
+func encodePNG(mask []int, h, w int, labels []string, colors map[string]string) ([]byte, error) {
+	palette := make(map[int]color.NRGBA)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i, id := range mask {
+		c, ok := palette[id]
+		if !ok {
+			c = vocColor(id)
+			if s, ok := colors[className(labels, id)]; ok {
+				var err error
+				if c, err = parseColor(s); err != nil {
+					return nil, err
+				}
+			} else if s, ok := colors[strconv.Itoa(id)]; ok {
+				var err error
+				if c, err = parseColor(s); err != nil {
+					return nil, err
+				}
+			}
+			palette[id] = c
+		}
+		img.SetNRGBA(i%w, i/w, c)
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// responseSegmentation writes predicted mask of the image of given model
+// with given segmentation outputs
+func responseSegmentation(w http.ResponseWriter, r *http.Request, model, fileName string, params TFParams, values []float32) {
+	shape, _ := outputShape(model)
+	mask, height, width, err := segmentMask(values, shape)
+	if err != nil {
+		responseError(w, "unable to make segmentation mask", err, http.StatusInternalServerError)
+		return
+	}
+	format := r.FormValue("mask")
+	if format == "" {
+		format = params.Segmentation.Format
+	}
+	labels := decisionLabels(model, params)
+	res := SegmentationResult{Filename: fileName, Width: width, Height: height, Classes: labels}
+	switch format {
+	case "", maskRLE:
+		res.RLE = encodeRLE(mask, height, width)
+	case maskPNG:
+		data, err := encodePNG(mask, height, width, labels, params.Segmentation.Colors)
+		if err != nil {
+			responseError(w, "unable to encode segmentation mask", err, http.StatusInternalServerError)
+			return
+		}
+		res.PNG = base64.StdEncoding.EncodeToString(data)
+	default:
+		msg := fmt.Sprintf("unsupported mask format %s, supported formats: rle, png", format)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	setOutputShapeHeader(w, model, "")
+	responseJSON(w, res)
+}
@@ -0,0 +1,92 @@
+package main
+
+// tests of segmentation masks, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestSegmentMask checks conversion of segmentation outputs into masks
+func TestSegmentMask(t *testing.T) {
+	tests := []struct {
+		values []float32
+		shape  []int64
+		mask   []int
+	}{
+		{[]float32{0.1, 0.9, 0.7, 0.3, 0.2, 0.2, 0, 1}, []int64{2, 2, 2}, []int{1, 0, 0, 1}},
+		{[]float32{0.7, 0.2, 0.5, 0.4}, []int64{2, 2, 1}, []int{1, 0, 1, 0}},
+		{[]float32{3, 0, 1, 1}, []int64{2, 2}, []int{3, 0, 1, 1}},
+	}
+	for _, tt := range tests {
+		mask, h, w, err := segmentMask(tt.values, tt.shape)
+		if err != nil || h != 2 || w != 2 || !reflect.DeepEqual(mask, tt.mask) {
+			t.Errorf("wrong mask %v (%dx%d) of shape %v, expected %v: %v", mask, h, w, tt.shape, tt.mask, err)
+		}
+	}
+	if _, _, _, err := segmentMask([]float32{1, 2, 3}, []int64{2, 2}); err == nil {
+		t.Error("outputs which do not match shape should be rejected")
+	}
+	rle := encodeRLE([]int{0, 0, 1, 1, 1, 2}, 2, 3)
+	if !reflect.DeepEqual(rle.Counts, []int{2, 3, 1}) || !reflect.DeepEqual(rle.Values, []int{0, 1, 2}) {
+		t.Errorf("wrong run-length encoding %+v", rle)
+	}
+	if c := vocColor(1); c != (color.NRGBA{128, 0, 0, 255}) {
+		t.Errorf("wrong color %v of class 1", c)
+	}
+}
+
+// TestFakeSegmentation checks masks of image requests of segmentation model
+func TestFakeSegmentation(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	fake.Outputs = []float32{0.1, 0.2, 0.7, 0.9, 0.05, 0.05, 0.8, 0.1, 0.1, 0.2, 0.6, 0.2}
+	fake.OutputShape = []int64{2, 2, 3}
+	params := TFParams{InputNode: "input", OutputNode: "output", ImgChannels: 3}
+	params.Segmentation = &SegmentationConfig{Colors: map[string]string{"a": "#00ff00"}}
+	writeModelFiles(t, "seg", []byte("seg"), params)
+
+	segment := func(query string) SegmentationResult {
+		req := imageRequest(t, "seg")
+		req.URL.RawQuery = query
+		rr := httptest.NewRecorder()
+		ImageHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+		}
+		var res SegmentationResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := segment("")
+	if res.RLE == nil || !reflect.DeepEqual(res.RLE.Counts, []int{1, 2, 1}) || !reflect.DeepEqual(res.RLE.Values, []int{2, 0, 1}) {
+		t.Errorf("wrong mask %+v", res.RLE)
+	}
+	if !reflect.DeepEqual(res.Classes, testLabels) || res.Width != 2 || res.Height != 2 {
+		t.Errorf("wrong segmentation result %+v", res)
+	}
+
+	res = segment("mask=png")
+	data, err := base64.StdEncoding.DecodeString(res.PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(1, 0)); c != (color.NRGBA{0, 255, 0, 255}) {
+		t.Errorf("wrong color %v of class a", c)
+	}
+	if c := color.NRGBAModel.Convert(img.At(0, 0)); c != vocColor(2) {
+		t.Errorf("wrong color %v of class c", c)
+	}
+}
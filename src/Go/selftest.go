@@ -0,0 +1,234 @@
+package main
+
+// selftest module provides golden set predictions checks for TF models
+//
+// Each model may ship a golden.json file (or file name defined by "golden"
+// key in params.json) with inputs and expected outputs, e.g.
+// {"tolerance": 1e-4, "tests": [{"keys": [...], "values": [...], "expected": [...]}]}
+// The server runs these tests when models are loaded and periodically
+// on a schedule defined by selfTestInterval configuration parameter.
+// Self-tests are not counted as model requests: they do not update model
+// usage and SLOs, and bypass circuit breaker and injected faults.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default tolerance used to compare model outputs with expected values
+const defaultTolerance = 1e-4
+
+// GoldenTest represents single golden test of the model
+type GoldenTest struct {
+	Keys      []string  `json:"keys"`      // row attribute names
+	Values    []float32 `json:"values"`    // row values
+	Expected  []float32 `json:"expected"`  // expected model output
+	Tolerance float64   `json:"tolerance"` // tolerance for this test
+}
+
+// GoldenSet represents golden test set shipped with the model
+type GoldenSet struct {
+	Tolerance float64      `json:"tolerance"` // default tolerance for all tests
+	Tests     []GoldenTest `json:"tests"`     // list of golden tests
+}
+
+// SelfTestResult represents results of model self-test
+type SelfTestResult struct {
+	Model    string   `json:"model"`    // model name
+	Passed   bool     `json:"passed"`   // status of self-test
+	Tests    int      `json:"tests"`    // number of performed tests
+	Failures []string `json:"failures"` // list of failures
+	Time     string   `json:"time"`     // time of self-test
+}
+
+// SelfTests keeps results of model self-tests
+type SelfTests struct {
+	Results map[string]SelfTestResult
+	mutex   sync.RWMutex
+}
+
+// global self-tests results
+var _selfTests = SelfTests{Results: make(map[string]SelfTestResult)}
+
+// set self-test result for given model
+func (s *SelfTests) set(res SelfTestResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Results[res.Model] = res
+}
+
+// remove self-test result of given model
+func (s *SelfTests) remove(model string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.Results, model)
+}
+
+// list returns all self-test results
+func (s *SelfTests) list() []SelfTestResult {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var out []SelfTestResult
+	for _, res := range s.Results {
+		out = append(out, res)
+	}
+	return out
+}
+
+// failed returns list of models which failed their self-tests
+func (s *SelfTests) failed() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var out []string
+	for name, res := range s.Results {
+		if !res.Passed {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// helper function to read golden set of the model, it returns nil if
+// model does not provide golden set
+func readGoldenSet(model string) (*GoldenSet, error) {
+	params, err := getModelParams(model)
+	if err != nil {
+		return nil, err
+	}
+	fname := params.Golden
+	if fname == "" {
+		fname = "golden.json"
+	}
+	path := fmt.Sprintf("%s/%s/%s", _config.ModelDir, model, fname)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var golden GoldenSet
+	err = json.Unmarshal(data, &golden)
+	if err != nil {
+		return nil, err
+	}
+	return &golden, nil
+}
+
+// helper function to run golden set tests of given model, it returns nil
+// if model does not have a golden set
+func selfTest(model string) *SelfTestResult {
+	golden, err := readGoldenSet(model)
+	if err != nil {
+		res := SelfTestResult{
+			Model:    model,
+			Failures: []string{fmt.Sprintf("unable to read golden set: %v", err)},
+			Time:     time.Now().String(),
+		}
+		return &res
+	}
+	if golden == nil {
+		return nil
+	}
+	res := SelfTestResult{Model: model, Passed: true, Tests: len(golden.Tests), Time: time.Now().String()}
+	for idx, test := range golden.Tests {
+		tolerance := test.Tolerance
+		if tolerance == 0 {
+			tolerance = golden.Tolerance
+		}
+		if tolerance == 0 {
+			tolerance = defaultTolerance
+		}
+		// self-tests check the model itself and do not use its fallback,
+		// they are not counted as requests of the model
+		row := &Row{Keys: test.Keys, Values: test.Values, Model: model, selfTest: true}
+		probs, err := predictRow(row)
+		if err != nil {
+			msg := fmt.Sprintf("test %d: unable to make predictions: %v", idx, err)
+			res.Failures = append(res.Failures, msg)
+			continue
+		}
+		if len(probs) != len(test.Expected) {
+			msg := fmt.Sprintf("test %d: output size %d does not match expected size %d", idx, len(probs), len(test.Expected))
+			res.Failures = append(res.Failures, msg)
+			continue
+		}
+		for i, p := range probs {
+			diff := math.Abs(float64(p) - float64(test.Expected[i]))
+			if diff > tolerance {
+				msg := fmt.Sprintf("test %d: output[%d]=%v deviates from expected %v by %v (tolerance %v)", idx, i, p, test.Expected[i], diff, tolerance)
+				res.Failures = append(res.Failures, msg)
+				break
+			}
+		}
+	}
+	if len(res.Failures) > 0 {
+		res.Passed = false
+	}
+	return &res
+}
+
+// helper function to run self-test of given model and record its results
+func runSelfTest(model string) {
+	res := selfTest(model)
+	if res == nil {
+		_selfTests.remove(model)
+		return
+	}
+	if res.Passed {
+		if VERBOSE > 0 {
+			log.Printf("model %s passed %d self-tests", model, res.Tests)
+		}
+	} else {
+		log.Println("ERROR: model", model, "failed self-tests", res.Failures)
+		publish(EventSelfTestFailed, model, strings.Join(res.Failures, "; "))
+	}
+	_selfTests.set(*res)
+}
+
+// background self-tests of installed models
+var _selfTestsRunning sync.WaitGroup
+
+// helper function to run self-test of installed model in background, the
+// self-tests are tracked such that they can be waited for
+func startSelfTest(model string) {
+	_selfTestsRunning.Add(1)
+	go func() {
+		defer _selfTestsRunning.Done()
+		runSelfTest(model)
+	}()
+}
+
+// helper function to run self-tests for all known models
+func runSelfTests() {
+	models, err := TFModels()
+	if err != nil {
+		log.Println("unable to get TF models for self-tests", err)
+	}
+	for _, m := range models {
+		runSelfTest(m.Name)
+	}
+}
+
+// selfTestScheduler runs self-tests of all models on server start and
+// periodically with given interval (in seconds), periodic self-tests run
+// only on the leader replica
+func selfTestScheduler(interval int) {
+	runSelfTests()
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		if isLeader() {
+			runSelfTests()
+		}
+	}
+}
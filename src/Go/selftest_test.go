@@ -0,0 +1,135 @@
+package main
+
+// tests of model self-tests, they do not require TF C library
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function to write golden set of the model into model area
+func writeGoldenSet(tb testing.TB, model, fname string, golden GoldenSet) {
+	data, err := json.Marshal(golden)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(_config.ModelDir, model, fname), data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// helper function to create golden test of test row with given expected outputs
+func goldenTest(expected []float32) GoldenTest {
+	row := testRow("dnn")
+	return GoldenTest{Keys: row.Keys, Values: row.Values, Expected: expected}
+}
+
+// TestSelfTest checks golden set predictions of models and readiness of
+// the server
+func TestSelfTest(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	t.Cleanup(func() {
+		for _, m := range []string{"dnn", "dnn2", "img"} {
+			_selfTests.remove(m)
+		}
+	})
+	if res := selfTest("dnn"); res != nil {
+		t.Fatalf("self-test of model without golden set %+v", res)
+	}
+
+	writeGoldenSet(t, "dnn", "golden.json", GoldenSet{Tests: []GoldenTest{goldenTest(testOutputs)}})
+	runSelfTest("dnn")
+	w := httptest.NewRecorder()
+	ReadyHandler(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("server is not ready: %d %s", w.Code, w.Body.String())
+	}
+
+	// golden set with custom file name, wrong outputs and wrong output size
+	params := TFParams{InputNode: "input", OutputNode: "output", Golden: "checks.json"}
+	writeModelFiles(t, "dnn2", []byte("dnn2"), params)
+	golden := GoldenSet{Tolerance: 0.01, Tests: []GoldenTest{
+		goldenTest([]float32{0.205, 0.3, 0.495}),
+		goldenTest([]float32{0.5, 0.3, 0.2}),
+		goldenTest([]float32{0.2, 0.3}),
+	}}
+	golden.Tests[0].Tolerance = 1e-3
+	writeGoldenSet(t, "dnn2", "checks.json", golden)
+	res := selfTest("dnn2")
+	if res == nil || res.Passed || res.Tests != 3 || len(res.Failures) != 3 {
+		t.Fatalf("wrong self-test result %+v", res)
+	}
+	if !strings.HasPrefix(res.Failures[0], "test 0: output[0]") || !strings.HasPrefix(res.Failures[1], "test 1: output[0]") || !strings.Contains(res.Failures[2], "expected size 2") {
+		t.Fatalf("wrong self-test failures %v", res.Failures)
+	}
+
+	runSelfTest("dnn2")
+	w = httptest.NewRecorder()
+	ReadyHandler(w, httptest.NewRequest("GET", "/ready", nil))
+	var rec struct {
+		Status string   `json:"status"`
+		Failed []string `json:"failedSelfTests"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &rec)
+	if w.Code != http.StatusServiceUnavailable || rec.Status != "not ready" || len(rec.Failed) != 1 || rec.Failed[0] != "dnn2" {
+		t.Fatalf("wrong readiness of server with failed self-tests: %d %s", w.Code, w.Body.String())
+	}
+
+	// model passes self-tests within tolerance of its golden set
+	golden.Tests = golden.Tests[:1]
+	golden.Tests[0].Tolerance = 0
+	writeGoldenSet(t, "dnn2", "checks.json", golden)
+	runSelfTest("dnn2")
+	w = httptest.NewRecorder()
+	ReadyHandler(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("server is not ready: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestSelfTestAccounting checks that self-tests are not counted as model
+// requests
+func TestSelfTestAccounting(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	t.Cleanup(func() {
+		_selfTests.remove("dnn")
+		_faults.remove("")
+		initSLOs(nil)
+		removeBreaker("dnn")
+	})
+	writeGoldenSet(t, "dnn", "golden.json", GoldenSet{Tests: []GoldenTest{goldenTest(testOutputs)}})
+	initSLOs([]SLOConfig{{Model: "dnn", ErrorTarget: 0.5}})
+	_config.FaultInjection = true
+	injectFault(t, Fault{Type: faultError, Model: "dnn"})
+	_config.BreakerThreshold = 1
+	breakerFailure("dnn", errors.New("failure"))
+	modelUsageLock.Lock()
+	delete(modelUsage, "dnn")
+	modelUsageLock.Unlock()
+
+	// self-test reaches the model despite injected fault and open breaker
+	if res := selfTest("dnn"); res == nil || !res.Passed {
+		t.Fatalf("wrong self-test result %+v", res)
+	}
+	if breakers := openBreakers(); len(breakers) != 1 || breakers[0].Model != "dnn" {
+		t.Errorf("self-test changed breaker of the model %+v", breakers)
+	}
+	if reports := sloReports(); reports[0].Requests != 0 {
+		t.Errorf("self-test is counted by SLO %+v", reports[0])
+	}
+	modelUsageLock.Lock()
+	_, touched := modelUsage["dnn"]
+	modelUsageLock.Unlock()
+	if touched {
+		t.Error("self-test is counted as model usage")
+	}
+	if _, err := makePredictions(testRow("dnn")); err == nil {
+		t.Error("requests of the model should fail")
+	}
+}
@@ -57,20 +57,74 @@ func handlers() *mux.Router {
 	router := mux.NewRouter()
 
 	// visible routes
-	router.HandleFunc(basePath("/delete"), DeleteHandler).Methods("DELETE")
-	router.HandleFunc(basePath("/delete/{model:[a-zA-Z0-9_]+}"), DeleteHandler).Methods("DELETE")
-	router.HandleFunc(basePath("/upload"), UploadHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/json"), PredictHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/proto"), PredictProtobufHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/image"), ImageHandler).Methods("POST")
-	router.HandleFunc(basePath("/json"), PredictHandler).Methods("POST")
-	router.HandleFunc(basePath("/proto"), PredictProtobufHandler).Methods("POST")
-	router.HandleFunc(basePath("/image"), ImageHandler).Methods("POST")
-	router.HandleFunc(basePath("/params"), ParamsHandler).Methods("POST")
-	router.HandleFunc(basePath("/params/{model:[a-zA-Z0-9_]+}"), ParamsHandler).Methods("GET")
+	router.HandleFunc(basePath("/delete"), mutating(DeleteHandler)).Methods("DELETE")
+	router.HandleFunc(basePath("/delete/{model:[a-zA-Z0-9_]+}"), mutating(DeleteHandler)).Methods("DELETE")
+	router.HandleFunc(basePath("/upload"), mutating(UploadHandler)).Methods("POST")
+	router.HandleFunc(basePath("/upload/sessions"), mutating(UploadSessionCreateHandler)).Methods("POST")
+	router.HandleFunc(basePath("/upload/sessions/{id:[a-f0-9]+}"), mutating(UploadSessionHandler)).Methods("GET", "PATCH", "DELETE")
+	router.HandleFunc(basePath("/upload/sessions/{id:[a-f0-9]+}/complete"), mutating(UploadSessionCompleteHandler)).Methods("POST")
+	router.HandleFunc(basePath("/predict/json"), drainable(eventStreamed(deduplicated(PredictHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/predict/proto"), drainable(deduplicated(PredictProtobufHandler))).Methods("POST")
+	router.HandleFunc(basePath("/predict/image"), drainable(eventStreamed(deduplicated(ImageHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/predict/batch"), drainable(eventStreamed(deduplicated(BatchHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/predict/root"), drainable(RootHandler)).Methods("POST")
+	router.HandleFunc(basePath("/predict/multi"), drainable(eventStreamed(deduplicated(MultiPredictHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/predict/video"), drainable(eventStreamed(VideoHandler))).Methods("POST")
+	router.HandleFunc(basePath("/predict/audio"), drainable(eventStreamed(AudioHandler))).Methods("POST")
+	router.HandleFunc(basePath("/predict/stateful"), drainable(StatefulHandler)).Methods("POST")
+	router.HandleFunc(basePath("/predict/stateful/{token:[a-f0-9]+}"), StatefulDeleteHandler).Methods("DELETE")
+	router.HandleFunc(basePath("/predict/pipeline/{name:[a-zA-Z0-9_-]+}"), drainable(eventStreamed(deduplicated(PipelineHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/tensor"), drainable(eventStreamed(deduplicated(TensorHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/validate/{model:[a-zA-Z0-9_-]+}"), ValidateHandler).Methods("POST")
+	router.HandleFunc(basePath("/compare"), drainable(CompareHandler)).Methods("POST")
+	router.HandleFunc(basePath("/calibration/{model:[a-zA-Z0-9_-]+}"), drainable(CalibrationHandler)).Methods("POST")
+	router.HandleFunc(basePath("/roc/{model:[a-zA-Z0-9_-]+}"), drainable(ROCHandler)).Methods("POST")
+	router.HandleFunc(basePath("/jobs"), drainable(JobSubmitHandler)).Methods("POST")
+	router.HandleFunc(basePath("/jobs"), JobsHandler).Methods("GET")
+	router.HandleFunc(basePath("/jobs/{id:[a-f0-9]+}"), JobHandler).Methods("GET", "DELETE")
+	router.HandleFunc(basePath("/jobs/{id:[a-f0-9]+}/results"), JobResultsHandler).Methods("GET")
+	router.HandleFunc(basePath("/json"), drainable(eventStreamed(deduplicated(PredictHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/proto"), drainable(deduplicated(PredictProtobufHandler))).Methods("POST")
+	router.HandleFunc(basePath("/image"), drainable(eventStreamed(deduplicated(ImageHandler)))).Methods("POST")
+	router.HandleFunc(basePath("/params"), mutating(ParamsHandler)).Methods("POST")
+	router.HandleFunc(basePath("/params/{model:[a-zA-Z0-9_-]+}"), ParamsHandler).Methods("GET")
 	router.HandleFunc(basePath("/data"), DataHandler).Methods("GET")
 	router.HandleFunc(basePath("/models"), ModelsHandler).Methods("GET")
+	router.HandleFunc(basePath("/models/import"), mutating(ImportHandler)).Methods("POST")
+	router.HandleFunc(basePath("/models/{name:[a-zA-Z0-9_-]+}"), ModelHandler).Methods("GET")
+	router.HandleFunc(basePath("/models/{name:[a-zA-Z0-9_-]+}/versions"), VersionsHandler).Methods("GET")
+	router.HandleFunc(basePath("/models/{name:[a-zA-Z0-9_-]+}/schema"), SchemaHandler).Methods("GET")
+	router.HandleFunc(basePath("/models/{name:[a-zA-Z0-9_-]+}/rollback"), mutating(RollbackHandler)).Methods("POST")
+	router.HandleFunc(basePath("/models/{name:[a-zA-Z0-9_-]+}/download"), DownloadHandler).Methods("GET")
 	router.HandleFunc(basePath("/status"), StatusHandler).Methods("GET")
+	router.HandleFunc(basePath("/metrics"), MetricsHandler).Methods("GET")
+	router.HandleFunc(basePath("/events"), LiveEventsHandler).Methods("GET")
+	router.HandleFunc(basePath("/ready"), ReadyHandler).Methods("GET")
+	router.HandleFunc(basePath("/aliases"), AliasesHandler).Methods("GET")
+	router.HandleFunc(basePath("/pipelines"), PipelinesHandler).Methods("GET")
+	router.HandleFunc(basePath("/analytics"), AnalyticsHandler).Methods("GET")
+	router.HandleFunc(basePath("/signing/keys"), SigningKeysHandler).Methods("GET")
+
+	// admin routes
+	router.HandleFunc(basePath("/admin/promote"), mutating(PromoteHandler)).Methods("POST")
+	router.HandleFunc(basePath("/admin/demote"), mutating(DemoteHandler)).Methods("POST")
+	router.HandleFunc(basePath("/admin/models/{name:[a-zA-Z0-9_-]+}/versions/{version}/pin"), mutating(PinHandler)).Methods("POST", "DELETE")
+	router.HandleFunc(basePath("/admin/disk"), DiskHandler).Methods("GET")
+	router.HandleFunc(basePath("/admin/readonly"), ReadOnlyHandler).Methods("GET", "POST")
+	router.HandleFunc(basePath("/admin/drain"), DrainHandler).Methods("GET", "POST", "DELETE")
+	router.HandleFunc(basePath("/admin/faults"), FaultsHandler).Methods("GET", "POST", "DELETE")
+	router.HandleFunc(basePath("/admin/faults/{id:[a-f0-9]+}"), FaultsHandler).Methods("DELETE")
+	router.HandleFunc(basePath("/admin/mlflow"), mutating(MLflowHandler)).Methods("POST")
+	router.HandleFunc(basePath("/admin/state"), mutating(StateHandler)).Methods("GET", "POST")
+	router.HandleFunc(basePath("/admin/backups"), BackupsHandler).Methods("GET", "POST")
+	router.HandleFunc(basePath("/admin/accounting"), AccountingHandler).Methods("GET")
+	router.HandleFunc(basePath("/admin/errors"), ErrorSamplesHandler).Methods("GET")
+	router.HandleFunc(basePath("/admin/errors/{model:[a-zA-Z0-9_-]+}"), ErrorSamplesHandler).Methods("GET", "DELETE")
+	router.HandleFunc(basePath("/admin/traces"), SlowTracesHandler).Methods("GET")
+	router.HandleFunc(basePath("/admin/traces/{model:[a-zA-Z0-9_-]+}"), SlowTracesHandler).Methods("GET", "DELETE")
+	router.HandleFunc(basePath("/login"), LoginHandler).Methods("GET")
+	router.HandleFunc(basePath("/logout"), LogoutHandler).Methods("GET", "POST")
+	router.HandleFunc(basePath("/oauth2/callback"), CallbackHandler).Methods("GET")
 	router.HandleFunc(basePath("/netron/"), NetronHandler).Methods("GET")
 	router.HandleFunc(basePath("/netron/{.*}"), NetronHandler).Methods("GET")
 	router.HandleFunc(basePath("/favicon.ico"), FaviconHandler).Methods("GET")
@@ -86,8 +140,24 @@ func handlers() *mux.Router {
 
 	// log all requests
 	router.Use(loggingMiddleware)
+	// redirect dashboard users to login page
+	router.Use(oidcMiddleware)
+	// authorize requests with configured policy
+	router.Use(policyMiddleware)
+	// account compute time of clients
+	router.Use(accountingMiddleware)
+	// capture prediction requests
+	router.Use(captureMiddleware)
+	// keep failing prediction requests
+	router.Use(errorSamplesMiddleware)
+	// inject faults of API endpoints
+	router.Use(faultMiddleware)
 	// use limiter middleware to slow down clients
 	router.Use(limitMiddleware)
+	// forward prediction requests to backends in proxy mode
+	router.Use(proxyMiddleware)
+	// sign responses of prediction endpoints
+	router.Use(signingMiddleware)
 
 	return router
 }
@@ -122,9 +192,14 @@ func server(config string) {
 		// log time, filename, and line number
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
+	// redact secrets of configuration in logs
+	log.SetOutput(redactWriter{w: log.Writer()})
+
+	// detect container resource limits
+	initLimits()
 
-	// create session options from given config TF proto file
-	_sessionOptions = readConfigProto(_config.ConfigProto) // default session options
+	// initialize TF library with session options from given config TF proto file
+	initTFLayer()
 	cacheLimit := _config.CacheLimit
 	if cacheLimit == 0 {
 		cacheLimit = 10 // default number of models to keep in cache
@@ -132,9 +207,140 @@ func server(config string) {
 	_cache = TFCache{Models: make(map[string]TFCacheEntry), Limit: cacheLimit}
 	VERBOSE = _config.Verbose
 
+	// setup read-only mode
+	setReadOnly(_config.ReadOnly)
+
+	// verify server dependencies
+	if !_config.SkipStartupChecks && !runStartupChecks(os.Stdout) {
+		log.Fatal("startup checks failed, see diagnostics above")
+	}
+
 	// initialize limiter
 	initLimiter(_config.LimiterPeriod)
 
+	// initialize event bus
+	initEventBus()
+
+	// setup output sinks of predictions
+	if err := initResultSinks(_config.ResultSinks); err != nil {
+		log.Fatal("invalid result sinks configuration: ", err)
+	}
+
+	// check free space of model area
+	checkDiskSpace()
+
+	// clean up leftovers of interrupted uploads
+	cleanStaging()
+
+	// setup model store of stateless mode
+	if err := initStore(); err != nil {
+		log.Fatal("unable to setup model store: ", err)
+	}
+
+	// open state store of aliases and job records
+	if err := initStateStore(); err != nil {
+		log.Fatal("unable to open state store: ", err)
+	}
+
+	// load model aliases
+	if err := _aliases.load(); err != nil {
+		log.Println("unable to load model aliases", err)
+	}
+	if sharedStateStore() {
+		go aliasesReloader()
+	}
+
+	// setup model pipelines
+	if err := initPipelines(_config.Pipelines); err != nil {
+		log.Fatal("invalid pipelines configuration: ", err)
+	}
+
+	// elect leader which runs cluster-wide background jobs
+	if err := initLeaderElection(); err != nil {
+		log.Fatal("unable to setup leader election: ", err)
+	}
+
+	// run model self-tests
+	go selfTestScheduler(_config.SelfTestInterval)
+
+	// run janitor of old model versions
+	go janitor(_config.JanitorInterval)
+
+	// run backups of model area
+	go backupScheduler()
+
+	// setup traffic capture
+	initCapture()
+
+	// setup response signing
+	initSigning()
+
+	// setup SLO tracking
+	initSLOs(_config.SLOs)
+	if len(_slos) > 0 {
+		interval := _config.SLOCheckInterval
+		if interval <= 0 {
+			interval = 60
+		}
+		go sloMonitor(time.Duration(interval) * time.Second)
+	}
+
+	// run memory watchdog
+	go memoryWatchdog()
+
+	// apportion compute time among clients
+	go accountingSampler(accountingInterval())
+
+	// save usage analytics of models
+	go analyticsSaver(time.Minute)
+
+	// close live serving statistics of every second
+	go liveStatsSampler()
+
+	// restore jobs of state store and run janitor of finished jobs
+	if err := _jobs.load(); err != nil {
+		log.Println("unable to load job records", err)
+	}
+	cleanJobs()
+	go jobsJanitor()
+
+	// import MLflow models
+	for _, m := range _config.MLflow {
+		go mlflowPoller(m)
+	}
+
+	// import models of bootstrap manifest
+	go importStartupManifest()
+
+	// setup backends of proxy mode
+	if err := initProxy(_config.ProxyBackends); err != nil {
+		log.Fatal("invalid proxy configuration: ", err)
+	}
+
+	// load plugins of custom input decoders
+	if err := initDecoders(_config.DecoderPlugins); err != nil {
+		log.Fatal(err)
+	}
+
+	// load result keys of streaming modes
+	if err := initResultKeys(); err != nil {
+		log.Fatal("unable to load result keys: ", err)
+	}
+
+	// setup dead-letter destination of streaming modes
+	if err := initDeadLetters(); err != nil {
+		log.Fatal("invalid dead-letter configuration: ", err)
+	}
+
+	// serve predictions via NATS
+	initNATSServing()
+
+	// score messages of MQTT topics
+	initMQTT()
+
+	// score records of Kafka topics
+	initKafkaConsumer()
+
 	// define our handlers
 	sdir := _config.StaticDir
 	if sdir == "" {
@@ -171,23 +377,27 @@ func server(config string) {
 
 	// start web server
 	addr := fmt.Sprintf(":%d", _config.Port)
-	_, e1 := os.Stat(_config.ServerCrt)
-	_, e2 := os.Stat(_config.ServerKey)
-	if e1 == nil && e2 == nil {
-		server := &http.Server{
-			Addr: addr,
-			TLSConfig: &tls.Config{
-				ClientAuth: tls.RequestClientCert,
-			},
+	cert, err := serverCertificate()
+	if err != nil {
+		log.Println("unable to load server certificate", err)
+	}
+	if cert != nil {
+		tlsConfig := &tls.Config{
+			ClientAuth:   tls.RequestClientCert,
+			Certificates: []tls.Certificate{*cert},
 		}
-		if _, err := os.Open(_config.ServerKey); err != nil {
-			log.Println("unable to open server key file", _config.ServerKey, err)
+		// client certificates identify users only if they are verified
+		cas, err := clientCAPool()
+		if err != nil {
+			log.Fatal("unable to load client CA certificates: ", err)
 		}
-		if _, err := os.Open(_config.ServerCrt); err != nil {
-			log.Println("unable to open server cert file", _config.ServerCrt, err)
+		if cas != nil {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			tlsConfig.ClientCAs = cas
 		}
+		server := &http.Server{Addr: addr, TLSConfig: tlsConfig}
 		log.Println("starting HTTPs server", addr)
-		err = server.ListenAndServeTLS(_config.ServerCrt, _config.ServerKey)
+		err = server.ListenAndServeTLS("", "")
 	} else {
 		log.Println("starting HTTP server", addr)
 		err = http.ListenAndServe(addr, nil)
@@ -0,0 +1,278 @@
+package main
+
+// sessions module provides per-model pools of TF sessions
+//
+// Operators may configure number of pre-created sessions for every model, e.g.
+// "sessionPoolSize": 2, "sessionPools": {"dnn": 8, "img": 1}
+// Sessions of the pool are handed out round-robin and every session serves
+// one request at a time, therefore heavy traffic to one model can use up to
+// N parallel sessions while it does not starve other models which have their
+// own pools. The TF 2.X saved models share single session and for them the
+// pool only limits number of concurrent requests. If pool size is zero the
+// server creates new session for every request.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionPool holds pre-created TF sessions of the model
+type SessionPool struct {
+	Model     string         // model name
+	Size      int            // number of sessions in the pool
+	graph     TFGraph        // model graph sessions are created for
+	config    []byte         // session config of the model, see presets module
+	cpus      []int          // CPU set of the model, see pinning module
+	sessions  chan TFSession // idle sessions
+	done      chan struct{}  // closed when pool is closed
+	closed    bool           // pool is closed and sessions should be released
+	mutex     sync.Mutex
+	busy      int64  // number of sessions in use
+	waiting   int64  // number of requests waiting for a session
+	requests  uint64 // total number of served requests
+	saturated uint64 // number of requests which waited for a session
+	waitTime  int64  // total wait time in nanoseconds
+}
+
+// SessionPoolStats represents saturation metrics of session pool
+type SessionPoolStats struct {
+	Model      string  `json:"model"`      // model name
+	Size       int     `json:"size"`       // number of sessions in the pool
+	Busy       int64   `json:"busy"`       // number of sessions in use
+	Waiting    int64   `json:"waiting"`    // number of requests waiting for a session
+	Requests   uint64  `json:"requests"`   // total number of served requests
+	Saturated  uint64  `json:"saturated"`  // number of requests which waited for a session
+	Saturation float64 `json:"saturation"` // fraction of busy sessions
+	AvgWait    float64 `json:"avgWait"`    // average wait time of saturated requests in ms
+}
+
+// global session pools
+var (
+	_sessionPools = make(map[string]*SessionPool)
+	sessionsLock  sync.Mutex
+)
+
+// helper function to return session pool size of given model
+func sessionPoolSize(model string) int {
+	if size, ok := _config.SessionPools[model]; ok {
+		return size
+	}
+	return _config.SessionPoolSize
+}
+
+// newSessionPool creates session pool for given model graph
+func newSessionPool(model string, graph TFGraph, size int) (*SessionPool, error) {
+	pool := &SessionPool{
+		Model:    model,
+		Size:     size,
+		graph:    graph,
+		sessions: make(chan TFSession, size),
+		done:     make(chan struct{}),
+	}
+	config, cpus, err := modelSessionConfig(model)
+	if err != nil {
+		return nil, err
+	}
+	pool.config, pool.cpus = config, cpus
+	for i := 0; i < size; i++ {
+		session, err := newPinnedSession(graph, config, cpus)
+		if err != nil {
+			pool.close()
+			return nil, err
+		}
+		pool.sessions <- session
+	}
+	return pool, nil
+}
+
+// acquire returns next idle session of the pool, it blocks if all
+// sessions of the pool are in use. If pool is closed (e.g. model was
+// reloaded) it returns new session which will be closed upon release.
+func (p *SessionPool) acquire() (TFSession, error) {
+	atomic.AddUint64(&p.requests, 1)
+	select {
+	case session := <-p.sessions:
+		atomic.AddInt64(&p.busy, 1)
+		return session, nil
+	default:
+	}
+	atomic.AddUint64(&p.saturated, 1)
+	atomic.AddInt64(&p.waiting, 1)
+	time0 := time.Now()
+	defer func() {
+		atomic.AddInt64(&p.waiting, -1)
+		atomic.AddInt64(&p.waitTime, int64(time.Since(time0)))
+		atomic.AddInt64(&p.busy, 1)
+	}()
+	select {
+	case session := <-p.sessions:
+		return session, nil
+	case <-p.done:
+		return newPinnedSession(p.graph, p.config, p.cpus)
+	}
+}
+
+// release returns session back to the pool
+func (p *SessionPool) release(session TFSession) {
+	atomic.AddInt64(&p.busy, -1)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		if session != nil {
+			session.Close()
+		}
+		return
+	}
+	p.sessions <- session
+}
+
+// close closes idle sessions of the pool, sessions in use are closed
+// when they are released
+func (p *SessionPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	for {
+		select {
+		case session := <-p.sessions:
+			if session != nil {
+				session.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// stats returns saturation metrics of the pool
+func (p *SessionPool) stats() SessionPoolStats {
+	stats := SessionPoolStats{
+		Model:     p.Model,
+		Size:      p.Size,
+		Busy:      atomic.LoadInt64(&p.busy),
+		Waiting:   atomic.LoadInt64(&p.waiting),
+		Requests:  atomic.LoadUint64(&p.requests),
+		Saturated: atomic.LoadUint64(&p.saturated),
+	}
+	if p.Size > 0 {
+		stats.Saturation = float64(stats.Busy) / float64(p.Size)
+	}
+	if stats.Saturated > 0 {
+		stats.AvgWait = float64(atomic.LoadInt64(&p.waitTime)) / float64(stats.Saturated) / 1e6
+	}
+	return stats
+}
+
+// getSessionPool returns session pool of given model, it returns nil if
+// model does not use session pool
+func getSessionPool(model string, graph TFGraph) (*SessionPool, error) {
+	size := sessionPoolSize(model)
+	if size <= 0 {
+		return nil, nil
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if pool, ok := _sessionPools[model]; ok {
+		if pool.graph == graph {
+			return pool, nil
+		}
+		// model graph has been reloaded
+		pool.close()
+		delete(_sessionPools, model)
+	}
+	pool, err := newSessionPool(model, graph, size)
+	if err != nil {
+		return nil, err
+	}
+	_sessionPools[model] = pool
+	return pool, nil
+}
+
+// removeSessionPool closes and removes session pool of given model
+func removeSessionPool(model string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if pool, ok := _sessionPools[model]; ok {
+		pool.close()
+		delete(_sessionPools, model)
+	}
+}
+
+// sessionPoolsStats returns saturation metrics of all session pools
+func sessionPoolsStats() []SessionPoolStats {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	var out []SessionPoolStats
+	for _, pool := range _sessionPools {
+		out = append(out, pool.stats())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
+
+// helper function to run given graph of the model and record its outcome
+// by circuit breaker of the model
+func runSession(model string, graph TFGraph, feeds map[string]TFTensor, fetches []string) ([]TFTensor, error) {
+	results, err := runGraph(model, graph, feeds, fetches)
+	if err == nil {
+		breakerSuccess(model)
+	} else if !errors.Is(err, errInvalidInput) {
+		// errors of client inputs are not model failures
+		breakerFailure(model, err)
+	}
+	return results, err
+}
+
+// helper function to run given graph of the model for given row, sessions
+// of self-test rows are not recorded by circuit breaker
+func runRowSession(row *Row, model string, graph TFGraph, feeds map[string]TFTensor, fetches []string) ([]TFTensor, error) {
+	if row.selfTest {
+		return runGraph(model, graph, feeds, fetches)
+	}
+	return runSession(model, graph, feeds, fetches)
+}
+
+// helper function to run given graph of the model either within session
+// of model's pool or within new session
+func runGraph(model string, graph TFGraph, feeds map[string]TFTensor, fetches []string) ([]TFTensor, error) {
+	feeds, err := withConstFeeds(model, feeds)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := getSessionPool(model, graph)
+	if err != nil {
+		return nil, err
+	}
+	var session TFSession
+	if pool != nil {
+		session, err = pool.acquire()
+		if err != nil {
+			pool.release(nil)
+			return nil, err
+		}
+		defer pool.release(session)
+	} else {
+		var config []byte
+		var cpus []int
+		if config, cpus, err = modelSessionConfig(model); err != nil {
+			return nil, err
+		}
+		session, err = newPinnedSession(graph, config, cpus)
+		if err != nil {
+			return nil, err
+		}
+		defer session.Close()
+	}
+	results, err := session.Run(feeds, fetches)
+	if err == nil && len(results) != len(fetches) {
+		err = fmt.Errorf("model %s produced %d outputs, expected %d", model, len(results), len(fetches))
+	}
+	return results, err
+}
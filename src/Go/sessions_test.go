@@ -0,0 +1,117 @@
+package main
+
+// tests of per-model session pools, they do not require TF C library
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// helper function to wait until given number of requests wait for session
+// of the pool
+func waitForSession(t *testing.T, pool *SessionPool, waiting int64) {
+	for i := 0; atomic.LoadInt64(&pool.waiting) != waiting; i++ {
+		if i > 500 {
+			t.Fatalf("%d requests wait for session, expected %d", atomic.LoadInt64(&pool.waiting), waiting)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSessionPool checks that saturated pool of one model blocks only
+// requests of this model
+func TestSessionPool(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.SessionPools = map[string]int{"dnn": 1, "dnn2": 2}
+	if pool, err := getSessionPool("img", &fakeGraph{}); pool != nil || err != nil {
+		t.Fatalf("model without pool size has session pool %+v: %v", pool, err)
+	}
+	pool, err := getSessionPool("dnn", &fakeGraph{})
+	if err != nil || pool.Size != 1 {
+		t.Fatalf("wrong session pool %+v: %v", pool, err)
+	}
+	session, _ := pool.acquire()
+
+	// second request of the model waits for session of the pool
+	acquired := make(chan TFSession)
+	go func() {
+		s, _ := pool.acquire()
+		acquired <- s
+	}()
+	waitForSession(t, pool, 1)
+
+	// other model has its own sessions
+	graph := &fakeGraph{}
+	other, err := getSessionPool("dnn2", graph)
+	if err != nil || other == pool || other.Size != 2 {
+		t.Fatalf("wrong session pool %+v: %v", other, err)
+	}
+	s1, _ := other.acquire()
+	s2, _ := other.acquire()
+	if stats := other.stats(); stats.Busy != 2 || stats.Saturated != 0 || stats.Saturation != 1 {
+		t.Fatalf("wrong stats of session pool %+v", stats)
+	}
+	other.release(s1)
+	other.release(s2)
+
+	pool.release(session)
+	select {
+	case s := <-acquired:
+		if s != session {
+			t.Fatal("waiting request received new session")
+		}
+		pool.release(s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("released session is not handed out to waiting request")
+	}
+	stats := pool.stats()
+	if stats.Requests != 2 || stats.Saturated != 1 || stats.Busy != 0 || stats.Waiting != 0 || stats.AvgWait <= 0 {
+		t.Fatalf("wrong stats of session pool %+v", stats)
+	}
+
+	// pool of the model is replaced when its graph is reloaded
+	if p, _ := getSessionPool("dnn2", graph); p != other {
+		t.Fatal("session pool is not reused")
+	}
+	if p, _ := getSessionPool("dnn2", &fakeGraph{}); p == other || !other.closed {
+		t.Fatal("session pool of old graph is used")
+	}
+	if stats := sessionPoolsStats(); len(stats) != 2 || stats[0].Model != "dnn" || stats[1].Model != "dnn2" {
+		t.Fatalf("wrong stats of session pools %+v", stats)
+	}
+}
+
+// TestSessionPoolClose checks that requests waiting for session of removed
+// pool are served by new sessions
+func TestSessionPoolClose(t *testing.T) {
+	setupFakeModels(t, 10, 1)
+	pool, err := getSessionPool("dnn", &fakeGraph{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _ := pool.acquire()
+	acquired := make(chan TFSession)
+	go func() {
+		s, _ := pool.acquire()
+		acquired <- s
+	}()
+	waitForSession(t, pool, 1)
+	removeSessionPool("dnn")
+	select {
+	case s := <-acquired:
+		if s == nil || s == session {
+			t.Fatalf("wrong session %v of removed pool", s)
+		}
+		pool.release(s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request waits for session of removed pool")
+	}
+	pool.release(session)
+	if stats := pool.stats(); stats.Busy != 0 || len(pool.sessions) != 0 {
+		t.Fatalf("sessions of removed pool are not released %+v", stats)
+	}
+	if stats := sessionPoolsStats(); len(stats) != 0 {
+		t.Fatalf("removed pool is kept %+v", stats)
+	}
+}
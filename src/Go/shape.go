@@ -0,0 +1,200 @@
+package main
+
+// shape module provides handling of output tensors of any rank
+//
+// Models do not always output [nrows, noutputs] matrices, e.g. regression
+// models may output scalars or vectors with single value per row, while
+// sequence and image models output rank-3 or rank-4 tensors. Outputs are
+// flattened (in row-major order) into rows, where the first dimension of
+// rank >= 2 tensors is the batch dimension, rank-1 outputs of batches
+// provide single value per row and scalars are single value outputs.
+// Shape of outputs of a single row is reported by Output-Shape header of
+// prediction responses, e.g. [4,5] for [nrows, 4, 5] outputs, [3] for
+// classifiers with 3 classes and [] for scalars, once the model produced
+// its first outputs.
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// output shapes of single row of every model
+var (
+	_outputShapes    = make(map[string][]int64)
+	outputShapesLock sync.RWMutex
+)
+
+// helper function to append flattened values of nested slices of given
+// shape to values
+func appendFlat(values []float32, rv reflect.Value, shape []int64) ([]float32, error) {
+	if len(shape) == 0 {
+		v, ok := numericValue(rv)
+		if !ok {
+			return nil, fmt.Errorf("non numeric value of %s type", rv.Type())
+		}
+		return append(values, v), nil
+	}
+	if int64(rv.Len()) != shape[0] {
+		return nil, fmt.Errorf("ragged tensor, dimension %d instead of %d", rv.Len(), shape[0])
+	}
+	var err error
+	for i := 0; i < rv.Len(); i++ {
+		if values, err = appendFlat(values, rv.Index(i), shape[1:]); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// helper function to flatten value of any rank into vector of floats, it
+// returns values and shape of the value
+func flattenValue(value interface{}) ([]float32, []int64, error) {
+	rv := reflect.ValueOf(value)
+	if !rv.IsValid() {
+		return nil, nil, fmt.Errorf("empty value")
+	}
+	// shape is defined by the first element of every dimension
+	shape := []int64{}
+	for t := rv; t.Kind() == reflect.Slice; t = t.Index(0) {
+		shape = append(shape, int64(t.Len()))
+		if t.Len() == 0 {
+			return []float32{}, shape, nil
+		}
+	}
+	values, err := appendFlat(nil, rv, shape)
+	return values, shape, err
+}
+
+// helper function to flatten tensor into vector of floats, it returns
+// values and shape of the tensor
+func flattenTensor(tensor TFTensor) ([]float32, []int64, error) {
+	values, shape, err := flattenValue(tensor.Value())
+	if err != nil {
+		return nil, nil, err
+	}
+	// tensors may keep values of any rank as flat vector
+	if tshape := tensor.Shape(); len(tshape) != len(shape) && tensorSize(tshape) == int64(len(values)) {
+		shape = tshape
+	}
+	return values, shape, nil
+}
+
+// helper function to calculate number of elements of tensor with given
+// shape, scalars have single element
+func tensorSize(shape []int64) int64 {
+	size := int64(1)
+	for _, d := range shape {
+		size *= d
+	}
+	return size
+}
+
+// helper function to split flat values of given shape into rows
+func splitRows(values []float32, shape []int64) [][]float32 {
+	if len(shape) < 2 {
+		return [][]float32{values}
+	}
+	rows := make([][]float32, shape[0])
+	if shape[0] == 0 {
+		return rows
+	}
+	size := len(values) / int(shape[0])
+	for i := range rows {
+		rows[i] = values[i*size : (i+1)*size]
+	}
+	return rows
+}
+
+// outputRows converts output tensor of the model into rows of outputs of
+// nrows input rows and records output shape of the model
+func outputRows(model string, tensor TFTensor, nrows int) ([][]float32, error) {
+	if tensor == nil {
+		return nil, fmt.Errorf("empty tensor")
+	}
+	if v, ok := tensor.Value().([][]float32); ok {
+		// fast path of common [nrows, noutputs] outputs
+		if len(v) > 0 {
+			recordOutputShape(model, []int64{int64(len(v[0]))})
+		}
+		return v, nil
+	}
+	values, shape, err := flattenTensor(tensor)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported output of %s model, type %T shape %v: %v", model, tensor.Value(), tensor.Shape(), err)
+	}
+	switch {
+	case len(shape) >= 2:
+		recordOutputShape(model, shape[1:])
+		return splitRows(values, shape), nil
+	case len(shape) == 1 && shape[0] == int64(nrows):
+		// single value per row
+		recordOutputShape(model, []int64{})
+		return splitRows(values, []int64{shape[0], 1}), nil
+	}
+	// scalar or vector of outputs of single row
+	recordOutputShape(model, shape)
+	return [][]float32{values}, nil
+}
+
+// outputRow converts output tensor of single row prediction into outputs
+func outputRow(model string, tensor TFTensor) ([]float32, error) {
+	rows, err := outputRows(model, tensor, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("model %s produced empty output", model)
+	}
+	return rows[0], nil
+}
+
+// helper function to record shape of single row outputs of the model
+func recordOutputShape(model string, shape []int64) {
+	outputShapesLock.RLock()
+	known, ok := _outputShapes[model]
+	outputShapesLock.RUnlock()
+	if ok && reflect.DeepEqual(known, shape) {
+		return
+	}
+	outputShapesLock.Lock()
+	_outputShapes[model] = append([]int64{}, shape...)
+	outputShapesLock.Unlock()
+}
+
+// helper function to return shape of single row outputs of the model
+func outputShape(model string) ([]int64, bool) {
+	outputShapesLock.RLock()
+	defer outputShapesLock.RUnlock()
+	shape, ok := _outputShapes[resolveModel(model)]
+	return shape, ok
+}
+
+// helper function to format shape, e.g. [4,5]
+func formatShape(shape []int64) string {
+	var dims []string
+	for _, d := range shape {
+		dims = append(dims, fmt.Sprintf("%d", d))
+	}
+	return "[" + strings.Join(dims, ",") + "]"
+}
+
+// setOutputShapeHeader reports shape of single row outputs of the model or
+// of its fallback model (see fallback module), default fallback outputs
+// don't have shape
+func setOutputShapeHeader(w http.ResponseWriter, model, fallback string) {
+	if fallback == "default" {
+		return
+	}
+	if fallback != "" {
+		model = fallback
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	if shape, ok := outputShape(model); ok {
+		w.Header().Set("Output-Shape", formatShape(shape))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+// tests of output tensors of any rank, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestOutputRows checks conversion of outputs of various ranks into rows
+func TestOutputRows(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		shape  []int64
+		nrows  int
+		rows   [][]float32
+		output string
+	}{
+		{"scalar", float32(0.5), []int64{}, 1, [][]float32{{0.5}}, "[]"},
+		{"single", []float32{0.5}, []int64{1}, 1, [][]float32{{0.5}}, "[]"},
+		{"vector", []float32{1, 2, 3}, []int64{3}, 1, [][]float32{{1, 2, 3}}, "[3]"},
+		{"batch", []float64{1, 2, 3}, []int64{3}, 3, [][]float32{{1}, {2}, {3}}, "[]"},
+		{"matrix", [][]int32{{1, 2}, {3, 4}}, []int64{2, 2}, 2, [][]float32{{1, 2}, {3, 4}}, "[2]"},
+		{"rank3", [][][]float32{{{1, 2}, {3, 4}, {5, 6}}}, []int64{1, 3, 2}, 1, [][]float32{{1, 2, 3, 4, 5, 6}}, "[3,2]"},
+		{"flat", []float32{1, 2, 3, 4}, []int64{2, 1, 2}, 2, [][]float32{{1, 2}, {3, 4}}, "[1,2]"},
+		{"empty", [][][]float32{}, []int64{0, 2, 2}, 0, [][]float32{}, "[]"},
+	}
+	for _, tt := range tests {
+		_outputShapes = make(map[string][]int64)
+		rows, err := outputRows(tt.name, &fakeTensor{value: tt.value, shape: tt.shape}, tt.nrows)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%s: wrong rows %v, expected %v", tt.name, rows, tt.rows)
+		}
+		if shape, ok := outputShape(tt.name); tt.name != "empty" && (!ok || formatShape(shape) != tt.output) {
+			t.Errorf("%s: wrong output shape %v, expected %s", tt.name, shape, tt.output)
+		}
+	}
+	if _, err := outputRow("empty", &fakeTensor{value: [][]float32{}, shape: []int64{0, 3}}); err == nil {
+		t.Error("empty output should be rejected")
+	}
+	if _, err := outputRows("ragged", &fakeTensor{value: [][][]float32{{{1, 2}}, {{3}}}, shape: []int64{2, 1, 2}}, 2); err == nil {
+		t.Error("ragged outputs should be rejected")
+	}
+	if _, err := outputRows("strings", &fakeTensor{value: []string{"a"}, shape: []int64{1}}, 1); err == nil {
+		t.Error("string outputs should be rejected")
+	}
+}
+
+// TestOutputShapeHeader checks reporting of output shape in responses
+func TestOutputShapeHeader(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	data, _ := json.Marshal(testRow("dnn"))
+	w := httptest.NewRecorder()
+	PredictHandler(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	if shape := w.Header().Get("Output-Shape"); shape != "[3]" {
+		t.Fatalf("wrong output shape %q", shape)
+	}
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(streamBatch(t, 2))))
+	if shape := w.Header().Get("Output-Shape"); w.Code != http.StatusOK || shape != "[3]" {
+		t.Fatalf("wrong batch response %d, output shape %q", w.Code, shape)
+	}
+}
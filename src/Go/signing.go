@@ -0,0 +1,283 @@
+package main
+
+// signing module provides signatures of prediction responses
+//
+// When "signingKeys" are configured responses of prediction endpoints (or
+// "signingEndpoints") are signed such that downstream systems can verify
+// they come from the server and were not modified by intermediaries, e.g.
+//
+//	"signingKeys": [{"id": "2024-02", "alg": "HS256", "key": "vault:secret/data/tfaas#hmac"},
+//	                {"id": "2024-01", "alg": "HS256", "key": "env:TFAAS_OLD_HMAC_KEY"}]
+//
+// The first key signs responses while other keys are kept for rotation, i.e.
+// they are listed by /signing/keys until clients stop using them. With "hmac"
+// format (default) responses carry header
+//
+//	X-TFaaS-Signature: t=<unix time>,kid=<key id>,alg=HS256,sig=<base64url>
+//
+// where sig is HMAC-SHA256 of "<t>.<body>". With "jws" format responses carry
+// X-TFaaS-JWS header with detached compact JWS (RFC 7515 appendix F) of the
+// body signed with HS256, ES256 (PEM EC P-256 key) or RS256 (PEM RSA key).
+// Public keys of ES256 and RS256 keys are published by /signing/keys in JWK
+// set format, HMAC keys are shared with clients out of band.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// response signing formats
+const (
+	signingHMAC = "hmac"
+	signingJWS  = "jws"
+)
+
+// SigningKey represents key of response signatures
+type SigningKey struct {
+	ID  string `json:"id"`  // key identifier
+	Alg string `json:"alg"` // signature algorithm: HS256 (default), ES256 or RS256
+	Key string `json:"key"` // hex/base64 HMAC key or PEM private key, may be secret reference
+}
+
+// signer represents parsed signing key
+type signer struct {
+	id   string
+	alg  string
+	hmac []byte
+	priv crypto.Signer
+}
+
+// global list of signers, the first signer signs responses
+var _signers []*signer
+
+// helper function to parse signing key
+func newSigner(k SigningKey) (*signer, error) {
+	value, err := resolveSecret(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	registerSecret(value)
+	s := &signer{id: k.ID, alg: k.Alg}
+	if s.alg == "" {
+		s.alg = "HS256"
+	}
+	switch s.alg {
+	case "HS256":
+		v := strings.TrimSpace(value)
+		if s.hmac, err = hex.DecodeString(v); err != nil {
+			if s.hmac, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return nil, errors.New("HMAC key should be hex or base64 encoded")
+			}
+		}
+		if len(s.hmac) < 32 {
+			return nil, fmt.Errorf("HMAC key has %d bytes, at least 32 bytes are required", len(s.hmac))
+		}
+		return s, nil
+	case "ES256", "RS256":
+		block, _ := pem.Decode([]byte(value))
+		if block == nil {
+			return nil, errors.New("private key should be PEM encoded")
+		}
+		var key interface{}
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			if s.alg != "ES256" || key.Curve != elliptic.P256() {
+				return nil, errors.New("ES256 requires EC P-256 key")
+			}
+			s.priv = key
+		case *rsa.PrivateKey:
+			if s.alg != "RS256" {
+				return nil, errors.New("RS256 requires RSA key")
+			}
+			s.priv = key
+		default:
+			return nil, fmt.Errorf("unsupported private key of %s algorithm", s.alg)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %s", s.alg)
+}
+
+// helper function to initialize response signing
+func initSigning() {
+	_signers = nil
+	for _, k := range _config.SigningKeys {
+		s, err := newSigner(k)
+		if err != nil {
+			log.Printf("unable to load signing key %s: %v", k.ID, err)
+			continue
+		}
+		_signers = append(_signers, s)
+	}
+	if len(_signers) > 0 {
+		log.Printf("sign responses with key %s (%s, %s format)", _signers[0].id, _signers[0].alg, signingFormat())
+	}
+}
+
+// helper function to return format of response signatures
+func signingFormat() string {
+	if _config.SigningFormat == signingJWS {
+		return signingJWS
+	}
+	return signingHMAC
+}
+
+// sign signs given data with the key
+func (s *signer) sign(data []byte) ([]byte, error) {
+	if s.hmac != nil {
+		mac := hmac.New(sha256.New, s.hmac)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+	digest := sha256.Sum256(data)
+	if key, ok := s.priv.(*ecdsa.PrivateKey); ok {
+		// JWS uses fixed size R || S representation of ECDSA signatures
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return s.priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// helper function to return signature header of response body
+func signatureHeader(body []byte, now time.Time) (string, string, error) {
+	s := _signers[0]
+	enc := base64.RawURLEncoding
+	if signingFormat() == signingJWS {
+		header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.id})
+		input := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+		sig, err := s.sign([]byte(input))
+		if err != nil {
+			return "", "", err
+		}
+		return "X-TFaaS-JWS", enc.EncodeToString(header) + ".." + enc.EncodeToString(sig), nil
+	}
+	if s.hmac == nil {
+		return "", "", fmt.Errorf("hmac format requires HS256 key, key %s is %s", s.id, s.alg)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig, _ := s.sign(append([]byte(ts+"."), body...))
+	return "X-TFaaS-Signature", fmt.Sprintf("t=%s,kid=%s,alg=%s,sig=%s", ts, s.id, s.alg, enc.EncodeToString(sig)), nil
+}
+
+// helper function to check if response of the request should be signed
+func signed(r *http.Request) bool {
+	if len(_signers) == 0 {
+		return false
+	}
+	if len(_config.SigningEndpoints) > 0 {
+		return InList(requestPath(r), _config.SigningEndpoints)
+	}
+	return requestAction(r) == actionPredict
+}
+
+// signingResponseWriter buffers response to sign it
+type signingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records response status
+func (w *signingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// Write buffers response body
+func (w *signingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// signingMiddleware signs responses of prediction endpoints
+func signingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !signed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &signingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		name, value, err := signatureHeader(sw.body.Bytes(), time.Now())
+		if err != nil {
+			log.Println("unable to sign response", err)
+		} else {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(sw.status)
+		w.Write(sw.body.Bytes())
+	})
+}
+
+// helper function to return JWK of public key of the signer
+func (s *signer) jwk() map[string]string {
+	enc := base64.RawURLEncoding
+	jwk := map[string]string{"kid": s.id, "alg": s.alg, "use": "sig"}
+	switch key := s.priv.(type) {
+	case *ecdsa.PrivateKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		jwk["kty"], jwk["crv"] = "EC", "P-256"
+		jwk["x"], jwk["y"] = enc.EncodeToString(x), enc.EncodeToString(y)
+	case *rsa.PrivateKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = enc.EncodeToString(key.N.Bytes())
+		jwk["e"] = enc.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	default:
+		// HMAC keys are secret, only their identifiers are published
+		jwk["kty"] = "oct"
+	}
+	return jwk
+}
+
+// SigningKeysHandler lists keys of response signatures in JWK set format
+func SigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+	for _, s := range _signers {
+		keys = append(keys, s.jwk())
+	}
+	responseJSON(w, map[string]interface{}{"keys": keys, "format": signingFormat()})
+}
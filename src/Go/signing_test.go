@@ -0,0 +1,128 @@
+package main
+
+// tests of response signing, they do not require TF C library
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// helper function to send prediction request and return its response
+func signedPrediction(t *testing.T, router http.Handler) *httptest.ResponseRecorder {
+	row, _ := json.Marshal(testRow("dnn"))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/json", bytes.NewReader(row)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	return rr
+}
+
+// TestSigningHMAC checks HMAC signatures of responses
+func TestSigningHMAC(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	key := strings.Repeat("0f", 32)
+	_config.SigningKeys = []SigningKey{{ID: "k2", Key: key}, {ID: "k1", Key: "env:TFAAS_TEST_MISSING"}}
+	initSigning()
+	t.Cleanup(func() { _signers = nil })
+	if len(_signers) != 1 {
+		t.Fatalf("unexpected signers %v", _signers)
+	}
+	initLimiter("1000-S")
+	router := handlers()
+	rr := signedPrediction(t, router)
+	header := rr.Header().Get("X-TFaaS-Signature")
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(header, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		fields[parts[0]] = parts[1]
+	}
+	raw, _ := hex.DecodeString(key)
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte(fields["t"] + "."))
+	mac.Write(rr.Body.Bytes())
+	if fields["kid"] != "k2" || fields["sig"] != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("invalid signature header %s", header)
+	}
+	// other endpoints are not signed
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/models", nil))
+	if rr.Header().Get("X-TFaaS-Signature") != "" {
+		t.Errorf("models catalog is signed")
+	}
+}
+
+// TestSigningJWS checks detached JWS signatures of responses and published keys
+func TestSigningJWS(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	os.Setenv("TFAAS_TEST_EC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})))
+	defer os.Unsetenv("TFAAS_TEST_EC_KEY")
+	_config.SigningFormat = signingJWS
+	_config.SigningKeys = []SigningKey{
+		{ID: "ec", Alg: "ES256", Key: "env:TFAAS_TEST_EC_KEY"},
+		{ID: "rsa", Alg: "RS256", Key: string(rsaPEM)},
+	}
+	initSigning()
+	t.Cleanup(func() { _signers = nil })
+	initLimiter("1000-S")
+	router := handlers()
+	rr := signedPrediction(t, router)
+	parts := strings.Split(rr.Header().Get("X-TFaaS-JWS"), ".")
+	if len(parts) != 3 || parts[1] != "" {
+		t.Fatalf("unexpected detached JWS %v", parts)
+	}
+
+	// verify signature with published key
+	rr2 := httptest.NewRecorder()
+	router.ServeHTTP(rr2, httptest.NewRequest("GET", "/signing/keys", nil))
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(rr2.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 2 {
+		t.Fatalf("unexpected signing keys %s", rr2.Body.String())
+	}
+	enc := base64.RawURLEncoding
+	x, _ := enc.DecodeString(jwks.Keys[0]["x"])
+	y, _ := enc.DecodeString(jwks.Keys[0]["y"])
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	sig, _ := enc.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + enc.EncodeToString(rr.Body.Bytes())))
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Errorf("invalid ES256 signature")
+	}
+	if jwks.Keys[1]["kty"] != "RSA" || jwks.Keys[1]["kid"] != "rsa" {
+		t.Errorf("unexpected RSA key %v", jwks.Keys[1])
+	}
+
+	// rotated RSA key signs responses after old key is removed
+	_config.SigningKeys = _config.SigningKeys[1:]
+	initSigning()
+	rr = signedPrediction(t, router)
+	parts = strings.Split(rr.Header().Get("X-TFaaS-JWS"), ".")
+	sig, _ = enc.DecodeString(parts[2])
+	digest = sha256.Sum256([]byte(parts[0] + "." + enc.EncodeToString(rr.Body.Bytes())))
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("invalid RS256 signature %v", err)
+	}
+}
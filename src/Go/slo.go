@@ -0,0 +1,201 @@
+package main
+
+// slo module provides latency and error SLO tracking
+//
+// Operators declare SLOs of API endpoints or models in server configuration:
+// "slos": [{"endpoint": "/json", "latency": 50, "latencyTarget": 0.99},
+//          {"model": "dnn", "latency": 20, "latencyTarget": 0.95, "errorTarget": 0.999}]
+// Every SLO is evaluated over rolling window (one hour by default) which is
+// split into sloBuckets buckets. The compliance, i.e. fraction of requests
+// faster than target latency and fraction of successful requests, is
+// reported in /status and /metrics. The burn rate is ratio of observed bad
+// requests to allowed ones (error budget), the SLO is burning when its burn
+// rate exceeds burnRate threshold and the server logs a warning about it.
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of buckets of SLO rolling window
+const sloBuckets = 60
+
+// default SLO rolling window in seconds
+const defaultSLOWindow = 3600
+
+// minimal number of requests in SLO window to raise alerts
+const minSLORequests = 10
+
+// SLOConfig represents SLO configuration of the endpoint or the model
+type SLOConfig struct {
+	Endpoint      string  `json:"endpoint"`      // API endpoint, e.g. /json
+	Model         string  `json:"model"`         // model name
+	Latency       float64 `json:"latency"`       // target latency in milliseconds
+	LatencyTarget float64 `json:"latencyTarget"` // fraction of requests faster than target latency, e.g. 0.99
+	ErrorTarget   float64 `json:"errorTarget"`   // fraction of successful requests, e.g. 0.999
+	Window        int     `json:"window"`        // rolling window in seconds, default one hour
+	BurnRate      float64 `json:"burnRate"`      // burn rate alert threshold, default 1
+}
+
+// SLOReport represents current compliance of SLO
+type SLOReport struct {
+	Endpoint          string  `json:"endpoint,omitempty"` // API endpoint
+	Model             string  `json:"model,omitempty"`    // model name
+	Requests          int64   `json:"requests"`           // number of requests in rolling window
+	Slow              int64   `json:"slow"`               // number of requests slower than target latency
+	Errors            int64   `json:"errors"`             // number of failed requests
+	LatencyCompliance float64 `json:"latencyCompliance"`  // fraction of requests faster than target latency
+	ErrorCompliance   float64 `json:"errorCompliance"`    // fraction of successful requests
+	LatencyBurnRate   float64 `json:"latencyBurnRate"`    // burn rate of latency error budget
+	ErrorBurnRate     float64 `json:"errorBurnRate"`      // burn rate of errors budget
+	Burning           bool    `json:"burning"`            // SLO burns faster than allowed
+}
+
+// sloBucket represents requests counters of time slot
+type sloBucket struct {
+	Slot   int64 // time slot of the bucket
+	Total  int64 // number of requests
+	Slow   int64 // number of slow requests
+	Errors int64 // number of failed requests
+}
+
+// SLOTracker tracks requests of single SLO
+type SLOTracker struct {
+	Config  SLOConfig
+	buckets [sloBuckets]sloBucket
+	lock    sync.Mutex
+}
+
+// global list of SLO trackers
+var _slos []*SLOTracker
+
+// helper function to initialize SLO trackers from given configuration
+func initSLOs(configs []SLOConfig) {
+	_slos = nil
+	for _, c := range configs {
+		if c.Endpoint == "" && c.Model == "" {
+			log.Println("WARNING: SLO should specify either endpoint or model", c)
+			continue
+		}
+		if c.Window <= 0 {
+			c.Window = defaultSLOWindow
+		}
+		if c.BurnRate <= 0 {
+			c.BurnRate = 1
+		}
+		_slos = append(_slos, &SLOTracker{Config: c})
+	}
+}
+
+// helper function to return width of the bucket in seconds
+func (t *SLOTracker) width() int64 {
+	if w := int64(t.Config.Window) / sloBuckets; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// observe records request with given duration and status
+func (t *SLOTracker) observe(now time.Time, duration time.Duration, failed bool) {
+	slot := now.Unix() / t.width()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := &t.buckets[slot%sloBuckets]
+	if b.Slot != slot {
+		*b = sloBucket{Slot: slot}
+	}
+	b.Total++
+	if failed {
+		b.Errors++
+	} else if t.Config.Latency > 0 && float64(duration)/float64(time.Millisecond) > t.Config.Latency {
+		b.Slow++
+	}
+}
+
+// helper function to calculate burn rate of error budget
+func burnRate(bad, total int64, target float64) float64 {
+	if target <= 0 || target >= 1 || total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - target)
+}
+
+// report returns SLO compliance over rolling window
+func (t *SLOTracker) report(now time.Time) SLOReport {
+	slot := now.Unix() / t.width()
+	rep := SLOReport{Endpoint: t.Config.Endpoint, Model: t.Config.Model, LatencyCompliance: 1, ErrorCompliance: 1}
+	t.lock.Lock()
+	for _, b := range t.buckets {
+		if slot-b.Slot < sloBuckets {
+			rep.Requests += b.Total
+			rep.Slow += b.Slow
+			rep.Errors += b.Errors
+		}
+	}
+	t.lock.Unlock()
+	if rep.Requests == 0 {
+		return rep
+	}
+	rep.LatencyCompliance = 1 - float64(rep.Slow)/float64(rep.Requests)
+	rep.ErrorCompliance = 1 - float64(rep.Errors)/float64(rep.Requests)
+	rep.LatencyBurnRate = burnRate(rep.Slow, rep.Requests, t.Config.LatencyTarget)
+	rep.ErrorBurnRate = burnRate(rep.Errors, rep.Requests, t.Config.ErrorTarget)
+	if rep.Requests >= minSLORequests {
+		rep.Burning = rep.LatencyBurnRate > t.Config.BurnRate || rep.ErrorBurnRate > t.Config.BurnRate
+	}
+	return rep
+}
+
+// helper function to record request of API endpoint, only server errors
+// count against SLO
+func observeEndpointSLO(path string, duration time.Duration, status int) {
+	if len(_slos) == 0 {
+		return
+	}
+	if base := strings.TrimRight(_config.Base, "/"); base != "" {
+		path = strings.TrimPrefix(path, base)
+	}
+	now := time.Now()
+	for _, t := range _slos {
+		if t.Config.Endpoint != "" && t.Config.Endpoint == path {
+			t.observe(now, duration, status >= 500)
+		}
+	}
+}
+
+// helper function to record inference of the model
+func observeModelSLO(model string, duration time.Duration, err error) {
+	if len(_slos) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, t := range _slos {
+		if t.Config.Endpoint == "" && t.Config.Model == model {
+			t.observe(now, duration, err != nil)
+		}
+	}
+}
+
+// helper function to return compliance reports of all SLOs
+func sloReports() []SLOReport {
+	var reports []SLOReport
+	now := time.Now()
+	for _, t := range _slos {
+		reports = append(reports, t.report(now))
+	}
+	return reports
+}
+
+// sloMonitor periodically logs warnings about burning SLOs
+func sloMonitor(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, rep := range sloReports() {
+			if rep.Burning {
+				log.Printf("WARNING: SLO is burning endpoint=%s model=%s requests=%d latencyCompliance=%.4f latencyBurnRate=%.2f errorCompliance=%.4f errorBurnRate=%.2f", rep.Endpoint, rep.Model, rep.Requests, rep.LatencyCompliance, rep.LatencyBurnRate, rep.ErrorCompliance, rep.ErrorBurnRate)
+			}
+		}
+	}
+}
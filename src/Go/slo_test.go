@@ -0,0 +1,77 @@
+package main
+
+// tests of SLO tracking, they do not require TF C library
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSLOTracker checks SLO compliance and burn rate calculations
+func TestSLOTracker(t *testing.T) {
+	tracker := &SLOTracker{Config: SLOConfig{Model: "dnn", Latency: 10, LatencyTarget: 0.9, ErrorTarget: 0.99, Window: 60, BurnRate: 1}}
+	now := time.Unix(1000000, 0)
+	for i := 0; i < 100; i++ {
+		duration := time.Millisecond
+		if i < 5 {
+			duration = 20 * time.Millisecond
+		}
+		tracker.observe(now, duration, i == 99)
+	}
+	rep := tracker.report(now)
+	if rep.Requests != 100 || rep.Slow != 5 || rep.Errors != 1 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if rep.LatencyCompliance != 0.95 || rep.ErrorCompliance != 0.99 {
+		t.Errorf("unexpected compliance %+v", rep)
+	}
+	if rep.LatencyBurnRate < 0.49 || rep.LatencyBurnRate > 0.51 || rep.ErrorBurnRate < 0.99 || rep.ErrorBurnRate > 1.01 || rep.Burning {
+		t.Errorf("unexpected burn rate %+v", rep)
+	}
+
+	// errors burn the budget faster than allowed
+	for i := 0; i < 10; i++ {
+		tracker.observe(now.Add(time.Second), time.Millisecond, true)
+	}
+	if rep := tracker.report(now.Add(time.Second)); !rep.Burning || rep.Errors != 11 {
+		t.Errorf("SLO should burn %+v", rep)
+	}
+
+	// old requests leave rolling window
+	if rep := tracker.report(now.Add(2 * time.Minute)); rep.Requests != 0 || rep.Burning || rep.LatencyCompliance != 1 {
+		t.Errorf("unexpected report of empty window %+v", rep)
+	}
+}
+
+// TestSLOObserve checks routing of observations to endpoint and model SLOs
+func TestSLOObserve(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	initSLOs([]SLOConfig{{Endpoint: "/json", Latency: 100}, {Model: "dnn", ErrorTarget: 0.5}, {Latency: 1}})
+	t.Cleanup(func() { initSLOs(nil) })
+	if len(_slos) != 2 || _slos[0].Config.Window != defaultSLOWindow {
+		t.Fatalf("unexpected SLOs %+v", _slos)
+	}
+	observeEndpointSLO("/json", time.Millisecond, http.StatusOK)
+	observeEndpointSLO("/json", time.Millisecond, http.StatusInternalServerError)
+	observeEndpointSLO("/json", time.Millisecond, http.StatusBadRequest)
+	observeEndpointSLO("/image", time.Millisecond, http.StatusOK)
+	observeModelSLO("dnn", time.Millisecond, errors.New("failure"))
+	observeModelSLO("dnn2", time.Millisecond, nil)
+	reports := sloReports()
+	if reports[0].Requests != 3 || reports[0].Errors != 1 || reports[1].Requests != 1 || reports[1].Errors != 1 {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, metric := range []string{`tfaas_slo_requests{endpoint="/json"} 3`, `tfaas_slo_error_compliance{model="dnn"} 0`, "tfaas_requests_total"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("metrics do not contain %s:\n%s", metric, body)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// slowtraces module provides sampling of slow request traces
+//
+// Tail latency of the model is hard to debug from aggregated metrics, while
+// tracing of every request is too expensive. With "slowTraces" option, e.g.
+// "slowTraces": 1, the server keeps full detail of the slowest 1% of row
+// predictions of every model: stage timings (preprocessing, inference with
+// model loading and TF session run, postprocessing), input size, shapes of
+// input and output tensors and TF error text. The latency threshold of slow
+// requests is recomputed from recent latencies of the model, and the last
+// "slowTracesSize" traces (default 20) of every model are kept in memory:
+// GET /admin/traces lists number of kept traces and thresholds of models,
+// GET /admin/traces/<model> returns traces of the model (newest first) and
+// DELETE /admin/traces/<model> removes them, e.g.
+// curl https://host/admin/traces/dnn
+// [{"time":1700000000,"model":"dnn","latency":48.1,"threshold":20.5,
+//   "stages":{"preprocess":0.1,"inference":47.8,"load":0.2,"session":47.5},
+//   "inputSize":42,"inputShape":[1,42],"outputShape":[1,2]}]
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// number of recent latencies of the model used to compute slow threshold
+const slowTraceWindow = 1000
+
+// number of observations between updates of slow threshold
+const slowTraceRefresh = 100
+
+// default number of kept traces of every model
+const defaultSlowTracesSize = 20
+
+// RequestTrace represents detail of slow request of the model
+type RequestTrace struct {
+	Time        int64              `json:"time"`                  // request time (unix seconds)
+	Model       string             `json:"model"`                 // model name
+	Latency     float64            `json:"latency"`               // request latency in milliseconds
+	Threshold   float64            `json:"threshold"`             // latency threshold of slow requests in milliseconds
+	Stages      map[string]float64 `json:"stages"`                // time of request stages in milliseconds
+	InputSize   int                `json:"inputSize"`             // number of input values
+	InputShape  []int64            `json:"inputShape,omitempty"`  // shape of input tensor
+	OutputShape []int64            `json:"outputShape,omitempty"` // shape of output tensor
+	Error       string             `json:"error,omitempty"`       // error of the request
+	start       time.Time
+}
+
+// slowTracker keeps recent latencies and slow traces of the model
+type slowTracker struct {
+	latencies []time.Duration // ring of recent latencies
+	next      int             // next position in ring of latencies
+	observed  int             // observations since last threshold update
+	threshold time.Duration   // latency threshold of slow requests, 0 if unknown
+	traces    []RequestTrace  // ring of slow traces
+	tnext     int             // next position in ring of traces
+}
+
+// global trackers of slow requests
+var (
+	_slowTrackers     = make(map[string]*slowTracker)
+	_slowTrackersLock sync.Mutex
+)
+
+// helper function to start trace of the request, it returns nil if slow
+// traces are disabled
+func startTrace(model string, row *Row) *RequestTrace {
+	if _config.SlowTraces <= 0 {
+		return nil
+	}
+	size := len(row.Values)
+	for _, step := range row.Sequence {
+		size += len(step)
+	}
+	return &RequestTrace{
+		Model:     model,
+		Stages:    make(map[string]float64),
+		InputSize: size,
+		start:     time.Now(),
+	}
+}
+
+// stage records time of request stage since given time, it is safe to call
+// it on nil trace
+func (t *RequestTrace) stage(name string, since time.Time) {
+	if t == nil {
+		return
+	}
+	t.Stages[name] += float64(time.Since(since)) / float64(time.Millisecond)
+}
+
+// shapes records shapes of input and output tensors, it is safe to call it
+// on nil trace
+func (t *RequestTrace) shapes(input, output TFTensor) {
+	if t == nil {
+		return
+	}
+	if input != nil {
+		t.InputShape = input.Shape()
+	}
+	if output != nil {
+		t.OutputShape = output.Shape()
+	}
+}
+
+// finish completes trace of the request and keeps it if the request is slow
+func (t *RequestTrace) finish(err error) {
+	if t == nil {
+		return
+	}
+	latency := time.Since(t.start)
+	if err != nil {
+		t.Error = err.Error()
+	}
+	_slowTrackersLock.Lock()
+	defer _slowTrackersLock.Unlock()
+	tracker, ok := _slowTrackers[t.Model]
+	if !ok {
+		tracker = &slowTracker{}
+		_slowTrackers[t.Model] = tracker
+	}
+	tracker.observe(latency)
+	if tracker.threshold == 0 || latency < tracker.threshold {
+		return
+	}
+	t.Time = t.start.Unix()
+	t.Latency = float64(latency) / float64(time.Millisecond)
+	t.Threshold = float64(tracker.threshold) / float64(time.Millisecond)
+	tracker.keep(*t)
+}
+
+// observe adds latency of the request and updates slow threshold of the model
+func (s *slowTracker) observe(latency time.Duration) {
+	if len(s.latencies) < slowTraceWindow {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.next] = latency
+		s.next = (s.next + 1) % slowTraceWindow
+	}
+	s.observed++
+	if s.observed < slowTraceRefresh {
+		return
+	}
+	s.observed = 0
+	sorted := append([]time.Duration{}, s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(len(sorted)) * (1 - _config.SlowTraces/100))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	s.threshold = sorted[idx]
+}
+
+// keep adds trace to the ring of slow traces, the oldest trace is replaced
+// when the ring is full
+func (s *slowTracker) keep(trace RequestTrace) {
+	size := _config.SlowTracesSize
+	if size <= 0 {
+		size = defaultSlowTracesSize
+	}
+	if len(s.traces) < size {
+		s.traces = append(s.traces, trace)
+		return
+	}
+	s.traces[s.tnext%len(s.traces)] = trace
+	s.tnext = (s.tnext + 1) % len(s.traces)
+}
+
+// list returns slow traces of the model, newest first
+func (s *slowTracker) list() []RequestTrace {
+	out := make([]RequestTrace, 0, len(s.traces))
+	for i := len(s.traces) - 1; i >= 0; i-- {
+		out = append(out, s.traces[(s.tnext+i)%len(s.traces)])
+	}
+	return out
+}
+
+// SlowTracesHandler provides or removes slow traces of models
+func SlowTracesHandler(w http.ResponseWriter, r *http.Request) {
+	model, ok := mux.Vars(r)["model"]
+	_slowTrackersLock.Lock()
+	defer _slowTrackersLock.Unlock()
+	if !ok {
+		summary := make(map[string]interface{})
+		for name, tracker := range _slowTrackers {
+			summary[name] = map[string]interface{}{
+				"traces":    len(tracker.traces),
+				"threshold": float64(tracker.threshold) / float64(time.Millisecond),
+			}
+		}
+		responseJSON(w, summary)
+		return
+	}
+	tracker, found := _slowTrackers[model]
+	if r.Method == "DELETE" {
+		if found {
+			tracker.traces, tracker.tnext = nil, 0
+		}
+		responseJSON(w, map[string]interface{}{"model": model, "removed": found})
+		return
+	}
+	if !found {
+		responseJSON(w, []RequestTrace{})
+		return
+	}
+	responseJSON(w, tracker.list())
+}
@@ -0,0 +1,82 @@
+package main
+
+// tests of slowtraces module, they do not require TF C library
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestSlowTraces checks traces of the slowest requests of the model
+func TestSlowTraces(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	orig := _config
+	t.Cleanup(func() {
+		_config = orig
+		_faults.remove("")
+		_slowTrackersLock.Lock()
+		_slowTrackers = make(map[string]*slowTracker)
+		_slowTrackersLock.Unlock()
+	})
+	_config.SlowTraces = 5
+	_config.SlowTracesSize = 3
+	_config.FaultInjection = true
+
+	for i := 0; i < slowTraceRefresh; i++ {
+		if _, err := makePredictions(testRow("dnn")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_slowTrackersLock.Lock()
+	threshold := _slowTrackers["dnn"].threshold
+	_slowTrackersLock.Unlock()
+	if threshold == 0 {
+		t.Fatal("slow threshold is not computed")
+	}
+
+	if _, code := injectFault(t, Fault{Type: faultLatency, Model: "dnn", Latency: 30}); code != 200 {
+		t.Fatalf("unable to inject latency, status %d", code)
+	}
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/traces/dnn", nil), map[string]string{"model": "dnn"})
+	w := httptest.NewRecorder()
+	SlowTracesHandler(w, req)
+	var traces []RequestTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &traces); err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) == 0 {
+		t.Fatal("slow request is not traced")
+	}
+	trace := traces[0]
+	if trace.Latency < 30 || trace.Stages["preprocess"] < 30 || trace.Threshold <= 0 {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+	if trace.InputSize != testNumKeys || len(trace.InputShape) != 2 || trace.InputShape[1] != testNumKeys || len(trace.OutputShape) == 0 {
+		t.Errorf("unexpected shapes of trace %+v", trace)
+	}
+	if _, ok := trace.Stages["session"]; !ok {
+		t.Errorf("session stage is not traced %+v", trace.Stages)
+	}
+}
+
+// TestSlowTracesRing checks wrap-around of slow traces of the model
+func TestSlowTracesRing(t *testing.T) {
+	orig := _config
+	t.Cleanup(func() { _config = orig })
+	_config.SlowTracesSize = 2
+	tracker := &slowTracker{}
+	for i := 1; i <= 3; i++ {
+		tracker.keep(RequestTrace{Latency: float64(i)})
+	}
+	traces := tracker.list()
+	if len(traces) != 2 || traces[0].Latency != 3 || traces[1].Latency != 2 {
+		t.Errorf("unexpected traces %+v", traces)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+// sparse module provides support of sparse inputs
+//
+// Very wide and mostly-zero feature vectors can be sent as parallel arrays
+// of indices and values together with dense dimension, e.g.
+// {"model": "dnn", "dim": 10000, "indices": [3, 512], "values": [1.5, 0.2]}
+// Batches use flat (row-major) indices into the batch of given shape, e.g.
+// {"model": "dnn", "shape": [2, 10000], "indices": [3, 10512], "values": [1.5, 0.2]}
+// The server densifies inputs before building TF tensors.
+
+import (
+	"fmt"
+)
+
+// maximum number of elements of densified input, it protects the server
+// from allocation of huge tensors for small requests
+const maxDenseSize = 1 << 24
+
+// helper function to convert sparse indices and values into dense vector
+// of given size
+func densify(indices []int64, values []float32, size int64) ([]float32, error) {
+	if len(indices) != len(values) {
+		return nil, fmt.Errorf("number of indices %d does not match number of values %d", len(indices), len(values))
+	}
+	if size <= 0 || size > maxDenseSize {
+		return nil, fmt.Errorf("invalid dense dimension %d", size)
+	}
+	dense := make([]float32, size)
+	seen := make(map[int64]bool, len(indices))
+	for i, idx := range indices {
+		if idx < 0 || idx >= size {
+			return nil, fmt.Errorf("index %d is out of range [0, %d)", idx, size)
+		}
+		if seen[idx] {
+			return nil, fmt.Errorf("duplicate index %d", idx)
+		}
+		seen[idx] = true
+		dense[idx] = values[i]
+	}
+	return dense, nil
+}
+
+// helper function to check if given row is sparse
+func (r *Row) isSparse() bool {
+	return len(r.Indices) > 0 || r.Dim > 0
+}
+
+// helper function to convert sparse row into dense one
+func densifyRow(row *Row) (*Row, error) {
+	if len(row.Keys) > 0 {
+		return nil, fmt.Errorf("sparse row should not provide keys")
+	}
+	values, err := densify(row.Indices, row.Values, row.Dim)
+	if err != nil {
+		return nil, err
+	}
+	r := *row
+	r.Values = values
+	r.Indices = nil
+	r.Dim = 0
+	return &r, nil
+}
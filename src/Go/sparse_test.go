@@ -0,0 +1,70 @@
+package main
+
+// tests of sparse inputs, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestDensify checks conversion of sparse inputs into dense vectors
+func TestDensify(t *testing.T) {
+	dense, err := densify([]int64{1, 4}, []float32{0.5, 2}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dense, []float32{0, 0.5, 0, 0, 2}) {
+		t.Errorf("wrong dense vector %v", dense)
+	}
+	tests := []struct {
+		indices []int64
+		values  []float32
+		size    int64
+	}{
+		{[]int64{1}, []float32{1, 2}, 5},    // length mismatch
+		{[]int64{5}, []float32{1}, 5},       // out of range
+		{[]int64{-1}, []float32{1}, 5},      // negative index
+		{[]int64{1, 1}, []float32{1, 2}, 5}, // duplicate index
+		{[]int64{1}, []float32{1}, 0},       // missing dimension
+		{[]int64{1}, []float32{1}, 1 << 40}, // huge dimension
+	}
+	for _, test := range tests {
+		if _, err := densify(test.indices, test.values, test.size); err == nil {
+			t.Errorf("invalid sparse input %+v should be rejected", test)
+		}
+	}
+}
+
+// TestFakeSparsePredictions checks predictions for sparse rows and batches
+func TestFakeSparsePredictions(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	row := &Row{Model: "dnn", Indices: []int64{0, 3}, Values: []float32{1, 2}, Dim: testNumKeys}
+	probs, err := makePredictions(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	row.Keys = []string{"a", "b"}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("sparse row with keys should be rejected")
+	}
+
+	batch := BatchRow{Model: "dnn", Indices: []int64{1, 6}, Values: []float32{1, 2}, Shape: []int64{2, testNumKeys}}
+	data, _ := json.Marshal(batch)
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	batch.Indices = []int64{1, 8}
+	data, _ = json.Marshal(batch)
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for out of range index", w.Code)
+	}
+}
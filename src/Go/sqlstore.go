@@ -0,0 +1,185 @@
+package main
+
+// sqlstore module provides SQL backends of state store
+//
+// Replicas of multi-replica deployments may share mutable server state
+// (aliases and job records, see statestore module) via SQLite or Postgres
+// database instead of embedded store, e.g.
+// "stateStore": "sqlite:///shared/tfaas/state.sqlite"
+// "stateStore": "postgres://tfaas:password@db:5432/tfaas?sslmode=require"
+// The state lives in tfaas_state table (bucket, name, value) which is
+// created on startup. Database drivers are not part of default build, the
+// server should be built with sqlite or postgres tag, see make build_sqlite
+// and make build_postgres. Replicas reload aliases of shared database every
+// minute, and every replica restores (and fails on restart) only its own
+// jobs since job files are kept in local jobs area of the replica. Model
+// catalog and keys are not part of shared state, replicas share models via
+// model store and keys via their configuration.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// interval of reloading aliases of shared state store
+const sharedAliasesInterval = time.Minute
+
+// SQLStore represents state store in SQL database
+type SQLStore struct {
+	Driver   string // database/sql driver name
+	db       *sql.DB
+	numbered bool // database uses numbered placeholders ($1, $2, ...)
+}
+
+// helper function to open state store of given location, it is embedded
+// key-value store unless location is SQLite or Postgres URL
+func openStateStore(location string) (StateStore, error) {
+	switch {
+	case strings.HasPrefix(location, "sqlite://"):
+		return openSQLStore("sqlite", strings.TrimPrefix(location, "sqlite://"), "BLOB", false)
+	case strings.HasPrefix(location, "postgres://"), strings.HasPrefix(location, "postgresql://"):
+		return openSQLStore("postgres", location, "BYTEA", true)
+	}
+	return openKVStore(location)
+}
+
+// openSQLStore opens state store in SQL database and creates its table
+func openSQLStore(driver, dsn, blob string, numbered bool) (*SQLStore, error) {
+	if !InList(driver, sql.Drivers()) {
+		return nil, fmt.Errorf("%s driver is not part of the server, please build it with %s tag", driver, driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLStore{Driver: driver, db: db, numbered: numbered}
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS tfaas_state (bucket VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL, value %s, PRIMARY KEY (bucket, name))", blob)
+	if _, err := db.Exec(stmt); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// helper function to rewrite ? placeholders of the query for the database
+func (s *SQLStore) query(q string) string {
+	if !s.numbered {
+		return q
+	}
+	var out strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&out, "$%d", n)
+			continue
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// sqlQuerier represents database or transaction which runs queries
+type sqlQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// helper function to read value of the key
+func (s *SQLStore) get(q sqlQuerier, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := q.QueryRow(s.query("SELECT value FROM tfaas_state WHERE bucket = ? AND name = ?"), bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Get implements StateStore interface
+func (s *SQLStore) Get(bucket, key string) ([]byte, error) {
+	return s.get(s.db, bucket, key)
+}
+
+// List implements StateStore interface
+func (s *SQLStore) List(bucket string) (map[string][]byte, error) {
+	rows, err := s.db.Query(s.query("SELECT name, value FROM tfaas_state WHERE bucket = ?"), bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		out[key] = value
+	}
+	return out, rows.Err()
+}
+
+// sqlTx represents update transaction of SQL store
+type sqlTx struct {
+	store *SQLStore
+	tx    *sql.Tx
+}
+
+// Get implements StateTx interface
+func (t *sqlTx) Get(bucket, key string) ([]byte, error) {
+	return t.store.get(t.tx, bucket, key)
+}
+
+// Put implements StateTx interface
+func (t *sqlTx) Put(bucket, key string, value []byte) error {
+	if bucket == "" || key == "" {
+		return errors.New("empty bucket or key")
+	}
+	stmt := "INSERT INTO tfaas_state (bucket, name, value) VALUES (?, ?, ?) ON CONFLICT (bucket, name) DO UPDATE SET value = excluded.value"
+	_, err := t.tx.Exec(t.store.query(stmt), bucket, key, value)
+	return err
+}
+
+// Delete implements StateTx interface
+func (t *sqlTx) Delete(bucket, key string) error {
+	_, err := t.tx.Exec(t.store.query("DELETE FROM tfaas_state WHERE bucket = ? AND name = ?"), bucket, key)
+	return err
+}
+
+// Update implements StateStore interface
+func (s *SQLStore) Update(fn func(tx StateTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqlTx{store: s, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close implements StateStore interface
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// helper function to check if state store is shared by replicas
+func sharedStateStore() bool {
+	_, ok := _stateStore.(*SQLStore)
+	return ok
+}
+
+// aliasesReloader periodically reloads aliases of shared state store which
+// may be changed by other replicas
+func aliasesReloader() {
+	for {
+		time.Sleep(sharedAliasesInterval)
+		if err := _aliases.load(); err != nil {
+			log.Println("unable to reload model aliases", err)
+		}
+	}
+}
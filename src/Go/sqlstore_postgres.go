@@ -0,0 +1,11 @@
+//go:build postgres
+
+package main
+
+// sqlstore_postgres module links Postgres driver of state store, see
+// sqlstore module
+
+import (
+	// registers postgres driver of database/sql
+	_ "github.com/lib/pq"
+)
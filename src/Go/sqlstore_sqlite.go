@@ -0,0 +1,11 @@
+//go:build sqlite
+
+package main
+
+// sqlstore_sqlite module links SQLite driver of state store, see sqlstore
+// module
+
+import (
+	// registers sqlite driver of database/sql
+	_ "modernc.org/sqlite"
+)
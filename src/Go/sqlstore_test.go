@@ -0,0 +1,245 @@
+package main
+
+// tests of SQL state store, they do not require TF C library
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDriver represents in-memory database which understands queries of
+// SQL state store
+type fakeSQLDriver struct {
+	data    map[string][]byte // values by bucket and name
+	queries []string          // executed queries
+	lock    sync.Mutex
+}
+
+// fakeSQLConn represents connection of fake database
+type fakeSQLConn struct {
+	driver  *fakeSQLDriver
+	pending map[string][]byte // data of running transaction
+}
+
+// fakeSQLStmt represents statement of fake database
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+// fakeSQLRows represents rows of fake query
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// global fake database
+var _fakeSQL = &fakeSQLDriver{data: make(map[string][]byte)}
+
+func init() {
+	sql.Register("tfaas-test", _fakeSQL)
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) { return &fakeSQLConn{driver: d}, nil }
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{conn: c, query: query}, nil
+}
+func (c *fakeSQLConn) Close() error { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.driver.lock.Lock()
+	defer c.driver.lock.Unlock()
+	c.pending = make(map[string][]byte)
+	for k, v := range c.driver.data {
+		c.pending[k] = v
+	}
+	return c, nil
+}
+func (c *fakeSQLConn) Commit() error {
+	c.driver.lock.Lock()
+	defer c.driver.lock.Unlock()
+	c.driver.data, c.pending = c.pending, nil
+	return nil
+}
+func (c *fakeSQLConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, err := s.Query(args)
+	return driver.RowsAffected(1), err
+}
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.conn.driver
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.queries = append(d.queries, s.query)
+	data := d.data
+	if s.conn.pending != nil {
+		data = s.conn.pending
+	}
+	key := func() string { return args[0].(string) + "/" + args[1].(string) }
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		return &fakeSQLRows{}, nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		data[key()] = args[2].([]byte)
+		return &fakeSQLRows{}, nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		delete(data, key())
+		return &fakeSQLRows{}, nil
+	case strings.HasPrefix(s.query, "SELECT value"):
+		rows := &fakeSQLRows{columns: []string{"value"}}
+		if v, ok := data[key()]; ok {
+			rows.rows = append(rows.rows, []driver.Value{v})
+		}
+		return rows, nil
+	case strings.HasPrefix(s.query, "SELECT name, value"):
+		rows := &fakeSQLRows{columns: []string{"name", "value"}}
+		for k, v := range data {
+			if parts := strings.SplitN(k, "/", 2); parts[0] == args[0].(string) {
+				rows.rows = append(rows.rows, []driver.Value{parts[1], v})
+			}
+		}
+		return rows, nil
+	}
+	return nil, errors.New("unsupported query " + s.query)
+}
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestSQLStore checks state store in SQL database
+func TestSQLStore(t *testing.T) {
+	_config.StateStore = "sqlite://" + filepath.Join(t.TempDir(), "state.sqlite")
+	_stateStore = nil
+	t.Cleanup(func() { _stateStore = nil })
+	err := initStateStore()
+	if InList("sqlite", sql.Drivers()) {
+		// server is built with sqlite tag
+		if err != nil {
+			t.Fatalf("unable to open SQLite state store: %v", err)
+		}
+		_stateStore.Update(func(tx StateTx) error { return tx.Put("b", "k", []byte("v")) })
+		if v, err := _stateStore.Get("b", "k"); string(v) != "v" {
+			t.Errorf("wrong value of SQLite state store: %s %v", v, err)
+		}
+	} else if err == nil || !strings.Contains(err.Error(), "sqlite tag") {
+		t.Fatalf("missing sqlite driver is not reported: %v", err)
+	}
+
+	store, err := openSQLStore("tfaas-test", "", "BYTEA", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx StateTx) error {
+		tx.Put("b", "k1", []byte("v1"))
+		tx.Put("b", "k2", []byte("v2"))
+		if v, _ := tx.Get("b", "k2"); string(v) != "v2" {
+			t.Errorf("transaction does not see its writes: %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx StateTx) error {
+		tx.Delete("b", "k1")
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("error of the transaction is not returned")
+	}
+	if v, _ := store.Get("b", "k1"); string(v) != "v1" {
+		t.Errorf("aborted transaction is applied: %s", v)
+	}
+	if v, err := store.Get("b", "unknown"); v != nil || err != nil {
+		t.Errorf("wrong value of unknown key %v %v", v, err)
+	}
+	if records, _ := store.List("b"); len(records) != 2 || string(records["k2"]) != "v2" {
+		t.Errorf("wrong records %v", records)
+	}
+	_fakeSQL.lock.Lock()
+	if !strings.Contains(strings.Join(_fakeSQL.queries, ";"), "VALUES ($1, $2, $3)") {
+		t.Errorf("wrong placeholders of queries %v", _fakeSQL.queries)
+	}
+	_fakeSQL.lock.Unlock()
+}
+
+// TestSQLStoreShared checks aliases and jobs of replicas sharing SQL store
+func TestSQLStoreShared(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.JobsDir = t.TempDir()
+	store, err := openSQLStore("tfaas-test", "", "BLOB", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_stateStore = store
+	defer func() { _stateStore = nil }()
+	if !sharedStateStore() {
+		t.Fatal("SQL store is not shared")
+	}
+
+	// alias promoted by other replica is not overwritten
+	if err := _aliases.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := _aliases.promote("dnn-prod", "dnn"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(Alias{Name: "dnn-dev", Model: "dnn2"})
+	store.Update(func(tx StateTx) error { return tx.Put(aliasesBucket, "dnn-dev", data) })
+	if _, err := _aliases.promote("dnn-prod", "dnn2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := _aliases.load(); err != nil {
+		t.Fatal(err)
+	}
+	if resolveModel("dnn-dev") != "dnn2" || resolveModel("dnn-prod") != "dnn2" {
+		t.Errorf("wrong shared aliases %+v", _aliases.list())
+	}
+
+	// jobs of other replicas are not restored
+	host, _ := os.Hostname()
+	_jobs = JobManager{Jobs: make(map[string]*Job)}
+	err = store.Update(func(tx StateTx) error {
+		for id, h := range map[string]string{"own": host, "other": host + "-other"} {
+			data, _ := json.Marshal(jobRecord{Job: Job{ID: id, Status: JobRunning}, Host: h})
+			tx.Put(jobsBucket, id, data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := _jobs.load(); err != nil {
+		t.Fatal(err)
+	}
+	if job, ok := _jobs.get("own"); !ok || job.Status != JobFailed {
+		t.Errorf("wrong restored job %+v", job)
+	}
+	if _, ok := _jobs.get("other"); ok {
+		t.Error("job of other replica is restored")
+	}
+	data, _ = store.Get(jobsBucket, "other")
+	var rec jobRecord
+	if json.Unmarshal(data, &rec); rec.Status != JobRunning {
+		t.Errorf("job of other replica is changed %s", data)
+	}
+}
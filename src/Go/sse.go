@@ -0,0 +1,172 @@
+package main
+
+// sse module provides server-sent events responses of predictions
+//
+// Predictions of slow models (e.g. video or large image models) may take
+// seconds, and aggressive proxies or load balancers reset idle connections
+// of such requests. Clients which accept text/event-stream (or provide
+// events=true query parameter) get prediction responses as server-sent
+// events instead: "started" event is sent right away, "heartbeat" events
+// with elapsed time are sent every "eventsHeartbeat" seconds (default 10)
+// while the model runs, and the final "result" event carries the usual JSON
+// response (e.g. top-K labels of image models), or "error" event carries
+// error response with its status, e.g.
+// curl -N -H "Accept: text/event-stream" -d @input.json https://host/json
+// event: started
+// data: {"path":"/json","time":1700000000}
+//
+// event: heartbeat
+// data: {"elapsed":10}
+//
+// event: result
+// data: {"probabilities":[0.1,0.9]}
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// content type of server-sent events
+const eventStreamType = "text/event-stream"
+
+// default interval in seconds of heartbeat events
+const defaultEventsHeartbeat = 10
+
+// eventRecorder records response of the handler streamed as event
+type eventRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header implements http.ResponseWriter interface
+func (w *eventRecorder) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *eventRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// Write implements http.ResponseWriter interface
+func (w *eventRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// helper function to check if client requests server-sent events
+func eventsRequested(r *http.Request) bool {
+	return r.URL.Query().Get("events") == "true" || strings.Contains(r.Header.Get("Accept"), eventStreamType)
+}
+
+// helper function to return interval of heartbeat events
+func eventsHeartbeat() time.Duration {
+	if _config.EventsHeartbeat > 0 {
+		return time.Duration(_config.EventsHeartbeat) * time.Second
+	}
+	return defaultEventsHeartbeat * time.Second
+}
+
+// helper function to set headers of server-sent events response
+func setEventStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable response buffering of nginx proxies
+	w.Header().Set("X-Accel-Buffering", "no")
+}
+
+// helper function to write server-sent event, multi-line data is written as
+// multiple data fields
+func writeEvent(w io.Writer, name string, data []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\n", name)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+// helper function to write server-sent event with JSON data
+func writeJSONEvent(w io.Writer, name string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, name, body)
+}
+
+// eventStreamed wraps prediction handler with server-sent events responses
+// for clients which request them
+func eventStreamed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !eventsRequested(r) {
+			handler(w, r)
+			return
+		}
+		// the handler produces its default JSON output
+		r.Header.Del("Accept")
+		rec := &eventRecorder{header: make(http.Header)}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer func() {
+				if p := recover(); p != nil {
+					rec.status = http.StatusInternalServerError
+					rec.body.Reset()
+					fmt.Fprintf(&rec.body, "{\"error\": %q}", fmt.Sprintf("%v", p))
+				}
+			}()
+			handler(rec, r)
+		}()
+
+		setEventStreamHeaders(w)
+		w.WriteHeader(http.StatusOK)
+		start := time.Now()
+		writeJSONEvent(w, "started", map[string]interface{}{"path": r.URL.Path, "time": start.Unix()})
+		ticker := time.NewTicker(eventsHeartbeat())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				if rec.status >= http.StatusBadRequest {
+					writeJSONEvent(w, "error", map[string]interface{}{"status": rec.status, "response": json.RawMessage(errorBody(rec.body.Bytes()))})
+					return
+				}
+				writeEvent(w, "result", rec.body.Bytes())
+				return
+			case <-ticker.C:
+				// client may be gone, the handler is still waited for
+				writeJSONEvent(w, "heartbeat", map[string]interface{}{"elapsed": int(time.Since(start).Seconds())})
+			}
+		}
+	}
+}
+
+// helper function to return JSON of error response, non JSON responses are
+// quoted
+func errorBody(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	if json.Valid(body) {
+		return body
+	}
+	data, _ := json.Marshal(string(body))
+	return data
+}
@@ -0,0 +1,108 @@
+package main
+
+// tests of sse module, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to parse server-sent events of the response
+func parseEvents(tb testing.TB, body string) ([]string, map[string]string) {
+	var names []string
+	data := make(map[string]string)
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var name string
+		var lines []string
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				lines = append(lines, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if name == "" {
+			tb.Fatalf("event without name: %q", block)
+		}
+		names = append(names, name)
+		data[name] = strings.Join(lines, "\n")
+	}
+	return names, data
+}
+
+// TestEventStreamedPredictions checks predictions streamed as server-sent events
+func TestEventStreamedPredictions(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	handler := eventStreamed(PredictHandler)
+	payload, _ := json.Marshal(testRow("dnn"))
+
+	// clients without events get plain response
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/json", bytes.NewReader(payload)))
+	if ctype := w.Header().Get("Content-Type"); ctype == eventStreamType {
+		t.Fatal("plain request is streamed as events")
+	}
+
+	req := httptest.NewRequest("POST", "/json", bytes.NewReader(payload))
+	req.Header.Set("Accept", eventStreamType)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != eventStreamType {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	names, data := parseEvents(t, w.Body.String())
+	if strings.Join(names, ",") != "started,result" {
+		t.Fatalf("unexpected events %v", names)
+	}
+	var probs []float32
+	if err := json.Unmarshal([]byte(data["result"]), &probs); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	// failed predictions are reported by error event
+	payload, _ = json.Marshal(testRow("unknown"))
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/json?events=true", bytes.NewReader(payload)))
+	names, data = parseEvents(t, w.Body.String())
+	if names[len(names)-1] != "error" {
+		t.Fatalf("unexpected events %v", names)
+	}
+	var failure struct {
+		Status int `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(data["error"]), &failure); err != nil || failure.Status != http.StatusInternalServerError {
+		t.Errorf("unexpected error event %s %v", data["error"], err)
+	}
+}
+
+// TestEventHeartbeats checks heartbeats of slow predictions
+func TestEventHeartbeats(t *testing.T) {
+	orig := _config
+	t.Cleanup(func() { _config = orig })
+	_config.EventsHeartbeat = 1
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "" {
+			t.Error("handler should produce default output")
+		}
+		time.Sleep(1200 * time.Millisecond)
+		w.Write([]byte("{\"labels\":\n[\"cat\"]}"))
+	}
+	req := httptest.NewRequest("POST", "/predict/video", nil)
+	req.Header.Set("Accept", eventStreamType)
+	w := httptest.NewRecorder()
+	eventStreamed(slow)(w, req)
+	names, data := parseEvents(t, w.Body.String())
+	if strings.Join(names, ",") != "started,heartbeat,result" {
+		t.Fatalf("unexpected events %v", names)
+	}
+	if data["result"] != "{\"labels\":\n[\"cat\"]}" {
+		t.Errorf("unexpected result %q", data["result"])
+	}
+}
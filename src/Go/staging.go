@@ -0,0 +1,159 @@
+package main
+
+// staging module provides atomic installation of uploaded models
+//
+// Uploaded models are written into modelDir/.staging area first, validated
+// (params parsing and graph import) and only afterwards moved into model area
+// via rename, such that partially written model can't be picked up by the server.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// installLock serializes installation of models into model area
+var installLock sync.Mutex
+
+// helper function to return location of staging area
+func stagingArea() string {
+	return filepath.Join(_config.ModelDir, ".staging")
+}
+
+// helper function to create new staging directory for model upload
+func stagingDir() (string, error) {
+	sdir := stagingArea()
+	if err := os.MkdirAll(sdir, 0755); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(sdir, "upload-")
+}
+
+// helper function to clean up staging area, e.g. after server crash
+func cleanStaging() {
+	sdir := stagingArea()
+	if _, err := os.Stat(sdir); err == nil {
+		log.Println("clean up staging area", sdir)
+		if err := os.RemoveAll(sdir); err != nil {
+			log.Println("unable to clean up staging area", err)
+		}
+	}
+}
+
+// helper function to validate model stored in given path
+func validateModel(path, name string) error {
+	var params TFParams
+	fname := filepath.Join(path, "params.json")
+	hasParams := false
+	if _, err := os.Stat(fname); err == nil {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &params); err != nil {
+			return fmt.Errorf("unable to parse %s: %v", fname, err)
+		}
+		if params.Name != "" && params.Name != name {
+			return fmt.Errorf("mismatch of model name %s and params name %s", name, params.Name)
+		}
+		hasParams = true
+	}
+	// models may require newer TF version
+	if err := checkModelTFVersion(path); err != nil {
+		return err
+	}
+	// constant feeds should have valid values
+	if _, err := constFeedTensors(params.ConstFeeds); err != nil {
+		return fmt.Errorf("invalid constant feeds: %v", err)
+	}
+	// models should use known session presets and valid CPU sets
+	var config []byte
+	if params.SessionPreset != "" {
+		var err error
+		if config, err = presetConfigProto(params.SessionPreset, availableCPUs()); err != nil {
+			return err
+		}
+	}
+	if _, err := modelCPUSet(params); err != nil {
+		return err
+	}
+	// models can not fall back to themselves
+	if params.Fallback != nil && params.Fallback.Model != "" && params.Fallback.Model == name {
+		return fmt.Errorf("model %s uses itself as fallback", name)
+	}
+	// NLP models should provide valid tokenizer
+	if params.Tokenizer != nil {
+		if _, err := newTokenizer(path, *params.Tokenizer); err != nil {
+			return fmt.Errorf("unable to load tokenizer: %v", err)
+		}
+	}
+	// XGBoost models are stored in JSON format
+	if params.Backend == xgboostBackend {
+		if _, err := loadXGBModel(filepath.Join(path, params.Model), params.EncryptionKey); err != nil {
+			return fmt.Errorf("unable to load model: %v", err)
+		}
+		return nil
+	}
+	// TF 2.X models are stored in saved model format
+	if _, err := os.Stat(filepath.Join(path, "saved_model.pb")); err == nil {
+		if params.EncryptionKey != "" {
+			return errors.New("saved models can not be encrypted, TF library loads them from disk")
+		}
+		model, err := _tf.LoadSavedModel(path, config)
+		if err != nil {
+			return fmt.Errorf("unable to load saved model: %v", err)
+		}
+		defer model.Close()
+		input, output := params.tf2Nodes()
+		return checkOutputIndices(model.Nodes(), input, output)
+	}
+	// TF 1.X models should provide params, graph and labels files
+	if !hasParams {
+		return fmt.Errorf("model %s does not provide params.json", name)
+	}
+	modelPath := filepath.Join(path, params.Model)
+	modelLabels := filepath.Join(path, params.Labels)
+	graph, _, err := loadModel(modelPath, modelLabels, params.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("unable to load model: %v", err)
+	}
+	defer graph.Close()
+	if params.InputNode == "" || params.OutputNode == "" {
+		if _, err := discoverNodes(graph.Nodes()); err != nil {
+			return fmt.Errorf("unable to discover model nodes: %v", err)
+		}
+		return nil
+	}
+	input, output := params.nodes()
+	return checkOutputIndices(graph.Nodes(), input, output)
+}
+
+// helper function to validate model in staging area and move it into
+// model area, the previous version of the model is archived
+func installModel(staging, name string) error {
+	if err := validateModel(staging, name); err != nil {
+		return err
+	}
+	// in stateless mode model store is authoritative source of models
+	if err := pushModel(staging, name); err != nil {
+		return err
+	}
+	installLock.Lock()
+	defer installLock.Unlock()
+	if err := archiveModel(name); err != nil {
+		return err
+	}
+	path := filepath.Join(_config.ModelDir, name)
+	if err := os.Rename(staging, path); err != nil {
+		return err
+	}
+	resetModelCache(name)
+	log.Printf("install model %s into %s", name, path)
+	publish(EventUpload, name, "new model version is installed")
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+// tests of staging area of uploaded models, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// helper function to write model files into new staging directory, the
+// model params use given model name
+func stageModel(t *testing.T, name string, def []byte, params TFParams) string {
+	staging, err := stagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(staging) != stagingArea() {
+		t.Fatalf("staging directory %s is outside of staging area", staging)
+	}
+	dir := _config.ModelDir
+	_config.ModelDir = stagingArea()
+	writeModelFiles(t, filepath.Base(staging), def, params)
+	_config.ModelDir = dir
+	params.Name = name
+	params.Model = "model.pb"
+	params.Labels = "labels.txt"
+	data, _ := json.Marshal(params)
+	if err := ioutil.WriteFile(filepath.Join(staging, "params.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return staging
+}
+
+// TestInstallModel checks that only validated models are moved from staging
+// area into model area and previous model is archived
+func TestInstallModel(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+
+	// invalid models do not replace current model
+	staging := stageModel(t, "dnn2", []byte("dnn v2"), params)
+	if err := installModel(staging, "dnn"); err == nil || !strings.Contains(err.Error(), "mismatch of model name") {
+		t.Fatalf("model with wrong name is installed: %v", err)
+	}
+	os.Remove(filepath.Join(staging, "params.json"))
+	if err := installModel(staging, "dnn"); err == nil || !strings.Contains(err.Error(), "params.json") {
+		t.Fatalf("model without params is installed: %v", err)
+	}
+	bad := params
+	bad.Fallback = &Fallback{Model: "dnn"}
+	if err := installModel(stageModel(t, "dnn", []byte("dnn v2"), bad), "dnn"); err == nil {
+		t.Fatal("model with fallback to itself is installed")
+	}
+	if def := modelDefinition(t, "dnn"); def != "dnn" {
+		t.Fatalf("invalid model replaced current model %s", def)
+	}
+
+	// valid model replaces current one which is kept as model version
+	if _, err := predictRow(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	staging = stageModel(t, "dnn", []byte("dnn v2"), params)
+	if err := installModel(staging, "dnn"); err != nil {
+		t.Fatal(err)
+	}
+	imports := atomic.LoadUint64(&fake.Imports)
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Fatalf("staging directory is left after install: %v", err)
+	}
+	if def := modelDefinition(t, "dnn"); def != "dnn v2" {
+		t.Fatalf("wrong installed model %s", def)
+	}
+	if versions, _ := modelVersions("dnn"); len(versions) != 1 {
+		t.Fatalf("previous model is not archived %+v", versions)
+	}
+	// installed model is loaded on next request
+	if _, err := predictRow(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&fake.Imports) == imports {
+		t.Fatal("previous model is kept in cache")
+	}
+
+	// leftovers of interrupted uploads are removed on server start
+	cleanStaging()
+	if _, err := os.Stat(stagingArea()); !os.IsNotExist(err) {
+		t.Fatalf("staging area is not cleaned up: %v", err)
+	}
+	for _, m := range []string{"dnn", "dnn2", "img"} {
+		if !modelExists(m) {
+			t.Fatalf("model %s is removed with staging area", m)
+		}
+	}
+}
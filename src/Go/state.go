@@ -0,0 +1,388 @@
+package main
+
+// state module provides export and restore of server state
+//
+// The complete state of the server, i.e. current versions of all models,
+// model aliases and configuration file, can be exported into single tar.gz
+// archive and restored on a fresh instance for disaster recovery, e.g.
+//
+//	tfaas -config config.json -export state.tar.gz
+//	tfaas -config config.json -restore state.tar.gz
+//
+// (or GET and POST of /admin/state on running servers). The archive contains
+// state.json (archive meta-data), config.json, aliases.json and
+// models/<model>/ areas. The restore writes configuration file only if it
+// does not exist yet, i.e. on a fresh instance, installs every model of the
+// archive via staging area (models are validated and pushed to model store
+// in stateless mode) and merges archived aliases into existing ones. Older
+// model versions (.versions area) are not part of the archive. Credentials
+// of the configuration file (tokens, passwords, client and cookie secrets,
+// signing, redaction and model keys and passwords of URLs) are exported
+// empty unless they are secret references (see secrets module), the
+// manifest lists redacted fields and the restored server takes their
+// defaults, e.g. environment variables, until operators set them again.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// version of state archive format
+const stateVersion = 1
+
+// configuration fields which hold credentials
+var secretConfigFields = []string{"backupToken", "bindPassword", "key", "modelStoreToken", "oidcClientSecret", "oidcCookieSecret", "redactionKey", "resultsStoreToken", "vaultToken"}
+
+// StateManifest represents meta-data of state archive
+type StateManifest struct {
+	Version int      `json:"version"` // archive format version
+	Created string   `json:"created"` // archive creation time
+	Host    string   `json:"host"`    // host name of exporting server
+	Build   string   `json:"build"`   // build of exporting server
+	Models  []string `json:"models"`  // archived models
+	Aliases int      `json:"aliases"` // number of archived aliases
+	Config  bool     `json:"config"`  // archive contains configuration file
+
+	// configuration fields with redacted credentials
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// StateReport represents outcome of state restore
+type StateReport struct {
+	Models  []string          `json:"models"`           // restored models
+	Failed  map[string]string `json:"failed,omitempty"` // models which failed to restore
+	Aliases int               `json:"aliases"`          // number of restored aliases
+	Config  string            `json:"config,omitempty"` // restored configuration file
+}
+
+// helper function to add file with given content to tarball
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// exportState writes state archive of the server
+func exportState(w io.Writer) (StateManifest, error) {
+	hostname, _ := os.Hostname()
+	manifest := StateManifest{
+		Version: stateVersion,
+		Created: time.Now().Format(time.RFC3339),
+		Host:    hostname,
+		Build:   info(),
+		Models:  []string{},
+	}
+	files, err := ioutil.ReadDir(_config.ModelDir)
+	if err != nil {
+		return manifest, err
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") && isModelArea(filepath.Join(_config.ModelDir, f.Name())) {
+			manifest.Models = append(manifest.Models, f.Name())
+		}
+	}
+	aliases := _aliases.list()
+	manifest.Aliases = len(aliases)
+	var config []byte
+	if _configFile != "" {
+		if config, err = ioutil.ReadFile(_configFile); err != nil {
+			return manifest, err
+		}
+		if config, manifest.Redacted, err = redactConfig(config); err != nil {
+			return manifest, err
+		}
+		manifest.Config = true
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeTarFile(tw, "state.json", data); err != nil {
+		return manifest, err
+	}
+	if manifest.Config {
+		if err := writeTarFile(tw, "config.json", config); err != nil {
+			return manifest, err
+		}
+	}
+	amap := make(map[string]Alias)
+	for _, a := range aliases {
+		amap[a.Name] = a
+	}
+	data, _ = json.MarshalIndent(amap, "", "  ")
+	if err := writeTarFile(tw, "aliases.json", data); err != nil {
+		return manifest, err
+	}
+	for _, model := range manifest.Models {
+		path := filepath.Join(_config.ModelDir, model)
+		if err := writeTarDir(tw, path, "models/"+model+"/"); err != nil {
+			return manifest, fmt.Errorf("unable to archive %s model: %v", model, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+// helper function to remove plain credentials of configuration file, it
+// returns configuration as is if it has no credentials and list of fields
+// with redacted credentials
+func redactConfig(data []byte) ([]byte, []string, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse configuration file: %v", err)
+	}
+	var redacted []string
+	var walk func(path string, secret bool, value interface{}) interface{}
+	walk = func(path string, secret bool, value interface{}) interface{} {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, item := range v {
+				// all values of model keys are keys
+				v[key] = walk(path+"."+key, secret || InList(key, secretConfigFields) || key == "modelKeys", item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				v[i] = walk(fmt.Sprintf("%s[%d]", path, i), secret, item)
+			}
+		case string:
+			if v == "" || isSecretRef(v) {
+				return v
+			}
+			if secret {
+				redacted = append(redacted, strings.TrimPrefix(path, "."))
+				return ""
+			}
+			if uri, err := url.Parse(v); err == nil && uri.User != nil {
+				if _, ok := uri.User.Password(); ok {
+					uri.User = url.User(uri.User.Username())
+					redacted = append(redacted, strings.TrimPrefix(path, "."))
+					return uri.String()
+				}
+			}
+		}
+		return value
+	}
+	walk("", false, config)
+	if len(redacted) == 0 {
+		return data, nil, nil
+	}
+	sort.Strings(redacted)
+	out, err := json.MarshalIndent(config, "", "  ")
+	return out, redacted, err
+}
+
+// helper function to unpack state tarball into given directory and read
+// its meta-data
+func unpackState(tarball, dir string) (StateManifest, error) {
+	var manifest StateManifest
+	if _, err := Untar(tarball, dir); err != nil {
+		return manifest, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		return manifest, errors.New("archive does not provide state.json, it is not state archive")
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.Version != stateVersion {
+		return manifest, fmt.Errorf("unsupported state archive version %d", manifest.Version)
+	}
+	return manifest, nil
+}
+
+// helper function to write configuration file of state tarball unless
+// given configuration file already exists
+func restoreConfig(tarball, configFile string) (bool, error) {
+	if _, err := os.Stat(configFile); err == nil {
+		return false, nil
+	}
+	file, err := os.Open(tarball)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return false, errors.New("state archive does not provide configuration file")
+		} else if err != nil {
+			return false, err
+		}
+		if header.Name != "config.json" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return false, err
+		}
+		return true, ioutil.WriteFile(configFile, data, 0600)
+	}
+}
+
+// helper function to merge aliases of state archive into model aliases
+func restoreAliases(fname string) (int, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	aliases := make(map[string]Alias)
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return 0, err
+	}
+	if len(aliases) == 0 {
+		return 0, nil
+	}
+	_aliases.mutex.Lock()
+	defer _aliases.mutex.Unlock()
+	for name, alias := range aliases {
+		_aliases.Aliases[name] = alias
+	}
+	return len(aliases), _aliases.write()
+}
+
+// restoreModels installs models and aliases of unpacked state archive
+func restoreModels(dir string, manifest StateManifest) StateReport {
+	report := StateReport{Models: []string{}, Failed: make(map[string]string)}
+	models := append([]string{}, manifest.Models...)
+	sort.Strings(models)
+	for _, model := range models {
+		// model names of the archive should refer to model areas
+		if model == "" || filepath.Base(model) != model || strings.HasPrefix(model, ".") {
+			report.Failed[model] = "invalid model name"
+			continue
+		}
+		path := filepath.Join(dir, "models", model)
+		if err := installModel(path, model); err != nil {
+			log.Printf("unable to restore %s model: %v", model, err)
+			report.Failed[model] = err.Error()
+			continue
+		}
+		report.Models = append(report.Models, model)
+	}
+	n, err := restoreAliases(filepath.Join(dir, "aliases.json"))
+	if err != nil {
+		log.Println("unable to restore aliases", err)
+		report.Failed["aliases"] = err.Error()
+	}
+	report.Aliases = n
+	return report
+}
+
+// restoreState restores server state from given archive, if configFile is
+// provided and does not exist it is written from the archive and used by
+// the restore
+func restoreState(fname, configFile string) (StateReport, error) {
+	var report StateReport
+	tarball, err := gunzipFile(fname)
+	if err != nil {
+		return report, err
+	}
+	if tarball != fname {
+		defer os.Remove(tarball)
+	}
+	restored := false
+	if configFile != "" {
+		if restored, err = restoreConfig(tarball, configFile); err != nil {
+			return report, err
+		}
+		if err := parseConfig(configFile); err != nil {
+			return report, err
+		}
+		// restored models are validated with TF library
+		initTFLayer()
+		if err := os.MkdirAll(_config.ModelDir, 0755); err != nil {
+			return report, err
+		}
+		if err := initStore(); err != nil {
+			return report, err
+		}
+		if err := initStateStore(); err != nil {
+			return report, err
+		}
+		if err := _aliases.load(); err != nil {
+			return report, err
+		}
+	}
+	// models are installed from staging area of model directory
+	staging, err := stagingDir()
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(staging)
+	manifest, err := unpackState(tarball, staging)
+	if err != nil {
+		return report, err
+	}
+	report = restoreModels(staging, manifest)
+	if restored {
+		report.Config = configFile
+		if len(manifest.Redacted) > 0 {
+			log.Printf("WARNING: credentials of restored configuration are not archived, set them again: %s", strings.Join(manifest.Redacted, ", "))
+		}
+	}
+	log.Printf("restored state of %s: %d models, %d failed, %d aliases", manifest.Host, len(report.Models), len(report.Failed), report.Aliases)
+	return report, nil
+}
+
+// StateHandler exports (GET) or restores (POST) server state archive
+func StateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	file, err := ioutil.TempFile("", "state-*.tar.gz")
+	if err != nil {
+		responseError(w, "unable to create state file", err, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if r.Method == "GET" {
+		// the archive is written to file first such that clients do not get
+		// truncated archive on failures
+		if _, err := exportState(file); err != nil {
+			responseError(w, "unable to export server state", err, http.StatusInternalServerError)
+			return
+		}
+		file.Seek(0, io.SeekStart)
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=tfaas-state-%s.tar.gz", time.Now().Format("20060102150405")))
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, file)
+		return
+	}
+	_, err = io.Copy(file, r.Body)
+	file.Close()
+	if err != nil {
+		responseError(w, "unable to read state archive", err, http.StatusBadRequest)
+		return
+	}
+	report, err := restoreState(file.Name(), "")
+	if err != nil {
+		responseError(w, "unable to restore server state", err, http.StatusBadRequest)
+		return
+	}
+	for _, model := range report.Models {
+		startSelfTest(model)
+	}
+	responseJSON(w, report)
+}
@@ -0,0 +1,299 @@
+package main
+
+// stateful module provides predictions of stateful models, e.g. RNNs
+//
+// Stateful models declare their state tensors in params.json, e.g.
+// "state": {"tensors": [
+//     {"input": "state_h_in", "output": "state_h_out", "shape": [-1, 128]},
+//     {"input": "state_c_in", "output": "state_c_out", "shape": [-1, 128]}],
+//  "ttl": 600}
+// POST /predict/stateful with batch of rows, e.g.
+// {"model": "rnn", "shape": [1, 3], "values": [1, 2, 3]}
+// feeds the model with zero initial state (dimensions -1 of state shape
+// match number of input rows), keeps its next state on the server and
+// returns state token together with outputs, e.g.
+// {"token": "8a1f...", "expires": "...", "outputs": [[0.1, 0.9]]}
+// Subsequent requests of the client provide the token (in request or via
+// State-Token header) and the model is fed with the state of the previous
+// call. States expire after "ttl" seconds of inactivity (default stateTTL
+// option or 10 minutes) and DELETE /predict/stateful/<token> releases state
+// explicitly. Requests with the same token are serialized, states are kept
+// in memory of the server replica (see sticky routing of clients).
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// default lifetime in seconds of idle states and max number of states
+const (
+	defaultStateTTL  = 600
+	defaultMaxStates = 10000
+)
+
+// StateTensor represents state tensor of stateful model
+type StateTensor struct {
+	Input  string  `json:"input"`  // graph node fed with the state
+	Output string  `json:"output"` // graph node which produces the next state
+	Shape  []int64 `json:"shape"`  // shape of initial zero state, -1 stands for number of input rows
+}
+
+// StateConfig represents state of stateful model
+type StateConfig struct {
+	Tensors []StateTensor `json:"tensors"`       // state tensors of the model
+	TTL     int           `json:"ttl,omitempty"` // lifetime in seconds of idle states
+}
+
+// StatefulRequest represents request of stateful model
+type StatefulRequest struct {
+	Model  string    `json:"model"`  // TF model name to use
+	Values []float32 `json:"values"` // flat vector of row values
+	Shape  []int64   `json:"shape"`  // shape of the batch, e.g. [nrows, ncols]
+	Token  string    `json:"token"`  // state token of previous call
+}
+
+// StatefulResponse represents response of stateful model
+type StatefulResponse struct {
+	Token   string      `json:"token"`   // state token of the next call
+	Expires string      `json:"expires"` // expiration time of the state
+	Outputs [][]float32 `json:"outputs"` // model outputs
+}
+
+// ModelState represents state kept between calls of stateful model
+type ModelState struct {
+	Model   string     // model name
+	Tensors []TFTensor // state tensors
+	Expires time.Time  // expiration time of the state
+	lock    sync.Mutex // serializes calls with the same token
+}
+
+// global store of model states
+var (
+	_states     = make(map[string]*ModelState)
+	_statesLock sync.Mutex
+)
+
+// helper function to return lifetime of idle states of the model
+func stateTTL(config *StateConfig) time.Duration {
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = _config.StateTTL
+	}
+	if ttl <= 0 {
+		ttl = defaultStateTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// helper function to remove expired states, it should be called with
+// acquired lock
+func purgeStates(now time.Time) {
+	for token, state := range _states {
+		if now.After(state.Expires) {
+			delete(_states, token)
+		}
+	}
+}
+
+// helper function to find state of given token or to create new one
+func lookupState(token, model string, ttl time.Duration) (*ModelState, string, error) {
+	now := time.Now()
+	_statesLock.Lock()
+	defer _statesLock.Unlock()
+	purgeStates(now)
+	if token != "" {
+		state, ok := _states[token]
+		if !ok {
+			return nil, "", errStateNotFound
+		}
+		if state.Model != model {
+			return nil, "", fmt.Errorf("state token belongs to model %s", state.Model)
+		}
+		state.Expires = now.Add(ttl)
+		return state, token, nil
+	}
+	limit := _config.MaxStates
+	if limit <= 0 {
+		limit = defaultMaxStates
+	}
+	if len(_states) >= limit {
+		return nil, "", errTooManyStates
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+	state := &ModelState{Model: model, Expires: now.Add(ttl)}
+	_states[token] = state
+	return state, token, nil
+}
+
+// helper function to remove state of given token
+func removeState(token string) bool {
+	_statesLock.Lock()
+	defer _statesLock.Unlock()
+	_, ok := _states[token]
+	delete(_states, token)
+	return ok
+}
+
+// errors of state look-up
+var (
+	errStateNotFound = errors.New("state is not found or expired")
+	errTooManyStates = errors.New("too many active states")
+)
+
+// helper function to create zero initial state tensors for given number of
+// input rows
+func initialState(config *StateConfig, rows int64) ([]TFTensor, error) {
+	var out []TFTensor
+	for _, st := range config.Tensors {
+		shape := make([]int64, len(st.Shape))
+		for i, d := range st.Shape {
+			if d == -1 {
+				d = rows
+			}
+			shape[i] = d
+		}
+		size, err := shapeSize(shape)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shape of state %s: %v", st.Input, err)
+		}
+		tensor, err := _tf.NewTensor(make([]float32, size), shape)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tensor)
+	}
+	return out, nil
+}
+
+// helper function to run stateful model with given state, the state is
+// updated by the next state produced by the model
+func runStateful(name string, config *StateConfig, state *ModelState, tensor TFTensor) (probs [][]float32, err error) {
+	start := time.Now()
+	defer func() { observeModelSLO(name, time.Since(start), err) }()
+	if err := breakerCheck(name); err != nil {
+		return nil, err
+	}
+	if err := injectModelFaults(name); err != nil {
+		return nil, err
+	}
+	tfModel, err := tfVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	if tfModel == xgboostBackend {
+		return nil, fmt.Errorf("model %s is not stateful", name)
+	}
+	touchModel(name)
+	graph, input, output, err := modelGraph(name, tfModel)
+	if err != nil {
+		return nil, err
+	}
+	tensors := state.Tensors
+	if tensors == nil {
+		if tensors, err = initialState(config, int64(tensorRowsCount(tensor))); err != nil {
+			return nil, err
+		}
+	}
+	feeds := map[string]TFTensor{input: tensor}
+	fetches := []string{output}
+	for i, st := range config.Tensors {
+		feeds[st.Input] = tensors[i]
+		fetches = append(fetches, st.Output)
+	}
+	results, err := runSession(name, graph, feeds, fetches)
+	if err != nil {
+		return nil, err
+	}
+	if probs, err = outputRows(name, results[0], tensorRowsCount(tensor)); err != nil {
+		return nil, err
+	}
+	state.Tensors = results[1:]
+	return probs, nil
+}
+
+// StatefulHandler provides predictions of stateful models
+func StatefulHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req StatefulRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responseError(w, "unable to unmarshal stateful request", err, http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		req.Token = r.Header.Get("State-Token")
+	}
+	model := resolveModel(req.Model)
+	if model == "" {
+		model = _params.Name
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model params", err, http.StatusBadRequest)
+		return
+	}
+	if params.State == nil || len(params.State.Tensors) == 0 {
+		msg := fmt.Sprintf("model %s is not stateful", model)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	shape := req.Shape
+	if len(shape) == 0 {
+		shape = []int64{1, int64(len(req.Values))}
+	}
+	tensor, err := makeFlatTensor(req.Values, shape)
+	if err != nil {
+		responseError(w, "unable to read rows", err, http.StatusBadRequest)
+		return
+	}
+	ttl := stateTTL(params.State)
+	state, token, err := lookupState(req.Token, model, ttl)
+	switch {
+	case err == errStateNotFound:
+		responseError(w, err.Error(), err, http.StatusNotFound)
+		return
+	case err == errTooManyStates:
+		responseError(w, err.Error(), err, http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		responseError(w, err.Error(), err, http.StatusBadRequest)
+		return
+	}
+	observeUsage(usageClient(r), model, tensorRowsCount(tensor))
+	state.lock.Lock()
+	probs, err := runStateful(model, params.State, state, tensor)
+	state.lock.Unlock()
+	if err != nil {
+		if req.Token == "" {
+			// new state was not initialized by the model
+			removeState(token)
+		}
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("State-Token", token)
+	responseJSON(w, StatefulResponse{
+		Token:   token,
+		Expires: time.Now().Add(ttl).UTC().Format(time.RFC3339),
+		Outputs: probs,
+	})
+}
+
+// StatefulDeleteHandler releases state of given token
+func StatefulDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !removeState(mux.Vars(r)["token"]) {
+		responseError(w, errStateNotFound.Error(), nil, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
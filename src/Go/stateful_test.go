@@ -0,0 +1,95 @@
+package main
+
+// tests of stateful models, they do not require TF C library
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to make stateful request with given body and token
+func statefulRequest(t *testing.T, body, token string) (int, StatefulResponse) {
+	req := httptest.NewRequest("POST", "/predict/stateful", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("State-Token", token)
+	}
+	rr := httptest.NewRecorder()
+	StatefulHandler(rr, req)
+	var res StatefulResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if rr.Header().Get("State-Token") != res.Token {
+			t.Errorf("wrong State-Token header %s", rr.Header().Get("State-Token"))
+		}
+	}
+	return rr.Code, res
+}
+
+// TestFakeStateful checks state kept between calls of stateful model
+func TestFakeStateful(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	_states = make(map[string]*ModelState)
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	params.State = &StateConfig{Tensors: []StateTensor{{Input: "h_in", Output: "h_out", Shape: []int64{-1, 2}}}}
+	writeModelFiles(t, "rnn", []byte("rnn"), params)
+
+	body := `{"model": "rnn", "shape": [1, 4], "values": [1, 2, 3, 4]}`
+	code, res := statefulRequest(t, body, "")
+	if code != http.StatusOK || res.Token == "" || len(res.Outputs) != 1 {
+		t.Fatalf("wrong response %d %+v", code, res)
+	}
+	checkProbs(t, res.Outputs[0])
+	// the first call is fed with zero state
+	if h := fake.Feeds()["h_in"]; !reflect.DeepEqual(h.Shape(), []int64{1, 2}) {
+		t.Errorf("wrong initial state shape %v", h.Shape())
+	}
+	if fetches := fake.Fetches(); len(fetches) != 2 || fetches[1] != "h_out" {
+		t.Errorf("wrong fetches %v", fetches)
+	}
+	// the next call is fed with state produced by the first one
+	code, next := statefulRequest(t, body, res.Token)
+	if code != http.StatusOK || next.Token != res.Token {
+		t.Fatalf("wrong response %d %+v", code, next)
+	}
+	if h, _ := tensorRows(fake.Feeds()["h_in"]); len(h) != 1 || !reflect.DeepEqual(h[0], testOutputs) {
+		t.Errorf("state is not carried across calls %v", h)
+	}
+
+	// tokens are bound to models
+	writeModelFiles(t, "rnn2", []byte("rnn2"), params)
+	if code, _ := statefulRequest(t, strings.Replace(body, "rnn", "rnn2", 1), res.Token); code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of token of another model", code)
+	}
+	// models without state are rejected
+	if code, _ := statefulRequest(t, strings.Replace(body, "rnn", "dnn", 1), ""); code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of model without state", code)
+	}
+
+	// expired states
+	_statesLock.Lock()
+	_states[res.Token].Expires = time.Now().Add(-time.Second)
+	_statesLock.Unlock()
+	if code, _ := statefulRequest(t, body, res.Token); code != http.StatusNotFound {
+		t.Errorf("wrong status %d of expired state", code)
+	}
+
+	// explicit release of the state
+	_, res = statefulRequest(t, body, "")
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/predict/stateful/"+res.Token, nil), map[string]string{"token": res.Token})
+		rr := httptest.NewRecorder()
+		StatefulDeleteHandler(rr, req)
+		if rr.Code != status {
+			t.Errorf("wrong status %d of state release, expected %d", rr.Code, status)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+// statestore module provides storage of mutable server state
+//
+// By default model aliases live in aliases.json file and job records only
+// in memory of the server. With "stateStore" option, e.g.
+// "stateStore": "/data/tfaas/state.db"
+// the server keeps its mutable state (aliases and job records) in embedded
+// key-value store. The store is append-only log of transactions, every
+// transaction is one record protected by CRC checksum and synced to disk
+// before it is applied, such that updates are atomic and survive crashes of
+// the server: truncated or corrupted tail of the log (interrupted write) is
+// discarded on startup. The log is periodically compacted into snapshot of
+// live keys. Existing aliases file is imported into the store on first use.
+// Finished jobs and their results are kept across restarts of the server,
+// while jobs interrupted by restart are marked as failed. State shared by
+// replicas may be kept in SQL database instead, see sqlstore module.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// buckets of server state
+const (
+	aliasesBucket = "aliases"
+	jobsBucket    = "jobs"
+)
+
+// minimal size of the log which is compacted
+const kvCompactSize = 1024 * 1024
+
+// maximal size of the log record
+const kvMaxRecord = 256 * 1024 * 1024
+
+// StateStore represents storage of mutable server state
+type StateStore interface {
+	Get(bucket, key string) ([]byte, error)        // value of the key, nil if key does not exist
+	List(bucket string) (map[string][]byte, error) // all keys and values of the bucket
+	Update(fn func(tx StateTx) error) error        // atomic update, nothing is written if fn fails
+	Close() error
+}
+
+// StateTx represents update transaction of state store
+type StateTx interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+}
+
+// global state store, it is nil if server state is not stored
+var _stateStore StateStore
+
+// initStateStore opens state store of the server
+func initStateStore() error {
+	if _config.StateStore == "" || _stateStore != nil {
+		return nil
+	}
+	store, err := openStateStore(_config.StateStore)
+	if err != nil {
+		return err
+	}
+	_stateStore = store
+	return nil
+}
+
+// kvOp represents operation of the log record
+type kvOp struct {
+	Op     string `json:"op"`              // put or del
+	Bucket string `json:"bucket"`          // bucket name
+	Key    string `json:"key"`             // key name
+	Value  []byte `json:"value,omitempty"` // value of put operation
+}
+
+// KVStore represents embedded key-value store
+type KVStore struct {
+	Path string                       // log file
+	data map[string]map[string][]byte // buckets of keys and values
+	file *os.File                     // log file opened for appends
+	size int64                        // size of the log
+	live int64                        // approximate size of live keys
+	lock sync.RWMutex
+}
+
+// openKVStore opens (or creates) key-value store
+func openKVStore(path string) (*KVStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &KVStore{Path: path, data: make(map[string]map[string][]byte), file: file}
+	reader := bufio.NewReader(file)
+	for {
+		ops, n, err := readKVRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// discard tail of interrupted write
+			log.Printf("state store %s: discard %v at offset %d", path, err, s.size)
+			if err := file.Truncate(s.size); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		s.apply(ops)
+		s.size += n
+	}
+	if _, err := file.Seek(s.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// helper function to read log record, it returns operations of the record
+// and size of the record
+func readKVRecord(r io.Reader) ([]kvOp, int64, error) {
+	var header [8]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated record header")
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > kvMaxRecord {
+		return nil, 0, fmt.Errorf("record of %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, fmt.Errorf("truncated record")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("record with wrong checksum")
+	}
+	var ops []kvOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, 0, err
+	}
+	return ops, int64(n) + int64(size), nil
+}
+
+// helper function to encode log record of given operations
+func encodeKVRecord(ops []kvOp) ([]byte, error) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	return append(record, data...), nil
+}
+
+// helper function to apply operations to the store, it should be called
+// with acquired lock
+func (s *KVStore) apply(ops []kvOp) {
+	for _, op := range ops {
+		bucket, ok := s.data[op.Bucket]
+		if !ok {
+			bucket = make(map[string][]byte)
+			s.data[op.Bucket] = bucket
+		}
+		if old, ok := bucket[op.Key]; ok {
+			s.live -= int64(len(op.Bucket) + len(op.Key) + len(old))
+		}
+		if op.Op == "del" {
+			delete(bucket, op.Key)
+			continue
+		}
+		bucket[op.Key] = op.Value
+		s.live += int64(len(op.Bucket) + len(op.Key) + len(op.Value))
+	}
+}
+
+// Get implements StateStore interface
+func (s *KVStore) Get(bucket, key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.data[bucket][key], nil
+}
+
+// List implements StateStore interface
+func (s *KVStore) List(bucket string) (map[string][]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	out := make(map[string][]byte)
+	for key, value := range s.data[bucket] {
+		out[key] = value
+	}
+	return out, nil
+}
+
+// kvTx represents update transaction of key-value store
+type kvTx struct {
+	store *KVStore
+	ops   []kvOp
+}
+
+// Get implements StateTx interface, it sees writes of the transaction
+func (tx *kvTx) Get(bucket, key string) ([]byte, error) {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if op := tx.ops[i]; op.Bucket == bucket && op.Key == key {
+			return op.Value, nil
+		}
+	}
+	return tx.store.data[bucket][key], nil
+}
+
+// Put implements StateTx interface
+func (tx *kvTx) Put(bucket, key string, value []byte) error {
+	if bucket == "" || key == "" {
+		return errors.New("empty bucket or key")
+	}
+	tx.ops = append(tx.ops, kvOp{Op: "put", Bucket: bucket, Key: key, Value: append([]byte{}, value...)})
+	return nil
+}
+
+// Delete implements StateTx interface
+func (tx *kvTx) Delete(bucket, key string) error {
+	tx.ops = append(tx.ops, kvOp{Op: "del", Bucket: bucket, Key: key})
+	return nil
+}
+
+// Update implements StateStore interface
+func (s *KVStore) Update(fn func(tx StateTx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errors.New("state store is closed")
+	}
+	tx := &kvTx{store: s}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	record, err := encodeKVRecord(tx.ops)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(record); err != nil {
+		// drop partially written record
+		s.file.Truncate(s.size)
+		s.file.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	s.apply(tx.ops)
+	if s.size > kvCompactSize && s.size > 2*s.live {
+		if err := s.compact(); err != nil {
+			log.Println("unable to compact state store", s.Path, err)
+		}
+	}
+	return nil
+}
+
+// helper function to rewrite the log as snapshot of live keys, it should be
+// called with acquired lock
+func (s *KVStore) compact() error {
+	var ops []kvOp
+	var buckets []string
+	for name := range s.data {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	for _, name := range buckets {
+		for key, value := range s.data[name] {
+			ops = append(ops, kvOp{Op: "put", Bucket: name, Key: key, Value: value})
+		}
+	}
+	record, err := encodeKVRecord(ops)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(record); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.Path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.size = int64(len(record))
+	return nil
+}
+
+// Close implements StateStore interface
+func (s *KVStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+// tests of state store, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// helper function to open state store of the test
+func openTestStateStore(t *testing.T) {
+	_config.StateStore = filepath.Join(t.TempDir(), "state.db")
+	_stateStore = nil
+	if err := initStateStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_stateStore.Close()
+		_stateStore = nil
+	})
+}
+
+// TestKVStore checks atomic updates and crash recovery of key-value store
+func TestKVStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx StateTx) error {
+		tx.Put("b", "k1", []byte("v1"))
+		tx.Put("b", "k2", []byte("v2"))
+		if v, _ := tx.Get("b", "k1"); string(v) != "v1" {
+			t.Errorf("transaction does not see its writes: %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx StateTx) error {
+		tx.Put("b", "k3", []byte("v3"))
+		tx.Delete("b", "k1")
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("error of the transaction is not returned")
+	}
+	if v, _ := store.Get("b", "k1"); string(v) != "v1" {
+		t.Errorf("aborted transaction is applied: %s", v)
+	}
+	store.Update(func(tx StateTx) error { return tx.Delete("b", "k2") })
+	store.Close()
+
+	// interrupted write leaves partial record at the end of the log
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	record, _ := encodeKVRecord([]kvOp{{Op: "put", Bucket: "b", Key: "k4", Value: []byte("v4")}})
+	file.Write(record[:len(record)-2])
+	file.Close()
+	store, err = openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := store.List("b")
+	if len(records) != 1 || string(records["k1"]) != "v1" {
+		t.Fatalf("wrong records after recovery %v", records)
+	}
+	if err := store.Update(func(tx StateTx) error { return tx.Put("b", "k5", []byte("v5")) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwritten keys are compacted
+	value := bytes.Repeat([]byte("x"), 64*1024)
+	for i := 0; i < 40; i++ {
+		store.Update(func(tx StateTx) error { return tx.Put("big", "key", value) })
+	}
+	if info, _ := os.Stat(path); info.Size() > kvCompactSize {
+		t.Errorf("log of %d bytes is not compacted", info.Size())
+	}
+	store.Close()
+	store, err = openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if records, _ := store.List("b"); len(records) != 2 || string(records["k5"]) != "v5" {
+		t.Errorf("wrong records after restart %v", records)
+	}
+	if v, _ := store.Get("big", "key"); !bytes.Equal(v, value) {
+		t.Errorf("wrong compacted value of %d bytes", len(v))
+	}
+}
+
+// TestStateStoreAliases checks aliases kept in state store
+func TestStateStoreAliases(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	data, _ := json.Marshal(map[string]Alias{"dnn-prod": {Name: "dnn-prod", Model: "dnn"}})
+	if err := ioutil.WriteFile(aliasesFile(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	openTestStateStore(t)
+	if err := _aliases.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := _aliases.promote("dnn-prod", "dnn2"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(aliasesFile())
+
+	// aliases are restored from the store after restart
+	_stateStore.Close()
+	_stateStore = nil
+	if err := initStateStore(); err != nil {
+		t.Fatal(err)
+	}
+	_aliases = Aliases{Aliases: make(map[string]Alias)}
+	if err := _aliases.load(); err != nil {
+		t.Fatal(err)
+	}
+	if model := resolveModel("dnn-prod"); model != "dnn2" {
+		t.Errorf("wrong model %s of restored alias", model)
+	}
+	if alias := _aliases.list()[0]; len(alias.History) != 1 || alias.History[0] != "dnn" {
+		t.Errorf("wrong history of restored alias %+v", alias)
+	}
+}
+
+// TestStateStoreJobs checks jobs kept in state store
+func TestStateStoreJobs(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	_config.JobsDir = t.TempDir()
+	openTestStateStore(t)
+	_jobs = JobManager{Jobs: make(map[string]*Job)}
+
+	files := make(map[string]string)
+	for _, name := range []string{"done.input", "done.csv", "running.input", "stray.csv"} {
+		files[name] = filepath.Join(_config.JobsDir, name)
+		ioutil.WriteFile(files[name], []byte("data"), 0644)
+	}
+	records := map[string]jobRecord{
+		"done":    {Job: Job{ID: "done", Model: "dnn", Status: JobDone, Finished: 1}, Input: files["done.input"], Output: files["done.csv"]},
+		"running": {Job: Job{ID: "running", Model: "dnn", Status: JobRunning}, Input: files["running.input"]},
+	}
+	err := _stateStore.Update(func(tx StateTx) error {
+		for id, rec := range records {
+			data, _ := json.Marshal(rec)
+			tx.Put(jobsBucket, id, data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := _jobs.load(); err != nil {
+		t.Fatal(err)
+	}
+	cleanJobs()
+	if job, ok := _jobs.get("done"); !ok || job.Status != JobDone {
+		t.Errorf("wrong restored job %+v", job)
+	}
+	if job, ok := _jobs.get("running"); !ok || job.Status != JobFailed || job.Finished == 0 {
+		t.Errorf("wrong interrupted job %+v", job)
+	}
+	for name, exists := range map[string]bool{"done.input": true, "done.csv": true, "running.input": false, "stray.csv": false} {
+		if _, err := os.Stat(files[name]); (err == nil) != exists {
+			t.Errorf("wrong state of %s file", name)
+		}
+	}
+	data, _ := _stateStore.Get(jobsBucket, "running")
+	var rec jobRecord
+	if json.Unmarshal(data, &rec); rec.Status != JobFailed {
+		t.Errorf("wrong record of interrupted job %s", data)
+	}
+
+	if !_jobs.remove("done") {
+		t.Fatal("restored job is not removed")
+	}
+	if data, _ := _stateStore.Get(jobsBucket, "done"); data != nil {
+		t.Errorf("record of removed job is kept %s", data)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// store module provides stateless mode of the server with external model store
+//
+// In stateless mode ("stateless": true) the server does not keep
+// authoritative state in its model area, instead model bundles (tar.gz) are
+// kept in external model store defined by "modelStore" option, either shared
+// directory (e.g. "/mnt/models" or "file:///mnt/models") or HTTP object
+// store (e.g. "https://store.example.com/tfaas") which supports GET, PUT and
+// DELETE of <url>/<model>.tar.gz objects. The "modelStoreToken" option or
+// MODEL_STORE_TOKEN environment variable provide authorization token of HTTP
+// store.
+// Uploaded models are validated and pushed to the store, deleted models are
+// removed from it, and models which are not present in local model area are
+// fetched from the store on first request. It allows to run any number of
+// replicas behind load balancer where any replica can serve any model.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ModelStore represents external store of model bundles
+type ModelStore interface {
+	Get(name string, w io.Writer) error // write tar.gz bundle of given model
+	Put(name string, r io.Reader) error // store tar.gz bundle of given model
+	Delete(name string) error           // remove bundle of given model
+}
+
+// errModelNotInStore is returned when model is not present in the store
+var errModelNotInStore = errors.New("model is not found in model store")
+
+// dirStore implements ModelStore in shared directory
+type dirStore struct {
+	path string
+}
+
+// helper function to return bundle file name of given model
+func (s *dirStore) bundle(name string) string {
+	return filepath.Join(s.path, name+".tar.gz")
+}
+
+// Get implements ModelStore interface
+func (s *dirStore) Get(name string, w io.Writer) error {
+	file, err := os.Open(s.bundle(name))
+	if os.IsNotExist(err) {
+		return errModelNotInStore
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Put implements ModelStore interface, the bundle is written into temporary
+// file and renamed such that other replicas never read partial bundles
+func (s *dirStore) Put(name string, r io.Reader) error {
+	file, err := ioutil.TempFile(s.path, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.bundle(name))
+}
+
+// Delete implements ModelStore interface
+func (s *dirStore) Delete(name string) error {
+	err := os.Remove(s.bundle(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// httpStore implements ModelStore via HTTP object store
+type httpStore struct {
+	url   string
+	token string
+}
+
+// helper function to perform request to HTTP store
+func (s *httpStore) request(method, name string, body io.Reader) (*http.Response, error) {
+	rurl := fmt.Sprintf("%s/%s.tar.gz", strings.TrimSuffix(s.url, "/"), url.PathEscape(name))
+	req, err := http.NewRequest(method, rurl, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	client := _client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method != "DELETE" {
+		resp.Body.Close()
+		return nil, errModelNotInStore
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, rurl, resp.Status)
+	}
+	return resp, nil
+}
+
+// Get implements ModelStore interface
+func (s *httpStore) Get(name string, w io.Writer) error {
+	resp, err := s.request("GET", name, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Put implements ModelStore interface
+func (s *httpStore) Put(name string, r io.Reader) error {
+	resp, err := s.request("PUT", name, r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete implements ModelStore interface
+func (s *httpStore) Delete(name string) error {
+	resp, err := s.request("DELETE", name, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// helper function to create model store for given URI
+func newModelStore(uri string) (ModelStore, error) {
+	switch {
+	case uri == "":
+		return nil, errors.New("model store is not configured")
+	case strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://"):
+		token := _config.ModelStoreToken
+		if token == "" {
+			token = os.Getenv("MODEL_STORE_TOKEN")
+		}
+		return &httpStore{url: uri, token: token}, nil
+	}
+	path := strings.TrimPrefix(uri, "file://")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &dirStore{path: path}, nil
+}
+
+// global model store of stateless mode
+var _store ModelStore
+
+// initStore sets up model store of stateless mode
+func initStore() error {
+	if !_config.Stateless {
+		return nil
+	}
+	store, err := newModelStore(_config.ModelStore)
+	if err != nil {
+		return err
+	}
+	_store = store
+	log.Printf("stateless mode with model store %s", _config.ModelStore)
+	return nil
+}
+
+// helper function to push model from given path into model store
+func pushModel(path, name string) error {
+	if _store == nil {
+		return nil
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBundle(writer, path))
+	}()
+	err := _store.Put(name, reader)
+	reader.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("unable to push model %s to model store: %v", name, err)
+	}
+	log.Printf("push model %s to model store", name)
+	return nil
+}
+
+// helper function to remove model from model store
+func unpushModel(name string) error {
+	if _store == nil {
+		return nil
+	}
+	return _store.Delete(name)
+}
+
+// lock of models fetched from model store
+var fetchLock sync.Mutex
+
+// helper function to fetch model from model store into model area if it is
+// not present there
+func fetchModel(name string) error {
+	if _store == nil || name == "" || modelExists(name) {
+		return nil
+	}
+	fetchLock.Lock()
+	defer fetchLock.Unlock()
+	// model could be fetched while we waited for the lock
+	if modelExists(name) {
+		return nil
+	}
+	file, err := ioutil.TempFile("", "store-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	err = _store.Get(name, file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("unable to fetch model %s: %v", name, err)
+	}
+	tarball, err := gunzipFile(file.Name())
+	if err != nil {
+		return err
+	}
+	if tarball != file.Name() {
+		defer os.Remove(tarball)
+	}
+	staging, err := stagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	bdir := filepath.Join(staging, "bundle")
+	if _, err := Untar(tarball, bdir); err != nil {
+		return err
+	}
+	if err := validateModel(bdir, name); err != nil {
+		return fmt.Errorf("invalid %s model in model store: %v", name, err)
+	}
+	installLock.Lock()
+	defer installLock.Unlock()
+	if err := os.Rename(bdir, filepath.Join(_config.ModelDir, name)); err != nil {
+		return err
+	}
+	resetModelCache(name)
+	log.Printf("fetch model %s from model store", name)
+	publish(EventReload, name, "model is fetched from model store")
+	return nil
+}
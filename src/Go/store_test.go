@@ -0,0 +1,145 @@
+package main
+
+// tests of stateless mode with external model store, they do not require TF C library
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// helper function to setup stateless mode with given model store
+func setupStore(t *testing.T, uri string) {
+	_config.Stateless = true
+	_config.ModelStore = uri
+	if err := initStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _store = nil })
+}
+
+// helper function to move model from model area into given model store
+func storeModel(t *testing.T, store ModelStore, name string) {
+	path := filepath.Join(_config.ModelDir, name)
+	var buf bytes.Buffer
+	if err := writeBundle(&buf, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(name, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+	resetModelCache(name)
+}
+
+// TestDirStore checks that models are fetched from, pushed to and removed
+// from shared directory store
+func TestDirStore(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	sdir := filepath.Join(t.TempDir(), "store")
+	setupStore(t, "file://"+sdir)
+	storeModel(t, _store, "dnn2")
+
+	// any instance serves model from the store
+	probs, err := makePredictions(testRow("dnn2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if !modelExists("dnn2") {
+		t.Error("model dnn2 is not fetched into model area")
+	}
+	if _, err := makePredictions(testRow("unknown")); err == nil || !strings.Contains(err.Error(), errModelNotInStore.Error()) {
+		t.Errorf("unexpected error of unknown model: %v", err)
+	}
+
+	// uploaded models are pushed to the store
+	staging, err := stagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeModelFiles(t, "dnn3", []byte("dnn3"), TFParams{InputNode: "input", OutputNode: "output"})
+	os.Remove(staging)
+	if err := os.Rename(filepath.Join(_config.ModelDir, "dnn3"), staging); err != nil {
+		t.Fatal(err)
+	}
+	if err := installModel(staging, "dnn3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dnn3.tar.gz")); err != nil {
+		t.Error("model dnn3 is not pushed to model store", err)
+	}
+
+	// deleted models are removed from the store
+	initLimiter("1000-S")
+	router := handlers()
+	req := httptest.NewRequest("DELETE", "/delete/dnn3", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dnn3.tar.gz")); !os.IsNotExist(err) {
+		t.Error("model dnn3 is not removed from model store", err)
+	}
+}
+
+// TestHTTPStore checks round trip of model bundles via HTTP object store
+func TestHTTPStore(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = data
+		case "DELETE":
+			delete(objects, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	os.Setenv("MODEL_STORE_TOKEN", "secret")
+	defer os.Unsetenv("MODEL_STORE_TOKEN")
+	setupStore(t, server.URL+"/models/")
+	storeModel(t, _store, "dnn")
+	if _, ok := objects["/models/dnn.tar.gz"]; !ok {
+		t.Fatalf("model dnn is not stored, objects %v", objects)
+	}
+	probs, err := makePredictions(testRow("dnn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if err := _store.Delete("dnn"); err != nil {
+		t.Fatal(err)
+	}
+	if err := _store.Delete("dnn"); err != nil {
+		t.Error("removal of missing model should succeed", err)
+	}
+	if err := _store.Get("dnn", io.Discard); err != errModelNotInStore {
+		t.Errorf("unexpected error of missing model: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+// stream module provides streaming of large batch predictions
+//
+// Batches of /predict/batch endpoint are scored in chunks of rows and
+// instead of single JSON array of predictions the results can be
+// - streamed as newline delimited JSON (one array of outputs per row) with
+//   chunked transfer encoding when client accepts application/x-ndjson (or
+//   format=ndjson) or provides stream=true query parameter, errors which happen after the
+//   response is started are reported by the last {"error": "..."} line;
+// - written to results store when client provides output=store query
+//   parameter, the response provides URL of the results object. The results
+//   store is either directory ("resultsStore": "/mnt/results", where
+//   "resultsURL" option provides public URL of the directory) or HTTP object
+//   store ("resultsStore": "https://store.example.com/results") which accepts
+//   PUT of <url>/<object> with optional "resultsStoreToken" bearer token.
+// Neither the server nor the client keep all predictions in memory then.
+// Please note that responses of signed endpoints (see signing module) are
+// buffered to be signed and therefore they are not streamed.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// content type of newline delimited JSON
+const ndjsonType = "application/x-ndjson"
+
+// number of rows of batch scored at once in streaming mode
+const streamChunkSize = 1000
+
+// helper function to check if client requests streaming of predictions,
+// ctype is negotiated output format (see output module)
+func streamRequested(r *http.Request, ctype string) bool {
+	return ctype == ndjsonType || r.URL.Query().Get("stream") == "true"
+}
+
+// helper function to score batch tensor in chunks of rows, given function
+// is called with predictions of every chunk
+func scoreBatchChunks(model string, keys []string, tensor TFTensor, fn func([][]float32) error) error {
+	shape := tensor.Shape()
+	if len(shape) != 2 || shape[0] <= streamChunkSize {
+		// only rank-2 batches are split into chunks
+		probs, err := makeBatchPredictions(model, keys, tensor)
+		if err != nil {
+			return err
+		}
+		return fn(probs)
+	}
+	rows, err := tensorRows(tensor)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(rows); start += streamChunkSize {
+		end := start + streamChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		values := make([]float32, 0, (end-start)*int(shape[1]))
+		for _, row := range rows[start:end] {
+			values = append(values, row...)
+		}
+		chunk, err := makeFlatTensor(values, []int64{int64(end - start), shape[1]})
+		if err != nil {
+			return err
+		}
+		probs, err := makeBatchPredictions(model, keys, chunk)
+		if err != nil {
+			return err
+		}
+		if err := fn(probs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to write predictions as newline delimited JSON rounded
+// to given number of significant digits
+func writeNDJSON(w io.Writer, probs [][]float32, digits int) error {
+	b := getBuffer()
+	defer putBuffer(b)
+	for _, p := range probs {
+		data := appendFloats(b.Bytes()[:0], p, digits)
+		data = append(data, '\n')
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamBatchProbs writes predictions of batch as newline delimited JSON
+func streamBatchProbs(w http.ResponseWriter, model string, keys []string, tensor TFTensor, raw bool) {
+	started := false
+	flusher, _ := w.(http.Flusher)
+	err := scoreBatchChunks(model, keys, tensor, func(probs [][]float32) error {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonType)
+			setOutputShapeHeader(w, model, "")
+			setRawOutputsHeader(w, raw)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := writeNDJSON(w, probs, outputDigits(raw)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	publish(EventPredictionFailed, model, err.Error())
+	if !started {
+		responseError(w, "unable to make batch predictions", err, http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "{\"error\": %q}\n", err.Error())
+}
+
+// helper function to upload results file into results store, it returns
+// URL of the results object
+func putResults(name string, file *os.File) (string, error) {
+	store := _config.ResultsStore
+	if store == "" {
+		return "", errors.New("results store is not configured")
+	}
+	if strings.HasPrefix(store, "http://") || strings.HasPrefix(store, "https://") {
+		rurl := fmt.Sprintf("%s/%s", strings.TrimSuffix(store, "/"), url.PathEscape(name))
+		req, err := http.NewRequest("PUT", rurl, file)
+		if err != nil {
+			return "", err
+		}
+		if info, err := file.Stat(); err == nil {
+			req.ContentLength = info.Size()
+		}
+		req.Header.Set("Content-Type", ndjsonType)
+		if _config.ResultsStoreToken != "" {
+			req.Header.Set("Authorization", "Bearer "+_config.ResultsStoreToken)
+		}
+		client := _client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return "", fmt.Errorf("PUT %s: %s", rurl, resp.Status)
+		}
+		return rurl, nil
+	}
+	dir := strings.TrimPrefix(store, "file://")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fname := filepath.Join(dir, name)
+	out, err := os.Create(fname)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, file)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname)
+		return "", err
+	}
+	if _config.ResultsURL != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimSuffix(_config.ResultsURL, "/"), name), nil
+	}
+	return "file://" + fname, nil
+}
+
+// BatchResults represents results of batch written to results store
+type BatchResults struct {
+	URL    string `json:"url"`    // URL of results object
+	Rows   int64  `json:"rows"`   // number of rows of results
+	Format string `json:"format"` // format of results object
+}
+
+// storeBatchProbs writes predictions of batch into results store
+func storeBatchProbs(w http.ResponseWriter, model string, keys []string, tensor TFTensor, raw bool) {
+	if _config.ResultsStore == "" {
+		responseError(w, "results store is not configured", nil, http.StatusBadRequest)
+		return
+	}
+	file, err := ioutil.TempFile("", "results-*.ndjson")
+	if err != nil {
+		responseError(w, "unable to create results file", err, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	var rows int64
+	err = scoreBatchChunks(model, keys, tensor, func(probs [][]float32) error {
+		rows += int64(len(probs))
+		return writeNDJSON(file, probs, outputDigits(raw))
+	})
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make batch predictions", err, http.StatusInternalServerError)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		responseError(w, "unable to read results file", err, http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("%s-%s-%s.ndjson", resolveModel(model), time.Now().UTC().Format("20060102T150405Z"), newJobID())
+	rurl, err := putResults(name, file)
+	if err != nil {
+		responseError(w, "unable to write results", err, http.StatusBadGateway)
+		return
+	}
+	responseJSON(w, BatchResults{URL: rurl, Rows: rows, Format: "ndjson"})
+}
@@ -0,0 +1,132 @@
+package main
+
+// tests of streaming of batch predictions, they do not require TF C library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function to create JSON batch request with given number of rows
+func streamBatch(t *testing.T, nrows int) []byte {
+	var values []float32
+	for i := 0; i < nrows; i++ {
+		values = append(values, testRow("dnn").Values...)
+	}
+	batch := BatchRow{Model: "dnn", Values: values, Shape: []int64{int64(nrows), testNumKeys}}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// helper function to check newline delimited predictions
+func checkNDJSON(t *testing.T, data []byte, nrows int) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var n int
+	for scanner.Scan() {
+		var probs []float32
+		if err := json.Unmarshal(scanner.Bytes(), &probs); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		checkProbs(t, probs)
+		n++
+	}
+	if n != nrows {
+		t.Fatalf("wrong number of predictions %d, expected %d", n, nrows)
+	}
+}
+
+// TestStreamBatch checks streaming of batch predictions in chunks
+func TestStreamBatch(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := 2*streamChunkSize + 5
+	req := httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(streamBatch(t, nrows)))
+	req.Header.Set("Accept", ndjsonType)
+	w := httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	if ctype := w.Header().Get("Content-Type"); ctype != ndjsonType {
+		t.Fatalf("wrong content type %s", ctype)
+	}
+	checkNDJSON(t, w.Body.Bytes(), nrows)
+
+	// errors before the response is started are reported as usual
+	data := bytes.Replace(streamBatch(t, 3), []byte(`"dnn"`), []byte(`"unknown"`), 1)
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch?stream=true", bytes.NewReader(data)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong status code %d for unknown model", w.Code)
+	}
+}
+
+// TestStoreBatch checks writing of batch predictions into results store
+func TestStoreBatch(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := streamChunkSize + 1
+	rurl := "/predict/batch?output=store"
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", rurl, bytes.NewReader(streamBatch(t, nrows))))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d without results store", w.Code)
+	}
+
+	// directory store
+	_config.ResultsStore = filepath.Join(_config.ModelDir, ".results")
+	_config.ResultsURL = "https://results.example.com/tfaas/"
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", rurl, bytes.NewReader(streamBatch(t, nrows))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var res BatchResults
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimPrefix(res.URL, "https://results.example.com/tfaas/")
+	if res.Rows != int64(nrows) || name == res.URL || !strings.HasPrefix(name, "dnn-") {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(_config.ResultsStore, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNDJSON(t, data, nrows)
+
+	// HTTP store
+	var stored []byte
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		stored, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	_config.ResultsStore = srv.URL + "/results"
+	_config.ResultsStoreToken = "secret"
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", rurl, bytes.NewReader(streamBatch(t, 3))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	res = BatchResults{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if !strings.HasPrefix(res.URL, srv.URL+"/results/dnn-") || auth != "Bearer secret" {
+		t.Fatalf("unexpected results %+v, authorization %q", res, auth)
+	}
+	checkNDJSON(t, stored, 3)
+}
@@ -0,0 +1,265 @@
+package main
+
+// tensor module provides predictions for tensors of explicit shape and dtype
+//
+// Inputs of some models do not map onto flat float vectors or images, e.g.
+// token ids, integer categories or string features. POST /tensor feeds
+// tensor of given data type and shape directly to the model, e.g.
+// {"model": "ranker", "dtype": "int64", "shape": [2, 3], "data": [1,2,3,4,5,6]}
+// where data is flat vector of values in row-major order. Clients may also
+// send raw little endian values with application/octet-stream content type,
+// e.g. POST /tensor?model=ranker&dtype=int64&shape=2,3
+// Supported dtypes are float (float32), double (float64), int32, int64,
+// uint8, bool and string (JSON only). The response contains output tensor
+// of the model with its shape, e.g. {"shape": [2, 1], "data": [0.1, 0.7]}.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TensorRequest represents tensor of explicit shape and data type
+type TensorRequest struct {
+	Model string          `json:"model"` // TF model name to use
+	DType string          `json:"dtype"` // data type of tensor values, default float
+	Shape []int64         `json:"shape"` // shape of the tensor
+	Data  json.RawMessage `json:"data"`  // flat vector of tensor values
+}
+
+// helper function to normalize data type name
+func tensorDType(dtype string) string {
+	switch dtype {
+	case "", "float":
+		return "float32"
+	case "double":
+		return "float64"
+	}
+	return dtype
+}
+
+// helper function to decode JSON values of given data type into flat slice
+// of corresponding Go type
+func decodeTensorData(dtype string, data []byte) (interface{}, int, error) {
+	var values interface{}
+	switch tensorDType(dtype) {
+	case "float32":
+		values = &[]float32{}
+	case "float64":
+		values = &[]float64{}
+	case "int32":
+		values = &[]int32{}
+	case "int64":
+		values = &[]int64{}
+	case "uint8":
+		// encoding/json treats []uint8 as base64 string
+		values = &[]uint16{}
+	case "bool":
+		values = &[]bool{}
+	case "string":
+		values = &[]string{}
+	default:
+		return nil, 0, fmt.Errorf("unsupported dtype %s", dtype)
+	}
+	if err := json.Unmarshal(data, values); err != nil {
+		return nil, 0, err
+	}
+	switch v := values.(type) {
+	case *[]float32:
+		return *v, len(*v), nil
+	case *[]float64:
+		return *v, len(*v), nil
+	case *[]int32:
+		return *v, len(*v), nil
+	case *[]int64:
+		return *v, len(*v), nil
+	case *[]uint16:
+		out := make([]uint8, len(*v))
+		for i, u := range *v {
+			if u > math.MaxUint8 {
+				return nil, 0, fmt.Errorf("value %d is out of uint8 range", u)
+			}
+			out[i] = uint8(u)
+		}
+		return out, len(out), nil
+	case *[]bool:
+		return *v, len(*v), nil
+	}
+	v := values.(*[]string)
+	return *v, len(*v), nil
+}
+
+// helper function to decode raw little endian values of given data type
+// into flat slice of corresponding Go type
+func decodeTensorBytes(dtype string, data []byte) (interface{}, int, error) {
+	size := map[string]int{
+		"float32": 4, "float64": 8, "int32": 4, "int64": 8, "uint8": 1, "bool": 1,
+	}[tensorDType(dtype)]
+	if size == 0 {
+		return nil, 0, fmt.Errorf("unsupported dtype %s of binary tensor", dtype)
+	}
+	if len(data)%size != 0 {
+		return nil, 0, fmt.Errorf("size %d of %s tensor is not multiple of %d", len(data), dtype, size)
+	}
+	n := len(data) / size
+	switch tensorDType(dtype) {
+	case "float32":
+		values := make([]float32, n)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+		return values, n, nil
+	case "float64":
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+		}
+		return values, n, nil
+	case "int32":
+		values := make([]int32, n)
+		for i := range values {
+			values[i] = int32(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+		return values, n, nil
+	case "int64":
+		values := make([]int64, n)
+		for i := range values {
+			values[i] = int64(binary.LittleEndian.Uint64(data[i*8:]))
+		}
+		return values, n, nil
+	case "bool":
+		values := make([]bool, n)
+		for i, b := range data {
+			values[i] = b != 0
+		}
+		return values, n, nil
+	}
+	return append([]uint8{}, data...), n, nil
+}
+
+// helper function to read tensor request from HTTP request
+func readTensorRequest(r *http.Request) (string, TFTensor, error) {
+	var req TensorRequest
+	var values interface{}
+	var n int
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream") {
+		query := r.URL.Query()
+		req.Model, req.DType = query.Get("model"), query.Get("dtype")
+		shape, err := parseShape(query.Get("shape"))
+		if err != nil {
+			return req.Model, nil, err
+		}
+		req.Shape = shape
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return req.Model, nil, err
+		}
+		if values, n, err = decodeTensorBytes(req.DType, data); err != nil {
+			return req.Model, nil, err
+		}
+	} else {
+		buf, err := readBuffer(r.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		defer putBuffer(buf)
+		if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+			return "", nil, err
+		}
+		if len(req.Data) == 0 {
+			return req.Model, nil, errors.New("tensor without data")
+		}
+		if values, n, err = decodeTensorData(req.DType, req.Data); err != nil {
+			return req.Model, nil, err
+		}
+	}
+	size, err := shapeSize(req.Shape)
+	if err != nil {
+		return req.Model, nil, err
+	}
+	if int64(n) != size {
+		return req.Model, nil, fmt.Errorf("number of values %d does not match shape %v", n, req.Shape)
+	}
+	tensor, err := _tf.NewTypedTensor(values, req.Shape)
+	return req.Model, tensor, err
+}
+
+// helper function to run model on given tensor, it returns output tensor
+// of the model
+func predictTensor(name string, tensor TFTensor) (output TFTensor, err error) {
+	name = resolveModel(name)
+	start := time.Now()
+	defer func() { observeModelSLO(name, time.Since(start), err) }()
+	if err := breakerCheck(name); err != nil {
+		return nil, err
+	}
+	if err := injectModelFaults(name); err != nil {
+		return nil, err
+	}
+	tfModel, err := tfVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	if tfModel == xgboostBackend {
+		return nil, fmt.Errorf("model %s does not accept tensor inputs", name)
+	}
+	touchModel(name)
+	graph, input, out, err := modelGraph(name, tfModel)
+	if err != nil {
+		return nil, err
+	}
+	results, err := runSession(name, graph, map[string]TFTensor{input: tensor}, []string{out})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// TensorHandler provides predictions for tensor of explicit shape and dtype
+func TensorHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectLargeBatch(w, r) || decodeRequestBody(w, r) {
+		return
+	}
+	defer r.Body.Close()
+	model, tensor, err := readTensorRequest(r)
+	if err != nil {
+		responseError(w, "unable to read tensor", err, http.StatusBadRequest)
+		return
+	}
+	if model == "" {
+		model = _params.Name
+	}
+	observeUsage(usageClient(r), model, tensorRowsCount(tensor))
+	output, err := predictTensor(model, tensor)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
+		return
+	}
+	values, shape, err := flattenTensor(output)
+	if err != nil {
+		responseError(w, "unsupported model output", err, http.StatusInternalServerError)
+		return
+	}
+	raw := rawOutputs(model, rawRequested(r))
+	setRawOutputsHeader(w, raw)
+	responseBytes(w, func(b []byte) []byte {
+		b = append(b, `{"shape":[`...)
+		for i, d := range shape {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = strconv.AppendInt(b, d, 10)
+		}
+		b = append(b, `],"data":`...)
+		b = appendFloats(b, values, outputDigits(raw))
+		return append(b, '}')
+	})
+}
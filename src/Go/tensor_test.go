@@ -0,0 +1,106 @@
+package main
+
+// tests of tensor predictions, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDecodeTensorData checks decoding of tensor values of various dtypes
+func TestDecodeTensorData(t *testing.T) {
+	for _, tt := range []struct {
+		dtype string
+		data  string
+		value interface{}
+	}{
+		{"", "[1.5, 2]", []float32{1.5, 2}},
+		{"double", "[1.5]", []float64{1.5}},
+		{"int32", "[1, -2]", []int32{1, -2}},
+		{"int64", "[3]", []int64{3}},
+		{"uint8", "[0, 255]", []uint8{0, 255}},
+		{"bool", "[true, false]", []bool{true, false}},
+		{"string", `["a", "b"]`, []string{"a", "b"}},
+	} {
+		value, n, err := decodeTensorData(tt.dtype, []byte(tt.data))
+		if err != nil {
+			t.Fatal(tt.dtype, err)
+		}
+		if !reflect.DeepEqual(value, tt.value) || n != reflect.ValueOf(tt.value).Len() {
+			t.Errorf("wrong %s values %v", tt.dtype, value)
+		}
+	}
+	for _, tt := range [][2]string{{"uint8", "[256]"}, {"int32", "[1.5]"}, {"complex64", "[1]"}} {
+		if _, _, err := decodeTensorData(tt[0], []byte(tt[1])); err == nil {
+			t.Errorf("invalid %s data %s is accepted", tt[0], tt[1])
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []int64{7, -1})
+	value, n, err := decodeTensorBytes("int64", buf.Bytes())
+	if err != nil || n != 2 || !reflect.DeepEqual(value, []int64{7, -1}) {
+		t.Errorf("wrong binary values %v: %v", value, err)
+	}
+	if _, _, err := decodeTensorBytes("int64", buf.Bytes()[:5]); err == nil {
+		t.Error("truncated binary tensor is accepted")
+	}
+	if _, _, err := decodeTensorBytes("string", buf.Bytes()); err == nil {
+		t.Error("binary string tensor is accepted")
+	}
+}
+
+// TestFakeTensor checks predictions of tensor endpoint
+func TestFakeTensor(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	body := `{"model": "dnn", "dtype": "int64", "shape": [2, 3], "data": [1, 2, 3, 4, 5, 6]}`
+	req := httptest.NewRequest("POST", "/tensor", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	TensorHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var res struct {
+		Shape []int64
+		Data  []float32
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Shape, []int64{2, 3}) || len(res.Data) != 6 {
+		t.Fatalf("wrong tensor response %s", rr.Body.String())
+	}
+	input := fake.Feeds()["input"]
+	if !reflect.DeepEqual(input.Value(), []int64{1, 2, 3, 4, 5, 6}) || !reflect.DeepEqual(input.Shape(), []int64{2, 3}) {
+		t.Errorf("wrong input tensor %v %v", input.Value(), input.Shape())
+	}
+
+	// binary tensor
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []int32{1, 2, 3, 4})
+	req = httptest.NewRequest("POST", "/tensor?model=dnn&dtype=int32&shape=1,4", &buf)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	TensorHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	if input := fake.Feeds()["input"]; !reflect.DeepEqual(input.Value(), []int32{1, 2, 3, 4}) {
+		t.Errorf("wrong binary input tensor %v", input.Value())
+	}
+
+	// values should match shape
+	body = `{"model": "dnn", "dtype": "bool", "shape": [2, 2], "data": [true]}`
+	req = httptest.NewRequest("POST", "/tensor", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	TensorHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status %d of mismatched shape", rr.Code)
+	}
+}
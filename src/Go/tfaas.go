@@ -11,21 +11,22 @@ import (
 	"log"
 	"os"
 	"sort"
+	"sync"
 	"time"
-
-	tf "github.com/galeone/tensorflow/tensorflow/go"
-	"github.com/galeone/tensorflow/tensorflow/go/op"
-	tg "github.com/galeone/tfgo"
 )
 
 // tfCache represent cache for TF 2.X models
-var tfCache map[string]*tg.Model
+var tfCache map[string]TFGraph
 var tfCacheParams map[string]TFParams
 
+// tfCacheLock protects access to TF 2.X caches
+var tfCacheLock sync.Mutex
+
 // ClassifyResult structure represents result of our TF model classification
 type ClassifyResult struct {
 	Filename string        `json:"filename"`
 	Labels   []LabelResult `json:"labels"`
+	Decision []string      `json:"decision,omitempty"` // labels which reached their thresholds
 }
 
 // LabelResult structure represents single result of TF model classification
@@ -39,12 +40,60 @@ type Row struct {
 	Keys   []string  `json:"keys"`   // row attribute names
 	Values []float32 `json:"values"` // row values
 	Model  string    `json:"model"`  // TF model name to use
+	Text   string    `json:"text"`   // raw text input of NLP models
+
+	// sequence input of RNN/transformer models, timesteps x features
+	Sequence [][]float32 `json:"sequence,omitempty"`
+
+	// sparse input, values of given indices of dense vector of dim size
+	Indices []int64 `json:"indices,omitempty"`
+	Dim     int64   `json:"dim,omitempty"`
+
+	// per-request overrides of model parameters
+	Overrides *Overrides `json:"overrides,omitempty"`
+
+	// return raw model outputs, see raw module
+	Raw bool `json:"raw,omitempty"`
+
+	// raw string features hashed by the server, see hashing module
+	Categorical map[string]string `json:"categorical,omitempty"`
+
+	// client event identifier returned and logged with predictions, see eventid module
+	EventID string `json:"eventID,omitempty"`
+
+	// trace of slow request, see slowtraces module
+	trace *RequestTrace
+
+	// golden set check of the server, it is not counted as model usage,
+	// see selftest module
+	selfTest bool
 }
 
 func (r *Row) String() string {
+	if len(r.Sequence) > 0 {
+		return fmt.Sprintf("%v", r.Sequence)
+	}
 	return fmt.Sprintf("%v", r.Values)
 }
 
+// helper function to create input tensor of given row, the row values are
+// represented by [1, nvalues] tensor, while sequence by rank-3 tensor
+// [1, timesteps, features]
+func makeRowTensor(row *Row) (TFTensor, error) {
+	if len(row.Sequence) == 0 {
+		return makeFlatTensor(row.Values, []int64{1, int64(len(row.Values))})
+	}
+	nfeatures := len(row.Sequence[0])
+	values := make([]float32, 0, len(row.Sequence)*nfeatures)
+	for i, step := range row.Sequence {
+		if len(step) != nfeatures {
+			return nil, fmt.Errorf("timestep %d has %d features while first timestep has %d", i, len(step), nfeatures)
+		}
+		values = append(values, step...)
+	}
+	return makeFlatTensor(values, []int64{1, int64(len(row.Sequence)), int64(nfeatures)})
+}
+
 // TFParams provides meta-data description of TF model to be used
 type TFParams struct {
 	Name        string   `json:"name"`         // model name
@@ -59,6 +108,83 @@ type TFParams struct {
 	OutputNode  string   `json:"output_node"`  // model output node name
 	Description string   `json:"description"`  // model description
 	TimeStamp   string   `json:"timestamp"`    // model timestamp
+	Golden      string   `json:"golden"`       // model golden test set file name
+	Backend     string   `json:"backend"`      // model backend: tensorflow (default) or xgboost
+
+	MinTFVersion string `json:"min_tf_version,omitempty"` // minimal TF version required by the model
+
+	InputIndex  int `json:"input_index,omitempty"`  // output index of input operation, e.g. input:1
+	OutputIndex int `json:"output_index,omitempty"` // output index of output operation, e.g. output:1
+
+	ConstFeeds []ConstFeed `json:"const_feeds,omitempty"` // constant feeds of every session run, e.g. keep_prob
+
+	Overridable []string `json:"overridable,omitempty"` // parameters which requests may override, e.g. output_node
+
+	Fallback *Fallback `json:"fallback,omitempty"` // fallback used when model inference fails
+
+	Tokenizer *TokenizerConfig `json:"tokenizer,omitempty"` // tokenizer of text input
+
+	Namespace string `json:"namespace,omitempty"` // model namespace used by authorization policy
+
+	EncryptionKey string `json:"encryption_key,omitempty"` // name of AES key of encrypted model file, see modelKeys option
+
+	Sensitive []string `json:"sensitive,omitempty"` // sensitive features redacted in logs and captured traffic
+	Redaction string   `json:"redaction,omitempty"` // redaction of sensitive features: hash (default) or drop
+
+	TopK int `json:"top_k,omitempty"` // number of best labels computed by TopK operation in the graph
+
+	RawOutputs bool `json:"raw_outputs,omitempty"` // always return raw model outputs
+
+	Thresholds map[string]float32 `json:"thresholds,omitempty"` // decision thresholds of classes, see decision module
+	Threshold  float32            `json:"threshold,omitempty"`  // decision threshold of classes without their own threshold
+
+	Hashing []HashedFeature `json:"hashing,omitempty"` // string features hashed into buckets, see hashing module
+
+	CentralCrop float64 `json:"central_crop,omitempty"` // fraction of central crop of images, e.g. 0.8
+
+	Segmentation *SegmentationConfig `json:"segmentation,omitempty"` // masks of segmentation models, see segmentation module
+
+	Audio *AudioConfig `json:"audio,omitempty"` // audio preprocessing of audio models, see audio module
+
+	State *StateConfig `json:"state,omitempty"` // state tensors of stateful models, see stateful module
+
+	Schema []FeatureSchema `json:"schema,omitempty"` // input features and their value ranges, see validate module
+
+	InputSchema string `json:"input_schema,omitempty"` // JSON Schema or Avro schema file of input payloads, see schemas module
+
+	Sinks []string `json:"sinks,omitempty"` // names of output sinks of predictions, see resultsinks module
+
+	SessionPreset string `json:"session_preset,omitempty"` // named TF session preset, e.g. low-latency, see presets module
+
+	CPUSet   string `json:"cpu_set,omitempty"`   // CPUs of TF threads of the model, e.g. 0-15,32-47, see pinning module
+	NUMANode *int   `json:"numa_node,omitempty"` // NUMA node of TF threads of the model, see pinning module
+
+	Batching *BatchingConfig `json:"batching,omitempty"` // micro-batching of single row predictions, see batching module
+}
+
+// default input and output names of TF 2.X saved models
+const (
+	defaultTF2InputName  = "serving_default_inputs_input"
+	defaultTF2OutputName = "StatefulPartitionedCall"
+)
+
+// nodes returns input and output operation names of TF 1.X model including
+// their output indices
+func (p *TFParams) nodes() (string, string) {
+	return outputIndexName(p.InputNode, p.InputIndex), outputIndexName(p.OutputNode, p.OutputIndex)
+}
+
+// tf2Nodes returns input and output operation names of TF 2.X model including
+// their output indices, e.g. StatefulPartitionedCall:1
+func (p *TFParams) tf2Nodes() (string, string) {
+	input, output := p.InputName, p.OutputName
+	if input == "" {
+		input = defaultTF2InputName
+	}
+	if output == "" {
+		output = defaultTF2OutputName
+	}
+	return outputIndexName(input, p.InputIndex), outputIndexName(output, p.OutputIndex)
 }
 
 // String provides string representation of TFParams
@@ -66,12 +192,11 @@ func (p *TFParams) String() string {
 	return fmt.Sprintf("<TFParams: name=%s model=%s description=%s labels=%s options=%v inputNode=%s outputNode=%s, timestamp=%s>", p.Name, p.Model, p.Description, p.Labels, p.Options, p.InputNode, p.OutputNode, p.TimeStamp)
 }
 
-// TFModel holds actual TF model (graph, labels, session options)
+// TFModel holds actual TF model (graph and labels)
 type TFModel struct {
-	Params         TFParams
-	Graph          *tf.Graph
-	Labels         []string
-	SessionOptions *tf.SessionOptions
+	Params TFParams
+	Graph  TFGraph
+	Labels []string
 }
 
 // helper function to load TF graph and labels
@@ -84,7 +209,7 @@ func (m *TFModel) loadModel() error {
 	if VERBOSE > 0 {
 		log.Println("load to cache", modelPath, modelLabels)
 	}
-	graph, labels, err := loadModel(modelPath, modelLabels)
+	graph, labels, err := loadModel(modelPath, modelLabels, m.Params.EncryptionKey)
 	if err != nil {
 		return err
 	}
@@ -103,6 +228,7 @@ type TFCacheEntry struct {
 type TFCache struct {
 	Models map[string]TFCacheEntry
 	Limit  int
+	mutex  sync.Mutex
 }
 
 // add TFModel to the cache
@@ -132,12 +258,23 @@ func (c *TFCache) add(name string) error {
 		log.Println("add to TFCache", params)
 	}
 	tfm := TFModel{Params: params}
-	err = tfm.loadModel()
+	err = injectLoadFault(name)
+	if err == nil {
+		err = checkModelTFVersion(path)
+	}
+	if err == nil {
+		err = tfm.loadModel()
+	}
+	if err == nil && (tfm.Params.InputNode == "" || tfm.Params.OutputNode == "") {
+		err = tfm.discoverNodes()
+	}
 	if err == nil {
 		c.Models[params.Name] = TFCacheEntry{TFModel: tfm, Time: time.Now()}
+		publish(EventReload, name, "model is loaded into cache")
 	} else {
 		log.Println("unable to load TF model", err)
-
+		publish(EventLoadFailure, name, err.Error())
+		breakerFailure(name, err)
 	}
 	if VERBOSE > 0 {
 		log.Println("add to TFCache", c)
@@ -147,11 +284,15 @@ func (c *TFCache) add(name string) error {
 
 // remove given model from the cache
 func (c *TFCache) remove(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	delete(c.Models, name)
 }
 
 // return TFModel from the cache
 func (c *TFCache) get(name string) (TFModel, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if entry, ok := c.Models[name]; ok {
 		return entry.TFModel, nil
 	}
@@ -161,12 +302,14 @@ func (c *TFCache) get(name string) (TFModel, error) {
 		var oldestName string
 		oldestTime := time.Now()
 		for name, entry := range c.Models {
-			if entry.Time.Unix() < oldestTime.Unix() {
+			if oldestName == "" || entry.Time.Before(oldestTime) {
 				oldestName = name
 				oldestTime = entry.Time
 			}
 		}
 		delete(c.Models, oldestName)
+		removeSessionPool(oldestName)
+		publish(EventEviction, oldestName, "model is evicted from cache")
 	}
 	// add new model into cache
 	err := c.add(name)
@@ -180,36 +323,20 @@ func (c *TFCache) get(name string) (TFModel, error) {
 
 // global variables
 var (
-	_cache          TFCache            // local cache for TFModels
-	_params         TFParams           // current params set
-	_sessionOptions *tf.SessionOptions // TF session options
-	_configProto    string             // protobuf configuration
+	_cache  TFCache  // local cache for TFModels
+	_params TFParams // current params set
 )
 
-// helper function to read TF config proto message provided in input file
-func readConfigProto(fname string) *tf.SessionOptions {
-	session := tf.SessionOptions{}
-	if fname != "" {
-		body, err := ioutil.ReadFile(fname)
-		if err == nil {
-			session = tf.SessionOptions{Config: body}
-		} else {
-			log.Println("unable to read TF config proto file", err)
-		}
-	}
-	return &session
-}
-
 // helper function to load TF model
-func loadModel(fname, flabels string) (*tf.Graph, []string, error) {
+func loadModel(fname, flabels, key string) (TFGraph, []string, error) {
 	var labels []string
-	graph := tf.NewGraph()
-	// Load inception model
-	model, err := ioutil.ReadFile(fname)
+	// Load inception model, encrypted models are decrypted in memory
+	model, err := readModelFile(fname, key)
 	if err != nil {
-		return graph, labels, err
+		return nil, labels, err
 	}
-	if err := graph.Import(model, ""); err != nil {
+	graph, err := _tf.ImportGraph(model)
+	if err != nil {
 		log.Println("unable to import graph model", fname, err)
 		return graph, labels, err
 	}
@@ -233,6 +360,10 @@ func loadModel(fname, flabels string) (*tf.Graph, []string, error) {
 
 // helper function to determine which model in our repository for given model name
 func tfVersion(name string) (string, error) {
+	// in stateless mode models are fetched from model store on demand
+	if err := fetchModel(name); err != nil {
+		return "", err
+	}
 	// if model area has assets, variables and saved_model.pb
 	// we will use TF 2.X approach based on tfgo
 	path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
@@ -240,6 +371,10 @@ func tfVersion(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// models of other backends declare it in their parameters
+	if isXGBModel(name) {
+		return xgboostBackend, nil
+	}
 	var fnames []string
 	for _, file := range files {
 		fnames = append(fnames, file.Name())
@@ -253,38 +388,134 @@ func tfVersion(name string) (string, error) {
 // helper function to generate predictions based on given row values
 // either TF 2.X models via tfgo or TF 1.X models via graph loading
 func makePredictions(row *Row) ([]float32, error) {
+	probs, _, err := predictWithFallback(row)
+	return probs, err
+}
+
+// helper function to generate predictions based on given row values without
+// fallback of the model
+func predictRow(row *Row) (probs []float32, err error) {
 	name := _params.Name
 	if row.Model != "" {
 		name = row.Model
 	}
+	// resolve model aliases
+	if model := resolveModel(name); model != name {
+		name = model
+		r := *row
+		r.Model = model
+		row = &r
+	}
+	start := time.Now()
+	// self-tests check the model itself and skip SLO, breaker and faults
+	if !row.selfTest {
+		defer func() { observeModelSLO(name, time.Since(start), err) }()
+	}
+	if trace := startTrace(name, row); trace != nil {
+		r := *row
+		r.trace = trace
+		row = &r
+		defer func() { trace.finish(err) }()
+	}
+	if !row.selfTest {
+		if err := breakerCheck(name); err != nil {
+			return nil, err
+		}
+		if err := injectModelFaults(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := row.Overrides.check(name); err != nil {
+		return nil, err
+	}
+	if row.isSparse() {
+		var err error
+		if row, err = densifyRow(row); err != nil {
+			return nil, err
+		}
+	}
+	if len(row.Categorical) > 0 {
+		var err error
+		if row, err = hashRow(name, row); err != nil {
+			return nil, err
+		}
+	}
 	tfModel, err := tfVersion(name)
 	if err != nil {
 		return []float32{}, err
 	}
-	if tfModel == "tf2" {
-		return makePredictions2(row)
+	if !row.selfTest {
+		touchModel(name)
+	}
+	row.trace.stage("preprocess", start)
+	inference := time.Now()
+	switch {
+	case row.Text != "":
+		probs, err = makeTextPredictions(name, tfModel, row)
+	case tfModel == xgboostBackend:
+		if len(row.Sequence) > 0 {
+			return nil, fmt.Errorf("model %s does not accept sequence input", name)
+		}
+		probs, err = makePredictionsXGB(name, row)
+	case rowBatching(name, row) != nil:
+		probs, err = makeBatchedPredictions(name, tfModel, rowBatching(name, row), row)
+	case tfModel == "tf2":
+		probs, err = makePredictions2(row)
+	default:
+		probs, err = makePredictions1(row)
+	}
+	row.trace.stage("inference", inference)
+	if err != nil {
+		return nil, err
+	}
+	if row.Raw || rawOutputs(name, false) {
+		return probs, nil
 	}
-	return makePredictions1(row)
+	defer row.trace.stage("postprocess", time.Now())
+	return row.Overrides.postProcess(probs), nil
 }
 
-// helper function to read tg.Model and its parameters
-func getModel(name string) (*tg.Model, error) {
+// helper function to read TF 2.X model from the cache
+func getModel(name string) (TFGraph, error) {
+	config, cpus, err := modelSessionConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	tfCacheLock.Lock()
+	defer tfCacheLock.Unlock()
 	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
+		tfCache = make(map[string]TFGraph)
 	}
-	var model *tg.Model
-	var ok bool
-	model, ok = tfCache[name]
+	model, ok := tfCache[name]
 	if !ok {
 		path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-		model = tg.LoadModel(path, []string{"serve"}, nil)
+		err = injectLoadFault(name)
+		if err == nil {
+			err = checkModelTFVersion(path)
+		}
+		if err == nil {
+			err = pinnedCall(cpus, func() error {
+				var err error
+				model, err = _tf.LoadSavedModel(path, config)
+				return err
+			})
+		}
+		if err != nil {
+			log.Println("unable to load TF model", err)
+			publish(EventLoadFailure, name, err.Error())
+			breakerFailure(name, err)
+			return nil, err
+		}
 		tfCache[name] = model
+		publish(EventReload, name, "model is loaded into cache")
 	}
 	return model, nil
 }
 
 // helper function to read model parameters
 func getModelParams(name string) (TFParams, error) {
+	tfCacheLock.Lock()
+	defer tfCacheLock.Unlock()
 	if tfCacheParams == nil {
 		tfCacheParams = make(map[string]TFParams)
 	}
@@ -310,20 +541,37 @@ func getModelParams(name string) (TFParams, error) {
 	return params, nil
 }
 
-// helper function to generate predictions based on given row values
-// based on tfgo
-func makePredictionsTensor(name string, tensor *tf.Tensor) ([]float32, error) {
+// helper function to remove given model from all caches
+func resetModelCache(name string) {
+	_cache.remove(name)
+	removeSessionPool(name)
+	removeBatchers(name)
+	removeXGBModel(name)
+	removeTokenizer(name)
+	removeInputSchema(name)
+	removeModelChecksum(name)
+	removeDiscoveredNodes(name)
+	removeConstFeeds(name)
+	removeBreaker(name)
+	removeTopK(name)
+	removeDecisionLabels(name)
+	tfCacheLock.Lock()
+	defer tfCacheLock.Unlock()
+	if model, ok := tfCache[name]; ok {
+		model.Close()
+	}
+	delete(tfCache, name)
+	delete(tfCacheParams, name)
+}
+
+// helper function to generate predictions based on given tensor
+// for TF 2.X models
+func makePredictionsTensor(name string, tensor TFTensor) ([]float32, error) {
 	// our input is a tf Tensor
 
 	// load TF model, saved as keras with the following dir structure
 	// assets saved_model.pb variables
 
-	// look-up model from out cache
-	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
-		tfCacheParams = make(map[string]TFParams)
-	}
-
 	// load model parameters
 	model, err := getModel(name)
 	if err != nil {
@@ -341,26 +589,24 @@ func makePredictionsTensor(name string, tensor *tf.Tensor) ([]float32, error) {
 		msg := fmt.Sprintf("Model params does not contain model output name")
 		return []float32{}, errors.New(msg)
 	}
-	log.Println("model input %s output %s tensor %v", params.InputName, params.OutputName, tensor)
-
-	results := model.Exec([]tf.Output{
-		model.Op(params.OutputName, 0),
-	}, map[tf.Output]*tf.Tensor{
-		model.Op(params.InputName, 0): tensor,
-	})
-	probs := results[0]
-	value := probs.Value() // returns [][]float32 vector
-	vals := value.([][]float32)
-	return vals[0], nil
+	input, output := params.tf2Nodes()
+	log.Printf("model input %s output %s tensor %v", input, output, tensor)
+
+	results, err := runSession(name, model,
+		map[string]TFTensor{input: tensor},
+		[]string{output})
+	if err != nil {
+		return []float32{}, err
+	}
+	return outputRow(name, results[0])
 }
 
 // helper function to generate predictions based on given row values
-// based on tfgo
+// for TF 2.X models
 func makePredictions2(row *Row) ([]float32, error) {
 	// our input is a vector, we wrap it into matrix ([ [1,1,...], [], ...])
-	matrix := [][]float32{row.Values}
-	// create tensor vector for our computations
-	tensor, err := tf.NewTensor(matrix)
+	// or a sequence which we wrap into rank-3 tensor
+	tensor, err := makeRowTensor(row)
 	if err != nil {
 		return nil, err
 	}
@@ -372,29 +618,27 @@ func makePredictions2(row *Row) ([]float32, error) {
 		name = row.Model
 	}
 	// look-up model from out cache
-	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
+	start := time.Now()
+	model, err := getModel(name)
+	row.trace.stage("load", start)
+	if err != nil {
+		return nil, err
 	}
-	var model *tg.Model
-	var ok bool
-	model, ok = tfCache[name]
-	if !ok {
-		path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-		model = tg.LoadModel(path, []string{"serve"}, nil)
-		tfCache[name] = model
+	// model parameters are optional for TF 2.X models
+	params, _ := getModelParams(name)
+	params = row.Overrides.apply(params)
+	input, output := params.tf2Nodes()
+	start = time.Now()
+	results, err := runRowSession(row, name, model,
+		map[string]TFTensor{input: tensor},
+		[]string{output})
+	row.trace.stage("session", start)
+	if err != nil {
+		row.trace.shapes(tensor, nil)
+		return nil, err
 	}
-
-	//     path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-	//     model := tg.LoadModel(path, []string{"serve"}, nil)
-	results := model.Exec([]tf.Output{
-		model.Op("StatefulPartitionedCall", 0),
-	}, map[tf.Output]*tf.Tensor{
-		model.Op("serving_default_inputs_input", 0): tensor,
-	})
-	probs := results[0]
-	value := probs.Value() // returns [][]float32 vector
-	vals := value.([][]float32)
-	return vals[0], nil
+	row.trace.shapes(tensor, results[0])
+	return outputRow(name, results[0])
 }
 
 // helper function to generate predictions based on given row values
@@ -402,9 +646,8 @@ func makePredictions2(row *Row) ([]float32, error) {
 // influenced by: https://pgaleone.eu/tensorflow/go/2017/05/29/understanding-tensorflow-using-go/
 func makePredictions1(row *Row) ([]float32, error) {
 	// our input is a vector, we wrap it into matrix ([ [1,1,...], [], ...])
-	matrix := [][]float32{row.Values}
-	// create tensor vector for our computations
-	tensor, err := tf.NewTensor(matrix)
+	// or a sequence which we wrap into rank-3 tensor
+	tensor, err := makeRowTensor(row)
 	if err != nil {
 		return nil, err
 	}
@@ -414,70 +657,41 @@ func makePredictions1(row *Row) ([]float32, error) {
 	if row.Model != "" {
 		model = row.Model
 	}
+	start := time.Now()
 	tfm, err := _cache.get(model)
+	row.trace.stage("load", start)
 	if err != nil {
 		log.Println("unable to get model from cache", model, err)
 		return nil, err
 	}
 
 	// Run inference with existing graph which we get from loadModel call
-	session, err := tf.NewSession(tfm.Graph, _sessionOptions)
-	if err != nil {
-		return nil, err
-	}
-	defer session.Close()
-	results, err := session.Run(
-		map[tf.Output]*tf.Tensor{tfm.Graph.Operation(tfm.Params.InputNode).Output(0): tensor},
-		[]tf.Output{tfm.Graph.Operation(tfm.Params.OutputNode).Output(0)},
-		nil)
+	params := row.Overrides.apply(tfm.Params)
+	input, output := params.nodes()
+	start = time.Now()
+	results, err := runRowSession(row, model, tfm.Graph,
+		map[string]TFTensor{input: tensor},
+		[]string{output})
+	row.trace.stage("session", start)
 	if err != nil {
+		row.trace.shapes(tensor, nil)
 		return nil, err
 	}
+	row.trace.shapes(tensor, results[0])
 
 	// our model probabilities
-	probs := results[0].Value().([][]float32)[0]
-	return probs, nil
+	return outputRow(model, results[0])
 }
 
 // helper function to create Tensor image repreresentation
-func makeTensorFromImage(imageBuffer *bytes.Buffer, imageFormat string, nChannels int64) (*tf.Tensor, error) {
-	tensor, err := tf.NewTensor(imageBuffer.String())
-	if err != nil {
-		return nil, err
-	}
-	graph, input, output, err := makeTransformImageGraph(imageFormat, nChannels)
-	if err != nil {
-		return nil, err
-	}
-	session, err := tf.NewSession(graph, _sessionOptions)
+func makeTensorFromImage(imageBuffer *bytes.Buffer, imageFormat string, nChannels int64, roi *ROI) (TFTensor, error) {
+	// correct orientation and color space of the image and crop it to
+	// region of interest, see exif and crop modules
+	data, format, err := normalizeImage(imageBuffer.Bytes(), imageFormat, roi)
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
-	normalized, err := session.Run(
-		map[tf.Output]*tf.Tensor{input: tensor},
-		[]tf.Output{output},
-		nil)
-	if err != nil {
-		return nil, err
-	}
-	return normalized[0], nil
-}
-
-// Creates a graph to decode an image
-func makeTransformImageGraph(imageFormat string, nChannels int64) (graph *tf.Graph, input, output tf.Output, err error) {
-	s := op.NewScope()
-	input = op.Placeholder(s, tf.String)
-	// Decode PNG or JPEG
-	var decode tf.Output
-	if imageFormat == "png" {
-		decode = op.DecodePng(s, input, op.DecodePngChannels(nChannels))
-	} else {
-		decode = op.DecodeJpeg(s, input, op.DecodeJpegChannels(nChannels))
-	}
-	output = op.ExpandDims(s, op.Cast(s, decode, tf.Float), op.Const(s.SubScope("make_batch"), int32(0)))
-	graph, err = s.Finalize()
-	return graph, input, output, err
+	return _tf.DecodeImage(data, format, nChannels)
 }
 
 // ByProbability holds label results in terms of probability values
@@ -0,0 +1,201 @@
+package main
+
+// tflayer module defines interface of TF library used by the server
+//
+// The server code does not use TF Go bindings directly, instead it imports
+// graphs, creates tensors and runs sessions via TFLayer interface. The
+// tensorflowLayer implements it via TF Go bindings, while FakeTF provides
+// pure Go implementation which allows to test server logic without TF
+// C library. The stub backend (FakeTF) can be enabled either at build time
+// via notf build tag or at run time via "backend": "stub" configuration,
+// in both cases "stubOutputs" defines canned model outputs.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TFTensor represents TF tensor
+type TFTensor interface {
+	Value() interface{} // tensor value, e.g. [][]float32
+	Shape() []int64     // tensor shape
+}
+
+// TFGraph represents loaded TF model, either TF 1.X graph or TF 2.X saved model
+type TFGraph interface {
+	Operations() []string // names of graph operations
+	Nodes() []TFNode      // graph operations with their types and consumers
+	Close() error         // release resources of the graph
+}
+
+// TFSession represents TF session
+type TFSession interface {
+	// Run runs graph with given feeds and returns tensors of given fetches,
+	// feeds and fetches refer to graph operations by their names, e.g.
+	// "input" or "output:1" for second output of the operation
+	Run(feeds map[string]TFTensor, fetches []string) ([]TFTensor, error)
+	Close() error
+}
+
+// TFLayer represents TF library
+type TFLayer interface {
+	ImportGraph(def []byte) (TFGraph, error)
+	// LoadSavedModel and NewSession use given TF session config (serialized
+	// ConfigProto), nil config means session options of the layer
+	LoadSavedModel(path string, config []byte) (TFGraph, error)
+	NewSession(graph TFGraph, config []byte) (TFSession, error)
+	NewTensor(values []float32, shape []int64) (TFTensor, error)
+	NewInt32Tensor(values []int32, shape []int64) (TFTensor, error)
+	NewScalarTensor(value interface{}) (TFTensor, error)
+	NewTypedTensor(values interface{}, shape []int64) (TFTensor, error)
+	ReadTensor(shape []int64, r io.Reader) (TFTensor, error)
+	DecodeImage(data []byte, format string, channels int64) (TFTensor, error)
+	// AddTopK adds TopK operation of k largest values of given output to the
+	// graph, it returns names of values and indices outputs of the operation
+	AddTopK(graph TFGraph, output, name string, k int) (string, string, error)
+	Version() string
+}
+
+// helper function to initialize TF layer used by the server
+func initTFLayer() {
+	if _config.Backend == "stub" || !hasTensorflow {
+		log.Println("WARNING: use stub TF backend with canned outputs", _config.StubOutputs)
+		_tf = &FakeTF{Outputs: _config.StubOutputs}
+		return
+	}
+	_tf = newTensorflowLayer(_config.ConfigProto)
+}
+
+// helper function to return name of TF backend used by the server
+func tfBackend() string {
+	if _, ok := _tf.(*FakeTF); ok {
+		return "stub"
+	}
+	return "tensorflow"
+}
+
+// helper function to check if TF library satisfies minimal TF version
+// declared in params.json of the model in given path
+func checkModelTFVersion(path string) error {
+	data, err := ioutil.ReadFile(filepath.Join(path, "params.json"))
+	if err != nil {
+		// models without params.json do not declare TF version
+		return nil
+	}
+	var params TFParams
+	if err := json.Unmarshal(data, &params); err != nil || params.MinTFVersion == "" {
+		return nil
+	}
+	// stub backend does not run TF ops
+	version := _tf.Version()
+	if version == "stub" {
+		return nil
+	}
+	if compareVersions(version, params.MinTFVersion) < 0 {
+		return fmt.Errorf("model %s requires TensorFlow %s or newer while server uses TensorFlow %s", filepath.Base(path), params.MinTFVersion, version)
+	}
+	return nil
+}
+
+// errInvalidInput marks session errors caused by invalid model inputs, e.g.
+// feeds of wrong shape, such errors are errors of clients rather than
+// failures of the model
+var errInvalidInput = errors.New("invalid model input")
+
+// messages of TF errors caused by invalid inputs (InvalidArgument errors of
+// TF kernels), TF Go bindings do not expose codes of TF errors
+var tfInputErrors = []string{
+	"Incompatible shapes",
+	"Matrix size-incompatible",
+	"You must feed a value for placeholder",
+	"Input to reshape is a tensor with",
+	"Dimensions of inputs should match",
+	"is not in [0, ",
+}
+
+// inputError represents session error caused by invalid model inputs
+type inputError struct {
+	err error
+}
+
+// Error implements error interface
+func (e *inputError) Error() string {
+	return e.err.Error()
+}
+
+// Is reports input errors as errInvalidInput
+func (e *inputError) Is(target error) bool {
+	return target == errInvalidInput
+}
+
+// helper function to mark error of TF session run as input error when it
+// is caused by invalid inputs
+func sessionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, msg := range tfInputErrors {
+		if strings.Contains(err.Error(), msg) {
+			return &inputError{err}
+		}
+	}
+	return err
+}
+
+// helper function to check shape of the feed against shape of the input,
+// unknown dimensions of the input are -1
+func checkFeedShape(name string, shape, input []int64) error {
+	ok := len(shape) == len(input)
+	for i := 0; ok && i < len(shape); i++ {
+		ok = input[i] < 0 || input[i] == shape[i]
+	}
+	if !ok {
+		return &inputError{fmt.Errorf("feed %s has shape %v while input shape is %v", name, shape, input)}
+	}
+	return nil
+}
+
+// helper function to parse operation name with optional output index,
+// e.g. "output:1"
+func parseOutputName(name string) (string, int, error) {
+	if idx := strings.LastIndex(name, ":"); idx != -1 {
+		i, err := strconv.Atoi(name[idx+1:])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid operation name %s", name)
+		}
+		return name[:idx], i, nil
+	}
+	return name, 0, nil
+}
+
+// helper function to add output index to operation name, e.g. output:1,
+// names with explicit index are kept as is
+func outputIndexName(name string, idx int) string {
+	if idx <= 0 || strings.Contains(name, ":") {
+		return name
+	}
+	return fmt.Sprintf("%s:%d", name, idx)
+}
+
+// helper function to convert tensor into matrix of floats, tensors of
+// rank > 2 are flattened into rows (see shape module)
+func tensorRows(tensor TFTensor) ([][]float32, error) {
+	if tensor == nil {
+		return nil, fmt.Errorf("empty tensor")
+	}
+	if v, ok := tensor.Value().([][]float32); ok {
+		return v, nil
+	}
+	values, shape, err := flattenTensor(tensor)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported tensor type %T shape %v: %v", tensor.Value(), tensor.Shape(), err)
+	}
+	return splitRows(values, shape), nil
+}
@@ -0,0 +1,359 @@
+package main
+
+// tflayer_fake module provides pure Go implementation of TFLayer
+//
+// FakeTF does not run any TF computations, instead every session run
+// returns canned output row for every row of its input. It allows to test
+// handlers, validation, batching and caching logic of the server without
+// TF C library.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register JPEG decoder
+	_ "image/png"  // register PNG decoder
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// FakeTF implements TFLayer without TF library
+type FakeTF struct {
+	Outputs []float32 // canned output row returned for every input row
+	Runs    uint64    // number of performed session runs
+	Imports uint64    // number of imported graphs and saved models
+
+	// shape of canned output row, e.g. [H, W, C] of segmentation models,
+	// default is [len(Outputs)]
+	OutputShape []int64
+
+	TFVersion string   // TF version reported by the layer, default stub
+	Nodes     []TFNode // nodes of imported graphs
+
+	// shape of model input, -1 for unknown dimensions, feeds of other
+	// shapes fail session runs with input error, nil accepts any feeds
+	InputShape []int64
+
+	feeds   map[string]TFTensor // feeds of the last session run
+	fetches []string            // fetches of the last session run
+	config  []byte              // config of the last created session
+	lock    sync.Mutex          // protects feeds, fetches and config
+}
+
+// Feeds returns feeds of the last session run
+func (f *FakeTF) Feeds() map[string]TFTensor {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.feeds
+}
+
+// Fetches returns fetches of the last session run
+func (f *FakeTF) Fetches() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.fetches
+}
+
+// SessionConfig returns config of the last created session or loaded saved
+// model
+func (f *FakeTF) SessionConfig() []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.config
+}
+
+// fakeTensor implements TFTensor interface
+type fakeTensor struct {
+	value interface{}
+	shape []int64
+}
+
+// Value implements TFTensor interface, flat values of rank-2 tensors are
+// returned as matrix like TF tensors do
+func (t *fakeTensor) Value() interface{} {
+	if values, ok := t.value.([]float32); ok && len(t.shape) == 2 && t.shape[1] > 0 {
+		var rows [][]float32
+		ncols := int(t.shape[1])
+		for i := 0; i+ncols <= len(values); i += ncols {
+			rows = append(rows, values[i:i+ncols])
+		}
+		return rows
+	}
+	return t.value
+}
+
+// Shape implements TFTensor interface
+func (t *fakeTensor) Shape() []int64 {
+	return t.shape
+}
+
+// fakeGraph implements TFGraph interface
+type fakeGraph struct {
+	nodes []TFNode
+	topK  map[string]int // TopK operations and their k
+	lock  sync.Mutex     // protects topK
+}
+
+// Operations implements TFGraph interface
+func (g *fakeGraph) Operations() []string {
+	var out []string
+	for _, node := range g.nodes {
+		out = append(out, node.Name)
+	}
+	return out
+}
+
+// Nodes implements TFGraph interface
+func (g *fakeGraph) Nodes() []TFNode {
+	return g.nodes
+}
+
+// Close implements TFGraph interface
+func (g *fakeGraph) Close() error {
+	return nil
+}
+
+// fakeSession implements TFSession interface
+type fakeSession struct {
+	tf    *FakeTF
+	graph *fakeGraph
+}
+
+// helper function to compute k largest canned outputs and their indices
+func fakeTopK(outputs []float32, k int) ([]float32, []int32) {
+	idx := make([]int32, len(outputs))
+	for i := range idx {
+		idx[i] = int32(i)
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return outputs[idx[i]] > outputs[idx[j]] })
+	if k < len(idx) {
+		idx = idx[:k]
+	}
+	values := make([]float32, len(idx))
+	for i, j := range idx {
+		values[i] = outputs[j]
+	}
+	return values, idx
+}
+
+// Run implements TFSession interface
+func (s *fakeSession) Run(feeds map[string]TFTensor, fetches []string) ([]TFTensor, error) {
+	atomic.AddUint64(&s.tf.Runs, 1)
+	if len(feeds) == 0 {
+		return nil, errors.New("no feeds are provided")
+	}
+	rows := int64(1)
+	for name, t := range feeds {
+		if name == "" {
+			return nil, errors.New("empty feed name")
+		}
+		if s.tf.InputShape != nil {
+			if err := checkFeedShape(name, t.Shape(), s.tf.InputShape); err != nil {
+				return nil, err
+			}
+		}
+		if shape := t.Shape(); len(shape) > 1 {
+			rows = shape[0]
+		}
+	}
+	outputs := s.tf.Outputs
+	if len(outputs) == 0 {
+		outputs = []float32{1}
+	}
+	var out []TFTensor
+	for _, name := range fetches {
+		if name == "" {
+			return nil, errors.New("empty fetch name")
+		}
+		opName, idx, err := parseOutputName(name)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := s.graph.topKOp(opName); ok {
+			values, indices := fakeTopK(outputs, k)
+			if idx == 1 {
+				value := make([][]int32, rows)
+				for i := range value {
+					value[i] = indices
+				}
+				out = append(out, &fakeTensor{value: value, shape: []int64{rows, int64(len(indices))}})
+				continue
+			}
+			value := make([][]float32, rows)
+			for i := range value {
+				value[i] = values
+			}
+			out = append(out, &fakeTensor{value: value, shape: []int64{rows, int64(len(values))}})
+			continue
+		}
+		if len(s.tf.OutputShape) > 0 {
+			// flat values of output rows of given shape
+			var value []float32
+			for i := int64(0); i < rows; i++ {
+				value = append(value, outputs...)
+			}
+			shape := append([]int64{rows}, s.tf.OutputShape...)
+			out = append(out, &fakeTensor{value: value, shape: shape})
+			continue
+		}
+		var value [][]float32
+		for i := int64(0); i < rows; i++ {
+			value = append(value, append([]float32{}, outputs...))
+		}
+		out = append(out, &fakeTensor{value: value, shape: []int64{rows, int64(len(outputs))}})
+	}
+	s.tf.lock.Lock()
+	s.tf.feeds = feeds
+	s.tf.fetches = fetches
+	s.tf.lock.Unlock()
+	return out, nil
+}
+
+// helper function to look-up TopK operation of the graph
+func (g *fakeGraph) topKOp(name string) (int, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	k, ok := g.topK[name]
+	return k, ok
+}
+
+// Close implements TFSession interface
+func (s *fakeSession) Close() error {
+	return nil
+}
+
+// Version implements TFLayer interface
+func (f *FakeTF) Version() string {
+	if f.TFVersion != "" {
+		return f.TFVersion
+	}
+	return "stub"
+}
+
+// ImportGraph implements TFLayer interface
+func (f *FakeTF) ImportGraph(def []byte) (TFGraph, error) {
+	if len(def) == 0 {
+		return nil, errors.New("empty graph definition")
+	}
+	atomic.AddUint64(&f.Imports, 1)
+	return &fakeGraph{nodes: f.Nodes}, nil
+}
+
+// LoadSavedModel implements TFLayer interface
+func (f *FakeTF) LoadSavedModel(path string, config []byte) (TFGraph, error) {
+	if _, err := os.Stat(filepath.Join(path, "saved_model.pb")); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&f.Imports, 1)
+	f.lock.Lock()
+	f.config = config
+	f.lock.Unlock()
+	return &fakeGraph{}, nil
+}
+
+// NewSession implements TFLayer interface
+func (f *FakeTF) NewSession(graph TFGraph, config []byte) (TFSession, error) {
+	if graph == nil {
+		return nil, errors.New("empty graph")
+	}
+	f.lock.Lock()
+	f.config = config
+	f.lock.Unlock()
+	g, _ := graph.(*fakeGraph)
+	return &fakeSession{tf: f, graph: g}, nil
+}
+
+// AddTopK implements TFLayer interface
+func (f *FakeTF) AddTopK(graph TFGraph, output, name string, k int) (string, string, error) {
+	g, ok := graph.(*fakeGraph)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported graph type %T", graph)
+	}
+	if k <= 0 {
+		return "", "", fmt.Errorf("invalid k %d", k)
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.topK[name]; ok {
+		return "", "", fmt.Errorf("duplicate operation %s", name)
+	}
+	if g.topK == nil {
+		g.topK = make(map[string]int)
+	}
+	g.topK[name] = k
+	return name, outputIndexName(name, 1), nil
+}
+
+// NewTensor implements TFLayer interface
+func (f *FakeTF) NewTensor(values []float32, shape []int64) (TFTensor, error) {
+	return &fakeTensor{value: values, shape: shape}, nil
+}
+
+// NewInt32Tensor implements TFLayer interface
+func (f *FakeTF) NewInt32Tensor(values []int32, shape []int64) (TFTensor, error) {
+	return &fakeTensor{value: values, shape: shape}, nil
+}
+
+// NewScalarTensor implements TFLayer interface
+func (f *FakeTF) NewScalarTensor(value interface{}) (TFTensor, error) {
+	switch value.(type) {
+	case float32, float64, int32, int64, bool:
+		return &fakeTensor{value: value, shape: []int64{}}, nil
+	}
+	return nil, fmt.Errorf("unsupported scalar type %T", value)
+}
+
+// NewTypedTensor implements TFLayer interface
+func (f *FakeTF) NewTypedTensor(values interface{}, shape []int64) (TFTensor, error) {
+	switch values.(type) {
+	case []float32, []float64, []int32, []int64, []uint8, []bool, []string:
+		return &fakeTensor{value: values, shape: shape}, nil
+	}
+	return nil, fmt.Errorf("unsupported tensor type %T", values)
+}
+
+// ReadTensor implements TFLayer interface
+func (f *FakeTF) ReadTensor(shape []int64, r io.Reader) (TFTensor, error) {
+	size, err := shapeSize(shape)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float32, size)
+	if err := binary.Read(r, binary.LittleEndian, values); err != nil {
+		return nil, err
+	}
+	return &fakeTensor{value: values, shape: shape}, nil
+}
+
+// DecodeImage implements TFLayer interface
+func (f *FakeTF) DecodeImage(data []byte, format string, channels int64) (TFTensor, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if channels <= 0 {
+		return nil, fmt.Errorf("invalid number of image channels %d", channels)
+	}
+	bounds := img.Bounds()
+	var values []float32
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			pixel := []float32{float32(r >> 8), float32(g >> 8), float32(b >> 8), float32(a >> 8)}
+			for c := int64(0); c < channels && c < 4; c++ {
+				values = append(values, pixel[c])
+			}
+		}
+	}
+	shape := []int64{1, int64(bounds.Dy()), int64(bounds.Dx()), channels}
+	return &fakeTensor{value: values, shape: shape}, nil
+}
@@ -0,0 +1,21 @@
+//go:build notf
+
+package main
+
+// tflayer_stub module provides TF layer for builds without TF library, e.g.
+// go build -tags notf
+// Such server uses FakeTF layer which returns canned outputs and it can be
+// used to run HTTP, auth and model management layers on machines without
+// libtensorflow.
+
+// TF library used by the server
+var _tf TFLayer = &FakeTF{}
+
+// server is built without TF library
+const hasTensorflow = false
+
+// newTensorflowLayer returns stub TF layer since server is built without
+// TF library
+func newTensorflowLayer(configProto string) TFLayer {
+	return &FakeTF{Outputs: _config.StubOutputs}
+}
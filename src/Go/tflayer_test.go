@@ -0,0 +1,394 @@
+package main
+
+// tests of server logic based on FakeTF layer, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// number of attributes of test model input
+const testNumKeys = 4
+
+// test model labels
+var testLabels = []string{"a", "b", "c"}
+
+// canned outputs of fake TF layer
+var testOutputs = []float32{0.2, 0.3, 0.5}
+
+// helper function to write model graph and its meta-data into model area
+func writeModelFiles(tb testing.TB, name string, def []byte, params TFParams) {
+	path := filepath.Join(_config.ModelDir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "model.pb"), def, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	var labels []byte
+	for _, l := range testLabels {
+		labels = append(labels, []byte(l+"\n")...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "labels.txt"), labels, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	params.Name = name
+	params.Model = "model.pb"
+	params.Labels = "labels.txt"
+	data, err := json.Marshal(params)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "params.json"), data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// helper function to setup empty model area and server caches for tests
+func setupTestArea(tb testing.TB, cacheLimit, poolSize int) {
+	// background self-tests of previous tests read server configuration
+	_selfTestsRunning.Wait()
+	dir, err := ioutil.TempDir("", "tfaas-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	tb.Cleanup(_selfTestsRunning.Wait)
+	_config = Configuration{ModelDir: dir, SessionPoolSize: poolSize}
+	_cache = TFCache{Models: make(map[string]TFCacheEntry), Limit: cacheLimit}
+	_params = TFParams{}
+	_aliases = Aliases{Aliases: make(map[string]Alias)}
+	tfCacheLock.Lock()
+	tfCache = nil
+	tfCacheParams = nil
+	tfCacheLock.Unlock()
+	tokenizersLock.Lock()
+	tokenizers = make(map[string]*Tokenizer)
+	tokenizersLock.Unlock()
+	constFeedsLock.Lock()
+	constFeeds = make(map[string]map[string]TFTensor)
+	constFeedsLock.Unlock()
+	breakersLock.Lock()
+	_breakers = make(map[string]*Breaker)
+	breakersLock.Unlock()
+	decisionLabelsLock.Lock()
+	_decisionLabels = make(map[string][]string)
+	decisionLabelsLock.Unlock()
+	sessionsLock.Lock()
+	for _, pool := range _sessionPools {
+		pool.close()
+	}
+	_sessionPools = make(map[string]*SessionPool)
+	sessionsLock.Unlock()
+}
+
+// helper function to setup model area with fake models and fake TF layer
+func setupFakeModels(tb testing.TB, cacheLimit, poolSize int) *FakeTF {
+	setupTestArea(tb, cacheLimit, poolSize)
+	fake := &FakeTF{Outputs: testOutputs}
+	orig := _tf
+	_tf = fake
+	tb.Cleanup(func() { _tf = orig })
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	writeModelFiles(tb, "dnn", []byte("dnn"), params)
+	writeModelFiles(tb, "dnn2", []byte("dnn2"), params)
+	params.ImgChannels = int64(len(testLabels))
+	writeModelFiles(tb, "img", []byte("img"), params)
+	return fake
+}
+
+// helper function to create test row
+func testRow(model string) *Row {
+	row := &Row{Model: model}
+	for i := 0; i < testNumKeys; i++ {
+		row.Keys = append(row.Keys, fmt.Sprintf("attr%d", i))
+		row.Values = append(row.Values, float32(i)/testNumKeys)
+	}
+	return row
+}
+
+// helper function to check model probabilities
+func checkProbs(tb testing.TB, probs []float32) {
+	if len(probs) != len(testLabels) {
+		tb.Fatalf("wrong number of probabilities %v", probs)
+	}
+	var sum float64
+	for _, p := range probs {
+		sum += float64(p)
+	}
+	if math.Abs(sum-1) > 1e-4 {
+		tb.Fatalf("probabilities %v do not sum up to 1", probs)
+	}
+}
+
+// helper function to create image upload request
+func imageRequest(tb testing.TB, model string) *http.Request {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 8), 128, 255})
+		}
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("model", model)
+	part, err := writer.CreateFormFile("image", "test.png")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := png.Encode(part, img); err != nil {
+		tb.Fatal(err)
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", "/image", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// TestFakePredictHandler checks JSON predictions
+func TestFakePredictHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	data, err := json.Marshal(testRow("dnn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	PredictHandler(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var probs []float32
+	if err := json.NewDecoder(w.Body).Decode(&probs); err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	// unknown model
+	data, _ = json.Marshal(testRow("unknown"))
+	w = httptest.NewRecorder()
+	PredictHandler(w, httptest.NewRequest("POST", "/json", bytes.NewReader(data)))
+	if w.Code == http.StatusOK {
+		t.Fatal("predictions for unknown model should fail")
+	}
+}
+
+// TestFakeBatchHandler checks batch predictions and validation of batch shape
+func TestFakeBatchHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	nrows := 3
+	var values []float32
+	for i := 0; i < nrows; i++ {
+		values = append(values, testRow("dnn").Values...)
+	}
+
+	// JSON batch
+	batch := BatchRow{Model: "dnn", Values: values, Shape: []int64{int64(nrows), testNumKeys}}
+	data, _ := json.Marshal(batch)
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var probs [][]float32
+	if err := json.NewDecoder(w.Body).Decode(&probs); err != nil {
+		t.Fatal(err)
+	}
+	if len(probs) != nrows {
+		t.Fatalf("wrong number of predictions %d, expected %d", len(probs), nrows)
+	}
+
+	// binary batch
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, values)
+	rurl := fmt.Sprintf("/predict/batch?model=dnn&shape=%d,%d", nrows, testNumKeys)
+	req := httptest.NewRequest("POST", rurl, &buf)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	BatchHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+
+	// shape mismatch
+	batch.Shape = []int64{int64(nrows + 1), testNumKeys}
+	data, _ = json.Marshal(batch)
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for invalid shape", w.Code)
+	}
+}
+
+// TestFakeImageHandler checks image predictions
+func TestFakeImageHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	w := httptest.NewRecorder()
+	ImageTF1Handler(w, imageRequest(t, "img"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var res ClassifyResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Labels) != len(testLabels) || res.Labels[0].Label != "c" {
+		t.Fatalf("wrong classification result %+v", res)
+	}
+}
+
+// TestFakeModelCache checks model cache limit and evictions
+func TestFakeModelCache(t *testing.T) {
+	fake := setupFakeModels(t, 1, 0)
+	for _, model := range []string{"dnn", "dnn2", "dnn"} {
+		if _, err := makePredictions(testRow(model)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.Imports != 3 {
+		t.Errorf("wrong number of imports %d with cache limit 1", fake.Imports)
+	}
+
+	fake = setupFakeModels(t, 2, 0)
+	for _, model := range []string{"dnn", "dnn2", "dnn"} {
+		if _, err := makePredictions(testRow(model)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.Imports != 2 {
+		t.Errorf("wrong number of imports %d with cache limit 2", fake.Imports)
+	}
+	resetModelCache("dnn")
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Imports != 3 {
+		t.Errorf("model should be reloaded after cache reset, imports %d", fake.Imports)
+	}
+}
+
+// TestFakeSessionPool checks concurrent predictions with session pools
+func TestFakeSessionPool(t *testing.T) {
+	fake := setupFakeModels(t, 10, 2)
+	var wg sync.WaitGroup
+	nreq := 50
+	for i := 0; i < nreq; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := makePredictions(testRow("dnn")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fake.Runs != uint64(nreq) {
+		t.Errorf("wrong number of session runs %d", fake.Runs)
+	}
+	stats := sessionPoolsStats()
+	if len(stats) != 1 || stats[0].Requests != uint64(nreq) || stats[0].Busy != 0 {
+		t.Errorf("wrong session pool stats %+v", stats)
+	}
+}
+
+// TestFakeValidateModel checks validation of uploaded models
+func TestFakeValidateModel(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	path := filepath.Join(_config.ModelDir, "dnn")
+	if err := validateModel(path, "dnn"); err != nil {
+		t.Errorf("valid model is rejected: %v", err)
+	}
+	if err := validateModel(path, "other"); err == nil {
+		t.Error("model with wrong name should be rejected")
+	}
+	os.Remove(filepath.Join(path, "params.json"))
+	if err := validateModel(path, "dnn"); err == nil {
+		t.Error("model without params should be rejected")
+	}
+}
+
+// TestFakeSequencePredictions checks predictions for sequence inputs
+func TestFakeSequencePredictions(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	seq := [][]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10, 11, 12}}
+	row := &Row{Model: "dnn", Sequence: seq}
+	tensor, err := makeRowTensor(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shape := tensor.Shape(); len(shape) != 3 || shape[0] != 1 || shape[1] != 4 || shape[2] != 3 {
+		t.Fatalf("wrong sequence tensor shape %v", shape)
+	}
+	probs, err := makePredictions(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+
+	// ragged sequence
+	row.Sequence = append(seq, []float32{1})
+	if _, err := makePredictions(row); err == nil {
+		t.Error("ragged sequence should be rejected")
+	}
+
+	// batch of sequences
+	var values []float32
+	for i := 0; i < 2; i++ {
+		for _, step := range seq {
+			values = append(values, step...)
+		}
+	}
+	batch := BatchRow{Model: "dnn", Values: values, Shape: []int64{2, 4, 3}}
+	data, _ := json.Marshal(batch)
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var rows [][]float32
+	if err := json.NewDecoder(w.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("wrong number of predictions %d", len(rows))
+	}
+}
+
+// TestFakeMinTFVersion checks that models which require newer TF version are
+// refused with clear error
+func TestFakeMinTFVersion(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	fake.TFVersion = "2.9.1"
+	params := TFParams{InputNode: "input", OutputNode: "output", MinTFVersion: "2.12.0"}
+	writeModelFiles(t, "newops", []byte("newops"), params)
+	_, err := makePredictions(testRow("newops"))
+	if err == nil || !strings.Contains(err.Error(), "requires TensorFlow 2.12.0") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := validateModel(filepath.Join(_config.ModelDir, "newops"), "newops"); err == nil {
+		t.Error("validation should refuse model which requires newer TF version")
+	}
+	if fake.Imports != 0 {
+		t.Errorf("model is imported %d times", fake.Imports)
+	}
+	fake.TFVersion = "2.12.1"
+	probs, err := makePredictions(testRow("newops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+}
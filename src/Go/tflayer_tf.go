@@ -0,0 +1,402 @@
+//go:build !notf
+
+package main
+
+// tflayer_tf module implements TFLayer via TF Go bindings, use notf build
+// tag to build the server without TF library
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+	"github.com/galeone/tensorflow/tensorflow/go/op"
+)
+
+// TF library used by the server
+var _tf TFLayer = newTensorflowLayer("")
+
+// server is built with TF library
+const hasTensorflow = true
+
+// tensorflowLayer implements TFLayer via TF Go bindings
+type tensorflowLayer struct {
+	options *tf.SessionOptions // TF session options
+}
+
+// newTensorflowLayer creates TF layer with session options from given
+// config proto file
+func newTensorflowLayer(configProto string) TFLayer {
+	return &tensorflowLayer{options: readConfigProto(configProto)}
+}
+
+// helper function to read TF config proto message provided in input file
+func readConfigProto(fname string) *tf.SessionOptions {
+	session := tf.SessionOptions{}
+	if fname != "" {
+		body, err := ioutil.ReadFile(fname)
+		if err == nil {
+			session = tf.SessionOptions{Config: body}
+		} else {
+			log.Println("unable to read TF config proto file", err)
+		}
+	} else if config := sessionConfigProto(); config != nil {
+		// size TF thread pools by resources available to the server
+		session = tf.SessionOptions{Config: config}
+	}
+	return &session
+}
+
+// tfGraph represents TF 1.X graph
+type tfGraph struct {
+	graph *tf.Graph
+}
+
+// Operations implements TFGraph interface
+func (g *tfGraph) Operations() []string {
+	var out []string
+	for _, o := range g.graph.Operations() {
+		out = append(out, o.Name())
+	}
+	return out
+}
+
+// Nodes implements TFGraph interface
+func (g *tfGraph) Nodes() []TFNode {
+	var nodes []TFNode
+	for _, o := range g.graph.Operations() {
+		node := TFNode{Name: o.Name(), Type: o.Type(), Outputs: o.NumOutputs()}
+		for i := 0; i < o.NumOutputs(); i++ {
+			node.Consumers += len(o.Output(i).Consumers())
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Close implements TFGraph interface
+func (g *tfGraph) Close() error {
+	return nil
+}
+
+// tfSavedModel represents TF 2.X saved model
+type tfSavedModel struct {
+	model *tf.SavedModel
+}
+
+// Operations implements TFGraph interface
+func (m *tfSavedModel) Operations() []string {
+	g := tfGraph{graph: m.model.Graph}
+	return g.Operations()
+}
+
+// Nodes implements TFGraph interface
+func (m *tfSavedModel) Nodes() []TFNode {
+	g := tfGraph{graph: m.model.Graph}
+	return g.Nodes()
+}
+
+// Close implements TFGraph interface
+func (m *tfSavedModel) Close() error {
+	return m.model.Session.Close()
+}
+
+// tfSession represents TF session
+type tfSession struct {
+	graph   *tf.Graph
+	session *tf.Session
+	shared  bool // session belongs to saved model and should not be closed
+}
+
+// helper function to look-up graph output of given operation
+func (s *tfSession) output(name string) (tf.Output, error) {
+	opName, idx, err := parseOutputName(name)
+	if err != nil {
+		return tf.Output{}, err
+	}
+	o := s.graph.Operation(opName)
+	if o == nil {
+		return tf.Output{}, fmt.Errorf("graph does not have operation %s", opName)
+	}
+	return o.Output(idx), nil
+}
+
+// helper function to convert TFTensor into TF tensor
+func toTensor(t TFTensor) (*tf.Tensor, error) {
+	if tensor, ok := t.(*tf.Tensor); ok {
+		return tensor, nil
+	}
+	tensor, err := tf.NewTensor(t.Value())
+	if err != nil {
+		return nil, err
+	}
+	if err := tensor.Reshape(t.Shape()); err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// Run implements TFSession interface
+func (s *tfSession) Run(feeds map[string]TFTensor, fetches []string) ([]TFTensor, error) {
+	inputs := make(map[tf.Output]*tf.Tensor)
+	for name, t := range feeds {
+		o, err := s.output(name)
+		if err != nil {
+			return nil, err
+		}
+		tensor, err := toTensor(t)
+		if err != nil {
+			return nil, &inputError{err}
+		}
+		if o.Op.Type() == "Placeholder" {
+			// check feeds of model inputs before running the graph
+			if shape, err := o.Shape().ToSlice(); err == nil {
+				if err := checkFeedShape(name, tensor.Shape(), shape); err != nil {
+					return nil, err
+				}
+			}
+			if o.DataType() != tensor.DataType() {
+				return nil, &inputError{fmt.Errorf("feed %s has data type %v while input data type is %v", name, tensor.DataType(), o.DataType())}
+			}
+		}
+		inputs[o] = tensor
+	}
+	var outputs []tf.Output
+	for _, name := range fetches {
+		o, err := s.output(name)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	results, err := s.session.Run(inputs, outputs, nil)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+	var out []TFTensor
+	for _, r := range results {
+		t, err := resultTensor(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// helper function to convert TF tensor of session results into TFTensor,
+// TF Go bindings can't represent reduced precision and quantized tensors
+// as Go values (and panic on them), therefore such tensors are decoded into
+// float32 tensors from their raw contents
+func resultTensor(t *tf.Tensor) (TFTensor, error) {
+	var dtype string
+	switch t.DataType() {
+	case tf.Float, tf.Double, tf.Int32, tf.Uint32, tf.Int64, tf.Uint64,
+		tf.Int16, tf.Uint16, tf.Int8, tf.Uint8, tf.Bool, tf.String:
+		return t, nil
+	case tf.Half:
+		dtype = "float16"
+	case tf.Bfloat16:
+		dtype = "bfloat16"
+	case tf.Quint8:
+		dtype = "quint8"
+	case tf.Qint16:
+		dtype = "qint16"
+	case tf.Quint16:
+		dtype = "quint16"
+	case tf.Qint32:
+		dtype = "qint32"
+	default:
+		return nil, fmt.Errorf("unsupported output data type %v", t.DataType())
+	}
+	var buf bytes.Buffer
+	if _, err := t.WriteContentsTo(&buf); err != nil {
+		return nil, err
+	}
+	values, err := decodeRawValues(dtype, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	tensor, err := tf.NewTensor(values)
+	if err != nil {
+		return nil, err
+	}
+	if err := tensor.Reshape(t.Shape()); err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// Close implements TFSession interface
+func (s *tfSession) Close() error {
+	if s.shared {
+		return nil
+	}
+	return s.session.Close()
+}
+
+// Version implements TFLayer interface
+func (l *tensorflowLayer) Version() string {
+	return tf.Version()
+}
+
+// ImportGraph implements TFLayer interface
+func (l *tensorflowLayer) ImportGraph(def []byte) (TFGraph, error) {
+	graph := tf.NewGraph()
+	if err := graph.Import(def, ""); err != nil {
+		return nil, err
+	}
+	return &tfGraph{graph: graph}, nil
+}
+
+// helper function to return session options of given session config
+func (l *tensorflowLayer) sessionOptions(config []byte) *tf.SessionOptions {
+	if config == nil {
+		return l.options
+	}
+	return &tf.SessionOptions{Config: config}
+}
+
+// LoadSavedModel implements TFLayer interface
+func (l *tensorflowLayer) LoadSavedModel(path string, config []byte) (TFGraph, error) {
+	model, err := tf.LoadSavedModel(path, []string{"serve"}, l.sessionOptions(config))
+	if err != nil {
+		return nil, err
+	}
+	return &tfSavedModel{model: model}, nil
+}
+
+// NewSession implements TFLayer interface, the TF 2.X saved models share
+// their own session created with config of LoadSavedModel
+func (l *tensorflowLayer) NewSession(graph TFGraph, config []byte) (TFSession, error) {
+	switch g := graph.(type) {
+	case *tfGraph:
+		session, err := tf.NewSession(g.graph, l.sessionOptions(config))
+		if err != nil {
+			return nil, err
+		}
+		return &tfSession{graph: g.graph, session: session}, nil
+	case *tfSavedModel:
+		return &tfSession{graph: g.model.Graph, session: g.model.Session, shared: true}, nil
+	}
+	return nil, fmt.Errorf("unsupported graph type %T", graph)
+}
+
+// NewTensor implements TFLayer interface, the values are copied once into
+// tensor memory and reshaped in place
+func (l *tensorflowLayer) NewTensor(values []float32, shape []int64) (TFTensor, error) {
+	tensor, err := tf.NewTensor(values)
+	if err != nil {
+		return nil, err
+	}
+	if err := tensor.Reshape(shape); err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// NewInt32Tensor implements TFLayer interface
+func (l *tensorflowLayer) NewInt32Tensor(values []int32, shape []int64) (TFTensor, error) {
+	tensor, err := tf.NewTensor(values)
+	if err != nil {
+		return nil, err
+	}
+	if err := tensor.Reshape(shape); err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// NewScalarTensor implements TFLayer interface
+func (l *tensorflowLayer) NewScalarTensor(value interface{}) (TFTensor, error) {
+	return tf.NewTensor(value)
+}
+
+// NewTypedTensor implements TFLayer interface, values are flat slice of
+// any type supported by TF Go bindings
+func (l *tensorflowLayer) NewTypedTensor(values interface{}, shape []int64) (TFTensor, error) {
+	tensor, err := tf.NewTensor(values)
+	if err != nil {
+		return nil, err
+	}
+	if err := tensor.Reshape(shape); err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// ReadTensor implements TFLayer interface, it reads float32 values (in
+// native byte order) directly into tensor memory
+func (l *tensorflowLayer) ReadTensor(shape []int64, r io.Reader) (TFTensor, error) {
+	return tf.ReadTensor(tf.Float, shape, r)
+}
+
+// DecodeImage implements TFLayer interface
+func (l *tensorflowLayer) DecodeImage(data []byte, format string, channels int64) (TFTensor, error) {
+	tensor, err := tf.NewTensor(string(data))
+	if err != nil {
+		return nil, err
+	}
+	graph, input, output, err := makeTransformImageGraph(format, channels)
+	if err != nil {
+		return nil, err
+	}
+	session, err := tf.NewSession(graph, l.options)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	normalized, err := session.Run(
+		map[tf.Output]*tf.Tensor{input: tensor},
+		[]tf.Output{output},
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	return normalized[0], nil
+}
+
+// AddTopK implements TFLayer interface, TF sessions pick up operations
+// added to the graph on their next run
+func (l *tensorflowLayer) AddTopK(graph TFGraph, output, name string, k int) (string, string, error) {
+	var g *tf.Graph
+	switch v := graph.(type) {
+	case *tfGraph:
+		g = v.graph
+	case *tfSavedModel:
+		g = v.model.Graph
+	default:
+		return "", "", fmt.Errorf("unsupported graph type %T", graph)
+	}
+	s := &tfSession{graph: g}
+	o, err := s.output(output)
+	if err != nil {
+		return "", "", err
+	}
+	scope := op.NewScopeWithGraph(g).SubScope(name)
+	values, indices := op.TopKV2(scope, o, op.Const(scope, int32(k)))
+	if err := scope.Err(); err != nil {
+		return "", "", err
+	}
+	opName := values.Op.Name()
+	return opName, outputIndexName(opName, indices.Index), nil
+}
+
+// Creates a graph to decode an image
+func makeTransformImageGraph(imageFormat string, nChannels int64) (graph *tf.Graph, input, output tf.Output, err error) {
+	s := op.NewScope()
+	input = op.Placeholder(s, tf.String)
+	// Decode PNG or JPEG
+	var decode tf.Output
+	if imageFormat == "png" {
+		decode = op.DecodePng(s, input, op.DecodePngChannels(nChannels))
+	} else {
+		decode = op.DecodeJpeg(s, input, op.DecodeJpegChannels(nChannels))
+	}
+	output = op.ExpandDims(s, op.Cast(s, decode, tf.Float), op.Const(s.SubScope("make_batch"), int32(0)))
+	graph, err = s.Finalize()
+	return graph, input, output, err
+}
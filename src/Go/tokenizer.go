@@ -0,0 +1,313 @@
+package main
+
+// tokenizer module provides text input support for NLP models
+//
+// Models which accept token ids declare tokenizer in their params.json, e.g.
+// {"name": "bert", ..., "tokenizer": {"type": "wordpiece", "vocab": "vocab.txt",
+//  "maxLength": 128, "padding": true, "truncation": true, "lowercase": true}}
+// and clients send raw text in Row, e.g. {"model": "bert", "text": "some text"}.
+// The server tokenizes the text and feeds the model with int32 tensor of
+// token ids of [1, length] shape, optionally together with attention mask.
+// The vocabulary file lists one token per line, token id is its line number.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// tokenizer types
+const (
+	whitespaceTokenizer = "whitespace"
+	wordpieceTokenizer  = "wordpiece"
+)
+
+// maximum number of characters of the word processed by wordpiece tokenizer
+const maxWordpieceChars = 100
+
+// TokenizerConfig represents tokenizer configuration of the model
+type TokenizerConfig struct {
+	Type       string `json:"type"`       // tokenizer type: whitespace or wordpiece
+	Vocab      string `json:"vocab"`      // vocabulary file name
+	MaxLength  int    `json:"maxLength"`  // maximum sequence length, 0 means no limit
+	Padding    bool   `json:"padding"`    // pad sequences up to maxLength
+	Truncation bool   `json:"truncation"` // truncate sequences longer than maxLength
+	Lowercase  bool   `json:"lowercase"`  // lowercase text before tokenization
+	UnkToken   string `json:"unkToken"`   // unknown token, default [UNK]
+	PadToken   string `json:"padToken"`   // padding token, default [PAD]
+	ClsToken   string `json:"clsToken"`   // token added at the beginning of sequence, e.g. [CLS]
+	SepToken   string `json:"sepToken"`   // token added at the end of sequence, e.g. [SEP]
+	MaskNode   string `json:"maskNode"`   // model input node of attention mask
+}
+
+// Tokenizer converts text into token ids
+type Tokenizer struct {
+	Config TokenizerConfig
+	vocab  map[string]int32
+}
+
+// global cache of model tokenizers
+var (
+	tokenizers     = make(map[string]*Tokenizer)
+	tokenizersLock sync.Mutex
+)
+
+// helper function to load vocabulary file
+func loadVocab(fname string) (map[string]int32, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vocab := make(map[string]int32)
+	scanner := bufio.NewScanner(file)
+	var idx int32
+	for scanner.Scan() {
+		token := strings.TrimRight(scanner.Text(), "\r")
+		if _, ok := vocab[token]; !ok {
+			vocab[token] = idx
+		}
+		idx++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(vocab) == 0 {
+		return nil, fmt.Errorf("empty vocabulary %s", fname)
+	}
+	return vocab, nil
+}
+
+// helper function to create tokenizer for given config, the vocabulary
+// file is looked up in given model path
+func newTokenizer(path string, config TokenizerConfig) (*Tokenizer, error) {
+	if config.Type == "" {
+		config.Type = whitespaceTokenizer
+	}
+	if config.Type != whitespaceTokenizer && config.Type != wordpieceTokenizer {
+		return nil, fmt.Errorf("unsupported tokenizer type '%s'", config.Type)
+	}
+	if config.Vocab == "" {
+		return nil, fmt.Errorf("%s tokenizer requires vocabulary file", config.Type)
+	}
+	if config.MaxLength < 0 {
+		return nil, fmt.Errorf("invalid tokenizer max length %d", config.MaxLength)
+	}
+	if config.UnkToken == "" {
+		config.UnkToken = "[UNK]"
+	}
+	if config.PadToken == "" {
+		config.PadToken = "[PAD]"
+	}
+	vocab, err := loadVocab(filepath.Join(path, config.Vocab))
+	if err != nil {
+		return nil, err
+	}
+	return &Tokenizer{Config: config, vocab: vocab}, nil
+}
+
+// helper function to split text into words, punctuation characters are
+// treated as separate words
+func splitWords(text string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			flush()
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			flush()
+			words = append(words, string(r))
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return words
+}
+
+// helper function to look-up id of given token
+func (t *Tokenizer) tokenID(token string) int32 {
+	if id, ok := t.vocab[token]; ok {
+		return id
+	}
+	return t.vocab[t.Config.UnkToken]
+}
+
+// helper function to split word into word pieces using greedy longest
+// match first algorithm
+func (t *Tokenizer) wordpiece(word string) []int32 {
+	chars := []rune(word)
+	if len(chars) > maxWordpieceChars {
+		return []int32{t.tokenID(t.Config.UnkToken)}
+	}
+	var ids []int32
+	for start := 0; start < len(chars); {
+		end := len(chars)
+		found := false
+		for ; end > start; end-- {
+			piece := string(chars[start:end])
+			if start > 0 {
+				piece = "##" + piece
+			}
+			if id, ok := t.vocab[piece]; ok {
+				ids = append(ids, id)
+				found = true
+				break
+			}
+		}
+		if !found {
+			// whole word is unknown if any of its pieces is unknown
+			return []int32{t.tokenID(t.Config.UnkToken)}
+		}
+		start = end
+	}
+	return ids
+}
+
+// Tokenize converts text into token ids and attention mask
+func (t *Tokenizer) Tokenize(text string) ([]int32, []int32, error) {
+	if t.Config.Lowercase {
+		text = strings.ToLower(text)
+	}
+	var ids []int32
+	if t.Config.ClsToken != "" {
+		ids = append(ids, t.tokenID(t.Config.ClsToken))
+	}
+	var words []string
+	if t.Config.Type == wordpieceTokenizer {
+		words = splitWords(text)
+	} else {
+		words = strings.Fields(text)
+	}
+	for _, word := range words {
+		if t.Config.Type == wordpieceTokenizer {
+			ids = append(ids, t.wordpiece(word)...)
+		} else {
+			ids = append(ids, t.tokenID(word))
+		}
+	}
+	maxLength := t.Config.MaxLength
+	if maxLength > 0 {
+		reserved := 0
+		if t.Config.SepToken != "" {
+			reserved = 1
+		}
+		if len(ids)+reserved > maxLength {
+			if !t.Config.Truncation {
+				return nil, nil, fmt.Errorf("text has %d tokens while model accepts %d", len(ids)+reserved, maxLength)
+			}
+			ids = ids[:maxLength-reserved]
+		}
+	}
+	if t.Config.SepToken != "" {
+		ids = append(ids, t.tokenID(t.Config.SepToken))
+	}
+	mask := make([]int32, len(ids))
+	for i := range mask {
+		mask[i] = 1
+	}
+	if t.Config.Padding && maxLength > 0 {
+		padID := t.vocab[t.Config.PadToken]
+		for len(ids) < maxLength {
+			ids = append(ids, padID)
+			mask = append(mask, 0)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil, errors.New("text does not contain any tokens")
+	}
+	return ids, mask, nil
+}
+
+// helper function to get tokenizer of given model
+func getTokenizer(name string) (*Tokenizer, error) {
+	tokenizersLock.Lock()
+	defer tokenizersLock.Unlock()
+	if t, ok := tokenizers[name]; ok {
+		return t, nil
+	}
+	params, err := getModelParams(name)
+	if err != nil {
+		return nil, err
+	}
+	if params.Tokenizer == nil {
+		return nil, fmt.Errorf("model %s does not accept text input", name)
+	}
+	t, err := newTokenizer(filepath.Join(_config.ModelDir, name), *params.Tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	tokenizers[name] = t
+	return t, nil
+}
+
+// helper function to remove tokenizer of given model
+func removeTokenizer(name string) {
+	tokenizersLock.Lock()
+	defer tokenizersLock.Unlock()
+	delete(tokenizers, name)
+}
+
+// helper function to generate predictions for text input
+func makeTextPredictions(name, tfModel string, row *Row) ([]float32, error) {
+	if tfModel == xgboostBackend {
+		return nil, fmt.Errorf("model %s does not accept text input", name)
+	}
+	tokenizer, err := getTokenizer(name)
+	if err != nil {
+		return nil, err
+	}
+	ids, mask, err := tokenizer.Tokenize(row.Text)
+	if err != nil {
+		return nil, err
+	}
+	shape := []int64{1, int64(len(ids))}
+	input, err := _tf.NewInt32Tensor(ids, shape)
+	if err != nil {
+		return nil, err
+	}
+	var graph TFGraph
+	var inputNode, outputNode string
+	if tfModel == "tf2" {
+		params, err := getModelParams(name)
+		if err != nil {
+			return nil, err
+		}
+		if graph, err = getModel(name); err != nil {
+			return nil, err
+		}
+		params = row.Overrides.apply(params)
+		inputNode, outputNode = params.tf2Nodes()
+	} else {
+		tfm, err := _cache.get(name)
+		if err != nil {
+			return nil, err
+		}
+		graph = tfm.Graph
+		params := row.Overrides.apply(tfm.Params)
+		inputNode, outputNode = params.nodes()
+	}
+	feeds := map[string]TFTensor{inputNode: input}
+	if node := tokenizer.Config.MaskNode; node != "" {
+		if feeds[node], err = _tf.NewInt32Tensor(mask, shape); err != nil {
+			return nil, err
+		}
+	}
+	results, err := runRowSession(row, name, graph, feeds, []string{outputNode})
+	if err != nil {
+		return nil, err
+	}
+	return outputRow(name, results[0])
+}
@@ -0,0 +1,91 @@
+package main
+
+// tests of text tokenization, they do not require TF C library
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// test vocabulary, token id is its line number
+var testVocab = []string{"[PAD]", "[UNK]", "[CLS]", "[SEP]", "the", "muon", "##s", "track", ",", "hit"}
+
+// helper function to write test vocabulary into given directory
+func writeTestVocab(tb testing.TB, path string) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	data := []byte(strings.Join(testVocab, "\n") + "\n")
+	if err := ioutil.WriteFile(filepath.Join(path, "vocab.txt"), data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// TestTokenizer checks whitespace and wordpiece tokenizers
+func TestTokenizer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestVocab(t, dir)
+	tests := []struct {
+		config TokenizerConfig
+		text   string
+		ids    []int32
+		mask   []int32
+	}{
+		{TokenizerConfig{Type: "whitespace", Vocab: "vocab.txt"}, "the muon hits", []int32{4, 5, 1}, []int32{1, 1, 1}},
+		{TokenizerConfig{Type: "wordpiece", Vocab: "vocab.txt", Lowercase: true, ClsToken: "[CLS]", SepToken: "[SEP]"},
+			"The muons, track", []int32{2, 4, 5, 6, 8, 7, 3}, []int32{1, 1, 1, 1, 1, 1, 1}},
+		{TokenizerConfig{Type: "wordpiece", Vocab: "vocab.txt", MaxLength: 6, Padding: true, ClsToken: "[CLS]", SepToken: "[SEP]"},
+			"muon hit", []int32{2, 5, 9, 3, 0, 0}, []int32{1, 1, 1, 1, 0, 0}},
+		{TokenizerConfig{Type: "wordpiece", Vocab: "vocab.txt", MaxLength: 4, Truncation: true, ClsToken: "[CLS]", SepToken: "[SEP]"},
+			"muons track hit", []int32{2, 5, 6, 3}, []int32{1, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		tokenizer, err := newTokenizer(dir, test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, mask, err := tokenizer.Tokenize(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, test.ids) || !reflect.DeepEqual(mask, test.mask) {
+			t.Errorf("%s: wrong tokens %v mask %v, expected %v %v", test.text, ids, mask, test.ids, test.mask)
+		}
+	}
+
+	// long text without truncation is rejected
+	tokenizer, _ := newTokenizer(dir, TokenizerConfig{Type: "whitespace", Vocab: "vocab.txt", MaxLength: 2})
+	if _, _, err := tokenizer.Tokenize("the muon track"); err == nil {
+		t.Error("long text should be rejected without truncation")
+	}
+	if _, err := newTokenizer(dir, TokenizerConfig{Type: "bpe", Vocab: "vocab.txt"}); err == nil {
+		t.Error("unsupported tokenizer should be rejected")
+	}
+}
+
+// TestTextPredictions checks predictions of NLP model for text input
+func TestTextPredictions(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	config := TokenizerConfig{Type: "wordpiece", Vocab: "vocab.txt", MaxLength: 8, Padding: true, MaskNode: "mask"}
+	writeModelFiles(t, "nlp", []byte("nlp"), TFParams{InputNode: "input", OutputNode: "output", Tokenizer: &config})
+	path := filepath.Join(_config.ModelDir, "nlp")
+	if err := validateModel(path, "nlp"); err == nil {
+		t.Error("model without vocabulary should be rejected")
+	}
+	writeTestVocab(t, path)
+	if err := validateModel(path, "nlp"); err != nil {
+		t.Fatalf("valid model is rejected: %v", err)
+	}
+	probs, err := makePredictions(&Row{Model: "nlp", Text: "the muon track"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProbs(t, probs)
+	if _, err := makePredictions(&Row{Model: "dnn", Text: "the muon track"}); err == nil {
+		t.Error("text input should be rejected for model without tokenizer")
+	}
+}
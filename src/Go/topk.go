@@ -0,0 +1,101 @@
+package main
+
+// topk module provides classification with TopK operation of model graph
+//
+// Sorting all probabilities of models with huge label spaces (100k+ labels)
+// in Go for every request is wasteful. Models may declare "top_k" in their
+// params.json, e.g. "top_k": 10, in which case TopK operation of the output
+// node is added to the model graph (once per loaded model) and image
+// classification of TF 1.X models fetches only k best values and their
+// indices from TF. The number of returned labels (top_n override, default 5)
+// is capped by top_k. Requests which override softmax use full model
+// outputs since softmax requires all of them.
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// topKOutputs represents TopK operation added to the graph
+type topKOutputs struct {
+	graph   TFGraph // graph the operation is added to
+	values  string  // name of values output
+	indices string  // name of indices output
+}
+
+// TopK operations of models keyed by their output and k
+var (
+	_topK    = make(map[string]map[string]topKOutputs)
+	topKLock sync.Mutex
+)
+
+// pattern of characters which are not allowed in TF operation names
+var opNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// helper function to return outputs of TopK operation of given output of the
+// model graph, the operation is added to the graph once
+func topKNodes(model string, graph TFGraph, output string, k int) (string, string, error) {
+	key := fmt.Sprintf("%s/%d", output, k)
+	topKLock.Lock()
+	defer topKLock.Unlock()
+	if nodes, ok := _topK[model][key]; ok && nodes.graph == graph {
+		return nodes.values, nodes.indices, nil
+	}
+	name := fmt.Sprintf("tfaas_topk_%d_%s", k, opNameRegexp.ReplaceAllString(output, "_"))
+	values, indices, err := _tf.AddTopK(graph, output, name, k)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to add TopK operation to %s model: %v", model, err)
+	}
+	if _topK[model] == nil {
+		_topK[model] = make(map[string]topKOutputs)
+	}
+	_topK[model][key] = topKOutputs{graph: graph, values: values, indices: indices}
+	return values, indices, nil
+}
+
+// helper function to forget TopK operations of the model
+func removeTopK(model string) {
+	topKLock.Lock()
+	defer topKLock.Unlock()
+	delete(_topK, model)
+}
+
+// classifyTopK classifies input tensor with TopK operation of the model
+// graph, it returns topN best labels
+func classifyTopK(model string, tfm TFModel, input, output string, tensor TFTensor, topN int) ([]LabelResult, error) {
+	k := tfm.Params.TopK
+	values, indices, err := topKNodes(model, tfm.Graph, output, k)
+	if err != nil {
+		return nil, err
+	}
+	results, err := runSession(model, tfm.Graph,
+		map[string]TFTensor{input: tensor},
+		[]string{values, indices})
+	if err != nil {
+		return nil, err
+	}
+	probs, err := tensorRows(results[0])
+	if err != nil {
+		return nil, err
+	}
+	idx, err := tensorRows(results[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(probs) == 0 || len(idx) == 0 || len(probs[0]) != len(idx[0]) {
+		return nil, fmt.Errorf("model %s produced inconsistent TopK outputs", model)
+	}
+	var labels []LabelResult
+	for i, p := range probs[0] {
+		if i >= topN {
+			break
+		}
+		j := int(idx[0][i])
+		if j < 0 || j >= len(tfm.Labels) {
+			return nil, fmt.Errorf("model %s produced label index %d out of %d labels", model, j, len(tfm.Labels))
+		}
+		labels = append(labels, LabelResult{Label: tfm.Labels[j], Probability: p})
+	}
+	return labels, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+// tests of TopK classification, they do not require TF C library
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTopKClassification checks image classification with TopK operation
+func TestTopKClassification(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	params := TFParams{InputNode: "input", OutputNode: "output", ImgChannels: 3, TopK: 2}
+	writeModelFiles(t, "imgk", []byte("imgk"), params)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ImageTF1Handler(w, imageRequest(t, "imgk"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+		}
+		var res ClassifyResult
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Labels) != 2 || res.Labels[0].Label != "c" || res.Labels[1].Label != "b" || res.Labels[1].Probability != 0.3 {
+			t.Fatalf("wrong classification result %+v", res)
+		}
+		fetches := fake.Fetches()
+		if len(fetches) != 2 || fetches[0] != "tfaas_topk_2_output" || fetches[1] != "tfaas_topk_2_output:1" {
+			t.Fatalf("wrong fetches %v", fetches)
+		}
+	}
+
+	// TopK operation is added again to reloaded model
+	resetModelCache("imgk")
+	w := httptest.NewRecorder()
+	ImageTF1Handler(w, imageRequest(t, "imgk"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d after reload: %s", w.Code, w.Body.String())
+	}
+}
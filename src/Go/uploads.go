@@ -0,0 +1,320 @@
+package main
+
+// uploads module provides resumable (chunked) uploads of model bundles
+//
+// Large model bundles are uploaded in chunks within upload session:
+// POST /upload/sessions with {"name": "dnn", "size": 123, "sha256": "..."}
+// creates new session, every chunk is sent via
+// PATCH /upload/sessions/{id} with Upload-Offset header (and optional
+// Chunk-Sha256 header), GET /upload/sessions/{id} returns current offset to
+// resume interrupted upload, and
+// POST /upload/sessions/{id}/complete verifies bundle checksum and installs
+// the bundle. The sessions are kept in modelDir/.uploads area, i.e. they
+// survive server restarts, and abandoned sessions are removed by the janitor
+// after uploadSessionTTL seconds.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// default time in seconds to keep abandoned upload sessions
+const defaultUploadSessionTTL = 86400
+
+// UploadSession represents resumable upload of model bundle
+type UploadSession struct {
+	ID      string `json:"id"`      // session identifier
+	Name    string `json:"name"`    // model name, optional for bundles with params.json
+	Size    int64  `json:"size"`    // total size of the bundle
+	Sha256  string `json:"sha256"`  // sha256 checksum of the bundle
+	Offset  int64  `json:"offset"`  // number of received bytes
+	Created int64  `json:"created"` // session creation time
+	Updated int64  `json:"updated"` // time of last received chunk
+}
+
+// locks of upload sessions, chunks of every session are written one at a
+// time while different sessions are uploaded concurrently
+var (
+	uploadLocks = make(map[string]*sync.Mutex)
+	uploadsLock sync.Mutex
+)
+
+// helper function to check if given upload session exists
+func hasUploadSession(id string) bool {
+	_, err := os.Stat(filepath.Join(uploadsArea(), id, "session.json"))
+	return err == nil
+}
+
+// helper function to return lock of given upload session
+func uploadLock(id string) *sync.Mutex {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	lock, ok := uploadLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		uploadLocks[id] = lock
+	}
+	return lock
+}
+
+// helper function to return location of upload sessions area
+func uploadsArea() string {
+	return filepath.Join(_config.ModelDir, ".uploads")
+}
+
+// helper function to return upload session TTL
+func uploadSessionTTL() int64 {
+	if _config.UploadSessionTTL > 0 {
+		return int64(_config.UploadSessionTTL)
+	}
+	return defaultUploadSessionTTL
+}
+
+// helper function to return path of upload session file
+func (s *UploadSession) path(fname string) string {
+	return filepath.Join(uploadsArea(), s.ID, fname)
+}
+
+// helper function to save upload session meta-data
+func (s *UploadSession) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path("session.json"), data, 0644)
+}
+
+// helper function to load upload session, the offset is taken from the
+// size of received data
+func loadUploadSession(id string) (*UploadSession, error) {
+	var s UploadSession
+	data, err := ioutil.ReadFile(filepath.Join(uploadsArea(), id, "session.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.path("data"))
+	if err != nil {
+		return nil, err
+	}
+	s.Offset = info.Size()
+	return &s, nil
+}
+
+// helper function to remove upload session
+func (s *UploadSession) remove() error {
+	uploadsLock.Lock()
+	delete(uploadLocks, s.ID)
+	uploadsLock.Unlock()
+	return os.RemoveAll(filepath.Join(uploadsArea(), s.ID))
+}
+
+// helper function to append chunk at given offset, in case of error the
+// received data are truncated back to given offset
+func (s *UploadSession) appendChunk(r io.Reader, offset int64, checksum string) error {
+	if offset != s.Offset {
+		return fmt.Errorf("upload offset %d does not match session offset %d", offset, s.Offset)
+	}
+	file, err := os.OpenFile(s.path("data"), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	limit := s.Size - offset
+	n, err := io.Copy(io.MultiWriter(file, h), io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("chunk exceeds bundle size %d", s.Size)
+	}
+	if err == nil && checksum != "" && !strings.EqualFold(checksum, hex.EncodeToString(h.Sum(nil))) {
+		err = errors.New("chunk checksum mismatch")
+	}
+	if err != nil {
+		file.Truncate(offset)
+		return err
+	}
+	s.Offset = offset + n
+	s.Updated = time.Now().Unix()
+	return s.save()
+}
+
+// helper function to verify checksum of uploaded bundle
+func (s *UploadSession) verify() error {
+	if s.Offset != s.Size {
+		return fmt.Errorf("bundle is incomplete, received %d out of %d bytes", s.Offset, s.Size)
+	}
+	file, err := os.Open(s.path("data"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, s.Sha256) {
+		return fmt.Errorf("bundle checksum %s does not match expected %s", sum, s.Sha256)
+	}
+	return nil
+}
+
+// helper function to remove abandoned upload sessions
+func expireUploadSessions() []string {
+	files, err := ioutil.ReadDir(uploadsArea())
+	if err != nil {
+		return nil
+	}
+	var expired []string
+	now := time.Now().Unix()
+	for _, f := range files {
+		lock := uploadLock(f.Name())
+		// skip sessions which receive chunks right now
+		if !lock.TryLock() {
+			continue
+		}
+		s, err := loadUploadSession(f.Name())
+		if err != nil {
+			s = &UploadSession{ID: f.Name()}
+		} else if now-s.Updated <= uploadSessionTTL() {
+			lock.Unlock()
+			continue
+		}
+		if err := s.remove(); err == nil {
+			expired = append(expired, f.Name())
+		}
+		lock.Unlock()
+	}
+	return expired
+}
+
+// UploadSessionCreateHandler creates new upload session
+func UploadSessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var s UploadSession
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		responseError(w, "unable to parse upload session", err, http.StatusBadRequest)
+		return
+	}
+	if _, err := hex.DecodeString(s.Sha256); err != nil || len(s.Sha256) != 2*sha256.Size {
+		responseError(w, "upload session should provide sha256 checksum of the bundle", err, http.StatusBadRequest)
+		return
+	}
+	if s.Size <= 0 {
+		responseError(w, "upload session should provide size of the bundle", nil, http.StatusBadRequest)
+		return
+	}
+	if err := checkFreeSpace(s.Size); err != nil {
+		responseError(w, "insufficient storage", err, http.StatusInsufficientStorage)
+		return
+	}
+	s.ID = newJobID()
+	s.Offset = 0
+	s.Created = time.Now().Unix()
+	s.Updated = s.Created
+	err := os.MkdirAll(filepath.Join(uploadsArea(), s.ID), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(s.path("data"), nil, 0644)
+	}
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		s.remove()
+		responseError(w, "unable to create upload session", err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("create upload session %s model %s size %d", s.ID, s.Name, s.Size)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", basePath("/upload/sessions/"+s.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// UploadSessionHandler provides status of upload session, accepts its
+// chunks or aborts the session
+func UploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	id := mux.Vars(r)["id"]
+	if !hasUploadSession(id) {
+		responseError(w, fmt.Sprintf("upload session %s is not found", id), nil, http.StatusNotFound)
+		return
+	}
+	lock := uploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	s, err := loadUploadSession(id)
+	if err != nil {
+		responseError(w, fmt.Sprintf("upload session %s is not found", id), err, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		if err := s.remove(); err != nil {
+			responseError(w, "unable to remove upload session", err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "PATCH":
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			responseError(w, "request should provide Upload-Offset header", err, http.StatusBadRequest)
+			return
+		}
+		if offset != s.Offset {
+			// client should resume upload from session offset
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(s)
+			return
+		}
+		if err := s.appendChunk(r.Body, offset, r.Header.Get("Chunk-Sha256")); err != nil {
+			responseError(w, "unable to write chunk", err, http.StatusBadRequest)
+			return
+		}
+	}
+	responseJSON(w, s)
+}
+
+// UploadSessionCompleteHandler verifies uploaded bundle and installs it
+func UploadSessionCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !hasUploadSession(id) {
+		responseError(w, fmt.Sprintf("upload session %s is not found", id), nil, http.StatusNotFound)
+		return
+	}
+	lock := uploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	s, err := loadUploadSession(id)
+	if err == nil {
+		err = s.verify()
+	}
+	if err != nil {
+		responseError(w, "unable to complete upload session", err, http.StatusBadRequest)
+		return
+	}
+	defer s.remove()
+	log.Printf("complete upload session %s model %s", s.ID, s.Name)
+	installBundleFile(w, s.path("data"), s.Name)
+}
@@ -0,0 +1,118 @@
+package main
+
+// tests of resumable uploads, they do not require TF C library
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to create tar.gz bundle of fake model
+func testBundle(t *testing.T, name string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	params, _ := json.Marshal(TFParams{Name: name, Model: "model.pb", Labels: "labels.txt", InputNode: "input", OutputNode: "output"})
+	files := map[string][]byte{"params.json": params, "model.pb": []byte(name), "labels.txt": []byte("a\nb\nc\n")}
+	for fname, data := range files {
+		tw.WriteHeader(&tar.Header{Name: fname, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// helper function to send request to upload session handler
+func uploadRequest(method, id string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/upload/sessions/"+id, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	w := httptest.NewRecorder()
+	if method == "POST" {
+		UploadSessionCompleteHandler(w, req)
+	} else {
+		UploadSessionHandler(w, req)
+	}
+	return w
+}
+
+// TestUploadSession checks chunked upload of model bundle
+func TestUploadSession(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	bundle := testBundle(t, "chunked")
+	sum := sha256.Sum256(bundle)
+	data, _ := json.Marshal(UploadSession{Size: int64(len(bundle)), Sha256: hex.EncodeToString(sum[:])})
+	w := httptest.NewRecorder()
+	UploadSessionCreateHandler(w, httptest.NewRequest("POST", "/upload/sessions", bytes.NewReader(data)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var s UploadSession
+	json.NewDecoder(w.Body).Decode(&s)
+
+	half := len(bundle) / 2
+	offset := func(n int) map[string]string { return map[string]string{"Upload-Offset": fmt.Sprint(n)} }
+	if w := uploadRequest("PATCH", s.ID, bundle[:half], offset(0)); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	// completion of incomplete upload fails
+	if w := uploadRequest("POST", s.ID, nil, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for incomplete upload", w.Code)
+	}
+	// wrong offset returns current session offset
+	w = uploadRequest("PATCH", s.ID, bundle[half:], offset(0))
+	json.NewDecoder(w.Body).Decode(&s)
+	if w.Code != http.StatusConflict || s.Offset != int64(half) {
+		t.Fatalf("wrong status code %d and offset %d for wrong offset", w.Code, s.Offset)
+	}
+	// chunk with wrong checksum is rejected and discarded
+	headers := offset(half)
+	headers["Chunk-Sha256"] = hex.EncodeToString(sum[:])
+	if w := uploadRequest("PATCH", s.ID, bundle[half:], headers); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d for wrong chunk checksum", w.Code)
+	}
+	chunkSum := sha256.Sum256(bundle[half:])
+	headers["Chunk-Sha256"] = hex.EncodeToString(chunkSum[:])
+	if w := uploadRequest("PATCH", s.ID, bundle[half:], headers); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	if w := uploadRequest("POST", s.ID, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(_config.ModelDir, "chunked", "model.pb")); err != nil {
+		t.Fatalf("model is not installed: %v", err)
+	}
+	if hasUploadSession(s.ID) {
+		t.Error("upload session should be removed after completion")
+	}
+	if w := uploadRequest("GET", s.ID, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code %d for removed session", w.Code)
+	}
+}
+
+// TestExpireUploadSessions checks removal of abandoned upload sessions
+func TestExpireUploadSessions(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	s := UploadSession{ID: "abc", Size: 10}
+	os.MkdirAll(filepath.Join(uploadsArea(), s.ID), 0755)
+	os.WriteFile(s.path("data"), nil, 0644)
+	s.save()
+	if expired := expireUploadSessions(); len(expired) != 1 {
+		t.Fatalf("abandoned session should expire %v", expired)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/vkuznet/x509proxy"
@@ -182,6 +183,10 @@ func TFModels() ([]TFParams, error) {
 	}
 	// loop over found model areas and read their parameters
 	for _, f := range files {
+		// skip non model areas, e.g. aliases file
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
 		path := fmt.Sprintf("%s/%s", _config.ModelDir, f.Name())
 		fname := fmt.Sprintf("%s/params.json", path)
 		file, err := os.Open(fname)
@@ -202,14 +207,22 @@ func TFModels() ([]TFParams, error) {
 	return models, nil
 }
 
-// Untar helper function to untar given tarball into target destination
+// Untar helper function to untar given tarball into target destination,
+// it returns list of top level directories (models) found in tarball
 // based on https://golangdocs.com/tar-gzip-in-golang
-func Untar(tarball, target string) error {
+func Untar(tarball, target string) ([]string, error) {
 	reader, err := os.Open(tarball)
 	if err != nil {
-		return err
+		return []string{}, err
 	}
 	defer reader.Close()
+	return UntarReader(reader, target)
+}
+
+// UntarReader helper function to untar given tar stream into target
+// destination, extracted files can't exhaust free space of model area
+func UntarReader(reader io.Reader, target string) ([]string, error) {
+	var models []string
 	tarReader := tar.NewReader(reader)
 
 	for {
@@ -217,27 +230,41 @@ func Untar(tarball, target string) error {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return models, err
 		}
 
+		if filepath.Clean(header.Name) == "." {
+			// top directory of bundles made by tar -C model -czf bundle.tgz .
+			continue
+		}
 		path := filepath.Join(target, header.Name)
+		if !strings.HasPrefix(path, filepath.Clean(target)+string(os.PathSeparator)) {
+			return models, fmt.Errorf("invalid file path %s in tarball", header.Name)
+		}
 		info := header.FileInfo()
+		top := strings.Split(strings.TrimPrefix(filepath.Clean(header.Name), "/"), "/")[0]
+		if top != "" && top != "." && !InList(top, models) {
+			models = append(models, top)
+		}
 		if info.IsDir() {
 			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
+				return models, err
 			}
 			continue
 		}
 
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return models, err
+		}
 		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
 		if err != nil {
-			return err
+			return models, err
 		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
+		_, err = io.Copy(newSpaceLimitedWriter(file), tarReader)
+		file.Close()
 		if err != nil {
-			return err
+			return models, err
 		}
 	}
-	return nil
+	return models, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+// validate module provides dry-run validation of model inputs
+//
+// Models may declare schema of their input features in params.json, e.g.
+// "schema": [{"name": "pt", "min": 0, "max": 7000},
+//            {"name": "nhits", "dtype": "int", "min": 0},
+//            {"name": "isolated", "dtype": "bool"}]
+// where feature dtype is float (default), int or bool and value ranges are
+// usually taken from the training profile of the model.
+// POST /validate/<model> with a row, e.g.
+// {"keys": ["pt", "nhits", "isolated"], "values": [35.2, 12, 1]}
+// or a batch of rows, e.g.
+// {"keys": [...], "shape": [2, 3], "values": [35.2, 12, 1, 8000, 3.5, 0]}
+// checks feature names, counts, dtypes and value ranges without running
+// inference and returns detailed validation errors, e.g.
+// {"valid": false, "rows": 2, "errors": [
+//   {"row": 1, "feature": "pt", "error": "value 8000 is above maximum 7000"},
+//   {"row": 1, "feature": "nhits", "error": "value 3.5 is not an integer"}]}
+// with 422 status code for invalid inputs. Models without schema are only
+// checked for consistency of keys and values and for NaN or Inf values.
+// Payloads are also checked against input schema of the model, see schemas
+// module.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// maximum number of reported validation errors
+const maxValidationErrors = 100
+
+// FeatureSchema represents expected input feature of the model
+type FeatureSchema struct {
+	Name  string   `json:"name"`            // feature name
+	DType string   `json:"dtype,omitempty"` // feature data type: float (default), int or bool
+	Min   *float64 `json:"min,omitempty"`   // minimal value of the feature
+	Max   *float64 `json:"max,omitempty"`   // maximal value of the feature
+}
+
+// ValidationRequest represents row or batch of rows to validate
+type ValidationRequest struct {
+	Keys   []string  `json:"keys"`   // feature names
+	Values []float32 `json:"values"` // row values or flat vector of batch values
+	Shape  []int64   `json:"shape"`  // shape of the batch, e.g. [nrows, ncols]
+}
+
+// ValidationError represents validation error of the input
+type ValidationError struct {
+	Row     int    `json:"row"`               // row index, -1 for errors of whole input
+	Feature string `json:"feature,omitempty"` // feature name
+	Error   string `json:"error"`             // error message
+}
+
+// ValidationResult represents result of input validation
+type ValidationResult struct {
+	Valid     bool              `json:"valid"`               // input passed all checks
+	Rows      int               `json:"rows"`                // number of validated rows
+	Errors    []ValidationError `json:"errors"`              // validation errors
+	Truncated bool              `json:"truncated,omitempty"` // only first errors are reported
+}
+
+// helper function to add validation error to the result
+func (v *ValidationResult) add(row int, feature, msg string, args ...interface{}) {
+	v.Valid = false
+	if len(v.Errors) >= maxValidationErrors {
+		v.Truncated = true
+		return
+	}
+	v.Errors = append(v.Errors, ValidationError{Row: row, Feature: feature, Error: fmt.Sprintf(msg, args...)})
+}
+
+// helper function to check value of the feature
+func (f FeatureSchema) check(value float32) error {
+	v := float64(value)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("value %v is not finite", value)
+	}
+	switch f.DType {
+	case "", "float":
+	case "int":
+		if v != math.Trunc(v) {
+			return fmt.Errorf("value %v is not an integer", value)
+		}
+	case "bool":
+		if v != 0 && v != 1 {
+			return fmt.Errorf("value %v is not a boolean (0 or 1)", value)
+		}
+	default:
+		return fmt.Errorf("unsupported dtype %s of the schema", f.DType)
+	}
+	if f.Min != nil && v < *f.Min {
+		return fmt.Errorf("value %v is below minimum %v", value, *f.Min)
+	}
+	if f.Max != nil && v > *f.Max {
+		return fmt.Errorf("value %v is above maximum %v", value, *f.Max)
+	}
+	return nil
+}
+
+// helper function to validate input against schema of the model
+func validateInput(req ValidationRequest, schema []FeatureSchema) ValidationResult {
+	res := ValidationResult{Valid: true, Errors: []ValidationError{}}
+	nrows, ncols := 1, len(req.Values)
+	switch len(req.Shape) {
+	case 0:
+	case 2:
+		if req.Shape[0] < 0 || req.Shape[1] < 0 || req.Shape[0]*req.Shape[1] != int64(len(req.Values)) {
+			res.add(-1, "", "shape %v does not match %d values", req.Shape, len(req.Values))
+			return res
+		}
+		nrows, ncols = int(req.Shape[0]), int(req.Shape[1])
+	default:
+		res.add(-1, "", "shape %v is not [nrows, ncols]", req.Shape)
+		return res
+	}
+	res.Rows = nrows
+
+	// feature names and counts
+	expected := ncols
+	if len(schema) > 0 {
+		expected = len(schema)
+		if ncols != expected {
+			res.add(-1, "", "rows have %d values while model expects %d features", ncols, expected)
+		}
+	}
+	if len(req.Keys) > 0 {
+		if len(req.Keys) != ncols {
+			res.add(-1, "", "%d keys do not match %d values of the row", len(req.Keys), ncols)
+		}
+		for i, f := range schema {
+			if i >= len(req.Keys) {
+				res.add(-1, f.Name, "feature is missing")
+			} else if req.Keys[i] != f.Name {
+				res.add(-1, f.Name, "feature is expected at position %d instead of %s", i, req.Keys[i])
+			}
+		}
+		for i := len(schema); len(schema) > 0 && i < len(req.Keys); i++ {
+			res.add(-1, req.Keys[i], "feature is unknown to the model")
+		}
+	}
+	if !res.Valid {
+		// values can't be matched with features
+		return res
+	}
+
+	// feature values
+	for row := 0; row < nrows; row++ {
+		for col := 0; col < ncols; col++ {
+			f := FeatureSchema{Name: fmt.Sprintf("%d", col)}
+			if len(schema) > 0 {
+				f = schema[col]
+			} else if len(req.Keys) > 0 {
+				f.Name = req.Keys[col]
+			}
+			if err := f.check(req.Values[row*ncols+col]); err != nil {
+				res.add(row, f.Name, "%v", err)
+			}
+		}
+	}
+	return res
+}
+
+// ValidateHandler validates model inputs without running inference
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	model := resolveModel(mux.Vars(r)["model"])
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model params", err, http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseError(w, "unable to read validation request", err, http.StatusBadRequest)
+		return
+	}
+	var req ValidationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		responseError(w, "unable to unmarshal validation request", err, http.StatusBadRequest)
+		return
+	}
+	res := validateInput(req, params.Schema)
+	// payload contract of the model, see schemas module
+	if schema, err := getInputSchema(model); err == nil && schema != nil {
+		violations, _ := schema.validate(body)
+		for _, msg := range violations {
+			res.add(-1, "", "%s", msg)
+		}
+	}
+	if !res.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	responseJSON(w, res)
+}
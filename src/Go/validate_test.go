@@ -0,0 +1,89 @@
+package main
+
+// tests of input validation, they do not require TF C library
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to validate input of given model
+func validateRequest(t *testing.T, model, body string) (int, ValidationResult) {
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/validate/"+model, strings.NewReader(body)), map[string]string{"model": model})
+	rr := httptest.NewRecorder()
+	ValidateHandler(rr, req)
+	var res ValidationResult
+	if rr.Code == http.StatusOK || rr.Code == http.StatusUnprocessableEntity {
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, res
+}
+
+// TestValidateInput checks validation of rows and batches against model schema
+func TestValidateInput(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	lo, hi := 0.0, 7000.0
+	params := TFParams{InputNode: "input", OutputNode: "output"}
+	params.Schema = []FeatureSchema{
+		{Name: "pt", Min: &lo, Max: &hi},
+		{Name: "nhits", DType: "int", Min: &lo},
+		{Name: "isolated", DType: "bool"},
+	}
+	writeModelFiles(t, "schema", []byte("schema"), params)
+
+	code, res := validateRequest(t, "schema", `{"keys": ["pt", "nhits", "isolated"], "values": [35.2, 12, 1]}`)
+	if code != http.StatusOK || !res.Valid || res.Rows != 1 || len(res.Errors) != 0 {
+		t.Errorf("valid row is rejected %d %+v", code, res)
+	}
+
+	body := `{"keys": ["pt", "nhits", "isolated"], "shape": [2, 3], "values": [35.2, 12, 1, 8000, 3.5, 2]}`
+	code, res = validateRequest(t, "schema", body)
+	expect := []ValidationError{
+		{Row: 1, Feature: "pt", Error: "value 8000 is above maximum 7000"},
+		{Row: 1, Feature: "nhits", Error: "value 3.5 is not an integer"},
+		{Row: 1, Feature: "isolated", Error: "value 2 is not a boolean (0 or 1)"},
+	}
+	if code != http.StatusUnprocessableEntity || res.Valid || res.Rows != 2 || len(res.Errors) != len(expect) {
+		t.Fatalf("wrong validation of batch %d %+v", code, res)
+	}
+	for i, e := range expect {
+		if res.Errors[i] != e {
+			t.Errorf("wrong error %+v, expected %+v", res.Errors[i], e)
+		}
+	}
+
+	// names and counts of features
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{"keys": ["pt", "isolated", "nhits"], "values": [1, 1, 1]}`, "feature is expected at position 1 instead of isolated"},
+		{`{"keys": ["pt", "nhits"], "values": [1, 1]}`, "rows have 2 values while model expects 3 features"},
+		{`{"keys": ["pt", "nhits", "isolated", "eta"], "values": [1, 1, 1, 1]}`, "rows have 4 values while model expects 3 features"},
+		{`{"shape": [2, 3], "values": [1, 1, 1]}`, "shape [2 3] does not match 3 values"},
+	}
+	for _, tt := range tests {
+		code, res := validateRequest(t, "schema", tt.body)
+		if code != http.StatusUnprocessableEntity || len(res.Errors) == 0 || res.Errors[0].Error != tt.error {
+			t.Errorf("wrong validation of %s: %d %+v", tt.body, code, res)
+		}
+	}
+
+	// models without schema are checked for consistency of inputs
+	if code, res := validateRequest(t, "dnn", `{"values": [1, 2, 3, 4]}`); code != http.StatusOK || !res.Valid {
+		t.Errorf("valid row of model without schema is rejected %d %+v", code, res)
+	}
+	if code, _ := validateRequest(t, "dnn", `{"keys": ["a"], "values": [1, 2]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status %d of inconsistent keys", code)
+	}
+	if code, _ := validateRequest(t, "missing", `{"values": [1]}`); code != http.StatusNotFound {
+		t.Errorf("wrong status %d of unknown model", code)
+	}
+}
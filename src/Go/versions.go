@@ -0,0 +1,262 @@
+package main
+
+// versions module provides support of model versions
+//
+// When model is uploaded to the server its previous content is moved to
+// modelDir/.versions/<model>/<version> area, where version is a time stamp
+// of the upload. The server keeps up to versionsLimit previous versions
+// of every model which can be used to rollback the model. Rollback swaps
+// the newest version with the current model (atomically on Linux), and the
+// current model is kept as a new version of the model.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// default number of previous model versions to keep
+const defaultVersionsLimit = 3
+
+// versionsLock protects model versions area
+var versionsLock sync.Mutex
+
+// name of the file which marks pinned model version
+const pinFile = ".pinned"
+
+// ModelVersion represents previous version of the model
+type ModelVersion struct {
+	Model   string `json:"model"`   // model name
+	Version string `json:"version"` // model version
+	Path    string `json:"path"`    // model version path
+	Pinned  bool   `json:"pinned"`  // pinned versions are never removed by janitor
+	Size    int64  `json:"size"`    // size of model version on disk
+	Time    int64  `json:"time"`    // creation time of model version (unix seconds)
+}
+
+// helper function to return location of model versions area
+func versionsDir(model string) string {
+	return filepath.Join(_config.ModelDir, ".versions", model)
+}
+
+// helper function to return number of model versions to keep
+func versionsLimit() int {
+	if _config.VersionsLimit > 0 {
+		return _config.VersionsLimit
+	}
+	return defaultVersionsLimit
+}
+
+// helper function to list previous versions of the model, the list is
+// sorted from oldest to newest version
+func modelVersions(model string) ([]ModelVersion, error) {
+	var out []ModelVersion
+	vdir := versionsDir(model)
+	files, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return out, err
+	}
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(vdir, f.Name())
+		_, err := os.Stat(filepath.Join(path, pinFile))
+		out = append(out, ModelVersion{
+			Model:   model,
+			Version: f.Name(),
+			Path:    path,
+			Pinned:  err == nil,
+			Size:    dirSize(path),
+			Time:    f.ModTime().Unix(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// helper function to return path of new version of the model, it should
+// be called under versions lock
+func newVersionPath(model string) (string, error) {
+	vdir := versionsDir(model)
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		return "", err
+	}
+	version := time.Now().Format("20060102150405")
+	path := filepath.Join(vdir, version)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path, nil
+		}
+		path = filepath.Join(vdir, fmt.Sprintf("%s.%d", version, i))
+	}
+}
+
+// helper function to update modification time of the version to reflect
+// its archiving time
+func touchVersion(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// helper function to move current model area into versions area
+func archiveModel(model string) error {
+	if !modelExists(model) {
+		return nil
+	}
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+	path, err := newVersionPath(model)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(_config.ModelDir, model), path); err != nil {
+		return err
+	}
+	touchVersion(path)
+	log.Printf("archive model %s to %s", model, path)
+	return nil
+}
+
+// helper function to restore previous version of the model, the current
+// model is archived as new version
+func rollbackModel(model string) (ModelVersion, error) {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+	var version ModelVersion
+	versions, err := modelVersions(model)
+	if err != nil {
+		return version, err
+	}
+	if len(versions) == 0 {
+		return version, fmt.Errorf("model %s does not have previous versions", model)
+	}
+	version = versions[len(versions)-1]
+	path := filepath.Join(_config.ModelDir, model)
+	if modelExists(model) {
+		archive, err := newVersionPath(model)
+		if err != nil {
+			return version, err
+		}
+		if err := exchangePaths(version.Path, path); err == nil {
+			// version area holds current model after the exchange
+			if err := os.Rename(version.Path, archive); err != nil {
+				log.Printf("unable to archive model %s as %s: %v", model, archive, err)
+				archive = version.Path
+			}
+		} else {
+			if err := os.Rename(path, archive); err != nil {
+				return version, err
+			}
+			if err := os.Rename(version.Path, path); err != nil {
+				// put current model back
+				os.Rename(archive, path)
+				return version, err
+			}
+		}
+		touchVersion(archive)
+		log.Printf("archive model %s to %s", model, archive)
+	} else if err := os.Rename(version.Path, path); err != nil {
+		return version, err
+	}
+	os.Remove(filepath.Join(path, pinFile))
+	version.Path = path
+	version.Pinned = false
+	resetModelCache(model)
+	log.Printf("rollback model %s to version %s", model, version.Version)
+	return version, nil
+}
+
+// VersionsHandler returns list of previous versions of the model
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	model := resolveModel(vars["name"])
+	versions, err := modelVersions(model)
+	if err != nil {
+		responseError(w, "unable to read model versions", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, versions)
+}
+
+// RollbackHandler restores previous version of the model. If model name is
+// an alias, the alias is switched back to its previous model, otherwise
+// the previous version of the model is restored from versions area.
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	if name == "" {
+		responseError(w, "no model name is provided", nil, http.StatusBadRequest)
+		return
+	}
+	if resolveModel(name) != name {
+		alias, err := _aliases.demote(name)
+		if err != nil {
+			responseError(w, "unable to rollback alias", err, http.StatusBadRequest)
+			return
+		}
+		log.Printf("rollback alias %s to model %s", alias.Name, alias.Model)
+		publish(EventRollback, alias.Model, fmt.Sprintf("alias %s points to model %s", alias.Name, alias.Model))
+		startSelfTest(alias.Model)
+		responseJSON(w, alias)
+		return
+	}
+	if !modelExists(name) {
+		msg := fmt.Sprintf("model %s does not exist", name)
+		responseError(w, msg, errors.New(msg), http.StatusNotFound)
+		return
+	}
+	version, err := rollbackModel(name)
+	if err != nil {
+		responseError(w, "unable to rollback model", err, http.StatusBadRequest)
+		return
+	}
+	publish(EventRollback, name, fmt.Sprintf("model is restored from version %s", version.Version))
+	startSelfTest(name)
+	responseJSON(w, version)
+}
+
+// helper function to pin or unpin given model version
+func pinVersion(model, version string, pin bool) error {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+	path := filepath.Join(versionsDir(model), filepath.Base(version))
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return fmt.Errorf("model %s does not have version %s", model, version)
+	}
+	fname := filepath.Join(path, pinFile)
+	if pin {
+		return ioutil.WriteFile(fname, []byte(time.Now().String()), 0644)
+	}
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PinHandler pins (POST) or unpins (DELETE) given model version
+func PinHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	model := resolveModel(vars["name"])
+	version := vars["version"]
+	pin := r.Method == "POST"
+	if err := pinVersion(model, version, pin); err != nil {
+		responseError(w, "unable to change model version pin", err, http.StatusBadRequest)
+		return
+	}
+	log.Printf("model %s version %s pinned=%v", model, version, pin)
+	w.WriteHeader(http.StatusOK)
+}
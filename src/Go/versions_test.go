@@ -0,0 +1,133 @@
+package main
+
+// tests of model versions, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// helper function to return model definition of the model in model area
+func modelDefinition(tb testing.TB, model string) string {
+	data, err := ioutil.ReadFile(filepath.Join(_config.ModelDir, model, "model.pb"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestRollbackModel checks that rollback swaps current model with its
+// newest version
+func TestRollbackModel(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	if _, err := rollbackModel("dnn"); err == nil {
+		t.Fatal("model without versions is rolled back")
+	}
+	if err := archiveModel("dnn"); err != nil {
+		t.Fatal(err)
+	}
+	writeModelFiles(t, "dnn", []byte("dnn v2"), TFParams{InputNode: "input", OutputNode: "output"})
+	versions, _ := modelVersions("dnn")
+	if len(versions) != 1 {
+		t.Fatalf("wrong versions %+v", versions)
+	}
+	if err := pinVersion("dnn", versions[0].Version, true); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := rollbackModel("dnn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := modelDefinition(t, "dnn"); def != "dnn" || version.Version != versions[0].Version || version.Pinned {
+		t.Fatalf("wrong restored model %s version %+v", def, version)
+	}
+	// current model is kept as new version
+	versions, _ = modelVersions("dnn")
+	if len(versions) != 1 || versions[0].Version == version.Version {
+		t.Fatalf("current model is not archived %+v", versions)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(versions[0].Path, "model.pb"))
+	if err != nil || string(data) != "dnn v2" {
+		t.Fatalf("wrong archived model %s: %v", data, err)
+	}
+
+	// second rollback restores the model again
+	if _, err := rollbackModel("dnn"); err != nil {
+		t.Fatal(err)
+	}
+	if def := modelDefinition(t, "dnn"); def != "dnn v2" {
+		t.Fatalf("wrong restored model %s", def)
+	}
+	if versions, _ = modelVersions("dnn"); len(versions) != 1 {
+		t.Fatalf("wrong versions %+v", versions)
+	}
+}
+
+// TestRollbackHandler checks rollback of models and aliases and pinning of
+// model versions via server routes
+func TestRollbackHandler(t *testing.T) {
+	setupFakeModels(t, 10, 0)
+	initLimiter("1000-S")
+	router := handlers()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	if w := serve("POST", "/models/unknown/rollback"); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code %d of rollback of unknown model", w.Code)
+	}
+	if w := serve("POST", "/models/dnn/rollback"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d of rollback of model without versions", w.Code)
+	}
+
+	archiveModel("dnn")
+	writeModelFiles(t, "dnn", []byte("dnn v2"), TFParams{InputNode: "input", OutputNode: "output"})
+	var versions []ModelVersion
+	w := serve("GET", "/models/dnn/versions")
+	json.Unmarshal(w.Body.Bytes(), &versions)
+	if w.Code != http.StatusOK || len(versions) != 1 || versions[0].Model != "dnn" || versions[0].Size == 0 {
+		t.Fatalf("wrong versions %d %s", w.Code, w.Body.String())
+	}
+	pinPath := "/admin/models/dnn/versions/" + versions[0].Version + "/pin"
+	if w := serve("POST", pinPath); w.Code != http.StatusOK {
+		t.Fatalf("unable to pin version: %d %s", w.Code, w.Body.String())
+	}
+	if versions, _ := modelVersions("dnn"); !versions[0].Pinned {
+		t.Fatal("version is not pinned")
+	}
+	if w := serve("DELETE", pinPath); w.Code != http.StatusOK {
+		t.Fatalf("unable to unpin version: %d %s", w.Code, w.Body.String())
+	}
+	if versions, _ := modelVersions("dnn"); versions[0].Pinned {
+		t.Fatal("version is not unpinned")
+	}
+	if w := serve("POST", "/admin/models/dnn/versions/unknown/pin"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d of pin of unknown version", w.Code)
+	}
+
+	var version ModelVersion
+	w = serve("POST", "/models/dnn/rollback")
+	json.Unmarshal(w.Body.Bytes(), &version)
+	if w.Code != http.StatusOK || version.Version != versions[0].Version || modelDefinition(t, "dnn") != "dnn" {
+		t.Fatalf("wrong rollback of model %d %s", w.Code, w.Body.String())
+	}
+
+	// rollback of alias points it to its previous model
+	_aliases.promote("dnn-prod", "dnn")
+	_aliases.promote("dnn-prod", "dnn2")
+	var alias Alias
+	w = serve("POST", "/models/dnn-prod/rollback")
+	json.Unmarshal(w.Body.Bytes(), &alias)
+	if w.Code != http.StatusOK || alias.Model != "dnn" || resolveModel("dnn-prod") != "dnn" {
+		t.Fatalf("wrong rollback of alias %d %s", w.Code, w.Body.String())
+	}
+	if w := serve("POST", "/models/dnn-prod/rollback"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code %d of rollback of alias without history", w.Code)
+	}
+}
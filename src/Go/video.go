@@ -0,0 +1,384 @@
+package main
+
+// video module provides frame extraction and batch scoring of videos
+//
+// POST /predict/video accepts short video upload (video form field) or its
+// URL (url form field) together with image model name, extracts frames at
+// given rate (fps form field, default 1 frame per second) and scores them
+// in batches, e.g.
+// scurl -F 'video=@/path/camera.mp4' -F 'model=ImageModel' -F 'fps=2' https://localhost:8083/predict/video
+// The response provides best labels (or outputs of models without labels)
+// of every frame together with summary of the video, i.e. labels with the
+// highest mean probability and the highest probability of labels over all
+// frames. Animated GIFs are decoded natively, while other video formats are
+// decoded by ffmpeg (ffmpeg option provides its path). Only URLs with
+// prefixes listed in videoURLPrefixes option are fetched, the number of
+// scored frames is limited by videoMaxFrames option (default 300).
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default limits of video scoring
+const (
+	defaultVideoMaxFrames = 300
+	defaultVideoMaxSize   = 256 << 20
+	videoBatchSize        = 32
+	videoDecodeTimeout    = 5 * time.Minute
+)
+
+// FrameResult represents scoring results of single video frame
+type FrameResult struct {
+	Frame         int           `json:"frame"`                   // frame number
+	Time          float64       `json:"time"`                    // frame time in seconds
+	Labels        []LabelResult `json:"labels,omitempty"`        // best labels of the frame
+	Probabilities []float32     `json:"probabilities,omitempty"` // outputs of models without labels
+}
+
+// VideoSummary represents aggregated scoring results of the video
+type VideoSummary struct {
+	Frames        int           `json:"frames"`                  // number of scored frames
+	Labels        []LabelResult `json:"labels,omitempty"`        // labels with the highest mean probability
+	Peaks         []LabelResult `json:"peaks,omitempty"`         // the highest probabilities of labels over frames
+	Probabilities []float32     `json:"probabilities,omitempty"` // mean outputs of models without labels
+}
+
+// VideoResult represents scoring results of the video
+type VideoResult struct {
+	Filename string        `json:"filename"`
+	FPS      float64       `json:"fps"`
+	Frames   []FrameResult `json:"frames"`
+	Summary  VideoSummary  `json:"summary"`
+}
+
+// helper function to return maximum number of scored frames
+func videoMaxFrames() int {
+	if _config.VideoMaxFrames > 0 {
+		return _config.VideoMaxFrames
+	}
+	return defaultVideoMaxFrames
+}
+
+// helper function to check if video URL is allowed
+func videoURLAllowed(rurl string) bool {
+	for _, prefix := range _config.VideoURLPrefixes {
+		if prefix != "" && strings.HasPrefix(rurl, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to write video of the request into temporary file, the
+// caller should remove the file
+func readVideo(r *http.Request) (string, string, error) {
+	var src io.Reader
+	var name string
+	if rurl := r.FormValue("url"); rurl != "" {
+		if !videoURLAllowed(rurl) {
+			return "", "", fmt.Errorf("video URL %s is not allowed", rurl)
+		}
+		client := _client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(rurl)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", "", fmt.Errorf("GET %s: %s", rurl, resp.Status)
+		}
+		src, name = resp.Body, filepath.Base(rurl)
+	} else {
+		file, header, err := r.FormFile("video")
+		if err != nil {
+			return "", "", err
+		}
+		defer file.Close()
+		src, name = file, header.Filename
+	}
+	tmp, err := ioutil.TempFile("", "video-*")
+	if err != nil {
+		return "", "", err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(src, defaultVideoMaxSize+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > defaultVideoMaxSize {
+		err = fmt.Errorf("video is larger than %d bytes", defaultVideoMaxSize)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), name, nil
+}
+
+// helper function to extract frames of GIF animation at given rate, it
+// returns PNG images of frames
+func gifFrames(data []byte, fps float64, maxFrames int) ([][]byte, error) {
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(anim.Image) == 0 {
+		return nil, fmt.Errorf("empty GIF animation")
+	}
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = anim.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	var frames [][]byte
+	var elapsed float64 // start time of current GIF frame
+	next := 0.0         // time of the next extracted frame
+	for i, img := range anim.Image {
+		// frames are drawn over previous ones
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		delay := 0.1
+		if i < len(anim.Delay) && anim.Delay[i] > 0 {
+			delay = float64(anim.Delay[i]) / 100
+		}
+		for next < elapsed+delay && len(frames) < maxFrames {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, canvas); err != nil {
+				return nil, err
+			}
+			frames = append(frames, buf.Bytes())
+			next = float64(len(frames)) / fps
+		}
+		elapsed += delay
+	}
+	return frames, nil
+}
+
+// helper function to extract frames of video file at given rate via
+// ffmpeg, it returns PNG images of frames
+func ffmpegFrames(fname string, fps float64, maxFrames int) ([][]byte, error) {
+	bin := _config.FFmpeg
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return nil, fmt.Errorf("video decoding requires ffmpeg: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "frames-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), videoDecodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "-hide_banner", "-loglevel", "error",
+		"-i", fname,
+		"-vf", fmt.Sprintf("fps=%s", strconv.FormatFloat(fps, 'f', -1, 64)),
+		"-frames:v", strconv.Itoa(maxFrames),
+		filepath.Join(dir, "frame-%06d.png"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("unable to extract video frames: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "frame-*.png"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var frames [][]byte
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, data)
+	}
+	return frames, nil
+}
+
+// extractFrames extracts frames of video file at given rate
+func extractFrames(fname string, fps float64) ([][]byte, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var frames [][]byte
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		frames, err = gifFrames(data, fps, videoMaxFrames())
+	} else {
+		frames, err = ffmpegFrames(fname, fps, videoMaxFrames())
+	}
+	if err == nil && len(frames) == 0 {
+		err = fmt.Errorf("video does not provide any frames")
+	}
+	return frames, err
+}
+
+// scoreFrames scores video frames with image model in batches
+func scoreFrames(model string, params TFParams, frames [][]byte, roi *ROI) ([][]float32, error) {
+	var probs [][]float32
+	for start := 0; start < len(frames); start += videoBatchSize {
+		end := start + videoBatchSize
+		if end > len(frames) {
+			end = len(frames)
+		}
+		var values []float32
+		var shape []int64
+		for i, frame := range frames[start:end] {
+			tensor, err := makeTensorFromImage(bytes.NewBuffer(frame), "png", params.ImgChannels, roi)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", start+i, err)
+			}
+			v, s, err := flattenTensor(tensor)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", start+i, err)
+			}
+			if shape != nil && fmt.Sprint(s) != fmt.Sprint(shape) {
+				return nil, fmt.Errorf("frame %d has shape %v while previous frames have %v", start+i, s, shape)
+			}
+			shape = s
+			values = append(values, v...)
+		}
+		// stack [1, H, W, C] frames into [n, H, W, C] batch
+		bshape := append([]int64{int64(end - start)}, shape[1:]...)
+		batch, err := makeFlatTensor(values, bshape)
+		if err != nil {
+			return nil, err
+		}
+		out, err := makeBatchPredictions(model, nil, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != end-start {
+			return nil, fmt.Errorf("model %s produced %d outputs of %d frames", model, len(out), end-start)
+		}
+		probs = append(probs, out...)
+	}
+	return probs, nil
+}
+
+// summarizeVideo aggregates scoring results of video frames
+func summarizeVideo(probs [][]float32, labels []string, topN int) VideoSummary {
+	summary := VideoSummary{Frames: len(probs)}
+	if len(probs) == 0 {
+		return summary
+	}
+	n := len(probs[0])
+	mean := make([]float32, n)
+	peak := make([]float32, n)
+	for i := range peak {
+		peak[i] = float32(math.Inf(-1))
+	}
+	for _, p := range probs {
+		for i := 0; i < n && i < len(p); i++ {
+			mean[i] += p[i] / float32(len(probs))
+			if p[i] > peak[i] {
+				peak[i] = p[i]
+			}
+		}
+	}
+	if len(labels) == 0 {
+		summary.Probabilities = mean
+		return summary
+	}
+	summary.Labels = bestLabels(labels, mean, topN)
+	summary.Peaks = bestLabels(labels, peak, topN)
+	return summary
+}
+
+// helper function to return topN best labels of given probabilities
+func bestLabels(labels []string, probs []float32, topN int) []LabelResult {
+	if n := len(labels); n < topN {
+		topN = n
+	}
+	if n := len(probs); n < topN {
+		topN = n
+	}
+	return findBestLabels(labels, probs, topN)
+}
+
+// VideoHandler provides predictions of image model for frames of the video
+func VideoHandler(w http.ResponseWriter, r *http.Request) {
+	model := resolveModel(r.FormValue("model"))
+	if model == "" {
+		responseError(w, "video predictions require image model", nil, http.StatusBadRequest)
+		return
+	}
+	params, err := getModelParams(model)
+	if err != nil {
+		responseError(w, "unable to read model params", err, http.StatusBadRequest)
+		return
+	}
+	if params.ImgChannels == 0 {
+		msg := fmt.Sprintf("model %s does not support image predictions", model)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	fps := 1.0
+	if v := r.FormValue("fps"); v != "" {
+		fps, err = strconv.ParseFloat(v, 64)
+		if err != nil || fps <= 0 || fps > 60 {
+			responseError(w, fmt.Sprintf("invalid fps %s", v), err, http.StatusBadRequest)
+			return
+		}
+	}
+	topN := 5
+	if v := r.FormValue("top_n"); v != "" {
+		if topN, err = strconv.Atoi(v); err != nil || topN <= 0 {
+			responseError(w, fmt.Sprintf("invalid top_n %s", v), err, http.StatusBadRequest)
+			return
+		}
+	}
+	roi, err := requestROI(r, params)
+	if err != nil {
+		responseError(w, "invalid crop", err, http.StatusBadRequest)
+		return
+	}
+	fname, name, err := readVideo(r)
+	if err != nil {
+		responseError(w, "unable to read video", err, http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(fname)
+	frames, err := extractFrames(fname, fps)
+	if err != nil {
+		responseError(w, "unable to extract video frames", err, http.StatusBadRequest)
+		return
+	}
+	observeUsage(usageClient(r), model, len(frames))
+	probs, err := scoreFrames(model, params, frames, roi)
+	if err != nil {
+		publish(EventPredictionFailed, model, err.Error())
+		responseError(w, "unable to score video frames", err, http.StatusInternalServerError)
+		return
+	}
+	labels := decisionLabels(model, params)
+	res := VideoResult{Filename: name, FPS: fps, Summary: summarizeVideo(probs, labels, topN)}
+	for i, p := range probs {
+		frame := FrameResult{Frame: i, Time: float64(i) / fps}
+		if len(labels) > 0 {
+			frame.Labels = bestLabels(labels, p, topN)
+		} else {
+			frame.Probabilities = p
+		}
+		res.Frames = append(res.Frames, frame)
+	}
+	responseJSON(w, res)
+}
@@ -0,0 +1,125 @@
+package main
+
+// tests of video scoring, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// helper function to create GIF animation of 3 frames of 0.5 seconds
+func testGIF(t *testing.T) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9)
+		for x := 0; x < 8; x++ {
+			for y := 0; y < 8; y++ {
+				img.Set(x, y, color.RGBA{uint8(i * 100), 0, 0, 255})
+			}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 50)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// helper function to create video request with given form fields
+func videoRequest(t *testing.T, video []byte, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	if video != nil {
+		part, err := writer.CreateFormFile("video", "test.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(video)
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", "/predict/video", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// TestGIFFrames checks extraction of GIF frames at given rate
+func TestGIFFrames(t *testing.T) {
+	data := testGIF(t)
+	for _, tt := range []struct {
+		fps    float64
+		frames int
+	}{{1, 2}, {2, 3}, {4, 6}, {0.5, 1}} {
+		frames, err := gifFrames(data, tt.fps, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != tt.frames {
+			t.Errorf("wrong number of frames %d at %v fps, expected %d", len(frames), tt.fps, tt.frames)
+		}
+	}
+	if frames, _ := gifFrames(data, 4, 2); len(frames) != 2 {
+		t.Errorf("number of frames is not limited %d", len(frames))
+	}
+}
+
+// TestFakeVideo checks scoring of video frames
+func TestFakeVideo(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	req := videoRequest(t, testGIF(t), map[string]string{"model": "img", "fps": "2", "top_n": "2"})
+	rr := httptest.NewRecorder()
+	VideoHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+	var res VideoResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Frames) != 3 || res.Summary.Frames != 3 || res.Frames[1].Time != 0.5 {
+		t.Fatalf("wrong video result %+v", res)
+	}
+	for _, f := range res.Frames {
+		if len(f.Labels) != 2 || f.Labels[0].Label != "c" {
+			t.Errorf("wrong labels of frame %+v", f)
+		}
+	}
+	if len(res.Summary.Labels) != 2 || res.Summary.Labels[0].Label != "c" || res.Summary.Peaks[0].Probability != testOutputs[2] {
+		t.Errorf("wrong summary %+v", res.Summary)
+	}
+	// frames are scored in single batch
+	if shape := fake.Feeds()["input"].Shape(); len(shape) != 4 || shape[0] != 3 {
+		t.Errorf("frames are not batched, input shape %v", shape)
+	}
+
+	// video URLs should be allowed by configuration
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testGIF(t))
+	}))
+	defer ts.Close()
+	req = videoRequest(t, nil, map[string]string{"model": "img", "url": ts.URL + "/video.gif"})
+	rr = httptest.NewRecorder()
+	VideoHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("video URL should not be allowed, status %d", rr.Code)
+	}
+	_config.VideoURLPrefixes = []string{ts.URL + "/"}
+	req = videoRequest(t, nil, map[string]string{"model": "img", "url": ts.URL + "/video.gif"})
+	rr = httptest.NewRecorder()
+	VideoHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+// watchdog module provides memory watchdog of the server
+//
+// When "memoryLimit" (in MB) is configured the watchdog periodically checks
+// resident memory (RSS) of the process. Once it crosses the limit the server
+// evicts models which were not used for "memoryIdle" seconds (least recently
+// used first), releases memory to the OS and, optionally, rejects batch
+// requests larger than "memoryBatchLimit" (in KB) with 503 status until the
+// memory usage falls below the limit. It gives the server a chance to
+// recover before the kernel OOM-killer takes the whole service down.
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default interval in seconds of memory checks
+const defaultMemoryCheckInterval = 10
+
+// default time in seconds after which unused models can be evicted
+const defaultMemoryIdle = 60
+
+// global flag of memory pressure
+var _memoryPressure int32
+
+// model usage times
+var (
+	modelUsage     = make(map[string]time.Time)
+	modelUsageLock sync.Mutex
+)
+
+// helper function to record usage of given model
+func touchModel(name string) {
+	modelUsageLock.Lock()
+	defer modelUsageLock.Unlock()
+	modelUsage[name] = time.Now()
+}
+
+// helper function to check if server is under memory pressure
+func underMemoryPressure() bool {
+	return atomic.LoadInt32(&_memoryPressure) == 1
+}
+
+// helper function to read resident memory of the process in bytes
+func processRSS() (uint64, error) {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		// non-Linux systems, use memory obtained by Go runtime
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.Sys, nil
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, errors.New("unable to parse /proc/self/statm")
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
+
+// helper function to list loaded models which were not used for given
+// time, least recently used models come first
+func idleModels(idle time.Duration) []string {
+	loaded := make(map[string]bool)
+	_cache.mutex.Lock()
+	for name := range _cache.Models {
+		loaded[name] = true
+	}
+	_cache.mutex.Unlock()
+	tfCacheLock.Lock()
+	for name := range tfCache {
+		loaded[name] = true
+	}
+	tfCacheLock.Unlock()
+
+	modelUsageLock.Lock()
+	defer modelUsageLock.Unlock()
+	var models []string
+	for name := range loaded {
+		if time.Since(modelUsage[name]) >= idle {
+			models = append(models, name)
+		}
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return modelUsage[models[i]].Before(modelUsage[models[j]])
+	})
+	return models
+}
+
+// helper function to evict given model from model caches
+func evictModel(name string) {
+	_cache.remove(name)
+	removeSessionPool(name)
+	tfCacheLock.Lock()
+	if model, ok := tfCache[name]; ok {
+		model.Close()
+		delete(tfCache, name)
+	}
+	tfCacheLock.Unlock()
+	publish(EventEviction, name, "model is evicted due to memory pressure")
+}
+
+// helper function to check memory usage and evict idle models if it
+// exceeds given limit in bytes, it returns list of evicted models
+func checkMemory(limit uint64, idle time.Duration) ([]string, error) {
+	rss, err := processRSS()
+	if err != nil {
+		return nil, err
+	}
+	if rss < limit {
+		if atomic.SwapInt32(&_memoryPressure, 0) == 1 {
+			log.Printf("memory usage %dMB is below limit %dMB", rss>>20, limit>>20)
+		}
+		return nil, nil
+	}
+	atomic.StoreInt32(&_memoryPressure, 1)
+	models := idleModels(idle)
+	log.Printf("WARNING: memory usage %dMB exceeds limit %dMB, evict idle models %v", rss>>20, limit>>20, models)
+	for _, name := range models {
+		evictModel(name)
+	}
+	publish(EventMemoryPressure, "", fmt.Sprintf("memory usage %dMB exceeds limit %dMB, evicted models %v", rss>>20, limit>>20, models))
+	runtime.GC()
+	debug.FreeOSMemory()
+	return models, nil
+}
+
+// memoryWatchdog periodically checks memory usage of the server
+func memoryWatchdog() {
+	if _config.MemoryLimit <= 0 {
+		return
+	}
+	interval := _config.MemoryCheckInterval
+	if interval <= 0 {
+		interval = defaultMemoryCheckInterval
+	}
+	idle := _config.MemoryIdle
+	if idle <= 0 {
+		idle = defaultMemoryIdle
+	}
+	limit := uint64(_config.MemoryLimit) << 20
+	log.Printf("memory watchdog limit %dMB interval %ds idle %ds", _config.MemoryLimit, interval, idle)
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		if _, err := checkMemory(limit, time.Duration(idle)*time.Second); err != nil {
+			log.Println("unable to check memory usage", err)
+		}
+	}
+}
+
+// helper function to reject large batch requests under memory pressure
+func rejectLargeBatch(w http.ResponseWriter, r *http.Request) bool {
+	limit := int64(_config.MemoryBatchLimit) << 10
+	if limit <= 0 || !underMemoryPressure() {
+		return false
+	}
+	// requests of unknown size are considered large
+	if r.ContentLength >= 0 && r.ContentLength <= limit {
+		return false
+	}
+	retry := _config.MemoryCheckInterval
+	if retry <= 0 {
+		retry = defaultMemoryCheckInterval
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	msg := "server is under memory pressure, batch request is too large"
+	responseError(w, msg, errors.New(msg), http.StatusServiceUnavailable)
+	return true
+}
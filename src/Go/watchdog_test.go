@@ -0,0 +1,77 @@
+package main
+
+// tests of memory watchdog, they do not require TF C library
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFakeMemoryWatchdog checks eviction of idle models under memory pressure
+func TestFakeMemoryWatchdog(t *testing.T) {
+	fake := setupFakeModels(t, 10, 0)
+	t.Cleanup(func() { _memoryPressure = 0 })
+	if rss, err := processRSS(); err != nil || rss == 0 {
+		t.Fatalf("unable to read RSS %d: %v", rss, err)
+	}
+	for _, model := range []string{"dnn", "dnn2"} {
+		if _, err := makePredictions(testRow(model)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// recently used models are not evicted
+	evicted, err := checkMemory(1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 0 || !underMemoryPressure() {
+		t.Errorf("unexpected evicted models %v pressure %v", evicted, underMemoryPressure())
+	}
+	evicted, err = checkMemory(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 2 || evicted[0] != "dnn" || evicted[1] != "dnn2" {
+		t.Errorf("unexpected evicted models %v", evicted)
+	}
+	if len(_cache.Models) != 0 {
+		t.Errorf("models are not evicted from cache %v", _cache.Models)
+	}
+	// evicted models are loaded again on demand
+	if _, err := makePredictions(testRow("dnn")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Imports != 3 {
+		t.Errorf("wrong number of imports %d", fake.Imports)
+	}
+
+	// large batches are rejected under memory pressure
+	_config.MemoryBatchLimit = 1
+	initLimiter("1000-S")
+	router := handlers()
+	body := `{"model":"dnn","shape":[1,2],"values":[1,2],"keys":["a","b"]` + strings.Repeat(" ", 2048) + "}"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewBufferString(body)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("wrong status code %d of large batch under memory pressure", w.Code)
+	}
+	body = `{"model":"dnn","shape":[1,2],"values":[1,2],"keys":["a","b"]}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewBufferString(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong status code %d of small batch: %s", w.Code, w.Body.String())
+	}
+
+	// pressure is released once memory usage falls below the limit
+	if _, err := checkMemory(1<<62, 0); err != nil {
+		t.Fatal(err)
+	}
+	if underMemoryPressure() {
+		t.Error("memory pressure should be released")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// webhooks module provides notifications about server events
+//
+// Operators may configure list of webhooks, e.g.
+// "webhooks": [{"url": "https://mattermost/hooks/xxx", "events": ["upload", "loadFailure"], "format": "mattermost"}]
+// and the server will send JSON event to every webhook interested in given
+// event (all events if list of events is empty). The mattermost (or slack)
+// format sends event as {"text": "..."} message.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook represents webhook configuration
+type Webhook struct {
+	URL    string   `json:"url"`    // webhook URL
+	Events []string `json:"events"` // list of events to send, empty list means all events
+	Format string   `json:"format"` // format of the message: json (default), mattermost or slack
+}
+
+// webhook HTTP client
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Publish implements EventSink interface and sends given event to the webhook
+func (h *Webhook) Publish(evt Event) error {
+	var data []byte
+	var err error
+	if h.Format == "mattermost" || h.Format == "slack" {
+		text := fmt.Sprintf("TFaaS %s: %s event for model %s: %s", evt.Host, evt.Event, evt.Model, evt.Message)
+		data, err = json.Marshal(map[string]string{"text": text})
+	} else {
+		data, err = json.Marshal(evt)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(h.URL, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with status %s", h.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+// tests of webhook notifications, they do not require TF C library
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebhook checks messages sent to webhooks
+func TestWebhook(t *testing.T) {
+	messages := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		messages <- data
+	}))
+	defer server.Close()
+	evt := Event{Event: EventUpload, Model: "dnn", Message: "new model version is installed", Host: "tfaas", Timestamp: 1700000000}
+
+	hook := Webhook{URL: server.URL + "/hook"}
+	if err := hook.Publish(evt); err != nil {
+		t.Fatal(err)
+	}
+	var rec Event
+	if err := json.Unmarshal(<-messages, &rec); err != nil || rec != evt {
+		t.Fatalf("wrong event %+v of webhook: %v", rec, err)
+	}
+
+	hook.Format = "mattermost"
+	if err := hook.Publish(evt); err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]string
+	json.Unmarshal(<-messages, &msg)
+	if msg["text"] != "TFaaS tfaas: upload event for model dnn: new model version is installed" {
+		t.Fatalf("wrong mattermost message %v", msg)
+	}
+
+	hook.URL = server.URL + "/fail"
+	if err := hook.Publish(evt); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("failed delivery is not reported: %v", err)
+	}
+
+	// webhooks receive only events they are subscribed to
+	var bus EventBus
+	hook = Webhook{URL: server.URL + "/hook", Events: []string{EventRollback}}
+	bus.subscribe(&hook, hook.Events)
+	bus.start()
+	bus.publish(evt)
+	evt.Event = EventRollback
+	bus.publish(evt)
+	select {
+	case data := <-messages:
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Event != EventRollback {
+			t.Fatalf("wrong event %s of webhook: %v", data, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not delivered to webhook")
+	}
+	select {
+	case data := <-messages:
+		t.Fatalf("unexpected message %s of webhook", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+// xgboost module provides predictions for XGBoost (BDT) models
+//
+// XGBoost models should be saved in JSON format, e.g. in python
+// bst.save_model("model.json")
+// and uploaded together with params.json which declares the backend, e.g.
+// {"name": "bdt", "model": "model.json", "backend": "xgboost"}
+// The model is evaluated in pure Go and it is served via the same Row API
+// as TF models. If model provides feature names the row keys are used to
+// map row values to model features, otherwise values are used in order.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// XGBoost backend name used in model parameters
+const xgboostBackend = "xgboost"
+
+// jsonBools represents list of booleans which can be encoded either as
+// JSON booleans or numbers
+type jsonBools []bool
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (b *jsonBools) UnmarshalJSON(data []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	out := make([]bool, len(values))
+	for i, v := range values {
+		switch val := v.(type) {
+		case bool:
+			out[i] = val
+		case float64:
+			out[i] = val != 0
+		default:
+			return fmt.Errorf("invalid boolean value %v", v)
+		}
+	}
+	*b = out
+	return nil
+}
+
+// XGBTree represents single tree of XGBoost model
+type XGBTree struct {
+	LeftChildren    []int     `json:"left_children"`
+	RightChildren   []int     `json:"right_children"`
+	SplitIndices    []int     `json:"split_indices"`
+	SplitConditions []float64 `json:"split_conditions"`
+	DefaultLeft     jsonBools `json:"default_left"`
+}
+
+// XGBModel represents XGBoost model saved in JSON format
+type XGBModel struct {
+	Learner struct {
+		FeatureNames    []string `json:"feature_names"`
+		GradientBooster struct {
+			Name  string `json:"name"`
+			Model struct {
+				Trees    []XGBTree `json:"trees"`
+				TreeInfo []int     `json:"tree_info"`
+			} `json:"model"`
+		} `json:"gradient_booster"`
+		LearnerModelParam struct {
+			BaseScore  string `json:"base_score"`
+			NumClass   string `json:"num_class"`
+			NumFeature string `json:"num_feature"`
+		} `json:"learner_model_param"`
+		Objective struct {
+			Name string `json:"name"`
+		} `json:"objective"`
+	} `json:"learner"`
+
+	baseMargin float64        // initial margin of predictions
+	numClass   int            // number of classes, 1 for binary and regression models
+	features   map[string]int // feature indexes
+}
+
+// global cache of XGBoost models
+var (
+	xgbCache     = make(map[string]*XGBModel)
+	xgbCacheLock sync.Mutex
+)
+
+// helper function to load XGBoost model from given file
+func loadXGBModel(fname, key string) (*XGBModel, error) {
+	data, err := readModelFile(fname, key)
+	if err != nil {
+		return nil, err
+	}
+	var model XGBModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("unable to parse XGBoost model %s: %v", fname, err)
+	}
+	learner := &model.Learner
+	if learner.GradientBooster.Name != "gbtree" {
+		return nil, fmt.Errorf("unsupported XGBoost booster '%s'", learner.GradientBooster.Name)
+	}
+	trees := learner.GradientBooster.Model.Trees
+	if len(trees) == 0 {
+		return nil, errors.New("XGBoost model does not have trees")
+	}
+	for idx := range trees {
+		if err := trees[idx].check(); err != nil {
+			return nil, fmt.Errorf("XGBoost tree %d is malformed: %v", idx, err)
+		}
+	}
+	model.numClass = 1
+	if v := learner.LearnerModelParam.NumClass; v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 1 {
+			model.numClass = n
+		}
+	}
+	if len(learner.GradientBooster.Model.TreeInfo) != len(trees) {
+		return nil, errors.New("XGBoost model tree info does not match number of trees")
+	}
+	for _, class := range learner.GradientBooster.Model.TreeInfo {
+		if class < 0 {
+			return nil, fmt.Errorf("invalid XGBoost tree class %d", class)
+		}
+	}
+	baseScore := 0.5
+	if v := learner.LearnerModelParam.BaseScore; v != "" {
+		if baseScore, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("invalid XGBoost base score %s", v)
+		}
+	}
+	model.baseMargin = baseScore
+	if strings.HasPrefix(learner.Objective.Name, "binary:logistic") || learner.Objective.Name == "reg:logistic" {
+		// base score of logistic objectives is a probability
+		model.baseMargin = math.Log(baseScore / (1 - baseScore))
+	}
+	if len(learner.FeatureNames) > 0 {
+		model.features = make(map[string]int)
+		for i, name := range learner.FeatureNames {
+			model.features[name] = i
+		}
+	}
+	return &model, nil
+}
+
+// helper function to check that nodes of the tree form a tree rooted at
+// node 0, i.e. children of split nodes are valid node indices and every
+// node is reached only once, such that evaluation of the tree terminates
+func (t *XGBTree) check() error {
+	n := len(t.LeftChildren)
+	if n == 0 {
+		return errors.New("tree does not have nodes")
+	}
+	if len(t.RightChildren) != n || len(t.SplitIndices) != n || len(t.SplitConditions) != n || len(t.DefaultLeft) != n {
+		return errors.New("node arrays have different sizes")
+	}
+	visited := make([]bool, n)
+	visited[0] = true
+	nodes := []int{0}
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		if t.LeftChildren[node] == -1 {
+			continue
+		}
+		if t.SplitIndices[node] < 0 {
+			return fmt.Errorf("node %d has invalid split index %d", node, t.SplitIndices[node])
+		}
+		for _, child := range []int{t.LeftChildren[node], t.RightChildren[node]} {
+			if child < 0 || child >= n {
+				return fmt.Errorf("node %d has invalid child %d", node, child)
+			}
+			if visited[child] {
+				return fmt.Errorf("node %d is reached more than once", child)
+			}
+			visited[child] = true
+			nodes = append(nodes, child)
+		}
+	}
+	return nil
+}
+
+// helper function to evaluate tree for given features
+func (t *XGBTree) eval(features []float64) float64 {
+	node := 0
+	for t.LeftChildren[node] != -1 {
+		idx := t.SplitIndices[node]
+		var value float64
+		if idx < len(features) {
+			value = features[idx]
+		} else {
+			value = math.NaN()
+		}
+		switch {
+		case math.IsNaN(value):
+			if t.DefaultLeft[node] {
+				node = t.LeftChildren[node]
+			} else {
+				node = t.RightChildren[node]
+			}
+		case value < t.SplitConditions[node]:
+			node = t.LeftChildren[node]
+		default:
+			node = t.RightChildren[node]
+		}
+	}
+	// leaf nodes keep leaf value in split conditions
+	return t.SplitConditions[node]
+}
+
+// helper function to map row values to model features
+func (m *XGBModel) featureVector(keys []string, values []float32) ([]float64, error) {
+	if m.features == nil || len(keys) == 0 {
+		out := make([]float64, len(values))
+		for i, v := range values {
+			out[i] = float64(v)
+		}
+		return out, nil
+	}
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("number of keys %d does not match number of values %d", len(keys), len(values))
+	}
+	out := make([]float64, len(m.features))
+	for i := range out {
+		out[i] = math.NaN()
+	}
+	for i, key := range keys {
+		idx, ok := m.features[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown feature %s", key)
+		}
+		out[idx] = float64(values[i])
+	}
+	return out, nil
+}
+
+// predict returns model predictions for given features
+func (m *XGBModel) predict(features []float64) []float32 {
+	margins := make([]float64, m.numClass)
+	for i := range margins {
+		margins[i] = m.baseMargin
+	}
+	booster := &m.Learner.GradientBooster.Model
+	for i := range booster.Trees {
+		margins[booster.TreeInfo[i]%m.numClass] += booster.Trees[i].eval(features)
+	}
+	out := make([]float32, m.numClass)
+	objective := m.Learner.Objective.Name
+	switch {
+	case strings.HasPrefix(objective, "multi:"):
+		// softmax of class margins
+		maxMargin := margins[0]
+		for _, v := range margins {
+			maxMargin = math.Max(maxMargin, v)
+		}
+		var sum float64
+		for i, v := range margins {
+			margins[i] = math.Exp(v - maxMargin)
+			sum += margins[i]
+		}
+		for i, v := range margins {
+			out[i] = float32(v / sum)
+		}
+	case objective == "binary:logistic" || objective == "reg:logistic":
+		out[0] = float32(1 / (1 + math.Exp(-margins[0])))
+	default:
+		// raw margins for regression and logitraw objectives
+		for i, v := range margins {
+			out[i] = float32(v)
+		}
+	}
+	return out
+}
+
+// helper function to check if given model is XGBoost model
+func isXGBModel(name string) bool {
+	params, err := getModelParams(name)
+	if err != nil {
+		return false
+	}
+	return params.Backend == xgboostBackend
+}
+
+// helper function to get XGBoost model from the cache
+func getXGBModel(name string) (*XGBModel, error) {
+	xgbCacheLock.Lock()
+	defer xgbCacheLock.Unlock()
+	if model, ok := xgbCache[name]; ok {
+		return model, nil
+	}
+	params, err := getModelParams(name)
+	if err != nil {
+		return nil, err
+	}
+	fname := fmt.Sprintf("%s/%s/%s", _config.ModelDir, name, params.Model)
+	err = injectLoadFault(name)
+	var model *XGBModel
+	if err == nil {
+		model, err = loadXGBModel(fname, params.EncryptionKey)
+	}
+	if err != nil {
+		publish(EventLoadFailure, name, err.Error())
+		return nil, err
+	}
+	xgbCache[name] = model
+	publish(EventReload, name, "model is loaded into cache")
+	return model, nil
+}
+
+// helper function to remove XGBoost model from the cache
+func removeXGBModel(name string) {
+	xgbCacheLock.Lock()
+	defer xgbCacheLock.Unlock()
+	delete(xgbCache, name)
+}
+
+// helper function to generate predictions of XGBoost model for given row
+func makePredictionsXGB(name string, row *Row) ([]float32, error) {
+	model, err := getXGBModel(name)
+	if err != nil {
+		return nil, err
+	}
+	features, err := model.featureVector(row.Keys, row.Values)
+	if err != nil {
+		return nil, err
+	}
+	return model.predict(features), nil
+}
+
+// helper function to generate predictions of XGBoost model for batch of rows
+func makeBatchPredictionsXGB(name string, keys []string, rows [][]float32) ([][]float32, error) {
+	model, err := getXGBModel(name)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]float32
+	for _, row := range rows {
+		features, err := model.featureVector(keys, row)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, model.predict(features))
+	}
+	return out, nil
+}
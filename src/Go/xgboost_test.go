@@ -0,0 +1,142 @@
+package main
+
+// tests of XGBoost backend, they do not require TF C library
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// test XGBoost model with single tree: x0 < 0.5 ? -1 : (x1 < 0.5 ? 0 : 1)
+const testXGBModel = `{
+  "learner": {
+    "feature_names": ["x0", "x1"],
+    "gradient_booster": {
+      "name": "gbtree",
+      "model": {
+        "trees": [{
+          "left_children": [1, -1, 3, -1, -1],
+          "right_children": [2, -1, 4, -1, -1],
+          "split_indices": [0, 0, 1, 0, 0],
+          "split_conditions": [0.5, -1, 0.5, 0, 1],
+          "default_left": [1, 0, 0, 0, 0]
+        }],
+        "tree_info": [0]
+      }
+    },
+    "learner_model_param": {"base_score": "5E-1", "num_class": "0", "num_feature": "2"},
+    "objective": {"name": "binary:logistic"}
+  }
+}`
+
+// helper function to write XGBoost model into model area
+func writeXGBModel(tb testing.TB, name string) {
+	path := filepath.Join(_config.ModelDir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "model.json"), []byte(testXGBModel), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	params := TFParams{Name: name, Model: "model.json", Backend: xgboostBackend}
+	data, _ := json.Marshal(params)
+	if err := ioutil.WriteFile(filepath.Join(path, "params.json"), data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { removeXGBModel(name) })
+}
+
+// helper function to compare probabilities
+func checkXGBProb(tb testing.TB, prob float32, margin float64) {
+	expect := 1 / (1 + math.Exp(-margin))
+	if math.Abs(float64(prob)-expect) > 1e-6 {
+		tb.Fatalf("wrong probability %v, expected %v", prob, expect)
+	}
+}
+
+// TestXGBoostPredictions checks predictions of XGBoost model
+func TestXGBoostPredictions(t *testing.T) {
+	setupTestArea(t, 10, 0)
+	writeXGBModel(t, "bdt")
+	path := filepath.Join(_config.ModelDir, "bdt")
+	if err := validateModel(path, "bdt"); err != nil {
+		t.Fatalf("valid model is rejected: %v", err)
+	}
+
+	// keys are mapped to model features
+	row := &Row{Model: "bdt", Keys: []string{"x1", "x0"}, Values: []float32{1, 1}}
+	probs, err := makePredictions(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkXGBProb(t, probs[0], 1)
+
+	// missing features follow default branch
+	row = &Row{Model: "bdt", Keys: []string{"x1"}, Values: []float32{1}}
+	if probs, err = makePredictions(row); err != nil {
+		t.Fatal(err)
+	}
+	checkXGBProb(t, probs[0], -1)
+
+	// unknown features are rejected
+	row = &Row{Model: "bdt", Keys: []string{"x2"}, Values: []float32{1}}
+	if _, err := makePredictions(row); err == nil {
+		t.Error("unknown feature should be rejected")
+	}
+
+	// batch predictions
+	batch := BatchRow{Model: "bdt", Keys: []string{"x0", "x1"}, Values: []float32{0, 0, 1, 0, 1, 1}, Shape: []int64{3, 2}}
+	data, _ := json.Marshal(batch)
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest("POST", "/predict/batch", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d: %s", w.Code, w.Body.String())
+	}
+	var rows [][]float32
+	if err := json.NewDecoder(w.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("wrong number of predictions %v", rows)
+	}
+	for i, margin := range []float64{-1, 0, 1} {
+		checkXGBProb(t, rows[i][0], margin)
+	}
+}
+
+// TestXGBoostMalformedTrees checks that trees with invalid children or
+// cycles are rejected on load
+func TestXGBoostMalformedTrees(t *testing.T) {
+	dir := t.TempDir()
+	for name, tree := range map[string]string{
+		"cycle":  `"left_children": [1, 0, -1], "right_children": [2, -1, -1]`,
+		"shared": `"left_children": [1, 2, -1], "right_children": [2, 2, -1]`,
+		"range":  `"left_children": [1, -1, -1], "right_children": [5, -1, -1]`,
+		"parent": `"left_children": [1, -1, -1], "right_children": [-1, -1, -1]`,
+	} {
+		model := strings.Replace(testXGBModel, `"left_children": [1, -1, 3, -1, -1],
+          "right_children": [2, -1, 4, -1, -1]`, tree, 1)
+		model = strings.Replace(model, `[0, 0, 1, 0, 0]`, `[0, 0, 0]`, 1)
+		model = strings.Replace(model, `[0.5, -1, 0.5, 0, 1]`, `[0.5, -1, 1]`, 1)
+		model = strings.Replace(model, `[1, 0, 0, 0, 0]`, `[1, 0, 0]`, 1)
+		fname := filepath.Join(dir, name+".json")
+		ioutil.WriteFile(fname, []byte(model), 0644)
+		if _, err := loadXGBModel(fname, ""); err == nil {
+			t.Errorf("tree with %s nodes is loaded", name)
+		}
+	}
+	model := strings.Replace(testXGBModel, `"tree_info": [0]`, `"tree_info": [-1]`, 1)
+	fname := filepath.Join(dir, "class.json")
+	ioutil.WriteFile(fname, []byte(model), 0644)
+	if _, err := loadXGBModel(fname, ""); err == nil {
+		t.Error("tree with negative class is loaded")
+	}
+}
@@ -13,6 +13,7 @@ import sys
 import pwd
 import ssl
 import json
+import struct
 import binascii
 import argparse
 import itertools
@@ -46,6 +47,8 @@ class OptionParser():
             dest="bundle", default="", help="upload bundle ML files to TFaaS")
         self.parser.add_argument("--predict", action="store",
             dest="predict", default="", help="fetch prediction from TFaaS")
+        self.parser.add_argument("--batch", action="store",
+            dest="batch", default="", help="fetch predictions for batch in binary format")
         self.parser.add_argument("--image", action="store",
             dest="image", default="", help="fetch prediction for given image")
         self.parser.add_argument("--model", action="store",
@@ -275,6 +278,35 @@ def predict(host, ifile, model, verbose=None, ckey=None, cert=None, capath=None)
     encoded_data = json.dumps(params)
     return getdata(url, headers, encoded_data, ckey, cert, capath, verbose)
 
+def encode_batch(shape, values):
+    """
+    Encode batch of given shape and flat values (in row-major order) into
+    TFaaS binary batch format: TFB1 magic, uint32 rank, rank int64 dims and
+    float32 values, all numbers are little endian
+    """
+    size = 1
+    for dim in shape:
+        size *= dim
+    if size != len(values):
+        raise Exception("number of values %d does not match shape %s" % (len(values), shape))
+    header = b'TFB1' + struct.pack('<I', len(shape)) + struct.pack('<%dq' % len(shape), *shape)
+    return header + struct.pack('<%df' % len(values), *values)
+
+def predictBatch(host, ifile, model, verbose=None, ckey=None, cert=None, capath=None):
+    "predict API get predictions for batch sent in binary format from TFaaS server"
+    params = json.load(open(ifile))
+    model = model or params.get('model', '')
+    url = host + '/predict/batch?model=%s' % model
+    client = '%s (%s)' % (TFAAS_CLIENT, os.environ.get('USER', ''))
+    headers = {"Accept": "application/json", "User-Agent": client,
+               "Content-Type": "application/x-tfaas-batch"}
+    if verbose:
+        print("URL   : %s" % url)
+        print("ifile : %s" % ifile)
+        print("shape : %s" % params['shape'])
+    encoded_data = encode_batch(params['shape'], params['values'])
+    return getdata(url, headers, encoded_data, ckey, cert, capath, verbose)
+
 def predictImage(host, ifile, model, verbose=None, ckey=None, cert=None, capath=None):
     "predict API get predictions from TFaaS server"
     url = host + '/image'
@@ -344,6 +376,8 @@ def main():
         res = models(opts.url, opts.verbose, opts.ckey, opts.cert, opts.capath)
     elif opts.predict:
         res = predict(opts.url, opts.predict, opts.model, opts.verbose, opts.ckey, opts.cert, opts.capath)
+    elif opts.batch:
+        res = predictBatch(opts.url, opts.batch, opts.model, opts.verbose, opts.ckey, opts.cert, opts.capath)
     elif opts.image:
         res = predictImage(opts.url, opts.image, opts.model, opts.verbose, opts.ckey, opts.cert, opts.capath)
     if res: